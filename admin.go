@@ -0,0 +1,471 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI is a module that serves usage endpoints on Caddy's admin API.
+// Access control is inherited from the admin endpoint's own configuration.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.usage",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes served by the usage module
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/usage/assets",
+			Handler: caddy.AdminHandlerFunc(a.handleAssets),
+		},
+		{
+			Pattern: "/usage/memory",
+			Handler: caddy.AdminHandlerFunc(a.handleMemory),
+		},
+		{
+			Pattern: "/usage/metrics",
+			Handler: caddy.AdminHandlerFunc(a.handleMetrics),
+		},
+		{
+			Pattern: "/usage/long_running",
+			Handler: caddy.AdminHandlerFunc(a.handleLongRunning),
+		},
+		{
+			Pattern: "/usage/top",
+			Handler: caddy.AdminHandlerFunc(a.handleTop),
+		},
+		{
+			Pattern: "/usage/duplicates",
+			Handler: caddy.AdminHandlerFunc(a.handleDuplicates),
+		},
+		{
+			Pattern: "/usage/legacy_clients",
+			Handler: caddy.AdminHandlerFunc(a.handleLegacyClients),
+		},
+		{
+			Pattern: "/usage/feed",
+			Handler: caddy.AdminHandlerFunc(a.handleFeed),
+		},
+		{
+			Pattern: "/usage/rollups",
+			Handler: caddy.AdminHandlerFunc(a.handleRollups),
+		},
+		{
+			Pattern: "/usage/audit",
+			Handler: caddy.AdminHandlerFunc(a.handleAudit),
+		},
+		{
+			Pattern: "/usage/reset",
+			Handler: caddy.AdminHandlerFunc(a.handleReset),
+		},
+		{
+			Pattern: "/usage/data",
+			Handler: caddy.AdminHandlerFunc(a.handleData),
+		},
+	}
+}
+
+// handleAssets serves the dashboard and alert bundle for a profile.
+// The optional asset query parameter selects just the dashboard or the
+// alert rules, ready for direct import into Grafana or Prometheus.
+func (adminAPI) handleAssets(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	profile := r.URL.Query().Get("profile")
+	bundle, ok := profileAssets(profile)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown profile '%s'", profile),
+		}
+	}
+
+	var body any
+	switch asset := r.URL.Query().Get("asset"); asset {
+	case "":
+		body = bundle
+	case "dashboard":
+		body = bundle.Dashboard
+	case "alerts":
+		body = bundle.Alerts
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("unknown asset '%s', expected dashboard or alerts", asset),
+		}
+	}
+
+	return writeJSON(w, body)
+}
+
+// handleLongRunning lists in-flight requests that have exceeded the
+// long_running threshold of their usage handler, longest-running first
+func (adminAPI) handleLongRunning(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	return writeJSON(w, inflight.longRunning(now()))
+}
+
+// handleData reports the reference datasets in use, where they were loaded
+// from, and their versions and ages
+func (adminAPI) handleData(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	return writeJSON(w, loadedData().status(now()))
+}
+
+// handleMemory reports the estimated memory held by the usage metrics and
+// the module's shared state, by component. The namespace query parameter
+// selects a namespace's metrics instead of the shared ones.
+func (adminAPI) handleMemory(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	um, err := metricsOfNamespace(r.URL.Query().Get("namespace"))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, um.memoryUsage())
+}
+
+// handleMetrics serves the usage metrics alone, without the rest of Caddy's
+// registry. The format is negotiated between the Prometheus text format,
+// OpenMetrics and a compact JSON format, see negotiateFormat, and the
+// response is compressed with zstd or gzip when the client accepts them.
+// The name[] and match[] query parameters select a subset of the series,
+// see parseSeriesFilter.
+func (adminAPI) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	format, err := negotiateFormat(r)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	filter, err := parseSeriesFilter(r.URL.Query())
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	// Count the scrape before gathering, so that it is part of the response
+	if globalUsageMetrics != nil {
+		globalUsageMetrics.recordScrape(r, now())
+	}
+
+	gatherer, err := usageGatherer()
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	families, err := gatherer.Gather()
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	cw, finish := compressResponse(w, negotiateEncoding(r))
+	err = writeMetrics(cw, filter.apply(families), format)
+	if finishErr := finish(); err == nil {
+		err = finishErr
+	}
+	return err
+}
+
+// handleTop lists the most frequent paths, client IPs and User-Agents
+// tracked by handlers with top_k, and the paths with the most server
+// errors. The dimension query parameter selects one of paths, clients,
+// user_agents and errors, n limits the number of values listed, and
+// namespace selects a namespace's metrics.
+func (adminAPI) handleTop(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	query := r.URL.Query()
+	n := 0
+	if v := query.Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid n '%s': must be a positive integer", v),
+			}
+		}
+	}
+
+	um, err := metricsOfNamespace(query.Get("namespace"))
+	if err != nil {
+		return err
+	}
+
+	trackers := um.topKTrackers()
+	dimension := query.Get("dimension")
+	switch dimension {
+	case "":
+	case topErrors:
+		trackers = nil
+	default:
+		tracker, ok := trackers[dimension]
+		if !ok {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("unknown dimension '%s', expected paths, clients, user_agents or errors", dimension),
+			}
+		}
+		trackers = map[string]*topKTracker{dimension: tracker}
+	}
+
+	top := make(map[string][]topKEntry, len(trackers)+1)
+	for dimension, tracker := range trackers {
+		top[dimension] = tracker.top(n)
+	}
+	if dimension == "" || dimension == topErrors {
+		top[topErrors] = um.errorHotspots(n)
+	}
+	return writeJSON(w, top)
+}
+
+// handleDuplicates lists the response bodies served by several URLs of a
+// host, found by handlers with content_hash, those served by the most URLs
+// first. The host query parameter selects a host, as recorded in the host
+// label, and namespace selects a namespace's metrics.
+func (adminAPI) handleDuplicates(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	query := r.URL.Query()
+	um, err := metricsOfNamespace(query.Get("namespace"))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, um.contents.duplicates(query.Get("host")))
+}
+
+// handleLegacyClients reports the TLS versions, HTTP versions and legacy
+// User-Agent families of each host's clients, tracked by handlers with
+// legacy_clients. The host query parameter selects a host, as recorded in
+// the host label.
+func (adminAPI) handleLegacyClients(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	return writeJSON(w, legacyClientReports(r.URL.Query().Get("host"), now()))
+}
+
+// handleFeed streams a live feed of requests handled by usage handlers as
+// Server-Sent Events, until the client disconnects. The host query
+// parameter selects a host, as recorded in the host label, and sample_rate
+// the fraction of requests streamed.
+func (adminAPI) handleFeed(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	host, sampleRate, err := parseFeedQuery(r.URL.Query())
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("streaming not supported"),
+		}
+	}
+
+	sub := subscribeFeed(host, sampleRate)
+	defer unsubscribeFeed(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// The client is gone once it disconnects; stop streaming quietly
+	_ = streamFeed(w, flusher, sub, r.Context().Done())
+	return nil
+}
+
+// handleRollups reports the daily or monthly usage rollups of each host and
+// API key aggregated by handlers with rollups. The granularity, by, tenant,
+// from and to query parameters select the rollups, see parseRollupQuery,
+// and format=csv exports them as CSV rather than JSON.
+func (adminAPI) handleRollups(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	query := r.URL.Query()
+	q, err := parseRollupQuery(query)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+	rollups := usageRollups(q)
+
+	switch format := query.Get("format"); format {
+	case "", "json":
+		return writeJSON(w, rollups)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		return writeRollupsCSV(w, rollups)
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("format must be json or csv, got '%s'", format),
+		}
+	}
+}
+
+// handleAudit lists the latest discrepancies between recorded values and
+// access log entries found by handlers with audit, most recent first
+func (adminAPI) handleAudit(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	return writeJSON(w, auditDiscrepancies())
+}
+
+// metricsOfNamespace returns the usage metrics of a namespace, the shared
+// metrics by default
+func metricsOfNamespace(ns string) (*usageMetrics, error) {
+	um := globalUsageMetrics
+	if ns != "" && ns != defaultMetricsNamespace {
+		if um = loadedNamespaceMetrics(ns); um == nil {
+			return nil, caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("unknown namespace '%s'", ns),
+			}
+		}
+	}
+	if um == nil {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusServiceUnavailable,
+			Err:        fmt.Errorf("usage metrics not initialized"),
+		}
+	}
+	return um, nil
+}
+
+// handleReset clears the usage metrics, or only the one named by the
+// metric query parameter, such as after a load test. Since it destroys
+// data, on top of the admin endpoint's access control it requires a
+// bearer token configured with reset_token, and is refused without one.
+func (adminAPI) handleReset(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	if !resetAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="usage reset"`)
+		return caddy.APIError{
+			HTTPStatus: http.StatusUnauthorized,
+			Err:        fmt.Errorf("resetting usage metrics requires a bearer token configured with reset_token"),
+		}
+	}
+
+	names, err := resetMetrics(r.URL.Query().Get("metric"))
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+	if len(names) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusServiceUnavailable,
+			Err:        fmt.Errorf("usage metrics not initialized"),
+		}
+	}
+
+	return writeJSON(w, map[string][]string{"reset": names})
+}
+
+// writeJSON writes v as an indented JSON response
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
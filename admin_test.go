@@ -0,0 +1,133 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// serveAdmin invokes the admin route matching pattern with the given request
+func serveAdmin(t *testing.T, pattern string, req *http.Request) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+
+	for _, route := range (adminAPI{}).Routes() {
+		if route.Pattern == pattern {
+			w := httptest.NewRecorder()
+			return w, route.Handler.ServeHTTP(w, req)
+		}
+	}
+
+	t.Fatalf("No admin route registered for %s", pattern)
+	return nil, nil
+}
+
+// apiErrorStatus returns the HTTP status of an admin API error
+func apiErrorStatus(err error) int {
+	var apiErr caddy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatus
+	}
+	return 0
+}
+
+// TestAdminModule verifies the admin module registration
+func TestAdminModule(t *testing.T) {
+	info := adminAPI{}.CaddyModule()
+	if info.ID != "admin.api.usage" {
+		t.Errorf("Expected module ID 'admin.api.usage', got '%s'", info.ID)
+	}
+	if _, ok := info.New().(*adminAPI); !ok {
+		t.Error("New() should return an *adminAPI instance")
+	}
+}
+
+// TestProfileAssetsCoverage tests that every profile ships with assets
+func TestProfileAssetsCoverage(t *testing.T) {
+	for _, name := range profileNames() {
+		spec, ok := profileAssetSpecs[name]
+		if !ok {
+			t.Errorf("Profile %s has no bundled assets", name)
+			continue
+		}
+		if len(spec.panels) == 0 || len(spec.alerts) == 0 {
+			t.Errorf("Profile %s should bundle both panels and alerts", name)
+		}
+	}
+}
+
+// TestHandleAssets tests the /usage/assets admin endpoint
+func TestHandleAssets(t *testing.T) {
+	req := httptest.NewRequest("GET", "/usage/assets?profile=api", nil)
+	w, err := serveAdmin(t, "/usage/assets", req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var bundle struct {
+		Profile   string `json:"profile"`
+		Dashboard struct {
+			UID    string           `json:"uid"`
+			Panels []map[string]any `json:"panels"`
+		} `json:"dashboard"`
+		Alerts struct {
+			Groups []struct {
+				Rules []map[string]any `json:"rules"`
+			} `json:"groups"`
+		} `json:"alerts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &bundle); err != nil {
+		t.Fatalf("Response is not valid JSON: %v", err)
+	}
+
+	if bundle.Profile != "api" || bundle.Dashboard.UID != "caddy-usage-api" {
+		t.Errorf("Unexpected bundle identity: %s / %s", bundle.Profile, bundle.Dashboard.UID)
+	}
+	if len(bundle.Dashboard.Panels) != len(profileAssetSpecs["api"].panels) {
+		t.Errorf("Expected %d panels, got %d", len(profileAssetSpecs["api"].panels), len(bundle.Dashboard.Panels))
+	}
+	if len(bundle.Alerts.Groups) != 1 || len(bundle.Alerts.Groups[0].Rules) != len(profileAssetSpecs["api"].alerts) {
+		t.Error("Expected one alert group containing the profile's alerts")
+	}
+
+	// A single asset can be requested for direct import
+	req = httptest.NewRequest("GET", "/usage/assets?profile=cdn&asset=alerts", nil)
+	w, err = serveAdmin(t, "/usage/assets", req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var alerts map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &alerts); err != nil {
+		t.Fatalf("Response is not valid JSON: %v", err)
+	}
+	if _, ok := alerts["groups"]; !ok {
+		t.Error("Expected a Prometheus rule file with groups")
+	}
+}
+
+// TestHandleAssetsErrors tests error responses of the /usage/assets endpoint
+func TestHandleAssetsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		expected int
+	}{
+		{"wrong method", "POST", "/usage/assets?profile=api", http.StatusMethodNotAllowed},
+		{"missing profile", "GET", "/usage/assets", http.StatusNotFound},
+		{"unknown profile", "GET", "/usage/assets?profile=enterprise", http.StatusNotFound},
+		{"unknown asset", "GET", "/usage/assets?profile=api&asset=slides", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := serveAdmin(t, "/usage/assets", httptest.NewRequest(tt.method, tt.url, nil))
+			if got := apiErrorStatus(err); got != tt.expected {
+				t.Errorf("Expected status %d, got %d (%v)", tt.expected, got, err)
+			}
+		})
+	}
+}
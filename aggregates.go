@@ -0,0 +1,167 @@
+package caddyusage
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// aggregateWindow is the window of the pre-aggregated series, matching
+// the common rate5m recording rules
+const aggregateWindow = 5 * time.Minute
+
+// aggregateSlot holds one host's requests in one time slice of the window
+type aggregateSlot struct {
+	epoch       int64
+	requests    uint64
+	errors      uint64
+	durationSum float64
+}
+
+// hostAggregates keeps per-host request, error and latency totals over a
+// sliding window, kept as time slices like windowedSketch, to derive the
+// series recording rules usually compute
+type hostAggregates struct {
+	mu        sync.Mutex
+	slotWidth time.Duration
+	hosts     map[string]*[windowSlots]aggregateSlot
+}
+
+// newHostAggregates creates per-host aggregates over aggregateWindow
+func newHostAggregates() *hostAggregates {
+	return &hostAggregates{
+		slotWidth: aggregateWindow / windowSlots,
+		hosts:     make(map[string]*[windowSlots]aggregateSlot),
+	}
+}
+
+// reset discards all aggregated requests
+func (ha *hostAggregates) reset() {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+
+	ha.hosts = make(map[string]*[windowSlots]aggregateSlot)
+}
+
+// add aggregates a request to host, which failed with a 5xx if failed
+func (ha *hostAggregates) add(host string, failed bool, duration float64, now time.Time) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+
+	slots, ok := ha.hosts[host]
+	if !ok {
+		slots = new([windowSlots]aggregateSlot)
+		ha.hosts[host] = slots
+	}
+
+	epoch := now.UnixNano() / int64(ha.slotWidth)
+	slot := &slots[epoch%windowSlots]
+	if slot.epoch != epoch {
+		*slot = aggregateSlot{epoch: epoch}
+	}
+	slot.requests++
+	if failed {
+		slot.errors++
+	}
+	slot.durationSum += duration
+}
+
+// hostAggregate is a host's totals within the window
+type hostAggregate struct {
+	requests    uint64
+	errors      uint64
+	durationSum float64
+}
+
+// window returns each host's totals within the window ending at now, and
+// the length of time they cover. Hosts without requests in the window are
+// dropped.
+func (ha *hostAggregates) window(now time.Time) (map[string]hostAggregate, time.Duration) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+
+	current := now.UnixNano() / int64(ha.slotWidth)
+	totals := make(map[string]hostAggregate, len(ha.hosts))
+	for host, slots := range ha.hosts {
+		var total hostAggregate
+		for _, slot := range slots {
+			if slot.epoch > current-windowSlots && slot.epoch <= current {
+				total.requests += slot.requests
+				total.errors += slot.errors
+				total.durationSum += slot.durationSum
+			}
+		}
+		if total.requests == 0 {
+			delete(ha.hosts, host)
+			continue
+		}
+		totals[host] = total
+	}
+
+	// The window is made of full past slices and the current, partial one
+	elapsed := time.Duration(now.UnixNano() - current*int64(ha.slotWidth))
+	return totals, (windowSlots-1)*ha.slotWidth + elapsed
+}
+
+// aggregatesCollector exports per-host series equivalent to common
+// recording rules, named like them, computed at scrape time
+type aggregatesCollector struct {
+	requestRate  *prometheus.Desc
+	errorRatio   *prometheus.Desc
+	meanDuration *prometheus.Desc
+	aggregates   *hostAggregates
+}
+
+// newAggregatesCollector returns a collector of the pre-aggregated series
+// of the metrics named <ns>_usage_*
+func newAggregatesCollector(ns string, aggregates *hostAggregates) aggregatesCollector {
+	prefix := "host:" + ns + "_usage_"
+	return aggregatesCollector{
+		requestRate: prometheus.NewDesc(
+			prefix+"requests:rate5m",
+			"Per-host request rate per second over the last 5 minutes",
+			[]string{"host"}, nil,
+		),
+		errorRatio: prometheus.NewDesc(
+			prefix+"errors:ratio_rate5m",
+			"Per-host fraction of requests failing with a 5xx status over the last 5 minutes",
+			[]string{"host"}, nil,
+		),
+		meanDuration: prometheus.NewDesc(
+			prefix+"request_duration_seconds:mean5m",
+			"Per-host mean request duration in seconds over the last 5 minutes",
+			[]string{"host"}, nil,
+		),
+		aggregates: aggregates,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c aggregatesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.requestRate
+	ch <- c.errorRatio
+	ch <- c.meanDuration
+}
+
+// Collect implements prometheus.Collector
+func (c aggregatesCollector) Collect(ch chan<- prometheus.Metric) {
+	totals, covered := c.aggregates.window(now())
+	for host, total := range totals {
+		requests := float64(total.requests)
+		ch <- prometheus.MustNewConstMetric(c.requestRate, prometheus.GaugeValue, requests/covered.Seconds(), host)
+		ch <- prometheus.MustNewConstMetric(c.errorRatio, prometheus.GaugeValue, float64(total.errors)/requests, host)
+		ch <- prometheus.MustNewConstMetric(c.meanDuration, prometheus.GaugeValue, total.durationSum/requests, host)
+	}
+}
+
+// collectAggregateMetrics adds a request to its host's aggregates
+func (uc *UsageCollector) collectAggregateMetrics(um *usageMetrics, host string, status int, duration float64, seen time.Time) {
+	um.aggregates.add(host, status >= http.StatusInternalServerError, duration, seen)
+}
+
+// Interface guards
+var (
+	_ prometheus.Collector = aggregatesCollector{}
+)
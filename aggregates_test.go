@@ -0,0 +1,84 @@
+package caddyusage
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestHostAggregates tests per-host totals over the sliding window
+func TestHostAggregates(t *testing.T) {
+	start := time.Unix(0, 0)
+	ha := newHostAggregates()
+
+	ha.add("example.com", false, 0.25, start)
+	ha.add("example.com", true, 0.5, start)
+	ha.add("api.example.com", false, 0.5, start)
+
+	totals, covered := ha.window(start.Add(2 * time.Minute))
+	if got := totals["example.com"]; got.requests != 2 || got.errors != 1 || got.durationSum != 0.75 {
+		t.Errorf("Unexpected totals for example.com: %+v", got)
+	}
+	if got := totals["api.example.com"]; got.requests != 1 || got.errors != 0 {
+		t.Errorf("Unexpected totals for api.example.com: %+v", got)
+	}
+	// Nine full past slices, and none of the current one
+	if expected := 9 * 30 * time.Second; covered != expected {
+		t.Errorf("Expected the window to cover %v, got %v", expected, covered)
+	}
+
+	// Hosts without requests in the window are dropped
+	ha.add("example.com", false, 0.1, start.Add(4*time.Minute))
+	totals, _ = ha.window(start.Add(6 * time.Minute))
+	if len(totals) != 1 || totals["example.com"].requests != 1 {
+		t.Errorf("Expected only the recent example.com request, got %+v", totals)
+	}
+	if _, ok := ha.hosts["api.example.com"]; ok {
+		t.Error("Expected api.example.com to be dropped")
+	}
+}
+
+// TestAggregateMetrics tests the pre-aggregated per-host series
+func TestAggregateMetrics(t *testing.T) {
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	uc.Aggregates = true
+
+	for _, status := range []int{200, 200, 200, 500} {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(status)
+		uc.collectMetrics(rec, req, now(), nil)
+	}
+
+	labels := usagetest.Labels{"host": "example.com"}
+	usagetest.AssertValue(t, registry, "host:caddy_usage_errors:ratio_rate5m", labels, 0.25)
+	usagetest.AssertCount(t, registry, "host:caddy_usage_requests:rate5m", labels, 1)
+	usagetest.AssertCount(t, registry, "host:caddy_usage_request_duration_seconds:mean5m", labels, 1)
+
+	// Aged out of the window
+	clock.Advance(10 * time.Minute)
+	usagetest.AssertAbsent(t, registry, "host:caddy_usage_requests:rate5m", labels)
+}
+
+// TestUnmarshalAggregates tests parsing of the aggregates option
+func TestUnmarshalAggregates(t *testing.T) {
+	var uc UsageCollector
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser("usage {\n aggregates\n}")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !uc.Aggregates {
+		t.Error("Expected aggregates to be enabled")
+	}
+
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser("usage {\n aggregates yes\n}")); err == nil {
+		t.Error("Expected an error but got none")
+	}
+}
@@ -0,0 +1,66 @@
+package caddyusage
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Protocol anomaly types
+const (
+	anomalyLengthConflict     = "content_length_transfer_encoding"
+	anomalyMultipleLength     = "multiple_content_length"
+	anomalyAbsoluteForm       = "absolute_form"
+	anomalyOversizedHeaders   = "oversized_headers"
+	anomalyTransferEncodingH2 = "h2_transfer_encoding"
+)
+
+// oversizedHeaderBytes is the header block size above which a request is
+// counted as having oversized headers. Browsers rarely send more than a
+// few KiB, while request smuggling and header-stuffing attempts often do.
+const oversizedHeaderBytes = 16 << 10
+
+// protocolAnomalies returns the protocol anomalies a request exhibits.
+// Go's HTTP server already rejects the most dangerous framing, but still
+// passes on requests that are worth watching for as smuggling or probing
+// indicators.
+func protocolAnomalies(r *http.Request) []string {
+	var anomalies []string
+
+	if len(r.TransferEncoding) > 0 || r.Header.Get("Transfer-Encoding") != "" {
+		if r.ProtoMajor >= 2 {
+			anomalies = append(anomalies, anomalyTransferEncodingH2)
+		} else if r.Header.Get("Content-Length") != "" {
+			anomalies = append(anomalies, anomalyLengthConflict)
+		}
+	}
+
+	if len(r.Header.Values("Content-Length")) > 1 {
+		anomalies = append(anomalies, anomalyMultipleLength)
+	}
+
+	// Absolute-form targets are only expected from clients talking to a
+	// forward proxy, which Caddy is not by default
+	if r.Method != http.MethodConnect && (strings.HasPrefix(r.RequestURI, "http://") || strings.HasPrefix(r.RequestURI, "https://")) {
+		anomalies = append(anomalies, anomalyAbsoluteForm)
+	}
+
+	size := 0
+	for name, values := range r.Header {
+		for _, value := range values {
+			// Account for the ": " separator and CRLF of each line
+			size += len(name) + len(value) + 4
+		}
+	}
+	if size > oversizedHeaderBytes {
+		anomalies = append(anomalies, anomalyOversizedHeaders)
+	}
+
+	return anomalies
+}
+
+// collectAnomalyMetrics records the protocol anomalies of a request
+func (uc *UsageCollector) collectAnomalyMetrics(um *usageMetrics, r *http.Request) {
+	for _, anomaly := range protocolAnomalies(r) {
+		um.protocolAnomalies.WithLabelValues(anomaly).Inc()
+	}
+}
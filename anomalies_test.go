@@ -0,0 +1,73 @@
+package caddyusage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestProtocolAnomalies tests detection of each anomaly type
+func TestProtocolAnomalies(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(r *http.Request)
+		expected []string
+	}{
+		{"clean request", func(r *http.Request) {}, nil},
+		{"length and chunked", func(r *http.Request) {
+			r.TransferEncoding = []string{"chunked"}
+			r.Header.Set("Content-Length", "10")
+		}, []string{anomalyLengthConflict}},
+		{"transfer encoding over h2", func(r *http.Request) {
+			r.ProtoMajor = 2
+			r.Header.Set("Transfer-Encoding", "chunked")
+		}, []string{anomalyTransferEncodingH2}},
+		{"multiple content lengths", func(r *http.Request) {
+			r.Header["Content-Length"] = []string{"10", "10"}
+		}, []string{anomalyMultipleLength}},
+		{"absolute form", func(r *http.Request) {
+			r.RequestURI = "http://example.com/admin"
+		}, []string{anomalyAbsoluteForm}},
+		{"absolute form connect", func(r *http.Request) {
+			r.Method = "CONNECT"
+			r.RequestURI = "https://example.com:443"
+		}, nil},
+		{"oversized headers", func(r *http.Request) {
+			r.Header.Set("X-Padding", strings.Repeat("a", oversizedHeaderBytes))
+		}, []string{anomalyOversizedHeaders}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			tt.setup(req)
+
+			if got := protocolAnomalies(req); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestProtocolAnomalyMetrics tests that anomalies are counted by type
+func TestProtocolAnomalyMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	uc.collectAnomalyMetrics(globalUsageMetrics, req)
+	if n := testutil.CollectAndCount(globalUsageMetrics.protocolAnomalies); n != 0 {
+		t.Errorf("Expected no anomaly series, got %d", n)
+	}
+
+	req.RequestURI = "http://internal.example.com/"
+	uc.collectAnomalyMetrics(globalUsageMetrics, req)
+
+	if got := testutil.ToFloat64(globalUsageMetrics.protocolAnomalies.WithLabelValues(anomalyAbsoluteForm)); got != 1 {
+		t.Errorf("Expected 1 absolute-form request, got %v", got)
+	}
+}
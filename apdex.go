@@ -0,0 +1,400 @@
+package caddyusage
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Apdex zones of a request
+const (
+	apdexSatisfied  = "satisfied"
+	apdexTolerating = "tolerating"
+	apdexFrustrated = "frustrated"
+)
+
+// ApdexTarget sets the Apdex threshold of a group of routes. Requests
+// served within the threshold satisfy users, those within four times the
+// threshold are tolerated, and slower or failed (5xx) requests frustrate.
+// With an objective, the group is also a service level objective (SLO),
+// whose compliance is the share of satisfied requests.
+type ApdexTarget struct {
+	// Group names the routes in the group label.
+	Group string `json:"group"`
+
+	// Threshold is the response time within which users are satisfied.
+	Threshold caddy.Duration `json:"threshold"`
+
+	// Paths lists the request paths of the group as globs, where * also
+	// matches /, or regular expressions when starting with ^. A target
+	// without paths matches every request.
+	Paths []string `json:"paths,omitempty"`
+
+	// Hosts lists the request hosts of the group as case-insensitive
+	// globs or regular expressions when starting with ^. A target without
+	// hosts matches every host.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Objective is the share of requests that should be satisfied, like
+	// 0.99, exported by the slo_objective gauge to compute burn rates.
+	Objective float64 `json:"objective,omitempty"`
+}
+
+// apdexTarget is an ApdexTarget with its paths and hosts compiled
+type apdexTarget struct {
+	group     string
+	threshold time.Duration
+	objective float64
+	paths     []*regexp.Regexp
+	hosts     []*regexp.Regexp
+}
+
+// compileApdexTargets validates and compiles Apdex targets
+func compileApdexTargets(targets []ApdexTarget) ([]apdexTarget, error) {
+	compiled := make([]apdexTarget, 0, len(targets))
+	for i, target := range targets {
+		if target.Group == "" {
+			return nil, fmt.Errorf("apdex target %d: group is required", i)
+		}
+		if target.Threshold <= 0 {
+			return nil, fmt.Errorf("apdex target %s: threshold must be positive", target.Group)
+		}
+		if target.Objective < 0 || target.Objective >= 1 {
+			return nil, fmt.Errorf("apdex target %s: objective must be between 0 and 1", target.Group)
+		}
+		paths, err := compilePatterns(target.Paths, false)
+		if err != nil {
+			return nil, fmt.Errorf("apdex target %s: %v", target.Group, err)
+		}
+		hosts, err := compilePatterns(target.Hosts, true)
+		if err != nil {
+			return nil, fmt.Errorf("apdex target %s: %v", target.Group, err)
+		}
+		compiled = append(compiled, apdexTarget{
+			group:     target.Group,
+			threshold: time.Duration(target.Threshold),
+			objective: target.Objective,
+			paths:     paths,
+			hosts:     hosts,
+		})
+	}
+	return compiled, nil
+}
+
+// matches reports whether a request belongs to the target's group
+func (t apdexTarget) matches(r *http.Request) bool {
+	return matchesAny(t.hosts, hostWithoutPort(r.Host)) && matchesAny(t.paths, r.URL.Path)
+}
+
+// zone returns the Apdex zone of a request served with status in elapsed
+func (t apdexTarget) zone(status int, elapsed time.Duration) string {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return apdexFrustrated
+	case elapsed <= t.threshold:
+		return apdexSatisfied
+	case elapsed <= 4*t.threshold:
+		return apdexTolerating
+	default:
+		return apdexFrustrated
+	}
+}
+
+// apdexSlot counts the requests of a group in one time slice of the window
+type apdexSlot struct {
+	epoch      int64
+	satisfied  uint64
+	tolerating uint64
+	total      uint64
+}
+
+// apdexWindow computes Apdex scores per group over a sliding window, kept
+// as time slices like windowedSketch
+type apdexWindow struct {
+	mu         sync.Mutex
+	slotWidth  time.Duration
+	groups     map[string]*[windowSlots]apdexSlot
+	objectives map[string]float64
+}
+
+// newApdexWindow creates an Apdex window covering the given window
+func newApdexWindow(window time.Duration) *apdexWindow {
+	aw := &apdexWindow{}
+	aw.setWindow(window)
+	return aw
+}
+
+// setWindow changes the window length, discarding all counted requests if
+// it differs from the current one
+func (aw *apdexWindow) setWindow(window time.Duration) {
+	slotWidth := window / windowSlots
+	if slotWidth <= 0 {
+		slotWidth = 1
+	}
+
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	if slotWidth == aw.slotWidth {
+		return
+	}
+	aw.slotWidth = slotWidth
+	aw.groups = make(map[string]*[windowSlots]apdexSlot)
+}
+
+// reset discards all counted requests
+func (aw *apdexWindow) reset() {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	aw.groups = make(map[string]*[windowSlots]apdexSlot)
+}
+
+// setObjectives sets the SLO objectives of the groups of targets, replacing
+// those set before
+func (aw *apdexWindow) setObjectives(targets []apdexTarget) {
+	objectives := make(map[string]float64)
+	for _, target := range targets {
+		if target.objective > 0 {
+			objectives[target.group] = target.objective
+		}
+	}
+
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	aw.objectives = objectives
+}
+
+// add counts a request of group in zone at the given time
+func (aw *apdexWindow) add(group, zone string, now time.Time) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	slots, ok := aw.groups[group]
+	if !ok {
+		slots = new([windowSlots]apdexSlot)
+		aw.groups[group] = slots
+	}
+
+	epoch := now.UnixNano() / int64(aw.slotWidth)
+	slot := &slots[epoch%windowSlots]
+	if slot.epoch != epoch {
+		*slot = apdexSlot{epoch: epoch}
+	}
+	switch zone {
+	case apdexSatisfied:
+		slot.satisfied++
+	case apdexTolerating:
+		slot.tolerating++
+	}
+	slot.total++
+}
+
+// apdexScore is the Apdex score and SLO compliance of a group
+type apdexScore struct {
+	apdex      float64
+	compliance float64
+}
+
+// scores returns the scores of each group with requests within the window
+// ending at now
+func (aw *apdexWindow) scores(now time.Time) map[string]apdexScore {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	scores := make(map[string]apdexScore, len(aw.groups))
+	current := now.UnixNano() / int64(aw.slotWidth)
+	for group, slots := range aw.groups {
+		var satisfied, tolerating, total uint64
+		for _, slot := range slots {
+			if slot.epoch > current-windowSlots && slot.epoch <= current {
+				satisfied += slot.satisfied
+				tolerating += slot.tolerating
+				total += slot.total
+			}
+		}
+		if total > 0 {
+			scores[group] = apdexScore{
+				apdex:      (float64(satisfied) + float64(tolerating)/2) / float64(total),
+				compliance: float64(satisfied) / float64(total),
+			}
+		}
+	}
+	return scores
+}
+
+// objectivesByGroup returns the SLO objective of each group that has one
+func (aw *apdexWindow) objectivesByGroup() map[string]float64 {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	return maps.Clone(aw.objectives)
+}
+
+// apdexCollector exports the Apdex scores and SLO compliance of a window,
+// computed at scrape time
+type apdexCollector struct {
+	desc           *prometheus.Desc
+	complianceDesc *prometheus.Desc
+	objectiveDesc  *prometheus.Desc
+	window         *apdexWindow
+}
+
+// newApdexCollector returns a collector of the apdex_score,
+// slo_compliance_ratio and slo_objective gauges
+func newApdexCollector(ns string, window *apdexWindow) apdexCollector {
+	return apdexCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(ns, "usage", "apdex_score"),
+			"Apdex score of each route group within the active window",
+			[]string{"group"}, nil,
+		),
+		complianceDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(ns, "usage", "slo_compliance_ratio"),
+			"Share of satisfied requests of each route group within the active window",
+			[]string{"group"}, nil,
+		),
+		objectiveDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(ns, "usage", "slo_objective"),
+			"Configured share of requests of each route group that should be satisfied",
+			[]string{"group"}, nil,
+		),
+		window: window,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c apdexCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+	ch <- c.complianceDesc
+	ch <- c.objectiveDesc
+}
+
+// Collect implements prometheus.Collector
+func (c apdexCollector) Collect(ch chan<- prometheus.Metric) {
+	for group, score := range c.window.scores(now()) {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, score.apdex, group)
+		ch <- prometheus.MustNewConstMetric(c.complianceDesc, prometheus.GaugeValue, score.compliance, group)
+	}
+	for group, objective := range c.window.objectivesByGroup() {
+		ch <- prometheus.MustNewConstMetric(c.objectiveDesc, prometheus.GaugeValue, objective, group)
+	}
+}
+
+// collectApdexMetrics counts a request towards the Apdex score of the
+// first target matching its host and path
+func (uc *UsageCollector) collectApdexMetrics(um *usageMetrics, r *http.Request, status int, elapsed time.Duration) {
+	for _, target := range uc.apdexTargets {
+		if !target.matches(r) {
+			continue
+		}
+		zone := target.zone(status, elapsed)
+		um.apdexRequests.WithLabelValues(target.group, zone).Inc()
+		um.apdex.add(target.group, zone, now())
+		return
+	}
+}
+
+// unmarshalApdexTarget parses an apdex directive:
+//
+//	apdex <group> <threshold> [<paths...>]
+func unmarshalApdexTarget(d *caddyfile.Dispenser) (ApdexTarget, error) {
+	var target ApdexTarget
+	var threshold string
+	if !d.Args(&target.Group, &threshold) {
+		return target, d.ArgErr()
+	}
+	dur, err := caddy.ParseDuration(threshold)
+	if err != nil {
+		return target, d.Errf("invalid apdex threshold '%s': %v", threshold, err)
+	}
+	target.Threshold = caddy.Duration(dur)
+	target.Paths = d.RemainingArgs()
+	return target, nil
+}
+
+// unmarshalSLO parses an slo block into an Apdex target with an objective:
+//
+//	slo <group> {
+//	    latency <duration>
+//	    objective <ratio>
+//	    hosts <patterns...>
+//	    paths <patterns...>
+//	}
+func unmarshalSLO(d *caddyfile.Dispenser) (ApdexTarget, error) {
+	var target ApdexTarget
+	if !d.NextArg() {
+		return target, d.ArgErr()
+	}
+	target.Group = d.Val()
+	if d.NextArg() {
+		return target, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "latency":
+			if !d.NextArg() {
+				return target, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur <= 0 {
+				return target, d.Errf("invalid slo latency '%s'", d.Val())
+			}
+			target.Threshold = caddy.Duration(dur)
+			if d.NextArg() {
+				return target, d.ArgErr()
+			}
+
+		case "objective":
+			if !d.NextArg() {
+				return target, d.ArgErr()
+			}
+			objective, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil || objective <= 0 || objective >= 1 {
+				return target, d.Errf("invalid slo objective '%s': must be between 0 and 1", d.Val())
+			}
+			target.Objective = objective
+			if d.NextArg() {
+				return target, d.ArgErr()
+			}
+
+		case "hosts":
+			hosts := d.RemainingArgs()
+			if len(hosts) == 0 {
+				return target, d.ArgErr()
+			}
+			target.Hosts = append(target.Hosts, hosts...)
+
+		case "paths":
+			paths := d.RemainingArgs()
+			if len(paths) == 0 {
+				return target, d.ArgErr()
+			}
+			target.Paths = append(target.Paths, paths...)
+
+		default:
+			return target, d.Errf("unrecognized slo option '%s'", option)
+		}
+	}
+
+	if target.Threshold == 0 {
+		return target, d.Errf("slo %s requires a latency", target.Group)
+	}
+	return target, nil
+}
+
+// Interface guards
+var (
+	_ prometheus.Collector = apdexCollector{}
+)
@@ -0,0 +1,204 @@
+package caddyusage
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestApdexZone tests placing requests in Apdex zones
+func TestApdexZone(t *testing.T) {
+	target := apdexTarget{group: "api", threshold: 100 * time.Millisecond}
+
+	tests := []struct {
+		name     string
+		status   int
+		elapsed  time.Duration
+		expected string
+	}{
+		{"fast", 200, 50 * time.Millisecond, apdexSatisfied},
+		{"at threshold", 200, 100 * time.Millisecond, apdexSatisfied},
+		{"slow", 200, 300 * time.Millisecond, apdexTolerating},
+		{"too slow", 200, 500 * time.Millisecond, apdexFrustrated},
+		{"fast client error", 404, 10 * time.Millisecond, apdexSatisfied},
+		{"fast server error", 502, 10 * time.Millisecond, apdexFrustrated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := target.zone(tt.status, tt.elapsed); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestApdexWindow tests that scores only cover the window
+func TestApdexWindow(t *testing.T) {
+	aw := newApdexWindow(10 * time.Minute)
+	start := time.Unix(1700000000, 0)
+
+	aw.add("api", apdexFrustrated, start)
+	aw.add("api", apdexSatisfied, start.Add(time.Minute))
+	if got := aw.scores(start.Add(time.Minute))["api"].apdex; got != 0.5 {
+		t.Errorf("Expected score 0.5, got %v", got)
+	}
+
+	later := start.Add(20 * time.Minute)
+	aw.add("api", apdexSatisfied, later)
+	aw.add("api", apdexTolerating, later)
+	if got := aw.scores(later)["api"].apdex; got != 0.75 {
+		t.Errorf("Expected score 0.75 once the earlier requests left the window, got %v", got)
+	}
+	if got := aw.scores(later)["api"].compliance; got != 0.5 {
+		t.Errorf("Expected compliance 0.5, got %v", got)
+	}
+	if _, ok := aw.scores(later.Add(time.Hour))["api"]; ok {
+		t.Error("Expected no score without requests in the window")
+	}
+}
+
+// TestApdexMetrics tests that requests count towards the first matching
+// route group
+func TestApdexMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.Apdex = []ApdexTarget{
+		{Group: "api", Threshold: caddy.Duration(100 * time.Millisecond), Paths: []string{"/api/*"}},
+		{Group: "site", Threshold: caddy.Duration(time.Second)},
+	}
+	var err error
+	if uc.apdexTargets, err = compileApdexTargets(uc.Apdex); err != nil {
+		t.Fatalf("Failed to compile targets: %v", err)
+	}
+
+	requests := []struct {
+		path    string
+		elapsed time.Duration
+	}{
+		{"/api/users", 50 * time.Millisecond},
+		{"/api/users", 200 * time.Millisecond},
+		{"/index.html", 200 * time.Millisecond},
+	}
+	for _, req := range requests {
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(200)
+		uc.collectMetrics(rec, httptest.NewRequest("GET", "http://example.com"+req.path, nil), time.Now().Add(-req.elapsed), nil)
+	}
+
+	if got := testutil.ToFloat64(globalUsageMetrics.apdexRequests.WithLabelValues("api", apdexTolerating)); got != 1 {
+		t.Errorf("Expected 1 tolerated api request, got %v", got)
+	}
+	usagetest.AssertValue(t, registry, "apdex_score", usagetest.Labels{"group": "api"}, 0.75)
+	usagetest.AssertValue(t, registry, "apdex_score", usagetest.Labels{"group": "site"}, 1)
+}
+
+// TestSLOMetrics tests that SLOs match hosts and export their compliance
+// and objective
+func TestSLOMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.Apdex = []ApdexTarget{
+		{Group: "checkout", Threshold: caddy.Duration(100 * time.Millisecond), Hosts: []string{"shop.*"}, Paths: []string{"/checkout/*"}, Objective: 0.99},
+		{Group: "shop", Threshold: caddy.Duration(time.Second), Hosts: []string{"^shop\\."}, Objective: 0.9},
+	}
+	var err error
+	if uc.apdexTargets, err = compileApdexTargets(uc.Apdex); err != nil {
+		t.Fatalf("Failed to compile targets: %v", err)
+	}
+	globalUsageMetrics.apdex.setObjectives(uc.apdexTargets)
+
+	requests := []struct {
+		target  string
+		status  int
+		elapsed time.Duration
+	}{
+		{"http://SHOP.example.com:8443/checkout/pay", 200, 50 * time.Millisecond},
+		{"http://shop.example.com/checkout/pay", 200, 50 * time.Millisecond},
+		{"http://shop.example.com/checkout/pay", 200, 50 * time.Millisecond},
+		{"http://shop.example.com/checkout/pay", 503, 10 * time.Millisecond},
+		{"http://shop.example.com/cart", 200, 2 * time.Second},
+		{"http://www.example.com/checkout/pay", 200, 50 * time.Millisecond},
+	}
+	for _, req := range requests {
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(req.status)
+		uc.collectMetrics(rec, httptest.NewRequest("GET", req.target, nil), now().Add(-req.elapsed), nil)
+	}
+
+	usagetest.AssertValue(t, registry, "apdex_requests_total", usagetest.Labels{"group": "checkout", "zone": apdexSatisfied}, 3)
+	usagetest.AssertValue(t, registry, "apdex_requests_total", usagetest.Labels{"group": "checkout", "zone": apdexFrustrated}, 1)
+	usagetest.AssertValue(t, registry, "apdex_requests_total", usagetest.Labels{"group": "shop", "zone": apdexTolerating}, 1)
+	usagetest.AssertCount(t, registry, "apdex_requests_total", nil, 3)
+	usagetest.AssertValue(t, registry, "slo_compliance_ratio", usagetest.Labels{"group": "checkout"}, 0.75)
+	usagetest.AssertValue(t, registry, "slo_compliance_ratio", usagetest.Labels{"group": "shop"}, 0)
+	usagetest.AssertValue(t, registry, "slo_objective", usagetest.Labels{"group": "checkout"}, 0.99)
+	usagetest.AssertValue(t, registry, "slo_objective", usagetest.Labels{"group": "shop"}, 0.9)
+
+	for _, invalid := range []ApdexTarget{
+		{Group: "api", Threshold: caddy.Duration(time.Second), Objective: 1},
+		{Group: "api", Threshold: caddy.Duration(time.Second), Hosts: []string{"^("}},
+	} {
+		if _, err := compileApdexTargets([]ApdexTarget{invalid}); err == nil {
+			t.Errorf("Expected an error for %+v", invalid)
+		}
+	}
+}
+
+// TestUnmarshalApdex tests parsing of the apdex option
+func TestUnmarshalApdex(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  []ApdexTarget
+		expectErr bool
+	}{
+		{
+			input: "usage {\n apdex api 300ms /api/* ^/v[0-9]+/\n apdex site 1s\n}",
+			expected: []ApdexTarget{
+				{Group: "api", Threshold: caddy.Duration(300 * time.Millisecond), Paths: []string{"/api/*", "^/v[0-9]+/"}},
+				{Group: "site", Threshold: caddy.Duration(time.Second)},
+			},
+		},
+		{input: "usage {\n apdex api\n}", expectErr: true},
+		{input: "usage {\n apdex api quick\n}", expectErr: true},
+		{
+			input: "usage {\n slo checkout {\n latency 250ms\n objective 0.995\n hosts shop.example.com\n paths /checkout/* /cart\n }\n}",
+			expected: []ApdexTarget{
+				{Group: "checkout", Threshold: caddy.Duration(250 * time.Millisecond), Objective: 0.995, Hosts: []string{"shop.example.com"}, Paths: []string{"/checkout/*", "/cart"}},
+			},
+		},
+		{input: "usage {\n slo checkout\n}", expectErr: true},
+		{input: "usage {\n slo api {\n latency fast\n }\n}", expectErr: true},
+		{input: "usage {\n slo api {\n latency 1s\n objective 99\n }\n}", expectErr: true},
+		{input: "usage {\n slo api {\n latency 1s\n hosts\n }\n}", expectErr: true},
+		{input: "usage {\n slo api {\n latency 1s\n window 30d\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.Apdex, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.Apdex)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package caddyusage
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// defaultAPIKeyHeader is the request header carrying API keys when
+// api_keys doesn't name one
+const defaultAPIKeyHeader = "X-Api-Key"
+
+// APIKeysConfig accounts requests, bytes and latency per API key, the
+// usage API gateways bill by. Requests without a key are accounted to
+// "anonymous".
+type APIKeysConfig struct {
+	// Header is the request header carrying API keys. A "Bearer " prefix
+	// is stripped. Defaults to X-Api-Key.
+	Header string `json:"header,omitempty"`
+
+	// Query is a query parameter carrying API keys, used when the header
+	// is absent. It is stripped from the full_url label.
+	Query string `json:"query,omitempty"`
+
+	// Hash records a hash of keys instead of the keys themselves, like
+	// the hash action of label_policy.
+	Hash bool `json:"hash,omitempty"`
+}
+
+// key returns the API key of a request, or anonymousAPIKey
+func (kc *APIKeysConfig) key(r *http.Request) string {
+	header := kc.Header
+	if header == "" {
+		header = defaultAPIKeyHeader
+	}
+
+	key := requestAPIKey(r, header)
+	if key == "" && kc.Query != "" {
+		key = strings.TrimSpace(r.URL.Query().Get(kc.Query))
+	}
+	if key == "" {
+		return anonymousAPIKey
+	}
+	if kc.Hash {
+		return hashValue(key)
+	}
+	return key
+}
+
+// collectAPIKeyMetrics accounts a request to its API key
+func (uc *UsageCollector) collectAPIKeyMetrics(um *usageMetrics, rec recordedResponse, r *http.Request, statusCode string, elapsed time.Duration) {
+	if uc.APIKeys == nil {
+		return
+	}
+
+	key := uc.policy.apply(um, "api_key", uc.APIKeys.key(r))
+	um.apiKeyRequests.WithLabelValues(key, statusCode).Inc()
+	um.apiKeyDuration.WithLabelValues(key).Observe(elapsed.Seconds())
+	if r.ContentLength > 0 {
+		um.apiKeyBytes.WithLabelValues(key, "request").Add(float64(r.ContentLength))
+	}
+	um.apiKeyBytes.WithLabelValues(key, "response").Add(float64(rec.Size()))
+}
+
+// unmarshalAPIKeysConfig parses an api_keys directive with an optional
+// block:
+//
+//	api_keys {
+//	    header <name>
+//	    query <param>
+//	    hash
+//	}
+func unmarshalAPIKeysConfig(d *caddyfile.Dispenser) (*APIKeysConfig, error) {
+	kc := &APIKeysConfig{}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if option == "hash" {
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			kc.Hash = true
+			continue
+		}
+
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		value := d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "header":
+			kc.Header = value
+		case "query":
+			kc.Query = value
+		default:
+			return nil, d.Errf("unrecognized api_keys option '%s'", option)
+		}
+	}
+	return kc, nil
+}
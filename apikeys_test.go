@@ -0,0 +1,111 @@
+package caddyusage
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestAPIKey tests reading API keys from headers and query parameters
+func TestAPIKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   APIKeysConfig
+		header   string
+		value    string
+		target   string
+		expected string
+	}{
+		{name: "default header", header: "X-Api-Key", value: "k1", target: "/", expected: "k1"},
+		{name: "bearer", config: APIKeysConfig{Header: "Authorization"}, header: "Authorization", value: "Bearer k2", target: "/", expected: "k2"},
+		{name: "query", config: APIKeysConfig{Query: "api_key"}, target: "/?api_key=k3", expected: "k3"},
+		{name: "header before query", config: APIKeysConfig{Query: "api_key"}, header: "X-Api-Key", value: "k1", target: "/?api_key=k3", expected: "k1"},
+		{name: "hashed", config: APIKeysConfig{Hash: true}, header: "X-Api-Key", value: "k1", target: "/", expected: hashValue("k1")},
+		{name: "anonymous", target: "/?api_key=k3", expected: anonymousAPIKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com"+tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			if got := tt.config.key(req); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestAPIKeyMetrics tests accounting requests, bytes and latency per key,
+// and that query keys stay out of full_url
+func TestAPIKeyMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	// Disabled by default
+	collectTestRequests(t, uc)
+	usagetest.AssertAbsent(t, registry, "api_key_requests_total", nil)
+
+	uc.APIKeys = &APIKeysConfig{Query: "key"}
+	for _, target := range []string{"/v1/search?q=caddy&key=k1", "/v1/search?key=k1", "/v1/search"} {
+		req := httptest.NewRequest("POST", "http://example.com"+target, strings.NewReader("hello"))
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(200)
+		if _, err := rec.Write([]byte("results")); err != nil {
+			t.Fatalf("Failed to write response: %v", err)
+		}
+		uc.collectMetrics(rec, req, now().Add(-50*time.Millisecond), nil)
+	}
+
+	usagetest.AssertValue(t, registry, "api_key_requests_total", usagetest.Labels{"api_key": "k1", "status_code": "200"}, 2)
+	usagetest.AssertValue(t, registry, "api_key_requests_total", usagetest.Labels{"api_key": anonymousAPIKey}, 1)
+	usagetest.AssertValue(t, registry, "api_key_bytes_total", usagetest.Labels{"api_key": "k1", "direction": "request"}, 10)
+	usagetest.AssertValue(t, registry, "api_key_bytes_total", usagetest.Labels{"api_key": "k1", "direction": "response"}, 14)
+	usagetest.AssertValue(t, registry, "api_key_request_duration_seconds", usagetest.Labels{"api_key": "k1"}, 2)
+
+	usagetest.AssertValue(t, registry, "requests_by_url_total", usagetest.Labels{"full_url": "http://example.com/v1/search?q=caddy"}, 1)
+	usagetest.AssertValue(t, registry, "requests_by_url_total", usagetest.Labels{"full_url": "http://example.com/v1/search"}, 2)
+}
+
+// TestUnmarshalAPIKeys tests parsing of the api_keys option
+func TestUnmarshalAPIKeys(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *APIKeysConfig
+		expectErr bool
+	}{
+		{input: "usage {\n api_keys\n}", expected: &APIKeysConfig{}},
+		{
+			input:    "usage {\n api_keys {\n header Authorization\n query api_key\n hash\n }\n}",
+			expected: &APIKeysConfig{Header: "Authorization", Query: "api_key", Hash: true},
+		},
+		{input: "usage {\n api_keys X-Api-Key\n}", expectErr: true},
+		{input: "usage {\n api_keys {\n header\n }\n}", expectErr: true},
+		{input: "usage {\n api_keys {\n hash sha256\n }\n}", expectErr: true},
+		{input: "usage {\n api_keys {\n cookie session\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		var uc UsageCollector
+		err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected an error but got none", tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(uc.APIKeys, tt.expected) {
+			t.Errorf("Expected %+v, got %+v", tt.expected, uc.APIKeys)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package caddyusage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// asnUnknown is recorded for clients whose address isn't announced by any
+// autonomous system of the database, such as private addresses
+const asnUnknown = "unknown"
+
+// asnDatabase maps IP addresses to the autonomous system announcing them
+type asnDatabase interface {
+	// lookup returns the number and organization of the autonomous system
+	// announcing addr, or 0 when there is none
+	lookup(addr netip.Addr) (uint32, string)
+	close() error
+}
+
+// sharedASNDatabase is an ASN database shared by the handlers configured
+// with the same file
+type sharedASNDatabase struct {
+	asnDatabase
+	path     string
+	modified time.Time
+	refs     int
+}
+
+var (
+	asnDatabases   = make(map[string]*sharedASNDatabase)
+	asnDatabasesMu sync.Mutex
+)
+
+// acquireASNDatabase returns the loaded database of path, loading it if
+// needed. A file modified since it was loaded is loaded again, so that
+// updates apply on config reloads. Each call must be balanced by a call to
+// releaseASNDatabase.
+func acquireASNDatabase(path string) (*sharedASNDatabase, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	asnDatabasesMu.Lock()
+	defer asnDatabasesMu.Unlock()
+
+	if db, ok := asnDatabases[path]; ok && db.modified.Equal(info.ModTime()) {
+		db.refs++
+		return db, nil
+	}
+
+	var loaded asnDatabase
+	if strings.HasSuffix(strings.ToLower(path), ".mmdb") {
+		loaded, err = openMaxMindASN(path)
+	} else {
+		loaded, err = loadIP2ASN(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Handlers still using a replaced database keep it until released
+	db := &sharedASNDatabase{asnDatabase: loaded, path: path, modified: info.ModTime(), refs: 1}
+	asnDatabases[path] = db
+	return db, nil
+}
+
+// releaseASNDatabase releases a handler's use of a database, closing it
+// once no handler uses it anymore
+func releaseASNDatabase(db *sharedASNDatabase) error {
+	asnDatabasesMu.Lock()
+	defer asnDatabasesMu.Unlock()
+
+	if db.refs--; db.refs > 0 {
+		return nil
+	}
+	if asnDatabases[db.path] == db {
+		delete(asnDatabases, db.path)
+	}
+	return db.close()
+}
+
+// maxMindASN is a MaxMind ASN database, such as GeoLite2-ASN.mmdb
+type maxMindASN struct {
+	reader *maxminddb.Reader
+}
+
+// maxMindASNRecord is the record of a network in a MaxMind ASN database
+type maxMindASNRecord struct {
+	Number       uint32 `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// openMaxMindASN opens a MaxMind database, which must have ASN records
+func openMaxMindASN(path string) (*maxMindASN, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(reader.Metadata.DatabaseType, "ASN") {
+		_ = reader.Close()
+		return nil, fmt.Errorf("%s is a %s database, not an ASN database", path, reader.Metadata.DatabaseType)
+	}
+	return &maxMindASN{reader: reader}, nil
+}
+
+func (m *maxMindASN) lookup(addr netip.Addr) (uint32, string) {
+	var record maxMindASNRecord
+	if err := m.reader.Lookup(addr.AsSlice(), &record); err != nil {
+		return 0, ""
+	}
+	return record.Number, record.Organization
+}
+
+func (m *maxMindASN) close() error {
+	return m.reader.Close()
+}
+
+// asnRange is a range of addresses announced by an autonomous system
+type asnRange struct {
+	start, end netip.Addr
+	asn        uint32
+	org        string
+}
+
+// ip2asnTable is an ip2asn database: ranges sorted by start address
+type ip2asnTable []asnRange
+
+// loadIP2ASN loads a database in the tab-separated format of iptoasn.com,
+// such as ip2asn-combined.tsv, gzipped when its name ends in .gz
+func loadIP2ASN(path string) (ip2asnTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(strings.ToLower(path), ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	table, err := parseIP2ASN(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return table, nil
+}
+
+// parseIP2ASN parses lines of range start, range end, AS number, country
+// code and AS description separated by tabs. Ranges of AS 0 are not
+// routed, and are left out.
+func parseIP2ASN(r io.Reader) (ip2asnTable, error) {
+	var table ip2asnTable
+
+	// Organizations announce many ranges; share their names
+	orgs := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		fields := strings.Split(text, "\t")
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("line %d: expected 5 tab-separated fields, got %d", line, len(fields))
+		}
+		start, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		end, err := netip.ParseAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if start.Is4() != end.Is4() || end.Less(start) {
+			return nil, fmt.Errorf("line %d: invalid range %s - %s", line, start, end)
+		}
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid AS number '%s'", line, fields[2])
+		}
+		if asn == 0 {
+			continue
+		}
+
+		org, ok := orgs[fields[4]]
+		if !ok {
+			org = strings.Clone(fields[4])
+			orgs[org] = org
+		}
+		table = append(table, asnRange{start: start.Unmap(), end: end.Unmap(), asn: uint32(asn), org: org})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(table) == 0 {
+		return nil, errors.New("no routed ranges")
+	}
+
+	slices.SortFunc(table, func(a, b asnRange) int { return a.start.Compare(b.start) })
+	return table, nil
+}
+
+func (t ip2asnTable) lookup(addr netip.Addr) (uint32, string) {
+	addr = addr.Unmap()
+
+	// Find the last range starting at or before addr
+	i, found := slices.BinarySearchFunc(t, addr, func(r asnRange, addr netip.Addr) int { return r.start.Compare(addr) })
+	if !found {
+		i--
+	}
+	if i < 0 || t[i].end.Less(addr) {
+		return 0, ""
+	}
+	return t[i].asn, t[i].org
+}
+
+func (t ip2asnTable) close() error {
+	return nil
+}
+
+// collectASNMetrics counts the request by the autonomous system of the
+// client's address
+func (uc *UsageCollector) collectASNMetrics(um *usageMetrics, rawIP string) {
+	if uc.asnDB == nil {
+		return
+	}
+
+	asn, org := asnUnknown, asnUnknown
+	if addr, err := netip.ParseAddr(rawIP); err == nil {
+		if number, name := uc.asnDB.lookup(addr); number != 0 {
+			asn = strconv.FormatUint(uint64(number), 10)
+			org = uc.policy.apply(um, "org", name)
+		}
+	}
+	um.requestsByASN.WithLabelValues(asn, org).Inc()
+}
@@ -0,0 +1,205 @@
+package caddyusage
+
+import (
+	"compress/gzip"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// testIP2ASN is an excerpt of an ip2asn-combined.tsv file
+const testIP2ASN = "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+	"1.0.1.0\t1.0.3.255\t0\tNone\tNot routed\n" +
+	"8.8.8.0\t8.8.8.255\t15169\tUS\tGOOGLE\n" +
+	"3.0.0.0\t3.127.255.255\t16509\tUS\tAMAZON-02\n" +
+	"2600:1f00::\t2600:1fff:ffff:ffff:ffff:ffff:ffff:ffff\t16509\tUS\tAMAZON-02\n"
+
+// TestIP2ASNLookup tests lookups of IPv4 and IPv6 addresses in an ip2asn
+// table, including the first and last address of ranges
+func TestIP2ASNLookup(t *testing.T) {
+	table, err := parseIP2ASN(strings.NewReader(testIP2ASN))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		addr string
+		asn  uint32
+		org  string
+	}{
+		{addr: "1.0.0.0", asn: 13335, org: "CLOUDFLARENET"},
+		{addr: "1.0.0.255", asn: 13335, org: "CLOUDFLARENET"},
+		{addr: "1.0.2.1"},
+		{addr: "3.64.1.1", asn: 16509, org: "AMAZON-02"},
+		{addr: "::ffff:8.8.8.8", asn: 15169, org: "GOOGLE"},
+		{addr: "2600:1f18::1", asn: 16509, org: "AMAZON-02"},
+		{addr: "0.0.0.1"},
+		{addr: "192.168.1.1"},
+		{addr: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		asn, org := table.lookup(netip.MustParseAddr(tt.addr))
+		if asn != tt.asn || org != tt.org {
+			t.Errorf("%s: expected AS%d %q, got AS%d %q", tt.addr, tt.asn, tt.org, asn, org)
+		}
+	}
+}
+
+// TestParseIP2ASNErrors tests that malformed ip2asn files are rejected
+func TestParseIP2ASNErrors(t *testing.T) {
+	tests := map[string]string{
+		"empty":          "",
+		"not routed":     "1.0.1.0\t1.0.3.255\t0\tNone\tNot routed\n",
+		"missing fields": "1.0.0.0\t1.0.0.255\t13335\n",
+		"invalid start":  "1.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n",
+		"invalid asn":    "1.0.0.0\t1.0.0.255\tAS13335\tUS\tCLOUDFLARENET\n",
+		"reversed range": "1.0.0.255\t1.0.0.0\t13335\tUS\tCLOUDFLARENET\n",
+		"mixed families": "1.0.0.0\t2600::\t13335\tUS\tCLOUDFLARENET\n",
+	}
+	for name, data := range tests {
+		if _, err := parseIP2ASN(strings.NewReader(data)); err == nil {
+			t.Errorf("%s: expected an error but got none", name)
+		}
+	}
+}
+
+// writeIP2ASN writes testIP2ASN to path, gzipped for .gz names
+func writeIP2ASN(t *testing.T, path string) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create %s: %v", path, err)
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(path, ".gz") {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		_, err = gz.Write([]byte(testIP2ASN))
+	} else {
+		_, err = f.Write([]byte(testIP2ASN))
+	}
+	if err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// TestASNMetrics tests that requests are counted by the autonomous system
+// of their client, and as unknown when it has none
+func TestASNMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	// Disabled without a database
+	uc.collectASNMetrics(globalUsageMetrics, "8.8.8.8")
+	usagetest.AssertAbsent(t, registry, "requests_by_asn_total", nil)
+
+	path := filepath.Join(t.TempDir(), "ip2asn-combined.tsv.gz")
+	writeIP2ASN(t, path)
+	db, err := acquireASNDatabase(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer func() { _ = releaseASNDatabase(db) }()
+	uc.asnDB = db
+
+	for _, ip := range []string{"8.8.8.8", "8.8.8.8", "2600:1f18::1", "192.168.1.1", "not-an-ip"} {
+		uc.collectASNMetrics(globalUsageMetrics, ip)
+	}
+	usagetest.AssertValue(t, registry, "requests_by_asn_total", usagetest.Labels{"asn": "15169", "org": "GOOGLE"}, 2)
+	usagetest.AssertValue(t, registry, "requests_by_asn_total", usagetest.Labels{"asn": "16509", "org": "AMAZON-02"}, 1)
+	usagetest.AssertValue(t, registry, "requests_by_asn_total", usagetest.Labels{"asn": asnUnknown, "org": asnUnknown}, 2)
+}
+
+// TestASNDatabaseShared tests that handlers share a database until its
+// file is modified, when it is loaded again
+func TestASNDatabaseShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip2asn.tsv")
+	writeIP2ASN(t, path)
+
+	first, err := acquireASNDatabase(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	second, err := acquireASNDatabase(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first != second {
+		t.Fatal("Expected handlers using the same file to share a database")
+	}
+
+	modified := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatalf("Failed to touch %s: %v", path, err)
+	}
+	reloaded, err := acquireASNDatabase(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if reloaded == first {
+		t.Error("Expected a modified file to be loaded again")
+	}
+
+	for _, db := range []*sharedASNDatabase{first, second, reloaded} {
+		if err := releaseASNDatabase(db); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if _, ok := asnDatabases[path]; ok {
+		t.Error("Expected the database to be closed with its last handler")
+	}
+}
+
+// TestASNDatabaseErrors tests that unusable databases fail to load
+func TestASNDatabaseErrors(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+	if err := os.WriteFile(invalid, []byte("not a database"), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", invalid, err)
+	}
+
+	for _, path := range []string{filepath.Join(dir, "missing.tsv"), invalid} {
+		if db, err := acquireASNDatabase(path); err == nil {
+			_ = releaseASNDatabase(db)
+			t.Errorf("%s: expected an error but got none", path)
+		}
+	}
+}
+
+// TestUnmarshalASNDatabase tests parsing of the asn_database option
+func TestUnmarshalASNDatabase(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  string
+		expectErr bool
+	}{
+		{input: "usage {\n asn_database /var/lib/GeoLite2-ASN.mmdb\n}", expected: "/var/lib/GeoLite2-ASN.mmdb"},
+		{input: "usage {\n asn_database\n}", expectErr: true},
+		{input: "usage {\n asn_database a.mmdb b.mmdb\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		var uc UsageCollector
+		err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected an error but got none", tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if uc.ASNDatabase != tt.expected {
+			t.Errorf("Expected %q, got %q", tt.expected, uc.ASNDatabase)
+		}
+	}
+}
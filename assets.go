@@ -0,0 +1,341 @@
+package caddyusage
+
+import (
+	"fmt"
+)
+
+// assetPanel describes one dashboard panel
+type assetPanel struct {
+	title   string
+	kind    string // timeseries, stat or table
+	unit    string
+	queries []string
+}
+
+// assetAlert describes one alerting rule
+type assetAlert struct {
+	name     string
+	expr     string
+	duration string
+	severity string
+	summary  string
+}
+
+// profileAssetSpec lists the panels and alerts bundled with a profile
+type profileAssetSpec struct {
+	panels []assetPanel
+	alerts []assetAlert
+}
+
+// Panels shared by all profiles
+var (
+	requestRatePanel = assetPanel{
+		title:   "Request rate by status",
+		kind:    "timeseries",
+		unit:    "reqps",
+		queries: []string{`sum by (status_code) (rate(caddy_usage_requests_total[5m]))`},
+	}
+	errorRatioPanel = assetPanel{
+		title:   "5xx error ratio",
+		kind:    "timeseries",
+		unit:    "percentunit",
+		queries: []string{`sum(rate(caddy_usage_requests_total{status_code=~"5.."}[5m])) / sum(rate(caddy_usage_requests_total[5m]))`},
+	}
+	latencyPanel = assetPanel{
+		title: "Request duration",
+		kind:  "timeseries",
+		unit:  "s",
+		queries: []string{
+			`histogram_quantile(0.5, sum by (le) (rate(caddy_usage_request_duration_seconds_bucket[5m])))`,
+			`histogram_quantile(0.95, sum by (le) (rate(caddy_usage_request_duration_seconds_bucket[5m])))`,
+			`histogram_quantile(0.99, sum by (le) (rate(caddy_usage_request_duration_seconds_bucket[5m])))`,
+		},
+	}
+	activePanel = assetPanel{
+		title: "Active paths, hosts and clients",
+		kind:  "stat",
+		unit:  "short",
+		queries: []string{
+			`caddy_usage_active_paths`,
+			`caddy_usage_active_hosts`,
+			`caddy_usage_active_clients`,
+		},
+	}
+)
+
+// highErrorRateAlert builds a 5xx ratio alert with the given threshold
+func highErrorRateAlert(threshold float64) assetAlert {
+	return assetAlert{
+		name:     "CaddyUsageHighErrorRate",
+		expr:     fmt.Sprintf(`sum(rate(caddy_usage_requests_total{status_code=~"5.."}[5m])) / sum(rate(caddy_usage_requests_total[5m])) > %g`, threshold),
+		duration: "10m",
+		severity: "critical",
+		summary:  fmt.Sprintf("More than %g%% of requests are failing with 5xx responses", threshold*100),
+	}
+}
+
+// highLatencyAlert builds a p95 latency alert with the given threshold in seconds
+func highLatencyAlert(threshold float64) assetAlert {
+	return assetAlert{
+		name:     "CaddyUsageHighLatency",
+		expr:     fmt.Sprintf(`histogram_quantile(0.95, sum by (le, host) (rate(caddy_usage_request_duration_seconds_bucket[5m]))) > %g`, threshold),
+		duration: "15m",
+		severity: "warning",
+		summary:  fmt.Sprintf("95th percentile request duration on {{ $labels.host }} is above %gs", threshold),
+	}
+}
+
+// noTrafficAlert fires when no requests have been recorded at all
+var noTrafficAlert = assetAlert{
+	name:     "CaddyUsageNoTraffic",
+	expr:     `sum(rate(caddy_usage_requests_total[15m])) == 0`,
+	duration: "15m",
+	severity: "warning",
+	summary:  "No requests have been recorded for 15 minutes",
+}
+
+// profileAssetSpecs holds the bundled assets for each profile
+var profileAssetSpecs = map[string]profileAssetSpec{
+	"minimal": {
+		panels: []assetPanel{requestRatePanel, errorRatioPanel, latencyPanel},
+		alerts: []assetAlert{highErrorRateAlert(0.05), noTrafficAlert},
+	},
+	"standard": {
+		panels: []assetPanel{
+			requestRatePanel, errorRatioPanel, latencyPanel,
+			{
+				title:   "Top clients",
+				kind:    "table",
+				unit:    "short",
+				queries: []string{`topk(20, sum by (client_ip) (increase(caddy_usage_requests_by_ip_total[1h])))`},
+			},
+			{
+				title:   "Top URLs",
+				kind:    "table",
+				unit:    "short",
+				queries: []string{`topk(20, sum by (full_url) (increase(caddy_usage_requests_by_url_total[1h])))`},
+			},
+		},
+		alerts: []assetAlert{highErrorRateAlert(0.05), highLatencyAlert(2), noTrafficAlert},
+	},
+	"verbose": {
+		panels: []assetPanel{
+			requestRatePanel, errorRatioPanel, latencyPanel, activePanel,
+			{
+				title: "Time to first byte",
+				kind:  "timeseries",
+				unit:  "s",
+				queries: []string{
+					`histogram_quantile(0.5, sum by (le) (rate(caddy_usage_ttfb_seconds_bucket[5m])))`,
+					`histogram_quantile(0.95, sum by (le) (rate(caddy_usage_ttfb_seconds_bucket[5m])))`,
+				},
+			},
+			{
+				title:   "Responses by content type",
+				kind:    "timeseries",
+				unit:    "reqps",
+				queries: []string{`sum by (content_type) (rate(caddy_usage_responses_by_content_type_total[5m]))`},
+			},
+			{
+				title:   "Requests by protocol",
+				kind:    "timeseries",
+				unit:    "reqps",
+				queries: []string{`sum by (proto) (rate(caddy_usage_requests_by_protocol_total[5m]))`},
+			},
+			{
+				title:   "Failures by origin",
+				kind:    "timeseries",
+				unit:    "reqps",
+				queries: []string{`sum by (origin, category) (rate(caddy_usage_failures_total[5m]))`},
+			},
+			{
+				title:   "Top user agents",
+				kind:    "table",
+				unit:    "short",
+				queries: []string{`topk(20, sum by (header_value) (increase(caddy_usage_requests_by_headers_total{header_name="User-Agent"}[1h])))`},
+			},
+		},
+		alerts: []assetAlert{highErrorRateAlert(0.05), highLatencyAlert(2), noTrafficAlert},
+	},
+	"web": {
+		panels: []assetPanel{
+			requestRatePanel, errorRatioPanel, latencyPanel, activePanel,
+			{
+				title:   "Top pages",
+				kind:    "table",
+				unit:    "short",
+				queries: []string{`topk(20, sum by (host, path) (increase(caddy_usage_requests_total{method="GET"}[1h])))`},
+			},
+			{
+				title:   "Top referrers",
+				kind:    "table",
+				unit:    "short",
+				queries: []string{`topk(20, sum by (header_value) (increase(caddy_usage_requests_by_headers_total{header_name="Referer"}[1h])))`},
+			},
+			{
+				title:   "Top user agents",
+				kind:    "table",
+				unit:    "short",
+				queries: []string{`topk(20, sum by (header_value) (increase(caddy_usage_requests_by_headers_total{header_name="User-Agent"}[1h])))`},
+			},
+		},
+		alerts: []assetAlert{highErrorRateAlert(0.05), highLatencyAlert(2)},
+	},
+	"api": {
+		panels: []assetPanel{
+			requestRatePanel, errorRatioPanel, latencyPanel, activePanel,
+			{
+				title:   "Requests by route",
+				kind:    "timeseries",
+				unit:    "reqps",
+				queries: []string{`topk(20, sum by (method, path) (rate(caddy_usage_requests_total[5m])))`},
+			},
+			{
+				title:   "Error routes",
+				kind:    "table",
+				unit:    "short",
+				queries: []string{`topk(20, sum by (method, path, status_code) (increase(caddy_usage_requests_total{status_code=~"[45].."}[1h])))`},
+			},
+			{
+				title:   "Rate limited requests by zone",
+				kind:    "timeseries",
+				unit:    "reqps",
+				queries: []string{`sum by (zone) (rate(caddy_usage_rate_limited_total[5m]))`},
+			},
+			{
+				title:   "Top clients",
+				kind:    "table",
+				unit:    "short",
+				queries: []string{`topk(20, sum by (client_ip) (increase(caddy_usage_requests_by_ip_total[1h])))`},
+			},
+		},
+		alerts: []assetAlert{
+			highErrorRateAlert(0.02),
+			highLatencyAlert(1),
+			{
+				name:     "CaddyUsageRateLimiting",
+				expr:     `sum by (zone) (rate(caddy_usage_rate_limited_total[5m])) > 1`,
+				duration: "10m",
+				severity: "warning",
+				summary:  "Rate limit zone {{ $labels.zone }} is rejecting more than one request per second",
+			},
+		},
+	},
+	"cdn": {
+		panels: []assetPanel{
+			requestRatePanel, errorRatioPanel, latencyPanel, activePanel,
+			{
+				title:   "Requests by host",
+				kind:    "timeseries",
+				unit:    "reqps",
+				queries: []string{`topk(20, sum by (host) (rate(caddy_usage_requests_total[5m])))`},
+			},
+			{
+				title:   "Not found ratio by host",
+				kind:    "timeseries",
+				unit:    "percentunit",
+				queries: []string{`sum by (host) (rate(caddy_usage_requests_total{status_code="404"}[5m])) / sum by (host) (rate(caddy_usage_requests_total[5m]))`},
+			},
+		},
+		alerts: []assetAlert{highErrorRateAlert(0.01), highLatencyAlert(0.5)},
+	},
+}
+
+// assetBundle is the dashboard and alert rules bundled with a profile
+type assetBundle struct {
+	Profile   string         `json:"profile"`
+	Dashboard map[string]any `json:"dashboard"`
+	Alerts    map[string]any `json:"alerts"`
+}
+
+// profileAssets builds the asset bundle for the named profile
+func profileAssets(profile string) (assetBundle, bool) {
+	spec, ok := profileAssetSpecs[profile]
+	if !ok {
+		return assetBundle{}, false
+	}
+
+	return assetBundle{
+		Profile:   profile,
+		Dashboard: buildDashboard(profile, spec.panels),
+		Alerts:    buildAlertRules(profile, spec.alerts),
+	}, true
+}
+
+// buildDashboard renders panels as an importable Grafana dashboard
+func buildDashboard(profile string, panels []assetPanel) map[string]any {
+	const width, height = 12, 8
+
+	grafanaPanels := make([]map[string]any, 0, len(panels))
+	for i, p := range panels {
+		targets := make([]map[string]any, 0, len(p.queries))
+		for j, q := range p.queries {
+			targets = append(targets, map[string]any{
+				"refId":      string(rune('A' + j)),
+				"expr":       q,
+				"datasource": map[string]any{"type": "prometheus", "uid": "${datasource}"},
+			})
+		}
+
+		grafanaPanels = append(grafanaPanels, map[string]any{
+			"id":         i + 1,
+			"title":      p.title,
+			"type":       p.kind,
+			"gridPos":    map[string]any{"x": (i % 2) * width, "y": (i / 2) * height, "w": width, "h": height},
+			"datasource": map[string]any{"type": "prometheus", "uid": "${datasource}"},
+			"fieldConfig": map[string]any{
+				"defaults":  map[string]any{"unit": p.unit},
+				"overrides": []any{},
+			},
+			"targets": targets,
+		})
+	}
+
+	return map[string]any{
+		"title":         fmt.Sprintf("Caddy Usage (%s)", profile),
+		"uid":           "caddy-usage-" + profile,
+		"tags":          []string{"caddy", "usage", profile},
+		"schemaVersion": 39,
+		"time":          map[string]any{"from": "now-6h", "to": "now"},
+		"refresh":       "30s",
+		"templating": map[string]any{
+			"list": []map[string]any{
+				{
+					"name":  "datasource",
+					"type":  "datasource",
+					"query": "prometheus",
+				},
+			},
+		},
+		"panels": grafanaPanels,
+	}
+}
+
+// buildAlertRules renders alerts as a Prometheus rule file. JSON is valid
+// YAML, so the output can be saved and loaded as a rule file directly.
+func buildAlertRules(profile string, alerts []assetAlert) map[string]any {
+	rules := make([]map[string]any, 0, len(alerts))
+	for _, a := range alerts {
+		rules = append(rules, map[string]any{
+			"alert": a.name,
+			"expr":  a.expr,
+			"for":   a.duration,
+			"labels": map[string]string{
+				"severity": a.severity,
+				"profile":  profile,
+			},
+			"annotations": map[string]string{
+				"summary": a.summary,
+			},
+		})
+	}
+
+	return map[string]any{
+		"groups": []map[string]any{
+			{
+				"name":  "caddy-usage-" + profile,
+				"rules": rules,
+			},
+		},
+	}
+}
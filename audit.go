@@ -0,0 +1,548 @@
+package caddyusage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultAuditIDHeader is the request header matching audited requests
+	// with their access log entries
+	defaultAuditIDHeader = "X-Request-Id"
+
+	// defaultAuditSampleRate is the fraction of requests audited
+	defaultAuditSampleRate = 0.01
+
+	// defaultAuditTolerance is how much longer than recorded the access
+	// log may report a request, for the work Caddy does around handlers
+	defaultAuditTolerance = 100 * time.Millisecond
+
+	// auditPollInterval is how often the access log is read
+	auditPollInterval = time.Second
+
+	// auditMatchWindow is how long an audited request waits for its access
+	// log entry before counting as unmatched
+	auditMatchWindow = time.Minute
+
+	// maxAuditPending bounds the audited requests waiting for their entry
+	maxAuditPending = 10000
+
+	// maxAuditDiscrepancies is the number of discrepancies kept for the
+	// admin API
+	maxAuditDiscrepancies = 100
+)
+
+// Results of the audit_checks_total metric
+const (
+	auditMatch            = "match"
+	auditStatusMismatch   = "status_mismatch"
+	auditDurationMismatch = "duration_mismatch"
+	auditUnmatched        = "unmatched"
+)
+
+// AuditConfig enables a debug mode cross-checking the status and duration
+// recorded for a sample of requests against Caddy's own access log, to
+// validate that the response recorder captures streamed and hijacked
+// responses correctly. Audited requests are tagged with a request ID
+// header, which the JSON access log records with the request's headers.
+type AuditConfig struct {
+	// AccessLog is the path of the JSON access log written by Caddy for
+	// the audited requests. Required.
+	AccessLog string `json:"access_log,omitempty"`
+
+	// IDHeader is the request header identifying requests in both. Audited
+	// requests without one are given Caddy's request UUID. Defaults to
+	// X-Request-Id.
+	IDHeader string `json:"id_header,omitempty"`
+
+	// SampleRate is the fraction of requests audited, between 0 and 1.
+	// Defaults to 0.01.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// Tolerance is how much the durations may differ, since the access log
+	// also measures the work Caddy does around handlers. Defaults to 100ms.
+	Tolerance caddy.Duration `json:"tolerance,omitempty"`
+}
+
+// validate checks the access log, sample rate and tolerance
+func (ac *AuditConfig) validate() error {
+	if ac.AccessLog == "" {
+		return fmt.Errorf("audit requires an access_log")
+	}
+	if ac.SampleRate < 0 || ac.SampleRate > 1 {
+		return fmt.Errorf("audit sample_rate must be between 0 and 1, got %g", ac.SampleRate)
+	}
+	if ac.Tolerance < 0 {
+		return fmt.Errorf("audit tolerance must not be negative, got %s", time.Duration(ac.Tolerance))
+	}
+	return nil
+}
+
+// idHeader returns the configured request ID header or its default
+func (ac *AuditConfig) idHeader() string {
+	if ac.IDHeader != "" {
+		return http.CanonicalHeaderKey(ac.IDHeader)
+	}
+	return defaultAuditIDHeader
+}
+
+// auditRecord is what was recorded for an audited request
+type auditRecord struct {
+	um        *usageMetrics
+	method    string
+	host      string
+	path      string
+	status    int
+	duration  time.Duration
+	tolerance time.Duration
+	recorded  time.Time
+}
+
+// AuditDiscrepancy is an audited request whose access log entry disagrees
+// with what was recorded
+type AuditDiscrepancy struct {
+	ID               string    `json:"id"`
+	Time             time.Time `json:"time"`
+	Result           string    `json:"result"`
+	Method           string    `json:"method"`
+	Host             string    `json:"host"`
+	Path             string    `json:"path"`
+	RecordedStatus   int       `json:"recorded_status"`
+	LoggedStatus     int       `json:"logged_status"`
+	RecordedDuration float64   `json:"recorded_duration_seconds"`
+	LoggedDuration   float64   `json:"logged_duration_seconds"`
+}
+
+// auditor follows an access log, checking the entries of audited requests
+// against what was recorded for them. Handlers auditing the same access
+// log share an auditor.
+type auditor struct {
+	path   string
+	logger *zap.Logger
+
+	mu            sync.Mutex
+	idHeader      string
+	pending       map[string]auditRecord
+	discrepancies []AuditDiscrepancy
+
+	// Tailing state, only used by poll
+	file    *os.File
+	reader  *bufio.Reader
+	partial []byte
+	offset  int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// auditorEntry is a shared auditor and the number of handlers using it
+type auditorEntry struct {
+	auditor *auditor
+	refs    int
+}
+
+var (
+	// Running auditors by access log
+	auditors   = make(map[string]*auditorEntry)
+	auditorsMu sync.Mutex
+)
+
+// acquireAuditor returns the running auditor of an access log, starting
+// one if needed. Since auditors are shared, the most recently provisioned
+// handler's ID header applies. Each call must be balanced by a call to
+// releaseAuditor.
+func acquireAuditor(ac *AuditConfig, logger *zap.Logger) *auditor {
+	auditorsMu.Lock()
+	defer auditorsMu.Unlock()
+
+	if entry, ok := auditors[ac.AccessLog]; ok {
+		entry.refs++
+		entry.auditor.mu.Lock()
+		entry.auditor.idHeader = ac.idHeader()
+		entry.auditor.mu.Unlock()
+		return entry.auditor
+	}
+
+	a := newAuditor(ac.AccessLog, ac.idHeader(), logger)
+	a.start()
+	auditors[ac.AccessLog] = &auditorEntry{auditor: a, refs: 1}
+	return a
+}
+
+// releaseAuditor releases a handler's use of an auditor, stopping it once
+// no handler uses it anymore
+func releaseAuditor(a *auditor) {
+	auditorsMu.Lock()
+	defer auditorsMu.Unlock()
+
+	entry, ok := auditors[a.path]
+	if !ok || entry.auditor != a {
+		return
+	}
+	if entry.refs--; entry.refs > 0 {
+		return
+	}
+	delete(auditors, a.path)
+	a.stop()
+}
+
+// newAuditor creates an auditor of an access log, which is followed from
+// its current end, matching requests by the given ID header
+func newAuditor(path, idHeader string, logger *zap.Logger) *auditor {
+	a := &auditor{
+		path:     path,
+		logger:   logger,
+		idHeader: idHeader,
+		pending:  make(map[string]auditRecord),
+		done:     make(chan struct{}),
+	}
+	if err := a.open(true); err != nil {
+		logger.Warn("access log not readable yet, auditing once it is", zap.String("path", path), zap.Error(err))
+	}
+	return a
+}
+
+// start reads the access log periodically
+func (a *auditor) start() {
+	ticker := newTicker(auditPollInterval)
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				a.poll()
+			case <-a.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops reading the access log
+func (a *auditor) stop() {
+	close(a.done)
+	a.wg.Wait()
+	if a.file != nil {
+		_ = a.file.Close()
+	}
+}
+
+// expect registers an audited request, waiting for its access log entry
+func (a *auditor) expect(id string, record auditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.pending) >= maxAuditPending {
+		return
+	}
+	a.pending[id] = record
+}
+
+// open opens the access log, at its end when following it from now on or
+// at its start after it was rotated
+func (a *auditor) open(atEnd bool) error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	if atEnd {
+		if offset, err = f.Seek(0, io.SeekEnd); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	a.file, a.reader, a.partial, a.offset = f, bufio.NewReader(f), nil, offset
+	return nil
+}
+
+// poll checks the entries appended to the access log since the last poll,
+// following rotations and truncations, and then expires the audited
+// requests whose entries never came
+func (a *auditor) poll() {
+	defer a.expire(now())
+
+	if a.file == nil {
+		if a.open(false) != nil {
+			return
+		}
+	}
+
+	// A truncated log is read again from its start
+	if info, err := a.file.Stat(); err == nil && info.Size() < a.offset {
+		if _, err := a.file.Seek(0, io.SeekStart); err == nil {
+			a.reader.Reset(a.file)
+			a.partial, a.offset = nil, 0
+		}
+	}
+	a.readEntries()
+
+	// A rotated log is read from the start of the new file, once the end
+	// of the old one was read
+	current, err := os.Stat(a.path)
+	if err != nil {
+		return
+	}
+	if opened, err := a.file.Stat(); err == nil && !os.SameFile(opened, current) {
+		_ = a.file.Close()
+		a.file = nil
+		if a.open(false) == nil {
+			a.readEntries()
+		}
+	}
+}
+
+// readEntries checks the complete lines appended to the access log
+func (a *auditor) readEntries() {
+	for {
+		line, err := a.reader.ReadBytes('\n')
+		a.offset += int64(len(line))
+		if err != nil {
+			// Keep incomplete lines until the rest is written
+			a.partial = append(a.partial, line...)
+			if !errors.Is(err, io.EOF) {
+				a.logger.Warn("reading access log", zap.String("path", a.path), zap.Error(err))
+			}
+			return
+		}
+		if len(a.partial) > 0 {
+			line = append(a.partial, line...)
+			a.partial = nil
+		}
+		a.check(line)
+	}
+}
+
+// accessLogEntry is the part of an access log entry checked by audits
+type accessLogEntry struct {
+	Request struct {
+		Headers http.Header `json:"headers"`
+	} `json:"request"`
+	Status   int             `json:"status"`
+	Duration json.RawMessage `json:"duration"`
+}
+
+// check compares an access log entry with the recorded values of its
+// request, if audited. Lines that aren't access log entries are ignored.
+func (a *auditor) check(line []byte) {
+	var entry accessLogEntry
+	if err := json.Unmarshal(line, &entry); err != nil || entry.Request.Headers == nil {
+		return
+	}
+	logged, ok := parseLoggedDuration(entry.Duration)
+	if !ok {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ids := entry.Request.Headers[a.idHeader]
+	if len(ids) == 0 {
+		return
+	}
+	record, ok := a.pending[ids[0]]
+	if !ok {
+		return
+	}
+	delete(a.pending, ids[0])
+
+	result := auditMatch
+	switch {
+	case entry.Status != record.status:
+		result = auditStatusMismatch
+	case logged < record.duration-record.tolerance || logged > record.duration+record.tolerance:
+		result = auditDurationMismatch
+	}
+	record.um.auditChecks.WithLabelValues(result).Inc()
+	if result == auditMatch {
+		return
+	}
+
+	if len(a.discrepancies) == maxAuditDiscrepancies {
+		a.discrepancies = slices.Delete(a.discrepancies, 0, 1)
+	}
+	a.discrepancies = append(a.discrepancies, AuditDiscrepancy{
+		ID:               ids[0],
+		Time:             record.recorded,
+		Result:           result,
+		Method:           record.method,
+		Host:             record.host,
+		Path:             record.path,
+		RecordedStatus:   record.status,
+		LoggedStatus:     entry.Status,
+		RecordedDuration: record.duration.Seconds(),
+		LoggedDuration:   logged.Seconds(),
+	})
+}
+
+// parseLoggedDuration parses the duration of an access log entry, in
+// seconds by default, or as a string with the string duration format
+func parseLoggedDuration(raw json.RawMessage) (time.Duration, bool) {
+	// Decoding null succeeds, leaving a zero duration
+	if bytes.Equal(raw, []byte("null")) {
+		return 0, false
+	}
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err == nil {
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return 0, false
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil
+}
+
+// expire counts the audited requests that waited for their access log
+// entry for too long as unmatched
+func (a *auditor) expire(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for id, record := range a.pending {
+		if now.Sub(record.recorded) > auditMatchWindow {
+			record.um.auditChecks.WithLabelValues(auditUnmatched).Inc()
+			delete(a.pending, id)
+		}
+	}
+}
+
+// collectAudit registers a sample of requests with the auditor, tagging
+// them with a request ID if they have none
+func (uc *UsageCollector) collectAudit(um *usageMetrics, rec recordedResponse, r *http.Request, elapsed time.Duration) {
+	if uc.auditor == nil {
+		return
+	}
+	rate := uc.Audit.SampleRate
+	if rate == 0 {
+		rate = defaultAuditSampleRate
+	}
+	if rate < 1 && rand.Float64() >= rate {
+		return
+	}
+
+	header := uc.Audit.idHeader()
+	id := r.Header.Get(header)
+	if id == "" {
+		id = newAuditID(r)
+		r.Header.Set(header, id)
+	}
+
+	tolerance := defaultAuditTolerance
+	if uc.Audit.Tolerance > 0 {
+		tolerance = time.Duration(uc.Audit.Tolerance)
+	}
+	uc.auditor.expect(id, auditRecord{
+		um:        um,
+		method:    r.Method,
+		host:      r.Host,
+		path:      r.URL.Path,
+		status:    rec.Status(),
+		duration:  elapsed,
+		tolerance: tolerance,
+		recorded:  now(),
+	})
+}
+
+// newAuditID returns Caddy's UUID of a request, or a random ID outside of
+// Caddy
+func newAuditID(r *http.Request) string {
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		if id, ok := repl.GetString("http.request.uuid"); ok && id != "" {
+			return id
+		}
+	}
+	return fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+}
+
+// auditDiscrepancies lists the latest discrepancies found by the running
+// auditors, most recent first
+func auditDiscrepancies() []AuditDiscrepancy {
+	auditorsMu.Lock()
+	running := make([]*auditor, 0, len(auditors))
+	for _, entry := range auditors {
+		running = append(running, entry.auditor)
+	}
+	auditorsMu.Unlock()
+
+	discrepancies := []AuditDiscrepancy{}
+	for _, a := range running {
+		a.mu.Lock()
+		discrepancies = append(discrepancies, a.discrepancies...)
+		a.mu.Unlock()
+	}
+	slices.SortFunc(discrepancies, func(x, y AuditDiscrepancy) int {
+		return y.Time.Compare(x.Time)
+	})
+	return discrepancies
+}
+
+// unmarshalAuditConfig parses an audit block:
+//
+//	audit <access_log> [{
+//	    id_header <name>
+//	    sample_rate <fraction>
+//	    tolerance <duration>
+//	}]
+func unmarshalAuditConfig(d *caddyfile.Dispenser) (*AuditConfig, error) {
+	ac := new(AuditConfig)
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	ac.AccessLog = d.Val()
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		value := d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "id_header":
+			ac.IDHeader = value
+		case "sample_rate":
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, d.Errf("invalid audit sample_rate '%s'", value)
+			}
+			ac.SampleRate = rate
+		case "tolerance":
+			tolerance, err := caddy.ParseDuration(value)
+			if err != nil || tolerance < 0 {
+				return nil, d.Errf("invalid audit tolerance '%s'", value)
+			}
+			ac.Tolerance = caddy.Duration(tolerance)
+		default:
+			return nil, d.Errf("unrecognized audit option '%s'", option)
+		}
+	}
+	return ac, nil
+}
@@ -0,0 +1,180 @@
+package caddyusage
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+	"go.uber.org/zap"
+)
+
+// accessLogLine returns an access log entry of a request, like Caddy's
+func accessLogLine(id string, status int, duration float64) string {
+	return fmt.Sprintf(`{"level":"info","logger":"http.log.access","msg":"handled request","request":{"method":"GET","host":"example.com","uri":"/","headers":{"X-Request-Id":[%q]}},"duration":%g,"status":%d}`+"\n", id, duration, status)
+}
+
+// appendFile appends data to a file
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// TestAuditor tests that access log entries of audited requests are
+// compared with what was recorded, following the log across partial
+// writes and rotations
+func TestAuditor(t *testing.T) {
+	_, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	appendFile(t, path, accessLogLine("old", 500, 9))
+
+	a := newAuditor(path, defaultAuditIDHeader, zap.NewNop())
+	defer a.stop()
+
+	record := auditRecord{um: globalUsageMetrics, method: "GET", host: "example.com", path: "/", status: 200, duration: 50 * time.Millisecond, tolerance: 100 * time.Millisecond, recorded: now()}
+	for _, id := range []string{"old", "match", "status", "duration", "partial", "rotated", "missing"} {
+		a.expect(id, record)
+	}
+
+	// Entries written before the auditor started are skipped
+	line := accessLogLine("partial", 200, 0.05)
+	appendFile(t, path, "not json\n"+accessLogLine("match", 200, 0.06)+accessLogLine("status", 502, 0.05)+
+		accessLogLine("duration", 200, 2)+accessLogLine("unknown", 200, 0.05)+line[:20])
+	a.poll()
+	usagetest.AssertValue(t, registry, "audit_checks_total", usagetest.Labels{"result": auditMatch}, 1)
+	usagetest.AssertValue(t, registry, "audit_checks_total", usagetest.Labels{"result": auditStatusMismatch}, 1)
+	usagetest.AssertValue(t, registry, "audit_checks_total", usagetest.Labels{"result": auditDurationMismatch}, 1)
+
+	// The rest of a partially written entry completes it
+	appendFile(t, path, line[20:])
+	a.poll()
+	usagetest.AssertValue(t, registry, "audit_checks_total", usagetest.Labels{"result": auditMatch}, 2)
+
+	// A rotated log is followed into the new file
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("Failed to rotate %s: %v", path, err)
+	}
+	appendFile(t, path, accessLogLine("rotated", 200, 0.05))
+	a.poll()
+	usagetest.AssertValue(t, registry, "audit_checks_total", usagetest.Labels{"result": auditMatch}, 3)
+
+	// Requests whose entries never come are unmatched
+	clock.Advance(auditMatchWindow + time.Second)
+	a.poll()
+	usagetest.AssertValue(t, registry, "audit_checks_total", usagetest.Labels{"result": auditUnmatched}, 2)
+
+	discrepancies := a.discrepancies
+	if len(discrepancies) != 2 {
+		t.Fatalf("Expected 2 discrepancies, got %+v", discrepancies)
+	}
+	if d := discrepancies[0]; d.ID != "status" || d.RecordedStatus != 200 || d.LoggedStatus != 502 {
+		t.Errorf("Unexpected status discrepancy: %+v", d)
+	}
+	if d := discrepancies[1]; d.ID != "duration" || d.RecordedDuration != 0.05 || d.LoggedDuration != 2 {
+		t.Errorf("Unexpected duration discrepancy: %+v", d)
+	}
+}
+
+// TestParseLoggedDuration tests both duration formats of access logs
+func TestParseLoggedDuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		`0.25`:    250 * time.Millisecond,
+		`"1.5ms"`: 1500 * time.Microsecond,
+	}
+	for raw, expected := range tests {
+		if d, ok := parseLoggedDuration([]byte(raw)); !ok || d != expected {
+			t.Errorf("%s: expected %s, got %s", raw, expected, d)
+		}
+	}
+	for _, raw := range []string{`"soon"`, `null`, ``} {
+		if _, ok := parseLoggedDuration([]byte(raw)); ok {
+			t.Errorf("%s: expected an invalid duration", raw)
+		}
+	}
+}
+
+// TestCollectAudit tests that sampled requests are tagged with an ID and
+// registered with the auditor
+func TestCollectAudit(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.Audit = &AuditConfig{AccessLog: filepath.Join(t.TempDir(), "access.log"), IDHeader: "x-trace-id", SampleRate: 1}
+	uc.auditor = newAuditor(uc.Audit.AccessLog, uc.Audit.idHeader(), zap.NewNop())
+	defer uc.auditor.stop()
+
+	rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+	rec.WriteHeader(http.StatusAccepted)
+
+	tagged := httptest.NewRequest("POST", "http://example.com/jobs", nil)
+	tagged.Header.Set("X-Trace-Id", "abc")
+	untagged := httptest.NewRequest("GET", "http://example.com/", nil)
+	uc.collectMetrics(rec, tagged, now(), nil)
+	uc.collectMetrics(rec, untagged, now(), nil)
+
+	id := untagged.Header.Get("X-Trace-Id")
+	if id == "" {
+		t.Fatal("Expected the audited request to be given an ID")
+	}
+	for _, id := range []string{"abc", id} {
+		if record, ok := uc.auditor.pending[id]; !ok || record.status != http.StatusAccepted {
+			t.Errorf("Expected request %s to be audited with its status, got %+v", id, record)
+		}
+	}
+
+	for name, ac := range map[string]AuditConfig{
+		"missing access log":  {},
+		"invalid sample rate": {AccessLog: "access.log", SampleRate: 2},
+		"negative tolerance":  {AccessLog: "access.log", Tolerance: caddy.Duration(-time.Second)},
+	} {
+		if err := ac.validate(); err == nil {
+			t.Errorf("%s: expected an error but got none", name)
+		}
+	}
+}
+
+// TestUnmarshalAudit tests parsing of the audit option
+func TestUnmarshalAudit(t *testing.T) {
+	var uc UsageCollector
+	input := "usage {\n audit /var/log/caddy/access.log {\n id_header X-Trace-Id\n sample_rate 0.5\n tolerance 250ms\n }\n}"
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := AuditConfig{AccessLog: "/var/log/caddy/access.log", IDHeader: "X-Trace-Id", SampleRate: 0.5, Tolerance: caddy.Duration(250 * time.Millisecond)}
+	if uc.Audit == nil || *uc.Audit != expected {
+		t.Errorf("Expected %+v, got %+v", expected, uc.Audit)
+	}
+
+	for _, invalid := range []string{
+		"usage {\n audit\n}",
+		"usage {\n audit a.log b.log\n}",
+		"usage {\n audit access.log {\n sample_rate 0\n }\n}",
+		"usage {\n audit access.log {\n tolerance soon\n }\n}",
+		"usage {\n audit access.log {\n id_header\n }\n}",
+		"usage {\n audit access.log {\n format json\n }\n}",
+	} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
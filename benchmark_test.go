@@ -7,6 +7,8 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"testing"
 	"time"
 
@@ -301,7 +303,7 @@ func BenchmarkMetricsCollection(b *testing.B) {
 	b.ReportAllocs()
 
 	for i := 0; i < b.N; i++ {
-		uc.collectMetrics(rec, req, startTime)
+		uc.collectMetrics(rec, req, startTime, nil)
 	}
 }
 
@@ -338,7 +340,7 @@ func BenchmarkConcurrentMetricsCollection(b *testing.B) {
 
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			uc.collectMetrics(rec, req, startTime)
+			uc.collectMetrics(rec, req, startTime, nil)
 		}
 	})
 }
@@ -399,8 +401,92 @@ func BenchmarkMemoryUsage(b *testing.B) {
 			b.ReportAllocs()
 
 			for i := 0; i < b.N; i++ {
-				uc.collectMetrics(rec, tc.req, startTime)
+				uc.collectMetrics(rec, tc.req, startTime, nil)
 			}
 		})
 	}
 }
+
+// BenchmarkFastPath compares the allocation-free helpers of the hot path
+// with what they replace
+func BenchmarkFastPath(b *testing.B) {
+	registry := prometheus.NewRegistry()
+	um, err := initializeMetrics(registry)
+	if err != nil {
+		b.Fatalf("Failed to initialize metrics: %v", err)
+	}
+	u, err := url.ParseRequestURI("/api/users/123")
+	if err != nil {
+		b.Fatalf("Failed to parse URL: %v", err)
+	}
+	event := usageEvent{Method: "GET", Host: "example.com", Path: "/api/users/123", Status: 200}
+
+	benchmarks := []struct {
+		name string
+		fn   func()
+	}{
+		{"StatusCode/strconv", func() { _ = strconv.Itoa(404) }},
+		{"StatusCode/table", func() { _ = statusCodeString(404) }},
+		{"URL/String", func() { _ = u.String() }},
+		{"URL/requestURL", func() { _ = requestURL(u) }},
+		{"Series/WithLabelValues", func() {
+			um.requestsTotal.WithLabelValues("200", "GET", "example.com", "/api").Inc()
+			um.requestDuration.WithLabelValues("GET", "200", "example.com").Observe(0.01)
+		}},
+		{"Series/cache", func() {
+			total, durations := um.series.basic(um, "200", "GET", "example.com", "/api")
+			total.Inc()
+			durations.Observe(0.01)
+		}},
+		{"Event/new", func() {
+			e := new(usageEvent)
+			*e = event
+			eventSink = e
+		}},
+		{"Event/pool", func() {
+			e := newUsageEvent(&event)
+			eventSink = e
+			releaseUsageEvent(e)
+		}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bm.fn()
+			}
+		})
+	}
+}
+
+// eventSink keeps benchmarked events escaping, like those handed to sinks
+var eventSink *usageEvent
+
+// BenchmarkCollectMetricsServerRequest benchmarks collection of a request
+// as servers receive it, with a bare path URL
+func BenchmarkCollectMetricsServerRequest(b *testing.B) {
+	registry := prometheus.NewRegistry()
+	metrics, err := initializeMetrics(registry)
+	if err != nil {
+		b.Fatalf("Failed to initialize metrics: %v", err)
+	}
+	originalMetrics := globalUsageMetrics
+	globalUsageMetrics = metrics
+	defer func() { globalUsageMetrics = originalMetrics }()
+
+	uc := &UsageCollector{logger: zap.NewNop(), ctx: caddy.Context{Context: context.Background()}}
+
+	req := httptest.NewRequest("GET", "/api/users/123", nil)
+	req.Host = "example.com"
+	req.RemoteAddr = "192.168.1.100:8080"
+	rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+	rec.WriteHeader(200)
+	startTime := time.Now()
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		uc.collectMetrics(rec, req, startTime, nil)
+	}
+}
@@ -0,0 +1,33 @@
+package caddyusage
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// peekRequestBody reads up to limit bytes of the request body without
+// consuming it: the bytes read are stitched back in front of the remaining
+// body so downstream handlers see the original stream. The second result
+// reports whether the whole body fit within the limit.
+func peekRequestBody(r *http.Request, limit int64) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+
+	peeked, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+
+	// Restore whatever was read, even on error, so the request is unaffected
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peeked), r.Body), r.Body}
+
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(peeked)) > limit {
+		return peeked[:limit], false, nil
+	}
+	return peeked, true, nil
+}
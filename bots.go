@@ -0,0 +1,469 @@
+package caddyusage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Bot verification defaults and bounds
+const (
+	defaultBotTTL         = 24 * time.Hour
+	defaultBotNegativeTTL = time.Hour
+	botLookupTimeout      = 5 * time.Second
+	botSaveInterval       = 5 * time.Minute
+	botQueueSize          = 1024
+	maxBotCacheEntries    = 100000
+)
+
+// Verification outcomes recorded by the bot_requests_total metric
+const (
+	botVerified   = "verified"
+	botUnverified = "unverified"
+	botPending    = "pending"
+)
+
+// knownBot is a crawler that identifies itself by User-Agent and whose
+// addresses reverse-resolve to names under its operator's domains
+type knownBot struct {
+	name    string
+	token   string
+	domains []string
+}
+
+// builtinBots are the crawlers that can be verified, following each
+// operator's published verification procedure. A data bundle can replace
+// them with its bots.json.
+var builtinBots = []knownBot{
+	{name: "googlebot", token: "googlebot", domains: []string{"googlebot.com", "google.com", "googleusercontent.com"}},
+	{name: "bingbot", token: "bingbot", domains: []string{"search.msn.com"}},
+	{name: "applebot", token: "applebot", domains: []string{"applebot.apple.com"}},
+	{name: "yandexbot", token: "yandexbot", domains: []string{"yandex.ru", "yandex.net", "yandex.com"}},
+	{name: "baiduspider", token: "baiduspider", domains: []string{"baidu.com", "baidu.jp"}},
+	{name: "petalbot", token: "petalbot", domains: []string{"petalsearch.com"}},
+}
+
+// matchKnownBot returns the known bot a User-Agent claims to be, if any
+func matchKnownBot(ua string) *knownBot {
+	ua = strings.ToLower(ua)
+	bots := loadedData().bots
+	for i := range bots {
+		if strings.Contains(ua, bots[i].token) {
+			return &bots[i]
+		}
+	}
+	return nil
+}
+
+// BotVerification enables verification of requests claiming to come from
+// well-known crawlers. Claims are checked asynchronously with a reverse DNS
+// lookup of the client address, confirmed by a forward lookup of the name,
+// so verification never delays requests. Results are cached, including
+// failures, and persisted so that they survive restarts.
+type BotVerification struct {
+	// CacheFile is where verification results are persisted. Defaults
+	// to usage/verified_bots.json in Caddy's data directory.
+	CacheFile string `json:"cache_file,omitempty"`
+
+	// TTL is how long a successful verification is trusted. Defaults
+	// to 24 hours.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// NegativeTTL is how long a failed verification is trusted before the
+	// address is checked again. Defaults to 1 hour.
+	NegativeTTL caddy.Duration `json:"negative_ttl,omitempty"`
+}
+
+// validate checks the configured durations
+func (bv *BotVerification) validate() error {
+	if bv.TTL < 0 {
+		return fmt.Errorf("verify_bots ttl must not be negative, got %s", time.Duration(bv.TTL))
+	}
+	if bv.NegativeTTL < 0 {
+		return fmt.Errorf("verify_bots negative_ttl must not be negative, got %s", time.Duration(bv.NegativeTTL))
+	}
+	return nil
+}
+
+// cacheFile returns the configured cache file or its default
+func (bv *BotVerification) cacheFile() string {
+	if bv.CacheFile != "" {
+		return bv.CacheFile
+	}
+	return filepath.Join(caddy.AppDataDir(), "usage", "verified_bots.json")
+}
+
+// botVerdict is the cached outcome of verifying a bot's address
+type botVerdict struct {
+	Verified bool      `json:"verified"`
+	Expires  time.Time `json:"expires"`
+}
+
+// botCheck is a pending verification of a bot's address
+type botCheck struct {
+	bot *knownBot
+	ip  string
+}
+
+// botVerifier verifies bot addresses in the background and caches the
+// results. Handlers configured with the same cache file share a verifier,
+// so config reloads keep its cache and worker.
+type botVerifier struct {
+	path        string
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	cache   map[string]botVerdict
+	pending map[string]struct{}
+	dirty   bool
+
+	queue chan botCheck
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	// Resolver functions, replaceable for testing
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+}
+
+// botVerifierEntry is a shared verifier and the number of handlers using it
+type botVerifierEntry struct {
+	verifier *botVerifier
+	refs     int
+}
+
+var (
+	// Running verifiers by cache file
+	botVerifiers   = make(map[string]*botVerifierEntry)
+	botVerifiersMu sync.Mutex
+)
+
+// acquireBotVerifier returns the running verifier for the configuration's
+// cache file, starting one if needed. Each call must be balanced by a call
+// to releaseBotVerifier.
+func acquireBotVerifier(bv *BotVerification) *botVerifier {
+	botVerifiersMu.Lock()
+	defer botVerifiersMu.Unlock()
+
+	path := bv.cacheFile()
+	if entry, ok := botVerifiers[path]; ok {
+		entry.refs++
+		return entry.verifier
+	}
+
+	verifier := newBotVerifier(path, time.Duration(bv.TTL), time.Duration(bv.NegativeTTL))
+	verifier.start()
+	botVerifiers[path] = &botVerifierEntry{verifier: verifier, refs: 1}
+	return verifier
+}
+
+// releaseBotVerifier releases a handler's use of a verifier, stopping it
+// and persisting its cache once no handler uses it anymore
+func releaseBotVerifier(verifier *botVerifier) error {
+	botVerifiersMu.Lock()
+	defer botVerifiersMu.Unlock()
+
+	entry, ok := botVerifiers[verifier.path]
+	if !ok || entry.verifier != verifier {
+		return nil
+	}
+	if entry.refs--; entry.refs > 0 {
+		return nil
+	}
+	delete(botVerifiers, verifier.path)
+	return verifier.stop()
+}
+
+// newBotVerifier creates a verifier, loading the results persisted in path
+func newBotVerifier(path string, ttl, negativeTTL time.Duration) *botVerifier {
+	if ttl == 0 {
+		ttl = defaultBotTTL
+	}
+	if negativeTTL == 0 {
+		negativeTTL = defaultBotNegativeTTL
+	}
+
+	v := &botVerifier{
+		path:        path,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		cache:       make(map[string]botVerdict),
+		pending:     make(map[string]struct{}),
+		queue:       make(chan botCheck, botQueueSize),
+		done:        make(chan struct{}),
+		lookupAddr:  net.DefaultResolver.LookupAddr,
+		lookupHost:  net.DefaultResolver.LookupHost,
+	}
+	v.load(now())
+	return v
+}
+
+// botCacheKey identifies the verification of a bot at an address
+func botCacheKey(bot *knownBot, ip string) string {
+	return bot.name + " " + ip
+}
+
+// verify returns the verification status of a bot's address. Unknown or
+// expired addresses are queued for verification and reported as pending.
+func (v *botVerifier) verify(bot *knownBot, ip string, now time.Time) string {
+	key := botCacheKey(bot, ip)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if verdict, ok := v.cache[key]; ok && now.Before(verdict.Expires) {
+		if verdict.Verified {
+			return botVerified
+		}
+		return botUnverified
+	}
+
+	if _, ok := v.pending[key]; !ok {
+		select {
+		case v.queue <- botCheck{bot: bot, ip: ip}:
+			v.pending[key] = struct{}{}
+		default:
+			// The queue is full; the address is queued again on a later request
+		}
+	}
+	return botPending
+}
+
+// start runs the verification worker
+func (v *botVerifier) start() {
+	ticker := newTicker(botSaveInterval)
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case check := <-v.queue:
+				v.record(check, v.check(check), now())
+			case <-ticker.C():
+				_ = v.save()
+			case <-v.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the verification worker and persists the cache
+func (v *botVerifier) stop() error {
+	close(v.done)
+	v.wg.Wait()
+	return v.save()
+}
+
+// check reports whether the address reverse-resolves to a name under one
+// of the bot's domains that forward-resolves back to the address
+func (v *botVerifier) check(check botCheck) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), botLookupTimeout)
+	defer cancel()
+
+	names, err := v.lookupAddr(ctx, check.ip)
+	if err != nil {
+		return false
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if !underDomains(name, check.bot.domains) {
+			continue
+		}
+		addrs, err := v.lookupHost(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if normalizeIP(addr) == check.ip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// underDomains reports whether name is one of domains or a subdomain of one
+func underDomains(name string, domains []string) bool {
+	for _, domain := range domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// record caches the outcome of a verification
+func (v *botVerifier) record(check botCheck, verified bool, now time.Time) {
+	ttl := v.negativeTTL
+	if verified {
+		ttl = v.ttl
+	}
+
+	key := botCacheKey(check.bot, check.ip)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.pending, key)
+	if _, ok := v.cache[key]; !ok && len(v.cache) >= maxBotCacheEntries {
+		v.evictExpired(now)
+		if len(v.cache) >= maxBotCacheEntries {
+			return
+		}
+	}
+	v.cache[key] = botVerdict{Verified: verified, Expires: now.Add(ttl)}
+	v.dirty = true
+}
+
+// evictExpired drops expired verdicts. The caller must hold v.mu.
+func (v *botVerifier) evictExpired(now time.Time) {
+	for key, verdict := range v.cache {
+		if !now.Before(verdict.Expires) {
+			delete(v.cache, key)
+		}
+	}
+}
+
+// load reads persisted verdicts, skipping expired ones and keeping the
+// cached ones that expire later. A missing or unreadable cache file just
+// means starting with an empty cache.
+func (v *botVerifier) load(now time.Time) {
+	data, err := os.ReadFile(v.path)
+	if err != nil {
+		return
+	}
+
+	var cache map[string]botVerdict
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for key, verdict := range cache {
+		if !now.Before(verdict.Expires) {
+			continue
+		}
+		if cached, ok := v.cache[key]; ok {
+			if verdict.Expires.After(cached.Expires) {
+				v.cache[key] = verdict
+			}
+		} else if len(v.cache) < maxBotCacheEntries {
+			v.cache[key] = verdict
+		}
+	}
+}
+
+// save persists the cache if it changed since it was last saved. Caddy
+// instances may share the file, so their verdicts saved since it was
+// loaded are merged in under the file's lock. The file is replaced
+// atomically so that a crash never leaves it truncated.
+func (v *botVerifier) save() error {
+	v.mu.Lock()
+	dirty := v.dirty
+	v.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	lock, err := lockFile(v.path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = lock.unlock() }()
+
+	v.load(now())
+
+	v.mu.Lock()
+	v.evictExpired(now())
+	data, err := json.Marshal(v.cache)
+	v.dirty = false
+	v.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(v.path, data, 0o600)
+}
+
+// collectBotMetrics counts requests claiming to come from a known bot by
+// verification status
+func (uc *UsageCollector) collectBotMetrics(um *usageMetrics, r *http.Request) {
+	if uc.botVerifier == nil {
+		return
+	}
+	bot := matchKnownBot(r.UserAgent())
+	if bot == nil {
+		return
+	}
+
+	// Verify the connecting address, as determined by Caddy's trusted
+	// proxies, since forwarding headers are trivially spoofed
+	addr := r.RemoteAddr
+	if ip, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string); ok && ip != "" {
+		addr = ip
+	}
+
+	status := uc.botVerifier.verify(bot, normalizeIP(addr), now())
+	um.botRequests.WithLabelValues(bot.name, status).Inc()
+}
+
+// unmarshalBotVerification parses a verify_bots directive, whose block
+// is optional:
+//
+//	verify_bots [{
+//	    cache_file <path>
+//	    ttl <duration>
+//	    negative_ttl <duration>
+//	}]
+func unmarshalBotVerification(d *caddyfile.Dispenser) (*BotVerification, error) {
+	bv := new(BotVerification)
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		value := d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "cache_file":
+			bv.CacheFile = value
+		case "ttl", "negative_ttl":
+			dur, err := caddy.ParseDuration(value)
+			if err != nil {
+				return nil, d.Errf("invalid %s '%s': %v", option, value, err)
+			}
+			if option == "ttl" {
+				bv.TTL = caddy.Duration(dur)
+			} else {
+				bv.NegativeTTL = caddy.Duration(dur)
+			}
+		default:
+			return nil, d.Errf("unrecognized verify_bots option '%s'", option)
+		}
+	}
+
+	return bv, nil
+}
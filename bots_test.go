@@ -0,0 +1,241 @@
+package caddyusage
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeResolver resolves from fixed tables
+type fakeResolver struct {
+	ptr map[string][]string
+	a   map[string][]string
+}
+
+func (f fakeResolver) lookupAddr(_ context.Context, addr string) ([]string, error) {
+	if names, ok := f.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, errors.New("no PTR record")
+}
+
+func (f fakeResolver) lookupHost(_ context.Context, host string) ([]string, error) {
+	if addrs, ok := f.a[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no A record")
+}
+
+// newTestBotVerifier returns a verifier with a fake resolver, not started
+func newTestBotVerifier(t *testing.T, path string) *botVerifier {
+	t.Helper()
+
+	resolver := fakeResolver{
+		ptr: map[string][]string{
+			"66.249.66.1":  {"crawl-66-249-66-1.googlebot.com."},
+			"203.0.113.9":  {"crawl.googlebot.com.attacker.example."},
+			"198.51.100.7": {"fake.googlebot.com."},
+		},
+		a: map[string][]string{
+			"crawl-66-249-66-1.googlebot.com": {"66.249.66.1"},
+			"fake.googlebot.com":              {"192.0.2.1"},
+		},
+	}
+
+	v := newBotVerifier(path, 0, 0)
+	v.lookupAddr = resolver.lookupAddr
+	v.lookupHost = resolver.lookupHost
+	return v
+}
+
+// TestMatchKnownBot tests bot recognition by User-Agent
+func TestMatchKnownBot(t *testing.T) {
+	tests := []struct {
+		ua       string
+		expected string
+	}{
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "googlebot"},
+		{"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", "bingbot"},
+		{"Mozilla/5.0 (compatible; Baiduspider/2.0)", "baiduspider"},
+		{"Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ua, func(t *testing.T) {
+			var got string
+			if bot := matchKnownBot(tt.ua); bot != nil {
+				got = bot.name
+			}
+			if got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestBotVerifierCheck tests reverse DNS verification with forward confirmation
+func TestBotVerifierCheck(t *testing.T) {
+	v := newTestBotVerifier(t, filepath.Join(t.TempDir(), "bots.json"))
+	googlebot := matchKnownBot("Googlebot")
+
+	tests := []struct {
+		name     string
+		ip       string
+		expected bool
+	}{
+		{"genuine", "66.249.66.1", true},
+		{"name outside the bot's domains", "203.0.113.9", false},
+		{"name not resolving back", "198.51.100.7", false},
+		{"no reverse name", "192.0.2.50", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := v.check(botCheck{bot: googlebot, ip: tt.ip}); got != tt.expected {
+				t.Errorf("Expected verified=%v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestBotVerifierCache tests that verification happens off the request
+// path, and that results, including failures, are cached and persisted
+func TestBotVerifierCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage", "bots.json")
+	v := newTestBotVerifier(t, path)
+	googlebot := matchKnownBot("Googlebot")
+	now := time.Now()
+
+	// Unknown addresses are pending and queued once
+	for range 2 {
+		if got := v.verify(googlebot, "66.249.66.1", now); got != botPending {
+			t.Fatalf("Expected %s, got %s", botPending, got)
+		}
+	}
+	v.verify(googlebot, "198.51.100.7", now)
+	if len(v.queue) != 2 {
+		t.Fatalf("Expected 2 queued checks, got %d", len(v.queue))
+	}
+
+	// Process the queue like the worker does
+	for len(v.queue) > 0 {
+		check := <-v.queue
+		v.record(check, v.check(check), now)
+	}
+	if got := v.verify(googlebot, "66.249.66.1", now); got != botVerified {
+		t.Errorf("Expected %s, got %s", botVerified, got)
+	}
+	if got := v.verify(googlebot, "198.51.100.7", now); got != botUnverified {
+		t.Errorf("Expected %s, got %s", botUnverified, got)
+	}
+
+	// Failures expire sooner than successes
+	later := now.Add(2 * defaultBotNegativeTTL)
+	if got := v.verify(googlebot, "66.249.66.1", later); got != botVerified {
+		t.Errorf("Expected %s after the negative TTL, got %s", botVerified, got)
+	}
+	if got := v.verify(googlebot, "198.51.100.7", later); got != botPending {
+		t.Errorf("Expected %s after the negative TTL, got %s", botPending, got)
+	}
+
+	// Results survive a restart
+	if err := v.save(); err != nil {
+		t.Fatalf("Failed to save cache: %v", err)
+	}
+	restarted := newTestBotVerifier(t, path)
+	if got := restarted.verify(googlebot, "66.249.66.1", now); got != botVerified {
+		t.Errorf("Expected %s after restart, got %s", botVerified, got)
+	}
+}
+
+// TestBotMetrics tests that handlers share a verifier and count bot
+// requests by verification status
+func TestBotMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	cfg := &BotVerification{CacheFile: filepath.Join(t.TempDir(), "bots.json")}
+	uc.VerifyBots = cfg
+	if err := uc.Provision(uc.ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	other := &UsageCollector{VerifyBots: cfg}
+	if err := other.Provision(uc.ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if uc.botVerifier != other.botVerifier {
+		t.Error("Expected handlers with the same cache file to share a verifier")
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Googlebot/2.1)")
+	uc.collectBotMetrics(globalUsageMetrics, req)
+	uc.collectBotMetrics(globalUsageMetrics, httptest.NewRequest("GET", "http://example.com/", nil))
+
+	if got := testutil.ToFloat64(globalUsageMetrics.botRequests.WithLabelValues("googlebot", botPending)); got != 1 {
+		t.Errorf("Expected 1 pending googlebot request, got %v", got)
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.botRequests); n != 1 {
+		t.Errorf("Expected requests without a bot User-Agent to be ignored, got %d series", n)
+	}
+
+	for _, h := range []*UsageCollector{uc, other} {
+		if err := h.Cleanup(); err != nil {
+			t.Fatalf("Cleanup failed: %v", err)
+		}
+	}
+	if _, ok := botVerifiers[cfg.CacheFile]; ok {
+		t.Error("Expected the verifier to be stopped after the last cleanup")
+	}
+}
+
+// TestUnmarshalBotVerification tests parsing of the verify_bots option
+func TestUnmarshalBotVerification(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *BotVerification
+		expectErr bool
+	}{
+		{input: "usage {\n verify_bots\n}", expected: &BotVerification{}},
+		{
+			input: "usage {\n verify_bots {\n cache_file /var/lib/caddy/bots.json\n ttl 12h\n negative_ttl 30m\n }\n}",
+			expected: &BotVerification{
+				CacheFile:   "/var/lib/caddy/bots.json",
+				TTL:         caddy.Duration(12 * time.Hour),
+				NegativeTTL: caddy.Duration(30 * time.Minute),
+			},
+		},
+		{input: "usage {\n verify_bots on\n}", expectErr: true},
+		{input: "usage {\n verify_bots {\n ttl\n }\n}", expectErr: true},
+		{input: "usage {\n verify_bots {\n ttl soon\n }\n}", expectErr: true},
+		{input: "usage {\n verify_bots {\n workers 4\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.VerifyBots, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.VerifyBots)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package caddyusage
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Results of caches for a response, as the result label of
+// cache_results_total
+const (
+	cacheHit    = "hit"
+	cacheMiss   = "miss"
+	cacheBypass = "bypass"
+)
+
+// defaultCacheHeaders are the response headers read for cache results when
+// none are configured, in order of precedence
+var defaultCacheHeaders = []string{"Cache-Status", "Cf-Cache-Status", "X-Cache-Status", "X-Cache", "Age"}
+
+// CacheResultsConfig records whether responses came from a cache, read from
+// the response headers that caches and CDNs add, in the
+// cache_results_total metric by host and path.
+type CacheResultsConfig struct {
+	// Headers lists the response headers read, in order of precedence:
+	// the first one present decides. Cache-Status is read as RFC 9211, Age
+	// as a hit when positive, and other headers by their keywords, such as
+	// HIT, MISS or BYPASS. Defaults to Cache-Status, Cf-Cache-Status,
+	// X-Cache-Status, X-Cache and Age.
+	Headers []string `json:"headers,omitempty"`
+}
+
+// headers returns the configured headers or their default
+func (cc *CacheResultsConfig) headers() []string {
+	if len(cc.Headers) > 0 {
+		return cc.Headers
+	}
+	return defaultCacheHeaders
+}
+
+// cacheResult returns the cache result of a response, or "" when none of
+// the headers tells it
+func (cc *CacheResultsConfig) cacheResult(header http.Header) string {
+	for _, name := range cc.headers() {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+
+		var result string
+		switch http.CanonicalHeaderKey(name) {
+		case "Cache-Status":
+			result = cacheStatusResult(value)
+		case "Age":
+			if age, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && age >= 0 {
+				result = cacheMiss
+				if age > 0 {
+					result = cacheHit
+				}
+			}
+		default:
+			result = cacheKeywordResult(value)
+		}
+		if result != "" {
+			return result
+		}
+	}
+	return ""
+}
+
+// cacheStatusResult reads an RFC 9211 Cache-Status header. Its last member
+// is the cache closest to the client, which decides: a hit, a bypass when
+// forwarded with fwd=bypass, or a miss.
+func cacheStatusResult(value string) string {
+	members := strings.Split(value, ",")
+	params := strings.Split(members[len(members)-1], ";")
+	if strings.TrimSpace(params[0]) == "" {
+		return ""
+	}
+
+	result := cacheMiss
+	for _, param := range params[1:] {
+		key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch strings.ToLower(key) {
+		case "hit":
+			if val == "" || val == "?1" {
+				return cacheHit
+			}
+		case "fwd":
+			if strings.EqualFold(strings.Trim(val, `"`), "bypass") {
+				result = cacheBypass
+			}
+		}
+	}
+	return result
+}
+
+// cacheKeywordResult reads headers like X-Cache and Cf-Cache-Status, whose
+// values name the result, such as HIT, TCP_MISS or "Hit from cloudfront".
+// With several caches listed, the last, closest to the client, decides.
+func cacheKeywordResult(value string) string {
+	values := strings.Split(value, ",")
+	value = strings.ToUpper(strings.TrimSpace(values[len(values)-1]))
+
+	switch {
+	case strings.Contains(value, "MISS"), strings.Contains(value, "EXPIRED"):
+		return cacheMiss
+	case strings.Contains(value, "HIT"), strings.Contains(value, "STALE"),
+		strings.Contains(value, "REVALIDATED"), strings.Contains(value, "UPDATING"):
+		return cacheHit
+	case strings.Contains(value, "BYPASS"), strings.Contains(value, "PASS"),
+		strings.Contains(value, "DYNAMIC"), strings.Contains(value, "UNCACHEABLE"):
+		return cacheBypass
+	}
+	return ""
+}
+
+// collectCacheMetrics records the cache result of a response
+func (uc *UsageCollector) collectCacheMetrics(um *usageMetrics, header http.Header, host, path string) {
+	if uc.CacheResults == nil {
+		return
+	}
+	if result := uc.CacheResults.cacheResult(header); result != "" {
+		um.cacheResults.WithLabelValues(result, host, path).Inc()
+	}
+}
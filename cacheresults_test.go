@@ -0,0 +1,105 @@
+package caddyusage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestCacheResult tests reading cache results from response headers
+func TestCacheResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected string
+	}{
+		{"no cache headers", http.Header{"Content-Type": {"text/html"}}, ""},
+		{"cache status hit", http.Header{"Cache-Status": {"ExampleCache; hit; ttl=30"}}, cacheHit},
+		{"cache status miss", http.Header{"Cache-Status": {"ExampleCache; fwd=uri-miss"}}, cacheMiss},
+		{"cache status bypass", http.Header{"Cache-Status": {"ExampleCache; fwd=bypass"}}, cacheBypass},
+		{"cache status closest to client", http.Header{"Cache-Status": {"Origin; hit, CDN; fwd=stale"}}, cacheMiss},
+		{"cloudflare hit", http.Header{"Cf-Cache-Status": {"HIT"}}, cacheHit},
+		{"cloudflare dynamic", http.Header{"Cf-Cache-Status": {"DYNAMIC"}}, cacheBypass},
+		{"cloudflare expired", http.Header{"Cf-Cache-Status": {"EXPIRED"}}, cacheMiss},
+		{"cloudfront", http.Header{"X-Cache": {"Hit from cloudfront"}}, cacheHit},
+		{"squid", http.Header{"X-Cache": {"TCP_MISS"}}, cacheMiss},
+		{"fastly shield and edge", http.Header{"X-Cache": {"MISS, HIT"}}, cacheHit},
+		{"nginx bypass", http.Header{"X-Cache-Status": {"BYPASS"}}, cacheBypass},
+		{"unknown keyword falls through", http.Header{"X-Cache": {"Error from cloudfront"}, "Age": {"12"}}, cacheHit},
+		{"fresh from origin", http.Header{"Age": {"0"}}, cacheMiss},
+		{"invalid age", http.Header{"Age": {"old"}}, ""},
+		{"precedence", http.Header{"Cache-Status": {"CDN; hit"}, "X-Cache": {"MISS"}}, cacheHit},
+	}
+
+	cc := &CacheResultsConfig{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cc.cacheResult(tt.header); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	// Only the configured headers are read
+	cc = &CacheResultsConfig{Headers: []string{"x-edge-result"}}
+	if got := cc.cacheResult(http.Header{"X-Cache": {"HIT"}}); got != "" {
+		t.Errorf("Expected unconfigured headers to be ignored, got %q", got)
+	}
+	if got := cc.cacheResult(http.Header{"X-Edge-Result": {"miss"}}); got != cacheMiss {
+		t.Errorf("Expected a miss from the configured header, got %q", got)
+	}
+}
+
+// TestCacheResultMetrics tests counting cache results by host and path
+func TestCacheResultMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	collect := func(path, cacheStatus string) {
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		if cacheStatus != "" {
+			rec.Header().Set("X-Cache", cacheStatus)
+		}
+		rec.WriteHeader(200)
+		uc.collectMetrics(rec, httptest.NewRequest("GET", "http://example.com"+path, nil), now(), nil)
+	}
+
+	// Disabled by default
+	collect("/logo.png", "HIT")
+	usagetest.AssertAbsent(t, registry, "cache_results_total", nil)
+
+	uc.CacheResults = &CacheResultsConfig{}
+	collect("/logo.png", "HIT")
+	collect("/logo.png", "HIT")
+	collect("/logo.png", "MISS")
+	collect("/api", "")
+
+	usagetest.AssertValue(t, registry, "cache_results_total", usagetest.Labels{"result": cacheHit, "host": "example.com", "path": "/logo.png"}, 2)
+	usagetest.AssertValue(t, registry, "cache_results_total", usagetest.Labels{"result": cacheMiss, "host": "example.com", "path": "/logo.png"}, 1)
+	usagetest.AssertAbsent(t, registry, "cache_results_total", usagetest.Labels{"path": "/api"})
+}
+
+// TestUnmarshalCacheResults tests parsing of the cache_results option
+func TestUnmarshalCacheResults(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected *CacheResultsConfig
+	}{
+		{"usage {\n cache_results\n}", &CacheResultsConfig{}},
+		{"usage {\n cache_results Cf-Cache-Status Age\n}", &CacheResultsConfig{Headers: []string{"Cf-Cache-Status", "Age"}}},
+	}
+	for _, tt := range tests {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(uc.CacheResults, tt.expected) {
+			t.Errorf("Expected %+v, got %+v", tt.expected, uc.CacheResults)
+		}
+	}
+}
@@ -1,9 +1,17 @@
 package caddyusage
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -26,16 +34,161 @@ type usageMetrics struct {
 	requestsByURL     *prometheus.CounterVec
 	requestsByHeaders *prometheus.CounterVec
 	requestDuration   *prometheus.HistogramVec
+	ttfb              *prometheus.HistogramVec
+	routeRequests     *prometheus.CounterVec
+	routeDuration     *prometheus.HistogramVec
+	requestsByCookie  *prometheus.CounterVec
+	cookieHeaderSize  *prometheus.HistogramVec
+
+	errorRouteRequests *prometheus.CounterVec
+	handlerErrors      *prometheus.CounterVec
+	handlerPanics      *prometheus.CounterVec
+	rateLimited        *prometheus.CounterVec
+	labelPolicyHits    *prometheus.CounterVec
+	costUnits          *prometheus.CounterVec
+	llmTokens          *prometheus.CounterVec
+	rpcRequests        *prometheus.CounterVec
+	rpcDuration        *prometheus.HistogramVec
+	soapRequests       *prometheus.CounterVec
+	soapDuration       *prometheus.HistogramVec
+	inspectedRequests  *prometheus.CounterVec
+	protocolAnomalies  *prometheus.CounterVec
+	sniMismatches      *prometheus.CounterVec
+	degradedRequests   *prometheus.CounterVec
+	overBudget         *prometheus.CounterVec
+	failures           *prometheus.CounterVec
+	upstreamRequests   *prometheus.CounterVec
+	upstreamLatency    *prometheus.HistogramVec
+	upstreamDuration   *prometheus.HistogramVec
+	apdexRequests      *prometheus.CounterVec
+	requestsByProtocol *prometheus.CounterVec
+	responsesByType    *prometheus.CounterVec
+	tlsRequests        *prometheus.CounterVec
+	scrapes            *prometheus.CounterVec
+	lastScrape         *prometheus.GaugeVec
+	botRequests        *prometheus.CounterVec
+	serverTiming       *prometheus.HistogramVec
+	cacheResults       *prometheus.CounterVec
+	requestsByASN      *prometheus.CounterVec
+	classifiedRequests *prometheus.CounterVec
+	requestsByReferrer *prometheus.CounterVec
+	divertedRequests   *prometheus.CounterVec
+	auditChecks        *prometheus.CounterVec
+	campaignRequests   *prometheus.CounterVec
+	requestsByUser     *prometheus.CounterVec
+	apiKeyRequests     *prometheus.CounterVec
+	apiKeyBytes        *prometheus.CounterVec
+	apiKeyDuration     *prometheus.HistogramVec
+	quotaExceeded      *prometheus.CounterVec
+	streamFirstByte    *prometheus.HistogramVec
+	streamDuration     *prometheus.HistogramVec
+	requestsByClass    *prometheus.CounterVec
+	errorsTotal        *prometheus.CounterVec
+
+	// Sliding-window distinct counters backing the active_* gauges
+	activePaths   *windowedSketch
+	activeHosts   *windowedSketch
+	activeClients *windowedSketch
+
+	// Sliding-window distinct counters backing the unique_clients gauges,
+	// by window label
+	uniqueClients map[string]*windowedSketch
+
+	// Sliding-window counts backing the apdex_score gauge
+	apdex *apdexWindow
+
+	// Sliding-window per-host totals backing the pre-aggregated series
+	aggregates *hostAggregates
+
+	// Heavy hitter trackers backing the top_* gauges
+	topPaths      *topKTracker
+	topClients    *topKTracker
+	topUserAgents *topKTracker
+
+	// URLs of sampled response bodies backing the duplicate_content_*
+	// gauges
+	contents *contentIndex
+
+	// Resolved series of the basic request metrics
+	series *seriesCache
+
+	// Relabeling rules applied to the series as they are collected
+	relabel atomic.Pointer[relabeling]
+
+	// collectors are the metrics' collectors as the usage gatherer exports
+	// them, and registered the ones registered with Caddy's registry,
+	// whose scrapes can reset the vectors in delta temporality mode
+	collectors []prometheus.Collector
+	registered []prometheus.Collector
 }
 
+// defaultActiveWindow is the sliding window used by the active_* gauges
+// when no active_window is configured
+const defaultActiveWindow = 5 * time.Minute
+
+// defaultMetricsNamespace prefixes the shared usage metrics
+const defaultMetricsNamespace = "caddy"
+
+// metricsNamespaceRegexp matches namespaces that form valid metric names
+var metricsNamespaceRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+
 var (
 	// Global metrics instance
 	globalUsageMetrics *usageMetrics
+
+	// Metrics of handlers configured with their own namespace, by
+	// namespace. The pool keeps a namespace's counters, sketches and
+	// aggregates across config reloads, as long as a handler uses it.
+	namespacedMetrics = caddy.NewUsagePool()
 )
 
+// namespaceMetrics is the metric set of a namespace and the registry it is
+// exposed by
+type namespaceMetrics struct {
+	mu       sync.Mutex
+	metrics  *usageMetrics
+	registry prometheus.Registerer
+}
+
+// Destruct implements caddy.Destructor, unregistering the metrics
+func (nm *namespaceMetrics) Destruct() error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	nm.metrics.unregister(nm.registry)
+	return nil
+}
+
+// reregister exposes the metrics through the registry of a newly loaded
+// config, since Caddy creates a registry per config
+func (nm *namespaceMetrics) reregister(registry prometheus.Registerer) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if registry == nm.registry {
+		return nil
+	}
+	if err := nm.metrics.register(registry); err != nil {
+		nm.metrics.unregister(registry)
+		return err
+	}
+	nm.registry = registry
+	return nil
+}
+
 // initializeMetrics creates and registers all usage metrics with Caddy's metrics registry
 func initializeMetrics(registry prometheus.Registerer) (*usageMetrics, error) {
-	const ns, sub = "caddy", "usage"
+	return initializeNamespacedMetrics(registry, defaultMetricsNamespace)
+}
+
+// initializeNamespacedMetrics creates and registers all usage metrics under
+// the given namespace, named <namespace>_usage_*
+func initializeNamespacedMetrics(registry prometheus.Registerer, ns string) (*usageMetrics, error) {
+	const sub = "usage"
+
+	activePaths := newWindowedSketch(defaultActiveWindow)
+	activeHosts := newWindowedSketch(defaultActiveWindow)
+	activeClients := newWindowedSketch(defaultActiveWindow)
 
 	metrics := &usageMetrics{
 		// Total requests by status code, method, and host
@@ -93,238 +246,2873 @@ func initializeMetrics(registry prometheus.Registerer) (*usageMetrics, error) {
 			},
 			[]string{"method", "status_code", "host"},
 		),
-	}
 
-	// Register each metric with Caddy's registry
-	collectors := []prometheus.Collector{
-		metrics.requestsTotal,
-		metrics.requestsByIP,
-		metrics.requestsByURL,
-		metrics.requestsByHeaders,
-		metrics.requestDuration,
-	}
+		// Time to first byte, apart from the transfer that follows
+		ttfb: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "ttfb_seconds",
+				Help:      "Time from the start of requests until their response headers or body were first written downstream, in seconds",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"method", "status_code", "host"},
+		),
 
-	for _, collector := range collectors {
-		if err := registry.Register(collector); err != nil {
-			// Check if it's already registered error, which is expected on config reload
-			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
-				// If it's not an AlreadyRegisteredError, return the actual error
-				return nil, err
-			}
-			// If it's AlreadyRegisteredError, continue - this is expected
-		}
-	}
+		// Requests by the logical route named by route_name
+		routeRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "route_requests_total",
+				Help:      "Total number of requests by the route named by the handler's route_name, status code and method",
+			},
+			[]string{"route", "status_code", "method"},
+		),
+		routeDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "route_request_duration_seconds",
+				Help:      "HTTP request duration in seconds by the route named by the handler's route_name and status code",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"route", "status_code"},
+		),
 
-	return metrics, nil
-}
+		// Requests by status class, for error rates without status regexes
+		requestsByClass: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "requests_by_class_total",
+				Help:      "Total number of requests by HTTP status class (1xx to 5xx), host and method",
+			},
+			[]string{"class", "host", "method"},
+		),
 
-// registerMetrics registers all usage metrics with the provided Prometheus registry
-func registerMetrics(registry prometheus.Registerer) error {
-	// Try to initialize metrics - may handle AlreadyRegisteredError gracefully
-	metrics, err := initializeMetrics(registry)
-	if err != nil {
-		return err
-	}
+		// Requests answered with a server error
+		errorsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "errors_total",
+				Help:      "Total number of requests answered with a 5xx status, by host and method",
+			},
+			[]string{"host", "method"},
+		),
 
-	// Set the global metrics instance if it's nil
-	// On config reload, this ensures we continue using metrics even if some were already registered
-	if globalUsageMetrics == nil {
-		globalUsageMetrics = metrics
-	}
+		// Requests by presence of configured cookie names (values are never recorded)
+		requestsByCookie: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "requests_by_cookie_total",
+				Help:      "Total number of requests by presence of configured cookie names",
+			},
+			[]string{"cookie_name", "present", "host"},
+		),
 
-	return nil
-}
+		// Total Cookie header size histogram
+		cookieHeaderSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "cookie_header_bytes",
+				Help:      "Total size of the request Cookie headers in bytes",
+				Buckets:   []float64{0, 64, 256, 512, 1024, 2048, 4096, 8192},
+			},
+			[]string{"host"},
+		),
 
-// UsageCollector is a Caddy HTTP handler that collects comprehensive request metrics
-// and integrates them with Caddy's built-in metrics system. It tracks response status codes,
-// client IPs, requested URLs, and request headers.
-type UsageCollector struct {
-	logger *zap.Logger
-	ctx    caddy.Context
-}
+		// Error-route invocations by the error that triggered them
+		errorRouteRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "error_route_requests_total",
+				Help:      "Total number of requests handled by error routes by original status and trigger",
+			},
+			[]string{"original_status", "trigger", "host"},
+		),
 
-// CaddyModule returns the Caddy module information
-func (UsageCollector) CaddyModule() caddy.ModuleInfo {
-	return caddy.ModuleInfo{
-		ID:  "http.handlers.usage",
-		New: func() caddy.Module { return new(UsageCollector) },
-	}
-}
+		// Errors returned by downstream handlers
+		handlerErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "handler_errors_total",
+				Help:      "Total number of errors returned by downstream handlers by error type, status code and host",
+			},
+			[]string{"type", "status_code", "host"},
+		),
 
-// Provision sets up the UsageCollector with necessary resources
-func (uc *UsageCollector) Provision(ctx caddy.Context) error {
-	uc.ctx = ctx
-	uc.logger = ctx.Logger(uc)
+		// Panics in downstream handlers
+		handlerPanics: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "handler_panics_total",
+				Help:      "Total number of panics in downstream handlers by host",
+			},
+			[]string{"host"},
+		),
 
-	// Register metrics with Caddy's internal metrics registry
-	if registry := ctx.GetMetricsRegistry(); registry != nil {
-		if err := registerMetrics(registry); err != nil {
-			uc.logger.Warn("failed to register usage metrics", zap.Error(err))
-		}
-	} else {
-		uc.logger.Warn("metrics registry not available, disabling metrics")
-	}
+		// Requests rejected by the rate_limit handler
+		rateLimited: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "rate_limited_total",
+				Help:      "Total number of requests rejected by the rate_limit handler by zone",
+			},
+			[]string{"zone"},
+		),
 
-	uc.logger.Info("usage collector provisioned successfully")
-	return nil
-}
+		// Label policy rule hits, for auditing cardinality and privacy decisions
+		labelPolicyHits: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "label_policy_hits_total",
+				Help:      "Total number of label values decided or transformed by label policy rules",
+			},
+			[]string{"label", "action", "rule"},
+		),
 
-// ServeHTTP implements the HTTP handler interface. This is where we collect
-// metrics at the end of the request cycle to avoid interfering with the request.
-func (uc *UsageCollector) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	// Record start time for duration calculation
-	startTime := time.Now()
+		// Usage units reported by upstream applications
+		costUnits: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "cost_units_total",
+				Help:      "Total usage units reported by upstream response headers or trailers by tenant",
+			},
+			[]string{"tenant", "source"},
+		),
 
-	// Create a response recorder to capture status code
-	rec := caddyhttp.NewResponseRecorder(w, nil, nil)
+		// LLM tokens consumed per API key and model
+		llmTokens: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "llm_tokens_total",
+				Help:      "Total number of LLM tokens reported by completion responses by API key, model and token type",
+			},
+			[]string{"api_key", "model", "type"},
+		),
 
-	// Continue with the next handler in the chain
-	err := next.ServeHTTP(rec, r)
+		// JSON-RPC calls by method
+		rpcRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "rpc_requests_total",
+				Help:      "Total number of JSON-RPC calls by method and HTTP status code",
+			},
+			[]string{"rpc_method", "status"},
+		),
 
-	// Write the recorded response back to the client
-	if writeErr := rec.WriteResponse(); writeErr != nil {
-		uc.logger.Warn("failed to write response", zap.Error(writeErr))
-	}
+		// JSON-RPC request duration by method
+		rpcDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "rpc_request_duration_seconds",
+				Help:      "JSON-RPC request duration in seconds by method",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"rpc_method"},
+		),
 
-	// Collect metrics after the request has been processed
-	uc.collectMetrics(rec, r, startTime)
+		// SOAP requests by action
+		soapRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "soap_requests_total",
+				Help:      "Total number of SOAP requests by action and HTTP status code",
+			},
+			[]string{"soap_action", "status"},
+		),
 
-	return err
-}
+		// SOAP request duration by action
+		soapDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "soap_request_duration_seconds",
+				Help:      "SOAP request duration in seconds by action",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"soap_action"},
+		),
 
-// collectMetrics gathers all the comprehensive metrics from the completed request
-func (uc *UsageCollector) collectMetrics(rec caddyhttp.ResponseRecorder, r *http.Request, startTime time.Time) {
-	// Use global metrics instance
-	if globalUsageMetrics == nil {
-		uc.logger.Error("usage metrics not initialized")
-		return
-	}
+		// Requests by label values derived from their bodies
+		inspectedRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "inspected_requests_total",
+				Help:      "Total number of requests by inspector, inspected body value and HTTP status code",
+			},
+			[]string{"inspector", "value", "status"},
+		),
 
-	// Calculate request duration
-	duration := time.Since(startTime).Seconds()
+		// Requests showing request smuggling or protocol probing indicators
+		protocolAnomalies: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "protocol_anomalies_total",
+				Help:      "Total number of requests with HTTP protocol anomalies by anomaly type",
+			},
+			[]string{"type"},
+		),
 
-	// Get basic request information
-	statusCode := strconv.Itoa(rec.Status())
-	method := r.Method
-	host := r.Host
-	path := r.URL.Path
-	fullURL := r.URL.String()
-	clientIP := getClientIP(r)
+		// TLS requests whose SNI differs from the Host header
+		sniMismatches: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "sni_mismatch_total",
+				Help:      "Total number of TLS requests whose SNI differs from the Host header by registrable domain",
+			},
+			[]string{"sni_domain", "host_domain"},
+		),
 
-	// Update basic request metrics
+		// Requests shed by protective limits rather than failing organically
+		degradedRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "degraded_requests_total",
+				Help:      "Total number of requests shed by rate limits, exhausted upstreams or deliberate load shedding by reason",
+			},
+			[]string{"reason"},
+		),
 
-	globalUsageMetrics.requestsTotal.WithLabelValues(statusCode, method, host, path).Inc()
-	globalUsageMetrics.requestsByIP.WithLabelValues(clientIP, statusCode, method).Inc()
-	globalUsageMetrics.requestsByURL.WithLabelValues(fullURL, method, statusCode).Inc()
-	globalUsageMetrics.requestDuration.WithLabelValues(method, statusCode, host).Observe(duration)
+		// Failed requests by where the failure originated
+		failures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "failures_total",
+				Help:      "Total number of failed requests by origin (client, upstream or edge) and category",
+			},
+			[]string{"origin", "category"},
+		),
 
-	// Collect metrics for important headers
-	uc.collectHeaderMetrics(globalUsageMetrics, r, method, statusCode)
-}
+		// Requests proxied by reverse_proxy by upstream
+		upstreamRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "upstream_requests_total",
+				Help:      "Total number of requests proxied by reverse_proxy by upstream and the upstream's status code",
+			},
+			[]string{"upstream", "status_code"},
+		),
+		upstreamLatency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "upstream_latency_seconds",
+				Help:      "Time until upstreams sent their response headers in seconds by upstream",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"upstream"},
+		),
+		upstreamDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "upstream_duration_seconds",
+				Help:      "Time spent proxying requests to upstreams, including their response bodies, in seconds by upstream",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"upstream"},
+		),
 
-// collectHeaderMetrics extracts and records metrics for important HTTP headers
-func (uc *UsageCollector) collectHeaderMetrics(um *usageMetrics, r *http.Request, method, statusCode string) {
-	// List of headers we want to track
-	importantHeaders := []string{
-		"User-Agent",
-		"Referer",
-		"Accept",
-		"Accept-Language",
-		"Accept-Encoding",
-		"Content-Type",
-		"Authorization", // Note: We'll hash this for security
-		"X-Forwarded-For",
-		"X-Real-IP",
-		"Origin",
-	}
-
-	for _, headerName := range importantHeaders {
-		headerValue := r.Header.Get(headerName)
-		if headerValue != "" {
-			// For sensitive headers like Authorization, we'll just track presence
-			if headerName == "Authorization" {
-				headerValue = "present"
-			}
+		// Requests by route group and Apdex zone
+		apdexRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "apdex_requests_total",
+				Help:      "Total number of requests by route group and Apdex zone (satisfied, tolerating or frustrated)",
+			},
+			[]string{"group", "zone"},
+		),
 
-			// Truncate very long header values to prevent label explosion
-			if len(headerValue) > 100 {
-				headerValue = headerValue[:100] + "..."
-			}
+		// Collection windows exceeding the collection budget
+		overBudget: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "collection_over_budget_total",
+				Help:      "Total number of windows in which metric collection latency exceeded the collection budget",
+			},
+			nil,
+		),
 
-			um.requestsByHeaders.WithLabelValues(headerName, headerValue, method, statusCode).Inc()
-		}
-	}
-}
+		// Requests by HTTP version and scheme
+		requestsByProtocol: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "requests_by_protocol_total",
+				Help:      "Total number of requests by HTTP protocol version, scheme and host",
+			},
+			[]string{"proto", "scheme", "host"},
+		),
 
-// getClientIP extracts the real client IP address from the request,
-// checking various headers that might contain the original IP
-func getClientIP(r *http.Request) string {
+		// Responses by media type, without parameters
+		responsesByType: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "responses_by_content_type_total",
+				Help:      "Total number of responses by Content-Type media type and status code",
+			},
+			[]string{"content_type", "status_code"},
+		),
+
+		// Requests received over TLS by connection parameters
+		tlsRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "tls_requests_total",
+				Help:      "Total number of requests received over TLS by TLS version, cipher suite, server name and client certificate presence",
+			},
+			[]string{"tls_version", "cipher_suite", "server_name", "client_cert"},
+		),
+
+		// Requests claiming to come from a known crawler
+		botRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "bot_requests_total",
+				Help:      "Total number of requests claiming to come from a well-known crawler by bot and verification status",
+			},
+			[]string{"bot", "verification"},
+		),
+
+		// Server-Timing durations reported by upstreams, next to Caddy's own
+		serverTiming: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "server_timing_seconds",
+				Help:      "Durations reported by upstreams in Server-Timing headers, and the request duration as edge, in seconds by host, path and timing name",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"host", "path", "timing"},
+		),
+
+		// Responses by the result of caches in front of or behind Caddy
+		cacheResults: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "cache_results_total",
+				Help:      "Total number of responses by cache result (hit, miss or bypass) read from cache response headers, by host and path",
+			},
+			[]string{"result", "host", "path"},
+		),
+
+		// Requests by the autonomous system of the client
+		requestsByASN: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "requests_by_asn_total",
+				Help:      "Total number of requests by the autonomous system number and organization announcing the client IP",
+			},
+			[]string{"asn", "org"},
+		),
+
+		// Requests by the class assigned by classifier modules
+		classifiedRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "classified_requests_total",
+				Help:      "Total number of requests by classifier, assigned class and HTTP status code",
+			},
+			[]string{"classifier", "class", "status_code"},
+		),
+
+		// Requests by the domain and category of their referrer
+		requestsByReferrer: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "requests_by_referrer_total",
+				Help:      "Total number of requests by the registrable domain of their referrer and its category: direct, internal, search, social or other",
+			},
+			[]string{"domain", "category"},
+		),
+
+		// Requests with diverted methods, recorded nowhere else
+		divertedRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "diverted_requests_total",
+				Help:      "Total number of requests with a diverted method, such as HEAD and OPTIONS, by host and method. They are not recorded by any other usage metric.",
+			},
+			[]string{"host", "method"},
+		),
+
+		// Audited requests by how their access log entry compared
+		auditChecks: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "audit_checks_total",
+				Help:      "Total number of audited requests by how the status and duration recorded compared with their access log entry: match, status_mismatch, duration_mismatch or unmatched",
+			},
+			[]string{"result"},
+		),
+
+		// Requests by campaign query parameter, like utm_source
+		campaignRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "campaign_requests_total",
+				Help:      "Total number of requests by host and campaign query parameter, such as utm_source, and its value",
+			},
+			[]string{"host", "param", "value"},
+		),
+
+		// Requests by authenticated user
+		requestsByUser: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "requests_by_user_total",
+				Help:      "Total number of requests by the ID of their authenticated user, status code and method",
+			},
+			[]string{"user", "status_code", "method"},
+		),
+
+		// Requests, bytes and latency by API key
+		apiKeyRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "api_key_requests_total",
+				Help:      "Total number of requests by API key and status code",
+			},
+			[]string{"api_key", "status_code"},
+		),
+		apiKeyBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "api_key_bytes_total",
+				Help:      "Total number of request and response body bytes by API key and direction",
+			},
+			[]string{"api_key", "direction"},
+		),
+		apiKeyDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "api_key_request_duration_seconds",
+				Help:      "Duration of requests in seconds by API key",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"api_key"},
+		),
+
+		// Requests rejected for exceeding their quota
+		quotaExceeded: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "quota_exceeded_total",
+				Help:      "Total number of requests rejected with 429 for exceeding their quota, by host and what the quota counts requests by (ip or api_key)",
+			},
+			[]string{"host", "by"},
+		),
+
+		// Streamed responses, apart from ordinary request durations
+		streamFirstByte: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "stream_first_byte_seconds",
+				Help:      "Time to the first byte of streamed responses in seconds by host and stream type",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"host", "type"},
+		),
+		streamDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "stream_duration_seconds",
+				Help:      "Total duration of streamed responses in seconds by host and stream type",
+				Buckets:   streamDurationBuckets,
+			},
+			[]string{"host", "type"},
+		),
+
+		// Collections of the usage metrics endpoint by scraper
+		scrapes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "scrapes_total",
+				Help:      "Total number of collections of the usage metrics endpoint by scraper",
+			},
+			scraperLabels,
+		),
+		lastScrape: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "last_scrape_timestamp_seconds",
+				Help:      "Unix time of the last collection of the usage metrics endpoint by scraper",
+			},
+			scraperLabels,
+		),
+
+		activePaths:   activePaths,
+		activeHosts:   activeHosts,
+		activeClients: activeClients,
+		uniqueClients: newUniqueClientSketches(),
+		apdex:         newApdexWindow(defaultActiveWindow),
+		aggregates:    newHostAggregates(),
+		topPaths:      newTopKTracker(defaultTopK),
+		topClients:    newTopKTracker(defaultTopK),
+		topUserAgents: newTopKTracker(defaultTopK),
+		contents:      newContentIndex(),
+		series:        newSeriesCache(),
+	}
+
+	collectors := []prometheus.Collector{
+		// Approximate distinct counts over the active window, computed at scrape time
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "active_paths",
+				Help:      "Approximate number of distinct host and path combinations requested within the active window",
+			},
+			func() float64 { return activePaths.estimate(now()) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "active_hosts",
+				Help:      "Approximate number of distinct hosts requested within the active window",
+			},
+			func() float64 { return activeHosts.estimate(now()) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "active_clients",
+				Help:      "Approximate number of distinct client IPs seen within the active window",
+			},
+			func() float64 { return activeClients.estimate(now()) },
+		),
+
+		// Most frequent values of unbounded dimensions, computed at scrape time
+		newTopKCollector(ns, topPaths, "path",
+			"Estimated number of requests of the most requested paths", metrics.topPaths),
+		newTopKCollector(ns, topClients, "client_ip",
+			"Estimated number of requests of the most active client IPs", metrics.topClients),
+		newTopKCollector(ns, topUserAgents, "user_agent",
+			"Estimated number of requests of the most common User-Agents", metrics.topUserAgents),
+
+		// In-flight requests past their long_running threshold
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "long_running_requests",
+				Help:      "Number of in-flight requests running longer than the configured long_running threshold",
+			},
+			func() float64 { return float64(inflight.countLongRunning(now())) },
+		),
+	}
+
+	// Distinct clients over fixed windows, estimated at scrape time
+	collectors = append(collectors, newUniqueClientCollectors(ns, metrics.uniqueClients)...)
+
+	// Timestamps, Apdex scores and pre-aggregated series are gauges, which
+	// delta temporality leaves alone
+	collectors = append(collectors,
+		metrics.lastScrape,
+		newApdexCollector(ns, metrics.apdex),
+		newAggregatesCollector(ns, metrics.aggregates),
+		newContentCollector(ns, metrics.contents),
+		newClockSkewCollector(ns),
+	)
+
+	// Vectors registered with Caddy's registry are wrapped so that scrapes
+	// can reset them in delta temporality mode
+	registered := slices.Clone(collectors)
+	for _, vec := range metrics.vectors() {
+		collectors = append(collectors, vec)
+		registered = append(registered, deltaCollector{vec})
+	}
+
+	// Every collector is relabeled when relabeling rules are set
+	for i, collector := range collectors {
+		collectors[i] = relabelCollector{Collector: collector, um: metrics}
+	}
+	for i, collector := range registered {
+		registered[i] = relabelCollector{Collector: collector, um: metrics}
+	}
+
+	metrics.collectors = collectors
+	metrics.registered = registered
+
+	// Register each metric with Caddy's registry, returning the metrics
+	// along with an error so that callers can unregister them
+	return metrics, metrics.register(registry)
+}
+
+// register registers the metrics' collectors with registry
+func (um *usageMetrics) register(registry prometheus.Registerer) error {
+	for _, collector := range um.registered {
+		if err := registry.Register(collector); err != nil {
+			// Check if it's already registered error, which is expected on config reload
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+			// If it's AlreadyRegisteredError, continue - this is expected
+		}
+	}
+	return nil
+}
+
+// vectors returns the metric vectors by metric name, without namespace
+func (um *usageMetrics) vectors() map[string]resettableCollector {
+	return map[string]resettableCollector{
+		"requests_total":                   um.requestsTotal,
+		"requests_by_ip_total":             um.requestsByIP,
+		"requests_by_url_total":            um.requestsByURL,
+		"requests_by_headers_total":        um.requestsByHeaders,
+		"request_duration_seconds":         um.requestDuration,
+		"ttfb_seconds":                     um.ttfb,
+		"route_requests_total":             um.routeRequests,
+		"route_request_duration_seconds":   um.routeDuration,
+		"requests_by_class_total":          um.requestsByClass,
+		"errors_total":                     um.errorsTotal,
+		"requests_by_cookie_total":         um.requestsByCookie,
+		"cookie_header_bytes":              um.cookieHeaderSize,
+		"error_route_requests_total":       um.errorRouteRequests,
+		"handler_errors_total":             um.handlerErrors,
+		"handler_panics_total":             um.handlerPanics,
+		"rate_limited_total":               um.rateLimited,
+		"label_policy_hits_total":          um.labelPolicyHits,
+		"cost_units_total":                 um.costUnits,
+		"llm_tokens_total":                 um.llmTokens,
+		"rpc_requests_total":               um.rpcRequests,
+		"rpc_request_duration_seconds":     um.rpcDuration,
+		"soap_requests_total":              um.soapRequests,
+		"soap_request_duration_seconds":    um.soapDuration,
+		"inspected_requests_total":         um.inspectedRequests,
+		"protocol_anomalies_total":         um.protocolAnomalies,
+		"sni_mismatch_total":               um.sniMismatches,
+		"degraded_requests_total":          um.degradedRequests,
+		"collection_over_budget_total":     um.overBudget,
+		"failures_total":                   um.failures,
+		"upstream_requests_total":          um.upstreamRequests,
+		"upstream_latency_seconds":         um.upstreamLatency,
+		"upstream_duration_seconds":        um.upstreamDuration,
+		"apdex_requests_total":             um.apdexRequests,
+		"requests_by_protocol_total":       um.requestsByProtocol,
+		"responses_by_content_type_total":  um.responsesByType,
+		"tls_requests_total":               um.tlsRequests,
+		"scrapes_total":                    um.scrapes,
+		"bot_requests_total":               um.botRequests,
+		"server_timing_seconds":            um.serverTiming,
+		"cache_results_total":              um.cacheResults,
+		"requests_by_asn_total":            um.requestsByASN,
+		"classified_requests_total":        um.classifiedRequests,
+		"requests_by_referrer_total":       um.requestsByReferrer,
+		"diverted_requests_total":          um.divertedRequests,
+		"audit_checks_total":               um.auditChecks,
+		"campaign_requests_total":          um.campaignRequests,
+		"requests_by_user_total":           um.requestsByUser,
+		"api_key_requests_total":           um.apiKeyRequests,
+		"api_key_bytes_total":              um.apiKeyBytes,
+		"api_key_request_duration_seconds": um.apiKeyDuration,
+		"quota_exceeded_total":             um.quotaExceeded,
+		"stream_first_byte_seconds":        um.streamFirstByte,
+		"stream_duration_seconds":          um.streamDuration,
+	}
+}
+
+// setActiveWindow resizes the sliding window of the active_* gauges
+func (um *usageMetrics) setActiveWindow(window time.Duration) {
+	um.activePaths.setWindow(window)
+	um.activeHosts.setWindow(window)
+	um.activeClients.setWindow(window)
+	um.apdex.setWindow(window)
+}
+
+// registerMetrics registers all usage metrics with the provided Prometheus registry
+func registerMetrics(registry prometheus.Registerer) error {
+	// On config reload, keep the metrics in use, exposing them through the
+	// new config's registry, so that their series carry over rather than
+	// starting over from zero
+	if globalUsageMetrics != nil {
+		return globalUsageMetrics.register(registry)
+	}
+
+	// Try to initialize metrics - may handle AlreadyRegisteredError gracefully
+	metrics, err := initializeMetrics(registry)
+	if err != nil {
+		return err
+	}
+	globalUsageMetrics = metrics
+
+	return nil
+}
+
+// registerNamespacedMetrics returns the metrics of a namespace, registering
+// them with the provided registry when first used. All handlers configured
+// with the same namespace share these metrics; each call must be balanced
+// by a call to releaseNamespacedMetrics.
+func registerNamespacedMetrics(registry prometheus.Registerer, ns string) (*usageMetrics, error) {
+	value, loaded, err := namespacedMetrics.LoadOrNew(ns, func() (caddy.Destructor, error) {
+		metrics, err := initializeNamespacedMetrics(registry, ns)
+		if err != nil {
+			if metrics != nil {
+				metrics.unregister(registry)
+			}
+			return nil, err
+		}
+		return &namespaceMetrics{metrics: metrics, registry: registry}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	entry := value.(*namespaceMetrics)
+
+	// Like the global metrics, keep using the existing set on config
+	// reload, since new handlers are provisioned before old ones clean up
+	if loaded {
+		if err := entry.reregister(registry); err != nil {
+			_, _ = namespacedMetrics.Delete(ns)
+			return nil, err
+		}
+	}
+	return entry.metrics, nil
+}
+
+// releaseNamespacedMetrics releases a handler's use of a namespace's
+// metrics, unregistering them once no handler uses the namespace anymore
+// so that its series don't linger after it is removed from the config
+func releaseNamespacedMetrics(ns string) {
+	// Unregistering doesn't fail
+	_, _ = namespacedMetrics.Delete(ns)
+}
+
+// loadedNamespaceMetrics returns the metrics of a namespace in use, or nil
+// if no handler uses the namespace
+func loadedNamespaceMetrics(ns string) *usageMetrics {
+	var um *usageMetrics
+	namespacedMetrics.Range(func(key, value any) bool {
+		if key == ns {
+			um = value.(*namespaceMetrics).metrics
+			return false
+		}
+		return true
+	})
+	return um
+}
+
+// unregister removes the metrics' collectors from registry
+func (um *usageMetrics) unregister(registry prometheus.Registerer) {
+	for _, collector := range um.registered {
+		registry.Unregister(collector)
+	}
+}
+
+// usageMetrics returns the metrics this handler records to
+func (uc *UsageCollector) usageMetrics() *usageMetrics {
+	if uc.metrics != nil {
+		return uc.metrics
+	}
+	return globalUsageMetrics
+}
+
+// UsageCollector is a Caddy HTTP handler that collects comprehensive request metrics
+// and integrates them with Caddy's built-in metrics system. It tracks response status codes,
+// client IPs, requested URLs, and request headers.
+type UsageCollector struct {
+	// Profile selects a curated set of defaults for a deployment type:
+	// minimal, standard, verbose, web, api or cdn. minimal and standard
+	// also leave out metrics collected by default, for low-memory nodes.
+	// Explicitly configured options take precedence, and configured label
+	// policy rules run before the profile's rules.
+	Profile string `json:"profile,omitempty"`
+
+	// Namespace isolates this handler's metrics from other usage handlers
+	// by registering a separate set named <namespace>_usage_*. Handlers
+	// configured with the same namespace share their metrics. Defaults to
+	// caddy, shared by all handlers without a namespace.
+	Namespace string `json:"namespace,omitempty"`
+
+	// RouteName names the logical route this handler instruments, like
+	// api or static, identifying it in logs and recording its requests in
+	// the route_requests_total and route_request_duration_seconds metrics.
+	RouteName string `json:"route_name,omitempty"`
+
+	// SampleRate is the fraction of requests recorded by the expensive
+	// requests_by_ip, requests_by_url and requests_by_headers metrics,
+	// each weighted to keep totals approximately right. Defaults to 1,
+	// recording every request.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// SampledHeader is a response header set to 1 on requests sampled for
+	// detailed collection, so that downstream services and tracing systems
+	// can align their own sampling with ours. Sampled requests are those
+	// recorded by the expensive dimensions, as sample_rate and
+	// collection_budget decide, with their body inspected when inspectors
+	// are configured. They are also flagged with the usage_sampled request
+	// variable, available to other handlers as {http.vars.usage_sampled}.
+	SampledHeader string `json:"sampled_header,omitempty"`
+
+	// DataBundle is a directory of reference data files replacing the
+	// builtin ones, for offline deployments that update them separately:
+	// public_suffix_list.dat and bots.json, each optional. Since the data
+	// is shared between all usage handlers, the most recently provisioned
+	// handler's bundle applies.
+	DataBundle string `json:"data_bundle,omitempty"`
+
+	// ASNDatabase is a MaxMind ASN database (.mmdb), or an ip2asn file
+	// from iptoasn.com (.tsv, optionally gzipped), mapping client IPs to
+	// the autonomous systems recorded by requests_by_asn_total. Modified
+	// files are loaded again on config reloads.
+	ASNDatabase string `json:"asn_database,omitempty"`
+
+	// ActiveWindow is the sliding window over which the active_paths,
+	// active_hosts and active_clients gauges count distinct values.
+	// Defaults to 5 minutes. Since usage metrics are shared between all
+	// usage handlers, the most recently provisioned handler's value applies.
+	ActiveWindow caddy.Duration `json:"active_window,omitempty"`
+
+	// LongRunning enables the long-running request watchdog: requests in
+	// flight for longer than this are counted by the long_running_requests
+	// gauge and listed by the admin API.
+	LongRunning caddy.Duration `json:"long_running,omitempty"`
+
+	// TrackedHeaders lists the request headers recorded by the
+	// requests_by_headers_total metric. Defaults to a set of common
+	// headers such as User-Agent, Referer and Accept. Credential headers
+	// like Authorization are only ever recorded as "present".
+	TrackedHeaders []string `json:"tracked_headers,omitempty"`
+
+	// DeltaTemporality resets counters and histograms after every
+	// collection by a single consumer, so each reports only what happened
+	// since the previous one, matching OTLP delta semantics. The first
+	// push exporter started owns the resets, or, without one, the scrape
+	// of Caddy's metrics registry. Intended for preview and CI
+	// environments that are scraped rarely, and by a single scraper.
+	// Applies to all usage metrics while any handler enables it.
+	DeltaTemporality bool `json:"delta_temporality,omitempty"`
+
+	// CookieMetrics enables the cookie presence counter and the Cookie
+	// header size histogram.
+	CookieMetrics bool `json:"cookie_metrics,omitempty"`
+
+	// Cookies lists the cookie names whose presence is counted when
+	// CookieMetrics is enabled. Cookie values are never recorded.
+	Cookies []string `json:"cookies,omitempty"`
+
+	// CostHeaders lists response headers (or trailers) through which
+	// upstream applications report usage units, such as X-Usage-Units.
+	// Numeric values are accumulated per tenant and header.
+	CostHeaders []string `json:"cost_headers,omitempty"`
+
+	// CostTenant is a placeholder expression identifying the tenant that
+	// reported cost is attributed to. Defaults to {http.request.host}.
+	CostTenant string `json:"cost_tenant,omitempty"`
+
+	// ServerTiming records the durations upstream applications report in
+	// Server-Timing headers, in the server_timing_seconds histogram.
+	ServerTiming *ServerTimingConfig `json:"server_timing,omitempty"`
+
+	// CacheResults records whether responses were cache hits, misses or
+	// bypasses, read from headers such as Cache-Status, X-Cache and Age,
+	// in the cache_results_total counter.
+	CacheResults *CacheResultsConfig `json:"cache_results,omitempty"`
+
+	// Referrers counts requests by the domain and category of their
+	// referrer in the requests_by_referrer_total metric, as lightweight
+	// web analytics.
+	Referrers *ReferrerConfig `json:"referrers,omitempty"`
+
+	// CampaignParams lists query parameters, such as utm_source, counted
+	// by value in the campaign_requests_total metric. They are stripped
+	// from the full_url label, since they multiply its values.
+	CampaignParams []string `json:"campaign_params,omitempty"`
+
+	// URLQuery sets how query strings are recorded in the full_url label:
+	// as-is, stripped, sorted, or reduced to an allowlist of parameters.
+	URLQuery *URLQueryConfig `json:"url_query,omitempty"`
+
+	// Labels counts requests by custom labels evaluated from Caddy
+	// placeholders, such as a tenant header or the authenticated user, in
+	// a counter named by the config.
+	Labels *LabelsConfig `json:"labels,omitempty"`
+
+	// Users records requests by the ID of the user authenticated by an
+	// authentication handler, like basic_auth, in the
+	// requests_by_user_total metric.
+	Users *UsersConfig `json:"users,omitempty"`
+
+	// APIKeys accounts requests, bytes and latency per API key, read from
+	// a request header or query parameter.
+	APIKeys *APIKeysConfig `json:"api_keys,omitempty"`
+
+	// JWT counts requests by claims of their bearer JWT, such as the
+	// subject or plan, in the requests_by_claims_total metric.
+	JWT *JWTConfig `json:"jwt,omitempty"`
+
+	// Quota limits requests per client IP or API key over a rolling
+	// window, answering requests over it with 429 Too Many Requests.
+	// Unlike the other options, it changes responses.
+	Quota *QuotaConfig `json:"quota,omitempty"`
+
+	// LLM enables prompt and completion token accounting for proxied
+	// OpenAI-compatible APIs.
+	LLM *LLMConfig `json:"llm,omitempty"`
+
+	// JSONRPC enables per-method metrics for JSON-RPC endpoints.
+	JSONRPC *JSONRPCConfig `json:"jsonrpc,omitempty"`
+
+	// SOAP enables per-action metrics for SOAP and XML services.
+	SOAP *SOAPConfig `json:"soap,omitempty"`
+
+	// Inspect runs body inspector modules over a size-capped copy of
+	// request bodies to derive additional labels.
+	Inspect *InspectConfig `json:"inspect,omitempty"`
+
+	// ClassifiersRaw are request classifier modules, each assigning
+	// requests to a class recorded by classified_requests_total.
+	ClassifiersRaw []json.RawMessage `json:"classifiers,omitempty" caddy:"namespace=usage.classifiers inline_key=classifier"`
+
+	// NormalizePaths templates IDs and other variable segments out of the
+	// path and full_url labels. Its rules run after the label policy and
+	// before the profile's rules.
+	NormalizePaths *PathNormalization `json:"normalize_paths,omitempty"`
+
+	// HostGroups map hosts to groups recorded in the host label in place
+	// of the hosts themselves. The first matching group applies; hosts
+	// matching no group are recorded as-is.
+	HostGroups []HostGroup `json:"host_groups,omitempty"`
+
+	// CollapseHosts records hosts in the host label as their registrable
+	// domain (eTLD+1) according to the public suffix list, so that
+	// app.example.co.uk is recorded as example.co.uk. Suits wildcard
+	// setups serving unbounded subdomains. IP address hosts are recorded
+	// as "ip". Host groups take precedence.
+	CollapseHosts bool `json:"collapse_hosts,omitempty"`
+
+	// ExcludePaths lists request paths that are not recorded by any
+	// metric, such as health checks or static assets. Patterns are globs,
+	// where * also matches /, or regular expressions when starting with ^.
+	ExcludePaths []string `json:"exclude_paths,omitempty"`
+
+	// ExcludeHosts lists hosts whose requests are not recorded by any
+	// metric, as case-insensitive globs or regular expressions.
+	ExcludeHosts []string `json:"exclude_hosts,omitempty"`
+
+	// DivertMethods lists request methods, such as HEAD and OPTIONS, that
+	// are only counted by host in the compact diverted_requests_total
+	// metric, keeping health checks and CORS preflights out of the
+	// detailed metrics.
+	DivertMethods []string `json:"divert_methods,omitempty"`
+
+	// VerifyBots verifies requests claiming to come from well-known
+	// crawlers like Googlebot with reverse and forward DNS lookups.
+	VerifyBots *BotVerification `json:"verify_bots,omitempty"`
+
+	// StatsD sends request counts and durations to a StatsD server or
+	// Datadog agent, alongside or instead of the Prometheus metrics.
+	StatsD *StatsDConfig `json:"statsd,omitempty"`
+
+	// OTLP pushes the usage metrics to an OpenTelemetry collector, for
+	// backends that don't scrape Prometheus endpoints.
+	OTLP *OTLPConfig `json:"otlp,omitempty"`
+
+	// Pushgateway pushes the usage metrics to a Prometheus Pushgateway,
+	// for short-lived instances that may exit between scrapes.
+	Pushgateway *PushgatewayConfig `json:"pushgateway,omitempty"`
+
+	// EventLog writes one JSON line per request to a rotated file, for
+	// offline analysis beyond the aggregated metrics.
+	EventLog *EventLogConfig `json:"event_log,omitempty"`
+
+	// ClickHouse inserts one row per request into a ClickHouse table, in
+	// batches, for queries beyond the aggregated metrics.
+	ClickHouse *ClickHouseConfig `json:"clickhouse,omitempty"`
+
+	// ContentHash hashes a sample of response bodies to find URLs of a
+	// host serving identical content.
+	ContentHash *ContentHashConfig `json:"content_hash,omitempty"`
+
+	// TenantReports subscribe tenants, identified by host or API key, to
+	// reports of their own usage and service levels, posted to a webhook
+	// on a schedule.
+	TenantReports []TenantReport `json:"tenant_reports,omitempty"`
+
+	// LegacyClients tracks the oldest TLS versions, HTTP versions and legacy
+	// User-Agent families seen by each host over a rolling window, reported
+	// by the admin API.
+	LegacyClients *LegacyClientsConfig `json:"legacy_clients,omitempty"`
+
+	// Rollups aggregates the usage of each host and API key into daily and
+	// monthly rollups of requests, bytes and errors, persisted and exported
+	// by the admin API as JSON or CSV.
+	Rollups *RollupsConfig `json:"rollups,omitempty"`
+
+	// Streams records Server-Sent Events and long responses of unknown
+	// length in stream histograms of their own, instead of
+	// request_duration_seconds.
+	Streams *StreamsConfig `json:"streams,omitempty"`
+
+	// Dashboard serves an HTML page rendering the top paths, status codes,
+	// latency percentiles and request rate of the handler's metrics, at a
+	// configurable path behind basic authentication, unless made public.
+	Dashboard *DashboardConfig `json:"dashboard,omitempty"`
+
+	// ResetToken is a bearer token allowing the admin API's /usage/reset
+	// endpoint to clear the usage metrics, which is refused unless a
+	// handler configures one. Placeholders like {env.USAGE_RESET_TOKEN}
+	// are replaced, so that the token needn't be in the config.
+	ResetToken string `json:"reset_token,omitempty"`
+
+	// Audit cross-checks the status and duration recorded for a sample of
+	// requests against Caddy's access log, reporting discrepancies in the
+	// audit_checks_total metric and the admin API. A debug mode.
+	Audit *AuditConfig `json:"audit,omitempty"`
+
+	// PersistCounters saves the usage counters to a file periodically and
+	// restores them on startup, so that totals survive restarts.
+	PersistCounters *PersistCountersConfig `json:"persist_counters,omitempty"`
+
+	// FaultInjection makes sink writes and metric collections fail or slow
+	// down on purpose, to test how failures are handled. Never enable it
+	// in production.
+	FaultInjection *FaultInjectionConfig `json:"fault_injection,omitempty"`
+
+	// ClockCheck monitors the wall clock for adjustments and, optionally,
+	// compares it with an NTP server, reporting the skew in the
+	// clock_skew_seconds and clock_skewed gauges.
+	ClockCheck *ClockCheckConfig `json:"clock_check,omitempty"`
+
+	// CollectionBudget is the latency budget for recording a request's
+	// metrics. When the 99th percentile of collection latency exceeds it,
+	// the expensive requests_by_ip, requests_by_url and
+	// requests_by_headers metrics only record a sample of requests, each
+	// weighted to keep totals approximately right, until latency recovers.
+	// Disabled by default.
+	CollectionBudget caddy.Duration `json:"collection_budget,omitempty"`
+
+	// Aggregates enables per-host series equivalent to common recording
+	// rules: the request rate, 5xx ratio and mean duration over the last
+	// 5 minutes, named like host:caddy_usage_requests:rate5m. Small
+	// installs can chart and alert on them without rule evaluation.
+	Aggregates bool `json:"aggregates,omitempty"`
+
+	// UniqueClients enables the unique_clients gauges, estimating the
+	// number of distinct clients over the last hour and day.
+	UniqueClients *UniqueClientsConfig `json:"unique_clients,omitempty"`
+
+	// TopK enables tracking of the most frequent paths, client IPs and
+	// User-Agents in constant memory, reported by the top_paths,
+	// top_clients and top_user_agents gauges and the admin API. It is the
+	// number of values reported per dimension. Since usage metrics are
+	// shared between all usage handlers, the most recently provisioned
+	// handler's value applies.
+	TopK int `json:"top_k,omitempty"`
+
+	// Apdex sets Apdex thresholds for groups of routes, recorded by the
+	// apdex_requests_total counter and the apdex_score gauge. A request
+	// counts towards the first target matching its host and path. Targets
+	// with an objective, set by slo blocks, are service level objectives.
+	Apdex []ApdexTarget `json:"apdex,omitempty"`
+
+	// WarmUp pre-creates zero-valued series for label values known in
+	// advance, so that they exist from the first scrape.
+	WarmUp *WarmUpConfig `json:"warm_up,omitempty"`
+
+	// LabelPolicy is an ordered list of rules deciding which label values
+	// are recorded as-is, replaced, or transformed. Built-in rules, such as
+	// truncating long header values, are evaluated after these.
+	LabelPolicy []LabelRule `json:"label_policy,omitempty"`
+
+	// Relabel is an ordered list of Prometheus-style relabeling rules
+	// keeping, dropping or rewriting series as they are collected, after
+	// the label policy shaped the recorded values. Since usage metrics are
+	// shared between all usage handlers, the most recently provisioned
+	// handler's rules apply.
+	Relabel []RelabelRule `json:"relabel,omitempty"`
+
+	logger              *zap.Logger
+	ctx                 caddy.Context
+	policy              *labelPolicy
+	metricLevel         metricLevel
+	trackedHeaders      []string
+	excludePaths        []*regexp.Regexp
+	excludeHosts        []*regexp.Regexp
+	hostGroups          []compiledHostGroup
+	apdexTargets        []apdexTarget
+	classifiers         []namedClassifier
+	deltaActive         bool
+	metrics             *usageMetrics
+	botVerifier         *botVerifier
+	otlpExporter        *otlpExporter
+	pushgateway         *pushgatewayPusher
+	eventLog            *eventLog
+	clickhouse          *clickHouseWriter
+	tenantSubscriptions []tenantSubscription
+	counterStore        *counterStore
+	legacyTracker       *legacyTracker
+	rollupTracker       *rollupTracker
+	auditor             *auditor
+	labelsCounter       *labelsCounter
+	jwtCounter          *labelsCounter
+	jwks                *jwksVerifier
+	quotaTracker        *quotaTracker
+	asnDB               *sharedASNDatabase
+	faultsActive        bool
+	resetToken          string
+	statsd              *statsdClient
+	clockChecked        bool
+	governor            *collectionGovernor
+}
+
+// CaddyModule returns the Caddy module information
+func (UsageCollector) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.usage",
+		New: func() caddy.Module { return new(UsageCollector) },
+	}
+}
+
+// Provision sets up the UsageCollector with necessary resources
+func (uc *UsageCollector) Provision(ctx caddy.Context) error {
+	uc.ctx = ctx
+	uc.logger = ctx.Logger(uc)
+	if uc.RouteName != "" {
+		uc.logger = uc.logger.With(zap.String("route", uc.RouteName))
+	}
+
+	// Compile the label policy shared by all collectors, with path
+	// normalization and then the profile's rules evaluated after the
+	// configured ones
+	profile := usageProfiles[uc.Profile]
+	rules := make([]LabelRule, 0, len(uc.LabelPolicy)+len(profile.labelPolicy))
+	rules = append(rules, uc.LabelPolicy...)
+	if uc.NormalizePaths != nil {
+		rules = append(rules, uc.NormalizePaths.labelRules()...)
+	}
+	rules = append(rules, profile.labelPolicy...)
+
+	policy, err := compileLabelPolicy(rules)
+	if err != nil {
+		return fmt.Errorf("compiling label policy: %v", err)
+	}
+	uc.policy = policy
+	uc.metricLevel = profile.metrics
+
+	// Canonicalize tracked header names once, so that label values and
+	// presence-only checks don't depend on how they were configured
+	for _, name := range uc.TrackedHeaders {
+		uc.trackedHeaders = append(uc.trackedHeaders, http.CanonicalHeaderKey(name))
+	}
+
+	if uc.excludePaths, err = compilePatterns(uc.ExcludePaths, false); err != nil {
+		return fmt.Errorf("compiling exclude_paths: %v", err)
+	}
+	if uc.excludeHosts, err = compilePatterns(uc.ExcludeHosts, true); err != nil {
+		return fmt.Errorf("compiling exclude_hosts: %v", err)
+	}
+	if uc.hostGroups, err = compileHostGroups(uc.HostGroups); err != nil {
+		return err
+	}
+	if uc.apdexTargets, err = compileApdexTargets(uc.Apdex); err != nil {
+		return err
+	}
+
+	if uc.Inspect != nil {
+		if err := uc.Inspect.provision(ctx); err != nil {
+			return err
+		}
+	}
+	if err := uc.provisionClassifiers(ctx); err != nil {
+		return err
+	}
+
+	// Register metrics with Caddy's internal metrics registry
+	if registry := ctx.GetMetricsRegistry(); registry != nil {
+		if uc.Namespace != "" && uc.Namespace != defaultMetricsNamespace {
+			metrics, err := registerNamespacedMetrics(registry, uc.Namespace)
+			if err != nil {
+				return fmt.Errorf("registering usage metrics in namespace '%s': %v", uc.Namespace, err)
+			}
+			uc.metrics = metrics
+		} else if err := registerMetrics(registry); err != nil {
+			uc.logger.Warn("failed to register usage metrics", zap.Error(err))
+		}
+
+		ns := uc.Namespace
+		if ns == "" {
+			ns = defaultMetricsNamespace
+		}
+		if uc.Labels != nil {
+			counter, err := acquireLabelsCounter(registry, ns, uc.Labels.metric(), labelsHelp, uc.Labels.names())
+			if err != nil {
+				return fmt.Errorf("registering labels metric '%s': %v", uc.Labels.metric(), err)
+			}
+			uc.labelsCounter = counter
+		}
+		if uc.JWT != nil {
+			counter, err := acquireLabelsCounter(registry, ns, defaultJWTMetric, jwtHelp, uc.JWT.labels())
+			if err != nil {
+				return fmt.Errorf("registering jwt metric: %v", err)
+			}
+			uc.jwtCounter = counter
+		}
+	} else {
+		uc.logger.Warn("metrics registry not available, disabling metrics")
+	}
+
+	// Load the reference data from a configured bundle
+	if uc.DataBundle != "" {
+		bundle, err := loadDataBundle(uc.DataBundle)
+		if err != nil {
+			return err
+		}
+		currentData.Store(bundle)
+	}
+
+	// Open the ASN database shared with handlers using the same file
+	if uc.ASNDatabase != "" {
+		db, err := acquireASNDatabase(uc.ASNDatabase)
+		if err != nil {
+			return fmt.Errorf("loading ASN database: %v", err)
+		}
+		uc.asnDB = db
+	}
+
+	// Apply a configured active window to the shared distinct counters
+	activeWindow := time.Duration(uc.ActiveWindow)
+	if activeWindow == 0 {
+		activeWindow = profile.activeWindow
+	}
+	if um := uc.usageMetrics(); activeWindow > 0 && um != nil {
+		um.setActiveWindow(activeWindow)
+	}
+
+	// Export the SLO objectives of this handler's Apdex targets
+	if um := uc.usageMetrics(); um != nil {
+		um.apdex.setObjectives(uc.apdexTargets)
+	}
+
+	// Size the shared heavy hitter trackers
+	if um := uc.usageMetrics(); uc.TopK > 0 && um != nil {
+		um.setTopK(uc.TopK)
+	}
+
+	// Reshape the collected series with the relabeling rules
+	if len(uc.Relabel) > 0 {
+		relabel, err := compileRelabeling(uc.Relabel)
+		if err != nil {
+			return fmt.Errorf("compiling relabel rules: %v", err)
+		}
+		if um := uc.usageMetrics(); um != nil {
+			um.setRelabeling(relabel)
+		}
+	}
+
+	// Pre-create the series of known label values
+	if um := uc.usageMetrics(); uc.WarmUp != nil && um != nil {
+		uc.warmUp(um)
+	}
+
+	// Restore the saved counters into the metrics registered above
+	if uc.PersistCounters != nil {
+		store, err := acquireCounterStore(uc.PersistCounters, uc.logger)
+		if err != nil {
+			return fmt.Errorf("opening usage counter store: %v", err)
+		}
+		uc.counterStore = store
+	}
+
+	if uc.DeltaTemporality {
+		deltaHandlers.Add(1)
+		uc.deltaActive = true
+	}
+
+	if uc.CollectionBudget > 0 {
+		uc.governor = newCollectionGovernor(time.Duration(uc.CollectionBudget), uc.logger)
+	}
+
+	if uc.VerifyBots != nil {
+		uc.botVerifier = acquireBotVerifier(uc.VerifyBots)
+	}
+
+	if uc.LegacyClients != nil {
+		uc.legacyTracker = acquireLegacyTracker(uc.LegacyClients, uc.logger)
+	}
+
+	if uc.Rollups != nil {
+		uc.rollupTracker = acquireRollupTracker(uc.Rollups, uc.logger)
+	}
+
+	if uc.Audit != nil {
+		uc.auditor = acquireAuditor(uc.Audit, uc.logger)
+	}
+
+	if uc.JWT != nil && uc.JWT.JWKS != "" {
+		uc.jwks = acquireJWKSVerifier(uc.JWT.JWKS, uc.logger)
+	}
+
+	if uc.Quota != nil {
+		uc.quotaTracker = acquireQuotaTracker(quotaTrackerID(uc.Namespace, uc.RouteName, uc.Quota), uc.Quota)
+	}
+
+	// Allow resets through the admin API with the configured token
+	if uc.ResetToken != "" {
+		uc.resetToken = caddy.NewReplacer().ReplaceKnown(uc.ResetToken, "")
+		acquireResetToken(uc.resetToken)
+	}
+
+	if uc.FaultInjection != nil {
+		acquireFaultInjection(uc.FaultInjection)
+		uc.faultsActive = true
+		uc.logger.Warn("usage fault injection enabled, sinks and collections will fail on purpose",
+			zap.Float64("drop_rate", uc.FaultInjection.DropRate),
+			zap.Duration("latency", time.Duration(uc.FaultInjection.Latency)),
+			zap.Float64("gather_fail_rate", uc.FaultInjection.GatherFailRate))
+	}
+
+	if uc.StatsD != nil {
+		client, err := acquireStatsDClient(uc.StatsD)
+		if err != nil {
+			return err
+		}
+		uc.statsd = client
+	}
+
+	if uc.OTLP != nil {
+		exporter, err := acquireOTLPExporter(uc.OTLP, uc.logger)
+		if err != nil {
+			return err
+		}
+		uc.otlpExporter = exporter
+	}
+
+	if uc.Pushgateway != nil {
+		pusher, err := acquirePushgatewayPusher(uc.Pushgateway, uc.logger)
+		if err != nil {
+			return err
+		}
+		uc.pushgateway = pusher
+	}
+
+	if uc.EventLog != nil {
+		eventLog, err := acquireEventLog(uc.EventLog, uc.logger)
+		if err != nil {
+			return err
+		}
+		uc.eventLog = eventLog
+	}
+
+	if uc.ClickHouse != nil {
+		writer, err := acquireClickHouseWriter(uc.ClickHouse, uc.logger)
+		if err != nil {
+			return err
+		}
+		uc.clickhouse = writer
+	}
+
+	if err := uc.provisionTenantReports(); err != nil {
+		return err
+	}
+
+	if uc.ClockCheck != nil {
+		if err := acquireClockMonitor(uc.ClockCheck, uc.logger); err != nil {
+			return err
+		}
+		uc.clockChecked = true
+	}
+
+	uc.logger.Info("usage collector provisioned successfully")
+	return nil
+}
+
+// ServeHTTP implements the HTTP handler interface. This is where we collect
+// metrics at the end of the request cycle to avoid interfering with the request.
+func (uc *UsageCollector) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// The dashboard is served by the handler itself, and not counted
+	if uc.Dashboard != nil {
+		if served, err := uc.serveDashboard(w, r); served {
+			return err
+		}
+	}
+
+	// Excluded requests pass through untouched
+	if uc.excluded(r) {
+		return next.ServeHTTP(w, r)
+	}
+
+	// Diverted requests are only counted by host
+	if uc.diverted(r) {
+		uc.collectDivertedRequest(r)
+		return next.ServeHTTP(w, r)
+	}
+
+	// Record start time for duration calculation
+	startTime := now()
+
+	// Reject requests over their quota before they reach the next handler
+	if uc.quotaTracker != nil {
+		if over, retryAfter := uc.overQuota(r); over {
+			return uc.rejectOverQuota(w, r, startTime, retryAfter)
+		}
+	}
+
+	// Let the watchdog see the request while it is in flight
+	if uc.LongRunning > 0 {
+		defer inflight.remove(uc.trackInflight(r, startTime))
+	}
+
+	// Observe completion responses for token accounting
+	var llm *llmCapture
+	if uc.LLM != nil {
+		maxBody := uc.LLM.MaxBody
+		if maxBody == 0 {
+			maxBody = defaultLLMMaxBody
+		}
+		llm = newLLMCapture(w, maxBody)
+		w = llm
+	}
+
+	// Extract JSON-RPC method names before the body is consumed downstream
+	var rpcMethods []string
+	if uc.JSONRPC != nil {
+		rpcMethods = uc.peekJSONRPCMethods(r)
+	}
+
+	// Likewise for the SOAP action, unless it's given in a header
+	var soapAction string
+	if uc.SOAP != nil {
+		soapAction = uc.soapAction(r)
+	}
+
+	// Copy request bodies for inspection as downstream handlers read them
+	var tee *bodyTee
+	if uc.Inspect != nil {
+		tee = uc.Inspect.teeBody(r)
+	}
+
+	// Decide ahead of the response whether the expensive dimensions record
+	// the request, so that sampled requests can be flagged downstream
+	weight := uc.sampleWeight()
+	if uc.sampled(weight, tee) {
+		uc.markSampled(w, r)
+	}
+
+	// Hash a sample of response bodies to find duplicate content
+	var hasher *contentHasher
+	if uc.ContentHash != nil {
+		if hasher = uc.ContentHash.sample(w, r); hasher != nil {
+			w = hasher
+		}
+	}
+
+	// Record the status and size as the response passes through
+	rec := newResponseRecorder(w)
+
+	// Continue with the next handler in the chain
+	err := uc.serveNext(rec, r, next)
+	status := responseStatus(rec, err)
+
+	// Collect metrics after the request has been processed
+	uc.collectSampledMetrics(rec, r, startTime, err, weight)
+
+	// Failures and upstreams are recorded by default, unless the minimal
+	// or standard profile leaves them out
+	um := uc.usageMetrics()
+	if um != nil && !uc.statsdOnly() && uc.metricLevel == levelVerbose {
+		uc.collectDegradedMetrics(um, r, status, err, rec.Header())
+		uc.collectFailureMetrics(um, r, status, err, rec.Header())
+		uc.collectUpstreamMetrics(um, r, status, err)
+
+		if err != nil {
+			uc.collectHandlerErrorMetrics(um, r, err)
+		}
+	}
+
+	if llm != nil && um != nil {
+		uc.collectLLMMetrics(um, r, llm)
+	}
+
+	if len(rpcMethods) > 0 && um != nil {
+		statusCode := statusCodeString(status)
+		uc.collectJSONRPCMetrics(um, rpcMethods, statusCode, since(startTime).Seconds())
+	}
+
+	if soapAction != "" && um != nil {
+		statusCode := statusCodeString(status)
+		uc.collectSOAPMetrics(um, soapAction, statusCode, since(startTime).Seconds())
+	}
+
+	if tee != nil && um != nil {
+		uc.collectInspectMetrics(um, r, tee, statusCodeString(status))
+	}
+
+	if hasher != nil && um != nil {
+		uc.collectContentHash(um, r, hasher, status)
+	}
+
+	return err
+}
+
+// collectMetrics gathers all the comprehensive metrics from the completed
+// request. err is the error returned by the handler chain, if any, which
+// decides the status of requests that failed before writing a response.
+func (uc *UsageCollector) collectMetrics(rec recordedResponse, r *http.Request, startTime time.Time, err error) {
+	uc.collectSampledMetrics(rec, r, startTime, err, uc.sampleWeight())
+}
+
+// collectSampledMetrics is collectMetrics with the weight the expensive
+// dimensions record the request with already decided by sampleWeight
+func (uc *UsageCollector) collectSampledMetrics(rec recordedResponse, r *http.Request, startTime time.Time, err error, weight float64) {
+	um := uc.usageMetrics()
+	if um == nil {
+		uc.logger.Error("usage metrics not initialized")
+		return
+	}
+	if status := responseStatus(rec, err); status != rec.Status() {
+		rec = answeredResponse{recordedResponse: rec, status: status}
+	}
+
+	// Calculate request duration
+	elapsed := since(startTime)
+	duration := elapsed.Seconds()
+
+	// Keep collection within its latency budget
+	if uc.governor != nil {
+		collectStart := now()
+		defer func() { uc.governor.observe(um, since(collectStart)) }()
+	}
+
+	// Get basic request information, filtered through the label policy
+	statusCode := uc.policy.apply(um, "status_code", statusCodeString(rec.Status()))
+	method := uc.policy.apply(um, "method", r.Method)
+	host := uc.hostLabel(um, r.Host)
+	path := uc.policy.apply(um, "path", r.URL.Path)
+	rawIP := getClientIP(r)
+	clientIP := uc.policy.apply(um, "client_ip", rawIP)
+
+	// Write the request to the event log and ClickHouse
+	if uc.eventLog != nil || uc.clickhouse != nil {
+		uc.collectEvent(rec, r, startTime, elapsed, method, host, path, clientIP)
+	}
+
+	// Stream the request to the live feed while anyone watches it
+	if feedSubscribed.Load() > 0 {
+		uc.collectFeedEvent(um, rec, r, startTime, elapsed, method, host, path, clientIP)
+	}
+
+	// Add the request to the usage reported to its tenants
+	if len(uc.tenantSubscriptions) > 0 {
+		uc.collectTenantReports(rec, r, elapsed)
+	}
+
+	// Remember the oldest clients of each host
+	if uc.legacyTracker != nil {
+		uc.collectLegacyClients(r, host)
+	}
+
+	// Add the request to the usage rollups of its host and API key
+	if uc.rollupTracker != nil {
+		uc.collectRollups(rec, r, host)
+	}
+
+	// Check a sample of requests against the access log
+	uc.collectAudit(um, rec, r, elapsed)
+
+	// Send to StatsD, and stop there when it replaces Prometheus
+	if uc.statsd != nil {
+		uc.collectStatsDMetrics(method, statusCode, host, elapsed)
+		if uc.statsdOnly() {
+			return
+		}
+	}
+
+	// Update basic request metrics, the only ones the minimal profile
+	// collects by default
+	verbose := uc.metricLevel == levelVerbose
+	total, durations := um.series.basic(um, statusCode, method, host, path)
+	total.Inc()
+	stream := uc.streamType(rec, elapsed)
+	if stream != "" {
+		collectStreamMetrics(um, rec, stream, host, startTime, elapsed)
+	} else {
+		durations.Observe(duration)
+		// Looked up only when observed, leaving no empty series for
+		// requests with no first byte time
+		if firstByte := firstByteTime(rec); verbose && !firstByte.IsZero() {
+			um.ttfb.WithLabelValues(method, statusCode, host).Observe(firstByte.Sub(startTime).Seconds())
+		}
+	}
+	uc.collectRouteMetrics(um, statusCode, method, duration, stream != "")
+	if verbose {
+		uc.collectStatusClassMetrics(um, rec.Status(), host, method)
+	}
+
+	// Feed the sliding-window distinct counters
+	seen := now()
+	if verbose {
+		um.activePaths.add(host+path, seen)
+		um.activeHosts.add(host, seen)
+		um.activeClients.add(clientIP, seen)
+	}
+	if uc.UniqueClients != nil {
+		uc.collectUniqueClientMetrics(um, r, rawIP, seen)
+	}
+	if uc.Aggregates {
+		uc.collectAggregateMetrics(um, host, rec.Status(), duration, seen)
+	}
+
+	// Track the heaviest hitters of the unbounded dimensions
+	if uc.TopK > 0 {
+		uc.collectTopKMetrics(um, r, path, rawIP)
+	}
+
+	// Record the expensive dimensions, sampled as configured and when
+	// over budget
+	if weight > 0 {
+		if uc.metricLevel != levelMinimal {
+			fullURL := uc.policy.apply(um, "full_url", uc.fullURL(r))
+			um.requestsByIP.WithLabelValues(clientIP, statusCode, method).Add(weight)
+			um.requestsByURL.WithLabelValues(fullURL, method, statusCode).Add(weight)
+		}
+		if verbose || len(uc.TrackedHeaders) > 0 {
+			uc.recordHeaderMetrics(um, r, method, statusCode, weight)
+		}
+	}
+
+	// Attribute the request to the client's network
+	uc.collectASNMetrics(um, rawIP)
+
+	// The remaining dimensions collected by default are left out by the
+	// minimal and standard profiles
+	if verbose {
+		// Track HTTP version and scheme adoption per host
+		uc.collectProtocolMetrics(um, r, host)
+
+		// Tell pages, API responses and assets apart
+		uc.collectContentTypeMetrics(um, rec.Header(), statusCode)
+
+		// Record TLS connection parameters
+		uc.collectTLSMetrics(um, r)
+
+		// Count framing and header anomalies of the request
+		uc.collectAnomalyMetrics(um, r)
+
+		// Count TLS requests for a different host than was asked for in the handshake
+		uc.collectSNIMetrics(um, r)
+
+		// Record the original failure when running inside handle_errors
+		uc.collectErrorRouteMetrics(um, r, host)
+
+		// Record rejections made by the rate_limit handler
+		uc.collectRateLimitMetrics(um, r)
+	}
+
+	// Accumulate cost units reported by upstream applications
+	uc.collectCostMetrics(um, r, rec.Header())
+
+	// Break request durations down by upstream-reported timings
+	uc.collectServerTimingMetrics(um, rec.Header(), host, path, elapsed)
+
+	// Record whether caches answered the request
+	uc.collectCacheMetrics(um, rec.Header(), host, path)
+
+	// Attribute the request to the site that referred it
+	uc.collectReferrerMetrics(um, r)
+	uc.collectCampaignMetrics(um, r, host)
+
+	// Count the request by the configured custom labels
+	uc.collectCustomLabels(um, r)
+
+	// Attribute the request to its authenticated user
+	uc.collectUserMetrics(um, r, statusCode, method)
+
+	// Account the request to its API key and token claims
+	uc.collectAPIKeyMetrics(um, rec, r, statusCode, elapsed)
+	uc.collectJWTMetrics(um, r)
+
+	// Verify requests claiming to come from known crawlers
+	uc.collectBotMetrics(um, r)
+
+	// Assign the request to classes with the configured classifiers
+	uc.collectClassMetrics(um, rec, r, rawIP, statusCode, elapsed)
+
+	// Score the request against its route group's Apdex threshold
+	uc.collectApdexMetrics(um, r, rec.Status(), elapsed)
+
+	// Collect opt-in cookie metrics
+	if uc.CookieMetrics {
+		uc.collectCookieMetrics(um, r, host)
+	}
+}
+
+// defaultTrackedHeaders are the request headers recorded when no headers
+// are configured
+var defaultTrackedHeaders = []string{
+	"User-Agent",
+	"Referer",
+	"Accept",
+	"Accept-Language",
+	"Accept-Encoding",
+	"Content-Type",
+	"Authorization",
+	"X-Forwarded-For",
+	"X-Real-IP",
+	"Origin",
+}
+
+// presenceOnlyHeaders carry credentials, so only their presence is recorded
+var presenceOnlyHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// collectHeaderMetrics extracts and records metrics for the tracked HTTP headers
+func (uc *UsageCollector) collectHeaderMetrics(um *usageMetrics, r *http.Request, method, statusCode string) {
+	uc.recordHeaderMetrics(um, r, method, statusCode, 1)
+}
+
+// recordHeaderMetrics records the tracked HTTP headers of a request with
+// the given weight
+func (uc *UsageCollector) recordHeaderMetrics(um *usageMetrics, r *http.Request, method, statusCode string, weight float64) {
+	trackedHeaders := uc.trackedHeaders
+	if trackedHeaders == nil {
+		trackedHeaders = defaultTrackedHeaders
+	}
+
+	for _, headerName := range trackedHeaders {
+		headerValue := r.Header.Get(headerName)
+		if headerValue != "" {
+			// For sensitive headers like Authorization, we'll just track presence
+			if presenceOnlyHeaders[headerName] {
+				headerValue = "present"
+			}
+
+			// Truncation and other value rules are handled by the label policy
+			headerValue = uc.policy.apply(um, "header_value", headerValue)
+
+			um.requestsByHeaders.WithLabelValues(headerName, headerValue, method, statusCode).Add(weight)
+		}
+	}
+}
+
+// getClientIP extracts the real client IP address from the request,
+// checking various headers that might contain the original IP
+func getClientIP(r *http.Request) string {
 	// Check X-Forwarded-For header first (most common for proxied requests)
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
 		// X-Forwarded-For can contain multiple IPs, take the first one
 		if ips := strings.Split(xff, ","); len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
+			return normalizeIP(ips[0])
 		}
 	}
 
 	// Check X-Real-IP header
 	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+		return normalizeIP(xri)
 	}
 
 	// Check X-Forwarded header
 	if xf := r.Header.Get("X-Forwarded"); xf != "" {
-		return xf
+		return normalizeIP(xf)
 	}
 
 	// Fall back to RemoteAddr
-	// Handle IPv6 addresses which are in format [::1]:port
-	if strings.HasPrefix(r.RemoteAddr, "[") {
-		if endBracket := strings.Index(r.RemoteAddr, "]"); endBracket != -1 {
-			return r.RemoteAddr[:endBracket+1]
-		}
-	}
+	return normalizeIP(r.RemoteAddr)
+}
 
-	// Handle IPv4 addresses in format ip:port
-	if ip := strings.Split(r.RemoteAddr, ":"); len(ip) > 0 {
-		return ip[0]
+// normalizeIP returns the canonical form of an IP address that may carry a
+// port, brackets or an IPv6 zone, like [fe80::1%eth0]:443, so that every
+// spelling of an address maps to the same series. IPv4-mapped IPv6
+// addresses become IPv4, and zones are dropped. Values that aren't IP
+// addresses are returned trimmed but otherwise unchanged.
+func normalizeIP(s string) string {
+	s = strings.TrimSpace(s)
+
+	host := s
+	if h, _, err := net.SplitHostPort(s); err == nil {
+		host = h
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		host = s[1 : len(s)-1]
 	}
 
-	return r.RemoteAddr
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return s
+	}
+	return addr.WithZone("").Unmap().String()
 }
 
 // Cleanup cleans up the handler, following caddy-ratelimit pattern
 func (uc *UsageCollector) Cleanup() error {
-	// Note: We don't delete metrics from the pool here because they might be used
-	// by other instances. Metrics will be cleaned up when the process exits.
+	// Caddy also cleans up handlers that failed to provision
+	if uc.deltaActive {
+		// The series cache was bypassed while delta temporality reset
+		// the vectors, so what it resolved before is stale
+		if deltaHandlers.Add(-1) == 0 {
+			for _, um := range usageMetricSets() {
+				um.series.invalidate()
+			}
+		}
+		uc.deltaActive = false
+	}
+
+	// Save the counters before the metrics they're read from are released
+	var counterStoreErr error
+	if uc.counterStore != nil {
+		counterStoreErr = releaseCounterStore(uc.counterStore)
+		uc.counterStore = nil
+	}
+
+	// Namespaced metrics are unregistered once their last handler is gone.
+	// The shared metrics are kept, since they're used by every handler
+	// without a namespace; they are cleaned up when the process exits.
+	if uc.metrics != nil {
+		releaseNamespacedMetrics(uc.Namespace)
+		uc.metrics = nil
+	}
+
+	// Stop the OTLP exporter, Pushgateway pusher and StatsD client once no
+	// handler uses them
+	var otlpErr, pushgatewayErr error
+	if uc.otlpExporter != nil {
+		otlpErr = releaseOTLPExporter(uc.otlpExporter)
+		uc.otlpExporter = nil
+	}
+	if uc.pushgateway != nil {
+		pushgatewayErr = releasePushgatewayPusher(uc.pushgateway)
+		uc.pushgateway = nil
+	}
+	if uc.statsd != nil {
+		// Closing a UDP socket doesn't fail in practice
+		_ = releaseStatsDClient(uc.statsd)
+		uc.statsd = nil
+	}
+
+	// Close the event log once no handler writes to it
+	var eventLogErr error
+	if uc.eventLog != nil {
+		eventLogErr = releaseEventLog(uc.eventLog)
+		uc.eventLog = nil
+	}
+
+	// Insert the pending rows once no handler writes to ClickHouse
+	var clickhouseErr error
+	if uc.clickhouse != nil {
+		clickhouseErr = releaseClickHouseWriter(uc.clickhouse)
+		uc.clickhouse = nil
+	}
+
+	// Stop reporting to tenants no handler subscribes anymore
+	uc.releaseTenantReports()
+
+	// Forget interned label values, kept again as metrics record them
+	labelValues.reset()
+
+	// Stop allowing resets with a token no handler configures anymore
+	if uc.resetToken != "" {
+		releaseResetToken(uc.resetToken)
+		uc.resetToken = ""
+	}
+
+	// End injected faults once no handler configures them
+	if uc.faultsActive {
+		releaseFaultInjection()
+		uc.faultsActive = false
+	}
+
+	// Stop monitoring the clock once no handler asks for it
+	if uc.clockChecked {
+		releaseClockMonitor()
+		uc.clockChecked = false
+	}
+
+	// Persist the legacy client observations once no handler tracks them
+	var legacyErr error
+	if uc.legacyTracker != nil {
+		legacyErr = releaseLegacyTracker(uc.legacyTracker)
+		uc.legacyTracker = nil
+	}
+
+	// Persist the usage rollups once no handler aggregates them
+	var rollupsErr error
+	if uc.rollupTracker != nil {
+		rollupsErr = releaseRollupTracker(uc.rollupTracker)
+		uc.rollupTracker = nil
+	}
+
+	// Unregister the custom labels counters once no handler records to them
+	if uc.labelsCounter != nil {
+		releaseLabelsCounter(uc.labelsCounter)
+		uc.labelsCounter = nil
+	}
+	if uc.jwtCounter != nil {
+		releaseLabelsCounter(uc.jwtCounter)
+		uc.jwtCounter = nil
+	}
+
+	// Forget quota counts once no handler enforces the quota
+	if uc.quotaTracker != nil {
+		releaseQuotaTracker(uc.quotaTracker)
+		uc.quotaTracker = nil
+	}
+
+	// Stop fetching the JWKS once no handler verifies tokens with it
+	if uc.jwks != nil {
+		releaseJWKSVerifier(uc.jwks)
+		uc.jwks = nil
+	}
+
+	// Stop following the access log once no handler audits it
+	if uc.auditor != nil {
+		releaseAuditor(uc.auditor)
+		uc.auditor = nil
+	}
+
+	// Close the ASN database once no handler uses it
+	if uc.asnDB != nil {
+		// Closing a memory-mapped file doesn't fail in practice
+		_ = releaseASNDatabase(uc.asnDB)
+		uc.asnDB = nil
+	}
+
+	// Stop the bot verification worker once no handler uses it
+	if uc.botVerifier != nil {
+		err := releaseBotVerifier(uc.botVerifier)
+		uc.botVerifier = nil
+		if err != nil {
+			return fmt.Errorf("saving bot verification cache: %v", err)
+		}
+	}
+
+	if otlpErr != nil {
+		return fmt.Errorf("closing otlp exporter: %v", otlpErr)
+	}
+	if pushgatewayErr != nil {
+		return fmt.Errorf("pushing usage metrics on shutdown: %v", pushgatewayErr)
+	}
+	if eventLogErr != nil {
+		return fmt.Errorf("closing event log: %v", eventLogErr)
+	}
+	if clickhouseErr != nil {
+		return fmt.Errorf("inserting usage rows into clickhouse on shutdown: %v", clickhouseErr)
+	}
+	if counterStoreErr != nil {
+		return fmt.Errorf("saving usage counters: %v", counterStoreErr)
+	}
+	if legacyErr != nil {
+		return fmt.Errorf("saving legacy client observations: %v", legacyErr)
+	}
+	if rollupsErr != nil {
+		return fmt.Errorf("saving usage rollups: %v", rollupsErr)
+	}
+
 	return nil
 }
 
 // Validate implements caddy.Validator to ensure the module configuration is valid
 func (uc *UsageCollector) Validate() error {
+	if _, ok := usageProfiles[uc.Profile]; uc.Profile != "" && !ok {
+		return fmt.Errorf("unknown profile '%s', expected one of %s", uc.Profile, strings.Join(profileNames(), ", "))
+	}
+	if uc.SampleRate < 0 || uc.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1, got %g", uc.SampleRate)
+	}
+	if uc.LLM != nil && uc.LLM.MaxBody < 0 {
+		return fmt.Errorf("llm max_body must not be negative, got %d", uc.LLM.MaxBody)
+	}
+	if uc.JSONRPC != nil && uc.JSONRPC.MaxBody < 0 {
+		return fmt.Errorf("jsonrpc max_body must not be negative, got %d", uc.JSONRPC.MaxBody)
+	}
+	if uc.SOAP != nil && uc.SOAP.MaxBody < 0 {
+		return fmt.Errorf("soap max_body must not be negative, got %d", uc.SOAP.MaxBody)
+	}
+	if uc.Inspect != nil {
+		if err := uc.Inspect.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.Namespace != "" && !metricsNamespaceRegexp.MatchString(uc.Namespace) {
+		return fmt.Errorf("invalid namespace '%s': must start with a letter and contain only letters, digits and underscores", uc.Namespace)
+	}
+	if uc.VerifyBots != nil {
+		if err := uc.VerifyBots.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.WarmUp != nil {
+		if err := uc.WarmUp.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.LongRunning < 0 {
+		return fmt.Errorf("long_running must not be negative, got %s", time.Duration(uc.LongRunning))
+	}
+	if uc.ActiveWindow < 0 {
+		return fmt.Errorf("active_window must not be negative, got %s", time.Duration(uc.ActiveWindow))
+	}
+	if uc.TopK < 0 {
+		return fmt.Errorf("top_k must not be negative, got %d", uc.TopK)
+	}
+	if uc.CollectionBudget < 0 {
+		return fmt.Errorf("collection_budget must not be negative, got %s", time.Duration(uc.CollectionBudget))
+	}
+	if uc.OTLP != nil {
+		if err := uc.OTLP.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.FaultInjection != nil {
+		if err := uc.FaultInjection.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.EventLog != nil {
+		if err := uc.EventLog.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.ClickHouse != nil {
+		if err := uc.ClickHouse.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.ContentHash != nil {
+		if err := uc.ContentHash.validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateTenantReports(uc.TenantReports); err != nil {
+		return err
+	}
+	if uc.PersistCounters != nil {
+		if err := uc.PersistCounters.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.URLQuery != nil {
+		if err := uc.URLQuery.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.Labels != nil {
+		if err := uc.Labels.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.JWT != nil {
+		if err := uc.JWT.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.Quota != nil {
+		if err := uc.Quota.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.Audit != nil {
+		if err := uc.Audit.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.LegacyClients != nil {
+		if err := uc.LegacyClients.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.Rollups != nil {
+		if err := uc.Rollups.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.Streams != nil {
+		if err := uc.Streams.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.Dashboard != nil {
+		if err := uc.Dashboard.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.Pushgateway != nil {
+		if err := uc.Pushgateway.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.ClockCheck != nil {
+		if err := uc.ClockCheck.validate(); err != nil {
+			return err
+		}
+	}
+	if uc.StatsD != nil {
+		if err := uc.StatsD.validate(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // parseCaddyfile parses the Caddyfile configuration for the usage directive
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var uc UsageCollector
+	err := uc.UnmarshalCaddyfile(h.Dispenser)
+	return &uc, err
+}
 
-	// The usage directive doesn't require any configuration parameters
-	// It automatically collects metrics when Caddy's metrics are enabled
-	for h.Next() {
-		// No additional configuration needed
-		if h.NextArg() {
-			return nil, h.ArgErr()
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	usage [profile <name>] {
+//	    profile <name>
+//	    route_name <name>
+//	    sample_rate <fraction>
+//	    namespace <name>
+//	    active_window <duration>
+//	    data_bundle <dir>
+//	    asn_database <path>
+//	    long_running <duration>
+//	    collection_budget <duration>
+//	    top_k [<size>]
+//	    unique_clients [<header>]
+//	    aggregates
+//	    headers <names...>
+//	    delta_temporality
+//	    host_group <pattern> <group>
+//	    apdex <group> <threshold> [<paths...>]
+//	    slo <group> {
+//	        latency <duration>
+//	        objective <ratio>
+//	        hosts <patterns...>
+//	        paths <patterns...>
+//	    }
+//	    collapse_hosts
+//	    exclude_paths <patterns...>
+//	    exclude_hosts <patterns...>
+//	    divert_methods [<methods...>]
+//	    cookies [<names...>]
+//	    cost_headers <names...>
+//	    cost_tenant <placeholder>
+//	    server_timing [<names...>]
+//	    cache_results [<headers...>]
+//	    campaigns [<params...>]
+//	    url_query keep|strip|sort|allow [<params...>]
+//	    labels [<metric>] {
+//	        <name> <placeholder>
+//	    }
+//	    users [hash]
+//	    api_keys {
+//	        header <name>
+//	        query <param>
+//	        hash
+//	    }
+//	    jwt {
+//	        header <name>
+//	        claim <label> [<claim>]
+//	        jwks <url>
+//	    }
+//	    quota <limit> <window> [ip|api_key]
+//	    referrers [{
+//	        internal <domains...>
+//	        search <domains...>
+//	        social <domains...>
+//	    }]
+//	    llm {
+//	        <option> <value>
+//	    }
+//	    jsonrpc {
+//	        max_body <size>
+//	    }
+//	    soap {
+//	        max_body <size>
+//	    }
+//	    inspect {
+//	        max_body <size>
+//	        sample_rate <fraction>
+//	        <inspector> [<args...>]
+//	    }
+//	    classifier <name> [<args...>]
+//	    normalize_paths [{
+//	        ids
+//	        <regexp> <replacement>
+//	    }]
+//	    statsd [<address>] [{
+//	        prefix <prefix>
+//	        dogstatsd
+//	        tags <tags...>
+//	        flush_interval <duration>
+//	        exclusive
+//	    }]
+//	    otlp [{
+//	        endpoint <address>
+//	        protocol grpc|http
+//	        interval <duration>
+//	        header <name> <value>
+//	        insecure
+//	    }]
+//	    pushgateway [<url>] [{
+//	        job <name>
+//	        grouping <label> <value>
+//	        interval <duration>
+//	        header <name> <value>
+//	        push_on_shutdown
+//	    }]
+//	    event_log <path> [{
+//	        headers <names...>
+//	        max_size <size>
+//	        rotate_every <duration>
+//	        max_files <count>
+//	    }]
+//	    clickhouse [<url>] [{
+//	        database <name>
+//	        table <name>
+//	        username <name>
+//	        password <password>
+//	        headers <names...>
+//	        batch_size <rows>
+//	        flush_interval <duration>
+//	        max_pending <rows>
+//	        create_table
+//	    }]
+//	    content_hash [{
+//	        sample_rate <fraction>
+//	        max_body <size>
+//	    }]
+//	    tenant_report <tenant> <webhook> {
+//	        hosts <patterns...>
+//	        api_keys <keys...>
+//	        key_header <name>
+//	        interval <duration>
+//	        header <name> <value>
+//	        availability <fraction>
+//	        latency <duration> [<fraction>]
+//	    }
+//	    legacy_clients {
+//	        file <path>
+//	        window <duration>
+//	    }
+//	    rollups {
+//	        file <path>
+//	        retention <duration>
+//	    }
+//	    streams [<min_duration>]
+//	    dashboard [<path>] {
+//	        basic_auth <username> <hashed_password>
+//	        public
+//	    }
+//	    reset_token <token>
+//	    audit <access_log> [{
+//	        id_header <name>
+//	        sample_rate <fraction>
+//	        tolerance <duration>
+//	    }]
+//	    persist_counters <path> {
+//	        interval <duration>
+//	    }
+//	    fault_injection {
+//	        sinks <names...>
+//	        drop_rate <fraction>
+//	        latency <duration>
+//	        gather_fail_rate <fraction>
+//	    }
+//	    clock_check [{
+//	        ntp_server <host[:port]>
+//	        interval <duration>
+//	        max_skew <duration>
+//	    }]
+//	    verify_bots [{
+//	        cache_file <path>
+//	        ttl <duration>
+//	        negative_ttl <duration>
+//	    }]
+//	    warm_up {
+//	        hosts <hosts...>
+//	        paths <paths...>
+//	        methods <methods...>
+//	        status_codes <codes...>
+//	    }
+//	    label_policy {
+//	        <action> <label> [<args...>]
+//	    }
+//	    relabel [<action>] {
+//	        source_labels <labels...>
+//	        separator <separator>
+//	        regex <regexp>
+//	        target_label <label>
+//	        replacement <replacement>
+//	    }
+//	}
+//
+// All options are optional; a bare `usage` directive collects the default metrics.
+// The route_name and sample_rate options treat empty values and omitted snippet
+// arguments as unset, so that snippets can take them as optional arguments,
+// like route_name {args[0]}.
+func (uc *UsageCollector) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		// The only inline arguments accepted are a profile selection
+		switch args := d.RemainingArgs(); {
+		case len(args) == 0:
+		case len(args) == 2 && args[0] == "profile":
+			uc.Profile = args[1]
+		default:
+			return d.ArgErr()
 		}
-	}
 
-	return &uc, nil
-}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "profile":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				uc.Profile = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "route_name":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				uc.RouteName = snippetArg(d.Val())
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "sample_rate":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rate, err := parseSampleRate(d.Val())
+				if err != nil {
+					return d.Errf("invalid sample_rate '%s': %v", d.Val(), err)
+				}
+				uc.SampleRate = rate
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "sampled_header":
+				uc.SampledHeader = defaultSampledHeader
+				if d.NextArg() {
+					uc.SampledHeader = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "namespace":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				uc.Namespace = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "data_bundle":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				uc.DataBundle = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "asn_database":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				uc.ASNDatabase = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "active_window":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				window, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid active_window '%s': %v", d.Val(), err)
+				}
+				uc.ActiveWindow = caddy.Duration(window)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "long_running":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				threshold, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid long_running '%s': %v", d.Val(), err)
+				}
+				uc.LongRunning = caddy.Duration(threshold)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "aggregates":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				uc.Aggregates = true
+
+			case "unique_clients":
+				cfg, err := unmarshalUniqueClients(d)
+				if err != nil {
+					return err
+				}
+				uc.UniqueClients = cfg
+
+			case "top_k":
+				uc.TopK = defaultTopK
+				if d.NextArg() {
+					k, err := strconv.Atoi(d.Val())
+					if err != nil || k <= 0 {
+						return d.Errf("invalid top_k '%s': must be a positive integer", d.Val())
+					}
+					uc.TopK = k
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "collection_budget":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				budget, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid collection_budget '%s': %v", d.Val(), err)
+				}
+				uc.CollectionBudget = caddy.Duration(budget)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "headers":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				uc.TrackedHeaders = append(uc.TrackedHeaders, args...)
+
+			case "host_group":
+				group, err := unmarshalHostGroup(d)
+				if err != nil {
+					return err
+				}
+				uc.HostGroups = append(uc.HostGroups, group)
+
+			case "apdex":
+				target, err := unmarshalApdexTarget(d)
+				if err != nil {
+					return err
+				}
+				uc.Apdex = append(uc.Apdex, target)
+
+			case "slo":
+				target, err := unmarshalSLO(d)
+				if err != nil {
+					return err
+				}
+				uc.Apdex = append(uc.Apdex, target)
+
+			case "collapse_hosts":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				uc.CollapseHosts = true
+
+			case "exclude_paths":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				uc.ExcludePaths = append(uc.ExcludePaths, args...)
+
+			case "exclude_hosts":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				uc.ExcludeHosts = append(uc.ExcludeHosts, args...)
+
+			case "divert_methods":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					args = defaultDivertedMethods
+				}
+				for _, method := range args {
+					uc.DivertMethods = append(uc.DivertMethods, strings.ToUpper(method))
+				}
+
+			case "delta_temporality":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				uc.DeltaTemporality = true
+
+			case "cookies":
+				uc.CookieMetrics = true
+				uc.Cookies = append(uc.Cookies, d.RemainingArgs()...)
+
+			case "cost_headers":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				uc.CostHeaders = append(uc.CostHeaders, args...)
+
+			case "server_timing":
+				uc.ServerTiming = &ServerTimingConfig{Names: d.RemainingArgs()}
+
+			case "cache_results":
+				uc.CacheResults = &CacheResultsConfig{Headers: d.RemainingArgs()}
+
+			case "campaigns":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					args = defaultCampaignParams
+				}
+				uc.CampaignParams = append(uc.CampaignParams, args...)
+
+			case "url_query":
+				cfg, err := unmarshalURLQueryConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.URLQuery = cfg
+
+			case "labels":
+				cfg, err := unmarshalLabelsConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.Labels = cfg
+
+			case "users":
+				cfg := &UsersConfig{}
+				if d.NextArg() {
+					if d.Val() != "hash" {
+						return d.Errf("invalid users option '%s'", d.Val())
+					}
+					cfg.Hash = true
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				uc.Users = cfg
+
+			case "api_keys":
+				cfg, err := unmarshalAPIKeysConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.APIKeys = cfg
+
+			case "jwt":
+				cfg, err := unmarshalJWTConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.JWT = cfg
+
+			case "quota":
+				cfg, err := unmarshalQuotaConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.Quota = cfg
+
+			case "referrers":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				cfg, err := unmarshalReferrerConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.Referrers = cfg
+
+			case "cost_tenant":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				uc.CostTenant = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "llm":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				cfg, err := unmarshalLLMConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.LLM = cfg
+
+			case "jsonrpc":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				cfg, err := unmarshalJSONRPCConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.JSONRPC = cfg
+
+			case "soap":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				cfg, err := unmarshalSOAPConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.SOAP = cfg
+
+			case "classifier":
+				raw, err := unmarshalClassifier(d)
+				if err != nil {
+					return err
+				}
+				uc.ClassifiersRaw = append(uc.ClassifiersRaw, raw)
+
+			case "inspect":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				cfg, err := unmarshalInspectConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.Inspect = cfg
+
+			case "normalize_paths":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				pn, err := unmarshalPathNormalization(d)
+				if err != nil {
+					return err
+				}
+				uc.NormalizePaths = pn
+
+			case "statsd":
+				cfg, err := unmarshalStatsDConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.StatsD = cfg
+
+			case "otlp":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				cfg, err := unmarshalOTLPConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.OTLP = cfg
+
+			case "pushgateway":
+				cfg, err := unmarshalPushgatewayConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.Pushgateway = cfg
+
+			case "event_log":
+				cfg, err := unmarshalEventLogConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.EventLog = cfg
+
+			case "clickhouse":
+				cfg, err := unmarshalClickHouseConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.ClickHouse = cfg
+
+			case "content_hash":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				cfg, err := unmarshalContentHashConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.ContentHash = cfg
+
+			case "tenant_report":
+				report, err := unmarshalTenantReport(d)
+				if err != nil {
+					return err
+				}
+				uc.TenantReports = append(uc.TenantReports, report)
+
+			case "legacy_clients":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				cfg, err := unmarshalLegacyClientsConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.LegacyClients = cfg
+
+			case "rollups":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				cfg, err := unmarshalRollupsConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.Rollups = cfg
+
+			case "streams":
+				cfg, err := unmarshalStreamsConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.Streams = cfg
+
+			case "dashboard":
+				cfg, err := unmarshalDashboardConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.Dashboard = cfg
+
+			case "reset_token":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				uc.ResetToken = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "audit":
+				cfg, err := unmarshalAuditConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.Audit = cfg
+
+			case "persist_counters":
+				cfg, err := unmarshalPersistCountersConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.PersistCounters = cfg
+
+			case "fault_injection":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				cfg, err := unmarshalFaultInjectionConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.FaultInjection = cfg
+
+			case "clock_check":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				cfg, err := unmarshalClockCheckConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.ClockCheck = cfg
+
+			case "verify_bots":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				cfg, err := unmarshalBotVerification(d)
+				if err != nil {
+					return err
+				}
+				uc.VerifyBots = cfg
+
+			case "warm_up":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				cfg, err := unmarshalWarmUpConfig(d)
+				if err != nil {
+					return err
+				}
+				uc.WarmUp = cfg
+
+			case "label_policy":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				rules, err := unmarshalLabelPolicy(d)
+				if err != nil {
+					return err
+				}
+				uc.LabelPolicy = append(uc.LabelPolicy, rules...)
+
+			case "relabel":
+				rule, err := unmarshalRelabelRule(d)
+				if err != nil {
+					return err
+				}
+				uc.Relabel = append(uc.Relabel, rule)
+
+			default:
+				return d.Errf("unrecognized usage option '%s'", d.Val())
+			}
+		}
+	}
 
-// UnmarshalCaddyfile implements caddyfile.Unmarshaler for JSON configuration
-func (uc *UsageCollector) UnmarshalCaddyfile(_ *caddyfile.Dispenser) error {
-	// No configuration needed - the module works automatically
-	// when Caddy's metrics system is enabled
 	return nil
 }
 
@@ -0,0 +1,43 @@
+package caddyusage
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// defaultCampaignParams are the query parameters counted when campaigns
+// is enabled without any
+var defaultCampaignParams = []string{"utm_source", "utm_medium", "utm_campaign"}
+
+// collectCampaignMetrics counts the campaign parameters of a request's
+// query string, one series per parameter and value
+func (uc *UsageCollector) collectCampaignMetrics(um *usageMetrics, r *http.Request, host string) {
+	if len(uc.CampaignParams) == 0 || r.URL.RawQuery == "" {
+		return
+	}
+
+	query := r.URL.Query()
+	for _, param := range uc.CampaignParams {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		um.campaignRequests.WithLabelValues(host, param, uc.policy.apply(um, "value", value)).Inc()
+	}
+}
+
+// withoutQueryParams removes the given parameters from a raw query string,
+// keeping the others as they were
+func withoutQueryParams(rawQuery string, params []string) string {
+	kept := make([]string, 0, strings.Count(rawQuery, "&")+1)
+	for _, pair := range strings.Split(rawQuery, "&") {
+		key, _, _ := strings.Cut(pair, "=")
+		if name, err := url.QueryUnescape(key); err == nil && slices.Contains(params, name) {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	return strings.Join(kept, "&")
+}
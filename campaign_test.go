@@ -0,0 +1,75 @@
+package caddyusage
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestWithoutQueryParams tests that only the given parameters are removed
+// from query strings
+func TestWithoutQueryParams(t *testing.T) {
+	params := []string{"utm_source", "utm_medium"}
+	tests := map[string]string{
+		"utm_source=news&page=2&utm_medium=email": "page=2",
+		"b=2&a=1":                       "b=2&a=1",
+		"utm_source=x":                  "",
+		"utm%5Fsource=x&q=caddy+server": "q=caddy+server",
+		"utm_sourced=x&flag":            "utm_sourced=x&flag",
+	}
+	for query, expected := range tests {
+		if got := withoutQueryParams(query, params); got != expected {
+			t.Errorf("%q: expected %q, got %q", query, expected, got)
+		}
+	}
+}
+
+// TestCampaignMetrics tests that campaign parameters are counted and
+// stripped from the full_url label
+func TestCampaignMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.CampaignParams = defaultCampaignParams
+
+	rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+	rec.WriteHeader(200)
+	for _, target := range []string{
+		"http://example.com/pricing?utm_source=newsletter&utm_medium=email&utm_campaign=launch&plan=pro",
+		"http://example.com/pricing?utm_source=newsletter&plan=pro",
+		"http://example.com/pricing?utm_source=&plan=pro",
+		"http://example.com/pricing?utm_source=twitter",
+	} {
+		uc.collectMetrics(rec, httptest.NewRequest("GET", target, nil), now(), nil)
+	}
+
+	usagetest.AssertValue(t, registry, "campaign_requests_total", usagetest.Labels{"host": "example.com", "param": "utm_source", "value": "newsletter"}, 2)
+	usagetest.AssertValue(t, registry, "campaign_requests_total", usagetest.Labels{"param": "utm_source", "value": "twitter"}, 1)
+	usagetest.AssertValue(t, registry, "campaign_requests_total", usagetest.Labels{"param": "utm_medium", "value": "email"}, 1)
+	usagetest.AssertValue(t, registry, "campaign_requests_total", usagetest.Labels{"param": "utm_campaign", "value": "launch"}, 1)
+	usagetest.AssertCount(t, registry, "campaign_requests_total", nil, 4)
+
+	usagetest.AssertValue(t, registry, "requests_by_url_total", usagetest.Labels{"full_url": "http://example.com/pricing?plan=pro"}, 3)
+	usagetest.AssertValue(t, registry, "requests_by_url_total", usagetest.Labels{"full_url": "http://example.com/pricing"}, 1)
+}
+
+// TestUnmarshalCampaigns tests parsing of the campaigns option
+func TestUnmarshalCampaigns(t *testing.T) {
+	tests := map[string][]string{
+		"usage {\n campaigns\n}":                  {"utm_source", "utm_medium", "utm_campaign"},
+		"usage {\n campaigns utm_source gclid\n}": {"utm_source", "gclid"},
+	}
+	for input, expected := range tests {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(uc.CampaignParams, expected) {
+			t.Errorf("%q: expected %v, got %v", input, expected, uc.CampaignParams)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(RulesClassifier{})
+}
+
+// RequestClassifier is implemented by modules in the usage.classifiers
+// namespace. A classifier assigns a completed request to a class, such as
+// bot, abuse or a user persona, recorded by the classified_requests_total
+// metric. Classifiers run on every recorded request, after the response,
+// so they must be fast; a model too slow for that should classify
+// asynchronously and return a cached result. Returning an empty string
+// records nothing for the request.
+//
+// The built-in rules classifier matches requests against ordered rules.
+// Modules backed by a trained model, such as an ONNX model, can feed it
+// the features' Vector.
+type RequestClassifier interface {
+	Classify(features RequestFeatures) string
+}
+
+// RequestFeatures are the features of a completed request given to
+// classifiers. Header values other than the User-Agent and the query
+// string are left out, since they may carry credentials.
+type RequestFeatures struct {
+	Method        string
+	Host          string
+	Path          string
+	ClientIP      string
+	UserAgent     string
+	ProtoMajor    int
+	TLS           bool
+	Status        int
+	Duration      time.Duration
+	RequestBytes  int64
+	ResponseBytes int64
+	HeaderCount   int
+	QueryParams   int
+	HasReferer    bool
+	HasCookie     bool
+	HasLanguage   bool
+}
+
+// FeatureVectorNames names the elements of RequestFeatures.Vector, in
+// order. Elements are only ever appended, so that models trained on a
+// vector keep working with later versions.
+var FeatureVectorNames = []string{
+	"proto_major",
+	"tls",
+	"status",
+	"duration_seconds",
+	"request_bytes",
+	"response_bytes",
+	"header_count",
+	"query_params",
+	"path_length",
+	"path_depth",
+	"user_agent_length",
+	"has_user_agent",
+	"has_referer",
+	"has_cookie",
+	"has_language",
+	"safe_method",
+}
+
+// Vector returns the features as numbers, for models taking a fixed-size
+// input. The elements are named by FeatureVectorNames.
+func (f RequestFeatures) Vector() []float32 {
+	return []float32{
+		float32(f.ProtoMajor),
+		boolFeature(f.TLS),
+		float32(f.Status),
+		float32(f.Duration.Seconds()),
+		float32(f.RequestBytes),
+		float32(f.ResponseBytes),
+		float32(f.HeaderCount),
+		float32(f.QueryParams),
+		float32(len(f.Path)),
+		float32(strings.Count(strings.Trim(f.Path, "/"), "/") + 1),
+		float32(len(f.UserAgent)),
+		boolFeature(f.UserAgent != ""),
+		boolFeature(f.HasReferer),
+		boolFeature(f.HasCookie),
+		boolFeature(f.HasLanguage),
+		boolFeature(f.Method == http.MethodGet || f.Method == http.MethodHead || f.Method == http.MethodOptions),
+	}
+}
+
+// boolFeature encodes a boolean feature as 0 or 1
+func boolFeature(b bool) float32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// requestFeatures extracts the features of a completed request
+func requestFeatures(rec recordedResponse, r *http.Request, clientIP string, elapsed time.Duration) RequestFeatures {
+	requestBytes := r.ContentLength
+	if requestBytes < 0 {
+		requestBytes = 0
+	}
+	queryParams := 0
+	if r.URL.RawQuery != "" {
+		queryParams = strings.Count(r.URL.RawQuery, "&") + 1
+	}
+
+	return RequestFeatures{
+		Method:        r.Method,
+		Host:          hostWithoutPort(r.Host),
+		Path:          r.URL.Path,
+		ClientIP:      clientIP,
+		UserAgent:     r.UserAgent(),
+		ProtoMajor:    r.ProtoMajor,
+		TLS:           r.TLS != nil,
+		Status:        rec.Status(),
+		Duration:      elapsed,
+		RequestBytes:  requestBytes,
+		ResponseBytes: int64(rec.Size()),
+		HeaderCount:   len(r.Header),
+		QueryParams:   queryParams,
+		HasReferer:    r.Referer() != "",
+		HasCookie:     r.Header.Get("Cookie") != "",
+		HasLanguage:   r.Header.Get("Accept-Language") != "",
+	}
+}
+
+// namedClassifier is a loaded classifier and the name it is recorded under
+type namedClassifier struct {
+	name string
+	RequestClassifier
+}
+
+// provisionClassifiers loads the configured classifier modules
+func (uc *UsageCollector) provisionClassifiers(ctx caddy.Context) error {
+	if len(uc.ClassifiersRaw) == 0 {
+		return nil
+	}
+
+	mods, err := ctx.LoadModule(uc, "ClassifiersRaw")
+	if err != nil {
+		return fmt.Errorf("loading request classifiers: %v", err)
+	}
+
+	for _, mod := range mods.([]any) {
+		uc.classifiers = append(uc.classifiers, namedClassifier{
+			name:              mod.(caddy.Module).CaddyModule().ID.Name(),
+			RequestClassifier: mod.(RequestClassifier),
+		})
+	}
+	return nil
+}
+
+// unmarshalClassifier parses a classifier directive into the module's
+// JSON:
+//
+//	classifier <name> [<args...>]
+func unmarshalClassifier(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	unm, err := caddyfile.UnmarshalModule(d, "usage.classifiers."+name)
+	if err != nil {
+		return nil, err
+	}
+	return caddyconfig.JSONModuleObject(unm, "classifier", name, nil), nil
+}
+
+// collectClassMetrics runs the classifiers over a completed request
+func (uc *UsageCollector) collectClassMetrics(um *usageMetrics, rec recordedResponse, r *http.Request, rawIP, statusCode string, elapsed time.Duration) {
+	if len(uc.classifiers) == 0 {
+		return
+	}
+
+	features := requestFeatures(rec, r, rawIP, elapsed)
+	for _, classifier := range uc.classifiers {
+		class := classifier.Classify(features)
+		if class == "" {
+			continue
+		}
+		class = uc.policy.apply(um, "class", class)
+		um.classifiedRequests.WithLabelValues(classifier.name, class, statusCode).Inc()
+	}
+}
+
+// RulesClassifier classifies requests with ordered rules: a request is
+// assigned the class of the first rule it matches, or the default class.
+type RulesClassifier struct {
+	// Rules are evaluated in order.
+	Rules []ClassRule `json:"rules,omitempty"`
+
+	// Default is the class of requests matching no rule. Defaults to
+	// recording nothing for them.
+	Default string `json:"default,omitempty"`
+
+	rules []compiledClassRule
+}
+
+// ClassRule assigns a class to the requests matching all of its
+// conditions. Each condition matches when any of its values does, and
+// unset conditions match every request.
+type ClassRule struct {
+	// Class is the class assigned to matching requests.
+	Class string `json:"class"`
+
+	// Methods are HTTP methods, matched case-insensitively.
+	Methods []string `json:"methods,omitempty"`
+
+	// Hosts are case-insensitive globs or regular expressions starting
+	// with ^, like exclude_hosts.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Paths are globs or regular expressions, like exclude_paths.
+	Paths []string `json:"paths,omitempty"`
+
+	// UserAgents are case-insensitive globs or regular expressions. An
+	// empty pattern matches requests without a User-Agent.
+	UserAgents []string `json:"user_agents,omitempty"`
+
+	// StatusCodes are globs over response status codes, like 404 or 4??.
+	StatusCodes []string `json:"status_codes,omitempty"`
+
+	// MinDuration matches requests taking at least this long.
+	MinDuration caddy.Duration `json:"min_duration,omitempty"`
+}
+
+// compiledClassRule is a ClassRule with its patterns compiled
+type compiledClassRule struct {
+	ClassRule
+	hosts       []*regexp.Regexp
+	paths       []*regexp.Regexp
+	userAgents  []*regexp.Regexp
+	statusCodes []*regexp.Regexp
+}
+
+// CaddyModule returns the Caddy module information
+func (RulesClassifier) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "usage.classifiers.rules",
+		New: func() caddy.Module { return new(RulesClassifier) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (rc *RulesClassifier) Provision(caddy.Context) error {
+	rc.rules = make([]compiledClassRule, 0, len(rc.Rules))
+	for i, rule := range rc.Rules {
+		compiled := compiledClassRule{ClassRule: rule}
+		var err error
+		if compiled.hosts, err = compilePatterns(rule.Hosts, true); err != nil {
+			return fmt.Errorf("class rule %d: %v", i, err)
+		}
+		if compiled.paths, err = compilePatterns(rule.Paths, false); err != nil {
+			return fmt.Errorf("class rule %d: %v", i, err)
+		}
+		if compiled.userAgents, err = compilePatterns(rule.UserAgents, true); err != nil {
+			return fmt.Errorf("class rule %d: %v", i, err)
+		}
+		if compiled.statusCodes, err = compilePatterns(rule.StatusCodes, false); err != nil {
+			return fmt.Errorf("class rule %d: %v", i, err)
+		}
+		rc.rules = append(rc.rules, compiled)
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator
+func (rc *RulesClassifier) Validate() error {
+	if len(rc.Rules) == 0 && rc.Default == "" {
+		return fmt.Errorf("rules classifier requires at least one class rule or a default class")
+	}
+	for i, rule := range rc.Rules {
+		if rule.Class == "" {
+			return fmt.Errorf("class rule %d: class is required", i)
+		}
+		if rule.MinDuration < 0 {
+			return fmt.Errorf("class rule %d: min_duration must not be negative, got %s", i, time.Duration(rule.MinDuration))
+		}
+	}
+	return nil
+}
+
+// Classify implements RequestClassifier
+func (rc *RulesClassifier) Classify(f RequestFeatures) string {
+	for _, rule := range rc.rules {
+		if rule.matches(f) {
+			return rule.Class
+		}
+	}
+	return rc.Default
+}
+
+// matches reports whether a request meets all of the rule's conditions
+func (rule *compiledClassRule) matches(f RequestFeatures) bool {
+	if len(rule.Methods) > 0 && !containsFold(rule.Methods, f.Method) {
+		return false
+	}
+	if time.Duration(rule.MinDuration) > f.Duration {
+		return false
+	}
+	return matchesAny(rule.hosts, f.Host) &&
+		matchesAny(rule.paths, f.Path) &&
+		matchesAny(rule.userAgents, f.UserAgent) &&
+		matchesAny(rule.statusCodes, strconv.Itoa(f.Status))
+}
+
+// matchesAny reports whether value matches any of the patterns, or
+// whether there are none
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, re := range patterns {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold reports whether values contains s, ignoring case
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	rules {
+//	    class <name> {
+//	        method <methods...>
+//	        host <patterns...>
+//	        path <patterns...>
+//	        user_agent <patterns...>
+//	        status <codes...>
+//	        min_duration <duration>
+//	    }
+//	    default <class>
+//	}
+func (rc *RulesClassifier) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume classifier name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "class":
+			rule, err := unmarshalClassRule(d)
+			if err != nil {
+				return err
+			}
+			rc.Rules = append(rc.Rules, rule)
+
+		case "default":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rc.Default = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		default:
+			return d.Errf("unrecognized rules classifier option '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// unmarshalClassRule parses a class block of the rules classifier
+func unmarshalClassRule(d *caddyfile.Dispenser) (ClassRule, error) {
+	var rule ClassRule
+	if !d.NextArg() {
+		return rule, d.ArgErr()
+	}
+	rule.Class = d.Val()
+	if d.NextArg() {
+		return rule, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if option == "min_duration" {
+			if !d.NextArg() {
+				return rule, d.ArgErr()
+			}
+			duration, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return rule, d.Errf("invalid min_duration '%s': %v", d.Val(), err)
+			}
+			rule.MinDuration = caddy.Duration(duration)
+			if d.NextArg() {
+				return rule, d.ArgErr()
+			}
+			continue
+		}
+
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return rule, d.ArgErr()
+		}
+		switch option {
+		case "method":
+			rule.Methods = append(rule.Methods, args...)
+		case "host":
+			rule.Hosts = append(rule.Hosts, args...)
+		case "path":
+			rule.Paths = append(rule.Paths, args...)
+		case "user_agent":
+			rule.UserAgents = append(rule.UserAgents, args...)
+		case "status":
+			rule.StatusCodes = append(rule.StatusCodes, args...)
+		default:
+			return rule, d.Errf("unrecognized class rule option '%s'", option)
+		}
+	}
+	return rule, nil
+}
+
+// Interface guards
+var (
+	_ RequestClassifier     = (*RulesClassifier)(nil)
+	_ caddy.Provisioner     = (*RulesClassifier)(nil)
+	_ caddy.Validator       = (*RulesClassifier)(nil)
+	_ caddyfile.Unmarshaler = (*RulesClassifier)(nil)
+)
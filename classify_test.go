@@ -0,0 +1,204 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestRulesClassifier tests that requests get the class of the first rule
+// they match, or the default class
+func TestRulesClassifier(t *testing.T) {
+	rc := &RulesClassifier{
+		Rules: []ClassRule{
+			{Class: "scraper", UserAgents: []string{"*python-requests*", "*curl*"}, Paths: []string{"/api/*"}},
+			{Class: "no_user_agent", UserAgents: []string{""}},
+			{Class: "prober", StatusCodes: []string{"4??"}, Methods: []string{"get"}, Hosts: []string{"*.example.com"}},
+			{Class: "slow_export", Paths: []string{"/export"}, MinDuration: caddy.Duration(time.Second)},
+		},
+		Default: "human",
+	}
+	if err := rc.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := rc.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		features RequestFeatures
+		expected string
+	}{
+		{"scraper", RequestFeatures{Path: "/api/users", UserAgent: "Python-Requests/2.31"}, "scraper"},
+		{"scraper outside api", RequestFeatures{Path: "/", UserAgent: "curl/8.5.0"}, "human"},
+		{"no user agent", RequestFeatures{Path: "/api/users"}, "no_user_agent"},
+		{"prober", RequestFeatures{Method: "GET", Host: "WWW.example.com", Status: 404, UserAgent: "x"}, "prober"},
+		{"prober wrong method", RequestFeatures{Method: "POST", Host: "www.example.com", Status: 404, UserAgent: "x"}, "human"},
+		{"prober success", RequestFeatures{Method: "GET", Host: "www.example.com", Status: 200, UserAgent: "x"}, "human"},
+		{"slow export", RequestFeatures{Path: "/export", Duration: 2 * time.Second, UserAgent: "x"}, "slow_export"},
+		{"fast export", RequestFeatures{Path: "/export", Duration: time.Millisecond, UserAgent: "x"}, "human"},
+	}
+	for _, tt := range tests {
+		if got := rc.Classify(tt.features); got != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, got)
+		}
+	}
+}
+
+// TestRulesClassifierValidate tests validation of class rules
+func TestRulesClassifierValidate(t *testing.T) {
+	tests := map[string]struct {
+		classifier RulesClassifier
+		expectErr  bool
+	}{
+		"default only":     {classifier: RulesClassifier{Default: "human"}},
+		"rule only":        {classifier: RulesClassifier{Rules: []ClassRule{{Class: "bot"}}}},
+		"empty":            {expectErr: true},
+		"missing class":    {classifier: RulesClassifier{Rules: []ClassRule{{Paths: []string{"/"}}}}, expectErr: true},
+		"negative minimum": {classifier: RulesClassifier{Rules: []ClassRule{{Class: "bot", MinDuration: -1}}}, expectErr: true},
+	}
+	for name, tt := range tests {
+		if err := tt.classifier.Validate(); (err != nil) != tt.expectErr {
+			t.Errorf("%s: expected error %v, got %v", name, tt.expectErr, err)
+		}
+	}
+
+	invalid := RulesClassifier{Rules: []ClassRule{{Class: "bot", UserAgents: []string{"^("}}}}
+	if err := invalid.Provision(caddy.Context{}); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
+
+// TestRequestFeatures tests the features extracted from a request and
+// their vector
+func TestRequestFeatures(t *testing.T) {
+	req := httptest.NewRequest("POST", "https://example.com:8443/api/v1/users?page=2&sort=name", strings.NewReader("{}"))
+	req.Header.Set("User-Agent", "test-agent")
+	req.Header.Set("Cookie", "session=abc")
+	rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+	rec.WriteHeader(201)
+	_, _ = rec.Write([]byte("created"))
+
+	f := requestFeatures(rec, req, "192.0.2.1", 250*time.Millisecond)
+	expected := RequestFeatures{
+		Method:        "POST",
+		Host:          "example.com",
+		Path:          "/api/v1/users",
+		ClientIP:      "192.0.2.1",
+		UserAgent:     "test-agent",
+		ProtoMajor:    1,
+		TLS:           true,
+		Status:        201,
+		Duration:      250 * time.Millisecond,
+		RequestBytes:  2,
+		ResponseBytes: 7,
+		HeaderCount:   2,
+		QueryParams:   2,
+		HasCookie:     true,
+	}
+	if f != expected {
+		t.Errorf("Expected %+v, got %+v", expected, f)
+	}
+
+	vector := f.Vector()
+	if len(vector) != len(FeatureVectorNames) {
+		t.Fatalf("Expected %d features, got %d", len(FeatureVectorNames), len(vector))
+	}
+	for name, want := range map[string]float32{"status": 201, "path_depth": 3, "has_cookie": 1, "has_referer": 0, "safe_method": 0} {
+		if got := vector[slices.Index(FeatureVectorNames, name)]; got != want {
+			t.Errorf("%s: expected %v, got %v", name, want, got)
+		}
+	}
+}
+
+// staticClassifier assigns every request the same class
+type staticClassifier string
+
+func (c staticClassifier) Classify(RequestFeatures) string { return string(c) }
+
+// TestClassMetrics tests that classes are recorded per classifier, and
+// that empty classes record nothing
+func TestClassMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.classifiers = []namedClassifier{
+		{name: "model", RequestClassifier: staticClassifier("abuse")},
+		{name: "undecided", RequestClassifier: staticClassifier("")},
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+	rec.WriteHeader(http.StatusForbidden)
+	uc.collectMetrics(rec, req, now(), nil)
+	uc.collectMetrics(rec, req, now(), nil)
+
+	usagetest.AssertValue(t, registry, "classified_requests_total", usagetest.Labels{"classifier": "model", "class": "abuse", "status_code": "403"}, 2)
+	usagetest.AssertAbsent(t, registry, "classified_requests_total", usagetest.Labels{"classifier": "undecided"})
+}
+
+// TestUnmarshalClassifier tests parsing of classifier directives
+func TestUnmarshalClassifier(t *testing.T) {
+	var uc UsageCollector
+	input := `usage {
+		classifier rules {
+			class scraper {
+				user_agent *python* *curl*
+				path /api/*
+				method GET HEAD
+				status 2??
+				min_duration 10ms
+			}
+			class unknown
+			default human
+		}
+	}`
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(uc.ClassifiersRaw) != 1 {
+		t.Fatalf("Expected 1 classifier, got %d", len(uc.ClassifiersRaw))
+	}
+
+	var classifier struct {
+		Classifier string `json:"classifier"`
+		RulesClassifier
+	}
+	if err := json.Unmarshal(uc.ClassifiersRaw[0], &classifier); err != nil {
+		t.Fatalf("Invalid classifier JSON: %v", err)
+	}
+	if classifier.Classifier != "rules" || classifier.Default != "human" || len(classifier.Rules) != 2 {
+		t.Fatalf("Unexpected classifier JSON: %s", uc.ClassifiersRaw[0])
+	}
+	rule := classifier.Rules[0]
+	if rule.Class != "scraper" || len(rule.UserAgents) != 2 || rule.Paths[0] != "/api/*" || len(rule.Methods) != 2 ||
+		rule.StatusCodes[0] != "2??" || rule.MinDuration != caddy.Duration(10*time.Millisecond) {
+		t.Errorf("Unexpected class rule: %+v", rule)
+	}
+
+	for _, invalid := range []string{
+		"usage {\n classifier\n}",
+		"usage {\n classifier no_such_classifier\n}",
+		"usage {\n classifier rules extra\n}",
+		"usage {\n classifier rules {\n class\n }\n}",
+		"usage {\n classifier rules {\n class bot {\n path\n }\n }\n}",
+		"usage {\n classifier rules {\n class bot {\n min_duration soon\n }\n }\n}",
+		"usage {\n classifier rules {\n class bot {\n referer *\n }\n }\n}",
+		"usage {\n classifier rules {\n fallback human\n }\n}",
+	} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
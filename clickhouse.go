@@ -0,0 +1,472 @@
+package caddyusage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// ClickHouse writer defaults and bounds
+const (
+	defaultClickHouseURL           = "http://localhost:8123"
+	defaultClickHouseDatabase      = "default"
+	defaultClickHouseTable         = "caddy_usage_events"
+	defaultClickHouseBatchSize     = 1000
+	defaultClickHouseFlushInterval = 5 * time.Second
+	defaultClickHouseMaxPending    = 100000
+	clickHouseTimeout              = 30 * time.Second
+	clickHouseMaxErrorBytes        = 4 << 10
+)
+
+// clickHouseIdentifier matches the database and table names accepted,
+// which need no quoting or escaping
+var clickHouseIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// clickHouseSchema creates the table of request records, with the columns
+// of usageEvent's JSON fields. %s is the quoted table name.
+const clickHouseSchema = `CREATE TABLE IF NOT EXISTS %s (
+	time DateTime64(3, 'UTC'),
+	duration_seconds Float64,
+	client_ip String,
+	method LowCardinality(String),
+	host LowCardinality(String),
+	path String,
+	status UInt16,
+	bytes UInt64,
+	headers Map(String, String),
+	clock_skewed Bool
+) ENGINE = MergeTree
+PARTITION BY toYYYYMM(time)
+ORDER BY (host, time)`
+
+// ClickHouseConfig configures inserting one row per request into a
+// ClickHouse table over its HTTP interface, for queries the metrics'
+// labels are too coarse for, such as per-customer billing.
+type ClickHouseConfig struct {
+	// URL is the server's HTTP interface. Defaults to
+	// http://localhost:8123.
+	URL string `json:"url,omitempty"`
+
+	// Database is the table's database. Defaults to default.
+	Database string `json:"database,omitempty"`
+
+	// Table is the table rows are inserted into. Defaults to
+	// caddy_usage_events.
+	Table string `json:"table,omitempty"`
+
+	// Username and Password authenticate the inserts.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Headers are request headers recorded in the headers column.
+	// Credentials, such as Authorization, are only recorded as present.
+	Headers []string `json:"headers,omitempty"`
+
+	// BatchSize is the number of rows inserted at once. Defaults to 1000.
+	BatchSize int `json:"batch_size,omitempty"`
+
+	// FlushInterval is the longest time rows wait to be inserted.
+	// Defaults to 5s.
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+
+	// MaxPending is the number of rows kept while inserts fail, past
+	// which the oldest are dropped. Defaults to 100000.
+	MaxPending int `json:"max_pending,omitempty"`
+
+	// CreateTable creates the table with the default schema if it
+	// doesn't exist.
+	CreateTable bool `json:"create_table,omitempty"`
+}
+
+// validate checks the URL, names and batching settings
+func (cc *ClickHouseConfig) validate() error {
+	if cc.URL != "" {
+		u, err := url.Parse(cc.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid clickhouse url '%s': expected an http or https URL", cc.URL)
+		}
+	}
+	for _, name := range []string{cc.Database, cc.Table} {
+		if name != "" && !clickHouseIdentifier.MatchString(name) {
+			return fmt.Errorf("invalid clickhouse name '%s': expected letters, digits and underscores", name)
+		}
+	}
+	if cc.BatchSize < 0 {
+		return fmt.Errorf("clickhouse batch_size must not be negative, got %d", cc.BatchSize)
+	}
+	if cc.MaxPending < 0 {
+		return fmt.Errorf("clickhouse max_pending must not be negative, got %d", cc.MaxPending)
+	}
+	if cc.FlushInterval < 0 {
+		return fmt.Errorf("clickhouse flush_interval must not be negative, got %s", time.Duration(cc.FlushInterval))
+	}
+	return nil
+}
+
+// clickHouseWriter batches request records and inserts them. Handlers
+// with the same configuration share a writer, so config reloads keep it.
+type clickHouseWriter struct {
+	key         string
+	url         string
+	table       string
+	username    string
+	password    string
+	batchSize   int
+	maxPending  int
+	interval    time.Duration
+	createTable bool
+	client      *http.Client
+	logger      *zap.Logger
+
+	mu         sync.Mutex
+	pending    []*usageEvent
+	dropped    int
+	tableReady bool
+	failing    bool
+
+	full chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// clickHouseWriterEntry is a shared writer and the number of handlers
+// using it
+type clickHouseWriterEntry struct {
+	writer *clickHouseWriter
+	refs   int
+}
+
+var (
+	// Running writers by configuration
+	clickHouseWriters   = make(map[string]*clickHouseWriterEntry)
+	clickHouseWritersMu sync.Mutex
+)
+
+// acquireClickHouseWriter returns the running writer for the
+// configuration, starting one if needed. Each successful call must be
+// balanced by a call to releaseClickHouseWriter.
+func acquireClickHouseWriter(cc *ClickHouseConfig, logger *zap.Logger) (*clickHouseWriter, error) {
+	clickHouseWritersMu.Lock()
+	defer clickHouseWritersMu.Unlock()
+
+	key, err := json.Marshal(cc)
+	if err != nil {
+		return nil, err
+	}
+	if entry, ok := clickHouseWriters[string(key)]; ok {
+		entry.refs++
+		return entry.writer, nil
+	}
+
+	w := &clickHouseWriter{
+		key:         string(key),
+		url:         defaultClickHouseURL,
+		username:    cc.Username,
+		password:    cc.Password,
+		batchSize:   defaultClickHouseBatchSize,
+		maxPending:  defaultClickHouseMaxPending,
+		interval:    defaultClickHouseFlushInterval,
+		createTable: cc.CreateTable,
+		client:      &http.Client{Timeout: clickHouseTimeout},
+		logger:      logger,
+		full:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	if cc.URL != "" {
+		w.url = cc.URL
+	}
+	database, table := defaultClickHouseDatabase, defaultClickHouseTable
+	if cc.Database != "" {
+		database = cc.Database
+	}
+	if cc.Table != "" {
+		table = cc.Table
+	}
+	w.table = "`" + database + "`.`" + table + "`"
+	if cc.BatchSize > 0 {
+		w.batchSize = cc.BatchSize
+	}
+	if cc.MaxPending > 0 {
+		w.maxPending = cc.MaxPending
+	}
+	if cc.FlushInterval > 0 {
+		w.interval = time.Duration(cc.FlushInterval)
+	}
+
+	w.run()
+	clickHouseWriters[w.key] = &clickHouseWriterEntry{writer: w, refs: 1}
+	return w, nil
+}
+
+// releaseClickHouseWriter releases a handler's use of a writer, inserting
+// the pending rows and stopping it once no handler uses it anymore
+func releaseClickHouseWriter(w *clickHouseWriter) error {
+	clickHouseWritersMu.Lock()
+	defer clickHouseWritersMu.Unlock()
+
+	entry, ok := clickHouseWriters[w.key]
+	if !ok || entry.writer != w {
+		return nil
+	}
+	if entry.refs--; entry.refs > 0 {
+		return nil
+	}
+	delete(clickHouseWriters, w.key)
+	return w.stop()
+}
+
+// run inserts the pending rows every interval, or as soon as a batch is
+// full, until stopped
+func (w *clickHouseWriter) run() {
+	ticker := newTicker(w.interval)
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				w.flushLogged()
+			case <-w.full:
+				w.flushLogged()
+			case <-w.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the writer, and inserts the pending rows a last time
+func (w *clickHouseWriter) stop() error {
+	close(w.done)
+	w.wg.Wait()
+	defer w.client.CloseIdleConnections()
+	return w.flush()
+}
+
+// add queues a row, dropping the oldest when inserts keep failing
+func (w *clickHouseWriter) add(event *usageEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) >= w.maxPending {
+		releaseUsageEvent(w.pending[0])
+		w.pending = w.pending[1:]
+		w.dropped++
+	}
+	w.pending = append(w.pending, event)
+	if len(w.pending) >= w.batchSize {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flushLogged inserts the pending rows, logging when inserts start or stop
+// failing
+func (w *clickHouseWriter) flushLogged() {
+	err := w.flush()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch {
+	case err != nil && !w.failing:
+		w.logger.Warn("failed to insert usage rows into clickhouse", zap.Error(err))
+	case err == nil && w.failing:
+		w.logger.Info("inserting usage rows into clickhouse again", zap.Int("dropped", w.dropped))
+		w.dropped = 0
+	}
+	w.failing = err != nil
+}
+
+// flush inserts the pending rows in batches, putting back those not
+// inserted for the next flush
+func (w *clickHouseWriter) flush() error {
+	for {
+		w.mu.Lock()
+		n := min(len(w.pending), w.batchSize)
+		batch := slices.Clone(w.pending[:n])
+		w.pending = w.pending[n:]
+		w.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		if err := w.insert(batch); err != nil {
+			w.mu.Lock()
+			w.pending = slices.Concat(batch, w.pending)
+			if excess := len(w.pending) - w.maxPending; excess > 0 {
+				for _, event := range w.pending[:excess] {
+					releaseUsageEvent(event)
+				}
+				w.pending = w.pending[excess:]
+				w.dropped += excess
+			}
+			w.mu.Unlock()
+			return err
+		}
+		for _, event := range batch {
+			releaseUsageEvent(event)
+		}
+	}
+}
+
+// insert creates the table if needed, and inserts a batch of rows
+func (w *clickHouseWriter) insert(batch []*usageEvent) error {
+	if err := sinkFault(sinkClickHouse); err != nil {
+		return err
+	}
+
+	if w.createTable && !w.tableReady {
+		if err := w.exec(fmt.Sprintf(clickHouseSchema, w.table), nil); err != nil {
+			return fmt.Errorf("creating table: %v", err)
+		}
+		w.tableReady = true
+	}
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range batch {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	return w.exec("INSERT INTO "+w.table+" FORMAT JSONEachRow", &body)
+}
+
+// exec runs a query with an optional body of data
+func (w *clickHouseWriter) exec(query string, data io.Reader) error {
+	u, err := url.Parse(w.url)
+	if err != nil {
+		return err
+	}
+	params := u.Query()
+	params.Set("query", query)
+	params.Set("date_time_input_format", "best_effort")
+	u.RawQuery = params.Encode()
+
+	if data == nil {
+		data = http.NoBody
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clickHouseTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), data)
+	if err != nil {
+		return err
+	}
+	if w.username != "" {
+		req.Header.Set("X-ClickHouse-User", w.username)
+	}
+	if w.password != "" {
+		req.Header.Set("X-ClickHouse-Key", w.password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, clickHouseMaxErrorBytes))
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("clickhouse responded with status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// unmarshalClickHouseConfig parses a clickhouse block:
+//
+//	clickhouse [<url>] [{
+//	    database <name>
+//	    table <name>
+//	    username <name>
+//	    password <password>
+//	    headers <names...>
+//	    batch_size <rows>
+//	    flush_interval <duration>
+//	    max_pending <rows>
+//	    create_table
+//	}]
+func unmarshalClickHouseConfig(d *caddyfile.Dispenser) (*ClickHouseConfig, error) {
+	cc := new(ClickHouseConfig)
+	if d.NextArg() {
+		cc.URL = d.Val()
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "headers":
+			headers := d.RemainingArgs()
+			if len(headers) == 0 {
+				return nil, d.ArgErr()
+			}
+			cc.Headers = append(cc.Headers, headers...)
+			continue
+		case "create_table":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			cc.CreateTable = true
+			continue
+		}
+
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		value := d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		switch option {
+		case "database":
+			cc.Database = value
+		case "table":
+			cc.Table = value
+		case "username":
+			cc.Username = value
+		case "password":
+			cc.Password = value
+		case "batch_size", "max_pending":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, d.Errf("invalid clickhouse %s '%s'", option, value)
+			}
+			if option == "batch_size" {
+				cc.BatchSize = n
+			} else {
+				cc.MaxPending = n
+			}
+		case "flush_interval":
+			dur, err := caddy.ParseDuration(value)
+			if err != nil {
+				return nil, d.Errf("invalid clickhouse flush_interval '%s': %v", value, err)
+			}
+			cc.FlushInterval = caddy.Duration(dur)
+		default:
+			return nil, d.Errf("unrecognized clickhouse option '%s'", option)
+		}
+	}
+
+	return cc, nil
+}
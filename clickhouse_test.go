@@ -0,0 +1,276 @@
+package caddyusage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// clickHouseQuery is a query received by a fake ClickHouse server
+type clickHouseQuery struct {
+	query string
+	user  string
+	key   string
+	rows  []usageEvent
+}
+
+// fakeClickHouse starts a server answering queries over the HTTP
+// interface, failing them while failing is set
+func fakeClickHouse(t *testing.T, failing *atomic.Bool) (*httptest.Server, <-chan clickHouseQuery) {
+	t.Helper()
+
+	queries := make(chan clickHouseQuery, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing != nil && failing.Load() {
+			http.Error(w, "Code: 241. DB::Exception: Memory limit exceeded", http.StatusInternalServerError)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		q := clickHouseQuery{
+			query: r.URL.Query().Get("query"),
+			user:  r.Header.Get("X-ClickHouse-User"),
+			key:   r.Header.Get("X-ClickHouse-Key"),
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			var row usageEvent
+			if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+				t.Errorf("Invalid row %q: %v", scanner.Text(), err)
+			}
+			q.rows = append(q.rows, row)
+		}
+		queries <- q
+	}))
+	t.Cleanup(server.Close)
+	return server, queries
+}
+
+// nextQuery returns the next query received, failing the test if none
+// arrives
+func nextQuery(t *testing.T, queries <-chan clickHouseQuery) clickHouseQuery {
+	t.Helper()
+
+	select {
+	case q := <-queries:
+		return q
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a query")
+		return clickHouseQuery{}
+	}
+}
+
+// TestClickHouseWriter tests table creation, batched inserts and the last
+// insert on release
+func TestClickHouseWriter(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	server, queries := fakeClickHouse(t, nil)
+	uc.ClickHouse = &ClickHouseConfig{
+		URL:         server.URL,
+		Database:    "analytics",
+		Username:    "caddy",
+		Password:    "secret",
+		Headers:     []string{"X-Api-Key", "Authorization"},
+		BatchSize:   2,
+		CreateTable: true,
+	}
+	w, err := acquireClickHouseWriter(uc.ClickHouse, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	uc.clickhouse = w
+
+	collect := func(path string) {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set("X-Api-Key", "customer-1")
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(200)
+		_, _ = rec.Write([]byte("ok"))
+		uc.collectMetrics(rec, req, now(), nil)
+	}
+
+	// A full batch is inserted without waiting for the interval, after
+	// creating the table
+	collect("/a")
+	collect("/b")
+
+	create := nextQuery(t, queries)
+	if !strings.HasPrefix(create.query, "CREATE TABLE IF NOT EXISTS `analytics`.`caddy_usage_events` (") {
+		t.Errorf("Expected the table to be created, got %q", create.query)
+	}
+	if create.user != "caddy" || create.key != "secret" {
+		t.Errorf("Expected credentials to be sent, got %q and %q", create.user, create.key)
+	}
+
+	insert := nextQuery(t, queries)
+	if want := "INSERT INTO `analytics`.`caddy_usage_events` FORMAT JSONEachRow"; insert.query != want {
+		t.Errorf("Expected query %q, got %q", want, insert.query)
+	}
+	expected := usageEvent{
+		Time:     now().UTC(),
+		ClientIP: "192.0.2.10",
+		Method:   "GET",
+		Host:     "example.com",
+		Path:     "/a",
+		Status:   200,
+		Bytes:    2,
+		Headers:  map[string]string{"X-Api-Key": "customer-1", "Authorization": "present"},
+	}
+	if len(insert.rows) != 2 || !reflect.DeepEqual(insert.rows[0], expected) || insert.rows[1].Path != "/b" {
+		t.Errorf("Expected rows for /a and /b, got %+v", insert.rows)
+	}
+
+	// Rows left over are inserted by the last handler releasing the writer,
+	// without creating the table again
+	collect("/c")
+	if err := releaseClickHouseWriter(w); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	last := nextQuery(t, queries)
+	if !strings.HasPrefix(last.query, "INSERT INTO") || len(last.rows) != 1 || last.rows[0].Path != "/c" {
+		t.Errorf("Expected the row for /c to be inserted, got %q with %+v", last.query, last.rows)
+	}
+}
+
+// TestClickHouseWriterFailures tests that rows are kept while inserts fail,
+// up to max_pending
+func TestClickHouseWriterFailures(t *testing.T) {
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	var failing atomic.Bool
+	failing.Store(true)
+	server, queries := fakeClickHouse(t, &failing)
+
+	w, err := acquireClickHouseWriter(&ClickHouseConfig{URL: server.URL, BatchSize: 10, MaxPending: 3}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer func() { _ = releaseClickHouseWriter(w) }()
+
+	for _, path := range []string{"/a", "/b", "/c", "/d"} {
+		w.add(&usageEvent{Path: path})
+	}
+	err = w.flush()
+	if err == nil || !strings.Contains(err.Error(), "Memory limit exceeded") {
+		t.Fatalf("Expected the server's error, got %v", err)
+	}
+
+	// The oldest row was dropped, and the others are retried
+	w.mu.Lock()
+	pending, dropped := len(w.pending), w.dropped
+	w.mu.Unlock()
+	if pending != 3 || dropped != 1 {
+		t.Errorf("Expected 3 pending rows and 1 dropped, got %d and %d", pending, dropped)
+	}
+
+	failing.Store(false)
+	if err := w.flush(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	q := nextQuery(t, queries)
+	var paths []string
+	for _, row := range q.rows {
+		paths = append(paths, row.Path)
+	}
+	if want := []string{"/b", "/c", "/d"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("Expected rows %v, got %v", want, paths)
+	}
+}
+
+// TestClickHouseValidate tests validation of clickhouse options
+func TestClickHouseValidate(t *testing.T) {
+	valid := []ClickHouseConfig{{}, {URL: "https://clickhouse.example.com:8443", Database: "analytics", Table: "usage_v2"}}
+	for _, cc := range valid {
+		if err := cc.validate(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", cc, err)
+		}
+	}
+
+	invalid := []ClickHouseConfig{
+		{URL: "clickhouse:9000"},
+		{URL: "tcp://clickhouse:9000"},
+		{Table: "usage; DROP TABLE users"},
+		{Database: "1st"},
+		{BatchSize: -1},
+		{MaxPending: -1},
+		{FlushInterval: -1},
+	}
+	for _, cc := range invalid {
+		if err := cc.validate(); err == nil {
+			t.Errorf("%+v: expected an error but got none", cc)
+		}
+	}
+}
+
+// TestUnmarshalClickHouse tests parsing of the clickhouse option
+func TestUnmarshalClickHouse(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *ClickHouseConfig
+		expectErr bool
+	}{
+		{input: "usage {\n clickhouse\n}", expected: &ClickHouseConfig{}},
+		{
+			input: "usage {\n clickhouse http://clickhouse:8123 {\n database analytics\n table usage\n username caddy\n password secret\n headers X-Api-Key X-Tenant\n batch_size 500\n flush_interval 10s\n max_pending 5000\n create_table\n }\n}",
+			expected: &ClickHouseConfig{
+				URL:           "http://clickhouse:8123",
+				Database:      "analytics",
+				Table:         "usage",
+				Username:      "caddy",
+				Password:      "secret",
+				Headers:       []string{"X-Api-Key", "X-Tenant"},
+				BatchSize:     500,
+				FlushInterval: caddy.Duration(10 * time.Second),
+				MaxPending:    5000,
+				CreateTable:   true,
+			},
+		},
+		{input: "usage {\n clickhouse a b\n}", expectErr: true},
+		{input: "usage {\n clickhouse {\n headers\n }\n}", expectErr: true},
+		{input: "usage {\n clickhouse {\n create_table yes\n }\n}", expectErr: true},
+		{input: "usage {\n clickhouse {\n batch_size 0\n }\n}", expectErr: true},
+		{input: "usage {\n clickhouse {\n flush_interval often\n }\n}", expectErr: true},
+		{input: "usage {\n clickhouse {\n table\n }\n}", expectErr: true},
+		{input: "usage {\n clickhouse {\n compression lz4\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.ClickHouse, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.ClickHouse)
+			}
+		})
+	}
+}
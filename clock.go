@@ -0,0 +1,75 @@
+package caddyusage
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock is the time source of the module. Every time measurement, from
+// request durations to sliding windows, cache expiry and periodic tasks,
+// goes through it, so that tests can control time deterministically.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTicker returns a ticker delivering ticks every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers periodic ticks, like time.Ticker
+type Ticker interface {
+	// C returns the channel ticks are delivered on.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// systemClock is the Clock of the real time
+type systemClock struct{}
+
+// Now implements Clock
+func (systemClock) Now() time.Time { return time.Now() }
+
+// NewTicker implements Clock
+func (systemClock) NewTicker(d time.Duration) Ticker { return systemTicker{time.NewTicker(d)} }
+
+// systemTicker adapts a time.Ticker to Ticker
+type systemTicker struct{ *time.Ticker }
+
+// C implements Ticker
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// clockHolder boxes a Clock, since atomic pointers need a concrete type
+type clockHolder struct{ Clock }
+
+// currentClock is the module's time source
+var currentClock atomic.Pointer[clockHolder]
+
+func init() {
+	currentClock.Store(&clockHolder{systemClock{}})
+}
+
+// SetClock replaces the module's time source, returning a function that
+// restores the previous one. It is intended for tests; time sources must
+// not be swapped while requests are in flight, or their durations will mix
+// both clocks.
+func SetClock(c Clock) (restore func()) {
+	previous := currentClock.Swap(&clockHolder{c})
+	return func() { currentClock.Store(previous) }
+}
+
+// now returns the current time of the module's time source
+func now() time.Time {
+	return currentClock.Load().Now()
+}
+
+// since returns the time elapsed since t on the module's time source
+func since(t time.Time) time.Duration {
+	return now().Sub(t)
+}
+
+// newTicker returns a ticker of the module's time source
+func newTicker(d time.Duration) Ticker {
+	return currentClock.Load().NewTicker(d)
+}
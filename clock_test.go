@@ -0,0 +1,146 @@
+package caddyusage
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeClock is a Clock that only moves when advanced
+type fakeClock struct {
+	mu      sync.Mutex
+	t       time.Time
+	tickers []*fakeTicker
+}
+
+// fakeTicker is a Ticker of a fakeClock
+type fakeTicker struct {
+	clock   *fakeClock
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ticker := &fakeTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.t.Add(d)}
+	c.tickers = append(c.tickers, ticker)
+	return ticker
+}
+
+// Advance moves the clock forward, firing the tickers that are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+	for _, ticker := range c.tickers {
+		for !ticker.stopped && !ticker.next.After(c.t) {
+			select {
+			case ticker.c <- ticker.next:
+			default:
+				// Like time.Ticker, drop ticks for slow receivers
+			}
+			ticker.next = ticker.next.Add(ticker.period)
+		}
+	}
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
+
+// TestClockDurations tests that request durations are measured on the
+// module's time source
+func TestClockDurations(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	start := now()
+	clock.Advance(1500 * time.Millisecond)
+
+	rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+	rec.WriteHeader(200)
+	uc.collectMetrics(rec, httptest.NewRequest("GET", "http://example.com/", nil), start, nil)
+
+	var metric dto.Metric
+	observer := globalUsageMetrics.requestDuration.WithLabelValues("GET", "200", "example.com")
+	if err := observer.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	if got := metric.GetHistogram().GetSampleSum(); got != 1.5 {
+		t.Errorf("Expected a duration of exactly 1.5s, got %v", got)
+	}
+}
+
+// TestClockWindows tests that the active window slides with the module's
+// time source
+func TestClockWindows(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+	rec.WriteHeader(200)
+	uc.collectMetrics(rec, httptest.NewRequest("GET", "http://example.com/", nil), now(), nil)
+
+	if got := globalUsageMetrics.activeHosts.estimate(now()); got != 1 {
+		t.Errorf("Expected 1 active host, got %v", got)
+	}
+	clock.Advance(2 * defaultActiveWindow)
+	if got := globalUsageMetrics.activeHosts.estimate(now()); got != 0 {
+		t.Errorf("Expected no active hosts once the window has passed, got %v", got)
+	}
+}
+
+// TestClockSchedulers tests that periodic tasks run on the module's time source
+func TestClockSchedulers(t *testing.T) {
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	path := filepath.Join(t.TempDir(), "bots.json")
+	v := newTestBotVerifier(t, path)
+	v.record(botCheck{bot: matchKnownBot("Googlebot"), ip: "66.249.66.1"}, true, now())
+	v.start()
+	defer func() { _ = v.stop() }()
+
+	clock.Advance(botSaveInterval)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the cache to be saved once the save interval passed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,168 @@
+package caddyusage
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+// Orders of the tables of usage top
+const (
+	topSortCount = "count"
+	topSortValue = "value"
+)
+
+// topSections are the tables printed by usage top, in order, with their
+// headings
+var topSections = []struct {
+	dimension string
+	heading   string
+}{
+	{topPaths, "PATH"},
+	{topClients, "CLIENT IP"},
+	{topUserAgents, "USER AGENT"},
+	{topErrors, "5XX HOTSPOT"},
+}
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "usage",
+		Usage: "top [--address <interface>] [--config <path> [--adapter <name>]] [--namespace <name>] [--sort count|value] [--limit <n>] [--watch <interval>]",
+		Short: "Inspects the usage recorded by a running instance",
+		Long: `
+Inspects the usage recorded by the usage handlers of a running Caddy
+instance, through its admin API.
+
+The top subcommand prints the most frequent paths, client IPs and User-Agents
+tracked by handlers with top_k, and the paths with the most 5xx responses.
+--sort orders each table by count, the default, or by value; --limit caps
+the rows per table; --watch reprints the tables at an interval until
+interrupted. --namespace selects a namespace's metrics.
+
+The admin API is found like by the reload and stop commands: at --address,
+or the admin address of the config given with --config, or the default.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			top := &cobra.Command{
+				Use:   "top",
+				Short: "Prints the top paths, client IPs, User-Agents and error hotspots",
+				RunE:  caddycmd.WrapCommandFuncForCobra(cmdUsageTop),
+			}
+			top.Flags().String("address", "", "The address of the admin API")
+			top.Flags().StringP("config", "c", "", "Configuration file with the admin address")
+			top.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+			top.Flags().String("namespace", "", "Namespace of the metrics to inspect")
+			top.Flags().StringP("sort", "s", topSortCount, "Order of each table: count or value")
+			top.Flags().IntP("limit", "n", defaultTopK, "Maximum number of rows per table")
+			top.Flags().DurationP("watch", "w", 0, "Reprint the tables at this interval")
+			cmd.AddCommand(top)
+		},
+	})
+}
+
+// cmdUsageTop prints the top values of a running instance
+func cmdUsageTop(fl caddycmd.Flags) (int, error) {
+	sortBy := fl.String("sort")
+	if sortBy != topSortCount && sortBy != topSortValue {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--sort must be count or value, got '%s'", sortBy)
+	}
+	limit := fl.Int("limit")
+	if limit <= 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--limit must be positive, got %d", limit)
+	}
+	watch := fl.Duration("watch")
+	if watch < 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--watch must not be negative, got %s", watch)
+	}
+
+	adminAddr, err := caddycmd.DetermineAdminAPIAddress(fl.String("address"), nil, fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("couldn't determine admin API address: %v", err)
+	}
+
+	query := url.Values{"n": {strconv.Itoa(limit)}}
+	if ns := fl.String("namespace"); ns != "" {
+		query.Set("namespace", ns)
+	}
+	uri := "/usage/top?" + query.Encode()
+
+	for {
+		top, err := fetchUsageTop(adminAddr, uri)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		if watch > 0 {
+			// Clear the terminal, like watch(1)
+			fmt.Print("\033[H\033[2J")
+			fmt.Printf("Every %s: usage top at %s\n\n", watch, now().Format(time.TimeOnly))
+		}
+		if err := writeUsageTop(os.Stdout, top, sortBy, limit); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		if watch == 0 {
+			return caddy.ExitCodeSuccess, nil
+		}
+		time.Sleep(watch)
+	}
+}
+
+// fetchUsageTop requests the top values from the admin API
+func fetchUsageTop(adminAddr, uri string) (map[string][]topKEntry, error) {
+	resp, err := caddycmd.AdminAPIRequest(adminAddr, http.MethodGet, uri, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("querying usage: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var top map[string][]topKEntry
+	if err := json.NewDecoder(resp.Body).Decode(&top); err != nil {
+		return nil, fmt.Errorf("decoding usage: %v", err)
+	}
+	return top, nil
+}
+
+// writeUsageTop prints a table per dimension, sorted by count or value and
+// limited to limit rows. Counts estimated by top_k are marked with "~"
+// when they may be overestimated.
+func writeUsageTop(w io.Writer, top map[string][]topKEntry, sortBy string, limit int) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i, section := range topSections {
+		entries := slices.Clone(top[section.dimension])
+		if sortBy == topSortValue {
+			slices.SortFunc(entries, func(a, b topKEntry) int { return strings.Compare(a.Value, b.Value) })
+		} else {
+			slices.SortFunc(entries, func(a, b topKEntry) int {
+				return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Value, b.Value))
+			})
+		}
+		entries = entries[:min(limit, len(entries))]
+
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "REQUESTS\t%s\n", section.heading)
+		if len(entries) == 0 {
+			fmt.Fprintln(tw, "-\t(none)")
+		}
+		for _, entry := range entries {
+			count := strconv.FormatUint(entry.Count, 10)
+			if entry.Error > 0 {
+				count = "~" + count
+			}
+			fmt.Fprintf(tw, "%s\t%s\n", count, entry.Value)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,57 @@
+package caddyusage
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestWriteUsageTop tests printing, sorting and limiting the top tables
+func TestWriteUsageTop(t *testing.T) {
+	top := map[string][]topKEntry{
+		topPaths:   {{Value: "/b", Count: 5}, {Value: "/a", Count: 9, Error: 2}, {Value: "/c", Count: 1}},
+		topClients: {{Value: "10.0.0.1", Count: 15}},
+		topErrors:  {{Value: "example.com/api", Count: 3}},
+	}
+
+	tests := []struct {
+		sortBy   string
+		limit    int
+		expected string
+	}{
+		{
+			sortBy: topSortCount,
+			limit:  2,
+			expected: `REQUESTS  PATH
+~9        /a
+5         /b
+
+REQUESTS  CLIENT IP
+15        10.0.0.1
+
+REQUESTS  USER AGENT
+-         (none)
+
+REQUESTS  5XX HOTSPOT
+3         example.com/api
+`,
+		},
+		{
+			sortBy: topSortValue,
+			limit:  10,
+			expected: `REQUESTS  PATH
+~9        /a
+5         /b
+1         /c
+`,
+		},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		if err := writeUsageTop(&out, top, tt.sortBy, tt.limit); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got := out.String(); !strings.HasPrefix(got, tt.expected) {
+			t.Errorf("Sorted by %s: expected output starting with\n%s\ngot\n%s", tt.sortBy, tt.expected, got)
+		}
+	}
+}
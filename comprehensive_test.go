@@ -10,6 +10,7 @@ import (
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"go.uber.org/zap"
 )
 
@@ -87,6 +88,34 @@ func TestHeaderMetricsProcessing(t *testing.T) {
 	}
 }
 
+// TestConfiguredHeaderMetrics tests that configured headers replace the
+// defaults and that credential headers stay presence-only
+func TestConfiguredHeaderMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.TrackedHeaders = []string{"x-api-version", "Proxy-Authorization"}
+	if err := uc.Provision(uc.ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/test", nil)
+	req.Header.Set("X-Api-Version", "2024-06-01")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("User-Agent", "Client/1.0")
+	uc.collectHeaderMetrics(globalUsageMetrics, req, "GET", "200")
+
+	if got := testutil.ToFloat64(globalUsageMetrics.requestsByHeaders.WithLabelValues("X-Api-Version", "2024-06-01", "GET", "200")); got != 1 {
+		t.Errorf("Expected 1 X-Api-Version request, got %v", got)
+	}
+	if got := testutil.ToFloat64(globalUsageMetrics.requestsByHeaders.WithLabelValues("Proxy-Authorization", "present", "GET", "200")); got != 1 {
+		t.Errorf("Expected Proxy-Authorization to be recorded as present, got %v", got)
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.requestsByHeaders); n != 2 {
+		t.Errorf("Expected only the configured headers to be recorded, got %d series", n)
+	}
+}
+
 // TestClientIPExtractionComprehensive tests extensive client IP scenarios
 func TestClientIPExtractionComprehensive(t *testing.T) {
 	testCases := []struct {
@@ -99,7 +128,41 @@ func TestClientIPExtractionComprehensive(t *testing.T) {
 			name:       "IPv6 remote address",
 			headers:    map[string]string{},
 			remoteAddr: "[2001:db8::1]:8080",
-			expected:   "[2001:db8::1]",
+			expected:   "2001:db8::1",
+		},
+		{
+			name:       "IPv6 remote address with zone",
+			headers:    map[string]string{},
+			remoteAddr: "[fe80::1%eth0]:443",
+			expected:   "fe80::1",
+		},
+		{
+			name:       "IPv6 remote address without port",
+			headers:    map[string]string{},
+			remoteAddr: "2001:DB8:0:0::1",
+			expected:   "2001:db8::1",
+		},
+		{
+			name:       "IPv4-mapped IPv6 remote address",
+			headers:    map[string]string{},
+			remoteAddr: "[::ffff:192.0.2.1]:8080",
+			expected:   "192.0.2.1",
+		},
+		{
+			name: "IPv6 in X-Forwarded-For",
+			headers: map[string]string{
+				"X-Forwarded-For": "[2001:db8::2]:51234, 198.51.100.1",
+			},
+			remoteAddr: "192.168.1.100:12345",
+			expected:   "2001:db8::2",
+		},
+		{
+			name: "IPv6 X-Real-IP",
+			headers: map[string]string{
+				"X-Real-IP": "2001:db8::3",
+			},
+			remoteAddr: "192.168.1.100:12345",
+			expected:   "2001:db8::3",
 		},
 		{
 			name: "malformed X-Forwarded-For",
@@ -215,7 +278,7 @@ func collectTestRequests(_ *testing.T, uc *UsageCollector) {
 		rec.WriteHeader(req.statusCode)
 
 		startTime := time.Now()
-		uc.collectMetrics(rec, httpReq, startTime)
+		uc.collectMetrics(rec, httpReq, startTime, nil)
 	}
 }
 
@@ -297,7 +360,7 @@ func TestConcurrentMetricsCollection(t *testing.T) {
 				rec.WriteHeader(200)
 
 				startTime := time.Now()
-				uc.collectMetrics(rec, req, startTime)
+				uc.collectMetrics(rec, req, startTime, nil)
 			}
 		}(i)
 	}
@@ -356,7 +419,7 @@ func TestMetricsWithDifferentURLPatterns(t *testing.T) {
 		rec.WriteHeader(200)
 
 		startTime := time.Now()
-		uc.collectMetrics(rec, req, startTime)
+		uc.collectMetrics(rec, req, startTime, nil)
 	}
 
 	// Verify metrics were collected
@@ -439,7 +502,7 @@ func TestMetricsWithSpecialCharacters(t *testing.T) {
 			startTime := time.Now()
 
 			// This should not panic even with special characters
-			uc.collectMetrics(rec, req, startTime)
+			uc.collectMetrics(rec, req, startTime, nil)
 		})
 	}
 
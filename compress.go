@@ -0,0 +1,108 @@
+package caddyusage
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings the usage metrics endpoint can compress with, in order
+// of preference when a client accepts several equally
+var metricsEncodings = []string{"zstd", "gzip"}
+
+// Encoders are pooled, since a zstd encoder in particular is expensive to
+// create compared to compressing a typical exposition
+var (
+	gzipWriters = sync.Pool{
+		New: func() any {
+			w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+			return w
+		},
+	}
+	zstdWriters = sync.Pool{
+		New: func() any {
+			w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+			return w
+		},
+	}
+)
+
+// negotiateEncoding returns the content encoding to compress a response
+// with according to the Accept-Encoding header, or "" for none
+func negotiateEncoding(r *http.Request) string {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		accepted[coding] = q
+	}
+
+	var best string
+	var bestQ float64
+	for _, encoding := range metricsEncodings {
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressedResponseWriter compresses everything written to the response
+type compressedResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+// Write compresses p into the response
+func (cw compressedResponseWriter) Write(p []byte) (int, error) {
+	return cw.w.Write(p)
+}
+
+// compressResponse wraps w to compress the response with encoding, if any.
+// The returned function must be called once the response is written, to
+// flush the compressed stream.
+func compressResponse(w http.ResponseWriter, encoding string) (http.ResponseWriter, func() error) {
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	switch encoding {
+	case "gzip":
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(w)
+		w.Header().Set("Content-Encoding", encoding)
+		return compressedResponseWriter{w, gz}, func() error {
+			defer gzipWriters.Put(gz)
+			return gz.Close()
+		}
+	case "zstd":
+		zw := zstdWriters.Get().(*zstd.Encoder)
+		zw.Reset(w)
+		w.Header().Set("Content-Encoding", encoding)
+		return compressedResponseWriter{w, zw}, func() error {
+			defer zstdWriters.Put(zw)
+			return zw.Close()
+		}
+	default:
+		return w, func() error { return nil }
+	}
+}
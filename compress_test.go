@@ -0,0 +1,95 @@
+package caddyusage
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// TestNegotiateEncoding tests content encoding selection
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "gzip"},
+		{"zstd", "zstd"},
+		{"gzip, zstd", "zstd"},
+		{"zstd;q=0.5, gzip", "gzip"},
+		{"zstd;q=0, gzip;q=0", ""},
+		{"*", "zstd"},
+		{"*;q=0.1, gzip;q=0.8", "gzip"},
+		{"GZIP", "gzip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/usage/metrics", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			if got := negotiateEncoding(req); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestHandleMetricsCompression tests that the metrics endpoint compresses
+// its response with the negotiated encoding
+func TestHandleMetricsCompression(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	collectTestRequests(t, uc)
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+
+	// Run twice so pooled encoders are reused
+	for range 2 {
+		for encoding, decode := range decoders {
+			t.Run(encoding, func(t *testing.T) {
+				req := httptest.NewRequest("GET", "/usage/metrics", nil)
+				req.Header.Set("Accept-Encoding", encoding)
+				w, err := serveAdmin(t, "/usage/metrics", req)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if got := w.Header().Get("Content-Encoding"); got != encoding {
+					t.Errorf("Expected Content-Encoding %s, got %q", encoding, got)
+				}
+				if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+					t.Errorf("Expected Vary: Accept-Encoding, got %q", got)
+				}
+
+				r, err := decode(w.Body)
+				if err != nil {
+					t.Fatalf("Failed to decode response: %v", err)
+				}
+				body, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatalf("Failed to decode response: %v", err)
+				}
+				if !strings.Contains(string(body), "caddy_usage_requests_total") {
+					t.Errorf("Expected decoded body to contain the metrics, got:\n%s", body)
+				}
+			})
+		}
+	}
+
+	// Without Accept-Encoding the response is not compressed
+	w, err := serveAdmin(t, "/usage/metrics", httptest.NewRequest("GET", "/usage/metrics", nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Expected no Content-Encoding, got %q", got)
+	}
+}
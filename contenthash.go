@@ -0,0 +1,321 @@
+package caddyusage
+
+import (
+	"cmp"
+	"container/list"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/cespare/xxhash/v2"
+	"github.com/dustin/go-humanize"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Content hashing defaults and bounds
+const (
+	defaultContentHashSampleRate = 0.01
+	defaultContentHashMaxBody    = 1 << 20
+
+	// maxTrackedContents bounds the number of distinct bodies remembered
+	// across hosts; the least recently seen are forgotten first
+	maxTrackedContents = 10000
+
+	// maxContentURLs bounds the URLs remembered per body
+	maxContentURLs = 100
+)
+
+// ContentHashConfig enables hashing a sample of response bodies, to find
+// URLs of a host serving identical content, such as alias endpoints and
+// URLs differing only by query parameters. These waste cache space and
+// crawl budget, and are reported by the duplicate_content_groups and
+// duplicate_content_urls gauges and the admin API.
+type ContentHashConfig struct {
+	// SampleRate is the fraction of responses hashed, between 0 and 1.
+	// Defaults to 0.01.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// MaxBody is the size of the largest body hashed. Larger bodies are
+	// skipped. Defaults to 1MiB.
+	MaxBody int64 `json:"max_body,omitempty"`
+}
+
+// validate checks the sample rate and body limit
+func (cc *ContentHashConfig) validate() error {
+	if cc.SampleRate < 0 || cc.SampleRate > 1 {
+		return fmt.Errorf("content_hash sample_rate must be between 0 and 1, got %g", cc.SampleRate)
+	}
+	if cc.MaxBody < 0 {
+		return fmt.Errorf("content_hash max_body must not be negative, got %d", cc.MaxBody)
+	}
+	return nil
+}
+
+// sample starts hashing the response body of a sampled GET request,
+// returning nil when the request is not sampled
+func (cc *ContentHashConfig) sample(w http.ResponseWriter, r *http.Request) *contentHasher {
+	if r.Method != http.MethodGet {
+		return nil
+	}
+	rate := cc.SampleRate
+	if rate == 0 {
+		rate = defaultContentHashSampleRate
+	}
+	if rate < 1 && rand.Float64() >= rate {
+		return nil
+	}
+
+	maxBody := cc.MaxBody
+	if maxBody == 0 {
+		maxBody = defaultContentHashMaxBody
+	}
+	return &contentHasher{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		digest:                xxhash.New(),
+		maxBody:               maxBody,
+	}
+}
+
+// contentHasher passes a response through to the client while hashing its
+// body, giving up once it grows past the limit
+type contentHasher struct {
+	*caddyhttp.ResponseWriterWrapper
+
+	digest  *xxhash.Digest
+	size    int64
+	maxBody int64
+}
+
+// Write implements http.ResponseWriter
+func (h *contentHasher) Write(p []byte) (int, error) {
+	n, err := h.ResponseWriterWrapper.Write(p)
+	h.size += int64(n)
+	if h.size <= h.maxBody {
+		_, _ = h.digest.Write(p[:n])
+	}
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom, routing data through Write so that
+// it is hashed rather than copied straight to the underlying writer
+func (h *contentHasher) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{h}, r)
+}
+
+// sum returns the hash of the body, and whether the whole non-empty body
+// was hashed
+func (h *contentHasher) sum() (uint64, bool) {
+	if h.size == 0 || h.size > h.maxBody {
+		return 0, false
+	}
+	return h.digest.Sum64(), true
+}
+
+// collectContentHash records the URL of a sampled successful response
+// under the hash of its body
+func (uc *UsageCollector) collectContentHash(um *usageMetrics, r *http.Request, h *contentHasher, status int) {
+	if status != http.StatusOK {
+		return
+	}
+	sum, ok := h.sum()
+	if !ok {
+		return
+	}
+	um.contents.add(uc.hostLabel(um, r.Host), r.URL.RequestURI(), sum)
+}
+
+// contentKey identifies a body served by a host
+type contentKey struct {
+	host string
+	sum  uint64
+}
+
+// trackedContent is a body and the URLs it was served from
+type trackedContent struct {
+	key  contentKey
+	urls map[string]struct{}
+}
+
+// contentIndex remembers the URLs each sampled body was served from, for
+// the most recently seen bodies
+type contentIndex struct {
+	mu       sync.Mutex
+	contents map[contentKey]*list.Element
+	recent   *list.List
+}
+
+// newContentIndex creates an empty index
+func newContentIndex() *contentIndex {
+	return &contentIndex{
+		contents: make(map[contentKey]*list.Element),
+		recent:   list.New(),
+	}
+}
+
+// reset forgets all bodies
+func (ci *contentIndex) reset() {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	ci.contents = make(map[contentKey]*list.Element)
+	ci.recent.Init()
+}
+
+// add records that host served the body with hash sum from url
+func (ci *contentIndex) add(host, url string, sum uint64) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	key := contentKey{host: host, sum: sum}
+	if elem, ok := ci.contents[key]; ok {
+		ci.recent.MoveToFront(elem)
+		content := elem.Value.(*trackedContent)
+		if len(content.urls) < maxContentURLs {
+			content.urls[url] = struct{}{}
+		}
+		return
+	}
+
+	if ci.recent.Len() >= maxTrackedContents {
+		oldest := ci.recent.Back()
+		ci.recent.Remove(oldest)
+		delete(ci.contents, oldest.Value.(*trackedContent).key)
+	}
+	content := &trackedContent{key: key, urls: map[string]struct{}{url: {}}}
+	ci.contents[key] = ci.recent.PushFront(content)
+}
+
+// duplicateContent is a body served by several URLs of a host
+type duplicateContent struct {
+	Host string   `json:"host"`
+	Hash string   `json:"hash"`
+	URLs []string `json:"urls"`
+}
+
+// duplicates lists the bodies served by several URLs, optionally of a
+// single host, those served by the most URLs first
+func (ci *contentIndex) duplicates(host string) []duplicateContent {
+	ci.mu.Lock()
+	duplicates := []duplicateContent{}
+	for key, elem := range ci.contents {
+		urls := elem.Value.(*trackedContent).urls
+		if len(urls) < 2 || (host != "" && key.host != host) {
+			continue
+		}
+		duplicate := duplicateContent{
+			Host: key.host,
+			Hash: strconv.FormatUint(key.sum, 16),
+			URLs: make([]string, 0, len(urls)),
+		}
+		for url := range urls {
+			duplicate.URLs = append(duplicate.URLs, url)
+		}
+		slices.Sort(duplicate.URLs)
+		duplicates = append(duplicates, duplicate)
+	}
+	ci.mu.Unlock()
+
+	slices.SortFunc(duplicates, func(a, b duplicateContent) int {
+		if c := cmp.Compare(len(b.URLs), len(a.URLs)); c != 0 {
+			return c
+		}
+		return cmp.Or(cmp.Compare(a.Host, b.Host), cmp.Compare(a.Hash, b.Hash))
+	})
+	return duplicates
+}
+
+// contentCollector exports the duplicate content gauges of an index,
+// computed at scrape time
+type contentCollector struct {
+	groupsDesc *prometheus.Desc
+	urlsDesc   *prometheus.Desc
+	index      *contentIndex
+}
+
+// newContentCollector returns a collector of the duplicate_content_groups
+// and duplicate_content_urls gauges
+func newContentCollector(ns string, index *contentIndex) contentCollector {
+	return contentCollector{
+		groupsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(ns, "usage", "duplicate_content_groups"),
+			"Number of sampled response bodies served by more than one URL of the host",
+			[]string{"host"}, nil,
+		),
+		urlsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(ns, "usage", "duplicate_content_urls"),
+			"Number of URLs of the host serving a sampled response body also served by another URL",
+			[]string{"host"}, nil,
+		),
+		index: index,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c contentCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.groupsDesc
+	ch <- c.urlsDesc
+}
+
+// Collect implements prometheus.Collector
+func (c contentCollector) Collect(ch chan<- prometheus.Metric) {
+	groups := make(map[string]int)
+	urls := make(map[string]int)
+
+	c.index.mu.Lock()
+	for key, elem := range c.index.contents {
+		if n := len(elem.Value.(*trackedContent).urls); n > 1 {
+			groups[key.host]++
+			urls[key.host] += n
+		}
+	}
+	c.index.mu.Unlock()
+
+	for host, n := range groups {
+		ch <- prometheus.MustNewConstMetric(c.groupsDesc, prometheus.GaugeValue, float64(n), host)
+		ch <- prometheus.MustNewConstMetric(c.urlsDesc, prometheus.GaugeValue, float64(urls[host]), host)
+	}
+}
+
+// unmarshalContentHashConfig parses a content_hash block:
+//
+//	content_hash [{
+//	    sample_rate <fraction>
+//	    max_body <size>
+//	}]
+func unmarshalContentHashConfig(d *caddyfile.Dispenser) (*ContentHashConfig, error) {
+	cc := new(ContentHashConfig)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		value := d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "sample_rate":
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, d.Errf("invalid content_hash sample_rate '%s'", value)
+			}
+			cc.SampleRate = rate
+		case "max_body":
+			size, err := humanize.ParseBytes(value)
+			if err != nil || size == 0 {
+				return nil, d.Errf("invalid content_hash max_body '%s'", value)
+			}
+			cc.MaxBody = int64(size)
+		default:
+			return nil, d.Errf("unrecognized content_hash option '%s'", option)
+		}
+	}
+	return cc, nil
+}
@@ -0,0 +1,163 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// serveContent sends a GET request through the collector with a handler
+// writing body in two chunks
+func serveContent(t *testing.T, uc *UsageCollector, target string, status int, body string) {
+	t.Helper()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(status)
+		half := len(body) / 2
+		if _, err := w.Write([]byte(body[:half])); err != nil {
+			return err
+		}
+		_, err := w.Write([]byte(body[half:]))
+		return err
+	})
+
+	w := httptest.NewRecorder()
+	if err := uc.ServeHTTP(w, httptest.NewRequest("GET", target, nil), next); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+	if w.Body.String() != body {
+		t.Errorf("Expected the body to pass through unchanged, got %q", w.Body.String())
+	}
+}
+
+// TestContentHash tests that URLs serving identical bodies are grouped per
+// host, and reported by the gauges and the admin endpoint
+func TestContentHash(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.ContentHash = &ContentHashConfig{SampleRate: 1, MaxBody: 64}
+	home := "<html>home</html>"
+	serveContent(t, uc, "http://example.com/", 200, home)
+	serveContent(t, uc, "http://example.com/index.html", 200, home)
+	serveContent(t, uc, "http://example.com/?utm_source=ads", 200, home)
+	serveContent(t, uc, "http://example.com/about", 200, "<html>about</html>")
+	serveContent(t, uc, "http://other.example.com/", 200, home)
+
+	// Errors, empty bodies and bodies past max_body are not hashed
+	serveContent(t, uc, "http://example.com/missing", 404, home)
+	serveContent(t, uc, "http://example.com/empty", 200, "")
+	serveContent(t, uc, "http://example.com/large", 200, strings.Repeat("x", 100))
+	serveContent(t, uc, "http://example.com/large2", 200, strings.Repeat("x", 100))
+
+	usagetest.AssertValue(t, registry, "duplicate_content_groups", usagetest.Labels{"host": "example.com"}, 1)
+	usagetest.AssertValue(t, registry, "duplicate_content_urls", usagetest.Labels{"host": "example.com"}, 3)
+	usagetest.AssertAbsent(t, registry, "duplicate_content_groups", usagetest.Labels{"host": "other.example.com"})
+
+	w, err := serveAdmin(t, "/usage/duplicates", httptest.NewRequest("GET", "/usage/duplicates?host=example.com", nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var duplicates []duplicateContent
+	if err := json.Unmarshal(w.Body.Bytes(), &duplicates); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	expected := []string{"/", "/?utm_source=ads", "/index.html"}
+	if len(duplicates) != 1 || duplicates[0].Host != "example.com" || !reflect.DeepEqual(duplicates[0].URLs, expected) {
+		t.Errorf("Expected %v to serve the same body, got %+v", expected, duplicates)
+	}
+}
+
+// TestContentHashSampling tests that unsampled and non-GET requests are
+// not hashed
+func TestContentHashSampling(t *testing.T) {
+	cc := &ContentHashConfig{SampleRate: 1}
+	if cc.sample(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil)) != nil {
+		t.Error("Expected POST responses not to be hashed")
+	}
+
+	cc.SampleRate = 0.001
+	sampled := 0
+	for range 1000 {
+		if cc.sample(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)) != nil {
+			sampled++
+		}
+	}
+	if sampled > 20 {
+		t.Errorf("Expected about 1 response in 1000 to be hashed, got %d", sampled)
+	}
+}
+
+// TestContentIndexBounds tests that the least recently seen bodies are
+// forgotten first, and that URLs per body are capped
+func TestContentIndexBounds(t *testing.T) {
+	ci := newContentIndex()
+	for i := range maxTrackedContents {
+		ci.add("example.com", "/", uint64(i+1))
+	}
+
+	// Seeing body 1 again makes body 2 the least recently seen
+	ci.add("example.com", "/again", 1)
+	ci.add("example.com", "/new", maxTrackedContents+1)
+	if len(ci.contents) != maxTrackedContents {
+		t.Fatalf("Expected %d bodies to be tracked, got %d", maxTrackedContents, len(ci.contents))
+	}
+	if _, ok := ci.contents[contentKey{host: "example.com", sum: 2}]; ok {
+		t.Error("Expected the least recently seen body to be forgotten")
+	}
+	if duplicates := ci.duplicates(""); len(duplicates) != 1 || !reflect.DeepEqual(duplicates[0].URLs, []string{"/", "/again"}) {
+		t.Errorf("Expected body 1 to be kept with both URLs, got %+v", duplicates)
+	}
+
+	ci.reset()
+	for i := range maxContentURLs + 10 {
+		ci.add("example.com", fmt.Sprintf("/page?id=%d", i), 1)
+	}
+	if duplicates := ci.duplicates(""); len(duplicates) != 1 || len(duplicates[0].URLs) != maxContentURLs {
+		t.Errorf("Expected %d URLs to be kept", maxContentURLs)
+	}
+}
+
+// TestUnmarshalContentHash tests parsing of the content_hash option
+func TestUnmarshalContentHash(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *ContentHashConfig
+		expectErr bool
+	}{
+		{input: "usage {\n content_hash\n}", expected: &ContentHashConfig{}},
+		{input: "usage {\n content_hash {\n sample_rate 0.05\n max_body 256KiB\n }\n}", expected: &ContentHashConfig{SampleRate: 0.05, MaxBody: 256 << 10}},
+		{input: "usage {\n content_hash 0.05\n}", expectErr: true},
+		{input: "usage {\n content_hash {\n sample_rate 2\n }\n}", expectErr: true},
+		{input: "usage {\n content_hash {\n max_body big\n }\n}", expectErr: true},
+		{input: "usage {\n content_hash {\n sample_rate\n }\n}", expectErr: true},
+		{input: "usage {\n content_hash {\n algorithm sha256\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.ContentHash, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.ContentHash)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package caddyusage
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Content types of responses that don't declare a valid one
+const (
+	contentTypeNone    = "none"
+	contentTypeInvalid = "invalid"
+)
+
+// responseContentType returns the media type of a response's Content-Type,
+// lowercased and without parameters, such as text/html for
+// "text/html; charset=utf-8"
+func responseContentType(header http.Header) string {
+	value := header.Get("Content-Type")
+	if value == "" {
+		return contentTypeNone
+	}
+	// Invalid parameters still leave the media type
+	mediaType, _, err := mime.ParseMediaType(value)
+	if (err != nil && !errors.Is(err, mime.ErrInvalidMediaParameter)) || !strings.Contains(mediaType, "/") {
+		return contentTypeInvalid
+	}
+	return mediaType
+}
+
+// collectContentTypeMetrics records responses by content type, telling
+// pages, API responses and static assets apart
+func (uc *UsageCollector) collectContentTypeMetrics(um *usageMetrics, header http.Header, statusCode string) {
+	contentType := uc.policy.apply(um, "content_type", responseContentType(header))
+	um.responsesByType.WithLabelValues(contentType, statusCode).Inc()
+}
@@ -0,0 +1,67 @@
+package caddyusage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestResponseContentType tests reducing Content-Type headers to their
+// media type
+func TestResponseContentType(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"", contentTypeNone},
+		{"text/html; charset=utf-8", "text/html"},
+		{"Application/JSON", "application/json"},
+		{"image/png", "image/png"},
+		{"text/plain; charset", "text/plain"},
+		{"html", contentTypeInvalid},
+		{"text/html/", contentTypeInvalid},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.value != "" {
+			header.Set("Content-Type", tt.value)
+		}
+		if got := responseContentType(header); got != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.value, tt.expected, got)
+		}
+	}
+}
+
+// TestContentTypeMetrics tests counting responses by content type and
+// status code
+func TestContentTypeMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	for _, tt := range []struct {
+		contentType string
+		status      int
+	}{
+		{"text/html; charset=utf-8", 200},
+		{"text/html", 200},
+		{"application/json", 200},
+		{"application/json", 500},
+		{"", 204},
+	} {
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		if tt.contentType != "" {
+			rec.Header().Set("Content-Type", tt.contentType)
+		}
+		rec.WriteHeader(tt.status)
+		uc.collectMetrics(rec, httptest.NewRequest("GET", "http://example.com/", nil), now(), nil)
+	}
+
+	usagetest.AssertValue(t, registry, "responses_by_content_type_total", usagetest.Labels{"content_type": "text/html", "status_code": "200"}, 2)
+	usagetest.AssertValue(t, registry, "responses_by_content_type_total", usagetest.Labels{"content_type": "application/json"}, 2)
+	usagetest.AssertValue(t, registry, "responses_by_content_type_total", usagetest.Labels{"content_type": contentTypeNone, "status_code": "204"}, 1)
+	usagetest.AssertCount(t, registry, "responses_by_content_type_total", nil, 4)
+}
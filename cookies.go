@@ -0,0 +1,32 @@
+package caddyusage
+
+import (
+	"net/http"
+)
+
+// collectCookieMetrics records which of the configured cookies were sent with
+// the request and the total size of its Cookie headers. Only cookie names are
+// inspected; values never leave this function.
+func (uc *UsageCollector) collectCookieMetrics(um *usageMetrics, r *http.Request, host string) {
+	cookieHeaders := r.Header.Values("Cookie")
+
+	size := 0
+	for _, h := range cookieHeaders {
+		size += len(h)
+	}
+	um.cookieHeaderSize.WithLabelValues(host).Observe(float64(size))
+
+	if len(uc.Cookies) == 0 {
+		return
+	}
+
+	for _, name := range uc.Cookies {
+		present := "false"
+		if len(cookieHeaders) > 0 {
+			if _, err := r.Cookie(name); err == nil {
+				present = "true"
+			}
+		}
+		um.requestsByCookie.WithLabelValues(name, present, host).Inc()
+	}
+}
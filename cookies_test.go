@@ -0,0 +1,78 @@
+package caddyusage
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestCookieMetrics tests cookie presence counting and header size observation
+func TestCookieMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.CookieMetrics = true
+	uc.Cookies = []string{"session", "consent"}
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Cookie", "session=secret-value; theme=dark")
+	uc.collectCookieMetrics(globalUsageMetrics, req, "example.com")
+
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	uc.collectCookieMetrics(globalUsageMetrics, req, "example.com")
+
+	tests := []struct {
+		name     string
+		present  string
+		expected float64
+	}{
+		{"session", "true", 1},
+		{"session", "false", 1},
+		{"consent", "true", 0},
+		{"consent", "false", 2},
+	}
+
+	for _, tt := range tests {
+		got := testutil.ToFloat64(globalUsageMetrics.requestsByCookie.WithLabelValues(tt.name, tt.present, "example.com"))
+		if got != tt.expected {
+			t.Errorf("Expected %s present=%s to be %v, got %v", tt.name, tt.present, tt.expected, got)
+		}
+	}
+
+	// Cookie values must never become label values
+	if n := testutil.CollectAndCount(globalUsageMetrics.requestsByCookie); n != 4 {
+		t.Errorf("Expected 4 cookie series, got %d", n)
+	}
+
+	if n := testutil.CollectAndCount(globalUsageMetrics.cookieHeaderSize); n != 1 {
+		t.Errorf("Expected 1 cookie size histogram, got %d", n)
+	}
+}
+
+// TestCookieMetricsDisabled tests that no cookie metrics are recorded unless enabled
+func TestCookieMetricsDisabled(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.Cookies = []string{"session"}
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Cookie", "session=abc")
+	rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+	rec.WriteHeader(200)
+	uc.collectMetrics(rec, req, time.Now(), nil)
+
+	metricFamilies, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	for _, mf := range metricFamilies {
+		switch mf.GetName() {
+		case "caddy_usage_requests_by_cookie_total", "caddy_usage_cookie_header_bytes":
+			t.Errorf("%s should not be recorded when cookie metrics are disabled", mf.GetName())
+		}
+	}
+}
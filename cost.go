@@ -0,0 +1,76 @@
+package caddyusage
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// defaultCostTenant attributes upstream-reported cost to the request host
+// when no cost_tenant is configured
+const defaultCostTenant = "{http.request.host}"
+
+// collectCostMetrics accumulates usage units reported by upstream applications
+// through response headers or trailers, attributed to the request's tenant
+func (uc *UsageCollector) collectCostMetrics(um *usageMetrics, r *http.Request, header http.Header) {
+	if len(uc.CostHeaders) == 0 {
+		return
+	}
+
+	var tenant string
+	for _, name := range uc.CostHeaders {
+		raw := costHeaderValue(header, name)
+		if raw == "" {
+			continue
+		}
+
+		units, err := strconv.ParseFloat(raw, 64)
+		if err != nil || units < 0 || math.IsInf(units, 0) || math.IsNaN(units) {
+			uc.logger.Debug("ignoring invalid usage units from upstream",
+				zap.String("header", name),
+				zap.String("value", raw))
+			continue
+		}
+
+		// Only resolve the tenant once a header is actually present
+		if tenant == "" {
+			tenant = uc.policy.apply(um, "tenant", uc.costTenant(r))
+		}
+
+		um.costUnits.WithLabelValues(tenant, name).Add(units)
+	}
+}
+
+// costTenant evaluates the configured tenant expression for the request
+func (uc *UsageCollector) costTenant(r *http.Request) string {
+	expr := uc.CostTenant
+	if expr == "" {
+		expr = defaultCostTenant
+	}
+
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
+
+	// The host placeholder needs an HTTP replacer; fall back for bare requests
+	tenant := repl.ReplaceAll(expr, "")
+	if tenant == "" && expr == defaultCostTenant {
+		tenant = r.Host
+	}
+	return tenant
+}
+
+// costHeaderValue returns the value of a response header, falling back to a
+// trailer of the same name. Trailers that weren't announced before the body
+// are stored with http.TrailerPrefix.
+func costHeaderValue(header http.Header, name string) string {
+	if v := header.Get(name); v != "" {
+		return strings.TrimSpace(v)
+	}
+	return strings.TrimSpace(header.Get(http.TrailerPrefix + name))
+}
@@ -0,0 +1,105 @@
+package caddyusage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestCostMetrics tests accumulation of upstream-reported usage units
+func TestCostMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.CostHeaders = []string{"X-Usage-Units", "X-Db-Reads"}
+
+	req := httptest.NewRequest("GET", "http://example.com/api", nil)
+
+	header := http.Header{}
+	header.Set("X-Usage-Units", "42")
+	header.Set(http.TrailerPrefix+"X-Db-Reads", "3.5")
+	uc.collectCostMetrics(globalUsageMetrics, req, header)
+
+	header = http.Header{}
+	header.Set("X-Usage-Units", " 8 ")
+	uc.collectCostMetrics(globalUsageMetrics, req, header)
+
+	if got := testutil.ToFloat64(globalUsageMetrics.costUnits.WithLabelValues("example.com", "X-Usage-Units")); got != 50 {
+		t.Errorf("Expected 50 usage units, got %v", got)
+	}
+	if got := testutil.ToFloat64(globalUsageMetrics.costUnits.WithLabelValues("example.com", "X-Db-Reads")); got != 3.5 {
+		t.Errorf("Expected 3.5 units from the trailer, got %v", got)
+	}
+}
+
+// TestCostMetricsInvalidValues tests that malformed or negative values are ignored
+func TestCostMetricsInvalidValues(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.CostHeaders = []string{"X-Usage-Units"}
+	req := httptest.NewRequest("GET", "http://example.com/api", nil)
+
+	for _, value := range []string{"lots", "-5", "NaN", "+Inf"} {
+		header := http.Header{}
+		header.Set("X-Usage-Units", value)
+		uc.collectCostMetrics(globalUsageMetrics, req, header)
+	}
+
+	if n := testutil.CollectAndCount(globalUsageMetrics.costUnits); n != 0 {
+		t.Errorf("Expected no cost series for invalid values, got %d", n)
+	}
+}
+
+// TestCostTenantPlaceholder tests attributing cost to a placeholder-derived tenant
+func TestCostTenantPlaceholder(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.CostHeaders = []string{"X-Usage-Units"}
+	uc.CostTenant = "{tenant}"
+
+	repl := caddy.NewReplacer()
+	repl.Set("tenant", "acme")
+	req := httptest.NewRequest("GET", "http://example.com/api", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+	header := http.Header{}
+	header.Set("X-Usage-Units", "7")
+	uc.collectCostMetrics(globalUsageMetrics, req, header)
+
+	if got := testutil.ToFloat64(globalUsageMetrics.costUnits.WithLabelValues("acme", "X-Usage-Units")); got != 7 {
+		t.Errorf("Expected 7 units attributed to acme, got %v", got)
+	}
+}
+
+// TestUnmarshalCost tests parsing of the cost options
+func TestUnmarshalCost(t *testing.T) {
+	input := `usage {
+		cost_headers X-Usage-Units X-Tokens
+		cost_tenant {http.request.header.X-Tenant-ID}
+	}`
+
+	var uc UsageCollector
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(uc.CostHeaders) != 2 || uc.CostHeaders[1] != "X-Tokens" {
+		t.Errorf("Unexpected cost headers: %v", uc.CostHeaders)
+	}
+	if uc.CostTenant != "{http.request.header.X-Tenant-ID}" {
+		t.Errorf("Unexpected cost tenant: %s", uc.CostTenant)
+	}
+
+	for _, invalid := range []string{"usage {\n cost_headers\n}", "usage {\n cost_tenant\n}", "usage {\n cost_tenant a b\n}"} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
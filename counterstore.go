@@ -0,0 +1,403 @@
+package caddyusage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// Counter persistence defaults and bounds
+const (
+	defaultPersistInterval = time.Minute
+	counterStoreTimeout    = time.Second
+)
+
+// PersistCountersConfig configures saving the usage counters to a file
+// and restoring them on startup, so that totals survive restarts and
+// deploys instead of starting over from zero.
+type PersistCountersConfig struct {
+	// Path is the database file the counters are saved to. It is created
+	// if needed, and must not be shared with other processes.
+	Path string `json:"path"`
+
+	// Interval is the time between saves. The counters are also saved
+	// when the last handler using the file is unloaded. Defaults to 1m.
+	Interval caddy.Duration `json:"interval,omitempty"`
+}
+
+// validate checks the path and interval
+func (pc *PersistCountersConfig) validate() error {
+	if pc.Path == "" {
+		return fmt.Errorf("persist_counters path is required")
+	}
+	if pc.Interval < 0 {
+		return fmt.Errorf("persist_counters interval must not be negative, got %s", time.Duration(pc.Interval))
+	}
+	return nil
+}
+
+// counterKey identifies a counter series in the store
+type counterKey struct {
+	Metric string            `json:"metric"`
+	Labels map[string]string `json:"labels"`
+}
+
+// counterStore periodically saves the counters of every set of usage
+// metrics to a bbolt database, in a bucket per namespace. Handlers saving
+// to the same file share a store, so config reloads keep it open.
+type counterStore struct {
+	path   string
+	db     *bolt.DB
+	logger *zap.Logger
+
+	mu        sync.Mutex
+	interval  time.Duration
+	saveFails bool
+
+	// Sets of metrics already restored, by namespace
+	restored map[string]*usageMetrics
+
+	intervals chan time.Duration
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// counterStoreEntry is a shared store and the number of handlers using it
+type counterStoreEntry struct {
+	store *counterStore
+	refs  int
+}
+
+var (
+	// Open stores by absolute path
+	counterStores   = make(map[string]*counterStoreEntry)
+	counterStoresMu sync.Mutex
+)
+
+// acquireCounterStore returns the open store of the configured file,
+// opening it if needed, and restores the saved counters into the loaded
+// metrics. Each successful call must be balanced by a call to
+// releaseCounterStore.
+func acquireCounterStore(pc *PersistCountersConfig, logger *zap.Logger) (*counterStore, error) {
+	path, err := filepath.Abs(pc.Path)
+	if err != nil {
+		return nil, err
+	}
+	interval := defaultPersistInterval
+	if pc.Interval > 0 {
+		interval = time.Duration(pc.Interval)
+	}
+
+	counterStoresMu.Lock()
+	defer counterStoresMu.Unlock()
+
+	store := (*counterStore)(nil)
+	if entry, ok := counterStores[path]; ok {
+		entry.refs++
+		store = entry.store
+		store.setInterval(interval)
+	} else {
+		// A timeout turns a file locked by another process into an error
+		// rather than a hang
+		db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: counterStoreTimeout})
+		if err != nil {
+			return nil, err
+		}
+		store = &counterStore{
+			path:      path,
+			db:        db,
+			logger:    logger,
+			restored:  make(map[string]*usageMetrics),
+			intervals: make(chan time.Duration, 1),
+			done:      make(chan struct{}),
+		}
+		store.setInterval(interval)
+		store.run()
+		counterStores[path] = &counterStoreEntry{store: store, refs: 1}
+	}
+
+	// Metrics loaded since the store was opened, such as a new namespace's,
+	// are restored as well
+	if err := store.restore(); err != nil {
+		logger.Warn("failed to restore usage counters", zap.String("path", path), zap.Error(err))
+	}
+	return store, nil
+}
+
+// releaseCounterStore releases a handler's use of a store, saving the
+// counters and closing it once no handler uses it anymore
+func releaseCounterStore(store *counterStore) error {
+	counterStoresMu.Lock()
+	defer counterStoresMu.Unlock()
+
+	entry, ok := counterStores[store.path]
+	if !ok || entry.store != store {
+		return nil
+	}
+	if entry.refs--; entry.refs > 0 {
+		return nil
+	}
+	delete(counterStores, store.path)
+	return store.stop()
+}
+
+// setInterval changes the time between saves
+func (s *counterStore) setInterval(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if interval == s.interval {
+		return
+	}
+	s.interval = interval
+	// The previous interval may not have been picked up yet
+	select {
+	case <-s.intervals:
+	default:
+	}
+	s.intervals <- interval
+}
+
+// run saves the counters every interval until stopped. The first interval
+// is the one queued when the store was opened.
+func (s *counterStore) run() {
+	ticker := newTicker(<-s.intervals)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() { ticker.Stop() }()
+
+		for {
+			select {
+			case <-ticker.C():
+				s.saveLogged()
+			case interval := <-s.intervals:
+				ticker.Stop()
+				ticker = newTicker(interval)
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops saving periodically, saves a last time and closes the file
+func (s *counterStore) stop() error {
+	close(s.done)
+	s.wg.Wait()
+
+	err := s.save()
+	if closeErr := s.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// saveLogged saves the counters, logging when saves start or stop failing
+func (s *counterStore) saveLogged() {
+	err := s.save()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case err != nil && !s.saveFails:
+		s.logger.Warn("failed to save usage counters", zap.String("path", s.path), zap.Error(err))
+	case err == nil && s.saveFails:
+		s.logger.Info("saving usage counters again", zap.String("path", s.path))
+	}
+	s.saveFails = err != nil
+}
+
+// save replaces the saved counters of each loaded set of metrics with
+// their current values. Namespaces that aren't loaded keep theirs.
+func (s *counterStore) save() error {
+	sets := usageMetricSets()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for ns, um := range sets {
+			if err := tx.DeleteBucket([]byte(ns)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+			bucket, err := tx.CreateBucket([]byte(ns))
+			if err != nil {
+				return err
+			}
+
+			for name, vec := range um.counterVecs() {
+				for _, series := range counterSeries(vec) {
+					key, err := json.Marshal(counterKey{Metric: name, Labels: series.labels})
+					if err != nil {
+						return err
+					}
+					value := binary.BigEndian.AppendUint64(nil, math.Float64bits(series.value))
+					if err := bucket.Put(key, value); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// restore raises each saved counter of the loaded sets of metrics not
+// restored yet to its saved value. Counters already at or past their saved
+// value are left alone. Each set is restored once, so that counters reset
+// since are not raised again.
+func (s *counterStore) restore() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sets := usageMetricSets()
+	return s.db.View(func(tx *bolt.Tx) error {
+		for ns, um := range sets {
+			if s.restored[ns] == um {
+				continue
+			}
+			s.restored[ns] = um
+
+			bucket := tx.Bucket([]byte(ns))
+			if bucket == nil {
+				continue
+			}
+			vecs := um.counterVecs()
+
+			err := bucket.ForEach(func(k, v []byte) error {
+				var key counterKey
+				if err := json.Unmarshal(k, &key); err != nil || len(v) != 8 {
+					return fmt.Errorf("invalid saved counter %q", k)
+				}
+				vec, ok := vecs[key.Metric]
+				if !ok {
+					// Metrics removed since the counters were saved
+					return nil
+				}
+				counter, err := vec.GetMetricWith(key.Labels)
+				if err != nil {
+					// Labels changed since the counters were saved
+					return nil
+				}
+
+				saved := math.Float64frombits(binary.BigEndian.Uint64(v))
+				var current dto.Metric
+				if err := counter.Write(&current); err != nil {
+					return err
+				}
+				if delta := saved - current.GetCounter().GetValue(); delta > 0 {
+					counter.Add(delta)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// counterSample is the value of a counter series
+type counterSample struct {
+	labels map[string]string
+	value  float64
+}
+
+// counterSeries returns the current value of each series of a counter
+// vector
+func counterSeries(vec *prometheus.CounterVec) []counterSample {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+
+	var samples []counterSample
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil || m.Counter == nil {
+			continue
+		}
+		labels := make(map[string]string, len(m.Label))
+		for _, pair := range m.Label {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		samples = append(samples, counterSample{labels: labels, value: m.Counter.GetValue()})
+	}
+	return samples
+}
+
+// counterVecs returns the metric vectors that are counters, by metric name
+// without namespace
+func (um *usageMetrics) counterVecs() map[string]*prometheus.CounterVec {
+	counters := make(map[string]*prometheus.CounterVec)
+	for name, vec := range um.vectors() {
+		if counter, ok := vec.(*prometheus.CounterVec); ok {
+			counters[name] = counter
+		}
+	}
+	return counters
+}
+
+// usageMetricSets returns the loaded sets of usage metrics by namespace,
+// the shared set under the default namespace
+func usageMetricSets() map[string]*usageMetrics {
+	sets := make(map[string]*usageMetrics)
+	if globalUsageMetrics != nil {
+		sets[defaultMetricsNamespace] = globalUsageMetrics
+	}
+
+	namespacedMetrics.Range(func(key, value any) bool {
+		sets[key.(string)] = value.(*namespaceMetrics).metrics
+		return true
+	})
+	return sets
+}
+
+// unmarshalPersistCountersConfig parses a persist_counters block:
+//
+//	persist_counters <path> [{
+//	    interval <duration>
+//	}]
+func unmarshalPersistCountersConfig(d *caddyfile.Dispenser) (*PersistCountersConfig, error) {
+	pc := new(PersistCountersConfig)
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	pc.Path = d.Val()
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch option := d.Val(); option {
+		case "interval":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid persist_counters interval '%s': %v", d.Val(), err)
+			}
+			pc.Interval = caddy.Duration(dur)
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unrecognized persist_counters option '%s'", option)
+		}
+	}
+	return pc, nil
+}
@@ -0,0 +1,187 @@
+package caddyusage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/chalabi2/caddy-usage/usagetest"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// TestCounterStore tests that counters saved by one process are restored
+// into the fresh metrics of the next, and that restoring again while
+// running changes nothing
+func TestCounterStore(t *testing.T) {
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	pc := &PersistCountersConfig{Path: filepath.Join(t.TempDir(), "counters.db"), Interval: caddy.Duration(time.Minute)}
+
+	uc, registry, cleanup := setupTestMetrics(t)
+	store, err := acquireCounterStore(pc, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	collectTestRequests(t, uc)
+	before := usagetest.Value(t, registry, "requests_total", nil)
+	if err := releaseCounterStore(store); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cleanup()
+
+	// A restarted process starts from the saved totals
+	uc, registry, cleanup = setupTestMetrics(t)
+	defer cleanup()
+	store, err = acquireCounterStore(pc, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer func() { _ = releaseCounterStore(store) }()
+
+	usagetest.AssertValue(t, registry, "requests_total", nil, before)
+	usagetest.AssertValue(t, registry, "requests_total", usagetest.Labels{"status_code": "404"}, 1)
+	usagetest.AssertValue(t, registry, "requests_by_ip_total", usagetest.Labels{"client_ip": "192.168.1.1"}, 2)
+
+	// Counters reset since they were restored are not raised again
+	collectTestRequests(t, uc)
+	if _, err := resetMetrics("requests_by_ip"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := store.restore(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	usagetest.AssertValue(t, registry, "requests_total", nil, 2*before)
+	usagetest.AssertAbsent(t, registry, "requests_by_ip_total", nil)
+
+	// Periodic saves pick up the new requests
+	clock.Advance(time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for savedTotal(t, store, "requests_total") != 2*before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %v requests to be saved", 2*before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// savedTotal returns the sum of the saved series of a counter of the
+// shared metrics
+func savedTotal(t *testing.T, store *counterStore, metric string) float64 {
+	t.Helper()
+
+	var total float64
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(defaultMetricsNamespace))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var key counterKey
+			if err := json.Unmarshal(k, &key); err != nil {
+				return err
+			}
+			if key.Metric == metric {
+				total += math.Float64frombits(binary.BigEndian.Uint64(v))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("Failed to read saved counters: %v", err)
+	}
+	return total
+}
+
+// TestCounterStoreShared tests that handlers saving to the same file share
+// a store, which is closed with the last of them
+func TestCounterStoreShared(t *testing.T) {
+	_, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	pc := &PersistCountersConfig{Path: filepath.Join(t.TempDir(), "counters.db")}
+	first, err := acquireCounterStore(pc, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	second, err := acquireCounterStore(pc, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first != second {
+		t.Fatal("Expected handlers saving to the same file to share a store")
+	}
+
+	if err := releaseCounterStore(first); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := second.save(); err != nil {
+		t.Errorf("Expected the store to stay open for the remaining handler: %v", err)
+	}
+	if err := releaseCounterStore(second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := counterStores[first.path]; ok {
+		t.Error("Expected the store to be closed with its last handler")
+	}
+}
+
+// TestPersistCountersValidate tests validation of persist_counters options
+func TestPersistCountersValidate(t *testing.T) {
+	tests := map[string]struct {
+		config    PersistCountersConfig
+		expectErr bool
+	}{
+		"valid":             {config: PersistCountersConfig{Path: "counters.db", Interval: caddy.Duration(time.Minute)}},
+		"missing path":      {config: PersistCountersConfig{}, expectErr: true},
+		"negative interval": {config: PersistCountersConfig{Path: "counters.db", Interval: -1}, expectErr: true},
+	}
+	for name, tt := range tests {
+		if err := tt.config.validate(); (err != nil) != tt.expectErr {
+			t.Errorf("%s: expected error %v, got %v", name, tt.expectErr, err)
+		}
+	}
+}
+
+// TestUnmarshalPersistCounters tests parsing of the persist_counters option
+func TestUnmarshalPersistCounters(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *PersistCountersConfig
+		expectErr bool
+	}{
+		{input: "usage {\n persist_counters /var/lib/caddy/usage.db\n}", expected: &PersistCountersConfig{Path: "/var/lib/caddy/usage.db"}},
+		{input: "usage {\n persist_counters usage.db {\n interval 30s\n }\n}", expected: &PersistCountersConfig{Path: "usage.db", Interval: caddy.Duration(30 * time.Second)}},
+		{input: "usage {\n persist_counters\n}", expectErr: true},
+		{input: "usage {\n persist_counters a.db b.db\n}", expectErr: true},
+		{input: "usage {\n persist_counters usage.db {\n interval often\n }\n}", expectErr: true},
+		{input: "usage {\n persist_counters usage.db {\n interval\n }\n}", expectErr: true},
+		{input: "usage {\n persist_counters usage.db {\n format json\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.PersistCounters, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.PersistCounters)
+			}
+		})
+	}
+}
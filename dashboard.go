@@ -0,0 +1,397 @@
+package caddyusage
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Dashboard defaults
+const (
+	defaultDashboardPath = "/_usage/dashboard"
+	dashboardTopPaths    = 10
+)
+
+// dashboardQuantiles are the latency percentiles shown by the dashboard
+var dashboardQuantiles = []float64{0.5, 0.9, 0.99}
+
+// DashboardConfig serves a self-contained HTML page rendering the top paths,
+// status codes, latency percentiles and request rate of the handler's
+// metrics, from memory, without Prometheus or Grafana.
+type DashboardConfig struct {
+	// Path is where the page is served; its data is served at <path>/data.
+	// Defaults to /_usage/dashboard.
+	Path string `json:"path,omitempty"`
+
+	// Username and Password protect the page with HTTP basic
+	// authentication. Password is a bcrypt hash, as output by caddy
+	// hash-password. Required unless Public is set.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Public serves the page without credentials, for when an
+	// authentication handler runs before the usage handler or the
+	// numbers aren't sensitive.
+	Public bool `json:"public,omitempty"`
+}
+
+// path returns the configured path or its default
+func (dc *DashboardConfig) path() string {
+	if dc.Path == "" {
+		return defaultDashboardPath
+	}
+	return strings.TrimSuffix(dc.Path, "/")
+}
+
+// validate checks the path and credentials
+func (dc *DashboardConfig) validate() error {
+	if dc.Path != "" && !strings.HasPrefix(dc.Path, "/") {
+		return fmt.Errorf("dashboard path must start with '/', got '%s'", dc.Path)
+	}
+	if (dc.Username == "") != (dc.Password == "") {
+		return fmt.Errorf("dashboard basic_auth requires both a username and a password hash")
+	}
+	if dc.Username == "" && !dc.Public {
+		return fmt.Errorf("dashboard requires basic_auth, or public to serve it without credentials")
+	}
+	if dc.Username != "" && dc.Public {
+		return fmt.Errorf("dashboard basic_auth and public are mutually exclusive")
+	}
+	if dc.Password != "" && !strings.HasPrefix(dc.Password, "$2") {
+		return fmt.Errorf("dashboard basic_auth password must be a bcrypt hash, as output by caddy hash-password")
+	}
+	return nil
+}
+
+// authorized reports whether a request carries the configured credentials,
+// refusing every request when there are none unless the page is public.
+// The password hash is compared even when the username doesn't match, so
+// that timing doesn't tell usernames apart.
+func (dc *DashboardConfig) authorized(r *http.Request) bool {
+	if dc.Public {
+		return true
+	}
+	if dc.Username == "" {
+		return false
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	sameUser := subtle.ConstantTimeCompare([]byte(username), []byte(dc.Username)) == 1
+	samePassword, err := caddyauth.BcryptHash{}.Compare([]byte(dc.Password), []byte(password))
+	return sameUser && samePassword && err == nil
+}
+
+// dashboardCount is the number of requests of a value
+type dashboardCount struct {
+	Value    string  `json:"value"`
+	Requests float64 `json:"requests"`
+}
+
+// dashboardPercentile is a latency percentile
+type dashboardPercentile struct {
+	Quantile float64 `json:"quantile"`
+	Seconds  float64 `json:"seconds"`
+}
+
+// dashboardData is what the dashboard renders. The page computes the
+// request rate from the change of Requests between polls.
+type dashboardData struct {
+	Time     time.Time             `json:"time"`
+	Requests float64               `json:"requests"`
+	Statuses []dashboardCount      `json:"statuses"`
+	TopPaths []dashboardCount      `json:"top_paths"`
+	Latency  []dashboardPercentile `json:"latency"`
+}
+
+// newDashboardData summarizes the requests of a host, or of all hosts,
+// recorded in a set of metrics
+func newDashboardData(um *usageMetrics, host string, now time.Time) dashboardData {
+	data := dashboardData{
+		Time:     now.UTC(),
+		Statuses: []dashboardCount{},
+		TopPaths: []dashboardCount{},
+		Latency:  []dashboardPercentile{},
+	}
+
+	statuses := make(map[string]float64)
+	paths := make(map[string]float64)
+	for _, series := range counterSeries(um.requestsTotal) {
+		if host != "" && series.labels["host"] != host {
+			continue
+		}
+		data.Requests += series.value
+		statuses[series.labels["status_code"]] += series.value
+		paths[series.labels["path"]] += series.value
+	}
+	data.Statuses = sortedCounts(statuses, func(a, b dashboardCount) int { return cmp.Compare(a.Value, b.Value) })
+	data.TopPaths = sortedCounts(paths, func(a, b dashboardCount) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), cmp.Compare(a.Value, b.Value))
+	})
+	if len(data.TopPaths) > dashboardTopPaths {
+		data.TopPaths = data.TopPaths[:dashboardTopPaths]
+	}
+
+	bounds, cumulative, count := mergedHistogram(um.requestDuration, host)
+	if count > 0 {
+		for _, q := range dashboardQuantiles {
+			data.Latency = append(data.Latency, dashboardPercentile{Quantile: q, Seconds: histogramQuantile(q, bounds, cumulative, count)})
+		}
+	}
+	return data
+}
+
+// sortedCounts lists counts by value in the given order
+func sortedCounts(counts map[string]float64, order func(a, b dashboardCount) int) []dashboardCount {
+	out := make([]dashboardCount, 0, len(counts))
+	for value, requests := range counts {
+		out = append(out, dashboardCount{Value: value, Requests: requests})
+	}
+	slices.SortFunc(out, order)
+	return out
+}
+
+// mergedHistogram sums the series of a histogram vector with a host label,
+// selecting a host when given, into the upper bounds of its buckets, their
+// cumulative counts and the total count
+func mergedHistogram(vec *prometheus.HistogramVec, host string) ([]float64, []uint64, uint64) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+
+	var bounds []float64
+	var cumulative []uint64
+	var count uint64
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil || m.Histogram == nil {
+			continue
+		}
+		if host != "" && !slices.ContainsFunc(m.Label, func(pair *dto.LabelPair) bool {
+			return pair.GetName() == "host" && pair.GetValue() == host
+		}) {
+			continue
+		}
+		buckets := m.Histogram.GetBucket()
+		if bounds == nil {
+			bounds = make([]float64, len(buckets))
+			cumulative = make([]uint64, len(buckets))
+			for i, bucket := range buckets {
+				bounds[i] = bucket.GetUpperBound()
+			}
+		}
+		for i, bucket := range buckets {
+			if i < len(cumulative) {
+				cumulative[i] += bucket.GetCumulativeCount()
+			}
+		}
+		count += m.Histogram.GetSampleCount()
+	}
+	return bounds, cumulative, count
+}
+
+// histogramQuantile estimates a quantile from cumulative bucket counts by
+// linear interpolation within the bucket it falls in, like PromQL's
+// histogram_quantile. Quantiles past the last bucket are its upper bound.
+func histogramQuantile(q float64, bounds []float64, cumulative []uint64, count uint64) float64 {
+	rank := q * float64(count)
+	lower, below := 0.0, uint64(0)
+	for i, bound := range bounds {
+		if float64(cumulative[i]) >= rank {
+			inBucket := cumulative[i] - below
+			if inBucket == 0 {
+				return bound
+			}
+			return lower + (bound-lower)*(rank-float64(below))/float64(inBucket)
+		}
+		lower, below = bound, cumulative[i]
+	}
+	if len(bounds) == 0 {
+		return math.NaN()
+	}
+	return bounds[len(bounds)-1]
+}
+
+// serveDashboard serves the dashboard page and its data, reporting whether
+// the request was one of them
+func (uc *UsageCollector) serveDashboard(w http.ResponseWriter, r *http.Request) (bool, error) {
+	base := uc.Dashboard.path()
+	dataPath := base + "/data"
+	if r.URL.Path != base && r.URL.Path != base+"/" && r.URL.Path != dataPath {
+		return false, nil
+	}
+
+	if !uc.Dashboard.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="usage dashboard"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return true, nil
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return true, nil
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Path == dataPath {
+		um := uc.usageMetrics()
+		if um == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true, nil
+		}
+		return true, writeJSON(w, newDashboardData(um, r.URL.Query().Get("host"), now()))
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	_, err := w.Write([]byte(dashboardHTML))
+	return true, err
+}
+
+// unmarshalDashboardConfig parses a dashboard directive, whose block sets
+// basic_auth or public:
+//
+//	dashboard [<path>] {
+//	    basic_auth <username> <hashed_password>
+//	    public
+//	}
+func unmarshalDashboardConfig(d *caddyfile.Dispenser) (*DashboardConfig, error) {
+	dc := new(DashboardConfig)
+	if d.NextArg() {
+		dc.Path = d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch option := d.Val(); option {
+		case "basic_auth":
+			if !d.Args(&dc.Username, &dc.Password) {
+				return nil, d.ArgErr()
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "public":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dc.Public = true
+		default:
+			return nil, d.Errf("unrecognized dashboard option '%s'", option)
+		}
+	}
+	return dc, nil
+}
+
+// dashboardHTML is the dashboard page. It polls <path>/data every two
+// seconds, keeping the host query parameter, and charts the request rate
+// over the last five minutes.
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Usage</title>
+<style>
+body { font: 14px system-ui, sans-serif; margin: 2em; color: #222; background: #fafafa; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin: 0 0 .5em; }
+.grid { display: grid; grid-template-columns: repeat(auto-fit, minmax(320px, 1fr)); gap: 1.5em; }
+.card { background: #fff; border: 1px solid #ddd; border-radius: 6px; padding: 1em; }
+table { width: 100%; border-collapse: collapse; }
+td { padding: .2em .4em; border-bottom: 1px solid #eee; word-break: break-all; }
+td.n { text-align: right; font-variant-numeric: tabular-nums; white-space: nowrap; }
+canvas { width: 100%; height: 160px; }
+#rate { font-size: 1.6em; }
+#error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Usage</h1>
+<p id="error"></p>
+<div class="grid">
+<div class="card"><h2>Request rate</h2><div id="rate">-</div><canvas id="chart" width="600" height="160"></canvas></div>
+<div class="card"><h2>Latency</h2><table id="latency"></table></div>
+<div class="card"><h2>Status codes</h2><table id="statuses"></table></div>
+<div class="card"><h2>Top paths</h2><table id="paths"></table></div>
+</div>
+<script>
+"use strict";
+const url = location.pathname.replace(/\/$/, "") + "/data" + location.search;
+const points = [];
+let last = null;
+
+function fill(id, rows) {
+  const table = document.getElementById(id);
+  table.replaceChildren();
+  for (const [label, value] of rows) {
+    const tr = table.insertRow();
+    tr.insertCell().textContent = label;
+    const td = tr.insertCell();
+    td.className = "n";
+    td.textContent = value;
+  }
+}
+
+function draw() {
+  const canvas = document.getElementById("chart");
+  const ctx = canvas.getContext("2d");
+  ctx.clearRect(0, 0, canvas.width, canvas.height);
+  if (points.length < 2) return;
+  const max = Math.max(...points.map(p => p.rate), 1);
+  const start = points[0].time, span = Math.max(points[points.length - 1].time - start, 1);
+  ctx.strokeStyle = "#2a6fdb";
+  ctx.lineWidth = 2;
+  ctx.beginPath();
+  points.forEach((p, i) => {
+    const x = (p.time - start) / span * canvas.width;
+    const y = canvas.height - p.rate / max * (canvas.height - 10);
+    i ? ctx.lineTo(x, y) : ctx.moveTo(x, y);
+  });
+  ctx.stroke();
+}
+
+async function poll() {
+  try {
+    const resp = await fetch(url, {credentials: "same-origin"});
+    if (!resp.ok) throw new Error(resp.status + " " + resp.statusText);
+    const data = await resp.json();
+    const time = Date.parse(data.time) / 1000;
+    if (last && time > last.time && data.requests >= last.requests) {
+      const rate = (data.requests - last.requests) / (time - last.time);
+      points.push({time, rate});
+      while (points.length && points[0].time < time - 300) points.shift();
+      document.getElementById("rate").textContent = rate.toFixed(1) + " req/s";
+      draw();
+    }
+    last = {time, requests: data.requests};
+    fill("latency", data.latency.map(p => ["p" + Math.round(p.quantile * 100), (p.seconds * 1000).toFixed(1) + " ms"]));
+    fill("statuses", data.statuses.map(s => [s.value, s.requests.toLocaleString()]));
+    fill("paths", data.top_paths.map(p => [p.value, p.requests.toLocaleString()]));
+    document.getElementById("error").textContent = "";
+  } catch (err) {
+    document.getElementById("error").textContent = "Failed to load usage: " + err.message;
+  }
+}
+
+poll();
+setInterval(poll, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,178 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// dashboardHash is the bcrypt hash of "hiccup"
+const dashboardHash = "$2a$14$Zkx19XLiW6VYouLHR5NmfOFU0z2GTNmpkT/5qqR7hx4IjWJPDhjvG"
+
+// TestDashboard tests serving the dashboard page and its data behind basic
+// authentication, without passing the requests on
+func TestDashboard(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.Dashboard = &DashboardConfig{Path: "/stats/", Username: "admin", Password: dashboardHash}
+
+	requests := []struct {
+		path     string
+		status   int
+		duration time.Duration
+	}{
+		{"/api/users", 200, 10 * time.Millisecond},
+		{"/api/users", 200, 20 * time.Millisecond},
+		{"/api/orders", 500, 400 * time.Millisecond},
+	}
+	for _, tt := range requests {
+		req := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(tt.status)
+		uc.collectMetrics(rec, req, now().Add(-tt.duration), nil)
+	}
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		t.Errorf("Unexpected request to the next handler: %s", r.URL.Path)
+		return nil
+	})
+	serve := func(target, username, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		if err := uc.ServeHTTP(w, req, next); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return w
+	}
+
+	if w := serve("/stats", "admin", "wrong"); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected 401 with a challenge, got %d", w.Code)
+	}
+
+	w := serve("/stats", "admin", "hiccup")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<title>Usage</title>") {
+		t.Errorf("Expected the dashboard page, got %d", w.Code)
+	}
+
+	w = serve("/stats/data?host=example.com", "admin", "hiccup")
+	var data dashboardData
+	if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+		t.Fatalf("Failed to decode data: %v", err)
+	}
+	if data.Requests != 3 {
+		t.Errorf("Expected 3 requests, got %g", data.Requests)
+	}
+	expectedStatuses := []dashboardCount{{Value: "200", Requests: 2}, {Value: "500", Requests: 1}}
+	if !reflect.DeepEqual(data.Statuses, expectedStatuses) {
+		t.Errorf("Expected statuses %+v, got %+v", expectedStatuses, data.Statuses)
+	}
+	expectedPaths := []dashboardCount{{Value: "/api/users", Requests: 2}, {Value: "/api/orders", Requests: 1}}
+	if !reflect.DeepEqual(data.TopPaths, expectedPaths) {
+		t.Errorf("Expected top paths %+v, got %+v", expectedPaths, data.TopPaths)
+	}
+	if len(data.Latency) != len(dashboardQuantiles) || data.Latency[2].Seconds <= data.Latency[0].Seconds {
+		t.Errorf("Expected increasing latency percentiles, got %+v", data.Latency)
+	}
+}
+
+// TestDashboardAccess tests that the dashboard refuses requests unless it
+// has credentials to check them against or is explicitly public
+func TestDashboardAccess(t *testing.T) {
+	req := httptest.NewRequest("GET", "/_usage/dashboard", nil)
+	if (&DashboardConfig{}).authorized(req) {
+		t.Error("Expected a dashboard without credentials to refuse access")
+	}
+	if !(&DashboardConfig{Public: true}).authorized(req) {
+		t.Error("Expected a public dashboard to be served without credentials")
+	}
+	if (&DashboardConfig{Username: "admin", Password: dashboardHash}).authorized(req) {
+		t.Error("Expected a request without credentials to be refused")
+	}
+}
+
+// TestHistogramQuantile tests interpolating quantiles within buckets
+func TestHistogramQuantile(t *testing.T) {
+	bounds := []float64{0.1, 0.5, 1}
+	cumulative := []uint64{50, 90, 100}
+
+	tests := []struct {
+		q        float64
+		count    uint64
+		expected float64
+	}{
+		{0.5, 100, 0.1},
+		{0.25, 100, 0.05},
+		{0.7, 100, 0.3},
+		{0.99, 100, 0.95},
+		{0.99, 200, 1},
+	}
+	for _, tt := range tests {
+		if got := histogramQuantile(tt.q, bounds, cumulative, tt.count); math.Abs(got-tt.expected) > 1e-9 {
+			t.Errorf("Quantile %g of %d: expected %g, got %g", tt.q, tt.count, tt.expected, got)
+		}
+	}
+	if got := histogramQuantile(0.5, nil, nil, 1); !math.IsNaN(got) {
+		t.Errorf("Expected NaN without buckets, got %g", got)
+	}
+}
+
+// TestUnmarshalDashboard tests parsing and validation of the dashboard
+// option
+func TestUnmarshalDashboard(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *DashboardConfig
+		expectErr bool
+	}{
+		{input: "usage {\n dashboard\n}", expected: &DashboardConfig{}},
+		{input: "usage {\n dashboard {\n public\n }\n}", expected: &DashboardConfig{Public: true}},
+		{
+			input:    "usage {\n dashboard /stats {\n basic_auth admin " + dashboardHash + "\n }\n}",
+			expected: &DashboardConfig{Path: "/stats", Username: "admin", Password: dashboardHash},
+		},
+		{input: "usage {\n dashboard /a /b\n}", expectErr: true},
+		{input: "usage {\n dashboard {\n basic_auth admin\n }\n}", expectErr: true},
+		{input: "usage {\n dashboard {\n refresh 5s\n }\n}", expectErr: true},
+		{input: "usage {\n dashboard {\n public yes\n }\n}", expectErr: true},
+	}
+	for _, tt := range tests {
+		var uc UsageCollector
+		err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected an error but got none", tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(uc.Dashboard, tt.expected) {
+			t.Errorf("Expected %+v, got %+v", tt.expected, uc.Dashboard)
+		}
+	}
+
+	for name, dc := range map[string]DashboardConfig{
+		"relative path":      {Path: "stats", Public: true},
+		"no password":        {Username: "admin"},
+		"plain password":     {Username: "admin", Password: "hiccup"},
+		"no credentials":     {},
+		"public credentials": {Username: "admin", Password: dashboardHash, Public: true},
+	} {
+		if err := dc.validate(); err == nil {
+			t.Errorf("%s: expected an error but got none", name)
+		}
+	}
+}
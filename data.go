@@ -0,0 +1,311 @@
+package caddyusage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Files of a data bundle, each optional
+const (
+	publicSuffixFile = "public_suffix_list.dat"
+	botsFile         = "bots.json"
+)
+
+// dataSourceBuiltin is the source of the data compiled into the module
+const dataSourceBuiltin = "builtin"
+
+// suffixList finds the public suffix of a domain, like
+// publicsuffix.List
+type suffixList interface {
+	PublicSuffix(domain string) string
+	String() string
+}
+
+// dataSet describes where a dataset was loaded from
+type dataSet struct {
+	Name     string     `json:"name"`
+	Source   string     `json:"source"`
+	Version  string     `json:"version,omitempty"`
+	Modified *time.Time `json:"modified,omitempty"`
+	Entries  int        `json:"entries,omitempty"`
+}
+
+// dataBundle holds the reference data the module relies on: the public
+// suffix list, for registrable domains, and the known bots
+type dataBundle struct {
+	dir      string
+	suffixes suffixList
+	bots     []knownBot
+	sets     []dataSet
+}
+
+// currentData is the bundle in use. Like other settings shared by all
+// handlers, the most recently provisioned handler's data_bundle applies.
+var currentData atomic.Pointer[dataBundle]
+
+func init() {
+	currentData.Store(builtinData())
+}
+
+// loadedData returns the bundle in use
+func loadedData() *dataBundle {
+	return currentData.Load()
+}
+
+// builtinData returns the data compiled into the module
+func builtinData() *dataBundle {
+	return &dataBundle{
+		suffixes: publicsuffix.List,
+		bots:     builtinBots,
+		sets: []dataSet{
+			{Name: "public_suffixes", Source: dataSourceBuiltin, Version: publicsuffix.List.String()},
+			{Name: "bots", Source: dataSourceBuiltin, Entries: len(builtinBots)},
+		},
+	}
+}
+
+// loadDataBundle loads the data files found in dir, falling back to the
+// builtin data for missing ones. An empty dir selects the builtin data.
+func loadDataBundle(dir string) (*dataBundle, error) {
+	bundle := builtinData()
+	if dir == "" {
+		return bundle, nil
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("data bundle: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("data bundle: %s is not a directory", dir)
+	}
+	bundle.dir = dir
+
+	path := filepath.Join(dir, publicSuffixFile)
+	if data, modified, err := readDataFile(path); err != nil {
+		return nil, err
+	} else if data != nil {
+		list, err := parsePublicSuffixList(data)
+		if err != nil {
+			return nil, fmt.Errorf("data bundle: %s: %v", path, err)
+		}
+		bundle.suffixes = list
+		bundle.sets[0] = dataSet{Name: "public_suffixes", Source: path, Version: list.version, Modified: modified, Entries: list.len()}
+	}
+
+	path = filepath.Join(dir, botsFile)
+	if data, modified, err := readDataFile(path); err != nil {
+		return nil, err
+	} else if data != nil {
+		bots, version, err := parseBots(data)
+		if err != nil {
+			return nil, fmt.Errorf("data bundle: %s: %v", path, err)
+		}
+		bundle.bots = bots
+		bundle.sets[1] = dataSet{Name: "bots", Source: path, Version: version, Modified: modified, Entries: len(bots)}
+	}
+
+	return bundle, nil
+}
+
+// readDataFile reads a bundle file and its modification time. A missing
+// file is not an error, and returns no data.
+func readDataFile(path string) ([]byte, *time.Time, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("data bundle: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("data bundle: %v", err)
+	}
+	modified := info.ModTime()
+	return data, &modified, nil
+}
+
+// botsData is a bots.json file
+type botsData struct {
+	Version string `json:"version"`
+	Bots    []struct {
+		Name    string   `json:"name"`
+		Token   string   `json:"token"`
+		Domains []string `json:"domains"`
+	} `json:"bots"`
+}
+
+// parseBots parses a bots.json file, returning the bots and their version
+func parseBots(data []byte) ([]knownBot, string, error) {
+	var file botsData
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, "", err
+	}
+
+	bots := make([]knownBot, 0, len(file.Bots))
+	for i, bot := range file.Bots {
+		if bot.Name == "" || bot.Token == "" || len(bot.Domains) == 0 {
+			return nil, "", fmt.Errorf("bot %d: name, token and domains are required", i)
+		}
+		domains := make([]string, len(bot.Domains))
+		for j, domain := range bot.Domains {
+			domains[j] = normalizeHostname(domain)
+		}
+		bots = append(bots, knownBot{name: bot.Name, token: strings.ToLower(bot.Token), domains: domains})
+	}
+	return bots, file.Version, nil
+}
+
+// publicSuffixList is a public suffix list loaded from a file in the
+// format of publicsuffix.org's public_suffix_list.dat
+type publicSuffixList struct {
+	version    string
+	rules      map[string]struct{}
+	wildcards  map[string]struct{}
+	exceptions map[string]struct{}
+}
+
+// parsePublicSuffixList parses a list of rules, one per line: a suffix,
+// a wildcard *.suffix, or an exception !suffix. The version is taken from
+// the list's VERSION or COMMIT comment, if any.
+func parsePublicSuffixList(data []byte) (*publicSuffixList, error) {
+	list := &publicSuffixList{
+		rules:      make(map[string]struct{}),
+		wildcards:  make(map[string]struct{}),
+		exceptions: make(map[string]struct{}),
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if comment, ok := strings.CutPrefix(line, "//"); ok {
+			comment = strings.TrimSpace(comment)
+			for _, prefix := range []string{"VERSION:", "COMMIT:"} {
+				if v, ok := strings.CutPrefix(comment, prefix); ok && list.version == "" {
+					list.version = strings.TrimSpace(v)
+				}
+			}
+			continue
+		}
+		if line == "" {
+			continue
+		}
+
+		// Rules end at the first whitespace
+		rule := strings.Fields(line)[0]
+		set := list.rules
+		if r, ok := strings.CutPrefix(rule, "!"); ok {
+			rule, set = r, list.exceptions
+		} else if r, ok := strings.CutPrefix(rule, "*."); ok {
+			rule, set = r, list.wildcards
+		}
+
+		// Hostnames are compared in their ASCII form
+		ascii, err := idna.ToASCII(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule '%s': %v", line, err)
+		}
+		set[ascii] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if list.len() == 0 {
+		return nil, errors.New("no rules")
+	}
+	return list, nil
+}
+
+// len returns the number of rules
+func (l *publicSuffixList) len() int {
+	return len(l.rules) + len(l.wildcards) + len(l.exceptions)
+}
+
+// PublicSuffix returns the public suffix of domain. Following the list's
+// algorithm, the longest matching rule applies, exceptions override
+// wildcards, and a domain matching no rule has its last label as suffix.
+func (l *publicSuffixList) PublicSuffix(domain string) string {
+	for candidate := domain; ; {
+		parent := ""
+		if i := strings.IndexByte(candidate, '.'); i >= 0 {
+			parent = candidate[i+1:]
+		}
+
+		if _, ok := l.exceptions[candidate]; ok {
+			return parent
+		}
+		if _, ok := l.rules[candidate]; ok {
+			return candidate
+		}
+		if _, ok := l.wildcards[parent]; ok && parent != "" {
+			return candidate
+		}
+
+		if parent == "" {
+			return candidate
+		}
+		candidate = parent
+	}
+}
+
+// String returns the list's version
+func (l *publicSuffixList) String() string {
+	return l.version
+}
+
+// effectiveTLDPlusOne returns the public suffix of domain with one more
+// label, like publicsuffix.EffectiveTLDPlusOne with another list
+func effectiveTLDPlusOne(list suffixList, domain string) (string, error) {
+	if strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") || strings.Contains(domain, "..") {
+		return "", fmt.Errorf("empty label in domain %q", domain)
+	}
+
+	suffix := list.PublicSuffix(domain)
+	if len(domain) <= len(suffix) {
+		return "", fmt.Errorf("cannot derive eTLD+1 for domain %q", domain)
+	}
+	i := len(domain) - len(suffix) - 1
+	if domain[i] != '.' {
+		return "", fmt.Errorf("invalid public suffix %q for domain %q", suffix, domain)
+	}
+	return domain[1+strings.LastIndex(domain[:i], "."):], nil
+}
+
+// dataStatus is the response of the data admin endpoint
+type dataStatus struct {
+	Bundle   string          `json:"bundle,omitempty"`
+	Datasets []dataSetStatus `json:"datasets"`
+}
+
+// dataSetStatus is a dataset with the age of its file
+type dataSetStatus struct {
+	dataSet
+	AgeSeconds *float64 `json:"age_seconds,omitempty"`
+}
+
+// status reports the bundle's datasets, with the age of their files at now
+func (b *dataBundle) status(now time.Time) dataStatus {
+	status := dataStatus{Bundle: b.dir, Datasets: make([]dataSetStatus, 0, len(b.sets))}
+	for _, set := range b.sets {
+		entry := dataSetStatus{dataSet: set}
+		if set.Modified != nil {
+			age := now.Sub(*set.Modified).Seconds()
+			entry.AgeSeconds = &age
+		}
+		status.Datasets = append(status.Datasets, entry)
+	}
+	return status
+}
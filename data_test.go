@@ -0,0 +1,178 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"golang.org/x/net/publicsuffix"
+)
+
+// testSuffixList is a public suffix list exercising every kind of rule
+const testSuffixList = `// ===BEGIN ICANN DOMAINS===
+// VERSION: 2026-09-30_12-00-00_UTC
+// COMMIT: 0123456789abcdef
+
+com
+co.uk
+*.ck
+!www.ck
+公司.cn
+
+// ===BEGIN PRIVATE DOMAINS===
+github.io
+`
+
+// testBots is a bots.json with a single bot
+const testBots = `{
+	"version": "2026-10-01",
+	"bots": [
+		{"name": "examplebot", "token": "ExampleBot", "domains": ["crawl.example.com."]}
+	]
+}`
+
+// useDataBundle loads the bundle in dir for the duration of the test
+func useDataBundle(t *testing.T, dir string) *dataBundle {
+	t.Helper()
+
+	bundle, err := loadDataBundle(dir)
+	if err != nil {
+		t.Fatalf("Failed to load data bundle: %v", err)
+	}
+	previous := currentData.Swap(bundle)
+	t.Cleanup(func() { currentData.Store(previous) })
+	return bundle
+}
+
+// TestPublicSuffixList tests the rules of a loaded public suffix list
+func TestPublicSuffixList(t *testing.T) {
+	list, err := parsePublicSuffixList([]byte(testSuffixList))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if list.version != "2026-09-30_12-00-00_UTC" {
+		t.Errorf("Expected the VERSION comment as version, got %q", list.version)
+	}
+
+	tests := []struct {
+		domain   string
+		expected string
+	}{
+		{domain: "www.example.com", expected: "com"},
+		{domain: "api.example.co.uk", expected: "co.uk"},
+		{domain: "shop.example.ck", expected: "example.ck"},
+		{domain: "www.ck", expected: "ck"},
+		{domain: "static.www.ck", expected: "ck"},
+		{domain: "user.github.io", expected: "github.io"},
+		{domain: "shop.xn--55qx5d.cn", expected: "xn--55qx5d.cn"},
+		{domain: "example.unknown", expected: "unknown"},
+	}
+	for _, tt := range tests {
+		if got := list.PublicSuffix(tt.domain); got != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.domain, tt.expected, got)
+		}
+	}
+
+	if _, err := parsePublicSuffixList([]byte("// nothing but comments\n")); err == nil {
+		t.Error("Expected an error for a list without rules")
+	}
+}
+
+// TestEffectiveTLDPlusOne tests that registrable domains derived from the
+// builtin list match x/net's
+func TestEffectiveTLDPlusOne(t *testing.T) {
+	for _, domain := range []string{"example.com", "a.b.example.co.uk", "foo.github.io", "com", "localhost", "a..com"} {
+		expected, expectedErr := publicsuffix.EffectiveTLDPlusOne(domain)
+		got, err := effectiveTLDPlusOne(publicsuffix.List, domain)
+		if got != expected || (err == nil) != (expectedErr == nil) {
+			t.Errorf("%s: expected %q (error %v), got %q (error %v)", domain, expected, expectedErr, got, err)
+		}
+	}
+}
+
+// TestDataBundle tests that a bundle's files replace the builtin data,
+// and that the admin endpoint reports them
+func TestDataBundle(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, publicSuffixFile), []byte(testSuffixList), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, botsFile), []byte(testBots), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	useDataBundle(t, dir)
+
+	if got := registrableDomain("static.www.ck"); got != "www.ck" {
+		t.Errorf("Expected the bundled list to apply, got %s", got)
+	}
+	if bot := matchKnownBot("Mozilla/5.0 (compatible; examplebot/1.0)"); bot == nil || bot.domains[0] != "crawl.example.com" {
+		t.Errorf("Expected the bundled bot, got %+v", bot)
+	}
+	if bot := matchKnownBot("Googlebot/2.1"); bot != nil {
+		t.Errorf("Expected the builtin bots to be replaced, got %+v", bot)
+	}
+
+	w, err := serveAdmin(t, "/usage/data", httptest.NewRequest("GET", "/usage/data", nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var status dataStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if status.Bundle != dir || len(status.Datasets) != 2 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+	for _, set := range status.Datasets {
+		if set.Source == dataSourceBuiltin || set.Version == "" || set.AgeSeconds == nil || set.Entries == 0 {
+			t.Errorf("Expected %s to be loaded from the bundle, got %+v", set.Name, set)
+		}
+	}
+}
+
+// TestLoadDataBundle tests partial and invalid bundles
+func TestLoadDataBundle(t *testing.T) {
+	// Missing files fall back to the builtin data
+	bundle, err := loadDataBundle(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, set := range bundle.status(time.Now()).Datasets {
+		if set.Source != dataSourceBuiltin || set.AgeSeconds != nil {
+			t.Errorf("Expected builtin %s, got %+v", set.Name, set)
+		}
+	}
+
+	if _, err := loadDataBundle(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, botsFile), []byte(`{"bots": [{"name": "nobot"}]}`), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := loadDataBundle(dir); err == nil {
+		t.Error("Expected an error for a bot without token and domains")
+	}
+}
+
+// TestUnmarshalDataBundle tests parsing of the data_bundle option
+func TestUnmarshalDataBundle(t *testing.T) {
+	var uc UsageCollector
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser("usage {\n data_bundle /opt/caddy/usage-data\n}")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if uc.DataBundle != "/opt/caddy/usage-data" {
+		t.Errorf("Expected the bundle directory, got %q", uc.DataBundle)
+	}
+
+	for _, input := range []string{"usage {\n data_bundle\n}", "usage {\n data_bundle a b\n}"} {
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("%q: expected an error but got none", input)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package caddyusage
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Reasons a request was shed rather than served
+const (
+	degradedRateLimited = "rate_limited"
+	degradedNoUpstreams = "no_upstreams"
+	degradedLoadShed    = "load_shed"
+)
+
+// degradedReason reports whether a request was turned away by a protective
+// limit rather than failing on its own, and which limit it was. err is the
+// error returned by the handler chain, or the error that invoked the
+// current error route.
+func degradedReason(r *http.Request, status int, err error, header http.Header) string {
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		if zone, ok := repl.GetString(rateLimitZonePlaceholder); ok && zone != "" {
+			return degradedRateLimited
+		}
+	}
+
+	// reverse_proxy fails with this error when every upstream is down or
+	// at its max_requests limit
+	var he caddyhttp.HandlerError
+	if errors.As(err, &he) && he.StatusCode == http.StatusServiceUnavailable &&
+		he.Err != nil && strings.Contains(he.Err.Error(), "no upstreams available") {
+		return degradedNoUpstreams
+	}
+
+	// A 503 with Retry-After is how servers and upstreams signal that they
+	// are deliberately shedding load
+	if status == http.StatusServiceUnavailable && header.Get("Retry-After") != "" {
+		return degradedLoadShed
+	}
+
+	return ""
+}
+
+// collectDegradedMetrics records requests shed by protective limits, so that
+// self-protective errors can be told apart from organic ones
+func (uc *UsageCollector) collectDegradedMetrics(um *usageMetrics, r *http.Request, status int, err error, header http.Header) {
+	if err == nil {
+		err, _ = r.Context().Value(caddyhttp.ErrorCtxKey).(error)
+	}
+
+	if reason := degradedReason(r, status, err, header); reason != "" {
+		um.degradedRequests.WithLabelValues(reason).Inc()
+	}
+}
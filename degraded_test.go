@@ -0,0 +1,73 @@
+package caddyusage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestDegradedReason tests classification of shed requests
+func TestDegradedReason(t *testing.T) {
+	noUpstreams := caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("no upstreams available"))
+
+	tests := []struct {
+		name     string
+		zone     string
+		status   int
+		err      error
+		header   http.Header
+		expected string
+	}{
+		{"served", "", http.StatusOK, nil, http.Header{}, ""},
+		{"rate limited", "api_zone", http.StatusTooManyRequests, nil, http.Header{}, degradedRateLimited},
+		{"no upstreams", "", 0, noUpstreams, http.Header{}, degradedNoUpstreams},
+		{"load shed", "", http.StatusServiceUnavailable, nil, http.Header{"Retry-After": {"30"}}, degradedLoadShed},
+		{"organic 503", "", http.StatusServiceUnavailable, nil, http.Header{}, ""},
+		{"organic error", "", 0, caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("backend broke")), http.Header{}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repl := caddy.NewReplacer()
+			if tt.zone != "" {
+				repl.Set(rateLimitZonePlaceholder, tt.zone)
+			}
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+			if got := degradedReason(req, tt.status, tt.err, tt.header); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestDegradedMetrics tests that shed requests are counted through the full
+// handler and from error routes
+func TestDegradedMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	noUpstreams := caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("no upstreams available"))
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return noUpstreams
+	})
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	_ = uc.ServeHTTP(httptest.NewRecorder(), req, next)
+
+	// Inside handle_errors, the original error comes from the context
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddyhttp.ErrorCtxKey, error(noUpstreams)))
+	uc.collectDegradedMetrics(globalUsageMetrics, req, http.StatusServiceUnavailable, nil, http.Header{})
+
+	if got := testutil.ToFloat64(globalUsageMetrics.degradedRequests.WithLabelValues(degradedNoUpstreams)); got != 2 {
+		t.Errorf("Expected 2 requests shed for lack of upstreams, got %v", got)
+	}
+}
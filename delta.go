@@ -0,0 +1,96 @@
+package caddyusage
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deltaHandlers counts the provisioned handlers with delta temporality
+// enabled. Usage metrics are shared between handlers, so they are reset
+// after collection as long as at least one such handler is live; counting
+// rather than flagging keeps config reloads, which provision the new
+// handlers before cleaning up the old ones, from switching it off.
+var deltaHandlers atomic.Int64
+
+// resettableCollector is a metric vector that can drop all its series
+type resettableCollector interface {
+	prometheus.Collector
+	Reset()
+}
+
+// deltaOwners are the running push exporters, OTLP exporters and
+// Pushgateway pushers, in the order they started. In delta temporality
+// mode, a single consumer resets the series after collecting them: the
+// first of these exporters after each of its pushes, or, when none runs,
+// Caddy's metrics registry when scraped. Other consumers, like the
+// /usage/metrics endpoint, never reset them, and see what was observed
+// since the owner's last reset.
+var deltaOwners struct {
+	sync.Mutex
+	exporters []any
+}
+
+// claimDeltaResets adds a started push exporter to those that can own the
+// resets, taking them over from the scrape if it is the first
+func claimDeltaResets(exporter any) {
+	deltaOwners.Lock()
+	defer deltaOwners.Unlock()
+
+	deltaOwners.exporters = append(deltaOwners.exporters, exporter)
+}
+
+// releaseDeltaResets removes a stopped push exporter, handing the resets
+// over to the next one, or back to the scrape
+func releaseDeltaResets(exporter any) {
+	deltaOwners.Lock()
+	defer deltaOwners.Unlock()
+
+	deltaOwners.exporters = slices.DeleteFunc(deltaOwners.exporters, func(e any) bool { return e == exporter })
+}
+
+// ownsDeltaResets reports whether exporter resets the series after
+// collecting them, a nil exporter standing for the scrape of Caddy's
+// registry
+func ownsDeltaResets(exporter any) bool {
+	if deltaHandlers.Load() == 0 {
+		return false
+	}
+
+	deltaOwners.Lock()
+	defer deltaOwners.Unlock()
+
+	if len(deltaOwners.exporters) == 0 {
+		return exporter == nil
+	}
+	return deltaOwners.exporters[0] == exporter
+}
+
+// resetDeltaSeries resets the vectors of every usage metric set, once the
+// exporter owning resets has pushed them
+func resetDeltaSeries() {
+	for _, um := range usageMetricSets() {
+		for _, vec := range um.vectors() {
+			vec.Reset()
+		}
+	}
+}
+
+// deltaCollector wraps a metric vector registered with Caddy's registry so
+// that, in delta temporality mode and while no push exporter owns the resets,
+// every scrape reports only what was observed since the previous one.
+// Observations made between a collection and the following reset are lost,
+// which is acceptable for the rarely-scraped environments this mode is for.
+type deltaCollector struct {
+	resettableCollector
+}
+
+// Collect implements prometheus.Collector
+func (c deltaCollector) Collect(ch chan<- prometheus.Metric) {
+	c.resettableCollector.Collect(ch)
+	if ownsDeltaResets(nil) {
+		c.Reset()
+	}
+}
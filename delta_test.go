@@ -0,0 +1,145 @@
+package caddyusage
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestDeltaTemporality tests that series are reset after collection only
+// while a delta handler is provisioned
+func TestDeltaTemporality(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	collect := func() {
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(200)
+		uc.collectMetrics(rec, httptest.NewRequest("GET", "http://example.com/", nil), time.Now(), nil)
+	}
+	count := func() float64 {
+		return testutil.ToFloat64(globalUsageMetrics.requestsTotal.WithLabelValues("200", "GET", "example.com", "/"))
+	}
+
+	// Cumulative by default
+	collect()
+	if _, err := registry.Gather(); err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	if got := count(); got != 1 {
+		t.Errorf("Expected the counter to survive collection, got %v", got)
+	}
+
+	delta := &UsageCollector{DeltaTemporality: true}
+	if err := delta.Provision(uc.ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	collect()
+	if _, err := registry.Gather(); err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.requestsTotal); n != 0 {
+		t.Errorf("Expected series to be reset after collection, got %d", n)
+	}
+
+	// Cleaning up the last delta handler restores cumulative behavior,
+	// and cleaning up twice doesn't unbalance the count
+	_ = delta.Cleanup()
+	_ = delta.Cleanup()
+	if got := deltaHandlers.Load(); got != 0 {
+		t.Fatalf("Expected no delta handlers after cleanup, got %d", got)
+	}
+
+	collect()
+	if _, err := registry.Gather(); err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	if got := count(); got != 1 {
+		t.Errorf("Expected the counter to survive collection again, got %v", got)
+	}
+}
+
+// TestDeltaResetOwner tests that only one consumer resets series in delta
+// temporality mode: the first push exporter, or the scrape without one
+func TestDeltaResetOwner(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	delta := &UsageCollector{DeltaTemporality: true}
+	if err := delta.Provision(uc.ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	defer func() { _ = delta.Cleanup() }()
+
+	collect := func() {
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(200)
+		uc.collectMetrics(rec, httptest.NewRequest("GET", "http://example.com/", nil), now(), nil)
+	}
+	count := func() int {
+		return testutil.CollectAndCount(globalUsageMetrics.requestsTotal)
+	}
+
+	// The usage gatherer, serving /usage/metrics and the push exporters,
+	// leaves series alone
+	collect()
+	gatherer, err := usageGatherer()
+	if err != nil {
+		t.Fatalf("usageGatherer failed: %v", err)
+	}
+	if _, err := gatherer.Gather(); err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	if n := count(); n != 1 {
+		t.Errorf("Expected the usage gatherer to keep series, got %d", n)
+	}
+
+	// A push exporter takes the resets over from the scrape
+	first, second := new(otlpExporter), new(pushgatewayPusher)
+	claimDeltaResets(first)
+	claimDeltaResets(second)
+	if _, err := registry.Gather(); err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	if n := count(); n != 1 {
+		t.Errorf("Expected scrapes to keep series while an exporter owns resets, got %d", n)
+	}
+	if ownsDeltaResets(nil) || !ownsDeltaResets(first) || ownsDeltaResets(second) {
+		t.Error("Expected the first exporter to own resets")
+	}
+
+	releaseDeltaResets(first)
+	if !ownsDeltaResets(second) {
+		t.Error("Expected the resets to pass on to the next exporter")
+	}
+
+	// Without exporters, scrapes reset series again
+	releaseDeltaResets(second)
+	if _, err := registry.Gather(); err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	if n := count(); n != 0 {
+		t.Errorf("Expected the scrape to reset series, got %d", n)
+	}
+}
+
+// TestUnmarshalDeltaTemporality tests parsing of the delta_temporality option
+func TestUnmarshalDeltaTemporality(t *testing.T) {
+	var uc UsageCollector
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser("usage {\n delta_temporality\n}")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !uc.DeltaTemporality {
+		t.Error("Expected delta temporality to be enabled")
+	}
+
+	var invalid UsageCollector
+	if err := invalid.UnmarshalCaddyfile(caddyfile.NewTestDispenser("usage {\n delta_temporality yes\n}")); err == nil {
+		t.Error("Expected an error for an argument")
+	}
+}
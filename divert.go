@@ -0,0 +1,26 @@
+package caddyusage
+
+import (
+	"net/http"
+	"slices"
+)
+
+// defaultDivertedMethods are the methods diverted when divert_methods is
+// given without any: health checks and CORS preflights
+var defaultDivertedMethods = []string{http.MethodHead, http.MethodOptions}
+
+// diverted reports whether a request's method is one of DivertMethods,
+// and so is only counted by divertedRequests
+func (uc *UsageCollector) diverted(r *http.Request) bool {
+	return len(uc.DivertMethods) > 0 && slices.Contains(uc.DivertMethods, r.Method)
+}
+
+// collectDivertedRequest counts a diverted request by host and method,
+// without recording it in any other metric
+func (uc *UsageCollector) collectDivertedRequest(r *http.Request) {
+	um := uc.usageMetrics()
+	if um == nil {
+		return
+	}
+	um.divertedRequests.WithLabelValues(uc.hostLabel(um, r.Host), r.Method).Inc()
+}
@@ -0,0 +1,63 @@
+package caddyusage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestDivertedRequests tests that requests with diverted methods are
+// served and only counted by host and method
+func TestDivertedRequests(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.DivertMethods = defaultDivertedMethods
+
+	served := 0
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		served++
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+	for _, method := range []string{"HEAD", "HEAD", "OPTIONS", "GET"} {
+		if err := uc.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "http://example.com/health", nil), next); err != nil {
+			t.Fatalf("ServeHTTP failed: %v", err)
+		}
+	}
+
+	if served != 4 {
+		t.Errorf("Expected every request to be served, got %d", served)
+	}
+	usagetest.AssertValue(t, registry, "diverted_requests_total", usagetest.Labels{"host": "example.com", "method": "HEAD"}, 2)
+	usagetest.AssertValue(t, registry, "diverted_requests_total", usagetest.Labels{"host": "example.com", "method": "OPTIONS"}, 1)
+	usagetest.AssertAbsent(t, registry, "diverted_requests_total", usagetest.Labels{"method": "GET"})
+	usagetest.AssertCount(t, registry, "requests_total", nil, 1)
+	usagetest.AssertValue(t, registry, "requests_total", usagetest.Labels{"method": "GET"}, 1)
+}
+
+// TestUnmarshalDivertMethods tests parsing of the divert_methods option
+func TestUnmarshalDivertMethods(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{input: "usage {\n divert_methods\n}", expected: []string{"HEAD", "OPTIONS"}},
+		{input: "usage {\n divert_methods options\n divert_methods TRACE\n}", expected: []string{"OPTIONS", "TRACE"}},
+	}
+
+	for _, tt := range tests {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(uc.DivertMethods, tt.expected) {
+			t.Errorf("%q: expected %v, got %v", tt.input, tt.expected, uc.DivertMethods)
+		}
+	}
+}
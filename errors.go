@@ -0,0 +1,141 @@
+package caddyusage
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Error triggers used to label error-route invocations
+const (
+	triggerTimeout             = "timeout"
+	triggerUpstreamUnreachable = "upstream_unreachable"
+	triggerClientCanceled      = "client_canceled"
+	triggerNotFound            = "not_found"
+	triggerForbidden           = "forbidden"
+	triggerOther               = "other"
+)
+
+// Types of errors returned by downstream handlers
+const (
+	errorTypeTimeout  = "timeout"
+	errorTypeCanceled = "canceled"
+	errorTypeHandler  = "handler_error"
+	errorTypeOther    = "other"
+)
+
+// errorStatus returns the status code Caddy associated with a handler chain
+// error, defaulting to 500 like Caddy's server does
+func errorStatus(err error) int {
+	var he caddyhttp.HandlerError
+	if errors.As(err, &he) && he.StatusCode != 0 {
+		return he.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+// errorTrigger classifies what caused a handler chain error
+func errorTrigger(err error) string {
+	// Client disconnects surface as a canceled context, sometimes wrapped
+	// in an unexported net error (see reverse_proxy's statusError)
+	if errors.Is(err, context.Canceled) || strings.Contains(err.Error(), "operation was canceled") {
+		return triggerClientCanceled
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return triggerTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return triggerTimeout
+	}
+
+	switch status := errorStatus(err); {
+	case status == http.StatusGatewayTimeout:
+		return triggerTimeout
+	case status == http.StatusBadGateway, status == http.StatusServiceUnavailable:
+		return triggerUpstreamUnreachable
+	case status == 499:
+		return triggerClientCanceled
+	case status == http.StatusNotFound:
+		return triggerNotFound
+	case status == http.StatusForbidden, status == http.StatusUnauthorized:
+		return triggerForbidden
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return triggerUpstreamUnreachable
+	}
+
+	return triggerOther
+}
+
+// collectErrorRouteMetrics records the original error when this handler runs
+// inside a handle_errors route. Caddy stores the error that short-circuited
+// the primary route in the request context before invoking error routes.
+func (uc *UsageCollector) collectErrorRouteMetrics(um *usageMetrics, r *http.Request, host string) {
+	handlerErr, ok := r.Context().Value(caddyhttp.ErrorCtxKey).(error)
+	if !ok || handlerErr == nil {
+		return
+	}
+
+	originalStatus := strconv.Itoa(errorStatus(handlerErr))
+	um.errorRouteRequests.WithLabelValues(originalStatus, errorTrigger(handlerErr), host).Inc()
+}
+
+// errorType classifies an error returned by downstream handlers: timeouts
+// and cancellations first, since Caddy wraps those in HandlerErrors too,
+// then errors carrying a status, then anything else
+func errorType(err error) string {
+	if errors.Is(err, context.Canceled) || strings.Contains(err.Error(), "operation was canceled") {
+		return errorTypeCanceled
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorTypeTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errorTypeTimeout
+	}
+
+	var he caddyhttp.HandlerError
+	if errors.As(err, &he) {
+		return errorTypeHandler
+	}
+
+	return errorTypeOther
+}
+
+// collectHandlerErrorMetrics records an error returned by downstream handlers
+func (uc *UsageCollector) collectHandlerErrorMetrics(um *usageMetrics, r *http.Request, err error) {
+	status := strconv.Itoa(errorStatus(err))
+	um.handlerErrors.WithLabelValues(errorType(err), status, uc.hostLabel(um, r.Host)).Inc()
+}
+
+// serveNext calls the next handler, counting panics in it before letting
+// them propagate to Caddy's own recovery. http.ErrAbortHandler is how
+// handlers such as reverse_proxy deliberately abort a response, so it isn't
+// counted.
+func (uc *UsageCollector) serveNext(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	defer func() {
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				if um := uc.usageMetrics(); um != nil {
+					um.handlerPanics.WithLabelValues(uc.hostLabel(um, r.Host)).Inc()
+				}
+			}
+			panic(v)
+		}
+	}()
+
+	return next.ServeHTTP(w, r)
+}
@@ -0,0 +1,168 @@
+package caddyusage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// timeoutError is a net.Error that reports a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// TestErrorTrigger tests classification of handler chain errors
+func TestErrorTrigger(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name           string
+		err            error
+		expectedStatus int
+		expectedCause  string
+	}{
+		{"plain error", errors.New("boom"), 500, triggerOther},
+		{"upstream dial failure", caddyhttp.Error(http.StatusBadGateway, dialErr), 502, triggerUpstreamUnreachable},
+		{"upstream timeout", caddyhttp.Error(http.StatusGatewayTimeout, timeoutError{}), 504, triggerTimeout},
+		{"deadline exceeded", fmt.Errorf("wrapped: %w", context.DeadlineExceeded), 500, triggerTimeout},
+		{"client canceled", caddyhttp.Error(499, context.Canceled), 499, triggerClientCanceled},
+		{"not found", caddyhttp.Error(http.StatusNotFound, nil), 404, triggerNotFound},
+		{"forbidden", caddyhttp.Error(http.StatusForbidden, errors.New("denied")), 403, triggerForbidden},
+		{"unwrapped dial failure", dialErr, 500, triggerUpstreamUnreachable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorStatus(tt.err); got != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, got)
+			}
+			if got := errorTrigger(tt.err); got != tt.expectedCause {
+				t.Errorf("Expected trigger %s, got %s", tt.expectedCause, got)
+			}
+		})
+	}
+}
+
+// TestErrorRouteMetrics tests that requests inside handle_errors routes are recorded
+func TestErrorRouteMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	// Regular requests are not counted as error-route invocations
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	uc.collectErrorRouteMetrics(globalUsageMetrics, req, "example.com")
+	if n := testutil.CollectAndCount(globalUsageMetrics.errorRouteRequests); n != 0 {
+		t.Errorf("Expected no error-route series for a regular request, got %d", n)
+	}
+
+	handlerErr := caddyhttp.Error(http.StatusGatewayTimeout, timeoutError{})
+	req = req.WithContext(context.WithValue(req.Context(), caddyhttp.ErrorCtxKey, error(handlerErr)))
+	uc.collectErrorRouteMetrics(globalUsageMetrics, req, "example.com")
+
+	got := testutil.ToFloat64(globalUsageMetrics.errorRouteRequests.WithLabelValues("504", triggerTimeout, "example.com"))
+	if got != 1 {
+		t.Errorf("Expected one error-route invocation, got %v", got)
+	}
+}
+
+// TestErrorType tests classification of errors returned by downstream handlers
+func TestErrorType(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"plain error", errors.New("boom"), errorTypeOther},
+		{"handler error", caddyhttp.Error(http.StatusBadGateway, errors.New("no backend")), errorTypeHandler},
+		{"handler error without cause", caddyhttp.Error(http.StatusNotFound, nil), errorTypeHandler},
+		{"wrapped timeout", caddyhttp.Error(http.StatusGatewayTimeout, timeoutError{}), errorTypeTimeout},
+		{"deadline exceeded", fmt.Errorf("wrapped: %w", context.DeadlineExceeded), errorTypeTimeout},
+		{"canceled", caddyhttp.Error(499, context.Canceled), errorTypeCanceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorType(tt.err); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestHandlerErrorMetrics tests that errors returned through the handler
+// are counted and still returned
+func TestHandlerErrorMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	handlerErr := caddyhttp.Error(http.StatusBadGateway, errors.New("no backend"))
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return handlerErr
+	})
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	if err := uc.ServeHTTP(httptest.NewRecorder(), req, next); !errors.Is(err, handlerErr) {
+		t.Errorf("Expected the handler error to be returned, got %v", err)
+	}
+
+	got := testutil.ToFloat64(globalUsageMetrics.handlerErrors.WithLabelValues(errorTypeHandler, "502", "example.com"))
+	if got != 1 {
+		t.Errorf("Expected one handler error, got %v", got)
+	}
+
+	// Successful requests are not counted
+	ok := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	if err := uc.ServeHTTP(httptest.NewRecorder(), req, ok); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.handlerErrors); n != 1 {
+		t.Errorf("Expected 1 handler error series, got %d", n)
+	}
+}
+
+// TestHandlerPanicMetrics tests that panics are counted and re-panicked,
+// except deliberate aborts
+func TestHandlerPanicMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	tests := []struct {
+		name     string
+		value    any
+		expected float64
+	}{
+		{"panic", "boom", 1},
+		{"abort is not counted", http.ErrAbortHandler, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				panic(tt.value)
+			})
+
+			func() {
+				defer func() {
+					if v := recover(); v != tt.value {
+						t.Errorf("Expected the panic to propagate, recovered %v", v)
+					}
+				}()
+				req := httptest.NewRequest("GET", "http://example.com/", nil)
+				_ = uc.ServeHTTP(httptest.NewRecorder(), req, next)
+			}()
+
+			if got := testutil.ToFloat64(globalUsageMetrics.handlerPanics.WithLabelValues("example.com")); got != tt.expected {
+				t.Errorf("Expected %v panics, got %v", tt.expected, got)
+			}
+		})
+	}
+}
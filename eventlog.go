@@ -0,0 +1,511 @@
+package caddyusage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+)
+
+// Event log defaults
+const (
+	defaultEventLogMaxSize  = 100 << 20
+	defaultEventLogMaxFiles = 10
+	eventLogFlushInterval   = time.Second
+	eventLogBufferSize      = 64 << 10
+
+	// eventLogTimeFormat stamps rotated files, sorting chronologically
+	eventLogTimeFormat = "20060102T150405.000"
+)
+
+// EventLogConfig configures writing one JSON line per request to a file,
+// for offline analysis of what the aggregated metrics leave out.
+type EventLogConfig struct {
+	// Path is the file events are appended to. Rotated files are named
+	// after it, with the time of rotation before the extension.
+	Path string `json:"path"`
+
+	// Headers are request headers recorded with each event. Credentials,
+	// such as Authorization, are only recorded as present.
+	Headers []string `json:"headers,omitempty"`
+
+	// MaxSize is the size in bytes past which the file is rotated.
+	// Defaults to 100 MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// RotateEvery rotates the file at this interval, whatever its size.
+	// Disabled by default.
+	RotateEvery caddy.Duration `json:"rotate_every,omitempty"`
+
+	// MaxFiles is the number of rotated files kept, the oldest being
+	// deleted. Defaults to 10.
+	MaxFiles int `json:"max_files,omitempty"`
+}
+
+// validate checks the path and rotation settings
+func (ec *EventLogConfig) validate() error {
+	if ec.Path == "" {
+		return fmt.Errorf("event_log path is required")
+	}
+	if ec.MaxSize < 0 {
+		return fmt.Errorf("event_log max_size must not be negative, got %d", ec.MaxSize)
+	}
+	if ec.RotateEvery < 0 {
+		return fmt.Errorf("event_log rotate_every must not be negative, got %s", time.Duration(ec.RotateEvery))
+	}
+	if ec.MaxFiles < 0 {
+		return fmt.Errorf("event_log max_files must not be negative, got %d", ec.MaxFiles)
+	}
+	return nil
+}
+
+// usageEvent is a request record of the event log and ClickHouse. Values
+// of labels are those recorded by the metrics, after the label policy.
+type usageEvent struct {
+	Time            time.Time         `json:"time"`
+	DurationSeconds float64           `json:"duration_seconds"`
+	ClientIP        string            `json:"client_ip"`
+	Method          string            `json:"method"`
+	Host            string            `json:"host"`
+	Path            string            `json:"path"`
+	Status          int               `json:"status"`
+	Bytes           int               `json:"bytes"`
+	Headers         map[string]string `json:"headers,omitempty"`
+
+	// ClockSkewed flags events timestamped while clock_check found the
+	// wall clock unreliable
+	ClockSkewed bool `json:"clock_skewed,omitempty"`
+}
+
+// usageEvents recycles events once written, or inserted into ClickHouse
+var usageEvents = sync.Pool{New: func() any { return new(usageEvent) }}
+
+// newUsageEvent returns an event copied from base, to be released with
+// releaseUsageEvent once no longer used
+func newUsageEvent(base *usageEvent) *usageEvent {
+	event := usageEvents.Get().(*usageEvent)
+	*event = *base
+	return event
+}
+
+// releaseUsageEvent returns an event to the pool
+func releaseUsageEvent(event *usageEvent) {
+	*event = usageEvent{}
+	usageEvents.Put(event)
+}
+
+// eventLog appends events to a file, rotating it by size and age. Handlers
+// logging to the same file share an event log, so config reloads keep it
+// open; like other shared settings, the most recently provisioned
+// handler's rotation settings apply.
+type eventLog struct {
+	path   string
+	logger *zap.Logger
+
+	mu          sync.Mutex
+	file        *os.File
+	buf         *bufio.Writer
+	size        int64
+	opened      time.Time
+	maxSize     int64
+	rotateEvery time.Duration
+	maxFiles    int
+	writeFails  bool
+	closed      bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// eventLogEntry is a shared event log and the number of handlers using it
+type eventLogEntry struct {
+	log  *eventLog
+	refs int
+}
+
+var (
+	// Open event logs by path
+	eventLogs   = make(map[string]*eventLogEntry)
+	eventLogsMu sync.Mutex
+)
+
+// acquireEventLog returns the open event log of the configured path,
+// opening it if needed. Each successful call must be balanced by a call to
+// releaseEventLog.
+func acquireEventLog(ec *EventLogConfig, logger *zap.Logger) (*eventLog, error) {
+	eventLogsMu.Lock()
+	defer eventLogsMu.Unlock()
+
+	path, err := filepath.Abs(ec.Path)
+	if err != nil {
+		return nil, fmt.Errorf("event log: %v", err)
+	}
+	if entry, ok := eventLogs[path]; ok {
+		entry.refs++
+		entry.log.configure(ec)
+		return entry.log, nil
+	}
+
+	l := &eventLog{path: path, logger: logger, done: make(chan struct{})}
+	l.configure(ec)
+	if err := l.open(); err != nil {
+		return nil, fmt.Errorf("event log: %v", err)
+	}
+	l.run()
+	eventLogs[path] = &eventLogEntry{log: l, refs: 1}
+	return l, nil
+}
+
+// releaseEventLog releases a handler's use of an event log, flushing and
+// closing it once no handler uses it anymore
+func releaseEventLog(l *eventLog) error {
+	eventLogsMu.Lock()
+	defer eventLogsMu.Unlock()
+
+	entry, ok := eventLogs[l.path]
+	if !ok || entry.log != l {
+		return nil
+	}
+	if entry.refs--; entry.refs > 0 {
+		return nil
+	}
+	delete(eventLogs, l.path)
+	return l.stop()
+}
+
+// configure applies the rotation settings of a configuration
+func (l *eventLog) configure(ec *EventLogConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.maxSize = defaultEventLogMaxSize
+	if ec.MaxSize > 0 {
+		l.maxSize = ec.MaxSize
+	}
+	l.rotateEvery = time.Duration(ec.RotateEvery)
+	l.maxFiles = defaultEventLogMaxFiles
+	if ec.MaxFiles > 0 {
+		l.maxFiles = ec.MaxFiles
+	}
+}
+
+// open opens the file for appending, creating it and its directory if
+// needed
+func (l *eventLog) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	l.file = file
+	l.buf = bufio.NewWriterSize(file, eventLogBufferSize)
+	l.size = info.Size()
+	l.opened = now()
+	return nil
+}
+
+// run flushes buffered events every second, and rotates files that have
+// reached their age while idle, until stopped
+func (l *eventLog) run() {
+	ticker := newTicker(eventLogFlushInterval)
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				l.mu.Lock()
+				err := l.flushLocked()
+				if err == nil && l.size > 0 && l.dueLocked(0) {
+					err = l.rotateLocked()
+				}
+				l.failedLocked(err)
+				l.mu.Unlock()
+			case <-l.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the flusher, writes what's buffered and closes the file
+func (l *eventLog) stop() error {
+	close(l.done)
+	l.wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	err := l.flushLocked()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file, l.buf = nil, nil
+	return err
+}
+
+// write appends an event, rotating the file first if the event would take
+// it past its maximum size or it has reached its age
+func (l *eventLog) write(event *usageEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	faultErr := sinkFault(sinkEventLog)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return
+	}
+	if faultErr != nil {
+		l.failedLocked(faultErr)
+		return
+	}
+	if l.file == nil {
+		// Rotation failed to reopen the file
+		if err := l.open(); err != nil {
+			l.failedLocked(err)
+			return
+		}
+	}
+	if l.size > 0 && l.dueLocked(int64(len(line))) {
+		if err := l.rotateLocked(); err != nil {
+			l.failedLocked(err)
+			return
+		}
+	}
+	n, err := l.buf.Write(line)
+	l.size += int64(n)
+	l.failedLocked(err)
+}
+
+// dueLocked reports whether the file must be rotated before writing n
+// more bytes
+func (l *eventLog) dueLocked(n int64) bool {
+	if l.size+n > l.maxSize {
+		return true
+	}
+	return l.rotateEvery > 0 && since(l.opened) >= l.rotateEvery
+}
+
+// flushLocked writes the buffered events to the file
+func (l *eventLog) flushLocked() error {
+	if l.buf == nil {
+		return nil
+	}
+	return l.buf.Flush()
+}
+
+// rotateLocked renames the file after the current time, opens a new one
+// and deletes the oldest rotated files past the maximum
+func (l *eventLog) rotateLocked() error {
+	if err := l.flushLocked(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file, l.buf = nil, nil
+
+	ext := filepath.Ext(l.path)
+	base := strings.TrimSuffix(l.path, ext)
+	if err := renameFile(l.path, base+"-"+now().UTC().Format(eventLogTimeFormat)+ext); err != nil {
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	rotated, err := l.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	for len(rotated) > l.maxFiles {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// rotatedFiles returns the paths of the rotated files, oldest first
+func (l *eventLog) rotatedFiles() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(l.path))
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Base(l.path)
+	ext := filepath.Ext(name)
+	prefix := strings.TrimSuffix(name, ext) + "-"
+
+	var rotated []string
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || !strings.HasSuffix(stamp, ext) || entry.IsDir() {
+			continue
+		}
+		// Other files sharing the prefix are left alone
+		if _, err := time.Parse(eventLogTimeFormat, strings.TrimSuffix(stamp, ext)); err != nil {
+			continue
+		}
+		rotated = append(rotated, filepath.Join(filepath.Dir(l.path), entry.Name()))
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// failedLocked logs when writing events starts or stops failing
+func (l *eventLog) failedLocked(err error) {
+	switch {
+	case err != nil && !l.writeFails:
+		l.logger.Warn("failed to write usage event log", zap.String("path", l.path), zap.Error(err))
+	case err == nil && l.writeFails:
+		l.logger.Info("writing usage event log again", zap.String("path", l.path))
+	}
+	l.writeFails = err != nil
+}
+
+// collectEvent writes a request to the event log and ClickHouse, with the
+// label values recorded by the metrics
+func (uc *UsageCollector) collectEvent(rec recordedResponse, r *http.Request, startTime time.Time, elapsed time.Duration, method, host, path, clientIP string) {
+	event := usageEvent{
+		Time:            startTime.UTC(),
+		DurationSeconds: elapsed.Seconds(),
+		ClientIP:        clientIP,
+		Method:          method,
+		Host:            host,
+		Path:            path,
+		Status:          rec.Status(),
+		Bytes:           rec.Size(),
+		ClockSkewed:     clockSkewed(),
+	}
+	if uc.eventLog != nil {
+		logged := newUsageEvent(&event)
+		logged.Headers = eventHeaders(r, uc.EventLog.Headers)
+		uc.eventLog.write(logged)
+		releaseUsageEvent(logged)
+	}
+	if uc.clickhouse != nil {
+		// Released by the writer once inserted or dropped
+		inserted := newUsageEvent(&event)
+		inserted.Headers = eventHeaders(r, uc.ClickHouse.Headers)
+		uc.clickhouse.add(inserted)
+	}
+}
+
+// eventHeaders returns the values of the named request headers that are
+// set, recording credentials only as present
+func eventHeaders(r *http.Request, names []string) map[string]string {
+	var headers map[string]string
+	for _, name := range names {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		value := r.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		if presenceOnlyHeaders[name] {
+			value = "present"
+		}
+		if headers == nil {
+			headers = make(map[string]string, len(names))
+		}
+		headers[name] = value
+	}
+	return headers
+}
+
+// unmarshalEventLogConfig parses an event_log block:
+//
+//	event_log <path> [{
+//	    headers <names...>
+//	    max_size <size>
+//	    rotate_every <duration>
+//	    max_files <count>
+//	}]
+func unmarshalEventLogConfig(d *caddyfile.Dispenser) (*EventLogConfig, error) {
+	ec := new(EventLogConfig)
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	ec.Path = d.Val()
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if option == "headers" {
+			headers := d.RemainingArgs()
+			if len(headers) == 0 {
+				return nil, d.ArgErr()
+			}
+			ec.Headers = append(ec.Headers, headers...)
+			continue
+		}
+
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		value := d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		switch option {
+		case "max_size":
+			size, err := humanize.ParseBytes(value)
+			if err != nil || size == 0 {
+				return nil, d.Errf("invalid event_log max_size '%s'", value)
+			}
+			ec.MaxSize = int64(size)
+		case "rotate_every":
+			dur, err := caddy.ParseDuration(value)
+			if err != nil {
+				return nil, d.Errf("invalid event_log rotate_every '%s': %v", value, err)
+			}
+			ec.RotateEvery = caddy.Duration(dur)
+		case "max_files":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, d.Errf("invalid event_log max_files '%s'", value)
+			}
+			ec.MaxFiles = n
+		default:
+			return nil, d.Errf("unrecognized event_log option '%s'", option)
+		}
+	}
+
+	return ec, nil
+}
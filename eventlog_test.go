@@ -0,0 +1,223 @@
+package caddyusage
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// readEvents returns the events of an event log file
+func readEvents(t *testing.T, path string) []usageEvent {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open event log: %v", err)
+	}
+	defer file.Close()
+
+	var events []usageEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event usageEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid event line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// rotatedEventLogs returns the rotated files of an event log
+func rotatedEventLogs(t *testing.T, l *eventLog) []string {
+	t.Helper()
+
+	rotated, err := l.rotatedFiles()
+	if err != nil {
+		t.Fatalf("Failed to list rotated files: %v", err)
+	}
+	return rotated
+}
+
+// TestEventLog tests the events written for requests
+func TestEventLog(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	path := filepath.Join(t.TempDir(), "logs", "usage.jsonl")
+	uc.EventLog = &EventLogConfig{Path: path, Headers: []string{"user-agent", "Authorization", "X-Missing"}}
+	l, err := acquireEventLog(uc.EventLog, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	uc.eventLog = l
+
+	start := now()
+	req := httptest.NewRequest("POST", "http://example.com/api/items?page=2", nil)
+	req.RemoteAddr = "192.0.2.10:51234"
+	req.Header.Set("User-Agent", "curl/8.0")
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+	rec.WriteHeader(201)
+	_, _ = rec.Write([]byte("created"))
+	clock.Advance(250 * time.Millisecond)
+	uc.collectMetrics(rec, req, start, nil)
+
+	// Events are flushed by the last handler releasing the log
+	if err := releaseEventLog(l); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []usageEvent{{
+		Time:            start,
+		DurationSeconds: 0.25,
+		ClientIP:        "192.0.2.10",
+		Method:          "POST",
+		Host:            "example.com",
+		Path:            "/api/items",
+		Status:          201,
+		Bytes:           7,
+		Headers:         map[string]string{"User-Agent": "curl/8.0", "Authorization": "present"},
+	}}
+	if got := readEvents(t, path); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, got)
+	}
+
+	// Events recorded while the clock is skewed are flagged
+	currentClockSkew.Store(&clockSkew{skewed: true})
+	defer currentClockSkew.Store(nil)
+
+	l, err = acquireEventLog(uc.EventLog, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	uc.eventLog = l
+	uc.collectMetrics(rec, req, now(), nil)
+	if err := releaseEventLog(l); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if events := readEvents(t, path); len(events) != 2 || events[0].ClockSkewed || !events[1].ClockSkewed {
+		t.Errorf("Expected the second event to be flagged, got %+v", events)
+	}
+}
+
+// TestEventLogRotation tests rotation by size and age, and that only the
+// newest rotated files are kept
+func TestEventLogRotation(t *testing.T) {
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "usage.jsonl")
+	other := filepath.Join(dir, "usage-notes.jsonl")
+	if err := os.WriteFile(other, []byte("keep\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	l, err := acquireEventLog(&EventLogConfig{Path: path, MaxSize: 300, MaxFiles: 2}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer func() { _ = releaseEventLog(l) }()
+
+	event := &usageEvent{Time: now(), Method: "GET", Host: "example.com", Path: "/", Status: 200}
+	line, _ := json.Marshal(event)
+	perFile := 300 / (len(line) + 1)
+
+	// Each rotation is stamped with its own time
+	for i := range 4 * perFile {
+		if i > 0 && i%perFile == 0 {
+			clock.Advance(time.Second)
+		}
+		l.write(event)
+	}
+
+	rotated := rotatedEventLogs(t, l)
+	if len(rotated) != 2 {
+		t.Fatalf("Expected 2 rotated files to be kept, got %v", rotated)
+	}
+	if want := filepath.Join(dir, "usage-20250101T000003.000.jsonl"); rotated[1] != want {
+		t.Errorf("Expected the newest rotation to be %s, got %s", want, rotated[1])
+	}
+	for _, file := range rotated {
+		if events := readEvents(t, file); len(events) != perFile {
+			t.Errorf("Expected %d events in %s, got %d", perFile, file, len(events))
+		}
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("Expected unrelated files to be kept: %v", err)
+	}
+
+	// Age rotation applies even while idle
+	l.configure(&EventLogConfig{Path: path, RotateEvery: caddy.Duration(time.Hour), MaxFiles: 2})
+	clock.Advance(time.Hour)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if rotated := rotatedEventLogs(t, l); strings.HasSuffix(rotated[len(rotated)-1], "T010003.000.jsonl") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected the file to be rotated after an hour, got %v", rotatedEventLogs(t, l))
+}
+
+// TestUnmarshalEventLog tests parsing of the event_log option
+func TestUnmarshalEventLog(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *EventLogConfig
+		expectErr bool
+	}{
+		{input: "usage {\n event_log /var/log/caddy/usage.jsonl\n}", expected: &EventLogConfig{Path: "/var/log/caddy/usage.jsonl"}},
+		{
+			input: "usage {\n event_log usage.jsonl {\n headers User-Agent Referer\n max_size 10MiB\n rotate_every 24h\n max_files 7\n }\n}",
+			expected: &EventLogConfig{
+				Path:        "usage.jsonl",
+				Headers:     []string{"User-Agent", "Referer"},
+				MaxSize:     10 << 20,
+				RotateEvery: caddy.Duration(24 * time.Hour),
+				MaxFiles:    7,
+			},
+		},
+		{input: "usage {\n event_log\n}", expectErr: true},
+		{input: "usage {\n event_log a b\n}", expectErr: true},
+		{input: "usage {\n event_log a {\n headers\n }\n}", expectErr: true},
+		{input: "usage {\n event_log a {\n max_size huge\n }\n}", expectErr: true},
+		{input: "usage {\n event_log a {\n max_files 0\n }\n}", expectErr: true},
+		{input: "usage {\n event_log a {\n rotate_every daily\n }\n}", expectErr: true},
+		{input: "usage {\n event_log a {\n compress\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.EventLog, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.EventLog)
+			}
+		})
+	}
+}
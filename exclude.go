@@ -0,0 +1,80 @@
+package caddyusage
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// compilePatterns compiles host or path patterns, like those of
+// exclude_paths and exclude_hosts. Patterns starting with ^ are regular expressions; any other pattern is a
+// glob where * matches any run of characters, including /, and ? matches
+// a single character. Globs must match the whole value.
+func compilePatterns(patterns []string, caseInsensitive bool) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		expr := pattern
+		if !strings.HasPrefix(pattern, "^") {
+			expr = globToRegexp(pattern)
+		}
+		if caseInsensitive {
+			expr = "(?i)" + expr
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// globToRegexp converts a glob to an anchored regular expression
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+// excluded reports whether a request matches exclude_paths or
+// exclude_hosts, and so must not be recorded by any metric
+func (uc *UsageCollector) excluded(r *http.Request) bool {
+	for _, re := range uc.excludePaths {
+		if re.MatchString(r.URL.Path) {
+			return true
+		}
+	}
+
+	if len(uc.excludeHosts) == 0 {
+		return false
+	}
+	host := hostWithoutPort(r.Host)
+	for _, re := range uc.excludeHosts {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostWithoutPort strips the port from a Host header value, if any
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,110 @@
+package caddyusage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestExcluded tests path and host exclusion patterns
+func TestExcluded(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.ExcludePaths = []string{"/health", "/static/*", `^/api/v[0-9]+/ping$`}
+	uc.ExcludeHosts = []string{"*.internal", "metrics.example.com"}
+	if err := uc.Provision(uc.ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	tests := []struct {
+		url      string
+		excluded bool
+	}{
+		{"http://example.com/health", true},
+		{"http://example.com/healthz", false},
+		{"http://example.com/static/css/site.css", true},
+		{"http://example.com/static", false},
+		{"http://example.com/api/v2/ping", true},
+		{"http://example.com/api/v2/ping/x", false},
+		{"http://db.internal/", true},
+		{"http://METRICS.example.com:8443/", true},
+		{"http://example.com/api/users", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if got := uc.excluded(req); got != tt.excluded {
+				t.Errorf("Expected excluded=%v, got %v", tt.excluded, got)
+			}
+		})
+	}
+}
+
+// TestExcludedRequestsNotRecorded tests that excluded requests are served
+// without touching any metric
+func TestExcludedRequestsNotRecorded(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.ExcludePaths = []string{"/health"}
+	if err := uc.Provision(uc.ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	var served bool
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		served = true
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	if err := uc.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/health", nil), next); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	if !served {
+		t.Error("Expected the excluded request to be served")
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.requestsTotal); n != 0 {
+		t.Errorf("Expected no series for an excluded request, got %d", n)
+	}
+}
+
+// TestExcludeInvalidPattern tests that invalid regular expressions fail provisioning
+func TestExcludeInvalidPattern(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.ExcludePaths = []string{"^/api/("}
+	if err := uc.Provision(uc.ctx); err == nil {
+		t.Error("Expected an error for an invalid exclude pattern")
+	}
+}
+
+// TestUnmarshalExclude tests parsing of the exclude_paths and exclude_hosts options
+func TestUnmarshalExclude(t *testing.T) {
+	var uc UsageCollector
+	input := "usage {\n exclude_paths /health /static/*\n exclude_paths /metrics\n exclude_hosts *.internal\n}"
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := []string{"/health", "/static/*", "/metrics"}; !slices.Equal(uc.ExcludePaths, expected) {
+		t.Errorf("Expected exclude_paths %v, got %v", expected, uc.ExcludePaths)
+	}
+	if expected := []string{"*.internal"}; !slices.Equal(uc.ExcludeHosts, expected) {
+		t.Errorf("Expected exclude_hosts %v, got %v", expected, uc.ExcludeHosts)
+	}
+
+	for _, invalid := range []string{"usage {\n exclude_paths\n}", "usage {\n exclude_hosts\n}"} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package caddyusage
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Formats the usage metrics endpoint can serve
+const (
+	formatText        = "text"
+	formatOpenMetrics = "openmetrics"
+	formatJSON        = "json"
+)
+
+// jsonMetricFamily is a metric family in the compact JSON exposition
+type jsonMetricFamily struct {
+	Name    string       `json:"name"`
+	Help    string       `json:"help,omitempty"`
+	Type    string       `json:"type"`
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+// jsonMetric is a single series in the compact JSON exposition. Counters
+// and gauges have a value; histograms and summaries have a count, a sum and
+// their buckets or quantiles, keyed by upper bound or quantile.
+type jsonMetric struct {
+	Labels    map[string]string  `json:"labels,omitempty"`
+	Value     *float64           `json:"value,omitempty"`
+	Count     *uint64            `json:"count,omitempty"`
+	Sum       *float64           `json:"sum,omitempty"`
+	Buckets   map[string]uint64  `json:"buckets,omitempty"`
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+}
+
+// usageGatherer returns a gatherer of every usage metric set in use, the
+// shared metrics and those of each namespace, along with the counters of
+// custom labels and JWT claims. Other metrics of Caddy's registry are left
+// out.
+func usageGatherer() (prometheus.Gatherer, error) {
+	sets := []*usageMetrics{globalUsageMetrics}
+
+	namespacedMetrics.Range(func(_, value any) bool {
+		sets = append(sets, value.(*namespaceMetrics).metrics)
+		return true
+	})
+
+	registry := prometheus.NewRegistry()
+	for _, um := range sets {
+		if um == nil {
+			continue
+		}
+		for _, collector := range um.collectors {
+			if err := registry.Register(collector); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Counters of custom labels are shared between handlers by name and
+	// label names rather than belonging to a set
+	var err error
+	labelsCounters.Range(func(_, value any) bool {
+		err = registry.Register(value.(*labelsCounter).vec)
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return withGatherFaults(registry), nil
+}
+
+// negotiateFormat picks the exposition format of a metrics request. The
+// format query parameter takes precedence over the Accept header, which
+// selects JSON only when it asks for JSON and none of the Prometheus formats.
+func negotiateFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case formatText, formatOpenMetrics, formatJSON:
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown format '%s', expected text, openmetrics or json", format)
+	}
+
+	var acceptsJSON, acceptsPrometheus bool
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			acceptsJSON = true
+		case "text/plain", "application/openmetrics-text":
+			acceptsPrometheus = true
+		}
+	}
+	if acceptsJSON && !acceptsPrometheus {
+		return formatJSON, nil
+	}
+
+	// Like Prometheus' own metrics handler, fall back to the text format
+	if expfmt.NegotiateIncludingOpenMetrics(r.Header).FormatType() == expfmt.TypeOpenMetrics {
+		return formatOpenMetrics, nil
+	}
+	return formatText, nil
+}
+
+// writeMetrics encodes families in the given format
+func writeMetrics(w http.ResponseWriter, families []*dto.MetricFamily, format string) error {
+	if format == formatJSON {
+		return writeJSON(w, jsonMetricFamilies(families))
+	}
+
+	expFormat := expfmt.NewFormat(expfmt.TypeTextPlain)
+	if format == formatOpenMetrics {
+		expFormat = expfmt.NewFormat(expfmt.TypeOpenMetrics)
+	}
+	w.Header().Set("Content-Type", string(expFormat))
+
+	enc := expfmt.NewEncoder(w, expFormat)
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			return err
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// jsonMetricFamilies converts gathered families to the compact JSON format
+func jsonMetricFamilies(families []*dto.MetricFamily) []jsonMetricFamily {
+	out := make([]jsonMetricFamily, 0, len(families))
+	for _, family := range families {
+		jf := jsonMetricFamily{
+			Name:    family.GetName(),
+			Help:    family.GetHelp(),
+			Type:    strings.ToLower(family.GetType().String()),
+			Metrics: make([]jsonMetric, 0, len(family.GetMetric())),
+		}
+
+		for _, metric := range family.GetMetric() {
+			var jm jsonMetric
+			if pairs := metric.GetLabel(); len(pairs) > 0 {
+				jm.Labels = make(map[string]string, len(pairs))
+				for _, pair := range pairs {
+					jm.Labels[pair.GetName()] = pair.GetValue()
+				}
+			}
+
+			switch {
+			case metric.Counter != nil:
+				value := metric.GetCounter().GetValue()
+				jm.Value = &value
+			case metric.Gauge != nil:
+				value := metric.GetGauge().GetValue()
+				jm.Value = &value
+			case metric.Untyped != nil:
+				value := metric.GetUntyped().GetValue()
+				jm.Value = &value
+			case metric.Histogram != nil:
+				h := metric.GetHistogram()
+				count, sum := h.GetSampleCount(), h.GetSampleSum()
+				jm.Count, jm.Sum = &count, &sum
+				jm.Buckets = make(map[string]uint64, len(h.GetBucket())+1)
+				for _, bucket := range h.GetBucket() {
+					jm.Buckets[formatBound(bucket.GetUpperBound())] = bucket.GetCumulativeCount()
+				}
+				jm.Buckets["+Inf"] = count
+			case metric.Summary != nil:
+				s := metric.GetSummary()
+				count, sum := s.GetSampleCount(), s.GetSampleSum()
+				jm.Count, jm.Sum = &count, &sum
+				jm.Quantiles = make(map[string]float64, len(s.GetQuantile()))
+				for _, quantile := range s.GetQuantile() {
+					jm.Quantiles[formatBound(quantile.GetQuantile())] = quantile.GetValue()
+				}
+			}
+
+			jf.Metrics = append(jf.Metrics, jm)
+		}
+
+		out = append(out, jf)
+	}
+	return out
+}
+
+// formatBound formats a bucket bound or quantile like the text format does
+func formatBound(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,132 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestNegotiateFormat tests exposition format selection
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		accept    string
+		expected  string
+		expectErr bool
+	}{
+		{name: "default", expected: formatText},
+		{name: "prometheus scraper", accept: "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5", expected: formatOpenMetrics},
+		{name: "text", accept: "text/plain", expected: formatText},
+		{name: "json", accept: "application/json", expected: formatJSON},
+		{name: "json and text", accept: "application/json, text/plain", expected: formatText},
+		{name: "query overrides accept", query: "?format=json", accept: "text/plain", expected: formatJSON},
+		{name: "query openmetrics", query: "?format=openmetrics", expected: formatOpenMetrics},
+		{name: "unknown query format", query: "?format=xml", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/usage/metrics"+tt.query, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			format, err := negotiateFormat(req)
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if format != tt.expected {
+				t.Errorf("Expected format %s, got %s", tt.expected, format)
+			}
+		})
+	}
+}
+
+// TestHandleMetrics tests the /usage/metrics admin endpoint in each format
+func TestHandleMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	collectTestRequests(t, uc)
+
+	tests := []struct {
+		accept      string
+		contentType string
+		contains    string
+	}{
+		{"text/plain", "text/plain", "# TYPE caddy_usage_requests_total counter"},
+		{"application/openmetrics-text", "application/openmetrics-text", "# EOF"},
+		{"application/json", "application/json", `"name": "caddy_usage_requests_total"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/usage/metrics", nil)
+			req.Header.Set("Accept", tt.accept)
+			w, err := serveAdmin(t, "/usage/metrics", req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.contentType) {
+				t.Errorf("Expected content type %s, got %s", tt.contentType, ct)
+			}
+			if !strings.Contains(w.Body.String(), tt.contains) {
+				t.Errorf("Expected body to contain %q, got:\n%s", tt.contains, w.Body.String())
+			}
+		})
+	}
+
+	req := httptest.NewRequest("POST", "/usage/metrics", nil)
+	if _, err := serveAdmin(t, "/usage/metrics", req); apiErrorStatus(err) != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %v", err)
+	}
+}
+
+// TestJSONExposition tests the compact JSON format of each metric type
+func TestJSONExposition(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	collectTestRequests(t, uc)
+
+	req := httptest.NewRequest("GET", "/usage/metrics?format=json", nil)
+	w, err := serveAdmin(t, "/usage/metrics", req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var families []jsonMetricFamily
+	if err := json.Unmarshal(w.Body.Bytes(), &families); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	byName := make(map[string]jsonMetricFamily)
+	for _, family := range families {
+		byName[family.Name] = family
+	}
+
+	counter, ok := byName["caddy_usage_requests_total"]
+	if !ok || counter.Type != "counter" || len(counter.Metrics) == 0 {
+		t.Fatalf("Expected requests_total counter series, got %+v", counter)
+	}
+	if m := counter.Metrics[0]; m.Value == nil || m.Labels["host"] == "" {
+		t.Errorf("Expected a labeled counter value, got %+v", m)
+	}
+
+	histogram, ok := byName["caddy_usage_request_duration_seconds"]
+	if !ok || histogram.Type != "histogram" || len(histogram.Metrics) == 0 {
+		t.Fatalf("Expected request_duration_seconds histogram series, got %+v", histogram)
+	}
+	if m := histogram.Metrics[0]; m.Count == nil || m.Sum == nil || m.Buckets["+Inf"] != *m.Count {
+		t.Errorf("Expected count, sum and an +Inf bucket matching the count, got %+v", m)
+	}
+
+	if gauge, ok := byName["caddy_usage_active_paths"]; !ok || gauge.Type != "gauge" {
+		t.Errorf("Expected active_paths gauge, got %+v", gauge)
+	}
+}
@@ -0,0 +1,100 @@
+package caddyusage
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Origins of failed requests: the client, the upstream behind
+// reverse_proxy, or Caddy itself
+const (
+	originClient   = "client"
+	originUpstream = "upstream"
+	originEdge     = "edge"
+)
+
+// Categories of failed requests within their origin
+const (
+	failureClientError         = "client_error"
+	failureClientCanceled      = "client_canceled"
+	failureUpstream5xx         = "upstream_5xx"
+	failureUpstreamTimeout     = "upstream_timeout"
+	failureUpstreamUnreachable = "upstream_unreachable"
+	failureEdgeLimited         = "edge_limited"
+	failureEdgeRejected        = "edge_rejected"
+	failureEdgeError           = "edge_error"
+)
+
+// upstreamPlaceholder is set by reverse_proxy to the address of the
+// upstream it proxied the request to
+const upstreamPlaceholder = "http.reverse_proxy.upstream.address"
+
+// proxied reports whether reverse_proxy handed the request to an upstream
+func proxied(r *http.Request) bool {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return false
+	}
+	addr, ok := repl.GetString(upstreamPlaceholder)
+	return ok && addr != ""
+}
+
+// failureClass attributes a failed request to the client, the upstream or
+// Caddy itself, returning empty strings for requests that didn't fail.
+// status is the response status, and err the error returned by the
+// handler chain or that invoked the current error route, if any.
+func failureClass(r *http.Request, status int, err error, header http.Header) (origin, category string) {
+	if err != nil {
+		status = errorStatus(err)
+	}
+	if status < http.StatusBadRequest {
+		return "", ""
+	}
+
+	// Requests shed by protective limits, whichever handler shed them
+	if degradedReason(r, status, err, header) != "" || status == http.StatusTooManyRequests {
+		return originEdge, failureEdgeLimited
+	}
+
+	if err != nil {
+		switch errorTrigger(err) {
+		case triggerClientCanceled:
+			return originClient, failureClientCanceled
+		case triggerTimeout:
+			if proxied(r) {
+				return originUpstream, failureUpstreamTimeout
+			}
+		case triggerUpstreamUnreachable:
+			if proxied(r) {
+				return originUpstream, failureUpstreamUnreachable
+			}
+		}
+	} else if proxied(r) && status >= http.StatusInternalServerError {
+		// Without an error, the response came from the upstream
+		return originUpstream, failureUpstream5xx
+	}
+
+	switch {
+	case status == http.StatusMisdirectedRequest, status == http.StatusRequestHeaderFieldsTooLarge:
+		return originEdge, failureEdgeRejected
+	case status == 499:
+		return originClient, failureClientCanceled
+	case status < http.StatusInternalServerError:
+		return originClient, failureClientError
+	default:
+		return originEdge, failureEdgeError
+	}
+}
+
+// collectFailureMetrics records the origin and category of failed requests
+func (uc *UsageCollector) collectFailureMetrics(um *usageMetrics, r *http.Request, status int, err error, header http.Header) {
+	if err == nil {
+		err, _ = r.Context().Value(caddyhttp.ErrorCtxKey).(error)
+	}
+
+	if origin, category := failureClass(r, status, err, header); origin != "" {
+		um.failures.WithLabelValues(origin, category).Inc()
+	}
+}
@@ -0,0 +1,89 @@
+package caddyusage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestFailureClass tests attribution of failed requests to their origin
+func TestFailureClass(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name             string
+		proxied          bool
+		status           int
+		err              error
+		header           http.Header
+		expectedOrigin   string
+		expectedCategory string
+	}{
+		{"success", false, http.StatusOK, nil, nil, "", ""},
+		{"redirect", false, http.StatusFound, nil, nil, "", ""},
+		{"not found", false, http.StatusNotFound, nil, nil, originClient, failureClientError},
+		{"upstream not found", true, http.StatusNotFound, nil, nil, originClient, failureClientError},
+		{"client canceled", true, 0, caddyhttp.Error(499, context.Canceled), nil, originClient, failureClientCanceled},
+		{"upstream 500", true, http.StatusInternalServerError, nil, nil, originUpstream, failureUpstream5xx},
+		{"upstream timeout", true, 0, caddyhttp.Error(http.StatusGatewayTimeout, timeoutError{}), nil, originUpstream, failureUpstreamTimeout},
+		{"upstream unreachable", true, 0, caddyhttp.Error(http.StatusBadGateway, dialErr), nil, originUpstream, failureUpstreamUnreachable},
+		{"no upstreams", false, 0, caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("no upstreams available")), nil, originEdge, failureEdgeLimited},
+		{"load shed", true, http.StatusServiceUnavailable, nil, http.Header{"Retry-After": {"10"}}, originEdge, failureEdgeLimited},
+		{"rate limited", false, 0, caddyhttp.Error(http.StatusTooManyRequests, errors.New("limit")), nil, originEdge, failureEdgeLimited},
+		{"misdirected", false, http.StatusMisdirectedRequest, nil, nil, originEdge, failureEdgeRejected},
+		{"headers too large", false, http.StatusRequestHeaderFieldsTooLarge, nil, nil, originEdge, failureEdgeRejected},
+		{"handler error", false, 0, errors.New("template failed"), nil, originEdge, failureEdgeError},
+		{"static 500", false, http.StatusInternalServerError, nil, nil, originEdge, failureEdgeError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repl := caddy.NewReplacer()
+			if tt.proxied {
+				repl.Set(upstreamPlaceholder, "10.0.0.2:8080")
+			}
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+			origin, category := failureClass(req, tt.status, tt.err, tt.header)
+			if origin != tt.expectedOrigin || category != tt.expectedCategory {
+				t.Errorf("Expected %s/%s, got %s/%s", tt.expectedOrigin, tt.expectedCategory, origin, category)
+			}
+		})
+	}
+}
+
+// TestFailureMetrics tests that failures are counted through the full
+// handler and from error routes
+func TestFailureMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	})
+	req := httptest.NewRequest("GET", "http://example.com/missing", nil)
+	_ = uc.ServeHTTP(httptest.NewRecorder(), req, next)
+
+	// Inside handle_errors, the original error decides, not the error page
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	handlerErr := caddyhttp.Error(http.StatusInternalServerError, errors.New("boom"))
+	req = req.WithContext(context.WithValue(req.Context(), caddyhttp.ErrorCtxKey, error(handlerErr)))
+	uc.collectFailureMetrics(globalUsageMetrics, req, http.StatusOK, nil, http.Header{})
+
+	if got := testutil.ToFloat64(globalUsageMetrics.failures.WithLabelValues(originClient, failureClientError)); got != 1 {
+		t.Errorf("Expected 1 client error, got %v", got)
+	}
+	if got := testutil.ToFloat64(globalUsageMetrics.failures.WithLabelValues(originEdge, failureEdgeError)); got != 1 {
+		t.Errorf("Expected 1 edge error, got %v", got)
+	}
+}
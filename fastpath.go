@@ -0,0 +1,120 @@
+package caddyusage
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statusCodeStrings are the decimal strings of the status codes below 600,
+// so that labeling a request with its status doesn't allocate
+var statusCodeStrings = func() (codes [600]string) {
+	for code := range codes {
+		codes[code] = strconv.Itoa(code)
+	}
+	return codes
+}()
+
+// statusCodeString returns the decimal string of a status code
+func statusCodeString(code int) string {
+	if code >= 0 && code < len(statusCodeStrings) {
+		return statusCodeStrings[code]
+	}
+	return strconv.Itoa(code)
+}
+
+// requestURL returns u.String() without building a new string for the
+// common server request URL that is just a path needing no escaping
+func requestURL(u *url.URL) string {
+	if u.Scheme == "" && u.Opaque == "" && u.User == nil && u.Host == "" &&
+		u.RawQuery == "" && !u.ForceQuery && u.Fragment == "" && strings.HasPrefix(u.Path, "/") {
+		return u.EscapedPath()
+	}
+	return u.String()
+}
+
+// maxCachedSeries bounds a series cache. Once full, series not cached yet
+// are looked up in their vectors on every request instead.
+const maxCachedSeries = 1 << 14
+
+// basicSeriesKey identifies the series of a request in the requests_total
+// and request_duration_seconds vectors
+type basicSeriesKey struct {
+	statusCode string
+	method     string
+	host       string
+	path       string
+}
+
+// basicSeries are the series of a request in the requests_total and
+// request_duration_seconds vectors, resolved in generation gen of their
+// cache
+type basicSeries struct {
+	gen      uint64
+	total    prometheus.Counter
+	duration prometheus.Observer
+}
+
+// seriesCache keeps the series of the most common label values resolved,
+// sparing each request the label slices and hashing of WithLabelValues.
+// Resetting the vectors drops their series, so resets must invalidate the
+// cache; while delta temporality resets them on every collection, the
+// cache is bypassed, and invalidated once that stops.
+type seriesCache struct {
+	gen atomic.Uint64
+
+	mu     sync.RWMutex
+	series map[basicSeriesKey]*basicSeries
+}
+
+// newSeriesCache creates an empty cache
+func newSeriesCache() *seriesCache {
+	return &seriesCache{series: make(map[basicSeriesKey]*basicSeries)}
+}
+
+// invalidate forgets the resolved series, after their vectors were reset
+func (c *seriesCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen.Add(1)
+	clear(c.series)
+}
+
+// basic returns the requests_total and request_duration_seconds series of
+// a request's label values
+func (c *seriesCache) basic(um *usageMetrics, statusCode, method, host, path string) (prometheus.Counter, prometheus.Observer) {
+	if deltaHandlers.Load() > 0 {
+		return um.requestsTotal.WithLabelValues(statusCode, method, host, path),
+			um.requestDuration.WithLabelValues(method, statusCode, host)
+	}
+
+	key := basicSeriesKey{statusCode: statusCode, method: method, host: host, path: path}
+	gen := c.gen.Load()
+
+	c.mu.RLock()
+	s, ok := c.series[key]
+	c.mu.RUnlock()
+	if ok && s.gen == gen {
+		return s.total, s.duration
+	}
+
+	// Resolve before locking; a reset meanwhile leaves the entry stale,
+	// and the next request resolves it again
+	s = &basicSeries{
+		gen:      gen,
+		total:    um.requestsTotal.WithLabelValues(statusCode, method, host, path),
+		duration: um.requestDuration.WithLabelValues(method, statusCode, host),
+	}
+
+	c.mu.Lock()
+	if _, cached := c.series[key]; cached || len(c.series) < maxCachedSeries {
+		c.series[key] = s
+	}
+	c.mu.Unlock()
+	return s.total, s.duration
+}
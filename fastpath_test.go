@@ -0,0 +1,71 @@
+package caddyusage
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestStatusCodeString tests that status codes are labeled like by
+// strconv, without allocating for those below 600
+func TestStatusCodeString(t *testing.T) {
+	for _, code := range []int{0, 200, 404, 599, 600, 999, -1} {
+		if got := statusCodeString(code); got != strconv.Itoa(code) {
+			t.Errorf("Expected %d, got %q", code, got)
+		}
+	}
+	if allocs := testing.AllocsPerRun(100, func() { _ = statusCodeString(503) }); allocs != 0 {
+		t.Errorf("Expected no allocations, got %g", allocs)
+	}
+}
+
+// TestRequestURL tests that request URLs match url.URL.String
+func TestRequestURL(t *testing.T) {
+	for _, target := range []string{
+		"/api/users",
+		"/files/a%20b.txt",
+		"/caf%C3%A9",
+		"/search?q=caddy",
+		"/path?",
+		"*",
+		"http://example.com/absolute",
+	} {
+		u := httptest.NewRequest("GET", target, nil).URL
+		if got, expected := requestURL(u), u.String(); got != expected {
+			t.Errorf("%s: expected %q, got %q", target, expected, got)
+		}
+	}
+
+	u, _ := url.ParseRequestURI("/api/users")
+	if allocs := testing.AllocsPerRun(100, func() { _ = requestURL(u) }); allocs != 0 {
+		t.Errorf("Expected no allocations, got %g", allocs)
+	}
+}
+
+// TestSeriesCache tests that cached series are reused without allocating,
+// and resolved again once their vectors are reset
+func TestSeriesCache(t *testing.T) {
+	_, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	um := globalUsageMetrics
+
+	total, durations := um.series.basic(um, "200", "GET", "example.com", "/")
+	total.Inc()
+	durations.Observe(0.1)
+	if cached, _ := um.series.basic(um, "200", "GET", "example.com", "/"); cached != total {
+		t.Error("Expected the cached series to be reused")
+	}
+	if allocs := testing.AllocsPerRun(100, func() { um.series.basic(um, "200", "GET", "example.com", "/") }); allocs != 0 {
+		t.Errorf("Expected no allocations for cached series, got %g", allocs)
+	}
+
+	if _, err := resetMetrics("requests_total"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	total, _ = um.series.basic(um, "200", "GET", "example.com", "/")
+	total.Inc()
+	usagetest.AssertValue(t, registry, "requests_total", usagetest.Labels{"status_code": "200", "method": "GET", "host": "example.com", "path": "/"}, 1)
+}
@@ -0,0 +1,219 @@
+package caddyusage
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Sinks faults can be injected into
+const (
+	sinkStatsD       = "statsd"
+	sinkOTLP         = "otlp"
+	sinkPushgateway  = "pushgateway"
+	sinkEventLog     = "event_log"
+	sinkClickHouse   = "clickhouse"
+	sinkTenantReport = "tenant_report"
+)
+
+// faultSinks are the sinks faults can be injected into
+var faultSinks = []string{sinkStatsD, sinkOTLP, sinkPushgateway, sinkEventLog, sinkClickHouse, sinkTenantReport}
+
+// errInjectedFault is the error of writes and collections failed on purpose
+var errInjectedFault = errors.New("injected fault")
+
+// FaultInjectionConfig makes the usage sinks and collections fail on
+// purpose, to check before production that failures are logged, data is
+// dropped rather than queued without bound, and the collection budget
+// holds. It is meant for testing environments.
+type FaultInjectionConfig struct {
+	// Sinks are the sinks writes are dropped and delayed for: statsd,
+	// otlp, pushgateway, event_log, clickhouse and tenant_report.
+	// Defaults to all of them.
+	Sinks []string `json:"sinks,omitempty"`
+
+	// DropRate is the fraction of sink writes that fail, from 0 to 1.
+	DropRate float64 `json:"drop_rate,omitempty"`
+
+	// Latency is added to every sink write. StatsD and event log writes
+	// are made while recording requests, so it also delays collection.
+	Latency caddy.Duration `json:"latency,omitempty"`
+
+	// GatherFailRate is the fraction of collections of the usage metrics
+	// that fail, for the admin metrics endpoint and pushes, from 0 to 1.
+	GatherFailRate float64 `json:"gather_fail_rate,omitempty"`
+}
+
+// validate checks the sinks, rates and latency
+func (fc *FaultInjectionConfig) validate() error {
+	for _, sink := range fc.Sinks {
+		if !slices.Contains(faultSinks, sink) {
+			return fmt.Errorf("unknown fault_injection sink '%s'", sink)
+		}
+	}
+	if fc.DropRate < 0 || fc.DropRate > 1 {
+		return fmt.Errorf("fault_injection drop_rate must be between 0 and 1, got %g", fc.DropRate)
+	}
+	if fc.GatherFailRate < 0 || fc.GatherFailRate > 1 {
+		return fmt.Errorf("fault_injection gather_fail_rate must be between 0 and 1, got %g", fc.GatherFailRate)
+	}
+	if fc.Latency < 0 {
+		return fmt.Errorf("fault_injection latency must not be negative, got %s", time.Duration(fc.Latency))
+	}
+	return nil
+}
+
+// faultInjector holds the faults in effect
+type faultInjector struct {
+	sinks          map[string]bool
+	dropRate       float64
+	latency        time.Duration
+	gatherFailRate float64
+}
+
+var (
+	// currentFaults are the faults in effect, or nil. Like other shared
+	// settings, the most recently provisioned handler's configuration
+	// applies, and faults stop once no handler configures them.
+	currentFaults atomic.Pointer[faultInjector]
+	faultRefs     int
+	faultsMu      sync.Mutex
+)
+
+// acquireFaultInjection puts the configured faults in effect. Each call
+// must be balanced by a call to releaseFaultInjection.
+func acquireFaultInjection(fc *FaultInjectionConfig) {
+	faultsMu.Lock()
+	defer faultsMu.Unlock()
+
+	sinks := fc.Sinks
+	if len(sinks) == 0 {
+		sinks = faultSinks
+	}
+	f := &faultInjector{
+		sinks:          make(map[string]bool, len(sinks)),
+		dropRate:       fc.DropRate,
+		latency:        time.Duration(fc.Latency),
+		gatherFailRate: fc.GatherFailRate,
+	}
+	for _, sink := range sinks {
+		f.sinks[sink] = true
+	}
+
+	faultRefs++
+	currentFaults.Store(f)
+}
+
+// releaseFaultInjection releases a handler's faults, ending them once no
+// handler configures them anymore
+func releaseFaultInjection() {
+	faultsMu.Lock()
+	defer faultsMu.Unlock()
+
+	if faultRefs--; faultRefs > 0 {
+		return
+	}
+	faultRefs = 0
+	currentFaults.Store(nil)
+}
+
+// sinkFault applies the faults in effect to a write to sink: it waits for
+// the injected latency, and returns errInjectedFault if the write is to be
+// dropped.
+func sinkFault(sink string) error {
+	f := currentFaults.Load()
+	if f == nil || !f.sinks[sink] {
+		return nil
+	}
+	if f.latency > 0 {
+		time.Sleep(f.latency)
+	}
+	if f.dropRate > 0 && rand.Float64() < f.dropRate {
+		return errInjectedFault
+	}
+	return nil
+}
+
+// faultyGatherer fails a fraction of its collections
+type faultyGatherer struct {
+	prometheus.Gatherer
+	failRate float64
+}
+
+// Gather implements prometheus.Gatherer
+func (g faultyGatherer) Gather() ([]*dto.MetricFamily, error) {
+	if rand.Float64() < g.failRate {
+		return nil, errInjectedFault
+	}
+	return g.Gatherer.Gather()
+}
+
+// withGatherFaults wraps a gatherer to fail at the rate in effect
+func withGatherFaults(g prometheus.Gatherer) prometheus.Gatherer {
+	if f := currentFaults.Load(); f != nil && f.gatherFailRate > 0 {
+		return faultyGatherer{Gatherer: g, failRate: f.gatherFailRate}
+	}
+	return g
+}
+
+// unmarshalFaultInjectionConfig parses a fault_injection block:
+//
+//	fault_injection {
+//	    sinks <names...>
+//	    drop_rate <fraction>
+//	    latency <duration>
+//	    gather_fail_rate <fraction>
+//	}
+func unmarshalFaultInjectionConfig(d *caddyfile.Dispenser) (*FaultInjectionConfig, error) {
+	fc := new(FaultInjectionConfig)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if option == "sinks" {
+			sinks := d.RemainingArgs()
+			if len(sinks) == 0 {
+				return nil, d.ArgErr()
+			}
+			fc.Sinks = append(fc.Sinks, sinks...)
+			continue
+		}
+
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		value := d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		switch option {
+		case "drop_rate", "gather_fail_rate":
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, d.Errf("invalid fault_injection %s '%s': %v", option, value, err)
+			}
+			if option == "drop_rate" {
+				fc.DropRate = rate
+			} else {
+				fc.GatherFailRate = rate
+			}
+		case "latency":
+			dur, err := caddy.ParseDuration(value)
+			if err != nil {
+				return nil, d.Errf("invalid fault_injection latency '%s': %v", value, err)
+			}
+			fc.Latency = caddy.Duration(dur)
+		default:
+			return nil, d.Errf("unrecognized fault_injection option '%s'", option)
+		}
+	}
+	return fc, nil
+}
@@ -0,0 +1,178 @@
+package caddyusage
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// injectFaults puts faults in effect for the duration of the test
+func injectFaults(t *testing.T, fc *FaultInjectionConfig) {
+	t.Helper()
+
+	acquireFaultInjection(fc)
+	t.Cleanup(releaseFaultInjection)
+}
+
+// TestSinkFault tests dropped and delayed writes, for the selected sinks
+// only
+func TestSinkFault(t *testing.T) {
+	if err := sinkFault(sinkStatsD); err != nil {
+		t.Errorf("Expected no fault without injection, got %v", err)
+	}
+
+	injectFaults(t, &FaultInjectionConfig{Sinks: []string{sinkStatsD}, DropRate: 1, Latency: caddy.Duration(10 * time.Millisecond)})
+
+	start := time.Now()
+	if err := sinkFault(sinkStatsD); !errors.Is(err, errInjectedFault) {
+		t.Errorf("Expected an injected fault, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("Expected the write to be delayed, took %s", elapsed)
+	}
+	if err := sinkFault(sinkOTLP); err != nil {
+		t.Errorf("Expected no fault for other sinks, got %v", err)
+	}
+}
+
+// TestFaultInjectionSinks tests that faults reach the sinks
+func TestFaultInjectionSinks(t *testing.T) {
+	_, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	injectFaults(t, &FaultInjectionConfig{DropRate: 1})
+
+	// Dropped StatsD metrics are never buffered
+	server := listenStatsD(t)
+	client, err := acquireStatsDClient(&StatsDConfig{Address: server.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	client.send("requests", "1", "c")
+	if len(client.buf) != 0 {
+		t.Errorf("Expected the metric to be dropped, got %q", client.buf)
+	}
+	_ = releaseStatsDClient(client)
+
+	// Dropped events are reported as failed writes
+	l, err := acquireEventLog(&EventLogConfig{Path: filepath.Join(t.TempDir(), "usage.jsonl")}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	l.write(&usageEvent{Method: "GET"})
+	l.mu.Lock()
+	if l.size != 0 || !l.writeFails {
+		t.Errorf("Expected the event to be dropped as a failed write, got size %d", l.size)
+	}
+	l.mu.Unlock()
+	_ = releaseEventLog(l)
+
+	// Dropped pushes fail
+	pusher := &pushgatewayPusher{url: "http://127.0.0.1:1", job: "caddy"}
+	if err := pusher.push(); !errors.Is(err, errInjectedFault) {
+		t.Errorf("Expected an injected fault, got %v", err)
+	}
+}
+
+// TestGatherFaults tests that collections of the usage metrics fail, and
+// recover once faults end
+func TestGatherFaults(t *testing.T) {
+	_, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	acquireFaultInjection(&FaultInjectionConfig{GatherFailRate: 1})
+	gatherer, err := usageGatherer()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := gatherer.Gather(); !errors.Is(err, errInjectedFault) {
+		t.Errorf("Expected an injected fault, got %v", err)
+	}
+
+	releaseFaultInjection()
+	if currentFaults.Load() != nil {
+		t.Fatal("Expected faults to end with their last handler")
+	}
+	gatherer, err = usageGatherer()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := gatherer.Gather(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+// TestFaultInjectionValidate tests validation of fault_injection options
+func TestFaultInjectionValidate(t *testing.T) {
+	valid := []FaultInjectionConfig{{}, {Sinks: []string{"otlp", "event_log"}, DropRate: 0.5, GatherFailRate: 1}}
+	for _, fc := range valid {
+		if err := fc.validate(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", fc, err)
+		}
+	}
+
+	invalid := []FaultInjectionConfig{
+		{Sinks: []string{"kafka"}},
+		{DropRate: 1.5},
+		{GatherFailRate: -0.1},
+		{Latency: -1},
+	}
+	for _, fc := range invalid {
+		if err := fc.validate(); err == nil {
+			t.Errorf("%+v: expected an error but got none", fc)
+		}
+	}
+}
+
+// TestUnmarshalFaultInjection tests parsing of the fault_injection option
+func TestUnmarshalFaultInjection(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *FaultInjectionConfig
+		expectErr bool
+	}{
+		{input: "usage {\n fault_injection\n}", expected: &FaultInjectionConfig{}},
+		{
+			input: "usage {\n fault_injection {\n sinks statsd otlp\n drop_rate 0.2\n latency 50ms\n gather_fail_rate 0.1\n }\n}",
+			expected: &FaultInjectionConfig{
+				Sinks:          []string{"statsd", "otlp"},
+				DropRate:       0.2,
+				Latency:        caddy.Duration(50 * time.Millisecond),
+				GatherFailRate: 0.1,
+			},
+		},
+		{input: "usage {\n fault_injection all\n}", expectErr: true},
+		{input: "usage {\n fault_injection {\n sinks\n }\n}", expectErr: true},
+		{input: "usage {\n fault_injection {\n drop_rate half\n }\n}", expectErr: true},
+		{input: "usage {\n fault_injection {\n latency slow\n }\n}", expectErr: true},
+		{input: "usage {\n fault_injection {\n panic_rate 1\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.FaultInjection, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.FaultInjection)
+			}
+		})
+	}
+}
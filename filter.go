@@ -0,0 +1,202 @@
+package caddyusage
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// labelNameRegexp matches a valid Prometheus label name
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*`)
+
+// seriesFilter selects a subset of the exposition at scrape time, like
+// Prometheus' federation endpoint does. With no names or selectors, every
+// series is kept.
+type seriesFilter struct {
+	// names are the metric families to keep, from name[] parameters
+	names map[string]bool
+
+	// selectors are the series selectors to keep series matching any
+	// of, from match[] parameters
+	selectors []seriesSelector
+}
+
+// seriesSelector is a series selector like {host="example.com"}, optionally
+// preceded by a metric name
+type seriesSelector struct {
+	name     string
+	matchers []labelMatcher
+}
+
+// labelMatcher matches a label value with one of the =, !=, =~ and !~
+// operators. A missing label matches like an empty value.
+type labelMatcher struct {
+	label string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+// parseSeriesFilter parses the name[] and match[] query parameters:
+//
+//	?name[]=caddy_usage_requests_total&match[]={host="example.com",status_code=~"5.."}
+func parseSeriesFilter(query url.Values) (*seriesFilter, error) {
+	filter := new(seriesFilter)
+
+	if names := query["name[]"]; len(names) > 0 {
+		filter.names = make(map[string]bool, len(names))
+		for _, name := range names {
+			filter.names[name] = true
+		}
+	}
+
+	for _, match := range query["match[]"] {
+		selector, err := parseSeriesSelector(match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match[] selector '%s': %v", match, err)
+		}
+		filter.selectors = append(filter.selectors, selector)
+	}
+
+	return filter, nil
+}
+
+// parseSeriesSelector parses a selector like name{label="value",...}
+func parseSeriesSelector(s string) (seriesSelector, error) {
+	var selector seriesSelector
+
+	s = strings.TrimSpace(s)
+	name, rest, hasMatchers := strings.Cut(s, "{")
+	selector.name = strings.TrimSpace(name)
+	if !hasMatchers {
+		if selector.name == "" {
+			return selector, fmt.Errorf("empty selector")
+		}
+		return selector, nil
+	}
+
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		if rest == "" {
+			return selector, fmt.Errorf("missing closing brace")
+		}
+		if rest[0] == '}' {
+			if strings.TrimSpace(rest[1:]) != "" {
+				return selector, fmt.Errorf("unexpected text after closing brace")
+			}
+			break
+		}
+
+		var matcher labelMatcher
+		matcher.label = labelNameRegexp.FindString(rest)
+		if matcher.label == "" {
+			return selector, fmt.Errorf("expected a label name at '%s'", rest)
+		}
+		rest = strings.TrimSpace(rest[len(matcher.label):])
+
+		for _, op := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(rest, op) {
+				matcher.op = op
+				break
+			}
+		}
+		if matcher.op == "" {
+			return selector, fmt.Errorf("expected an operator after label '%s'", matcher.label)
+		}
+		rest = strings.TrimSpace(rest[len(matcher.op):])
+
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return selector, fmt.Errorf("expected a quoted value for label '%s'", matcher.label)
+		}
+		rest = rest[len(quoted):]
+		if matcher.value, err = strconv.Unquote(quoted); err != nil {
+			return selector, err
+		}
+
+		if matcher.op == "=~" || matcher.op == "!~" {
+			// Like Prometheus, regular expressions match the whole value
+			if matcher.re, err = regexp.Compile("^(?:" + matcher.value + ")$"); err != nil {
+				return selector, err
+			}
+		}
+
+		selector.matchers = append(selector.matchers, matcher)
+	}
+
+	if selector.name == "" && len(selector.matchers) == 0 {
+		return selector, fmt.Errorf("empty selector")
+	}
+	return selector, nil
+}
+
+// matches reports whether a label value satisfies the matcher
+func (m labelMatcher) matches(value string) bool {
+	switch m.op {
+	case "=":
+		return value == m.value
+	case "!=":
+		return value != m.value
+	case "=~":
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+// matches reports whether a series of the named family matches the selector
+func (s seriesSelector) matches(family string, metric *dto.Metric) bool {
+	if s.name != "" && s.name != family {
+		return false
+	}
+	for _, matcher := range s.matchers {
+		var value string
+		for _, pair := range metric.GetLabel() {
+			if pair.GetName() == matcher.label {
+				value = pair.GetValue()
+				break
+			}
+		}
+		if !matcher.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the families and series kept by the filter, dropping
+// families left without series
+func (f *seriesFilter) apply(families []*dto.MetricFamily) []*dto.MetricFamily {
+	if f.names == nil && len(f.selectors) == 0 {
+		return families
+	}
+
+	kept := families[:0]
+	for _, family := range families {
+		if f.names != nil && !f.names[family.GetName()] {
+			continue
+		}
+
+		if len(f.selectors) > 0 {
+			metrics := family.Metric[:0]
+			for _, metric := range family.GetMetric() {
+				for _, selector := range f.selectors {
+					if selector.matches(family.GetName(), metric) {
+						metrics = append(metrics, metric)
+						break
+					}
+				}
+			}
+			family.Metric = metrics
+		}
+
+		if len(family.GetMetric()) > 0 {
+			kept = append(kept, family)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,115 @@
+package caddyusage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestParseSeriesSelector tests parsing of match[] selectors
+func TestParseSeriesSelector(t *testing.T) {
+	tests := []struct {
+		input     string
+		name      string
+		matchers  int
+		expectErr bool
+	}{
+		{input: "caddy_usage_requests_total", name: "caddy_usage_requests_total"},
+		{input: `{host="example.com"}`, matchers: 1},
+		{input: `caddy_usage_requests_total{host="example.com", status_code=~"5.."}`, name: "caddy_usage_requests_total", matchers: 2},
+		{input: `{path!~"/health|/ready",method!="OPTIONS",}`, matchers: 2},
+		{input: `{path="/a}b"}`, matchers: 1},
+		{input: "", expectErr: true},
+		{input: "{}", expectErr: true},
+		{input: `{host="example.com"`, expectErr: true},
+		{input: `{host=example.com}`, expectErr: true},
+		{input: `{host~"x"}`, expectErr: true},
+		{input: `{path=~"("}`, expectErr: true},
+		{input: `{host="a"} extra`, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			selector, err := parseSeriesSelector(tt.input)
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if selector.name != tt.name || len(selector.matchers) != tt.matchers {
+				t.Errorf("Expected name %q with %d matchers, got %+v", tt.name, tt.matchers, selector)
+			}
+		})
+	}
+}
+
+// TestHandleMetricsFilter tests scrape-time filtering on the metrics endpoint
+func TestHandleMetricsFilter(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	collectTestRequests(t, uc)
+
+	tests := []struct {
+		name        string
+		query       url.Values
+		contains    []string
+		notContains []string
+	}{
+		{
+			name:        "by name",
+			query:       url.Values{"name[]": {"caddy_usage_requests_total"}},
+			contains:    []string{"caddy_usage_requests_total{"},
+			notContains: []string{"caddy_usage_request_duration_seconds", "caddy_usage_active_paths"},
+		},
+		{
+			name:        "by label",
+			query:       url.Values{"match[]": {`{status_code="404"}`}},
+			contains:    []string{`status_code="404"`},
+			notContains: []string{`status_code="200"`, "caddy_usage_active_paths"},
+		},
+		{
+			name:        "by regexp with any of several selectors",
+			query:       url.Values{"match[]": {`caddy_usage_requests_total{method=~"POST|DELETE"}`, "caddy_usage_active_hosts"}},
+			contains:    []string{`method="POST"`, `method="DELETE"`, "caddy_usage_active_hosts"},
+			notContains: []string{`method="GET"`, "caddy_usage_active_paths"},
+		},
+		{
+			name:        "name and selector",
+			query:       url.Values{"name[]": {"caddy_usage_requests_total"}, "match[]": {`{method!="GET"}`}},
+			contains:    []string{`caddy_usage_requests_total{host="example.com",method="POST"`},
+			notContains: []string{`method="GET"`, "caddy_usage_requests_by_url_total"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/usage/metrics?"+tt.query.Encode(), nil)
+			w, err := serveAdmin(t, "/usage/metrics", req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			body := w.Body.String()
+			for _, s := range tt.contains {
+				if !strings.Contains(body, s) {
+					t.Errorf("Expected body to contain %q, got:\n%s", s, body)
+				}
+			}
+			for _, s := range tt.notContains {
+				if strings.Contains(body, s) {
+					t.Errorf("Expected body not to contain %q, got:\n%s", s, body)
+				}
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/usage/metrics?"+url.Values{"match[]": {"{host"}}.Encode(), nil)
+	if _, err := serveAdmin(t, "/usage/metrics", req); apiErrorStatus(err) != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid selector, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package caddyusage
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// governorWindow is the number of collections whose latency is
+	// evaluated against the budget at a time
+	governorWindow = 1000
+
+	// maxShedFactor bounds how sparsely expensive dimensions are sampled
+	maxShedFactor = 64
+)
+
+// collectionGovernor keeps metric collection within a latency budget. It
+// measures how long collection takes and, when the 99th percentile of a
+// window exceeds the budget, halves the fraction of requests recorded by
+// the expensive, high-cardinality dimensions: requests_by_ip,
+// requests_by_url and requests_by_headers. Sampled requests are recorded
+// with a weight of the sampling factor, so that their totals stay
+// approximately right. Once latency falls well under the budget, the
+// sampling is relaxed again.
+type collectionGovernor struct {
+	budget time.Duration
+	logger *zap.Logger
+
+	// factor is the current sampling factor: one in factor requests is
+	// recorded by expensive dimensions
+	factor atomic.Int64
+	count  atomic.Uint64
+
+	mu      sync.Mutex
+	samples []time.Duration
+}
+
+// newCollectionGovernor returns a governor enforcing budget
+func newCollectionGovernor(budget time.Duration, logger *zap.Logger) *collectionGovernor {
+	g := &collectionGovernor{
+		budget:  budget,
+		logger:  logger,
+		samples: make([]time.Duration, 0, governorWindow),
+	}
+	g.factor.Store(1)
+	return g
+}
+
+// weight returns the weight with which the current request should be
+// recorded by expensive dimensions, or 0 if it should be skipped. A nil
+// governor records every request.
+func (g *collectionGovernor) weight() float64 {
+	if g == nil {
+		return 1
+	}
+
+	factor := g.factor.Load()
+	if factor <= 1 {
+		return 1
+	}
+	if g.count.Add(1)%uint64(factor) != 0 {
+		return 0
+	}
+	return float64(factor)
+}
+
+// observe records how long a collection took, adjusting the sampling
+// factor at the end of every window
+func (g *collectionGovernor) observe(um *usageMetrics, took time.Duration) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	g.samples = append(g.samples, took)
+	if len(g.samples) < governorWindow {
+		g.mu.Unlock()
+		return
+	}
+	slices.Sort(g.samples)
+	p99 := g.samples[len(g.samples)*99/100]
+	g.samples = g.samples[:0]
+	g.mu.Unlock()
+
+	factor := g.factor.Load()
+	next := factor
+	switch {
+	case p99 > g.budget:
+		um.overBudget.WithLabelValues().Inc()
+		next = min(factor*2, maxShedFactor)
+	case p99 < g.budget/2:
+		next = max(factor/2, 1)
+	}
+	if next == factor {
+		return
+	}
+
+	g.factor.Store(next)
+	if next > factor {
+		g.logger.Warn("metric collection over budget, sampling expensive dimensions",
+			zap.Duration("p99", p99),
+			zap.Duration("budget", g.budget),
+			zap.Int64("sample_one_in", next))
+	} else {
+		g.logger.Info("metric collection back under budget, relaxing sampling",
+			zap.Duration("p99", p99),
+			zap.Duration("budget", g.budget),
+			zap.Int64("sample_one_in", next))
+	}
+}
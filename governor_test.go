@@ -0,0 +1,136 @@
+package caddyusage
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// observeWindow feeds the governor a full window of collections, two in
+// a hundred of which take slow and the rest fast
+func observeWindow(g *collectionGovernor, fast, slow time.Duration) {
+	for i := range governorWindow {
+		took := fast
+		if i%100 < 2 {
+			took = slow
+		}
+		g.observe(globalUsageMetrics, took)
+	}
+}
+
+// TestCollectionGovernor tests that sampling tightens while collection is
+// over budget and relaxes once it recovers
+func TestCollectionGovernor(t *testing.T) {
+	_, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	budget := 200 * time.Microsecond
+	g := newCollectionGovernor(budget, zap.NewNop())
+
+	steps := []struct {
+		name       string
+		fast, slow time.Duration
+		expected   int64
+	}{
+		{"within budget", 50 * time.Microsecond, 150 * time.Microsecond, 1},
+		{"p99 over budget", 50 * time.Microsecond, time.Millisecond, 2},
+		{"still over budget", 50 * time.Microsecond, time.Millisecond, 4},
+		{"under budget but not well under", 50 * time.Microsecond, 150 * time.Microsecond, 4},
+		{"well under budget", 10 * time.Microsecond, 50 * time.Microsecond, 2},
+		{"recovered", 10 * time.Microsecond, 50 * time.Microsecond, 1},
+	}
+
+	for _, step := range steps {
+		observeWindow(g, step.fast, step.slow)
+		if got := g.factor.Load(); got != step.expected {
+			t.Fatalf("%s: expected factor %d, got %d", step.name, step.expected, got)
+		}
+	}
+
+	if got := testutil.ToFloat64(globalUsageMetrics.overBudget.WithLabelValues()); got != 2 {
+		t.Errorf("Expected 2 windows over budget, got %v", got)
+	}
+
+	// The factor is bounded
+	for range 10 {
+		observeWindow(g, time.Millisecond, time.Millisecond)
+	}
+	if got := g.factor.Load(); got != maxShedFactor {
+		t.Errorf("Expected factor %d, got %d", maxShedFactor, got)
+	}
+}
+
+// TestCollectionGovernorWeights tests that sampled expensive dimensions
+// are weighted to keep their totals
+func TestCollectionGovernorWeights(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.governor = newCollectionGovernor(time.Millisecond, zap.NewNop())
+	uc.governor.factor.Store(4)
+
+	for range 8 {
+		req := httptest.NewRequest("GET", "http://example.com/page", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("User-Agent", "test-agent")
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(200)
+		uc.collectMetrics(rec, req, time.Now(), nil)
+	}
+
+	tests := []struct {
+		name     string
+		got      float64
+		expected float64
+	}{
+		{"requests", testutil.ToFloat64(globalUsageMetrics.requestsTotal.WithLabelValues("200", "GET", "example.com", "/page")), 8},
+		{"by ip", testutil.ToFloat64(globalUsageMetrics.requestsByIP.WithLabelValues("10.0.0.1", "200", "GET")), 8},
+		{"by url", testutil.ToFloat64(globalUsageMetrics.requestsByURL.WithLabelValues("http://example.com/page", "GET", "200")), 8},
+		{"by header", testutil.ToFloat64(globalUsageMetrics.requestsByHeaders.WithLabelValues("User-Agent", "test-agent", "GET", "200")), 8},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, tt.got)
+		}
+	}
+}
+
+// TestUnmarshalCollectionBudget tests parsing of the collection_budget option
+func TestUnmarshalCollectionBudget(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  caddy.Duration
+		expectErr bool
+	}{
+		{input: "usage {\n collection_budget 200us\n}", expected: caddy.Duration(200 * time.Microsecond)},
+		{input: "usage {\n collection_budget\n}", expectErr: true},
+		{input: "usage {\n collection_budget fast\n}", expectErr: true},
+		{input: "usage {\n collection_budget 200us 1ms\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if uc.CollectionBudget != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, uc.CollectionBudget)
+			}
+		})
+	}
+}
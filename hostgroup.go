@@ -0,0 +1,84 @@
+package caddyusage
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// HostGroup maps the hosts matching a pattern to a group name, recorded in
+// the host label in place of the host itself. Grouping keeps the label's
+// cardinality bounded when a site serves many subdomains, such as one per
+// customer.
+type HostGroup struct {
+	// Match is a case-insensitive glob like *.customer1.com, or a regular
+	// expression when starting with ^. The port is ignored.
+	Match string `json:"match"`
+
+	// Group is the value recorded for matching hosts.
+	Group string `json:"group"`
+}
+
+// compiledHostGroup is a HostGroup with its pattern compiled
+type compiledHostGroup struct {
+	re    *regexp.Regexp
+	group string
+}
+
+// compileHostGroups validates and compiles host groups
+func compileHostGroups(groups []HostGroup) ([]compiledHostGroup, error) {
+	compiled := make([]compiledHostGroup, 0, len(groups))
+	for i, group := range groups {
+		if group.Match == "" || group.Group == "" {
+			return nil, fmt.Errorf("host group %d: match and group are required", i)
+		}
+		res, err := compilePatterns([]string{group.Match}, true)
+		if err != nil {
+			return nil, fmt.Errorf("host group %d: %v", i, err)
+		}
+		compiled = append(compiled, compiledHostGroup{re: res[0], group: group.Group})
+	}
+	return compiled, nil
+}
+
+// groupHost returns the group of the first host group matching host. Hosts
+// matching no group are collapsed to their registrable domain when
+// CollapseHosts is enabled, or returned as-is.
+func (uc *UsageCollector) groupHost(host string) string {
+	if len(uc.hostGroups) == 0 && !uc.CollapseHosts {
+		return host
+	}
+
+	bare := hostWithoutPort(host)
+	for _, group := range uc.hostGroups {
+		if group.re.MatchString(bare) {
+			return group.group
+		}
+	}
+
+	if uc.CollapseHosts {
+		return registrableDomain(normalizeHostname(bare))
+	}
+	return host
+}
+
+// hostLabel returns the host label value of a host, grouped and then
+// filtered through the label policy
+func (uc *UsageCollector) hostLabel(um *usageMetrics, host string) string {
+	return uc.policy.apply(um, "host", uc.groupHost(host))
+}
+
+// unmarshalHostGroup parses a host_group directive:
+//
+//	host_group <pattern> <group>
+func unmarshalHostGroup(d *caddyfile.Dispenser) (HostGroup, error) {
+	var group HostGroup
+	if !d.Args(&group.Match, &group.Group) {
+		return group, d.ArgErr()
+	}
+	if d.NextArg() {
+		return group, d.ArgErr()
+	}
+	return group, nil
+}
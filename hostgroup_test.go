@@ -0,0 +1,133 @@
+package caddyusage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestHostGroups tests that hosts are recorded as their group
+func TestHostGroups(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.HostGroups = []HostGroup{
+		{Match: "*.customer1.com", Group: "customer1"},
+		{Match: `^(www\.)?customer2\.(com|net)$`, Group: "customer2"},
+		{Match: "*.com", Group: "other-com"},
+	}
+	if err := uc.Provision(uc.ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"app.customer1.com", "customer1"},
+		{"API.Customer1.com:8443", "customer1"},
+		{"customer2.net", "customer2"},
+		{"www.customer2.com", "customer2"},
+		{"customer1.com", "other-com"},
+		{"example.org", "example.org"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := uc.hostLabel(nil, tt.host); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	// Collected metrics carry the group
+	collectTestRequests(t, uc)
+	if n := testutil.CollectAndCount(globalUsageMetrics.requestsTotal); n == 0 {
+		t.Fatal("Expected requests to be recorded")
+	}
+	if got := testutil.ToFloat64(globalUsageMetrics.requestsTotal.WithLabelValues("200", "GET", "other-com", "/api/users")); got != 2 {
+		t.Errorf("Expected 2 requests recorded for group other-com, got %v", got)
+	}
+}
+
+// TestHostGroupsInvalid tests that invalid host groups fail provisioning
+func TestHostGroupsInvalid(t *testing.T) {
+	for _, groups := range [][]HostGroup{
+		{{Match: "*.example.com"}},
+		{{Group: "example"}},
+		{{Match: "^(", Group: "example"}},
+	} {
+		uc, _, cleanup := setupTestMetrics(t)
+		uc.HostGroups = groups
+		if err := uc.Provision(uc.ctx); err == nil {
+			t.Errorf("Expected an error for %+v", groups)
+		}
+		cleanup()
+	}
+}
+
+// TestUnmarshalHostGroup tests parsing of the host_group and collapse_hosts options
+func TestUnmarshalHostGroup(t *testing.T) {
+	var uc UsageCollector
+	input := "usage {\n host_group *.customer1.com customer1\n host_group *.customer2.com customer2\n collapse_hosts\n}"
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []HostGroup{
+		{Match: "*.customer1.com", Group: "customer1"},
+		{Match: "*.customer2.com", Group: "customer2"},
+	}
+	if !reflect.DeepEqual(uc.HostGroups, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, uc.HostGroups)
+	}
+	if !uc.CollapseHosts {
+		t.Error("Expected collapse_hosts to be enabled")
+	}
+
+	for _, invalid := range []string{
+		"usage {\n host_group\n}",
+		"usage {\n host_group *.customer1.com\n}",
+		"usage {\n host_group *.customer1.com customer1 extra\n}",
+		"usage {\n collapse_hosts yes\n}",
+	} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+// TestCollapseHosts tests collapsing hosts to their registrable domain
+func TestCollapseHosts(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.CollapseHosts = true
+	uc.HostGroups = []HostGroup{{Match: "*.internal.example.com", Group: "internal"}}
+	if err := uc.Provision(uc.ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"tenant42.example.com", "example.com"},
+		{"API.Example.co.uk:443", "example.co.uk"},
+		{"example.com.", "example.com"},
+		{"db.internal.example.com", "internal"},
+		{"192.0.2.1:8080", ipDomain},
+		{"[2001:db8::1]:443", ipDomain},
+		{"localhost", "localhost"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := uc.hostLabel(nil, tt.host); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package caddyusage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
+)
+
+func init() {
+	caddy.RegisterModule(JSONFieldInspector{})
+}
+
+// defaultInspectMaxBody caps how much of a request body is retained for
+// body inspectors
+const defaultInspectMaxBody = 64 << 10
+
+// BodyInspector is implemented by modules in the usage.inspectors namespace.
+// An inspector derives a single label value from a request body, such as a
+// GraphQL operation name. The body is a prefix of at most the configured
+// number of bytes; complete reports whether it holds the entire body.
+// Returning an empty string records nothing for the request.
+type BodyInspector interface {
+	Inspect(r *http.Request, body []byte, complete bool) string
+}
+
+// InspectConfig configures body inspection. Rather than reading bodies
+// ahead of the handler chain, the body is copied as downstream handlers
+// consume it, up to MaxBody bytes, and inspected once the request is done.
+// Inspection therefore never delays or buffers streaming request bodies,
+// and bodies that downstream handlers never read are not inspected.
+type InspectConfig struct {
+	// MaxBody is the maximum number of request body bytes retained for
+	// the inspectors. Defaults to 64KiB.
+	MaxBody int64 `json:"max_body,omitempty"`
+
+	// SampleRate is the fraction of requests with a body that are
+	// inspected, between 0 and 1. Defaults to 1, inspecting every request.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// SampledHeader is a response header set to 1 on sampled requests,
+	// unless the handler sets its own. With inspectors configured, only
+	// requests whose body is inspected are sampled.
+	SampledHeader string `json:"sampled_header,omitempty"`
+
+	// InspectorsRaw are the body inspector modules to run.
+	InspectorsRaw []json.RawMessage `json:"inspectors,omitempty" caddy:"namespace=usage.inspectors inline_key=inspector"`
+
+	inspectors []namedInspector
+}
+
+// namedInspector is a loaded inspector and the name it is recorded under
+type namedInspector struct {
+	name string
+	BodyInspector
+}
+
+// provision loads the configured inspector modules
+func (ic *InspectConfig) provision(ctx caddy.Context) error {
+	if len(ic.InspectorsRaw) == 0 {
+		return nil
+	}
+
+	mods, err := ctx.LoadModule(ic, "InspectorsRaw")
+	if err != nil {
+		return fmt.Errorf("loading body inspectors: %v", err)
+	}
+
+	for _, mod := range mods.([]any) {
+		ic.inspectors = append(ic.inspectors, namedInspector{
+			name:          mod.(caddy.Module).CaddyModule().ID.Name(),
+			BodyInspector: mod.(BodyInspector),
+		})
+	}
+	return nil
+}
+
+// validate checks the inspection limits
+func (ic *InspectConfig) validate() error {
+	if ic.MaxBody < 0 {
+		return fmt.Errorf("inspect max_body must not be negative, got %d", ic.MaxBody)
+	}
+	if ic.SampleRate < 0 || ic.SampleRate > 1 {
+		return fmt.Errorf("inspect sample_rate must be between 0 and 1, got %g", ic.SampleRate)
+	}
+	return nil
+}
+
+// teeBody starts capturing the body of a sampled request, returning nil
+// when the request is not to be inspected
+func (ic *InspectConfig) teeBody(r *http.Request) *bodyTee {
+	if len(ic.inspectors) == 0 || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	if ic.SampleRate > 0 && ic.SampleRate < 1 && rand.Float64() >= ic.SampleRate {
+		return nil
+	}
+
+	maxBody := ic.MaxBody
+	if maxBody == 0 {
+		maxBody = defaultInspectMaxBody
+	}
+
+	tee := &bodyTee{ReadCloser: r.Body, limit: maxBody}
+	r.Body = tee
+	return tee
+}
+
+// bodyTee retains up to limit bytes of a request body as it is read by
+// downstream handlers
+type bodyTee struct {
+	io.ReadCloser
+
+	limit    int64
+	buf      bytes.Buffer
+	eof      bool
+	overflow bool
+}
+
+// Read implements io.Reader
+func (t *bodyTee) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+
+	if room := t.limit - int64(t.buf.Len()); int64(n) > room {
+		t.overflow = true
+		t.buf.Write(p[:room])
+	} else {
+		t.buf.Write(p[:n])
+	}
+
+	if err == io.EOF {
+		t.eof = true
+	}
+	return n, err
+}
+
+// captured returns the retained body prefix and whether it is the whole body
+func (t *bodyTee) captured() ([]byte, bool) {
+	return t.buf.Bytes(), t.eof && !t.overflow
+}
+
+// collectInspectMetrics runs the inspectors over the captured body
+func (uc *UsageCollector) collectInspectMetrics(um *usageMetrics, r *http.Request, tee *bodyTee, statusCode string) {
+	body, complete := tee.captured()
+	if len(body) == 0 {
+		return
+	}
+
+	for _, inspector := range uc.Inspect.inspectors {
+		value := inspector.Inspect(r, body, complete)
+		if value == "" {
+			continue
+		}
+		value = uc.policy.apply(um, "inspected_value", value)
+		um.inspectedRequests.WithLabelValues(inspector.name, value, statusCode).Inc()
+	}
+}
+
+// unmarshalInspectConfig parses an inspect block:
+//
+//	inspect {
+//	    max_body <size>
+//	    sample_rate <fraction>
+//	    sampled_header [<name>]
+//	    <inspector> [<args...>]
+//	}
+func unmarshalInspectConfig(d *caddyfile.Dispenser) (*InspectConfig, error) {
+	cfg := new(InspectConfig)
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "max_body":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil || size == 0 {
+				return nil, d.Errf("invalid max_body '%s'", d.Val())
+			}
+			cfg.MaxBody = int64(size)
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+
+		case "sample_rate":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, d.Errf("invalid sample_rate '%s'", d.Val())
+			}
+			cfg.SampleRate = rate
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+
+		case "sampled_header":
+			cfg.SampledHeader = defaultSampledHeader
+			if d.NextArg() {
+				cfg.SampledHeader = d.Val()
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+
+		default:
+			// Anything else names an inspector module
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "usage.inspectors."+name)
+			if err != nil {
+				return nil, err
+			}
+			cfg.InspectorsRaw = append(cfg.InspectorsRaw, caddyconfig.JSONModuleObject(unm, "inspector", name, nil))
+		}
+	}
+
+	return cfg, nil
+}
+
+// JSONFieldInspector records the value of a field of JSON request bodies,
+// such as the operationName of GraphQL requests or the model requested
+// from an LLM API. Bodies that are truncated, not JSON, or lack the field
+// are not recorded.
+type JSONFieldInspector struct {
+	// Field is the dot-separated path of the field, like operationName
+	// or params.0.to. Array elements are addressed by index.
+	Field string `json:"field"`
+}
+
+// CaddyModule returns the Caddy module information
+func (JSONFieldInspector) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "usage.inspectors.json_field",
+		New: func() caddy.Module { return new(JSONFieldInspector) },
+	}
+}
+
+// Inspect implements BodyInspector
+func (ji JSONFieldInspector) Inspect(_ *http.Request, body []byte, complete bool) string {
+	if !complete {
+		return ""
+	}
+
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		return ""
+	}
+
+	for _, key := range strings.Split(ji.Field, ".") {
+		switch v := value.(type) {
+		case map[string]any:
+			value = v[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return ""
+			}
+			value = v[i]
+		default:
+			return ""
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return ""
+	}
+}
+
+// Validate implements caddy.Validator
+func (ji JSONFieldInspector) Validate() error {
+	if ji.Field == "" {
+		return fmt.Errorf("json_field inspector requires a field")
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	json_field <field>
+func (ji *JSONFieldInspector) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume inspector name
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	ji.Field = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ BodyInspector         = (*JSONFieldInspector)(nil)
+	_ caddy.Validator       = (*JSONFieldInspector)(nil)
+	_ caddyfile.Unmarshaler = (*JSONFieldInspector)(nil)
+)
@@ -0,0 +1,219 @@
+package caddyusage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestJSONFieldInspector tests field lookups in JSON bodies
+func TestJSONFieldInspector(t *testing.T) {
+	tests := []struct {
+		name     string
+		field    string
+		body     string
+		complete bool
+		expected string
+	}{
+		{"graphql operation", "operationName", `{"query":"query Me { me { id } }","operationName":"Me"}`, true, "Me"},
+		{"nested field", "params.0.to", `{"method":"eth_call","params":[{"to":"0xabc"}]}`, true, "0xabc"},
+		{"number", "version", `{"version":2}`, true, "2"},
+		{"boolean", "stream", `{"stream":true}`, true, "true"},
+		{"missing field", "operationName", `{"query":"{ me }"}`, true, ""},
+		{"object value", "params", `{"params":{"a":1}}`, true, ""},
+		{"index out of range", "params.3", `{"params":[1]}`, true, ""},
+		{"not json", "operationName", `operationName=Me`, true, ""},
+		{"truncated body", "operationName", `{"operationName":"Me"}`, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ji := JSONFieldInspector{Field: tt.field}
+			if got := ji.Inspect(nil, []byte(tt.body), tt.complete); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestBodyTee tests that the body is passed through unchanged while a
+// capped prefix is retained
+func TestBodyTee(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int64
+		body     string
+		captured string
+		complete bool
+	}{
+		{"within limit", 64, "hello world", "hello world", true},
+		{"exact limit", 5, "hello", "hello", true},
+		{"over limit", 5, "hello world", "hello", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tee := &bodyTee{ReadCloser: io.NopCloser(strings.NewReader(tt.body)), limit: tt.limit}
+
+			read, err := io.ReadAll(tee)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(read) != tt.body {
+				t.Errorf("Expected body %q to be passed through, got %q", tt.body, read)
+			}
+
+			captured, complete := tee.captured()
+			if string(captured) != tt.captured || complete != tt.complete {
+				t.Errorf("Expected (%q, %v), got (%q, %v)", tt.captured, tt.complete, captured, complete)
+			}
+		})
+	}
+}
+
+// TestBodyTeeUnread tests that an unread body is reported as incomplete
+func TestBodyTeeUnread(t *testing.T) {
+	tee := &bodyTee{ReadCloser: io.NopCloser(strings.NewReader("{}")), limit: 64}
+	if captured, complete := tee.captured(); len(captured) != 0 || complete {
+		t.Errorf("Expected nothing captured, got (%q, %v)", captured, complete)
+	}
+}
+
+// TestInspectMetrics tests inspector modules through the full handler
+func TestInspectMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	uc.Inspect = &InspectConfig{
+		InspectorsRaw: []json.RawMessage{json.RawMessage(`{"inspector":"json_field","field":"operationName"}`)},
+	}
+	if err := uc.Inspect.provision(ctx); err != nil {
+		t.Fatalf("Failed to provision inspectors: %v", err)
+	}
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	body := `{"query":"query GetUser { user { id } }","operationName":"GetUser"}`
+	req := httptest.NewRequest("POST", "http://api.example.com/graphql", strings.NewReader(body))
+	if err := uc.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	if got := testutil.ToFloat64(globalUsageMetrics.inspectedRequests.WithLabelValues("json_field", "GetUser", "200")); got != 1 {
+		t.Errorf("Expected 1 GetUser request, got %v", got)
+	}
+
+	// A handler that never reads the body leaves nothing to inspect
+	ignore := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	req = httptest.NewRequest("POST", "http://api.example.com/graphql", strings.NewReader(body))
+	if err := uc.ServeHTTP(httptest.NewRecorder(), req, ignore); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	if n := testutil.CollectAndCount(globalUsageMetrics.inspectedRequests); n != 1 {
+		t.Errorf("Expected 1 inspected series, got %d", n)
+	}
+}
+
+// TestSampledPropagation tests that sampled requests are flagged in the
+// request variables and the configured response header
+func TestSampledPropagation(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	uc.Inspect = &InspectConfig{
+		SampledHeader: defaultSampledHeader,
+		InspectorsRaw: []json.RawMessage{json.RawMessage(`{"inspector":"json_field","field":"operationName"}`)},
+	}
+	if err := uc.Inspect.provision(ctx); err != nil {
+		t.Fatalf("Failed to provision inspectors: %v", err)
+	}
+
+	for _, tt := range []struct {
+		body    io.Reader
+		sampled bool
+	}{
+		{strings.NewReader(`{"operationName":"GetUser"}`), true},
+		{nil, false}, // requests without a body are never sampled
+	} {
+		var sampledDownstream bool
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			sampledDownstream = Sampled(r)
+			w.WriteHeader(http.StatusOK)
+			return nil
+		})
+
+		req := httptest.NewRequest("POST", "http://api.example.com/graphql", tt.body)
+		req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+		w := httptest.NewRecorder()
+		if err := uc.ServeHTTP(w, req, next); err != nil {
+			t.Fatalf("ServeHTTP failed: %v", err)
+		}
+
+		if sampledDownstream != tt.sampled {
+			t.Errorf("Expected downstream sampled=%v, got %v", tt.sampled, sampledDownstream)
+		}
+		if got := w.Header().Get(defaultSampledHeader) == "1"; got != tt.sampled {
+			t.Errorf("Expected %s header=%v, got %v", defaultSampledHeader, tt.sampled, got)
+		}
+	}
+}
+
+// TestUnmarshalInspect tests parsing of the inspect block
+func TestUnmarshalInspect(t *testing.T) {
+	var uc UsageCollector
+	input := "usage {\n inspect {\n max_body 16KiB\n sample_rate 0.25\n sampled_header\n json_field operationName\n }\n}"
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if uc.Inspect == nil || uc.Inspect.MaxBody != 16<<10 || uc.Inspect.SampleRate != 0.25 || uc.Inspect.SampledHeader != defaultSampledHeader {
+		t.Fatalf("Unexpected inspect config: %+v", uc.Inspect)
+	}
+	if len(uc.Inspect.InspectorsRaw) != 1 {
+		t.Fatalf("Expected 1 inspector, got %d", len(uc.Inspect.InspectorsRaw))
+	}
+
+	var inspector map[string]string
+	if err := json.Unmarshal(uc.Inspect.InspectorsRaw[0], &inspector); err != nil {
+		t.Fatalf("Invalid inspector JSON: %v", err)
+	}
+	if inspector["inspector"] != "json_field" || inspector["field"] != "operationName" {
+		t.Errorf("Unexpected inspector JSON: %s", uc.Inspect.InspectorsRaw[0])
+	}
+
+	for _, invalid := range []string{
+		"usage {\n inspect extra\n}",
+		"usage {\n inspect {\n max_body 0\n }\n}",
+		"usage {\n inspect {\n sample_rate 1.5\n }\n}",
+		"usage {\n inspect {\n sampled_header X-A X-B\n }\n}",
+		"usage {\n inspect {\n json_field\n }\n}",
+		"usage {\n inspect {\n no_such_inspector\n }\n}",
+	} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package caddyusage
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
+)
+
+// defaultJSONRPCMaxBody caps how much of a request body is read to find the
+// JSON-RPC method names
+const defaultJSONRPCMaxBody = 64 << 10
+
+// unknownRPCMethod labels requests whose method could not be determined,
+// because the body was too large or not valid JSON-RPC
+const unknownRPCMethod = "unknown"
+
+// JSONRPCConfig enables per-method metrics for JSON-RPC endpoints such as
+// blockchain nodes. Method names are read from a size-capped prefix of the
+// request body, which is then passed downstream unchanged.
+type JSONRPCConfig struct {
+	// MaxBody is the maximum number of request body bytes read to extract
+	// method names. Larger requests are recorded as "unknown".
+	// Defaults to 64KiB.
+	MaxBody int64 `json:"max_body,omitempty"`
+}
+
+// jsonrpcMessage is the part of a JSON-RPC request needed for metrics
+type jsonrpcMessage struct {
+	Method string `json:"method"`
+}
+
+// peekJSONRPCMethods returns the method of each call in a JSON-RPC request,
+// supporting both single calls and batches
+func (uc *UsageCollector) peekJSONRPCMethods(r *http.Request) []string {
+	if r.Method != http.MethodPost {
+		return nil
+	}
+
+	maxBody := uc.JSONRPC.MaxBody
+	if maxBody == 0 {
+		maxBody = defaultJSONRPCMaxBody
+	}
+
+	body, complete, err := peekRequestBody(r, maxBody)
+	if err != nil || !complete {
+		return []string{unknownRPCMethod}
+	}
+
+	return parseJSONRPCMethods(body)
+}
+
+// parseJSONRPCMethods extracts method names from a JSON-RPC request body
+func parseJSONRPCMethods(body []byte) []string {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil
+	}
+
+	var calls []jsonrpcMessage
+	if body[0] == '[' {
+		if err := json.Unmarshal(body, &calls); err != nil {
+			return []string{unknownRPCMethod}
+		}
+	} else {
+		var call jsonrpcMessage
+		if err := json.Unmarshal(body, &call); err != nil {
+			return []string{unknownRPCMethod}
+		}
+		calls = []jsonrpcMessage{call}
+	}
+
+	methods := make([]string, 0, len(calls))
+	for _, call := range calls {
+		if call.Method == "" {
+			call.Method = unknownRPCMethod
+		}
+		methods = append(methods, call.Method)
+	}
+	return methods
+}
+
+// collectJSONRPCMetrics records each call of a JSON-RPC request. Every call
+// in a batch is attributed the latency of the whole HTTP request.
+func (uc *UsageCollector) collectJSONRPCMetrics(um *usageMetrics, methods []string, statusCode string, duration float64) {
+	for _, method := range methods {
+		method = uc.policy.apply(um, "rpc_method", method)
+		um.rpcRequests.WithLabelValues(method, statusCode).Inc()
+		um.rpcDuration.WithLabelValues(method).Observe(duration)
+	}
+}
+
+// unmarshalJSONRPCConfig parses a jsonrpc block:
+//
+//	jsonrpc {
+//	    max_body <size>
+//	}
+func unmarshalJSONRPCConfig(d *caddyfile.Dispenser) (*JSONRPCConfig, error) {
+	cfg := new(JSONRPCConfig)
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "max_body":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil || size == 0 {
+				return nil, d.Errf("invalid max_body '%s'", d.Val())
+			}
+			cfg.MaxBody = int64(size)
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unrecognized jsonrpc option '%s'", d.Val())
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,142 @@
+package caddyusage
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestParseJSONRPCMethods tests method extraction from request bodies
+func TestParseJSONRPCMethods(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected []string
+	}{
+		{"single call", `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`, []string{"eth_blockNumber"}},
+		{"batch", ` [{"method":"eth_call"},{"method":"eth_getBalance"},{"method":"eth_call"}]`, []string{"eth_call", "eth_getBalance", "eth_call"}},
+		{"missing method", `{"jsonrpc":"2.0","id":1}`, []string{unknownRPCMethod}},
+		{"invalid json", `{"method":`, []string{unknownRPCMethod}},
+		{"empty batch", `[]`, []string{}},
+		{"empty body", ``, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseJSONRPCMethods([]byte(tt.body)); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestJSONRPCMetrics tests per-method metrics through the full handler
+func TestJSONRPCMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	uc.JSONRPC = &JSONRPCConfig{}
+
+	body := `[{"jsonrpc":"2.0","id":1,"method":"eth_call"},{"jsonrpc":"2.0","id":2,"method":"eth_chainId"}]`
+
+	var received string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		received = string(b)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	req := httptest.NewRequest("POST", "http://rpc.example.com/", strings.NewReader(body))
+	if err := uc.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	if received != body {
+		t.Errorf("Downstream handler received a modified body: %q", received)
+	}
+
+	for _, method := range []string{"eth_call", "eth_chainId"} {
+		if got := testutil.ToFloat64(globalUsageMetrics.rpcRequests.WithLabelValues(method, "200")); got != 1 {
+			t.Errorf("Expected 1 %s call, got %v", method, got)
+		}
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.rpcDuration); n != 2 {
+		t.Errorf("Expected latency histograms for 2 methods, got %d", n)
+	}
+}
+
+// TestJSONRPCOversizedBody tests that bodies above the limit are counted as unknown
+func TestJSONRPCOversizedBody(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	uc.JSONRPC = &JSONRPCConfig{MaxBody: 16}
+
+	body := `{"method":"eth_getLogs","params":[{"fromBlock":"0x0"}]}`
+	req := httptest.NewRequest("POST", "http://rpc.example.com/", strings.NewReader(body))
+
+	if got := uc.peekJSONRPCMethods(req); !reflect.DeepEqual(got, []string{unknownRPCMethod}) {
+		t.Errorf("Expected unknown method, got %v", got)
+	}
+
+	rest, err := io.ReadAll(req.Body)
+	if err != nil || string(rest) != body {
+		t.Errorf("Body was not restored after peeking: %q (%v)", rest, err)
+	}
+
+	// Non-POST requests are not inspected
+	if got := uc.peekJSONRPCMethods(httptest.NewRequest("GET", "http://rpc.example.com/", nil)); got != nil {
+		t.Errorf("Expected GET requests to be skipped, got %v", got)
+	}
+}
+
+// TestJSONRPCMethodPolicy tests that unexpected method names don't become labels
+func TestJSONRPCMethodPolicy(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.collectJSONRPCMetrics(globalUsageMetrics, []string{"eth_call<script>", strings.Repeat("m", 100)}, "200", 0.1)
+
+	if got := testutil.ToFloat64(globalUsageMetrics.rpcRequests.WithLabelValues(deniedLabelValue, "200")); got != 1 {
+		t.Errorf("Expected method with invalid characters to be denied, got %v", got)
+	}
+	if got := testutil.ToFloat64(globalUsageMetrics.rpcRequests.WithLabelValues(strings.Repeat("m", 64)+"...", "200")); got != 1 {
+		t.Errorf("Expected long method to be truncated, got %v", got)
+	}
+}
+
+// TestUnmarshalJSONRPC tests parsing of the jsonrpc block
+func TestUnmarshalJSONRPC(t *testing.T) {
+	var uc UsageCollector
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser("usage {\n jsonrpc {\n max_body 128KiB\n }\n}")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if uc.JSONRPC == nil || uc.JSONRPC.MaxBody != 128<<10 {
+		t.Errorf("Unexpected jsonrpc config: %+v", uc.JSONRPC)
+	}
+
+	uc = UsageCollector{}
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser("usage {\n jsonrpc\n}")); err != nil || uc.JSONRPC == nil {
+		t.Errorf("Expected bare jsonrpc to enable defaults, got %+v (%v)", uc.JSONRPC, err)
+	}
+
+	for _, invalid := range []string{
+		"usage {\n jsonrpc {\n max_body\n }\n}",
+		"usage {\n jsonrpc {\n max_body huge\n }\n}",
+		"usage {\n jsonrpc {\n methods eth_call\n }\n}",
+	} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,590 @@
+package caddyusage
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// JWT claim accounting defaults and claim values of requests whose claims
+// can't be read
+const (
+	defaultJWTMetric    = "requests_by_claims_total"
+	jwksRefreshInterval = time.Hour
+	jwksRetryInterval   = time.Minute
+	jwksTimeout         = 10 * time.Second
+
+	jwtMissing = "none"
+	jwtInvalid = "invalid"
+)
+
+// jwtHelp describes the counter of JWT claims
+const jwtHelp = "Total number of requests by claims of their bearer JWT"
+
+// JWTConfig counts requests by claims of the JWT they carry as a bearer
+// token, such as the subject, audience or plan, so usage can be
+// attributed to the tenants and plans encoded in tokens.
+type JWTConfig struct {
+	// Header is the request header carrying the token, with or without a
+	// "Bearer " prefix. Defaults to Authorization.
+	Header string `json:"header,omitempty"`
+
+	// Claims are the claims recorded, each as a label.
+	Claims []JWTClaim `json:"claims"`
+
+	// JWKS is the URL of a JSON Web Key Set verifying token signatures.
+	// Without it, claims are read without verification. With it, claims
+	// of tokens failing verification or past their expiry are recorded
+	// as "invalid".
+	JWKS string `json:"jwks,omitempty"`
+}
+
+// JWTClaim is a claim recorded as a label.
+type JWTClaim struct {
+	// Label is the label name.
+	Label string `json:"label"`
+
+	// Claim is the name of the claim, such as sub or
+	// https://example.com/plan. Defaults to the label name.
+	Claim string `json:"claim,omitempty"`
+}
+
+// claim returns the configured claim name or the label name
+func (c JWTClaim) claim() string {
+	if c.Claim == "" {
+		return c.Label
+	}
+	return c.Claim
+}
+
+// labels returns the label names in order
+func (jc *JWTConfig) labels() []string {
+	names := make([]string, len(jc.Claims))
+	for i, claim := range jc.Claims {
+		names[i] = claim.Label
+	}
+	return names
+}
+
+// validate checks the claims and JWKS URL
+func (jc *JWTConfig) validate() error {
+	if len(jc.Claims) == 0 {
+		return fmt.Errorf("jwt requires at least one claim")
+	}
+	seen := make(map[string]bool, len(jc.Claims))
+	for _, claim := range jc.Claims {
+		if labelNameRegexp.FindString(claim.Label) != claim.Label || strings.HasPrefix(claim.Label, "__") {
+			return fmt.Errorf("jwt claim label must be a valid label name, got '%s'", claim.Label)
+		}
+		if seen[claim.Label] {
+			return fmt.Errorf("jwt claim label '%s' is used more than once", claim.Label)
+		}
+		seen[claim.Label] = true
+	}
+	if jc.JWKS != "" {
+		u, err := url.Parse(jc.JWKS)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("jwt jwks must be an http or https URL, got '%s'", jc.JWKS)
+		}
+	}
+	return nil
+}
+
+// jwtHeader is the subset of a JWT header needed to verify it
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// parseJWT decodes the header and claims of a compact JWT, and returns
+// the signed part and the signature
+func parseJWT(token string) (jwtHeader, map[string]any, []byte, []byte, error) {
+	var header jwtHeader
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return header, nil, nil, nil, fmt.Errorf("malformed token")
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return header, nil, nil, nil, fmt.Errorf("decoding header: %v", err)
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return header, nil, nil, nil, fmt.Errorf("parsing header: %v", err)
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return header, nil, nil, nil, fmt.Errorf("decoding claims: %v", err)
+	}
+	var claims map[string]any
+	dec := json.NewDecoder(bytes.NewReader(rawClaims))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return header, nil, nil, nil, fmt.Errorf("parsing claims: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return header, nil, nil, nil, fmt.Errorf("decoding signature: %v", err)
+	}
+	return header, claims, []byte(parts[0] + "." + parts[1]), signature, nil
+}
+
+// claimValue formats a claim as a label value: strings as-is, numbers and
+// booleans in JSON notation, lists of strings joined by commas, and
+// anything else as empty
+func claimValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return strings.Join(values, ",")
+	default:
+		return ""
+	}
+}
+
+// timeClaim returns a NumericDate claim, like exp, and whether it is set
+func timeClaim(claims map[string]any, name string) (time.Time, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// claimValues returns the label values of a request's token claims
+func (uc *UsageCollector) claimValues(r *http.Request) []string {
+	values := make([]string, len(uc.JWT.Claims))
+	fill := func(value string) []string {
+		for i := range values {
+			values[i] = value
+		}
+		return values
+	}
+
+	token := requestAPIKey(r, uc.JWT.Header)
+	if token == "" {
+		return fill(jwtMissing)
+	}
+	header, claims, signed, signature, err := parseJWT(token)
+	if err != nil {
+		return fill(jwtInvalid)
+	}
+
+	if uc.jwks != nil {
+		if !uc.jwks.verify(header, signed, signature) {
+			return fill(jwtInvalid)
+		}
+		current := now()
+		if exp, ok := timeClaim(claims, "exp"); ok && !current.Before(exp) {
+			return fill(jwtInvalid)
+		}
+		if nbf, ok := timeClaim(claims, "nbf"); ok && current.Before(nbf) {
+			return fill(jwtInvalid)
+		}
+	}
+
+	for i, claim := range uc.JWT.Claims {
+		values[i] = claimValue(claims[claim.claim()])
+	}
+	return values
+}
+
+// collectJWTMetrics counts a request by the configured claims of its JWT
+func (uc *UsageCollector) collectJWTMetrics(um *usageMetrics, r *http.Request) {
+	if uc.jwtCounter == nil {
+		return
+	}
+
+	values := uc.claimValues(r)
+	for i, claim := range uc.JWT.Claims {
+		values[i] = uc.policy.apply(um, claim.Label, values[i])
+	}
+	uc.jwtCounter.vec.WithLabelValues(values...).Inc()
+}
+
+// jwksVerifier verifies token signatures with the keys of a JSON Web Key
+// Set, fetched in the background and refreshed hourly, or sooner when a
+// token names an unknown key
+type jwksVerifier struct {
+	url    string
+	client *http.Client
+	logger *zap.Logger
+
+	mu      sync.RWMutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+
+	refresh chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// jwkSet is a JSON Web Key Set
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwk is a JSON Web Key, with the members of RSA, EC and OKP public keys
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes the public key of a JWK
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("exponent out of range")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+// verifySignature reports whether signature signs signed with key under
+// a JWS algorithm
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) bool {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, signed, signature)
+	default:
+		return false
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil
+		}
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(pub, hash, digest, signature, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+// newJWKSVerifier creates a verifier of the key set at url
+func newJWKSVerifier(url string, logger *zap.Logger) *jwksVerifier {
+	return &jwksVerifier{
+		url:     url,
+		client:  &http.Client{Timeout: jwksTimeout},
+		logger:  logger,
+		keys:    make(map[string]crypto.PublicKey),
+		refresh: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// start fetches the key set in the background until stop is called
+func (v *jwksVerifier) start() {
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		ticker := newTicker(jwksRefreshInterval)
+		defer ticker.Stop()
+
+		v.fetch()
+		for {
+			select {
+			case <-ticker.C():
+				v.fetch()
+			case <-v.refresh:
+				v.mu.RLock()
+				due := since(v.fetched) >= jwksRetryInterval
+				v.mu.RUnlock()
+				if due {
+					v.fetch()
+				}
+			case <-v.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop ends background fetching
+func (v *jwksVerifier) stop() {
+	close(v.done)
+	v.wg.Wait()
+}
+
+// fetch replaces the keys with those of the key set, keeping the current
+// keys if it can't be fetched
+func (v *jwksVerifier) fetch() {
+	v.mu.Lock()
+	v.fetched = now()
+	v.mu.Unlock()
+
+	keys, err := v.load()
+	if err != nil {
+		v.logger.Warn("failed to fetch JWKS", zap.String("url", v.url), zap.Error(err))
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.keys = keys
+}
+
+// load fetches and decodes the key set, skipping keys for encryption and
+// of unsupported types
+func (v *jwksVerifier) load() (map[string]crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var set jwkSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("parsing key set: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			v.logger.Debug("skipping JWKS key", zap.String("kid", k.Kid), zap.Error(err))
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// verify reports whether a token is signed by a key of the set. Tokens
+// naming an unknown key trigger a refresh, rate limited to one a minute.
+func (v *jwksVerifier) verify(header jwtHeader, signed, signature []byte) bool {
+	v.mu.RLock()
+	key, ok := v.keys[header.Kid]
+	if !ok && header.Kid == "" && len(v.keys) == 1 {
+		for _, only := range v.keys {
+			key, ok = only, true
+		}
+	}
+	v.mu.RUnlock()
+
+	if !ok {
+		select {
+		case v.refresh <- struct{}{}:
+		default:
+		}
+		return false
+	}
+	return verifySignature(header.Alg, key, signed, signature)
+}
+
+// jwksEntry is a running verifier and its number of users
+type jwksEntry struct {
+	verifier *jwksVerifier
+	refs     int
+}
+
+var (
+	// Running JWKS verifiers by key set URL
+	jwksVerifiers   = make(map[string]*jwksEntry)
+	jwksVerifiersMu sync.Mutex
+)
+
+// acquireJWKSVerifier returns the running verifier of a key set, starting
+// one if needed. Each call must be balanced by a call to
+// releaseJWKSVerifier.
+func acquireJWKSVerifier(url string, logger *zap.Logger) *jwksVerifier {
+	jwksVerifiersMu.Lock()
+	defer jwksVerifiersMu.Unlock()
+
+	if entry, ok := jwksVerifiers[url]; ok {
+		entry.refs++
+		return entry.verifier
+	}
+
+	v := newJWKSVerifier(url, logger)
+	v.start()
+	jwksVerifiers[url] = &jwksEntry{verifier: v, refs: 1}
+	return v
+}
+
+// releaseJWKSVerifier releases a handler's use of a verifier, stopping it
+// once no handler uses it anymore
+func releaseJWKSVerifier(v *jwksVerifier) {
+	jwksVerifiersMu.Lock()
+	defer jwksVerifiersMu.Unlock()
+
+	entry, ok := jwksVerifiers[v.url]
+	if !ok || entry.verifier != v {
+		return
+	}
+	if entry.refs--; entry.refs > 0 {
+		return
+	}
+	delete(jwksVerifiers, v.url)
+	v.stop()
+}
+
+// unmarshalJWTConfig parses a jwt block:
+//
+//	jwt {
+//	    header <name>
+//	    claim <label> [<claim>]
+//	    jwks <url>
+//	}
+func unmarshalJWTConfig(d *caddyfile.Dispenser) (*JWTConfig, error) {
+	jc := &JWTConfig{}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		args := d.RemainingArgs()
+		switch option {
+		case "header":
+			if len(args) != 1 {
+				return nil, d.ArgErr()
+			}
+			jc.Header = args[0]
+		case "claim":
+			if len(args) < 1 || len(args) > 2 {
+				return nil, d.ArgErr()
+			}
+			claim := JWTClaim{Label: args[0]}
+			if len(args) == 2 {
+				claim.Claim = args[1]
+			}
+			jc.Claims = append(jc.Claims, claim)
+		case "jwks":
+			if len(args) != 1 {
+				return nil, d.ArgErr()
+			}
+			jc.JWKS = args[0]
+		default:
+			return nil, d.Errf("unrecognized jwt option '%s'", option)
+		}
+	}
+	if len(jc.Claims) == 0 {
+		return nil, d.ArgErr()
+	}
+	return jc, nil
+}
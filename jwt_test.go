@@ -0,0 +1,232 @@
+package caddyusage
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/chalabi2/caddy-usage/usagetest"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// makeJWT encodes a token, signing it with sign when given
+func makeJWT(t *testing.T, header, claims map[string]any, sign func([]byte) []byte) string {
+	t.Helper()
+
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Failed to encode token: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	var signature []byte
+	if sign != nil {
+		signature = sign([]byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// bearerRequest returns a request carrying token in Authorization
+func bearerRequest(token string) *http.Request {
+	req := httptest.NewRequest("GET", "http://example.com/api", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// TestClaimValues tests reading claims of unverified tokens
+func TestClaimValues(t *testing.T) {
+	uc := &UsageCollector{JWT: &JWTConfig{Claims: []JWTClaim{
+		{Label: "sub"},
+		{Label: "aud"},
+		{Label: "plan", Claim: "https://example.com/plan"},
+		{Label: "seats"},
+	}}}
+	token := makeJWT(t, map[string]any{"alg": "none"}, map[string]any{
+		"sub":                      "tenant-1",
+		"aud":                      []string{"api", "web"},
+		"https://example.com/plan": "pro",
+		"seats":                    25,
+	}, nil)
+
+	tests := []struct {
+		name     string
+		token    string
+		expected []string
+	}{
+		{"claims", token, []string{"tenant-1", "api,web", "pro", "25"}},
+		{"no token", "", []string{jwtMissing, jwtMissing, jwtMissing, jwtMissing}},
+		{"malformed", "not.a-token", []string{jwtInvalid, jwtInvalid, jwtInvalid, jwtInvalid}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := uc.claimValues(bearerRequest(tt.token)); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestJWKSVerifier tests verifying RSA, ECDSA and Ed25519 signatures with
+// keys fetched from a key set, and rejecting expired tokens
+func TestJWKSVerifier(t *testing.T) {
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate ECDSA key: %v", err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	set := map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edPublic)},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+	}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(set)
+	}))
+	defer server.Close()
+
+	v := newJWKSVerifier(server.URL, zap.NewNop())
+	v.fetch()
+	if len(v.keys) != 3 {
+		t.Fatalf("Expected 3 signing keys, got %d", len(v.keys))
+	}
+
+	digest := func(signed []byte) []byte {
+		sum := sha256.Sum256(signed)
+		return sum[:]
+	}
+	signRSA := func(signed []byte) []byte {
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest(signed))
+		if err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+		return sig
+	}
+	signEC := func(signed []byte) []byte {
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest(signed))
+		if err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	signEd := func(signed []byte) []byte { return ed25519.Sign(edKey, signed) }
+
+	uc := &UsageCollector{JWT: &JWTConfig{Claims: []JWTClaim{{Label: "sub"}}}, jwks: v}
+	claims := map[string]any{"sub": "tenant-1", "exp": clock.Now().Add(time.Hour).Unix()}
+	expired := map[string]any{"sub": "tenant-1", "exp": clock.Now().Add(-time.Second).Unix()}
+
+	tests := []struct {
+		name     string
+		token    string
+		expected string
+	}{
+		{"RS256", makeJWT(t, map[string]any{"alg": "RS256", "kid": "rsa"}, claims, signRSA), "tenant-1"},
+		{"ES256", makeJWT(t, map[string]any{"alg": "ES256", "kid": "ec"}, claims, signEC), "tenant-1"},
+		{"EdDSA", makeJWT(t, map[string]any{"alg": "EdDSA", "kid": "ed"}, claims, signEd), "tenant-1"},
+		{"expired", makeJWT(t, map[string]any{"alg": "RS256", "kid": "rsa"}, expired, signRSA), jwtInvalid},
+		{"wrong key", makeJWT(t, map[string]any{"alg": "RS256", "kid": "ec"}, claims, signRSA), jwtInvalid},
+		{"unknown key", makeJWT(t, map[string]any{"alg": "RS256", "kid": "other"}, claims, signRSA), jwtInvalid},
+		{"unsigned", makeJWT(t, map[string]any{"alg": "none", "kid": "rsa"}, claims, nil), jwtInvalid},
+		{"encryption key", makeJWT(t, map[string]any{"alg": "RS256", "kid": "enc"}, claims, signRSA), jwtInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := uc.claimValues(bearerRequest(tt.token)); got[0] != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got[0])
+			}
+		})
+	}
+}
+
+// TestJWTMetrics tests that requests are counted by their claims
+func TestJWTMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	registry := prometheus.NewRegistry()
+	uc.JWT = &JWTConfig{Claims: []JWTClaim{{Label: "sub"}, {Label: "plan"}}}
+	counter, err := acquireLabelsCounter(registry, defaultMetricsNamespace, defaultJWTMetric, jwtHelp, uc.JWT.labels())
+	if err != nil {
+		t.Fatalf("Failed to register jwt counter: %v", err)
+	}
+	defer releaseLabelsCounter(counter)
+	uc.jwtCounter = counter
+
+	token := makeJWT(t, map[string]any{"alg": "none"}, map[string]any{"sub": "tenant-1", "plan": "pro"}, nil)
+	uc.collectJWTMetrics(globalUsageMetrics, bearerRequest(token))
+	uc.collectJWTMetrics(globalUsageMetrics, bearerRequest(token))
+	uc.collectJWTMetrics(globalUsageMetrics, bearerRequest(""))
+
+	usagetest.AssertValue(t, registry, "requests_by_claims_total", usagetest.Labels{"sub": "tenant-1", "plan": "pro"}, 2)
+	usagetest.AssertValue(t, registry, "requests_by_claims_total", usagetest.Labels{"sub": jwtMissing, "plan": jwtMissing}, 1)
+}
+
+// TestUnmarshalJWT tests parsing and validation of the jwt option
+func TestUnmarshalJWT(t *testing.T) {
+	var uc UsageCollector
+	input := "usage {\n jwt {\n header X-Token\n claim sub\n claim plan https://example.com/plan\n jwks https://auth.example.com/.well-known/jwks.json\n }\n}"
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := &JWTConfig{
+		Header: "X-Token",
+		Claims: []JWTClaim{{Label: "sub"}, {Label: "plan", Claim: "https://example.com/plan"}},
+		JWKS:   "https://auth.example.com/.well-known/jwks.json",
+	}
+	if !reflect.DeepEqual(uc.JWT, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, uc.JWT)
+	}
+
+	for _, invalid := range []string{
+		"usage {\n jwt\n}",
+		"usage {\n jwt sub\n}",
+		"usage {\n jwt {\n claim\n }\n}",
+		"usage {\n jwt {\n claim sub\n jwks\n }\n}",
+		"usage {\n jwt {\n claim sub\n secret s3cr3t\n }\n}",
+	} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+
+	for name, jc := range map[string]JWTConfig{
+		"invalid label":   {Claims: []JWTClaim{{Label: "https://example.com/plan"}}},
+		"duplicate label": {Claims: []JWTClaim{{Label: "sub"}, {Label: "sub", Claim: "tenant"}}},
+		"invalid jwks":    {Claims: []JWTClaim{{Label: "sub"}}, JWKS: "file:///etc/jwks.json"},
+	} {
+		if err := jc.validate(); err == nil {
+			t.Errorf("%s: expected an error but got none", name)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package caddyusage
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultLabelsMetric names the counter of custom labels when labels
+// doesn't name one
+const defaultLabelsMetric = "requests_by_labels_total"
+
+// labelsHelp describes the counter of custom labels
+const labelsHelp = "Total number of requests by custom labels evaluated from placeholders"
+
+// labelsMetricRegexp matches metric names that form valid Prometheus names
+// once prefixed with <namespace>_usage_
+var labelsMetricRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// LabelsConfig counts requests by labels whose values are evaluated from
+// Caddy placeholders, like a tenant header or the authenticated user, in a
+// counter of its own.
+type LabelsConfig struct {
+	// Metric names the counter, exposed as <namespace>_usage_<metric>.
+	// Default: requests_by_labels_total
+	Metric string `json:"metric,omitempty"`
+
+	// Labels are the labels of the counter, in order.
+	Labels []CustomLabel `json:"labels"`
+}
+
+// CustomLabel is a label whose value is evaluated per request.
+type CustomLabel struct {
+	// Name is the label name.
+	Name string `json:"name"`
+
+	// Value is the placeholder expression of the label value, like
+	// {http.request.header.X-Tenant-ID}. Unknown placeholders evaluate
+	// to an empty value.
+	Value string `json:"value"`
+}
+
+// metric returns the configured metric name or its default
+func (lc *LabelsConfig) metric() string {
+	if lc.Metric == "" {
+		return defaultLabelsMetric
+	}
+	return lc.Metric
+}
+
+// names returns the label names in order
+func (lc *LabelsConfig) names() []string {
+	names := make([]string, len(lc.Labels))
+	for i, label := range lc.Labels {
+		names[i] = label.Name
+	}
+	return names
+}
+
+// validate checks that the metric and labels form valid, distinct names
+func (lc *LabelsConfig) validate() error {
+	if !labelsMetricRegexp.MatchString(lc.metric()) {
+		return fmt.Errorf("labels metric must be a valid metric name, got '%s'", lc.Metric)
+	}
+	if len(lc.Labels) == 0 {
+		return fmt.Errorf("labels requires at least one label")
+	}
+	seen := make(map[string]bool, len(lc.Labels))
+	for _, label := range lc.Labels {
+		if labelNameRegexp.FindString(label.Name) != label.Name || strings.HasPrefix(label.Name, "__") {
+			return fmt.Errorf("labels name must be a valid label name, got '%s'", label.Name)
+		}
+		if seen[label.Name] {
+			return fmt.Errorf("labels name '%s' is used more than once", label.Name)
+		}
+		seen[label.Name] = true
+		if label.Value == "" {
+			return fmt.Errorf("labels value of '%s' must not be empty", label.Name)
+		}
+	}
+	return nil
+}
+
+// labelsCounters are the counters of custom labels in use, by name and
+// label names. Like namespaced metrics, a counter keeps its series across
+// config reloads as long as a handler records to it.
+var labelsCounters = caddy.NewUsagePool()
+
+// labelsCounter is a counter of custom labels and the registry it is
+// exposed by
+type labelsCounter struct {
+	key      string
+	mu       sync.Mutex
+	vec      *prometheus.CounterVec
+	registry prometheus.Registerer
+}
+
+// Destruct implements caddy.Destructor, unregistering the counter
+func (lc *labelsCounter) Destruct() error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.registry.Unregister(lc.vec)
+	return nil
+}
+
+// reregister exposes the counter through the registry of a newly loaded
+// config, since Caddy creates a registry per config
+func (lc *labelsCounter) reregister(registry prometheus.Registerer) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if registry == lc.registry {
+		return nil
+	}
+	if err := registry.Register(lc.vec); err != nil {
+		return err
+	}
+	lc.registry = registry
+	return nil
+}
+
+// acquireLabelsCounter returns the counter of configured labels in a
+// namespace, registering it with the provided registry when first used.
+// Each call must be balanced by a call to releaseLabelsCounter.
+func acquireLabelsCounter(registry prometheus.Registerer, ns, metric, help string, names []string) (*labelsCounter, error) {
+	key := ns + "_usage_" + metric + "{" + strings.Join(names, ",") + "}"
+	value, loaded, err := labelsCounters.LoadOrNew(key, func() (caddy.Destructor, error) {
+		vec := prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: "usage",
+				Name:      metric,
+				Help:      help,
+			},
+			names,
+		)
+		if err := registry.Register(vec); err != nil {
+			return nil, err
+		}
+		return &labelsCounter{key: key, vec: vec, registry: registry}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	counter := value.(*labelsCounter)
+
+	if loaded {
+		if err := counter.reregister(registry); err != nil {
+			_, _ = labelsCounters.Delete(key)
+			return nil, err
+		}
+	}
+	return counter, nil
+}
+
+// releaseLabelsCounter releases a handler's use of a counter of custom
+// labels, unregistering it once no handler records to it anymore
+func releaseLabelsCounter(counter *labelsCounter) {
+	// Unregistering doesn't fail
+	_, _ = labelsCounters.Delete(counter.key)
+}
+
+// collectCustomLabels counts a request by the configured labels, evaluating
+// their placeholders once the request was handled
+func (uc *UsageCollector) collectCustomLabels(um *usageMetrics, r *http.Request) {
+	if uc.labelsCounter == nil {
+		return
+	}
+
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
+
+	values := make([]string, len(uc.Labels.Labels))
+	for i, label := range uc.Labels.Labels {
+		values[i] = uc.policy.apply(um, label.Name, repl.ReplaceAll(label.Value, ""))
+	}
+	uc.labelsCounter.vec.WithLabelValues(values...).Inc()
+}
+
+// unmarshalLabelsConfig parses a labels block, each line naming a label
+// and the placeholder expression of its value:
+//
+//	labels [<metric>] {
+//	    <name> <placeholder>
+//	}
+func unmarshalLabelsConfig(d *caddyfile.Dispenser) (*LabelsConfig, error) {
+	cfg := &LabelsConfig{}
+	if d.NextArg() {
+		cfg.Metric = d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		label := CustomLabel{Name: d.Val()}
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		label.Value = d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		cfg.Labels = append(cfg.Labels, label)
+	}
+	if len(cfg.Labels) == 0 {
+		return nil, d.ArgErr()
+	}
+	return cfg, nil
+}
@@ -0,0 +1,136 @@
+package caddyusage
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/chalabi2/caddy-usage/usagetest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestCustomLabels tests that requests are counted by labels evaluated
+// from placeholders, in a counter shared by handlers with the same labels
+func TestCustomLabels(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	registry := prometheus.NewRegistry()
+	uc.Labels = &LabelsConfig{Labels: []CustomLabel{
+		{Name: "tenant", Value: "{http.request.header.X-Tenant-ID}"},
+		{Name: "user", Value: "{http.auth.user.id}"},
+	}}
+	counter, err := acquireLabelsCounter(registry, defaultMetricsNamespace, uc.Labels.metric(), labelsHelp, uc.Labels.names())
+	if err != nil {
+		t.Fatalf("Failed to register labels counter: %v", err)
+	}
+	uc.labelsCounter = counter
+
+	// Another handler with the same labels records to the same counter
+	shared, err := acquireLabelsCounter(registry, defaultMetricsNamespace, uc.Labels.metric(), labelsHelp, uc.Labels.names())
+	if err != nil {
+		t.Fatalf("Failed to share labels counter: %v", err)
+	}
+	if shared != counter {
+		t.Error("Expected handlers with the same labels to share the counter")
+	}
+	releaseLabelsCounter(shared)
+
+	for _, user := range []string{"alice", "alice", "bob"} {
+		repl := caddy.NewReplacer()
+		repl.Set("http.request.header.X-Tenant-ID", "acme")
+		repl.Set("http.auth.user.id", user)
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+		uc.collectCustomLabels(globalUsageMetrics, req)
+	}
+	uc.collectCustomLabels(globalUsageMetrics, httptest.NewRequest("GET", "http://example.com/", nil))
+
+	usagetest.AssertValue(t, registry, "requests_by_labels_total", usagetest.Labels{"tenant": "acme", "user": "alice"}, 2)
+	usagetest.AssertValue(t, registry, "requests_by_labels_total", usagetest.Labels{"tenant": "acme", "user": "bob"}, 1)
+	usagetest.AssertCount(t, registry, "requests_by_labels_total", nil, 3)
+
+	// The counter is pushed and served with the usage metrics
+	gatherer, err := usageGatherer()
+	if err != nil {
+		t.Fatalf("usageGatherer failed: %v", err)
+	}
+	usagetest.AssertCount(t, gatherer, "requests_by_labels_total", nil, 3)
+
+	// A different label set can't reuse the metric name in one registry
+	other := &LabelsConfig{Labels: []CustomLabel{{Name: "plan", Value: "{plan}"}}}
+	if _, err := acquireLabelsCounter(registry, defaultMetricsNamespace, other.metric(), labelsHelp, other.names()); err == nil {
+		t.Error("Expected an error registering different labels under the same name")
+	}
+
+	releaseLabelsCounter(counter)
+	usagetest.AssertAbsent(t, registry, "requests_by_labels_total", nil)
+}
+
+// TestLabelsConfigValidate tests rejecting invalid metric and label names
+func TestLabelsConfigValidate(t *testing.T) {
+	tenant := CustomLabel{Name: "tenant", Value: "{tenant}"}
+	tests := map[string]LabelsConfig{
+		"no labels":        {},
+		"invalid metric":   {Metric: "by-tenant", Labels: []CustomLabel{tenant}},
+		"invalid label":    {Labels: []CustomLabel{{Name: "1st", Value: "{x}"}}},
+		"reserved label":   {Labels: []CustomLabel{{Name: "__name__", Value: "{x}"}}},
+		"duplicate labels": {Labels: []CustomLabel{tenant, tenant}},
+		"empty value":      {Labels: []CustomLabel{{Name: "tenant"}}},
+	}
+	for name, cfg := range tests {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%s: expected an error but got none", name)
+		}
+	}
+
+	valid := LabelsConfig{Metric: "requests_by_tenant_total", Labels: []CustomLabel{tenant}}
+	if err := valid.validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+// TestUnmarshalLabels tests parsing of the labels option
+func TestUnmarshalLabels(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *LabelsConfig
+		expectErr bool
+	}{
+		{
+			input: "usage {\n labels {\n tenant {http.request.header.X-Tenant-ID}\n user {http.auth.user.id}\n }\n}",
+			expected: &LabelsConfig{Labels: []CustomLabel{
+				{Name: "tenant", Value: "{http.request.header.X-Tenant-ID}"},
+				{Name: "user", Value: "{http.auth.user.id}"},
+			}},
+		},
+		{
+			input:    "usage {\n labels requests_by_tenant_total {\n tenant {http.request.host}\n }\n}",
+			expected: &LabelsConfig{Metric: "requests_by_tenant_total", Labels: []CustomLabel{{Name: "tenant", Value: "{http.request.host}"}}},
+		},
+		{input: "usage {\n labels\n}", expectErr: true},
+		{input: "usage {\n labels a b {\n tenant {x}\n }\n}", expectErr: true},
+		{input: "usage {\n labels {\n tenant\n }\n}", expectErr: true},
+		{input: "usage {\n labels {\n tenant {x} {y}\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		var uc UsageCollector
+		err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected an error but got none", tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(uc.Labels, tt.expected) {
+			t.Errorf("Expected %+v, got %+v", tt.expected, uc.Labels)
+		}
+	}
+}
@@ -0,0 +1,493 @@
+package caddyusage
+
+import (
+	"cmp"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Legacy client tracking defaults and bounds
+const (
+	defaultLegacyWindow   = 30 * 24 * time.Hour
+	legacySaveInterval    = 5 * time.Minute
+	maxLegacyObservations = 10000
+)
+
+// Kinds of client capabilities tracked per host
+const (
+	legacyTLSVersion  = "tls_version"
+	legacyHTTPVersion = "http_version"
+	legacyUserAgent   = "user_agent"
+)
+
+// legacyUserAgentFamily is a family of old clients whose share of traffic
+// matters when deciding to drop support for them
+type legacyUserAgentFamily struct {
+	name  string
+	match *regexp.Regexp
+}
+
+// legacyUserAgents are the notable legacy client families. A User-Agent
+// may belong to several, such as a browser and the OS it runs on.
+var legacyUserAgents = []legacyUserAgentFamily{
+	{name: "internet_explorer", match: regexp.MustCompile(`MSIE |Trident/`)},
+	{name: "edge_legacy", match: regexp.MustCompile(`Edge/\d`)},
+	{name: "windows_xp", match: regexp.MustCompile(`Windows NT 5\.[12]`)},
+	{name: "windows_7", match: regexp.MustCompile(`Windows NT 6\.1`)},
+	{name: "android_4_or_older", match: regexp.MustCompile(`Android [1-4]\.`)},
+	{name: "ios_12_or_older", match: regexp.MustCompile(`(iPhone|iPad|iPod).* OS ([1-9]|1[0-2])_`)},
+	{name: "java_8_or_older", match: regexp.MustCompile(`Java/1\.[5-8]`)},
+	{name: "python_2", match: regexp.MustCompile(`Python-urllib/2\.`)},
+}
+
+// LegacyClientsConfig enables tracking of the oldest TLS versions, HTTP
+// versions and legacy User-Agent families seen by each host over a rolling
+// window, to tell when support for them can be dropped. Observations are
+// persisted so that they survive restarts, and reported by the admin API.
+type LegacyClientsConfig struct {
+	// File is where observations are persisted. Defaults to
+	// usage/legacy_clients.json in Caddy's data directory.
+	File string `json:"file,omitempty"`
+
+	// Window is how long observations are kept. Defaults to 30 days.
+	Window caddy.Duration `json:"window,omitempty"`
+}
+
+// validate checks the window
+func (lc *LegacyClientsConfig) validate() error {
+	if lc.Window < 0 {
+		return fmt.Errorf("legacy_clients window must not be negative, got %s", time.Duration(lc.Window))
+	}
+	if lc.Window > 0 && lc.Window < caddy.Duration(24*time.Hour) {
+		return fmt.Errorf("legacy_clients window must be at least a day, got %s", time.Duration(lc.Window))
+	}
+	return nil
+}
+
+// file returns the configured file or its default
+func (lc *LegacyClientsConfig) file() string {
+	if lc.File != "" {
+		return lc.File
+	}
+	return filepath.Join(caddy.AppDataDir(), "usage", "legacy_clients.json")
+}
+
+// legacyKey identifies a capability of the clients of a host
+type legacyKey struct {
+	host  string
+	kind  string
+	value string
+}
+
+// legacyObservation counts the requests of a host's clients with a
+// capability, by day
+type legacyObservation struct {
+	Host     string    `json:"host"`
+	Kind     string    `json:"kind"`
+	Value    string    `json:"value"`
+	LastSeen time.Time `json:"last_seen"`
+
+	// Requests by day, numbered from the Unix epoch in UTC
+	Days map[int64]uint64 `json:"days"`
+}
+
+// legacyDay returns the number of the UTC day of t
+func legacyDay(t time.Time) int64 {
+	return t.Unix() / int64(24*time.Hour/time.Second)
+}
+
+// legacyTracker records the capabilities of each host's clients and
+// persists them. Handlers configured with the same file share a tracker,
+// so config reloads keep its observations.
+type legacyTracker struct {
+	path   string
+	logger *zap.Logger
+
+	mu           sync.Mutex
+	window       time.Duration
+	observations map[legacyKey]*legacyObservation
+	dirty        bool
+	saveFails    bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// legacyTrackerEntry is a shared tracker and the number of handlers using it
+type legacyTrackerEntry struct {
+	tracker *legacyTracker
+	refs    int
+}
+
+var (
+	// Running trackers by file
+	legacyTrackers   = make(map[string]*legacyTrackerEntry)
+	legacyTrackersMu sync.Mutex
+)
+
+// acquireLegacyTracker returns the running tracker for the configured
+// file, starting one if needed. Since trackers are shared, the most
+// recently provisioned handler's window applies. Each call must be
+// balanced by a call to releaseLegacyTracker.
+func acquireLegacyTracker(lc *LegacyClientsConfig, logger *zap.Logger) *legacyTracker {
+	window := defaultLegacyWindow
+	if lc.Window > 0 {
+		window = time.Duration(lc.Window)
+	}
+
+	legacyTrackersMu.Lock()
+	defer legacyTrackersMu.Unlock()
+
+	path := lc.file()
+	if entry, ok := legacyTrackers[path]; ok {
+		entry.refs++
+		entry.tracker.mu.Lock()
+		entry.tracker.window = window
+		entry.tracker.mu.Unlock()
+		return entry.tracker
+	}
+
+	tracker := newLegacyTracker(path, window, logger)
+	tracker.start()
+	legacyTrackers[path] = &legacyTrackerEntry{tracker: tracker, refs: 1}
+	return tracker
+}
+
+// releaseLegacyTracker releases a handler's use of a tracker, stopping it
+// and persisting its observations once no handler uses it anymore
+func releaseLegacyTracker(tracker *legacyTracker) error {
+	legacyTrackersMu.Lock()
+	defer legacyTrackersMu.Unlock()
+
+	entry, ok := legacyTrackers[tracker.path]
+	if !ok || entry.tracker != tracker {
+		return nil
+	}
+	if entry.refs--; entry.refs > 0 {
+		return nil
+	}
+	delete(legacyTrackers, tracker.path)
+	return tracker.stop()
+}
+
+// newLegacyTracker creates a tracker, loading the observations persisted
+// in path
+func newLegacyTracker(path string, window time.Duration, logger *zap.Logger) *legacyTracker {
+	t := &legacyTracker{
+		path:         path,
+		logger:       logger,
+		window:       window,
+		observations: make(map[legacyKey]*legacyObservation),
+		done:         make(chan struct{}),
+	}
+	t.load()
+	return t
+}
+
+// start persists the observations periodically
+func (t *legacyTracker) start() {
+	ticker := newTicker(legacySaveInterval)
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				t.saveLogged()
+			case <-t.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the periodic saves and persists the observations
+func (t *legacyTracker) stop() error {
+	close(t.done)
+	t.wg.Wait()
+	return t.save()
+}
+
+// observe counts a request of a host's client with a capability. New
+// capabilities are dropped once the tracker is full.
+func (t *legacyTracker) observe(host, kind, value string, now time.Time) {
+	key := legacyKey{host: host, kind: kind, value: value}
+	day := legacyDay(now)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	obs, ok := t.observations[key]
+	if !ok {
+		if len(t.observations) >= maxLegacyObservations {
+			t.evictExpired(now)
+			if len(t.observations) >= maxLegacyObservations {
+				return
+			}
+		}
+		obs = &legacyObservation{Host: host, Kind: kind, Value: value, Days: make(map[int64]uint64)}
+		t.observations[key] = obs
+	}
+	obs.Days[day]++
+	obs.LastSeen = now
+	t.dirty = true
+}
+
+// evictExpired drops the days that fell out of the window, and the
+// observations left without any. The caller must hold t.mu.
+func (t *legacyTracker) evictExpired(now time.Time) {
+	oldest := legacyDay(now.Add(-t.window))
+	for key, obs := range t.observations {
+		for day := range obs.Days {
+			if day <= oldest {
+				delete(obs.Days, day)
+			}
+		}
+		if len(obs.Days) == 0 {
+			delete(t.observations, key)
+		}
+	}
+}
+
+// load reads persisted observations. A missing or unreadable file just
+// means starting with no observations.
+func (t *legacyTracker) load() {
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return
+	}
+
+	var observations []*legacyObservation
+	if err := json.Unmarshal(data, &observations); err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, obs := range observations {
+		if len(t.observations) >= maxLegacyObservations || obs.Days == nil {
+			continue
+		}
+		t.observations[legacyKey{host: obs.Host, kind: obs.Kind, value: obs.Value}] = obs
+	}
+	t.evictExpired(now())
+}
+
+// save persists the observations if they changed since they were last
+// saved. The file is replaced atomically so that a crash never leaves it
+// truncated.
+func (t *legacyTracker) save() error {
+	t.mu.Lock()
+	if !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	t.evictExpired(now())
+	observations := make([]*legacyObservation, 0, len(t.observations))
+	for _, obs := range t.observations {
+		observations = append(observations, obs)
+	}
+	data, err := json.Marshal(observations)
+	t.dirty = false
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(t.path, data, 0o600); err != nil {
+		t.mu.Lock()
+		t.dirty = true
+		t.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// saveLogged persists the observations, logging when saves start or stop
+// failing
+func (t *legacyTracker) saveLogged() {
+	err := t.save()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case err != nil && !t.saveFails:
+		t.logger.Warn("failed to save legacy client observations", zap.String("path", t.path), zap.Error(err))
+	case err == nil && t.saveFails:
+		t.logger.Info("saving legacy client observations again", zap.String("path", t.path))
+	}
+	t.saveFails = err != nil
+}
+
+// legacyUsage is the traffic of a host's clients with a capability within
+// the window
+type legacyUsage struct {
+	Value    string    `json:"value"`
+	Requests uint64    `json:"requests"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// legacyClientReport lists the capabilities of a host's clients within the
+// window, the oldest versions first
+type legacyClientReport struct {
+	Host              string        `json:"host"`
+	OldestTLSVersion  string        `json:"oldest_tls_version,omitempty"`
+	OldestHTTPVersion string        `json:"oldest_http_version,omitempty"`
+	TLSVersions       []legacyUsage `json:"tls_versions"`
+	HTTPVersions      []legacyUsage `json:"http_versions"`
+	LegacyUserAgents  []legacyUsage `json:"legacy_user_agents"`
+}
+
+// legacyClientReports reports the clients of every host, or of a single
+// host, seen by the running trackers within their windows
+func legacyClientReports(host string, now time.Time) []legacyClientReport {
+	legacyTrackersMu.Lock()
+	trackers := make([]*legacyTracker, 0, len(legacyTrackers))
+	for _, entry := range legacyTrackers {
+		trackers = append(trackers, entry.tracker)
+	}
+	legacyTrackersMu.Unlock()
+
+	usage := make(map[legacyKey]*legacyUsage)
+	for _, t := range trackers {
+		t.mu.Lock()
+		oldest := legacyDay(now.Add(-t.window))
+		for key, obs := range t.observations {
+			if host != "" && key.host != host {
+				continue
+			}
+			var requests uint64
+			for day, n := range obs.Days {
+				if day > oldest {
+					requests += n
+				}
+			}
+			if requests == 0 {
+				continue
+			}
+			u, ok := usage[key]
+			if !ok {
+				u = &legacyUsage{Value: key.value}
+				usage[key] = u
+			}
+			u.Requests += requests
+			if obs.LastSeen.After(u.LastSeen) {
+				u.LastSeen = obs.LastSeen
+			}
+		}
+		t.mu.Unlock()
+	}
+
+	reports := make(map[string]*legacyClientReport)
+	for key, u := range usage {
+		report, ok := reports[key.host]
+		if !ok {
+			report = &legacyClientReport{
+				Host:             key.host,
+				TLSVersions:      []legacyUsage{},
+				HTTPVersions:     []legacyUsage{},
+				LegacyUserAgents: []legacyUsage{},
+			}
+			reports[key.host] = report
+		}
+		switch key.kind {
+		case legacyTLSVersion:
+			report.TLSVersions = append(report.TLSVersions, *u)
+		case legacyHTTPVersion:
+			report.HTTPVersions = append(report.HTTPVersions, *u)
+		case legacyUserAgent:
+			report.LegacyUserAgents = append(report.LegacyUserAgents, *u)
+		}
+	}
+
+	// Version names sort from oldest to newest: SSLv3 before TLS 1.0, and
+	// HTTP/1.0 before HTTP/2
+	byValue := func(a, b legacyUsage) int { return cmp.Compare(a.Value, b.Value) }
+	out := make([]legacyClientReport, 0, len(reports))
+	for _, report := range reports {
+		slices.SortFunc(report.TLSVersions, byValue)
+		slices.SortFunc(report.HTTPVersions, byValue)
+		slices.SortFunc(report.LegacyUserAgents, byValue)
+		if len(report.TLSVersions) > 0 {
+			report.OldestTLSVersion = report.TLSVersions[0].Value
+		}
+		if len(report.HTTPVersions) > 0 {
+			report.OldestHTTPVersion = report.HTTPVersions[0].Value
+		}
+		out = append(out, *report)
+	}
+	slices.SortFunc(out, func(a, b legacyClientReport) int { return cmp.Compare(a.Host, b.Host) })
+	return out
+}
+
+// collectLegacyClients records the TLS version, HTTP version and legacy
+// User-Agent families of a request's client under its host
+func (uc *UsageCollector) collectLegacyClients(r *http.Request, host string) {
+	seen := now()
+	if r.TLS != nil {
+		uc.legacyTracker.observe(host, legacyTLSVersion, tls.VersionName(r.TLS.Version), seen)
+	}
+	uc.legacyTracker.observe(host, legacyHTTPVersion, protocolVersion(r), seen)
+
+	ua := r.UserAgent()
+	if ua == "" {
+		return
+	}
+	for _, family := range legacyUserAgents {
+		if family.match.MatchString(ua) {
+			uc.legacyTracker.observe(host, legacyUserAgent, family.name, seen)
+		}
+	}
+}
+
+// unmarshalLegacyClientsConfig parses a legacy_clients directive, whose
+// block is optional:
+//
+//	legacy_clients [{
+//	    file <path>
+//	    window <duration>
+//	}]
+func unmarshalLegacyClientsConfig(d *caddyfile.Dispenser) (*LegacyClientsConfig, error) {
+	lc := new(LegacyClientsConfig)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		value := d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "file":
+			lc.File = value
+		case "window":
+			dur, err := caddy.ParseDuration(value)
+			if err != nil {
+				return nil, d.Errf("invalid legacy_clients window '%s': %v", value, err)
+			}
+			lc.Window = caddy.Duration(dur)
+		default:
+			return nil, d.Errf("unrecognized legacy_clients option '%s'", option)
+		}
+	}
+	return lc, nil
+}
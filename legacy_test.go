@@ -0,0 +1,195 @@
+package caddyusage
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// legacyReports fetches the legacy client reports from the admin API
+func legacyReports(t *testing.T, target string) []legacyClientReport {
+	t.Helper()
+
+	w, err := serveAdmin(t, "/usage/legacy_clients", httptest.NewRequest("GET", target, nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var reports []legacyClientReport
+	if err := json.Unmarshal(w.Body.Bytes(), &reports); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return reports
+}
+
+// TestLegacyClients tests that the oldest versions and legacy User-Agents
+// of each host's clients are reported until they fall out of the window
+func TestLegacyClients(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	uc.legacyTracker = acquireLegacyTracker(&LegacyClientsConfig{File: filepath.Join(t.TempDir(), "legacy.json")}, zap.NewNop())
+	defer func() { _ = releaseLegacyTracker(uc.legacyTracker) }()
+
+	requests := []struct {
+		host  string
+		tls   uint16
+		proto string
+		ua    string
+	}{
+		{host: "example.com", tls: tls.VersionTLS12, proto: "HTTP/1.1", ua: "Mozilla/5.0 (Windows NT 6.1; Trident/7.0; rv:11.0) like Gecko"},
+		{host: "example.com", tls: tls.VersionTLS13, proto: "HTTP/2.0", ua: "Mozilla/5.0 (X11; Linux x86_64) Firefox/130.0"},
+		{host: "example.com", tls: tls.VersionTLS13, proto: "HTTP/2.0", ua: "Mozilla/5.0 (X11; Linux x86_64) Firefox/130.0"},
+		{host: "api.example.com", proto: "HTTP/1.0"},
+	}
+	start := now()
+	for _, tt := range requests {
+		req := httptest.NewRequest("GET", "http://"+tt.host+"/", nil)
+		req.Proto = tt.proto
+		req.ProtoMajor, req.ProtoMinor, _ = http.ParseHTTPVersion(tt.proto)
+		if tt.tls != 0 {
+			req.TLS = &tls.ConnectionState{Version: tt.tls}
+		}
+		req.Header.Set("User-Agent", tt.ua)
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(200)
+		uc.collectMetrics(rec, req, now(), nil)
+	}
+
+	reports := legacyReports(t, "/usage/legacy_clients?host=example.com")
+	expected := []legacyClientReport{{
+		Host:              "example.com",
+		OldestTLSVersion:  "TLS 1.2",
+		OldestHTTPVersion: "HTTP/1.1",
+		TLSVersions:       []legacyUsage{{Value: "TLS 1.2", Requests: 1, LastSeen: start}, {Value: "TLS 1.3", Requests: 2, LastSeen: start}},
+		HTTPVersions:      []legacyUsage{{Value: "HTTP/1.1", Requests: 1, LastSeen: start}, {Value: "HTTP/2", Requests: 2, LastSeen: start}},
+		LegacyUserAgents:  []legacyUsage{{Value: "internet_explorer", Requests: 1, LastSeen: start}, {Value: "windows_7", Requests: 1, LastSeen: start}},
+	}}
+	if !reflect.DeepEqual(reports, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, reports)
+	}
+
+	if reports := legacyReports(t, "/usage/legacy_clients"); len(reports) != 2 || reports[0].Host != "api.example.com" || reports[0].OldestHTTPVersion != "HTTP/1.0" || reports[0].OldestTLSVersion != "" {
+		t.Errorf("Expected a plain HTTP/1.0 client of api.example.com first, got %+v", reports)
+	}
+
+	// Observations expire once out of the window
+	clock.Advance(31 * 24 * time.Hour)
+	if reports := legacyReports(t, "/usage/legacy_clients"); len(reports) != 0 {
+		t.Errorf("Expected no clients within the window, got %+v", reports)
+	}
+}
+
+// TestLegacyClientsPersist tests that observations survive a restart
+func TestLegacyClientsPersist(t *testing.T) {
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	lc := &LegacyClientsConfig{File: filepath.Join(t.TempDir(), "legacy.json"), Window: caddy.Duration(7 * 24 * time.Hour)}
+	tracker := acquireLegacyTracker(lc, zap.NewNop())
+	tracker.observe("example.com", legacyTLSVersion, "TLS 1.0", now())
+	if err := releaseLegacyTracker(tracker); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	clock.Advance(24 * time.Hour)
+	tracker = acquireLegacyTracker(lc, zap.NewNop())
+	defer func() { _ = releaseLegacyTracker(tracker) }()
+
+	reports := legacyClientReports("", now())
+	if len(reports) != 1 || reports[0].OldestTLSVersion != "TLS 1.0" || reports[0].TLSVersions[0].Requests != 1 {
+		t.Errorf("Expected the TLS 1.0 client to be restored, got %+v", reports)
+	}
+}
+
+// TestLegacyUserAgents tests matching of legacy client families
+func TestLegacyUserAgents(t *testing.T) {
+	tests := map[string][]string{
+		"Mozilla/4.0 (compatible; MSIE 8.0; Windows NT 5.1; Trident/4.0)":                                      {"internet_explorer", "windows_xp"},
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/70.0 Safari/537.36 Edge/18.17763": {"edge_legacy"},
+		"Mozilla/5.0 (Linux; U; Android 4.4.2; en-us) AppleWebKit/534.30 Version/4.0 Mobile Safari/534.30":     {"android_4_or_older"},
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 12_5_7 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148":          {"ios_12_or_older"},
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148":            nil,
+		"Java/1.8.0_292":           {"java_8_or_older"},
+		"Java/17.0.2":              nil,
+		"Python-urllib/2.7":        {"python_2"},
+		"Mozilla/5.0 (Android 14)": nil,
+	}
+	for ua, expected := range tests {
+		var families []string
+		for _, family := range legacyUserAgents {
+			if family.match.MatchString(ua) {
+				families = append(families, family.name)
+			}
+		}
+		if !slices.Equal(families, expected) {
+			t.Errorf("%s: expected %v, got %v", ua, expected, families)
+		}
+	}
+}
+
+// TestLegacyClientsValidate tests validation of legacy_clients options
+func TestLegacyClientsValidate(t *testing.T) {
+	tests := map[string]struct {
+		config    LegacyClientsConfig
+		expectErr bool
+	}{
+		"default":         {config: LegacyClientsConfig{}},
+		"90 days":         {config: LegacyClientsConfig{Window: caddy.Duration(90 * 24 * time.Hour)}},
+		"negative window": {config: LegacyClientsConfig{Window: -1}, expectErr: true},
+		"under a day":     {config: LegacyClientsConfig{Window: caddy.Duration(time.Hour)}, expectErr: true},
+	}
+	for name, tt := range tests {
+		if err := tt.config.validate(); (err != nil) != tt.expectErr {
+			t.Errorf("%s: expected error %v, got %v", name, tt.expectErr, err)
+		}
+	}
+}
+
+// TestUnmarshalLegacyClients tests parsing of the legacy_clients option
+func TestUnmarshalLegacyClients(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *LegacyClientsConfig
+		expectErr bool
+	}{
+		{input: "usage {\n legacy_clients\n}", expected: &LegacyClientsConfig{}},
+		{input: "usage {\n legacy_clients {\n file /var/lib/caddy/legacy.json\n window 90d\n }\n}", expected: &LegacyClientsConfig{File: "/var/lib/caddy/legacy.json", Window: caddy.Duration(90 * 24 * time.Hour)}},
+		{input: "usage {\n legacy_clients 30d\n}", expectErr: true},
+		{input: "usage {\n legacy_clients {\n window monthly\n }\n}", expectErr: true},
+		{input: "usage {\n legacy_clients {\n file\n }\n}", expectErr: true},
+		{input: "usage {\n legacy_clients {\n user_agents ie\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.LegacyClients, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.LegacyClients)
+			}
+		})
+	}
+}
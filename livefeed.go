@@ -0,0 +1,173 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Live feed bounds
+const (
+	// feedBufferSize is the number of events buffered per subscriber before
+	// new events are dropped for it
+	feedBufferSize = 256
+
+	// feedKeepalive is how often an idle stream gets a comment, so that
+	// proxies and clients don't time it out
+	feedKeepalive = 15 * time.Second
+)
+
+// feedEvent is a request of the live feed. Values of labels are those
+// recorded by the metrics, after the label policy.
+type feedEvent struct {
+	Time            time.Time `json:"time"`
+	Method          string    `json:"method"`
+	Host            string    `json:"host"`
+	Path            string    `json:"path"`
+	Status          int       `json:"status"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	ClientIP        string    `json:"client_ip"`
+	UserAgent       string    `json:"user_agent,omitempty"`
+}
+
+// feedSubscriber is a stream of the live feed, receiving a sample of the
+// requests of a host or of all hosts
+type feedSubscriber struct {
+	host       string
+	sampleRate float64
+	events     chan feedEvent
+	dropped    atomic.Uint64
+}
+
+var (
+	// Streams of the live feed
+	feedSubscribers   = make(map[*feedSubscriber]struct{})
+	feedSubscribersMu sync.Mutex
+
+	// feedSubscribed counts the streams, so that requests skip building
+	// events while nobody is watching
+	feedSubscribed atomic.Int32
+)
+
+// subscribeFeed adds a stream of the live feed. Each call must be balanced
+// by a call to unsubscribeFeed.
+func subscribeFeed(host string, sampleRate float64) *feedSubscriber {
+	sub := &feedSubscriber{
+		host:       host,
+		sampleRate: sampleRate,
+		events:     make(chan feedEvent, feedBufferSize),
+	}
+
+	feedSubscribersMu.Lock()
+	defer feedSubscribersMu.Unlock()
+
+	feedSubscribers[sub] = struct{}{}
+	feedSubscribed.Add(1)
+	return sub
+}
+
+// unsubscribeFeed removes a stream of the live feed
+func unsubscribeFeed(sub *feedSubscriber) {
+	feedSubscribersMu.Lock()
+	defer feedSubscribersMu.Unlock()
+
+	if _, ok := feedSubscribers[sub]; ok {
+		delete(feedSubscribers, sub)
+		feedSubscribed.Add(-1)
+	}
+}
+
+// publishFeedEvent sends an event to the streams it is sampled for. Slow
+// streams don't hold requests up: events are dropped for a stream whose
+// buffer is full.
+func publishFeedEvent(event feedEvent) {
+	feedSubscribersMu.Lock()
+	defer feedSubscribersMu.Unlock()
+
+	for sub := range feedSubscribers {
+		if sub.host != "" && sub.host != event.Host {
+			continue
+		}
+		if sub.sampleRate < 1 && rand.Float64() >= sub.sampleRate {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// collectFeedEvent publishes a request to the live feed, with the label
+// values recorded by the metrics
+func (uc *UsageCollector) collectFeedEvent(um *usageMetrics, rec recordedResponse, r *http.Request, startTime time.Time, elapsed time.Duration, method, host, path, clientIP string) {
+	event := feedEvent{
+		Time:            startTime.UTC(),
+		Method:          method,
+		Host:            host,
+		Path:            path,
+		Status:          rec.Status(),
+		DurationSeconds: elapsed.Seconds(),
+		ClientIP:        clientIP,
+	}
+	if ua := r.Header.Get("User-Agent"); ua != "" {
+		event.UserAgent = uc.policy.apply(um, "header_value", ua)
+	}
+	publishFeedEvent(event)
+}
+
+// parseFeedQuery reads the host and sample_rate query parameters of a
+// stream. The sample rate defaults to 1, streaming every request.
+func parseFeedQuery(query url.Values) (string, float64, error) {
+	sampleRate := 1.0
+	if value := query.Get("sample_rate"); value != "" {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return "", 0, fmt.Errorf("sample_rate must be greater than 0 and at most 1, got '%s'", value)
+		}
+		sampleRate = rate
+	}
+	return query.Get("host"), sampleRate, nil
+}
+
+// streamFeed writes a stream's events as Server-Sent Events until done is
+// closed. Each request is a "request" event with a JSON payload; events
+// dropped because the client read too slowly are reported by a "dropped"
+// event with their number.
+func streamFeed(w http.ResponseWriter, flusher http.Flusher, sub *feedSubscriber, done <-chan struct{}) error {
+	ticker := newTicker(feedKeepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-sub.events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: request\ndata: %s\n\n", data); err != nil {
+				return err
+			}
+		case <-ticker.C():
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+
+		if dropped := sub.dropped.Swap(0); dropped > 0 {
+			if _, err := fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped); err != nil {
+				return err
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,113 @@
+package caddyusage
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// TestLiveFeed tests streaming the requests of a host as Server-Sent Events
+func TestLiveFeed(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = adminAPI{}.handleFeed(w, r)
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/usage/feed?host=example.com")
+	if err != nil {
+		t.Fatalf("Failed to open feed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %q", ct)
+	}
+
+	for _, host := range []string{"other.com", "example.com"} {
+		req := httptest.NewRequest("GET", "http://"+host+"/api/users", nil)
+		req.Header.Set("User-Agent", "curl/8.5.0")
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(404)
+		uc.collectMetrics(rec, req, now(), nil)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for scanner.Scan() && scanner.Text() != "" {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 2 || lines[0] != "event: request" || !strings.HasPrefix(lines[1], "data: ") {
+		t.Fatalf("Expected a request event, got %q", lines)
+	}
+
+	var event feedEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &event); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if event.Host != "example.com" || event.Path != "/api/users" || event.Status != 404 || event.Method != "GET" || event.UserAgent != "curl/8.5.0" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
+
+// TestPublishFeedEvent tests filtering by host and dropping events of
+// streams that fall behind
+func TestPublishFeedEvent(t *testing.T) {
+	all := subscribeFeed("", 1)
+	defer unsubscribeFeed(all)
+	api := subscribeFeed("api.example.com", 1)
+	defer unsubscribeFeed(api)
+
+	for range feedBufferSize + 3 {
+		publishFeedEvent(feedEvent{Host: "example.com"})
+	}
+
+	if len(all.events) != feedBufferSize || all.dropped.Load() != 3 {
+		t.Errorf("Expected %d buffered and 3 dropped events, got %d and %d", feedBufferSize, len(all.events), all.dropped.Load())
+	}
+	if len(api.events) != 0 || api.dropped.Load() != 0 {
+		t.Errorf("Expected no events of other hosts, got %d", len(api.events))
+	}
+
+	unsubscribeFeed(all)
+	unsubscribeFeed(api)
+	if n := feedSubscribed.Load(); n != 0 {
+		t.Errorf("Expected no streams left, got %d", n)
+	}
+}
+
+// TestParseFeedQuery tests parsing of the feed's query parameters
+func TestParseFeedQuery(t *testing.T) {
+	tests := []struct {
+		query     string
+		host      string
+		rate      float64
+		expectErr bool
+	}{
+		{query: "", rate: 1},
+		{query: "host=example.com&sample_rate=0.1", host: "example.com", rate: 0.1},
+		{query: "sample_rate=0", expectErr: true},
+		{query: "sample_rate=1.5", expectErr: true},
+		{query: "sample_rate=half", expectErr: true},
+	}
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		host, rate, err := parseFeedQuery(values)
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected an error but got none", tt.query)
+			}
+			continue
+		}
+		if err != nil || host != tt.host || rate != tt.rate {
+			t.Errorf("%q: expected %q and %g, got %q, %g and %v", tt.query, tt.host, tt.rate, host, rate, err)
+		}
+	}
+}
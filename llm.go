@@ -0,0 +1,266 @@
+package caddyusage
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+)
+
+// defaultLLMMaxBody caps how much of a non-streaming completion response is
+// buffered for parsing, and how long a single event-stream line may get
+const defaultLLMMaxBody = 1 << 20
+
+// anonymousAPIKey labels LLM usage from requests without an API key
+const anonymousAPIKey = "anonymous"
+
+// LLMConfig enables token accounting for OpenAI-compatible APIs proxied
+// through Caddy. Token counts are read from the usage object of completion
+// responses, including the final chunk of streamed responses, or from
+// upstream-provided headers.
+type LLMConfig struct {
+	// KeyHeader is the request header carrying the caller's API key.
+	// A "Bearer " prefix is stripped. Keys are always hashed before being
+	// recorded. Defaults to Authorization.
+	KeyHeader string `json:"key_header,omitempty"`
+
+	// PromptTokensHeader and CompletionTokensHeader name response headers
+	// reporting token counts. When present they take precedence over the
+	// response body.
+	PromptTokensHeader     string `json:"prompt_tokens_header,omitempty"`
+	CompletionTokensHeader string `json:"completion_tokens_header,omitempty"`
+
+	// MaxBody is the maximum number of response bytes buffered for parsing.
+	// Larger non-streaming responses are passed through unparsed.
+	// Defaults to 1MiB.
+	MaxBody int64 `json:"max_body,omitempty"`
+}
+
+// llmUsage is the subset of an OpenAI-compatible completion response
+// needed for token accounting
+type llmUsage struct {
+	Model string `json:"model"`
+	Usage *struct {
+		PromptTokens     float64 `json:"prompt_tokens"`
+		CompletionTokens float64 `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// llmCapture passes a response through to the client while retaining what
+// is needed to read token usage from it. Non-streaming bodies are buffered
+// up to a limit; event streams are parsed line by line so memory stays
+// bounded no matter how long the stream runs.
+type llmCapture struct {
+	*caddyhttp.ResponseWriterWrapper
+
+	maxBody   int64
+	decided   bool
+	streaming bool
+	skip      bool
+
+	buf    bytes.Buffer
+	result llmUsage
+}
+
+// newLLMCapture wraps w for token accounting
+func newLLMCapture(w http.ResponseWriter, maxBody int64) *llmCapture {
+	return &llmCapture{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		maxBody:               maxBody,
+	}
+}
+
+// Write implements http.ResponseWriter
+func (c *llmCapture) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriterWrapper.Write(p)
+	c.observe(p[:n])
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom, routing data through Write so that
+// it is observed rather than copied straight to the underlying writer
+func (c *llmCapture) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{c}, r)
+}
+
+// writerOnly hides every method but Write, preventing io.Copy recursion
+type writerOnly struct{ io.Writer }
+
+// observe feeds written bytes to the body or stream parser
+func (c *llmCapture) observe(p []byte) {
+	if !c.decided {
+		c.decided = true
+		header := c.Header()
+		if enc := header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+			c.skip = true
+		}
+		mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+		c.streaming = mediaType == "text/event-stream"
+	}
+	if c.skip {
+		return
+	}
+
+	if !c.streaming {
+		if int64(c.buf.Len()+len(p)) > c.maxBody {
+			c.skip = true
+			c.buf = bytes.Buffer{}
+			return
+		}
+		c.buf.Write(p)
+		return
+	}
+
+	// Event streams: process each complete line, keeping only the partial tail
+	c.buf.Write(p)
+	for {
+		line, err := c.buf.ReadBytes('\n')
+		if err != nil {
+			// Incomplete line; put it back unless it's grown too long
+			if int64(len(line)) <= c.maxBody {
+				c.buf.Write(line)
+			}
+			return
+		}
+		c.observeEvent(line)
+	}
+}
+
+// observeEvent parses one server-sent event line
+func (c *llmCapture) observeEvent(line []byte) {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok {
+		return
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("[DONE]")) {
+		return
+	}
+	c.merge(data)
+}
+
+// merge folds a JSON chunk into the captured usage
+func (c *llmCapture) merge(data []byte) {
+	var chunk llmUsage
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return
+	}
+	if chunk.Model != "" {
+		c.result.Model = chunk.Model
+	}
+	if chunk.Usage != nil {
+		c.result.Usage = chunk.Usage
+	}
+}
+
+// usage returns the model and token counts observed in the response
+func (c *llmCapture) usage() (model string, prompt, completion float64, ok bool) {
+	if !c.streaming && !c.skip && c.buf.Len() > 0 {
+		c.merge(c.buf.Bytes())
+		c.buf.Reset()
+	}
+
+	if c.result.Usage == nil {
+		return c.result.Model, 0, 0, false
+	}
+	return c.result.Model, c.result.Usage.PromptTokens, c.result.Usage.CompletionTokens, true
+}
+
+// collectLLMMetrics records token usage for a completed LLM API request
+func (uc *UsageCollector) collectLLMMetrics(um *usageMetrics, r *http.Request, c *llmCapture) {
+	model, prompt, completion, ok := c.usage()
+
+	// Upstream usage headers take precedence over the body
+	header := c.Header()
+	if v, err := strconv.ParseFloat(header.Get(uc.LLM.PromptTokensHeader), 64); uc.LLM.PromptTokensHeader != "" && err == nil && v >= 0 {
+		prompt, ok = v, true
+	}
+	if v, err := strconv.ParseFloat(header.Get(uc.LLM.CompletionTokensHeader), 64); uc.LLM.CompletionTokensHeader != "" && err == nil && v >= 0 {
+		completion, ok = v, true
+	}
+	if !ok {
+		return
+	}
+
+	if model == "" {
+		model = "unknown"
+	}
+	model = uc.policy.apply(um, "model", model)
+	apiKey := uc.policy.apply(um, "api_key", llmAPIKey(r, uc.LLM.KeyHeader))
+
+	um.llmTokens.WithLabelValues(apiKey, model, "prompt").Add(prompt)
+	um.llmTokens.WithLabelValues(apiKey, model, "completion").Add(completion)
+}
+
+// llmAPIKey returns a stable hash identifying the caller's API key
+func llmAPIKey(r *http.Request, keyHeader string) string {
+	key := requestAPIKey(r, keyHeader)
+	if key == "" {
+		return anonymousAPIKey
+	}
+
+	return hashValue(key)
+}
+
+// requestAPIKey returns the caller's API key from keyHeader, Authorization
+// by default, without a "Bearer " prefix
+func requestAPIKey(r *http.Request, keyHeader string) string {
+	if keyHeader == "" {
+		keyHeader = "Authorization"
+	}
+
+	key := strings.TrimSpace(r.Header.Get(keyHeader))
+	if len(key) > 7 && strings.EqualFold(key[:7], "bearer ") {
+		key = strings.TrimSpace(key[7:])
+	}
+	return key
+}
+
+// unmarshalLLMConfig parses an llm block:
+//
+//	llm {
+//	    key_header <name>
+//	    prompt_tokens_header <name>
+//	    completion_tokens_header <name>
+//	    max_body <size>
+//	}
+func unmarshalLLMConfig(d *caddyfile.Dispenser) (*LLMConfig, error) {
+	cfg := new(LLMConfig)
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		value := d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "key_header":
+			cfg.KeyHeader = value
+		case "prompt_tokens_header":
+			cfg.PromptTokensHeader = value
+		case "completion_tokens_header":
+			cfg.CompletionTokensHeader = value
+		case "max_body":
+			size, err := humanize.ParseBytes(value)
+			if err != nil || size == 0 {
+				return nil, d.Errf("invalid max_body '%s'", value)
+			}
+			cfg.MaxBody = int64(size)
+		default:
+			return nil, d.Errf("unrecognized llm option '%s'", option)
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,181 @@
+package caddyusage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// serveLLM sends a request through the collector with a handler that writes
+// the given chunks as the response body
+func serveLLM(t *testing.T, uc *UsageCollector, contentType string, header http.Header, chunks ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest("POST", "http://llm.example.com/v1/chat/completions", nil)
+	req.Header.Set("Authorization", "Bearer sk-test-key")
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+		w.Header().Set("Content-Type", contentType)
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(http.StatusOK)
+		for _, chunk := range chunks {
+			if _, err := w.Write([]byte(chunk)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	if err := uc.ServeHTTP(w, req, next); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+	return w
+}
+
+// llmTokens returns the recorded token count for the test API key
+func llmTokens(model, tokenType string) float64 {
+	key := llmAPIKey(&http.Request{Header: http.Header{"Authorization": {"Bearer sk-test-key"}}}, "")
+	return testutil.ToFloat64(globalUsageMetrics.llmTokens.WithLabelValues(key, model, tokenType))
+}
+
+// TestLLMNonStreaming tests token accounting for regular completion responses
+func TestLLMNonStreaming(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	uc.LLM = &LLMConfig{}
+
+	body := `{"id":"chatcmpl-1","model":"gpt-4o","choices":[],"usage":{"prompt_tokens":12,"completion_tokens":30,"total_tokens":42}}`
+	w := serveLLM(t, uc, "application/json", nil, body[:20], body[20:])
+
+	if w.Body.String() != body {
+		t.Error("Response body was not passed through unchanged")
+	}
+	if got := llmTokens("gpt-4o", "prompt"); got != 12 {
+		t.Errorf("Expected 12 prompt tokens, got %v", got)
+	}
+	if got := llmTokens("gpt-4o", "completion"); got != 30 {
+		t.Errorf("Expected 30 completion tokens, got %v", got)
+	}
+}
+
+// TestLLMStreaming tests token accounting for server-sent event streams
+func TestLLMStreaming(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	uc.LLM = &LLMConfig{}
+
+	stream := strings.Join([]string{
+		`data: {"model":"gpt-4o-mini","choices":[{"delta":{"content":"Hel"}}]}`,
+		`data: {"model":"gpt-4o-mini","choices":[{"delta":{"content":"lo"}}]}`,
+		`data: {"model":"gpt-4o-mini","choices":[],"usage":{"prompt_tokens":5,"completion_tokens":2}}`,
+		`data: [DONE]`,
+		``,
+	}, "\n\n")
+
+	// Split mid-line to exercise partial line handling
+	serveLLM(t, uc, "text/event-stream; charset=utf-8", nil, stream[:50], stream[50:130], stream[130:])
+
+	if got := llmTokens("gpt-4o-mini", "prompt"); got != 5 {
+		t.Errorf("Expected 5 prompt tokens, got %v", got)
+	}
+	if got := llmTokens("gpt-4o-mini", "completion"); got != 2 {
+		t.Errorf("Expected 2 completion tokens, got %v", got)
+	}
+}
+
+// TestLLMUsageHeaders tests that upstream usage headers take precedence
+func TestLLMUsageHeaders(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	uc.LLM = &LLMConfig{PromptTokensHeader: "X-Prompt-Tokens", CompletionTokensHeader: "X-Completion-Tokens"}
+
+	header := http.Header{"X-Prompt-Tokens": {"100"}, "X-Completion-Tokens": {"200"}}
+	serveLLM(t, uc, "application/json", header, `{"model":"llama-3"}`)
+
+	if got := llmTokens("llama-3", "prompt"); got != 100 {
+		t.Errorf("Expected 100 prompt tokens, got %v", got)
+	}
+	if got := llmTokens("llama-3", "completion"); got != 200 {
+		t.Errorf("Expected 200 completion tokens, got %v", got)
+	}
+}
+
+// TestLLMSkippedResponses tests responses that cannot be parsed are ignored
+func TestLLMSkippedResponses(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	uc.LLM = &LLMConfig{MaxBody: 64}
+
+	body := `{"model":"gpt-4o","usage":{"prompt_tokens":1,"completion_tokens":1},"padding":"` + strings.Repeat("x", 100) + `"}`
+	serveLLM(t, uc, "application/json", nil, body)
+	serveLLM(t, uc, "application/json", http.Header{"Content-Encoding": {"gzip"}}, `{"model":"gpt-4o","usage":{"prompt_tokens":1}}`)
+	serveLLM(t, uc, "application/json", nil, `not json`)
+
+	if n := testutil.CollectAndCount(globalUsageMetrics.llmTokens); n != 0 {
+		t.Errorf("Expected no token series, got %d", n)
+	}
+}
+
+// TestLLMAPIKey tests API key extraction and hashing
+func TestLLMAPIKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	if got := llmAPIKey(req, ""); got != anonymousAPIKey {
+		t.Errorf("Expected anonymous key, got %s", got)
+	}
+
+	req.Header.Set("Authorization", "Bearer sk-secret")
+	bearer := llmAPIKey(req, "")
+	if bearer == "sk-secret" || strings.Contains(bearer, "secret") {
+		t.Error("API key must be hashed")
+	}
+
+	req.Header.Set("X-Api-Key", "sk-secret")
+	if got := llmAPIKey(req, "X-Api-Key"); got != bearer {
+		t.Error("Expected the same hash for the same key regardless of header")
+	}
+}
+
+// TestUnmarshalLLM tests parsing of the llm block
+func TestUnmarshalLLM(t *testing.T) {
+	input := `usage {
+		llm {
+			key_header X-Api-Key
+			prompt_tokens_header X-Prompt-Tokens
+			completion_tokens_header X-Completion-Tokens
+			max_body 2MiB
+		}
+	}`
+
+	var uc UsageCollector
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := LLMConfig{
+		KeyHeader:              "X-Api-Key",
+		PromptTokensHeader:     "X-Prompt-Tokens",
+		CompletionTokensHeader: "X-Completion-Tokens",
+		MaxBody:                2 << 20,
+	}
+	if uc.LLM == nil || *uc.LLM != expected {
+		t.Errorf("Expected %+v, got %+v", expected, uc.LLM)
+	}
+
+	for _, invalid := range []string{
+		"usage {\n llm {\n max_body lots\n }\n}",
+		"usage {\n llm {\n key_header\n }\n}",
+		"usage {\n llm {\n model gpt\n }\n}",
+	} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
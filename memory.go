@@ -0,0 +1,176 @@
+package caddyusage
+
+import (
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// maxInternedLabels bounds the intern table. Once full, new label values
+// are recorded without interning rather than growing the table further.
+const maxInternedLabels = 1 << 16
+
+// Rough per-entry overheads used for memory estimates. The exact figures
+// depend on the Prometheus client and Go runtime versions; they only need
+// to be right within a small factor for capacity tuning.
+const (
+	seriesOverheadBytes = 256
+	bucketBytes         = 16
+	mapEntryBytes       = 48
+)
+
+// internTable deduplicates label value strings. The same host, path or
+// user agent is typically recorded by several metric vectors; interning
+// makes them all share one copy, detached from the request that
+// produced it, rather than each series keeping its own. The table is
+// cleared when metrics are reset and when handlers are cleaned up, so that
+// it doesn't keep values no series holds anymore.
+type internTable struct {
+	mu     sync.RWMutex
+	values map[string]string
+	bytes  int64
+}
+
+// labelValues is shared by all handlers, like the metrics that hold the values
+var labelValues = &internTable{values: make(map[string]string)}
+
+// intern returns the canonical copy of s
+func (it *internTable) intern(s string) string {
+	it.mu.RLock()
+	canonical, ok := it.values[s]
+	it.mu.RUnlock()
+	if ok {
+		return canonical
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	if canonical, ok := it.values[s]; ok {
+		return canonical
+	}
+	if len(it.values) >= maxInternedLabels {
+		return s
+	}
+
+	canonical = strings.Clone(s)
+	it.values[canonical] = canonical
+	it.bytes += int64(len(canonical))
+	return canonical
+}
+
+// reset forgets all interned values. Series still holding them keep their
+// copies; values recorded again are interned anew.
+func (it *internTable) reset() {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	it.values = make(map[string]string)
+	it.bytes = 0
+}
+
+// size returns the number of interned values and their estimated memory
+func (it *internTable) size() (int, int64) {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	return len(it.values), it.bytes + int64(len(it.values))*mapEntryBytes
+}
+
+// vectorMemory is the estimated memory held by one metric vector
+type vectorMemory struct {
+	Series int   `json:"series"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// memoryReport is the module's estimated memory use by component
+type memoryReport struct {
+	TotalBytes int64                   `json:"total_bytes"`
+	Vectors    map[string]vectorMemory `json:"vectors"`
+	Sketches   map[string]int64        `json:"sketches"`
+	Interned   struct {
+		Values int   `json:"values"`
+		Bytes  int64 `json:"bytes"`
+	} `json:"interned"`
+	Inflight struct {
+		Requests int   `json:"requests"`
+		Bytes    int64 `json:"bytes"`
+	} `json:"inflight"`
+}
+
+// vectorSize estimates the memory held by the series of a metric vector.
+// Label value bytes are counted even though interned values are shared,
+// since the table may not hold them all.
+func vectorSize(vec prometheus.Collector) vectorMemory {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+
+	var size vectorMemory
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			continue
+		}
+
+		size.Series++
+		size.Bytes += seriesOverheadBytes
+		for _, label := range m.GetLabel() {
+			size.Bytes += int64(len(label.GetValue()))
+		}
+		if h := m.GetHistogram(); h != nil {
+			size.Bytes += int64(len(h.GetBucket())) * bucketBytes
+		}
+	}
+	return size
+}
+
+// memoryUsage estimates the memory held by the usage metrics and the
+// module's shared state
+func (um *usageMetrics) memoryUsage() memoryReport {
+	report := memoryReport{
+		Vectors:  make(map[string]vectorMemory),
+		Sketches: make(map[string]int64),
+	}
+
+	for name, vec := range um.vectors() {
+		size := vectorSize(vec)
+		report.Vectors[name] = size
+		report.TotalBytes += size.Bytes
+	}
+
+	for name, sketch := range map[string]*windowedSketch{
+		"active_paths":   um.activePaths,
+		"active_hosts":   um.activeHosts,
+		"active_clients": um.activeClients,
+	} {
+		size := int64(unsafe.Sizeof(*sketch))
+		report.Sketches[name] = size
+		report.TotalBytes += size
+	}
+
+	for window, sketch := range um.uniqueClients {
+		size := int64(unsafe.Sizeof(*sketch))
+		report.Sketches["unique_clients_"+window] = size
+		report.TotalBytes += size
+	}
+
+	for dimension, tracker := range um.topKTrackers() {
+		size := tracker.memory()
+		report.Sketches["top_"+dimension] = size
+		report.TotalBytes += size
+	}
+
+	report.Interned.Values, report.Interned.Bytes = labelValues.size()
+	report.TotalBytes += report.Interned.Bytes
+
+	report.Inflight.Requests = inflight.size()
+	report.Inflight.Bytes = int64(report.Inflight.Requests) * (int64(unsafe.Sizeof(inflightRequest{})) + mapEntryBytes)
+	report.TotalBytes += report.Inflight.Bytes
+
+	return report
+}
@@ -0,0 +1,154 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// TestInternTable tests that equal label values share one copy
+func TestInternTable(t *testing.T) {
+	it := &internTable{values: make(map[string]string)}
+
+	// Build equal strings with distinct backing arrays
+	a := strings.Repeat("example.com", 2)
+	b := strings.Repeat("example.com", 2)
+	if unsafe.StringData(a) == unsafe.StringData(b) {
+		t.Fatal("Test strings unexpectedly share memory")
+	}
+
+	ia, ib := it.intern(a), it.intern(b)
+	if ia != a || unsafe.StringData(ia) != unsafe.StringData(ib) {
+		t.Error("Expected equal values to be interned to the same copy")
+	}
+	if unsafe.StringData(ia) == unsafe.StringData(a) {
+		t.Error("Expected the interned copy to be detached from the original")
+	}
+
+	if values, bytes := it.size(); values != 1 || bytes <= int64(len(a)) {
+		t.Errorf("Expected 1 value of more than %d bytes, got %d values of %d bytes", len(a), values, bytes)
+	}
+}
+
+// TestInternTableFull tests that a full table stops growing
+func TestInternTableFull(t *testing.T) {
+	it := &internTable{values: make(map[string]string, maxInternedLabels)}
+	for i := range maxInternedLabels {
+		it.intern(strconv.Itoa(i))
+	}
+
+	overflow := strings.Repeat("x", 8)
+	if got := it.intern(overflow); unsafe.StringData(got) != unsafe.StringData(overflow) {
+		t.Error("Expected values beyond the limit to be returned as-is")
+	}
+	if values, _ := it.size(); values != maxInternedLabels {
+		t.Errorf("Expected the table to stay at %d values, got %d", maxInternedLabels, values)
+	}
+}
+
+// TestInternTableReset tests that resetting the metrics or cleaning up a
+// handler empties the intern table
+func TestInternTableReset(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	collectTestRequests(t, uc)
+	if values, _ := labelValues.size(); values == 0 {
+		t.Fatal("Expected label values to be interned")
+	}
+	if _, err := resetMetrics("requests_by_ip"); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if values, bytes := labelValues.size(); values != 0 || bytes != 0 {
+		t.Errorf("Expected an empty table after a reset, got %d values of %d bytes", values, bytes)
+	}
+
+	collectTestRequests(t, uc)
+	if err := uc.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if values, _ := labelValues.size(); values != 0 {
+		t.Errorf("Expected an empty table after cleanup, got %d values", values)
+	}
+}
+
+// TestMemoryReport tests the memory report served by the admin API
+func TestMemoryReport(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	req := httptest.NewRequest("GET", "http://example.com/api/users", nil)
+	uc.collectHeaderMetrics(globalUsageMetrics, req, "GET", "200")
+	globalUsageMetrics.requestsTotal.WithLabelValues("200", "GET", "example.com", "/api/users").Inc()
+	globalUsageMetrics.requestDuration.WithLabelValues("GET", "200", "example.com").Observe(0.1)
+
+	rec, err := serveAdmin(t, "/usage/memory", httptest.NewRequest("GET", "/usage/memory", nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var report memoryReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+
+	if got := report.Vectors["requests_total"]; got.Series != 1 || got.Bytes <= seriesOverheadBytes {
+		t.Errorf("Unexpected requests_total estimate: %+v", got)
+	}
+	if histogram, counter := report.Vectors["request_duration_seconds"], report.Vectors["requests_total"]; histogram.Bytes <= counter.Bytes {
+		t.Errorf("Expected the histogram to be estimated larger than the counter, got %d <= %d", histogram.Bytes, counter.Bytes)
+	}
+	if len(report.Sketches) != 8 || report.Sketches["active_paths"] == 0 {
+		t.Errorf("Unexpected sketch estimates: %v", report.Sketches)
+	}
+	if report.TotalBytes <= report.Vectors["requests_total"].Bytes+report.Sketches["active_paths"] {
+		t.Errorf("Expected the total to include every component, got %d", report.TotalBytes)
+	}
+}
+
+// TestMemoryReportNamespace tests the memory report of a namespace's metrics
+func TestMemoryReportNamespace(t *testing.T) {
+	_, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	defer forgetNamespace("site_a")
+
+	siteA, err := registerNamespacedMetrics(registry, "site_a")
+	if err != nil {
+		t.Fatalf("Failed to register site_a metrics: %v", err)
+	}
+	siteA.requestsTotal.WithLabelValues("200", "GET", "example.com", "/").Inc()
+	siteA.requestsTotal.WithLabelValues("404", "GET", "example.com", "/missing").Inc()
+
+	rec, err := serveAdmin(t, "/usage/memory", httptest.NewRequest("GET", "/usage/memory?namespace=site_a", nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var report memoryReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if got := report.Vectors["requests_total"].Series; got != 2 {
+		t.Errorf("Expected the namespace's 2 requests_total series, got %d", got)
+	}
+
+	_, err = serveAdmin(t, "/usage/memory", httptest.NewRequest("GET", "/usage/memory?namespace=site_b", nil))
+	if status := apiErrorStatus(err); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown namespace, got %d", status)
+	}
+}
+
+// TestMemoryReportUninitialized tests the report without initialized metrics
+func TestMemoryReportUninitialized(t *testing.T) {
+	original := globalUsageMetrics
+	globalUsageMetrics = nil
+	defer func() { globalUsageMetrics = original }()
+
+	_, err := serveAdmin(t, "/usage/memory", httptest.NewRequest("GET", "/usage/memory", nil))
+	if status := apiErrorStatus(err); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", status)
+	}
+}
@@ -0,0 +1,222 @@
+package caddyusage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// forgetNamespace drops a namespace's metrics, however many handlers use
+// them
+func forgetNamespace(ns string) {
+	for {
+		if _, ok := namespacedMetrics.References(ns); !ok {
+			return
+		}
+		_, _ = namespacedMetrics.Delete(ns)
+	}
+}
+
+// TestNamespacedMetrics tests that namespaces are isolated from each other
+// and from the shared metrics, and shared between handlers using the same one
+func TestNamespacedMetrics(t *testing.T) {
+	_, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	defer forgetNamespace("site_a")
+	defer forgetNamespace("site_b")
+
+	siteA, err := registerNamespacedMetrics(registry, "site_a")
+	if err != nil {
+		t.Fatalf("Failed to register site_a metrics: %v", err)
+	}
+	siteB, err := registerNamespacedMetrics(registry, "site_b")
+	if err != nil {
+		t.Fatalf("Failed to register site_b metrics: %v", err)
+	}
+	if again, _ := registerNamespacedMetrics(registry, "site_a"); again != siteA {
+		t.Error("Expected handlers with the same namespace to share metrics")
+	}
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	for _, metrics := range []*usageMetrics{siteA, siteA, siteB} {
+		uc := &UsageCollector{logger: zap.NewNop(), metrics: metrics}
+		if err := uc.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil), next); err != nil {
+			t.Fatalf("ServeHTTP failed: %v", err)
+		}
+	}
+
+	requests := func(um *usageMetrics) float64 {
+		return testutil.ToFloat64(um.requestsTotal.WithLabelValues("200", "GET", "example.com", "/"))
+	}
+	if got := requests(siteA); got != 2 {
+		t.Errorf("Expected 2 site_a requests, got %v", got)
+	}
+	if got := requests(siteB); got != 1 {
+		t.Errorf("Expected 1 site_b request, got %v", got)
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.requestsTotal); n != 0 {
+		t.Errorf("Expected the shared metrics to be untouched, got %d series", n)
+	}
+
+	// Each namespace is exposed under its own metric names
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	for _, name := range []string{"site_a_usage_requests_total", "site_b_usage_requests_total"} {
+		if !names[name] {
+			t.Errorf("Expected %s to be registered", name)
+		}
+	}
+}
+
+// TestNamespacedMetricsCleanup tests that a namespace's metrics are
+// unregistered once the last handler using it is cleaned up
+func TestNamespacedMetricsCleanup(t *testing.T) {
+	_, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	defer forgetNamespace("site_a")
+
+	registered := func() bool {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("Gather failed: %v", err)
+		}
+		for _, family := range families {
+			if family.GetName() == "site_a_usage_active_paths" {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Two handlers share the namespace, as on a reload where the new
+	// config is provisioned before the old one is cleaned up
+	var handlers []*UsageCollector
+	for range 2 {
+		metrics, err := registerNamespacedMetrics(registry, "site_a")
+		if err != nil {
+			t.Fatalf("Failed to register site_a metrics: %v", err)
+		}
+		metrics.requestsTotal.WithLabelValues("200", "GET", "example.com", "/").Inc()
+		handlers = append(handlers, &UsageCollector{Namespace: "site_a", metrics: metrics})
+	}
+
+	if err := handlers[0].Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if !registered() {
+		t.Fatal("Expected metrics to stay registered while a handler uses them")
+	}
+
+	if err := handlers[1].Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if registered() {
+		t.Error("Expected metrics to be unregistered after the last handler is cleaned up")
+	}
+	if loadedNamespaceMetrics("site_a") != nil {
+		t.Error("Expected the namespace to be forgotten")
+	}
+
+	// Cleaning up again is a no-op, and the namespace can be used anew
+	if err := handlers[1].Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if _, err := registerNamespacedMetrics(registry, "site_a"); err != nil {
+		t.Fatalf("Failed to register site_a metrics again: %v", err)
+	}
+	if !registered() {
+		t.Error("Expected metrics to be registered again")
+	}
+}
+
+// TestMetricsCarryOverReload tests that on a config reload, which provisions
+// handlers with a new registry before cleaning up the old ones, the shared
+// and namespaced metrics keep their series and are exposed through the new
+// registry
+func TestMetricsCarryOverReload(t *testing.T) {
+	_, oldRegistry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	defer forgetNamespace("site_a")
+
+	siteA, err := registerNamespacedMetrics(oldRegistry, "site_a")
+	if err != nil {
+		t.Fatalf("Failed to register site_a metrics: %v", err)
+	}
+	old := &UsageCollector{Namespace: "site_a", metrics: siteA}
+	globalUsageMetrics.requestsTotal.WithLabelValues("200", "GET", "example.com", "/").Inc()
+	siteA.requestsTotal.WithLabelValues("200", "GET", "example.com", "/").Add(2)
+	siteA.activePaths.add("/", now())
+
+	newRegistry := prometheus.NewRegistry()
+	if err := registerMetrics(newRegistry); err != nil {
+		t.Fatalf("Failed to register metrics: %v", err)
+	}
+	reloaded, err := registerNamespacedMetrics(newRegistry, "site_a")
+	if err != nil {
+		t.Fatalf("Failed to register site_a metrics: %v", err)
+	}
+	if err := old.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	defer releaseNamespacedMetrics("site_a")
+
+	if reloaded != siteA {
+		t.Fatal("Expected the reloaded handler to keep the namespace's metrics")
+	}
+	usagetest.AssertValue(t, newRegistry, "requests_total", nil, 1)
+	usagetest.AssertValue(t, newRegistry, usagetest.Name("site_a", "requests_total"), nil, 2)
+	if got := usagetest.Value(t, newRegistry, usagetest.Name("site_a", "active_paths"), nil); got < 0.5 {
+		t.Errorf("Expected the active paths sketch to carry over, got %v", got)
+	}
+}
+
+// TestNamespaceValidation tests that namespaces must form valid metric names
+func TestNamespaceValidation(t *testing.T) {
+	for ns, valid := range map[string]bool{
+		"":         true,
+		"site_a":   true,
+		"Tenant42": true,
+		"1site":    false,
+		"site-a":   false,
+		"_hidden":  false,
+	} {
+		uc := &UsageCollector{Namespace: ns}
+		if err := uc.Validate(); (err == nil) != valid {
+			t.Errorf("Namespace %q: expected valid=%v, got error %v", ns, valid, err)
+		}
+	}
+}
+
+// TestUnmarshalNamespace tests parsing of the namespace option
+func TestUnmarshalNamespace(t *testing.T) {
+	var uc UsageCollector
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser("usage {\n namespace site_a\n}")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if uc.Namespace != "site_a" {
+		t.Errorf("Expected namespace site_a, got %q", uc.Namespace)
+	}
+
+	for _, invalid := range []string{"usage {\n namespace\n}", "usage {\n namespace a b\n}"} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
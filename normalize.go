@@ -0,0 +1,84 @@
+package caddyusage
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// PathNormalization templates request paths before they are recorded, so
+// that every resource of a route maps to a single series instead of one
+// per ID. Rewrites apply to both the path and full_url labels.
+type PathNormalization struct {
+	// IDs replaces numeric and UUID path segments with :id.
+	IDs bool `json:"ids,omitempty"`
+
+	// Rules are regular expression rewrites applied in order, after
+	// ID replacement.
+	Rules []PathRewrite `json:"rules,omitempty"`
+}
+
+// PathRewrite is a regular expression rewrite of request paths
+type PathRewrite struct {
+	// Match is the regular expression to replace.
+	Match string `json:"match"`
+
+	// Replacement may reference capture groups of Match like $1.
+	Replacement string `json:"replacement"`
+}
+
+// labelRules returns the label policy rules implementing the normalization
+func (pn *PathNormalization) labelRules() []LabelRule {
+	var rules []LabelRule
+	if pn.IDs {
+		rules = append(rules, idSegmentRules...)
+	}
+	for _, rewrite := range pn.Rules {
+		for _, label := range []string{"path", "full_url"} {
+			rules = append(rules, LabelRule{
+				Action:      policyReplace,
+				Label:       label,
+				Match:       rewrite.Match,
+				Replacement: rewrite.Replacement,
+			})
+		}
+	}
+	return rules
+}
+
+// unmarshalPathNormalization parses a normalize_paths directive. Without a
+// block, numeric and UUID segments are templated:
+//
+//	normalize_paths [{
+//	    ids
+//	    <regexp> <replacement>
+//	}]
+func unmarshalPathNormalization(d *caddyfile.Dispenser) (*PathNormalization, error) {
+	pn := new(PathNormalization)
+
+	nesting := d.Nesting()
+	if !d.NextBlock(nesting) {
+		pn.IDs = true
+		return pn, nil
+	}
+
+	for ok := true; ok; ok = d.NextBlock(nesting) {
+		if d.Val() == "ids" {
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			pn.IDs = true
+			continue
+		}
+
+		rewrite := PathRewrite{Match: d.Val()}
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		rewrite.Replacement = d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		pn.Rules = append(pn.Rules, rewrite)
+	}
+
+	return pn, nil
+}
@@ -0,0 +1,105 @@
+package caddyusage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// TestPathNormalization tests ID templating and rewrite rules on the path
+// and full_url labels
+func TestPathNormalization(t *testing.T) {
+	uc := &UsageCollector{
+		NormalizePaths: &PathNormalization{
+			IDs:   true,
+			Rules: []PathRewrite{{Match: `^/files/.*`, Replacement: "/files/*"}},
+		},
+	}
+	if err := uc.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	tests := []struct {
+		label    string
+		value    string
+		expected string
+	}{
+		{"path", "/api/users/123", "/api/users/:id"},
+		{"path", "/api/orders/550e8400-e29b-41d4-a716-446655440000/items", "/api/orders/:id/items"},
+		{"path", "/api/v2/users", "/api/v2/users"},
+		{"path", "/files/docs/report.pdf", "/files/*"},
+		{"full_url", "/api/users/42?expand=true", "/api/users/:id?expand=true"},
+		{"full_url", "/files/a/b?download=1", "/files/*"},
+		{"host", "123.example.com", "123.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.label+" "+tt.value, func(t *testing.T) {
+			if got := uc.policy.apply(nil, tt.label, tt.value); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestPathNormalizationInvalidRule tests that invalid expressions fail provisioning
+func TestPathNormalizationInvalidRule(t *testing.T) {
+	uc := &UsageCollector{
+		NormalizePaths: &PathNormalization{Rules: []PathRewrite{{Match: `(`, Replacement: "x"}}},
+	}
+	if err := uc.Provision(caddy.Context{Context: context.Background()}); err == nil {
+		t.Error("Expected an error for an invalid rewrite expression")
+	}
+}
+
+// TestUnmarshalPathNormalization tests parsing of the normalize_paths option
+func TestUnmarshalPathNormalization(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *PathNormalization
+		expectErr bool
+	}{
+		{
+			input:    "usage {\n normalize_paths\n}",
+			expected: &PathNormalization{IDs: true},
+		},
+		{
+			input: "usage {\n normalize_paths {\n ids\n ^/files/.* /files/*\n }\n}",
+			expected: &PathNormalization{
+				IDs:   true,
+				Rules: []PathRewrite{{Match: `^/files/.*`, Replacement: "/files/*"}},
+			},
+		},
+		{
+			input: "usage {\n normalize_paths {\n ^/u/[^/]+ /u/:name\n }\n}",
+			expected: &PathNormalization{
+				Rules: []PathRewrite{{Match: `^/u/[^/]+`, Replacement: "/u/:name"}},
+			},
+		},
+		{input: "usage {\n normalize_paths extra\n}", expectErr: true},
+		{input: "usage {\n normalize_paths {\n ^/u/.*\n }\n}", expectErr: true},
+		{input: "usage {\n normalize_paths {\n ids now\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.NormalizePaths, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.NormalizePaths)
+			}
+		})
+	}
+}
@@ -0,0 +1,644 @@
+package caddyusage
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// OTLP export defaults and bounds
+const (
+	otlpProtocolGRPC     = "grpc"
+	otlpProtocolHTTP     = "http"
+	defaultOTLPInterval  = 30 * time.Second
+	defaultOTLPGRPCAddr  = "localhost:4317"
+	defaultOTLPHTTPURL   = "http://localhost:4318"
+	otlpHTTPPath         = "/v1/metrics"
+	otlpGRPCMethod       = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	otlpExportTimeout    = 10 * time.Second
+	otlpScopeName        = "github.com/chalabi2/caddy-usage"
+	otlpServiceName      = "caddy"
+	otlpMaxResponseBytes = 64 << 10
+)
+
+// OTLP aggregation temporalities
+const (
+	otlpTemporalityDelta      = 1
+	otlpTemporalityCumulative = 2
+)
+
+// OTLPConfig configures pushing the usage metrics to an OpenTelemetry
+// collector over OTLP.
+type OTLPConfig struct {
+	// Endpoint is the collector's address: host:port for gRPC, or a URL
+	// for HTTP, where /v1/metrics is used if it has no path. Defaults to
+	// localhost:4317 and http://localhost:4318.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Protocol is grpc or http (protobuf over HTTP). Defaults to http.
+	Protocol string `json:"protocol,omitempty"`
+
+	// Interval is the time between pushes. Defaults to 30s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// Headers are sent with every push, such as authentication tokens for
+	// hosted collectors. They are gRPC metadata with the grpc protocol.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Insecure connects to a gRPC endpoint without TLS. HTTP endpoints use
+	// TLS as their URL scheme says.
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// validate checks the protocol, endpoint and interval
+func (oc *OTLPConfig) validate() error {
+	switch oc.Protocol {
+	case "", otlpProtocolGRPC, otlpProtocolHTTP:
+	default:
+		return fmt.Errorf("unknown otlp protocol '%s', expected %s or %s", oc.Protocol, otlpProtocolGRPC, otlpProtocolHTTP)
+	}
+	if oc.Interval < 0 {
+		return fmt.Errorf("otlp interval must not be negative, got %s", time.Duration(oc.Interval))
+	}
+	if oc.protocol() == otlpProtocolHTTP {
+		if _, err := oc.httpURL(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protocol returns the configured protocol or its default
+func (oc *OTLPConfig) protocol() string {
+	if oc.Protocol != "" {
+		return oc.Protocol
+	}
+	return otlpProtocolHTTP
+}
+
+// interval returns the configured interval or its default
+func (oc *OTLPConfig) interval() time.Duration {
+	if oc.Interval > 0 {
+		return time.Duration(oc.Interval)
+	}
+	return defaultOTLPInterval
+}
+
+// httpURL returns the URL metrics are posted to with the http protocol
+func (oc *OTLPConfig) httpURL() (string, error) {
+	endpoint := oc.Endpoint
+	if endpoint == "" {
+		endpoint = defaultOTLPHTTPURL
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid otlp endpoint '%s': expected an http or https URL", oc.Endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpHTTPPath
+	}
+	return u.String(), nil
+}
+
+// grpcAddr returns the address metrics are sent to with the grpc protocol
+func (oc *OTLPConfig) grpcAddr() string {
+	if oc.Endpoint != "" {
+		return oc.Endpoint
+	}
+	return defaultOTLPGRPCAddr
+}
+
+// otlpSender delivers encoded export requests to a collector
+type otlpSender interface {
+	send(ctx context.Context, payload []byte) error
+	close() error
+}
+
+// otlpHTTPSender posts export requests as protobuf over HTTP
+type otlpHTTPSender struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// send implements otlpSender
+func (s *otlpHTTPSender) send(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, otlpMaxResponseBytes))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// close implements otlpSender
+func (s *otlpHTTPSender) close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// otlpGRPCSender calls the collector's metrics service over gRPC
+type otlpGRPCSender struct {
+	conn    *grpc.ClientConn
+	headers metadata.MD
+}
+
+// send implements otlpSender
+func (s *otlpGRPCSender) send(ctx context.Context, payload []byte) error {
+	if len(s.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, s.headers)
+	}
+	var resp []byte
+	return s.conn.Invoke(ctx, otlpGRPCMethod, payload, &resp, grpc.ForceCodec(otlpCodec{}))
+}
+
+// close implements otlpSender
+func (s *otlpGRPCSender) close() error {
+	return s.conn.Close()
+}
+
+// otlpCodec passes export requests and responses through as the protobuf
+// bytes they already are
+type otlpCodec struct{}
+
+// Marshal implements encoding.Codec
+func (otlpCodec) Marshal(v any) ([]byte, error) {
+	payload, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return payload, nil
+}
+
+// Unmarshal implements encoding.Codec
+func (otlpCodec) Unmarshal(data []byte, v any) error {
+	resp, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*resp = append((*resp)[:0], data...)
+	return nil
+}
+
+// Name implements encoding.Codec
+func (otlpCodec) Name() string {
+	return "proto"
+}
+
+// newOTLPSender returns a sender for the configured protocol
+func newOTLPSender(oc *OTLPConfig) (otlpSender, error) {
+	if oc.protocol() == otlpProtocolHTTP {
+		u, err := oc.httpURL()
+		if err != nil {
+			return nil, err
+		}
+		return &otlpHTTPSender{url: u, headers: oc.Headers, client: &http.Client{}}, nil
+	}
+
+	creds := credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	if oc.Insecure {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient(oc.grpcAddr(), grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	return &otlpGRPCSender{conn: conn, headers: metadata.New(oc.Headers)}, nil
+}
+
+// otlpExporter periodically pushes the usage metrics of every set to a
+// collector. Handlers with the same configuration share an exporter, so
+// config reloads keep it running.
+type otlpExporter struct {
+	key      string
+	interval time.Duration
+	sender   otlpSender
+	logger   *zap.Logger
+
+	// Start of the cumulative series, and of the current delta interval
+	start     time.Time
+	lastPush  time.Time
+	pushFails bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// otlpExporterEntry is a shared exporter and the number of handlers using it
+type otlpExporterEntry struct {
+	exporter *otlpExporter
+	refs     int
+}
+
+var (
+	// Running exporters by configuration
+	otlpExporters   = make(map[string]*otlpExporterEntry)
+	otlpExportersMu sync.Mutex
+
+	// otlpStart is when the first exporter started. Usage metrics outlive
+	// config reloads, so their cumulative series all start then.
+	otlpStart     time.Time
+	otlpStartOnce sync.Once
+)
+
+// acquireOTLPExporter returns the running exporter for the configuration,
+// starting one if needed. Each successful call must be balanced by a call
+// to releaseOTLPExporter.
+func acquireOTLPExporter(oc *OTLPConfig, logger *zap.Logger) (*otlpExporter, error) {
+	otlpExportersMu.Lock()
+	defer otlpExportersMu.Unlock()
+
+	key, err := json.Marshal(oc)
+	if err != nil {
+		return nil, err
+	}
+	if entry, ok := otlpExporters[string(key)]; ok {
+		entry.refs++
+		return entry.exporter, nil
+	}
+
+	sender, err := newOTLPSender(oc)
+	if err != nil {
+		return nil, fmt.Errorf("setting up otlp export: %v", err)
+	}
+	otlpStartOnce.Do(func() { otlpStart = now() })
+
+	exporter := &otlpExporter{
+		key:      string(key),
+		interval: oc.interval(),
+		sender:   sender,
+		logger:   logger,
+		start:    otlpStart,
+		lastPush: now(),
+		done:     make(chan struct{}),
+	}
+	exporter.run()
+	claimDeltaResets(exporter)
+	otlpExporters[exporter.key] = &otlpExporterEntry{exporter: exporter, refs: 1}
+	return exporter, nil
+}
+
+// releaseOTLPExporter releases a handler's use of an exporter, stopping it
+// after a final push once no handler uses it anymore
+func releaseOTLPExporter(exporter *otlpExporter) error {
+	otlpExportersMu.Lock()
+	defer otlpExportersMu.Unlock()
+
+	entry, ok := otlpExporters[exporter.key]
+	if !ok || entry.exporter != exporter {
+		return nil
+	}
+	if entry.refs--; entry.refs > 0 {
+		return nil
+	}
+	delete(otlpExporters, exporter.key)
+	defer releaseDeltaResets(exporter)
+	return exporter.stop()
+}
+
+// run pushes the metrics every interval until stopped
+func (e *otlpExporter) run() {
+	ticker := newTicker(e.interval)
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				e.pushLogged()
+			case <-e.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops pushing, pushes a last time and closes the connection
+func (e *otlpExporter) stop() error {
+	close(e.done)
+	e.wg.Wait()
+	e.pushLogged()
+	return e.sender.close()
+}
+
+// pushLogged pushes the metrics, logging when pushes start or stop failing
+func (e *otlpExporter) pushLogged() {
+	err := e.push()
+	switch {
+	case err != nil && !e.pushFails:
+		e.logger.Warn("failed to push usage metrics over otlp", zap.Error(err))
+	case err == nil && e.pushFails:
+		e.logger.Info("pushing usage metrics over otlp again")
+	}
+	e.pushFails = err != nil
+}
+
+// push sends the current usage metrics to the collector
+func (e *otlpExporter) push() error {
+	gatherer, err := usageGatherer()
+	if err != nil {
+		return err
+	}
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	// In delta temporality mode, the exporter owning the resets pushes
+	// what was observed since its previous push, and resets the vectors
+	// once the push went through
+	pushed := now()
+	owner := ownsDeltaResets(e)
+	start, temporality := e.start, otlpTemporalityCumulative
+	if owner {
+		start, temporality = e.lastPush, otlpTemporalityDelta
+	}
+
+	if err := sinkFault(sinkOTLP); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), otlpExportTimeout)
+	defer cancel()
+	if err := e.sender.send(ctx, encodeOTLPMetrics(families, start, pushed, temporality)); err != nil {
+		return err
+	}
+	if owner {
+		resetDeltaSeries()
+	}
+	e.lastPush = pushed
+	return nil
+}
+
+// encodeOTLPMetrics encodes metric families as an OTLP
+// ExportMetricsServiceRequest. Counters become monotonic sums, gauges and
+// untyped metrics gauges, and histograms and summaries keep their type.
+func encodeOTLPMetrics(families []*dto.MetricFamily, start, at time.Time, temporality int) []byte {
+	var scope []byte
+	scope = appendOTLPMessage(scope, 1, appendOTLPString(nil, 1, otlpScopeName))
+	for _, family := range families {
+		scope = appendOTLPMessage(scope, 2, encodeOTLPMetric(family, start, at, temporality))
+	}
+
+	resource := appendOTLPMessage(nil, 1, encodeOTLPAttribute("service.name", otlpServiceName))
+
+	var resourceMetrics []byte
+	resourceMetrics = appendOTLPMessage(resourceMetrics, 1, resource)
+	resourceMetrics = appendOTLPMessage(resourceMetrics, 2, scope)
+
+	return appendOTLPMessage(nil, 1, resourceMetrics)
+}
+
+// encodeOTLPMetric encodes a metric family as an OTLP Metric
+func encodeOTLPMetric(family *dto.MetricFamily, start, at time.Time, temporality int) []byte {
+	var b []byte
+	b = appendOTLPString(b, 1, family.GetName())
+	b = appendOTLPString(b, 2, family.GetHelp())
+
+	startNanos, atNanos := uint64(start.UnixNano()), uint64(at.UnixNano())
+	var data []byte
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		for _, m := range family.Metric {
+			data = appendOTLPMessage(data, 1, encodeOTLPNumber(m, m.GetCounter().GetValue(), startNanos, atNanos))
+		}
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, uint64(temporality))
+		data = protowire.AppendTag(data, 3, protowire.VarintType)
+		data = protowire.AppendVarint(data, 1)
+		return appendOTLPMessage(b, 7, data)
+
+	case dto.MetricType_HISTOGRAM:
+		for _, m := range family.Metric {
+			data = appendOTLPMessage(data, 1, encodeOTLPHistogram(m, startNanos, atNanos))
+		}
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, uint64(temporality))
+		return appendOTLPMessage(b, 9, data)
+
+	case dto.MetricType_SUMMARY:
+		for _, m := range family.Metric {
+			data = appendOTLPMessage(data, 1, encodeOTLPSummary(m, startNanos, atNanos))
+		}
+		return appendOTLPMessage(b, 11, data)
+
+	default:
+		for _, m := range family.Metric {
+			value := m.GetGauge().GetValue()
+			if m.Untyped != nil {
+				value = m.GetUntyped().GetValue()
+			}
+			data = appendOTLPMessage(data, 1, encodeOTLPNumber(m, value, 0, atNanos))
+		}
+		return appendOTLPMessage(b, 5, data)
+	}
+}
+
+// encodeOTLPNumber encodes a NumberDataPoint. A zero start is left out,
+// as gauges have none.
+func encodeOTLPNumber(m *dto.Metric, value float64, start, at uint64) []byte {
+	b := appendOTLPTimes(encodeOTLPAttributes(m, 7), start, at)
+	b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(value))
+}
+
+// encodeOTLPHistogram encodes a HistogramDataPoint
+func encodeOTLPHistogram(m *dto.Metric, start, at uint64) []byte {
+	h := m.GetHistogram()
+	b := appendOTLPTimes(encodeOTLPAttributes(m, 9), start, at)
+	b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, h.GetSampleCount())
+	b = protowire.AppendTag(b, 5, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(h.GetSampleSum()))
+
+	counts, bounds := otlpBuckets(h)
+	var packed []byte
+	for _, count := range counts {
+		packed = protowire.AppendFixed64(packed, count)
+	}
+	b = protowire.AppendTag(b, 6, protowire.BytesType)
+	b = protowire.AppendBytes(b, packed)
+
+	packed = packed[:0]
+	for _, bound := range bounds {
+		packed = protowire.AppendFixed64(packed, math.Float64bits(bound))
+	}
+	b = protowire.AppendTag(b, 7, protowire.BytesType)
+	return protowire.AppendBytes(b, packed)
+}
+
+// otlpBuckets converts a histogram's cumulative buckets to OTLP's per-bucket
+// counts and their finite upper bounds, with one more count than bounds for
+// the overflow bucket
+func otlpBuckets(h *dto.Histogram) ([]uint64, []float64) {
+	counts := make([]uint64, 0, len(h.Bucket)+1)
+	bounds := make([]float64, 0, len(h.Bucket))
+
+	var previous uint64
+	for _, bucket := range h.Bucket {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			break
+		}
+		counts = append(counts, bucket.GetCumulativeCount()-previous)
+		bounds = append(bounds, bucket.GetUpperBound())
+		previous = bucket.GetCumulativeCount()
+	}
+	return append(counts, h.GetSampleCount()-previous), bounds
+}
+
+// encodeOTLPSummary encodes a SummaryDataPoint
+func encodeOTLPSummary(m *dto.Metric, start, at uint64) []byte {
+	s := m.GetSummary()
+	b := appendOTLPTimes(encodeOTLPAttributes(m, 7), start, at)
+	b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, s.GetSampleCount())
+	b = protowire.AppendTag(b, 5, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(s.GetSampleSum()))
+
+	for _, q := range s.Quantile {
+		var quantile []byte
+		quantile = protowire.AppendTag(quantile, 1, protowire.Fixed64Type)
+		quantile = protowire.AppendFixed64(quantile, math.Float64bits(q.GetQuantile()))
+		quantile = protowire.AppendTag(quantile, 2, protowire.Fixed64Type)
+		quantile = protowire.AppendFixed64(quantile, math.Float64bits(q.GetValue()))
+		b = appendOTLPMessage(b, 6, quantile)
+	}
+	return b
+}
+
+// encodeOTLPAttributes encodes a metric's labels as KeyValue attributes
+// in field num
+func encodeOTLPAttributes(m *dto.Metric, num protowire.Number) []byte {
+	var b []byte
+	for _, label := range m.Label {
+		b = appendOTLPMessage(b, num, encodeOTLPAttribute(label.GetName(), label.GetValue()))
+	}
+	return b
+}
+
+// encodeOTLPAttribute encodes a KeyValue with a string value
+func encodeOTLPAttribute(key, value string) []byte {
+	b := appendOTLPString(nil, 1, key)
+	return appendOTLPMessage(b, 2, appendOTLPString(nil, 1, value))
+}
+
+// appendOTLPTimes appends a data point's start and timestamp, leaving out
+// a zero start
+func appendOTLPTimes(b []byte, start, at uint64) []byte {
+	if start != 0 {
+		b = protowire.AppendTag(b, 2, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, start)
+	}
+	b = protowire.AppendTag(b, 3, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, at)
+}
+
+// appendOTLPMessage appends an embedded message field
+func appendOTLPMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// appendOTLPString appends a string field, leaving out empty ones
+func appendOTLPString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// unmarshalOTLPConfig parses an otlp block:
+//
+//	otlp {
+//	    endpoint <address>
+//	    protocol grpc|http
+//	    interval <duration>
+//	    header <name> <value>
+//	    insecure
+//	}
+func unmarshalOTLPConfig(d *caddyfile.Dispenser) (*OTLPConfig, error) {
+	oc := new(OTLPConfig)
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "endpoint", "protocol", "interval":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			value := d.Val()
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			switch option {
+			case "endpoint":
+				oc.Endpoint = value
+			case "protocol":
+				oc.Protocol = value
+			case "interval":
+				dur, err := caddy.ParseDuration(value)
+				if err != nil {
+					return nil, d.Errf("invalid otlp interval '%s': %v", value, err)
+				}
+				oc.Interval = caddy.Duration(dur)
+			}
+
+		case "header":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return nil, d.ArgErr()
+			}
+			if oc.Headers == nil {
+				oc.Headers = make(map[string]string)
+			}
+			oc.Headers[args[0]] = args[1]
+
+		case "insecure":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			oc.Insecure = true
+
+		default:
+			return nil, d.Errf("unrecognized otlp option '%s'", option)
+		}
+	}
+
+	return oc, nil
+}
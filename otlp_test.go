@@ -0,0 +1,189 @@
+package caddyusage
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestOTLPBuckets tests the conversion of cumulative histogram buckets to
+// per-bucket counts
+func TestOTLPBuckets(t *testing.T) {
+	h := &dto.Histogram{
+		SampleCount: proto.Uint64(10),
+		Bucket: []*dto.Bucket{
+			{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(2)},
+			{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(7)},
+			{UpperBound: proto.Float64(5), CumulativeCount: proto.Uint64(7)},
+		},
+	}
+
+	counts, bounds := otlpBuckets(h)
+	if expected := []uint64{2, 5, 0, 3}; !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Expected counts %v, got %v", expected, counts)
+	}
+	if expected := []float64{0.1, 1, 5}; !reflect.DeepEqual(bounds, expected) {
+		t.Errorf("Expected bounds %v, got %v", expected, bounds)
+	}
+}
+
+// TestOTLPExport tests pushing the usage metrics over HTTP, with a final
+// push when the last handler releases the exporter
+func TestOTLPExport(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+	rec.WriteHeader(200)
+	uc.collectMetrics(rec, req, now(), nil)
+
+	var (
+		mu     sync.Mutex
+		pushes []*http.Request
+		bodies [][]byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		pushes = append(pushes, r)
+		bodies = append(bodies, body)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	cfg := &OTLPConfig{Endpoint: server.URL, Headers: map[string]string{"Authorization": "Bearer token"}}
+	first, err := acquireOTLPExporter(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	second, err := acquireOTLPExporter(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first != second {
+		t.Error("Expected handlers with the same configuration to share an exporter")
+	}
+
+	if err := releaseOTLPExporter(first); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mu.Lock()
+	if len(pushes) != 0 {
+		t.Errorf("Expected no push while the exporter is in use, got %d", len(pushes))
+	}
+	mu.Unlock()
+
+	if err := releaseOTLPExporter(second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(pushes) != 1 {
+		t.Fatalf("Expected a final push, got %d", len(pushes))
+	}
+	push := pushes[0]
+	if push.URL.Path != otlpHTTPPath {
+		t.Errorf("Expected a push to %s, got %s", otlpHTTPPath, push.URL.Path)
+	}
+	if got := push.Header.Get("Content-Type"); got != "application/x-protobuf" {
+		t.Errorf("Expected protobuf content, got %s", got)
+	}
+	if got := push.Header.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Expected the configured header, got %q", got)
+	}
+	for _, expected := range []string{"caddy_usage_requests_total", "example.com", otlpScopeName} {
+		if !bytes.Contains(bodies[0], []byte(expected)) {
+			t.Errorf("Expected the export request to contain %s", expected)
+		}
+	}
+}
+
+// TestOTLPConfigValidate tests validation of the otlp options
+func TestOTLPConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg       OTLPConfig
+		expectErr bool
+	}{
+		{cfg: OTLPConfig{}},
+		{cfg: OTLPConfig{Protocol: "grpc", Endpoint: "collector:4317"}},
+		{cfg: OTLPConfig{Protocol: "http", Endpoint: "https://otlp.example.com"}},
+		{cfg: OTLPConfig{Protocol: "udp"}, expectErr: true},
+		{cfg: OTLPConfig{Protocol: "http", Endpoint: "collector:4318"}, expectErr: true},
+		{cfg: OTLPConfig{Interval: -1}, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		err := tt.cfg.validate()
+		if tt.expectErr && err == nil {
+			t.Errorf("%+v: expected an error but got none", tt.cfg)
+		}
+		if !tt.expectErr && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tt.cfg, err)
+		}
+	}
+
+	if got, _ := (&OTLPConfig{Endpoint: "https://otlp.example.com"}).httpURL(); got != "https://otlp.example.com/v1/metrics" {
+		t.Errorf("Expected the default path to be added, got %s", got)
+	}
+	if got, _ := (&OTLPConfig{Endpoint: "https://otlp.example.com/otlp/v1/metrics"}).httpURL(); got != "https://otlp.example.com/otlp/v1/metrics" {
+		t.Errorf("Expected the path to be kept, got %s", got)
+	}
+}
+
+// TestUnmarshalOTLP tests parsing of the otlp block
+func TestUnmarshalOTLP(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *OTLPConfig
+		expectErr bool
+	}{
+		{input: "usage {\n otlp\n}", expected: &OTLPConfig{}},
+		{
+			input: "usage {\n otlp {\n endpoint collector:4317\n protocol grpc\n interval 1m\n header x-api-key secret\n insecure\n }\n}",
+			expected: &OTLPConfig{
+				Endpoint: "collector:4317",
+				Protocol: "grpc",
+				Interval: caddy.Duration(time.Minute),
+				Headers:  map[string]string{"x-api-key": "secret"},
+				Insecure: true,
+			},
+		},
+		{input: "usage {\n otlp {\n interval soon\n }\n}", expectErr: true},
+		{input: "usage {\n otlp {\n header x-api-key\n }\n}", expectErr: true},
+		{input: "usage {\n otlp {\n compression gzip\n }\n}", expectErr: true},
+		{input: "usage {\n otlp collector:4317\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.OTLP, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.OTLP)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package caddyusage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces the file at path with data, so that readers and
+// crashes only ever see the old or the new contents. The data is written to
+// a temporary file in the same directory, flushed to disk and renamed over
+// path; the directory is then flushed where the platform allows it, so that
+// the rename itself survives a crash.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	// A unique name keeps processes sharing the directory from writing to
+	// the same temporary file
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	// Fails harmlessly once the file was renamed
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := renameFile(tmp.Name(), path); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// fileLock is an exclusive lock on a file shared between processes
+type fileLock struct {
+	f *os.File
+}
+
+// lockFile takes an exclusive lock guarding path, waiting while another
+// process holds it. The lock is held on a separate path.lock file, since
+// writeFileAtomic replaces path itself. Locks are advisory: they only
+// exclude other users of lockFile, and on platforms without file locking,
+// nothing.
+func lockFile(path string) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockHandle(f); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &fileLock{f: f}, nil
+}
+
+// unlock releases the lock. The lock file is left in place, as removing
+// it would let a waiting process lock a file that no longer exists.
+func (l *fileLock) unlock() error {
+	err := unlockHandle(l.f)
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
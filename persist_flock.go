@@ -0,0 +1,29 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package caddyusage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fileLocking reports whether lockFile excludes other processes
+const fileLocking = true
+
+// lockHandle takes an exclusive flock on f, waiting for it. flock locks
+// belong to the open file, so they also exclude other opens of the file
+// within this process.
+func lockHandle(f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if !errors.Is(err, syscall.EINTR) {
+			return err
+		}
+	}
+}
+
+// unlockHandle releases the flock on f
+func unlockHandle(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
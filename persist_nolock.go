@@ -0,0 +1,20 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package caddyusage
+
+import "os"
+
+// fileLocking reports whether lockFile excludes other processes. Other
+// platforms lack flock, and their fcntl locks are released when any file
+// of the process is closed, so files are not locked there.
+const fileLocking = false
+
+// lockHandle does nothing on platforms without file locking
+func lockHandle(*os.File) error {
+	return nil
+}
+
+// unlockHandle does nothing on platforms without file locking
+func unlockHandle(*os.File) error {
+	return nil
+}
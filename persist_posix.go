@@ -0,0 +1,22 @@
+//go:build !windows
+
+package caddyusage
+
+import "os"
+
+// renameFile renames oldpath over newpath, which POSIX does atomically
+func renameFile(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// syncDir flushes a directory's entries to disk, making renames within it
+// durable. It is best effort: some file systems don't support it, and
+// the data itself was already flushed.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
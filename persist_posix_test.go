@@ -0,0 +1,29 @@
+//go:build !windows
+
+package caddyusage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteFileAtomicMode tests that files get the requested permissions,
+// whatever the umask and the previous file's mode
+func TestWriteFileAtomicMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if err := writeFileAtomic(path, []byte("new"), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("Expected mode 0600, got %o", mode)
+	}
+}
@@ -0,0 +1,77 @@
+package caddyusage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestWriteFileAtomic tests that files are created, replaced, and that no
+// temporary file is left behind
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nested", "state.json")
+
+	for _, contents := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(contents), 0o600); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read file: %v", err)
+		}
+		if string(data) != contents {
+			t.Errorf("Expected %q, got %q", contents, data)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("Failed to list directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the file, got %d entries", len(entries))
+	}
+}
+
+// TestLockFile tests that a file lock excludes other holders until it is
+// released
+func TestLockFile(t *testing.T) {
+	if !fileLocking {
+		t.Skip("files are not locked on this platform")
+	}
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	lock, err := lockFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	acquired := make(chan *fileLock)
+	go func() {
+		other, err := lockFile(path)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		acquired <- other
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Expected the lock to be held")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := lock.unlock(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	select {
+	case other := <-acquired:
+		if other != nil {
+			_ = other.unlock()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the lock to be acquired once released")
+	}
+}
@@ -0,0 +1,51 @@
+//go:build windows
+
+package caddyusage
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// fileLocking reports whether lockFile excludes other processes
+const fileLocking = true
+
+// Retries of renames over files that are open elsewhere
+const (
+	renameRetries    = 10
+	renameRetryDelay = 50 * time.Millisecond
+)
+
+// lockHandle takes an exclusive lock on the first byte of f, waiting for
+// it. Windows locks are mandatory for the locked range, which holds no
+// data here.
+func lockHandle(f *os.File) error {
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, new(windows.Overlapped))
+}
+
+// unlockHandle releases the lock on f
+func unlockHandle(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, new(windows.Overlapped))
+}
+
+// renameFile renames oldpath over newpath. Windows refuses to replace a
+// file another process has open, unless it shared deletion, which Go and
+// most programs don't; such opens are usually brief reads, so the rename
+// is retried for a while.
+func renameFile(oldpath, newpath string) error {
+	for i := 0; ; i++ {
+		err := os.Rename(oldpath, newpath)
+		if err == nil || i == renameRetries ||
+			(!errors.Is(err, windows.ERROR_ACCESS_DENIED) && !errors.Is(err, windows.ERROR_SHARING_VIOLATION)) {
+			return err
+		}
+		time.Sleep(renameRetryDelay)
+	}
+}
+
+// syncDir does nothing: Windows can't flush directories, and NTFS
+// journals renames
+func syncDir(string) {}
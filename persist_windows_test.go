@@ -0,0 +1,56 @@
+//go:build windows
+
+package caddyusage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestWriteFileAtomicOpenFile tests that a file open for reading elsewhere
+// is replaced once it is closed, which Windows otherwise refuses
+func TestWriteFileAtomicOpenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("old"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	reader, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	time.AfterFunc(100*time.Millisecond, func() { _ = reader.Close() })
+
+	if err := writeFileAtomic(path, []byte("new"), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if string(data) != "new" {
+		t.Errorf("Expected the new contents, got %q", data)
+	}
+}
+
+// TestLockFileWindowsPath tests locking a path with a drive letter and
+// backslashes
+func TestLockFileWindowsPath(t *testing.T) {
+	dir, err := filepath.Abs(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to resolve directory: %v", err)
+	}
+	if filepath.VolumeName(dir) == "" {
+		t.Fatalf("Expected a volume name in %s", dir)
+	}
+
+	lock, err := lockFile(dir + `\sub\state.json`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := lock.unlock(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
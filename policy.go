@@ -0,0 +1,269 @@
+package caddyusage
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/cespare/xxhash/v2"
+)
+
+// Label policy actions
+const (
+	policyAllow    = "allow"
+	policyDeny     = "deny"
+	policyReplace  = "replace"
+	policyTruncate = "truncate"
+	policyHash     = "hash"
+)
+
+// deniedLabelValue replaces label values rejected by a deny rule
+const deniedLabelValue = "other"
+
+// LabelRule is a single step of the label policy. Rules are evaluated in
+// order against the value of one label (or every label when Label is "*").
+// allow and deny stop evaluation when they match; replace, truncate and hash
+// transform the value and let evaluation continue.
+type LabelRule struct {
+	// Action is one of allow, deny, replace, truncate or hash.
+	Action string `json:"action"`
+
+	// Label is the metric label the rule applies to, such as path,
+	// client_ip or header_value. Use "*" to match every label.
+	Label string `json:"label"`
+
+	// Match is an optional regular expression the value must match for
+	// the rule to apply. An empty Match applies to every value.
+	Match string `json:"match,omitempty"`
+
+	// Replacement is the replacement string for replace rules, which may
+	// reference capture groups of Match like $1.
+	Replacement string `json:"replacement,omitempty"`
+
+	// MaxLength is the maximum value length kept by truncate rules.
+	MaxLength int `json:"max_length,omitempty"`
+}
+
+// defaultLabelRules are always evaluated after the configured rules. They
+// keep client-controlled values from exploding label cardinality.
+var defaultLabelRules = []LabelRule{
+	{Action: policyTruncate, Label: "header_value", MaxLength: 100},
+	{Action: policyDeny, Label: "rpc_method", Match: `[^A-Za-z0-9_.:/-]`},
+	{Action: policyTruncate, Label: "rpc_method", MaxLength: 64},
+	{Action: policyDeny, Label: "soap_action", Match: `[^A-Za-z0-9_.:/#-]`},
+	{Action: policyTruncate, Label: "soap_action", MaxLength: 128},
+	{Action: policyTruncate, Label: "inspected_value", MaxLength: 64},
+}
+
+// compiledLabelRule is a LabelRule with its expression compiled
+type compiledLabelRule struct {
+	LabelRule
+	pos   int
+	index string
+	re    *regexp.Regexp
+}
+
+// labelPolicy decides, for every recorded label value, whether it is kept,
+// replaced, or transformed. It centralizes the module's cardinality and
+// privacy handling so each collector doesn't need its own ad-hoc rules.
+type labelPolicy struct {
+	byLabel  map[string][]*compiledLabelRule
+	wildcard []*compiledLabelRule
+}
+
+// defaultLabelPolicy is used by handlers that were not provisioned with a policy
+var defaultLabelPolicy = mustCompileLabelPolicy(nil)
+
+// compileLabelPolicy validates and compiles the configured rules followed by
+// the default rules
+func compileLabelPolicy(rules []LabelRule) (*labelPolicy, error) {
+	lp := &labelPolicy{byLabel: make(map[string][]*compiledLabelRule)}
+
+	all := make([]LabelRule, 0, len(rules)+len(defaultLabelRules))
+	all = append(all, rules...)
+	all = append(all, defaultLabelRules...)
+
+	for i, rule := range all {
+		if rule.Label == "" {
+			return nil, fmt.Errorf("label policy rule %d: label is required", i)
+		}
+
+		switch rule.Action {
+		case policyAllow, policyDeny, policyHash:
+		case policyReplace:
+			if rule.Match == "" {
+				return nil, fmt.Errorf("label policy rule %d: replace requires a match expression", i)
+			}
+		case policyTruncate:
+			if rule.MaxLength <= 0 {
+				return nil, fmt.Errorf("label policy rule %d: truncate requires a positive max_length", i)
+			}
+		default:
+			return nil, fmt.Errorf("label policy rule %d: unknown action '%s'", i, rule.Action)
+		}
+
+		compiled := &compiledLabelRule{LabelRule: rule, pos: i, index: strconv.Itoa(i)}
+		if rule.Match != "" {
+			re, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("label policy rule %d: invalid match expression: %v", i, err)
+			}
+			compiled.re = re
+		}
+
+		if rule.Label == "*" {
+			lp.wildcard = append(lp.wildcard, compiled)
+		} else {
+			lp.byLabel[rule.Label] = append(lp.byLabel[rule.Label], compiled)
+		}
+	}
+
+	// Wildcard rules are evaluated in their configured position relative to
+	// label-specific rules, so merge them into every label's rule list
+	if len(lp.wildcard) > 0 {
+		for label, labelRules := range lp.byLabel {
+			lp.byLabel[label] = mergeRules(labelRules, lp.wildcard)
+		}
+	}
+
+	return lp, nil
+}
+
+// mustCompileLabelPolicy is like compileLabelPolicy but panics on error
+func mustCompileLabelPolicy(rules []LabelRule) *labelPolicy {
+	lp, err := compileLabelPolicy(rules)
+	if err != nil {
+		panic(err)
+	}
+	return lp
+}
+
+// mergeRules merges two rule lists, each already in configuration order
+func mergeRules(a, b []*compiledLabelRule) []*compiledLabelRule {
+	merged := make([]*compiledLabelRule, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if a[0].pos < b[0].pos {
+			merged, a = append(merged, a[0]), a[1:]
+		} else {
+			merged, b = append(merged, b[0]), b[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
+
+// apply runs the policy for one label value and returns the interned value
+// to record. Rule hits are counted on um when it is non-nil.
+func (lp *labelPolicy) apply(um *usageMetrics, label, value string) string {
+	if lp == nil {
+		lp = defaultLabelPolicy
+	}
+
+	rules, ok := lp.byLabel[label]
+	if !ok {
+		rules = lp.wildcard
+	}
+
+	for _, rule := range rules {
+		if rule.re != nil && !rule.re.MatchString(value) {
+			continue
+		}
+
+		switch rule.Action {
+		case policyAllow:
+			lp.hit(um, label, rule)
+			return labelValues.intern(value)
+
+		case policyDeny:
+			lp.hit(um, label, rule)
+			return deniedLabelValue
+
+		case policyReplace:
+			value = rule.re.ReplaceAllString(value, rule.Replacement)
+
+		case policyTruncate:
+			if len(value) <= rule.MaxLength {
+				continue
+			}
+			value = value[:rule.MaxLength] + "..."
+
+		case policyHash:
+			value = hashValue(value)
+		}
+
+		lp.hit(um, label, rule)
+	}
+
+	return labelValues.intern(value)
+}
+
+// hashValue returns the hash recorded in place of a label value by the
+// hash action, and by options hashing identities like user IDs
+func hashValue(value string) string {
+	return strconv.FormatUint(xxhash.Sum64String(value), 16)
+}
+
+// hit records that a rule changed or decided a label value
+func (lp *labelPolicy) hit(um *usageMetrics, label string, rule *compiledLabelRule) {
+	if um == nil {
+		return
+	}
+	um.labelPolicyHits.WithLabelValues(label, rule.Action, rule.index).Inc()
+}
+
+// unmarshalLabelPolicy parses a label_policy block:
+//
+//	label_policy {
+//	    allow    <label> [<regexp>]
+//	    deny     <label> [<regexp>]
+//	    replace  <label> <regexp> <replacement>
+//	    truncate <label> <max_length>
+//	    hash     <label> [<regexp>]
+//	}
+func unmarshalLabelPolicy(d *caddyfile.Dispenser) ([]LabelRule, error) {
+	var rules []LabelRule
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		rule := LabelRule{Action: d.Val()}
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return nil, d.ArgErr()
+		}
+		rule.Label = args[0]
+		args = args[1:]
+
+		switch rule.Action {
+		case policyAllow, policyDeny, policyHash:
+			if len(args) > 1 {
+				return nil, d.ArgErr()
+			}
+			if len(args) == 1 {
+				rule.Match = args[0]
+			}
+
+		case policyReplace:
+			if len(args) != 2 {
+				return nil, d.ArgErr()
+			}
+			rule.Match, rule.Replacement = args[0], args[1]
+
+		case policyTruncate:
+			if len(args) != 1 {
+				return nil, d.ArgErr()
+			}
+			maxLength, err := strconv.Atoi(args[0])
+			if err != nil || maxLength <= 0 {
+				return nil, d.Errf("invalid truncate length '%s'", args[0])
+			}
+			rule.MaxLength = maxLength
+
+		default:
+			return nil, d.Errf("unrecognized label_policy action '%s'", rule.Action)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,157 @@
+package caddyusage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestLabelPolicyApply tests rule evaluation order and actions
+func TestLabelPolicyApply(t *testing.T) {
+	rules := []LabelRule{
+		{Action: policyAllow, Label: "path", Match: `^/health$`},
+		{Action: policyReplace, Label: "path", Match: `/[0-9]+`, Replacement: "/:id"},
+		{Action: policyDeny, Label: "client_ip", Match: `^10\.`},
+		{Action: policyHash, Label: "user"},
+		{Action: policyTruncate, Label: "*", MaxLength: 8},
+	}
+
+	lp, err := compileLabelPolicy(rules)
+	if err != nil {
+		t.Fatalf("Failed to compile policy: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		label    string
+		value    string
+		expected string
+	}{
+		{"allow stops evaluation", "path", "/health", "/health"},
+		{"replace then wildcard truncate", "path", "/u/123", "/u/:id"},
+		{"replace chained into truncate", "path", "/users/123/posts/456", "/users/:..."},
+		{"deny", "client_ip", "10.0.0.1", deniedLabelValue},
+		{"not denied then truncated", "client_ip", "192.168.1.1", "192.168...."},
+		{"wildcard only", "host", "example.com", "example...."},
+		{"short values untouched", "method", "GET", "GET"},
+		{"default header truncation", "header_value", strings.Repeat("a", 150), strings.Repeat("a", 8) + "..."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lp.apply(nil, tt.label, tt.value); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	// Hashing is stable and never exposes the original value
+	hashed := lp.apply(nil, "user", "alice")
+	if hashed == "alice" || hashed != lp.apply(nil, "user", "alice") {
+		t.Errorf("Expected a stable hash, got %q", hashed)
+	}
+}
+
+// TestDefaultLabelPolicy tests the behavior of handlers without a configured policy
+func TestDefaultLabelPolicy(t *testing.T) {
+	var lp *labelPolicy
+
+	long := strings.Repeat("x", 150)
+	if got := lp.apply(nil, "header_value", long); got != long[:100]+"..." {
+		t.Errorf("Expected header value truncated to 100 characters, got %d", len(got))
+	}
+	if got := lp.apply(nil, "path", long); got != long {
+		t.Error("Expected path to be untouched by the default policy")
+	}
+}
+
+// TestLabelPolicyCompileErrors tests rejection of invalid rules
+func TestLabelPolicyCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule LabelRule
+	}{
+		{"missing label", LabelRule{Action: policyAllow}},
+		{"unknown action", LabelRule{Action: "explode", Label: "path"}},
+		{"replace without match", LabelRule{Action: policyReplace, Label: "path"}},
+		{"truncate without length", LabelRule{Action: policyTruncate, Label: "path"}},
+		{"invalid regexp", LabelRule{Action: policyDeny, Label: "path", Match: "("}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := compileLabelPolicy([]LabelRule{tt.rule}); err == nil {
+				t.Error("Expected an error but got none")
+			}
+		})
+	}
+}
+
+// TestLabelPolicyHits tests that rule hits are counted
+func TestLabelPolicyHits(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	lp, err := compileLabelPolicy([]LabelRule{{Action: policyDeny, Label: "client_ip", Match: `^10\.`}})
+	if err != nil {
+		t.Fatalf("Failed to compile policy: %v", err)
+	}
+	uc.policy = lp
+
+	lp.apply(globalUsageMetrics, "client_ip", "10.1.2.3")
+	lp.apply(globalUsageMetrics, "client_ip", "10.4.5.6")
+	lp.apply(globalUsageMetrics, "client_ip", "192.168.1.1")
+
+	if got := testutil.ToFloat64(globalUsageMetrics.labelPolicyHits.WithLabelValues("client_ip", policyDeny, "0")); got != 2 {
+		t.Errorf("Expected 2 deny hits, got %v", got)
+	}
+}
+
+// TestUnmarshalLabelPolicy tests parsing of the label_policy block
+func TestUnmarshalLabelPolicy(t *testing.T) {
+	input := `usage {
+		label_policy {
+			allow path ^/api/
+			deny client_ip ^10\.
+			replace path /[0-9]+ /:id
+			truncate header_value 64
+			hash client_ip
+		}
+	}`
+
+	var uc UsageCollector
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []LabelRule{
+		{Action: policyAllow, Label: "path", Match: "^/api/"},
+		{Action: policyDeny, Label: "client_ip", Match: `^10\.`},
+		{Action: policyReplace, Label: "path", Match: "/[0-9]+", Replacement: "/:id"},
+		{Action: policyTruncate, Label: "header_value", MaxLength: 64},
+		{Action: policyHash, Label: "client_ip"},
+	}
+
+	if len(uc.LabelPolicy) != len(expected) {
+		t.Fatalf("Expected %d rules, got %d", len(expected), len(uc.LabelPolicy))
+	}
+	for i, rule := range expected {
+		if uc.LabelPolicy[i] != rule {
+			t.Errorf("Rule %d: expected %+v, got %+v", i, rule, uc.LabelPolicy[i])
+		}
+	}
+
+	for _, invalid := range []string{
+		"usage {\n label_policy {\n explode path\n }\n}",
+		"usage {\n label_policy {\n truncate path many\n }\n}",
+		"usage {\n label_policy {\n replace path /x\n }\n}",
+		"usage {\n label_policy {\n allow\n }\n}",
+	} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
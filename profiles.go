@@ -0,0 +1,121 @@
+package caddyusage
+
+import (
+	"sort"
+	"time"
+)
+
+// Shared label rules used by the built-in profiles
+var (
+	// stripQueryRule drops the query string from the full_url label
+	stripQueryRule = LabelRule{Action: policyReplace, Label: "full_url", Match: `\?.*$`, Replacement: ""}
+
+	// idSegmentRules replace numeric and UUID path segments with :id
+	idSegmentRules = []LabelRule{
+		{Action: policyReplace, Label: "path", Match: `/[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`, Replacement: "/:id"},
+		{Action: policyReplace, Label: "path", Match: `/[0-9]+\b`, Replacement: "/:id"},
+		{Action: policyReplace, Label: "full_url", Match: `/[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`, Replacement: "/:id"},
+		{Action: policyReplace, Label: "full_url", Match: `/[0-9]+\b`, Replacement: "/:id"},
+	}
+)
+
+// metricLevel is how many of the metrics collected by default a profile
+// keeps. Metrics of explicitly configured options are collected at every
+// level.
+type metricLevel int
+
+const (
+	// levelVerbose collects every metric, the default
+	levelVerbose metricLevel = iota
+
+	// levelStandard collects requests_total, request_duration_seconds,
+	// requests_by_ip_total and requests_by_url_total
+	levelStandard
+
+	// levelMinimal collects requests_total and request_duration_seconds
+	levelMinimal
+)
+
+// usageProfile is a curated set of defaults for a common deployment type.
+// Explicitly configured options always take precedence over the profile.
+type usageProfile struct {
+	// labelPolicy is evaluated after the configured label policy
+	labelPolicy []LabelRule
+
+	// activeWindow is used when no active_window is configured
+	activeWindow time.Duration
+
+	// metrics selects the metrics collected by default
+	metrics metricLevel
+}
+
+// usageProfiles are the profiles selectable with the profile option
+var usageProfiles = map[string]usageProfile{
+	// minimal suits low-memory edge nodes: only requests_total and
+	// request_duration_seconds are collected, with resource IDs templated
+	// out of paths. Per-client, per-URL and per-header values of
+	// explicitly configured options are collapsed into a single series.
+	"minimal": {
+		labelPolicy: append([]LabelRule{
+			{Action: policyDeny, Label: "full_url"},
+			{Action: policyDeny, Label: "client_ip"},
+			{Action: policyDeny, Label: "header_value"},
+		}, idSegmentRules...),
+		metrics: levelMinimal,
+	},
+
+	// standard adds the requests by client IP and URL to minimal's
+	// metrics, leaving out headers, content types and the other
+	// dimensions collected by default
+	"standard": {
+		metrics: levelStandard,
+	},
+
+	// verbose collects every metric, like no profile, for selecting it
+	// explicitly
+	"verbose": {
+		metrics: levelVerbose,
+	},
+
+	// web suits sites serving pages to browsers: query strings are dropped
+	// and paths are kept but bounded in length
+	"web": {
+		labelPolicy: []LabelRule{
+			stripQueryRule,
+			{Action: policyTruncate, Label: "path", MaxLength: 200},
+			{Action: policyTruncate, Label: "full_url", MaxLength: 200},
+		},
+		activeWindow: 15 * time.Minute,
+	},
+
+	// api suits JSON/REST backends: resource IDs are templated out of
+	// paths so each route maps to one series
+	"api": {
+		labelPolicy: append(append([]LabelRule{stripQueryRule}, idSegmentRules...),
+			LabelRule{Action: policyTruncate, Label: "header_value", MaxLength: 64},
+		),
+	},
+
+	// cdn suits high-volume asset delivery with very diverse clients:
+	// client IPs are collapsed and URLs bounded
+	"cdn": {
+		labelPolicy: []LabelRule{
+			stripQueryRule,
+			{Action: policyDeny, Label: "client_ip"},
+			{Action: policyTruncate, Label: "path", MaxLength: 100},
+			{Action: policyTruncate, Label: "full_url", MaxLength: 100},
+			{Action: policyTruncate, Label: "header_value", MaxLength: 64},
+		},
+		activeWindow: time.Minute,
+	},
+}
+
+// profileNames returns the names of all built-in profiles, sorted
+func profileNames() []string {
+	names := make([]string, 0, len(usageProfiles))
+	for name := range usageProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
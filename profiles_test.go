@@ -0,0 +1,184 @@
+package caddyusage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestProfilesCompile tests that every built-in profile produces a valid policy
+func TestProfilesCompile(t *testing.T) {
+	for _, name := range profileNames() {
+		t.Run(name, func(t *testing.T) {
+			if _, err := compileLabelPolicy(usageProfiles[name].labelPolicy); err != nil {
+				t.Errorf("Profile %s has an invalid label policy: %v", name, err)
+			}
+		})
+	}
+}
+
+// TestProfileLabelPolicy tests the normalization applied by the profiles
+func TestProfileLabelPolicy(t *testing.T) {
+	tests := []struct {
+		profile  string
+		label    string
+		value    string
+		expected string
+	}{
+		{"api", "path", "/api/users/123/posts/456", "/api/users/:id/posts/:id"},
+		{"api", "path", "/api/orders/3f2504e0-4f89-11d3-9a0c-0305e82c3301", "/api/orders/:id"},
+		{"api", "path", "/api/v2/items", "/api/v2/items"},
+		{"api", "full_url", "/api/users/42?expand=true", "/api/users/:id"},
+		{"web", "full_url", "/blog/post?utm_source=x", "/blog/post"},
+		{"cdn", "client_ip", "203.0.113.1", deniedLabelValue},
+		{"minimal", "full_url", "/anything?at=all", deniedLabelValue},
+		{"minimal", "header_value", "Mozilla/5.0", deniedLabelValue},
+		{"minimal", "path", "/users/7", "/users/:id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.profile+"/"+tt.label, func(t *testing.T) {
+			uc := &UsageCollector{Profile: tt.profile}
+			if err := uc.Provision(caddy.Context{Context: context.Background()}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			if got := uc.policy.apply(nil, tt.label, tt.value); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestProfileOverrides tests that configured rules take precedence over the profile
+func TestProfileOverrides(t *testing.T) {
+	uc := &UsageCollector{
+		Profile:     "cdn",
+		LabelPolicy: []LabelRule{{Action: policyAllow, Label: "client_ip"}},
+	}
+	if err := uc.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	if got := uc.policy.apply(nil, "client_ip", "203.0.113.1"); got != "203.0.113.1" {
+		t.Errorf("Expected configured allow rule to override the profile, got %q", got)
+	}
+}
+
+// TestProfileValidation tests that unknown profiles are rejected
+func TestProfileValidation(t *testing.T) {
+	if err := (&UsageCollector{Profile: "api"}).Validate(); err != nil {
+		t.Errorf("Expected api profile to be valid: %v", err)
+	}
+	if err := (&UsageCollector{Profile: "enterprise"}).Validate(); err == nil {
+		t.Error("Expected unknown profile to be rejected")
+	}
+}
+
+// TestUnmarshalProfile tests selecting a profile in the Caddyfile
+func TestUnmarshalProfile(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  string
+		expectErr bool
+	}{
+		{input: `usage profile api`, expected: "api"},
+		{input: "usage {\n profile cdn\n}", expected: "cdn"},
+		{input: `usage profile`, expectErr: true},
+		{input: `usage api`, expectErr: true},
+		{input: "usage {\n profile web extra\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		var uc UsageCollector
+		err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("Expected an error for %q", tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", tt.input, err)
+		}
+		if uc.Profile != tt.expected {
+			t.Errorf("Expected profile %q, got %q", tt.expected, uc.Profile)
+		}
+	}
+}
+
+// TestProfileMetricLevels tests the metrics the minimal, standard and
+// verbose profiles collect, and that explicitly configured options are
+// collected regardless
+func TestProfileMetricLevels(t *testing.T) {
+	tests := []struct {
+		profile  string
+		present  []string
+		absent   []string
+		explicit bool
+	}{
+		{
+			profile: "minimal",
+			present: []string{"requests_total", "request_duration_seconds"},
+			absent:  []string{"requests_by_ip_total", "requests_by_url_total", "requests_by_headers_total", "responses_by_content_type_total", "requests_by_protocol_total", "requests_by_class_total", "ttfb_seconds"},
+		},
+		{
+			profile: "standard",
+			present: []string{"requests_total", "request_duration_seconds", "requests_by_ip_total", "requests_by_url_total"},
+			absent:  []string{"requests_by_headers_total", "responses_by_content_type_total", "requests_by_protocol_total", "requests_by_class_total"},
+		},
+		{
+			profile: "verbose",
+			present: []string{"requests_total", "requests_by_ip_total", "requests_by_headers_total", "responses_by_content_type_total", "requests_by_protocol_total", "requests_by_class_total", "ttfb_seconds"},
+		},
+		{
+			profile:  "minimal",
+			present:  []string{"requests_total", "requests_by_headers_total", "cache_results_total"},
+			absent:   []string{"requests_by_ip_total", "requests_by_protocol_total"},
+			explicit: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			_, registry, cleanup := setupTestMetrics(t)
+			defer cleanup()
+
+			uc := &UsageCollector{Profile: tt.profile}
+			if tt.explicit {
+				uc.TrackedHeaders = []string{"User-Agent"}
+				uc.CacheResults = &CacheResultsConfig{}
+			}
+			if err := uc.Provision(caddy.Context{Context: context.Background()}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("X-Cache", "HIT")
+				_, err := w.Write([]byte("<html></html>"))
+				return err
+			})
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.Header.Set("User-Agent", "curl/8.5.0")
+			if err := uc.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+				t.Fatalf("ServeHTTP failed: %v", err)
+			}
+
+			for _, name := range tt.present {
+				if usagetest.Value(t, registry, name, nil) == 0 {
+					t.Errorf("Expected %s to be collected", name)
+				}
+			}
+			for _, name := range tt.absent {
+				usagetest.AssertAbsent(t, registry, name, nil)
+			}
+		})
+	}
+}
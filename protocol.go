@@ -0,0 +1,35 @@
+package caddyusage
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// protocolVersion returns the HTTP version of a request, as HTTP/1.0,
+// HTTP/1.1, HTTP/2 or HTTP/3
+func protocolVersion(r *http.Request) string {
+	switch {
+	case r.ProtoMajor >= 2:
+		return "HTTP/" + strconv.Itoa(r.ProtoMajor)
+	case r.ProtoMajor == 1:
+		return "HTTP/1." + strconv.Itoa(r.ProtoMinor)
+	default:
+		return r.Proto
+	}
+}
+
+// requestScheme returns https for requests received over TLS, http otherwise
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// collectProtocolMetrics records requests by HTTP version and scheme, for
+// tracking HTTP/2 and HTTP/3 adoption per host
+func (uc *UsageCollector) collectProtocolMetrics(um *usageMetrics, r *http.Request, host string) {
+	proto := uc.policy.apply(um, "proto", protocolVersion(r))
+	scheme := uc.policy.apply(um, "scheme", requestScheme(r))
+	um.requestsByProtocol.WithLabelValues(proto, scheme, host).Inc()
+}
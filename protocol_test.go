@@ -0,0 +1,51 @@
+package caddyusage
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestProtocolMetrics tests that requests are counted by HTTP version and scheme
+func TestProtocolMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	tests := []struct {
+		major, minor int
+		tls          bool
+		proto        string
+		scheme       string
+	}{
+		{1, 0, false, "HTTP/1.0", "http"},
+		{1, 1, false, "HTTP/1.1", "http"},
+		{1, 1, true, "HTTP/1.1", "https"},
+		{2, 0, true, "HTTP/2", "https"},
+		{3, 0, true, "HTTP/3", "https"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.ProtoMajor, req.ProtoMinor = tt.major, tt.minor
+		if tt.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		if got := protocolVersion(req); got != tt.proto {
+			t.Errorf("Expected proto %s, got %s", tt.proto, got)
+		}
+		if got := requestScheme(req); got != tt.scheme {
+			t.Errorf("Expected scheme %s, got %s", tt.scheme, got)
+		}
+		uc.collectProtocolMetrics(globalUsageMetrics, req, "example.com")
+	}
+
+	if n := testutil.CollectAndCount(globalUsageMetrics.requestsByProtocol); n != len(tests) {
+		t.Errorf("Expected %d series, got %d", len(tests), n)
+	}
+	if got := testutil.ToFloat64(globalUsageMetrics.requestsByProtocol.WithLabelValues("HTTP/3", "https", "example.com")); got != 1 {
+		t.Errorf("Expected 1 HTTP/3 request, got %v", got)
+	}
+}
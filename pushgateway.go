@@ -0,0 +1,338 @@
+package caddyusage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"go.uber.org/zap"
+)
+
+// Pushgateway defaults and bounds
+const (
+	defaultPushgatewayURL      = "http://localhost:9091"
+	defaultPushgatewayJob      = "caddy"
+	defaultPushgatewayInterval = 15 * time.Second
+	pushgatewayTimeout         = 10 * time.Second
+)
+
+// PushgatewayConfig configures pushing the usage metrics to a Prometheus
+// Pushgateway, for instances too short-lived to be scraped reliably.
+type PushgatewayConfig struct {
+	// URL is the Pushgateway's base URL, without the /metrics/job/...
+	// path. Defaults to http://localhost:9091.
+	URL string `json:"url,omitempty"`
+
+	// Job is the job label of the pushed metrics. Defaults to caddy.
+	Job string `json:"job,omitempty"`
+
+	// Grouping adds labels to the grouping key, such as an instance label
+	// telling apart replicas pushing under the same job.
+	Grouping map[string]string `json:"grouping,omitempty"`
+
+	// Interval is the time between pushes. Defaults to 15s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// Headers are sent with every push, such as authentication tokens.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// PushOnShutdown pushes a last time when the configuration is
+	// unloaded, so that requests since the previous push are not lost
+	// when the process exits.
+	PushOnShutdown bool `json:"push_on_shutdown,omitempty"`
+}
+
+// validate checks the URL, grouping labels and interval
+func (pc *PushgatewayConfig) validate() error {
+	if _, err := pc.url(); err != nil {
+		return err
+	}
+	for name := range pc.Grouping {
+		if name == "" || name == "job" {
+			return fmt.Errorf("invalid pushgateway grouping label '%s'", name)
+		}
+	}
+	if pc.Interval < 0 {
+		return fmt.Errorf("pushgateway interval must not be negative, got %s", time.Duration(pc.Interval))
+	}
+	return nil
+}
+
+// url returns the configured URL or its default
+func (pc *PushgatewayConfig) url() (string, error) {
+	if pc.URL == "" {
+		return defaultPushgatewayURL, nil
+	}
+	u, err := url.Parse(pc.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid pushgateway url '%s': expected an http or https URL", pc.URL)
+	}
+	return pc.URL, nil
+}
+
+// job returns the configured job or its default
+func (pc *PushgatewayConfig) job() string {
+	if pc.Job != "" {
+		return pc.Job
+	}
+	return defaultPushgatewayJob
+}
+
+// interval returns the configured interval or its default
+func (pc *PushgatewayConfig) interval() time.Duration {
+	if pc.Interval > 0 {
+		return time.Duration(pc.Interval)
+	}
+	return defaultPushgatewayInterval
+}
+
+// pushgatewayPusher periodically pushes the usage metrics of every set to
+// a Pushgateway. Handlers with the same configuration share a pusher, so
+// config reloads keep it running.
+type pushgatewayPusher struct {
+	key            string
+	url            string
+	job            string
+	grouping       map[string]string
+	headers        http.Header
+	interval       time.Duration
+	pushOnShutdown bool
+	client         *http.Client
+	logger         *zap.Logger
+	pushFails      bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// pushgatewayPusherEntry is a shared pusher and the number of handlers
+// using it
+type pushgatewayPusherEntry struct {
+	pusher *pushgatewayPusher
+	refs   int
+}
+
+var (
+	// Running pushers by configuration
+	pushgatewayPushers   = make(map[string]*pushgatewayPusherEntry)
+	pushgatewayPushersMu sync.Mutex
+)
+
+// acquirePushgatewayPusher returns the running pusher for the
+// configuration, starting one if needed. Each successful call must be
+// balanced by a call to releasePushgatewayPusher.
+func acquirePushgatewayPusher(pc *PushgatewayConfig, logger *zap.Logger) (*pushgatewayPusher, error) {
+	pushgatewayPushersMu.Lock()
+	defer pushgatewayPushersMu.Unlock()
+
+	key, err := json.Marshal(pc)
+	if err != nil {
+		return nil, err
+	}
+	if entry, ok := pushgatewayPushers[string(key)]; ok {
+		entry.refs++
+		return entry.pusher, nil
+	}
+
+	u, err := pc.url()
+	if err != nil {
+		return nil, err
+	}
+	headers := make(http.Header, len(pc.Headers))
+	for name, value := range pc.Headers {
+		headers.Set(name, value)
+	}
+
+	pusher := &pushgatewayPusher{
+		key:            string(key),
+		url:            u,
+		job:            pc.job(),
+		grouping:       pc.Grouping,
+		headers:        headers,
+		interval:       pc.interval(),
+		pushOnShutdown: pc.PushOnShutdown,
+		client:         &http.Client{Timeout: pushgatewayTimeout},
+		logger:         logger,
+		done:           make(chan struct{}),
+	}
+	pusher.run()
+	claimDeltaResets(pusher)
+	pushgatewayPushers[pusher.key] = &pushgatewayPusherEntry{pusher: pusher, refs: 1}
+	return pusher, nil
+}
+
+// releasePushgatewayPusher releases a handler's use of a pusher, stopping
+// it once no handler uses it anymore
+func releasePushgatewayPusher(pusher *pushgatewayPusher) error {
+	pushgatewayPushersMu.Lock()
+	defer pushgatewayPushersMu.Unlock()
+
+	entry, ok := pushgatewayPushers[pusher.key]
+	if !ok || entry.pusher != pusher {
+		return nil
+	}
+	if entry.refs--; entry.refs > 0 {
+		return nil
+	}
+	delete(pushgatewayPushers, pusher.key)
+	defer releaseDeltaResets(pusher)
+	return pusher.stop()
+}
+
+// run pushes the metrics every interval until stopped
+func (p *pushgatewayPusher) run() {
+	ticker := newTicker(p.interval)
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				p.pushLogged()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops pushing, and pushes a last time when configured to. The last
+// push's error is returned, since it is the only one telling that the
+// metrics since the previous push are lost.
+func (p *pushgatewayPusher) stop() error {
+	close(p.done)
+	p.wg.Wait()
+	defer p.client.CloseIdleConnections()
+
+	if !p.pushOnShutdown {
+		return nil
+	}
+	return p.push()
+}
+
+// pushLogged pushes the metrics, logging when pushes start or stop failing
+func (p *pushgatewayPusher) pushLogged() {
+	err := p.push()
+	switch {
+	case err != nil && !p.pushFails:
+		p.logger.Warn("failed to push usage metrics to the pushgateway", zap.Error(err))
+	case err == nil && p.pushFails:
+		p.logger.Info("pushing usage metrics to the pushgateway again")
+	}
+	p.pushFails = err != nil
+}
+
+// push replaces the metrics of the pusher's grouping key with the current
+// usage metrics
+func (p *pushgatewayPusher) push() error {
+	if err := sinkFault(sinkPushgateway); err != nil {
+		return err
+	}
+
+	gatherer, err := usageGatherer()
+	if err != nil {
+		return err
+	}
+
+	pusher := push.New(p.url, p.job).Gatherer(gatherer).Client(p.client).Header(p.headers.Clone())
+	for name, value := range p.grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+
+	// In delta temporality mode, the pusher owning the resets resets the
+	// vectors once the push went through
+	owner := ownsDeltaResets(p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), pushgatewayTimeout)
+	defer cancel()
+	if err := pusher.PushContext(ctx); err != nil {
+		return err
+	}
+	if owner {
+		resetDeltaSeries()
+	}
+	return nil
+}
+
+// unmarshalPushgatewayConfig parses a pushgateway block:
+//
+//	pushgateway [<url>] [{
+//	    job <name>
+//	    grouping <label> <value>
+//	    interval <duration>
+//	    header <name> <value>
+//	    push_on_shutdown
+//	}]
+func unmarshalPushgatewayConfig(d *caddyfile.Dispenser) (*PushgatewayConfig, error) {
+	pc := new(PushgatewayConfig)
+	if d.NextArg() {
+		pc.URL = d.Val()
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch option := d.Val(); option {
+		case "job":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			pc.Job = d.Val()
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+
+		case "interval":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid pushgateway interval '%s': %v", d.Val(), err)
+			}
+			pc.Interval = caddy.Duration(dur)
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+
+		case "grouping", "header":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return nil, d.ArgErr()
+			}
+			if option == "grouping" {
+				if pc.Grouping == nil {
+					pc.Grouping = make(map[string]string)
+				}
+				pc.Grouping[args[0]] = args[1]
+			} else {
+				if pc.Headers == nil {
+					pc.Headers = make(map[string]string)
+				}
+				pc.Headers[args[0]] = args[1]
+			}
+
+		case "push_on_shutdown":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			pc.PushOnShutdown = true
+
+		default:
+			return nil, d.Errf("unrecognized pushgateway option '%s'", option)
+		}
+	}
+
+	return pc, nil
+}
@@ -0,0 +1,216 @@
+package caddyusage
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// pushgatewayRecorder records the pushes it receives
+type pushgatewayRecorder struct {
+	mu     sync.Mutex
+	pushes []*http.Request
+	bodies [][]byte
+}
+
+func (p *pushgatewayRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pushes = append(p.pushes, r)
+	p.bodies = append(p.bodies, body)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (p *pushgatewayRecorder) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pushes)
+}
+
+// TestPushgatewayPush tests periodic pushes and the push on shutdown
+func TestPushgatewayPush(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+	rec.WriteHeader(200)
+	uc.collectMetrics(rec, req, now(), nil)
+
+	recorder := &pushgatewayRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	cfg := &PushgatewayConfig{
+		URL:            server.URL,
+		Job:            "edge",
+		Grouping:       map[string]string{"instance": "replica-1"},
+		Interval:       caddy.Duration(time.Minute),
+		Headers:        map[string]string{"Authorization": "Bearer token"},
+		PushOnShutdown: true,
+	}
+	first, err := acquirePushgatewayPusher(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	second, err := acquirePushgatewayPusher(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first != second {
+		t.Error("Expected handlers with the same configuration to share a pusher")
+	}
+
+	clock.Advance(time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for recorder.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if recorder.count() != 1 {
+		t.Fatalf("Expected a push after the interval, got %d", recorder.count())
+	}
+
+	if err := releasePushgatewayPusher(first); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if recorder.count() != 1 {
+		t.Error("Expected no push while a handler still uses the pusher")
+	}
+	if err := releasePushgatewayPusher(second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if recorder.count() != 2 {
+		t.Fatalf("Expected a push on shutdown, got %d pushes", recorder.count())
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	for i, push := range recorder.pushes {
+		if push.Method != http.MethodPut || push.URL.Path != "/metrics/job/edge/instance/replica-1" {
+			t.Errorf("Unexpected push %s %s", push.Method, push.URL.Path)
+		}
+		if got := push.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("Expected the configured header, got %q", got)
+		}
+		if !bytes.Contains(recorder.bodies[i], []byte("caddy_usage_requests_total")) {
+			t.Error("Expected the usage metrics to be pushed")
+		}
+	}
+}
+
+// TestPushgatewayNoShutdownPush tests that stopping doesn't push unless
+// configured to, and that failed shutdown pushes are reported
+func TestPushgatewayNoShutdownPush(t *testing.T) {
+	_, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	recorder := &pushgatewayRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	pusher, err := acquirePushgatewayPusher(&PushgatewayConfig{URL: server.URL}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := releasePushgatewayPusher(pusher); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if recorder.count() != 0 {
+		t.Errorf("Expected no push, got %d", recorder.count())
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer failing.Close()
+
+	pusher, err = acquirePushgatewayPusher(&PushgatewayConfig{URL: failing.URL, PushOnShutdown: true}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := releasePushgatewayPusher(pusher); err == nil {
+		t.Error("Expected the failed shutdown push to be reported")
+	}
+}
+
+// TestPushgatewayValidate tests validation of pushgateway options
+func TestPushgatewayValidate(t *testing.T) {
+	valid := []PushgatewayConfig{{}, {URL: "https://push.example.com"}, {Grouping: map[string]string{"instance": "a"}}}
+	for _, pc := range valid {
+		if err := pc.validate(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", pc, err)
+		}
+	}
+
+	invalid := []PushgatewayConfig{
+		{URL: "localhost:9091"},
+		{URL: "ftp://push.example.com"},
+		{Grouping: map[string]string{"job": "other"}},
+		{Interval: -1},
+	}
+	for _, pc := range invalid {
+		if err := pc.validate(); err == nil {
+			t.Errorf("%+v: expected an error but got none", pc)
+		}
+	}
+}
+
+// TestUnmarshalPushgateway tests parsing of the pushgateway option
+func TestUnmarshalPushgateway(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *PushgatewayConfig
+		expectErr bool
+	}{
+		{input: "usage {\n pushgateway\n}", expected: &PushgatewayConfig{}},
+		{input: "usage {\n pushgateway http://pushgateway:9091\n}", expected: &PushgatewayConfig{URL: "http://pushgateway:9091"}},
+		{
+			input: "usage {\n pushgateway {\n job edge\n grouping instance replica-1\n interval 30s\n header Authorization \"Bearer token\"\n push_on_shutdown\n }\n}",
+			expected: &PushgatewayConfig{
+				Job:            "edge",
+				Grouping:       map[string]string{"instance": "replica-1"},
+				Interval:       caddy.Duration(30 * time.Second),
+				Headers:        map[string]string{"Authorization": "Bearer token"},
+				PushOnShutdown: true,
+			},
+		},
+		{input: "usage {\n pushgateway a b\n}", expectErr: true},
+		{input: "usage {\n pushgateway {\n grouping instance\n }\n}", expectErr: true},
+		{input: "usage {\n pushgateway {\n interval soon\n }\n}", expectErr: true},
+		{input: "usage {\n pushgateway {\n push_on_shutdown yes\n }\n}", expectErr: true},
+		{input: "usage {\n pushgateway {\n delete_on_shutdown\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.Pushgateway, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.Pushgateway)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package caddyusage
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Query string modes of the full_url label
+const (
+	queryKeep  = "keep"
+	queryStrip = "strip"
+	querySort  = "sort"
+	queryAllow = "allow"
+)
+
+// URLQueryConfig sets how query strings are recorded in the full_url
+// label of requests_by_url_total, where every permutation of parameters
+// otherwise creates a series.
+type URLQueryConfig struct {
+	// Mode is keep to record query strings as-is, strip to drop them,
+	// sort to sort their parameters and canonicalize their encoding, or
+	// allow to keep only the parameters in Params, sorted and
+	// canonicalized. Defaults to keep.
+	Mode string `json:"mode,omitempty"`
+
+	// Params lists the parameters kept by the allow mode.
+	Params []string `json:"params,omitempty"`
+}
+
+// validate checks the mode and its parameters
+func (qc *URLQueryConfig) validate() error {
+	switch qc.Mode {
+	case "", queryKeep, queryStrip, querySort:
+		if len(qc.Params) > 0 {
+			return fmt.Errorf("url_query params are only used by the %s mode", queryAllow)
+		}
+	case queryAllow:
+		if len(qc.Params) == 0 {
+			return fmt.Errorf("url_query %s mode requires params", queryAllow)
+		}
+	default:
+		return fmt.Errorf("unknown url_query mode '%s', expected %s, %s, %s or %s", qc.Mode, queryKeep, queryStrip, querySort, queryAllow)
+	}
+	return nil
+}
+
+// apply returns a raw query string as recorded by the mode
+func (qc *URLQueryConfig) apply(rawQuery string) string {
+	switch qc.Mode {
+	case queryStrip:
+		return ""
+	case querySort:
+		// Unparseable pairs are dropped, like url.Values does
+		values, _ := url.ParseQuery(rawQuery)
+		return values.Encode()
+	case queryAllow:
+		values, _ := url.ParseQuery(rawQuery)
+		for name := range values {
+			if !slices.Contains(qc.Params, name) {
+				delete(values, name)
+			}
+		}
+		return values.Encode()
+	}
+	return rawQuery
+}
+
+// fullURL returns the full URL of a request as recorded by the full_url
+// label: without campaign parameters, since they are counted separately,
+// nor the API key parameter, and with its query string shaped by url_query
+func (uc *UsageCollector) fullURL(r *http.Request) string {
+	keyParam := ""
+	if uc.APIKeys != nil {
+		keyParam = uc.APIKeys.Query
+	}
+	if r.URL.RawQuery == "" || (len(uc.CampaignParams) == 0 && uc.URLQuery == nil && keyParam == "") {
+		return requestURL(r.URL)
+	}
+
+	u := *r.URL
+	if len(uc.CampaignParams) > 0 {
+		u.RawQuery = withoutQueryParams(u.RawQuery, uc.CampaignParams)
+	}
+	if keyParam != "" {
+		u.RawQuery = withoutQueryParams(u.RawQuery, []string{keyParam})
+	}
+	if uc.URLQuery != nil {
+		u.RawQuery = uc.URLQuery.apply(u.RawQuery)
+	}
+	return u.String()
+}
+
+// unmarshalURLQueryConfig parses a url_query directive:
+//
+//	url_query keep|strip|sort
+//	url_query allow <params...>
+func unmarshalURLQueryConfig(d *caddyfile.Dispenser) (*URLQueryConfig, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	qc := &URLQueryConfig{Mode: d.Val(), Params: d.RemainingArgs()}
+	if (qc.Mode == queryAllow) != (len(qc.Params) > 0) {
+		return nil, d.ArgErr()
+	}
+	if err := qc.validate(); err != nil {
+		return nil, d.Errf("invalid url_query mode '%s'", qc.Mode)
+	}
+	return qc, nil
+}
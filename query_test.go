@@ -0,0 +1,88 @@
+package caddyusage
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// TestFullURLQuery tests how each url_query mode records query strings,
+// together with campaign parameter stripping
+func TestFullURLQuery(t *testing.T) {
+	const target = "http://example.com/search?q=caddy%20server&utm_source=news&page=2&session=abc&flag"
+	tests := []struct {
+		name      string
+		query     *URLQueryConfig
+		campaigns []string
+		expected  string
+	}{
+		{name: "default", expected: target},
+		{name: "keep", query: &URLQueryConfig{Mode: queryKeep}, expected: target},
+		{name: "strip", query: &URLQueryConfig{Mode: queryStrip}, expected: "http://example.com/search"},
+		{name: "sort", query: &URLQueryConfig{Mode: querySort}, expected: "http://example.com/search?flag=&page=2&q=caddy+server&session=abc&utm_source=news"},
+		{name: "allow", query: &URLQueryConfig{Mode: queryAllow, Params: []string{"q", "page", "utm_source"}}, expected: "http://example.com/search?page=2&q=caddy+server&utm_source=news"},
+		{name: "campaigns", campaigns: defaultCampaignParams, expected: "http://example.com/search?q=caddy%20server&page=2&session=abc&flag"},
+		{
+			name:      "allow with campaigns",
+			query:     &URLQueryConfig{Mode: queryAllow, Params: []string{"q", "page", "utm_source"}},
+			campaigns: defaultCampaignParams,
+			expected:  "http://example.com/search?page=2&q=caddy+server",
+		},
+	}
+
+	for _, tt := range tests {
+		uc := &UsageCollector{URLQuery: tt.query, CampaignParams: tt.campaigns}
+		if got := uc.fullURL(httptest.NewRequest("GET", target, nil)); got != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, got)
+		}
+	}
+
+	uc := &UsageCollector{URLQuery: &URLQueryConfig{Mode: queryStrip}}
+	if got := uc.fullURL(httptest.NewRequest("GET", "http://example.com/", nil)); got != "http://example.com/" {
+		t.Errorf("Expected URLs without a query string as-is, got %q", got)
+	}
+}
+
+// TestURLQueryValidate tests validation of url_query modes
+func TestURLQueryValidate(t *testing.T) {
+	tests := map[string]struct {
+		config    URLQueryConfig
+		expectErr bool
+	}{
+		"default":            {},
+		"sort":               {config: URLQueryConfig{Mode: querySort}},
+		"allow":              {config: URLQueryConfig{Mode: queryAllow, Params: []string{"page"}}},
+		"allow without list": {config: URLQueryConfig{Mode: queryAllow}, expectErr: true},
+		"strip with list":    {config: URLQueryConfig{Mode: queryStrip, Params: []string{"page"}}, expectErr: true},
+		"unknown mode":       {config: URLQueryConfig{Mode: "hash"}, expectErr: true},
+	}
+	for name, tt := range tests {
+		if err := tt.config.validate(); (err != nil) != tt.expectErr {
+			t.Errorf("%s: expected error %v, got %v", name, tt.expectErr, err)
+		}
+	}
+}
+
+// TestUnmarshalURLQuery tests parsing of the url_query option
+func TestUnmarshalURLQuery(t *testing.T) {
+	var uc UsageCollector
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser("usage {\n url_query allow q page\n}")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if uc.URLQuery == nil || uc.URLQuery.Mode != queryAllow || len(uc.URLQuery.Params) != 2 {
+		t.Errorf("Unexpected url_query: %+v", uc.URLQuery)
+	}
+
+	for _, invalid := range []string{
+		"usage {\n url_query\n}",
+		"usage {\n url_query allow\n}",
+		"usage {\n url_query strip q\n}",
+		"usage {\n url_query hash\n}",
+	} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
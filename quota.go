@@ -0,0 +1,330 @@
+package caddyusage
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Quota scopes: what requests are counted by
+const (
+	quotaByIP     = "ip"
+	quotaByAPIKey = "api_key"
+)
+
+// QuotaConfig enforces a request quota per client IP or API key over a
+// rolling window. Requests over the quota are answered with 429 Too Many
+// Requests and a Retry-After header without reaching the next handler.
+type QuotaConfig struct {
+	// By is what requests are counted by: ip or api_key. API keys are
+	// read as configured by api_keys, and requests without one aren't
+	// limited. Default: ip
+	By string `json:"by,omitempty"`
+
+	// Limit is the number of requests allowed within the window.
+	Limit int `json:"limit"`
+
+	// Window is the rolling window the limit applies to.
+	Window caddy.Duration `json:"window"`
+}
+
+// by returns the configured scope or its default
+func (qc *QuotaConfig) by() string {
+	if qc.By == "" {
+		return quotaByIP
+	}
+	return qc.By
+}
+
+// validate checks the scope, limit and window
+func (qc *QuotaConfig) validate() error {
+	if by := qc.by(); by != quotaByIP && by != quotaByAPIKey {
+		return fmt.Errorf("quota by must be ip or api_key, got '%s'", qc.By)
+	}
+	if qc.Limit <= 0 {
+		return fmt.Errorf("quota limit must be positive, got %d", qc.Limit)
+	}
+	if qc.Window <= 0 {
+		return fmt.Errorf("quota window must be positive, got %s", time.Duration(qc.Window))
+	}
+	return nil
+}
+
+// quotaSlot counts the requests of a key in one time slice of the window
+type quotaSlot struct {
+	epoch int64
+	count int
+}
+
+// quotaTracker counts requests per key over a rolling window, kept as
+// time slices like windowedSketch
+type quotaTracker struct {
+	id        string
+	window    time.Duration
+	slotWidth time.Duration
+
+	mu   sync.Mutex
+	keys map[string]*[windowSlots]quotaSlot
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newQuotaTracker creates a tracker of a rolling window
+func newQuotaTracker(id string, window time.Duration) *quotaTracker {
+	slotWidth := window / windowSlots
+	if slotWidth <= 0 {
+		slotWidth = 1
+	}
+	return &quotaTracker{
+		id:        id,
+		window:    window,
+		slotWidth: slotWidth,
+		keys:      make(map[string]*[windowSlots]quotaSlot),
+		done:      make(chan struct{}),
+	}
+}
+
+// start sweeps keys without requests in the window until stop is called
+func (qt *quotaTracker) start() {
+	qt.wg.Add(1)
+	go func() {
+		defer qt.wg.Done()
+
+		ticker := newTicker(qt.window)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				qt.sweep(now())
+			case <-qt.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop ends sweeping
+func (qt *quotaTracker) stop() {
+	close(qt.done)
+	qt.wg.Wait()
+}
+
+// sweep forgets keys without requests in the window ending at now
+func (qt *quotaTracker) sweep(now time.Time) {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+
+	current := now.UnixNano() / int64(qt.slotWidth)
+	for key, slots := range qt.keys {
+		active := false
+		for _, slot := range slots {
+			if slot.epoch > current-windowSlots && slot.count > 0 {
+				active = true
+				break
+			}
+		}
+		if !active {
+			delete(qt.keys, key)
+		}
+	}
+}
+
+// allow counts a request of key at now unless the key already made limit
+// requests within the window. When it did, allow returns how long until
+// enough of them leave the window for a request to be allowed again.
+func (qt *quotaTracker) allow(key string, limit int, now time.Time) (bool, time.Duration) {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+
+	slots, ok := qt.keys[key]
+	if !ok {
+		slots = new([windowSlots]quotaSlot)
+		qt.keys[key] = slots
+	}
+
+	current := now.UnixNano() / int64(qt.slotWidth)
+	total := 0
+	for _, slot := range slots {
+		if slot.epoch > current-windowSlots && slot.epoch <= current {
+			total += slot.count
+		}
+	}
+
+	if total < limit {
+		slot := &slots[current%windowSlots]
+		if slot.epoch != current {
+			*slot = quotaSlot{epoch: current}
+		}
+		slot.count++
+		return true, 0
+	}
+
+	// Find the oldest slot whose expiry brings the key under its limit
+	for epoch := current - windowSlots + 1; epoch <= current; epoch++ {
+		slot := slots[epoch%windowSlots]
+		if slot.epoch == epoch {
+			total -= slot.count
+		}
+		if total < limit {
+			expiry := time.Unix(0, (epoch+windowSlots)*int64(qt.slotWidth))
+			return false, expiry.Sub(now)
+		}
+	}
+	return false, qt.window
+}
+
+// quotaTrackerEntry is a running tracker and its number of users
+type quotaTrackerEntry struct {
+	tracker *quotaTracker
+	refs    int
+}
+
+var (
+	// Running quota trackers by handler and quota, so that counts survive
+	// config reloads that keep them
+	quotaTrackers   = make(map[string]*quotaTrackerEntry)
+	quotaTrackersMu sync.Mutex
+)
+
+// quotaTrackerID identifies the counts of a quota: handlers share them
+// only when they are in the same metrics namespace and route and enforce
+// the same scope, limit and window
+func quotaTrackerID(namespace, route string, qc *QuotaConfig) string {
+	if namespace == "" {
+		namespace = defaultMetricsNamespace
+	}
+	return fmt.Sprintf("%s/%s/%s/%d/%s", namespace, route, qc.by(), qc.Limit, time.Duration(qc.Window))
+}
+
+// acquireQuotaTracker returns the running tracker of id, starting one for
+// qc's window if needed. Each call must be balanced by a call to
+// releaseQuotaTracker.
+func acquireQuotaTracker(id string, qc *QuotaConfig) *quotaTracker {
+	quotaTrackersMu.Lock()
+	defer quotaTrackersMu.Unlock()
+
+	if entry, ok := quotaTrackers[id]; ok {
+		entry.refs++
+		return entry.tracker
+	}
+
+	qt := newQuotaTracker(id, time.Duration(qc.Window))
+	qt.start()
+	quotaTrackers[id] = &quotaTrackerEntry{tracker: qt, refs: 1}
+	return qt
+}
+
+// releaseQuotaTracker releases a handler's use of a tracker, stopping it
+// once no handler uses it anymore
+func releaseQuotaTracker(qt *quotaTracker) {
+	quotaTrackersMu.Lock()
+	defer quotaTrackersMu.Unlock()
+
+	entry, ok := quotaTrackers[qt.id]
+	if !ok || entry.tracker != qt {
+		return
+	}
+	if entry.refs--; entry.refs > 0 {
+		return
+	}
+	delete(quotaTrackers, qt.id)
+	qt.stop()
+}
+
+// quotaKey returns the key a request is counted by, or "" when it isn't
+// limited
+func (uc *UsageCollector) quotaKey(r *http.Request) string {
+	if uc.Quota.by() == quotaByIP {
+		return quotaClientIP(r)
+	}
+
+	keys := uc.APIKeys
+	if keys == nil {
+		keys = &APIKeysConfig{}
+	}
+	if key := keys.key(r); key != anonymousAPIKey {
+		return key
+	}
+	return ""
+}
+
+// quotaClientIP returns the address of the client a request is counted
+// against, as determined by Caddy's trusted proxies, since forwarding
+// headers are trivially spoofed to dodge the quota
+func quotaClientIP(r *http.Request) string {
+	addr := r.RemoteAddr
+	if ip, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string); ok && ip != "" {
+		addr = ip
+	}
+	return normalizeIP(addr)
+}
+
+// overQuota reports whether a request exceeds its quota, counting it
+// towards the quota otherwise, and how long until it would be allowed
+func (uc *UsageCollector) overQuota(r *http.Request) (bool, time.Duration) {
+	key := uc.quotaKey(r)
+	if key == "" {
+		return false, 0
+	}
+	allowed, retryAfter := uc.quotaTracker.allow(key, uc.Quota.Limit, now())
+	return !allowed, retryAfter
+}
+
+// rejectOverQuota answers a request over its quota with 429 Too Many
+// Requests and the number of seconds to wait in Retry-After, and records
+// it like any other request
+func (uc *UsageCollector) rejectOverQuota(w http.ResponseWriter, r *http.Request, startTime time.Time, retryAfter time.Duration) error {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+
+	rec := newResponseRecorder(w)
+	rec.WriteHeader(http.StatusTooManyRequests)
+	uc.collectMetrics(rec, r, startTime, nil)
+
+	if um := uc.usageMetrics(); um != nil {
+		um.quotaExceeded.WithLabelValues(uc.hostLabel(um, r.Host), uc.Quota.by()).Inc()
+	}
+	return nil
+}
+
+// unmarshalQuotaConfig parses a quota directive:
+//
+//	quota <limit> <window> [ip|api_key]
+func unmarshalQuotaConfig(d *caddyfile.Dispenser) (*QuotaConfig, error) {
+	var limit, window string
+	if !d.Args(&limit, &window) {
+		return nil, d.ArgErr()
+	}
+	qc := &QuotaConfig{}
+
+	n, err := strconv.Atoi(limit)
+	if err != nil || n <= 0 {
+		return nil, d.Errf("invalid quota limit '%s': must be a positive integer", limit)
+	}
+	qc.Limit = n
+
+	dur, err := caddy.ParseDuration(window)
+	if err != nil || dur <= 0 {
+		return nil, d.Errf("invalid quota window '%s'", window)
+	}
+	qc.Window = caddy.Duration(dur)
+
+	if d.NextArg() {
+		qc.By = d.Val()
+		if qc.By != quotaByIP && qc.By != quotaByAPIKey {
+			return nil, d.Errf("invalid quota scope '%s'", qc.By)
+		}
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	return qc, nil
+}
@@ -0,0 +1,181 @@
+package caddyusage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestQuotaTracker tests counting requests over a rolling window and the
+// wait until a key is allowed again
+func TestQuotaTracker(t *testing.T) {
+	qt := newQuotaTracker("test", time.Minute)
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i, at := range []time.Duration{0, 0, 30 * time.Second} {
+		if ok, _ := qt.allow("a", 3, start.Add(at)); !ok {
+			t.Fatalf("Expected request %d to be allowed", i)
+		}
+	}
+	ok, retryAfter := qt.allow("a", 3, start.Add(30*time.Second))
+	if ok || retryAfter != 30*time.Second {
+		t.Errorf("Expected a rejection for 30s, got %v for %s", ok, retryAfter)
+	}
+	if ok, _ := qt.allow("b", 3, start.Add(30*time.Second)); !ok {
+		t.Error("Expected other keys to have their own quota")
+	}
+
+	// The first two requests leave the window after a minute
+	if ok, _ := qt.allow("a", 3, start.Add(time.Minute)); !ok {
+		t.Error("Expected a request to be allowed once earlier ones left the window")
+	}
+
+	qt.sweep(start.Add(90 * time.Second))
+	if len(qt.keys) != 1 {
+		t.Errorf("Expected only the key with requests in the window to remain, got %d", len(qt.keys))
+	}
+}
+
+// TestQuotaEnforcement tests that requests over their quota are answered
+// with 429 and Retry-After without reaching the next handler
+func TestQuotaEnforcement(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	uc.Quota = &QuotaConfig{Limit: 2, Window: caddy.Duration(time.Minute)}
+	uc.quotaTracker = newQuotaTracker("test", time.Minute)
+
+	served := 0
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		served++
+		return nil
+	})
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://example.com/api", nil)
+		req.RemoteAddr = remoteAddr
+		if err := uc.ServeHTTP(w, req, next); err != nil {
+			t.Fatalf("ServeHTTP failed: %v", err)
+		}
+		return w
+	}
+
+	serve("192.0.2.1:1234")
+	serve("192.0.2.1:1234")
+	w := serve("192.0.2.1:1234")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected 429 with Retry-After 60, got %d with %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := serve("192.0.2.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("Expected another client to be served, got %d", w.Code)
+	}
+
+	if served != 3 {
+		t.Errorf("Expected 3 requests to be served, got %d", served)
+	}
+	usagetest.AssertValue(t, registry, "quota_exceeded_total", usagetest.Labels{"host": "example.com", "by": quotaByIP}, 1)
+	usagetest.AssertValue(t, registry, "requests_total", usagetest.Labels{"status_code": "429"}, 1)
+
+	// Quotas by API key don't limit requests without one
+	uc.Quota.By = quotaByAPIKey
+	uc.quotaTracker = newQuotaTracker("test", time.Minute)
+	for i := 0; i < 3; i++ {
+		if w := serve("192.0.2.1:1234"); w.Code != http.StatusOK {
+			t.Errorf("Expected requests without an API key to be served, got %d", w.Code)
+		}
+	}
+}
+
+// TestQuotaKey tests that IP quotas count the client address Caddy
+// trusts rather than forwarding headers any client can set
+func TestQuotaKey(t *testing.T) {
+	uc := &UsageCollector{Quota: &QuotaConfig{Limit: 1, Window: caddy.Duration(time.Minute)}}
+
+	req := httptest.NewRequest("GET", "http://example.com/api", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("X-Real-IP", "203.0.113.8")
+	if key := uc.quotaKey(req); key != "192.0.2.1" {
+		t.Errorf("Expected forwarding headers to be ignored, got %q", key)
+	}
+
+	// Behind a trusted proxy, Caddy sets the client IP from the headers
+	vars := map[string]any{caddyhttp.ClientIPVarKey: "203.0.113.7"}
+	req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, vars))
+	if key := uc.quotaKey(req); key != "203.0.113.7" {
+		t.Errorf("Expected the client IP determined by Caddy, got %q", key)
+	}
+}
+
+// TestQuotaTrackerSharing tests that only handlers enforcing the same
+// quota in the same namespace and route share their counts
+func TestQuotaTrackerSharing(t *testing.T) {
+	hourly := &QuotaConfig{Limit: 100, Window: caddy.Duration(time.Hour)}
+	stricter := &QuotaConfig{Limit: 10, Window: caddy.Duration(time.Hour)}
+
+	a := acquireQuotaTracker(quotaTrackerID("", "", hourly), hourly)
+	defer releaseQuotaTracker(a)
+	b := acquireQuotaTracker(quotaTrackerID(defaultMetricsNamespace, "", hourly), hourly)
+	defer releaseQuotaTracker(b)
+	if a != b {
+		t.Error("Expected handlers with the same quota to share a tracker")
+	}
+
+	for name, id := range map[string]string{
+		"limit":     quotaTrackerID("", "", stricter),
+		"namespace": quotaTrackerID("site_b", "", hourly),
+		"route":     quotaTrackerID("", "api", hourly),
+	} {
+		qt := acquireQuotaTracker(id, hourly)
+		if qt == a {
+			t.Errorf("Expected a different %s to get its own tracker", name)
+		}
+		releaseQuotaTracker(qt)
+	}
+}
+
+// TestUnmarshalQuota tests parsing and validation of the quota option
+func TestUnmarshalQuota(t *testing.T) {
+	tests := map[string]*QuotaConfig{
+		"usage {\n quota 1000 1h\n}":       {Limit: 1000, Window: caddy.Duration(time.Hour)},
+		"usage {\n quota 10 1m api_key\n}": {By: quotaByAPIKey, Limit: 10, Window: caddy.Duration(time.Minute)},
+		"usage {\n quota 5000 24h ip\n}":   {By: quotaByIP, Limit: 5000, Window: caddy.Duration(24 * time.Hour)},
+	}
+	for input, expected := range tests {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(uc.Quota, expected) {
+			t.Errorf("%q: expected %+v, got %+v", input, expected, uc.Quota)
+		}
+	}
+
+	for _, invalid := range []string{
+		"usage {\n quota 1000\n}",
+		"usage {\n quota many 1h\n}",
+		"usage {\n quota 0 1h\n}",
+		"usage {\n quota 1000 soon\n}",
+		"usage {\n quota 1000 1h user\n}",
+		"usage {\n quota 1000 1h ip extra\n}",
+	} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+
+	if err := (&QuotaConfig{By: "user", Limit: 1, Window: caddy.Duration(time.Minute)}).validate(); err == nil {
+		t.Error("Expected an error for an unknown scope")
+	}
+}
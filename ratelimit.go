@@ -0,0 +1,29 @@
+package caddyusage
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// rateLimitZonePlaceholder is set by the rate_limit handler
+// (github.com/mholt/caddy-ratelimit) to the name of the zone whose
+// limit was exceeded when it rejects a request.
+const rateLimitZonePlaceholder = "http.rate_limit.exceeded.name"
+
+// collectRateLimitMetrics records requests rejected by the rate_limit handler.
+// This works when usage wraps rate_limit in the handler chain or runs in a
+// handle_errors route, since both share the request's replacer.
+func (uc *UsageCollector) collectRateLimitMetrics(um *usageMetrics, r *http.Request) {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+
+	zone, ok := repl.GetString(rateLimitZonePlaceholder)
+	if !ok || zone == "" {
+		return
+	}
+
+	um.rateLimited.WithLabelValues(uc.policy.apply(um, "zone", zone)).Inc()
+}
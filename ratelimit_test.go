@@ -0,0 +1,47 @@
+package caddyusage
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestRateLimitMetrics tests that rate_limit rejections are counted by zone
+func TestRateLimitMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	repl := caddy.NewReplacer()
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+	// Requests that weren't rate limited are ignored
+	uc.collectRateLimitMetrics(globalUsageMetrics, req)
+	if n := testutil.CollectAndCount(globalUsageMetrics.rateLimited); n != 0 {
+		t.Errorf("Expected no rate limited series, got %d", n)
+	}
+
+	repl.Set(rateLimitZonePlaceholder, "api_zone")
+	uc.collectRateLimitMetrics(globalUsageMetrics, req)
+	uc.collectRateLimitMetrics(globalUsageMetrics, req)
+
+	if got := testutil.ToFloat64(globalUsageMetrics.rateLimited.WithLabelValues("api_zone")); got != 2 {
+		t.Errorf("Expected 2 rate limited requests, got %v", got)
+	}
+}
+
+// TestRateLimitMetricsWithoutReplacer tests requests lacking a replacer are ignored
+func TestRateLimitMetricsWithoutReplacer(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	uc.collectRateLimitMetrics(globalUsageMetrics, req)
+
+	if n := testutil.CollectAndCount(globalUsageMetrics.rateLimited); n != 0 {
+		t.Errorf("Expected no rate limited series, got %d", n)
+	}
+}
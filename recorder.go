@@ -0,0 +1,158 @@
+package caddyusage
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// recordedResponse is what collection reads of a response once it has been
+// served. Both responseRecorder and caddyhttp's recorders provide it.
+type recordedResponse interface {
+	Header() http.Header
+	Status() int
+	Size() int
+}
+
+// responseRecorder passes a response straight through to the client,
+// recording only its status and the number of body bytes written. Unlike
+// caddyhttp's recorder it has nothing to buffer or write back. It keeps the
+// Push, ReadFrom and Unwrap of caddyhttp's ResponseWriterWrapper, and passes
+// Flush and Hijack through to the underlying writer, so streamed responses
+// reach the client as they are written and upgraded connections work
+// through it.
+type responseRecorder struct {
+	*caddyhttp.ResponseWriterWrapper
+
+	status      int
+	size        int
+	wroteHeader bool
+	firstByte   time.Time
+}
+
+// newResponseRecorder wraps w to record its status and size
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+	}
+}
+
+// WriteHeader implements http.ResponseWriter. Informational responses are
+// passed through without being recorded, except 101 Switching Protocols,
+// which is final.
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	if rr.wroteHeader {
+		return
+	}
+	if statusCode >= 200 || statusCode == http.StatusSwitchingProtocols {
+		rr.status = statusCode
+		rr.started()
+	}
+	rr.ResponseWriterWrapper.WriteHeader(statusCode)
+}
+
+// started marks the final header as written, remembering when. A body
+// written without a header is sent with 200 OK.
+func (rr *responseRecorder) started() {
+	if !rr.wroteHeader {
+		rr.wroteHeader = true
+		rr.firstByte = now()
+		if rr.status == 0 {
+			rr.status = http.StatusOK
+		}
+	}
+}
+
+// Write implements http.ResponseWriter
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	rr.started()
+	n, err := rr.ResponseWriterWrapper.Write(p)
+	rr.size += n
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom, keeping the underlying writer's fast
+// path for copied bodies while counting them
+func (rr *responseRecorder) ReadFrom(r io.Reader) (int64, error) {
+	rr.started()
+	n, err := rr.ResponseWriterWrapper.ReadFrom(r)
+	rr.size += int(n)
+	return n, err
+}
+
+// FlushError flushes the response to the client. The flush sends the
+// header, so it marks the first byte as written.
+func (rr *responseRecorder) FlushError() error {
+	if err := http.NewResponseController(rr.ResponseWriter).Flush(); err != nil {
+		return err
+	}
+	rr.started()
+	return nil
+}
+
+// Flush implements http.Flusher
+func (rr *responseRecorder) Flush() {
+	_ = rr.FlushError()
+}
+
+// Hijack implements http.Hijacker
+func (rr *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(rr.ResponseWriter).Hijack()
+}
+
+// Status returns the status of the response, 0 if nothing was written
+func (rr *responseRecorder) Status() int {
+	return rr.status
+}
+
+// Size returns the number of body bytes written
+func (rr *responseRecorder) Size() int {
+	return rr.size
+}
+
+// responseStatus returns the status a request was answered with. When a
+// handler returned err without writing anything, Caddy's error handling
+// answers for it, with the error's status; otherwise a response with
+// nothing written is sent as 200 OK.
+func responseStatus(rec recordedResponse, err error) int {
+	if status := rec.Status(); status != 0 {
+		return status
+	}
+	if err != nil {
+		return errorStatus(err)
+	}
+	return http.StatusOK
+}
+
+// answeredResponse is a recorded response reporting the status it was
+// answered with rather than the one written
+type answeredResponse struct {
+	recordedResponse
+	status int
+}
+
+// Status returns the status the response was answered with
+func (ar answeredResponse) Status() int {
+	return ar.status
+}
+
+// firstByteTime returns when the final header of a response was written,
+// or the zero time when nothing was written or rec doesn't track it
+func firstByteTime(rec recordedResponse) time.Time {
+	if rr, ok := rec.(*responseRecorder); ok {
+		return rr.firstByte
+	}
+	return time.Time{}
+}
+
+// Interface guards to ensure the recorder keeps what streaming relies on
+var (
+	_ http.Flusher     = (*responseRecorder)(nil)
+	_ http.Hijacker    = (*responseRecorder)(nil)
+	_ io.ReaderFrom    = (*responseRecorder)(nil)
+	_ recordedResponse = (*responseRecorder)(nil)
+)
@@ -0,0 +1,195 @@
+package caddyusage
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// hijackableRecorder is an httptest.ResponseRecorder whose connection can
+// be taken over
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+// Hijack implements http.Hijacker
+func (h *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.hijacked = true
+	client, server := net.Pipe()
+	client.Close()
+	return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+}
+
+// informationalRecorder is an httptest.ResponseRecorder that, like the
+// net/http server, sends informational responses ahead of the final one
+// rather than taking them for it
+type informationalRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+// WriteHeader implements http.ResponseWriter
+func (ir informationalRecorder) WriteHeader(statusCode int) {
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		return
+	}
+	ir.ResponseRecorder.WriteHeader(statusCode)
+}
+
+// TestResponseRecorder tests recording the status and size of responses
+func TestResponseRecorder(t *testing.T) {
+	tests := []struct {
+		name           string
+		write          func(w http.ResponseWriter)
+		expectedStatus int
+		expectedSize   int
+	}{
+		{"nothing written", func(w http.ResponseWriter) {}, 0, 0},
+		{"body only", func(w http.ResponseWriter) { _, _ = w.Write([]byte("hello")) }, 200, 5},
+		{"status and body", func(w http.ResponseWriter) {
+			w.WriteHeader(404)
+			_, _ = w.Write([]byte("not found"))
+		}, 404, 9},
+		{"informational first", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusEarlyHints)
+			w.WriteHeader(201)
+		}, 201, 0},
+		{"switching protocols", func(w http.ResponseWriter) { w.WriteHeader(http.StatusSwitchingProtocols) }, 101, 0},
+		{"status after body", func(w http.ResponseWriter) {
+			_, _ = w.Write([]byte("ok"))
+			w.WriteHeader(500)
+		}, 200, 2},
+		{"copied body", func(w http.ResponseWriter) {
+			_, _ = w.(io.ReaderFrom).ReadFrom(strings.NewReader("copied"))
+		}, 200, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := newResponseRecorder(httptest.NewRecorder())
+			tt.write(rr)
+			if rr.Status() != tt.expectedStatus || rr.Size() != tt.expectedSize {
+				t.Errorf("Expected status %d and size %d, got %d and %d", tt.expectedStatus, tt.expectedSize, rr.Status(), rr.Size())
+			}
+		})
+	}
+}
+
+// TestResponseRecorderPassthrough tests that flushes and hijacks reach the
+// underlying writer, so streamed responses aren't held back
+func TestResponseRecorderPassthrough(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	next := caddyhttp.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) error {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		_, _ = rw.Write([]byte("data: 1\n\n"))
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			t.Fatal("Expected the recorder to implement http.Flusher")
+		}
+		flusher.Flush()
+		if !w.Flushed || w.Body.String() != "data: 1\n\n" {
+			t.Errorf("Expected the first event to reach the client before the stream ends, got %q", w.Body.String())
+		}
+		_, err := rw.Write([]byte("data: 2\n\n"))
+		return err
+	})
+	if err := uc.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/events", nil), next); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+	usagetest.AssertValue(t, registry, "requests_total",
+		usagetest.Labels{"status_code": "200", "method": "GET", "host": "example.com", "path": "/events"}, 1)
+
+	hw := &hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rr := newResponseRecorder(hw)
+	rr.WriteHeader(http.StatusSwitchingProtocols)
+	conn, _, err := http.NewResponseController(rr).Hijack()
+	if err != nil {
+		t.Fatalf("Expected the connection to be hijacked, got %v", err)
+	}
+	conn.Close()
+	if !hw.hijacked || rr.Status() != http.StatusSwitchingProtocols {
+		t.Errorf("Expected a hijacked 101 response, got %d", rr.Status())
+	}
+}
+
+// TestHandlerErrorStatus tests that requests failing before a response is
+// written are recorded with the status Caddy answers them with
+func TestHandlerErrorStatus(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	serve := func(path string, next caddyhttp.HandlerFunc) {
+		_ = uc.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com"+path, nil), next)
+	}
+	serve("/proxied", func(http.ResponseWriter, *http.Request) error {
+		return caddyhttp.Error(http.StatusBadGateway, errors.New("dial tcp: connection refused"))
+	})
+	serve("/broken", func(http.ResponseWriter, *http.Request) error {
+		return errors.New("unexpected failure")
+	})
+	serve("/written", func(w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return caddyhttp.Error(http.StatusBadGateway, errors.New("upstream went away"))
+	})
+	serve("/empty", func(http.ResponseWriter, *http.Request) error { return nil })
+
+	for path, status := range map[string]string{"/proxied": "502", "/broken": "500", "/written": "503", "/empty": "200"} {
+		usagetest.AssertValue(t, registry, "requests_total",
+			usagetest.Labels{"status_code": status, "method": "GET", "host": "example.com", "path": path}, 1)
+	}
+}
+
+// TestTTFBMetrics tests that the time to first byte is recorded apart from
+// the time the rest of the response takes
+func TestTTFBMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+		clock.Advance(300 * time.Millisecond)
+		w.WriteHeader(http.StatusEarlyHints)
+		clock.Advance(200 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+		clock.Advance(2 * time.Second)
+		_, err := w.Write([]byte("created"))
+		return err
+	})
+	w := informationalRecorder{httptest.NewRecorder()}
+	if err := uc.ServeHTTP(w, httptest.NewRequest("POST", "http://example.com/upload", nil), next); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	labels := usagetest.Labels{"method": "POST", "status_code": "201", "host": "example.com"}
+	for name, expected := range map[string]float64{"ttfb_seconds": 0.5, "request_duration_seconds": 2.5} {
+		series := usagetest.Series(t, registry, name, labels)
+		if len(series) != 1 {
+			t.Fatalf("Expected one %s series, got %d", name, len(series))
+		}
+		if sum := series[0].GetHistogram().GetSampleSum(); math.Abs(sum-expected) > 1e-9 {
+			t.Errorf("Expected %s of %gs, got %gs", name, expected, sum)
+		}
+	}
+
+	// Metrics collected without a response passing through have no time
+	// to first byte
+	rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+	rec.WriteHeader(200)
+	uc.collectMetrics(rec, httptest.NewRequest("GET", "http://example.com/", nil), now(), nil)
+	usagetest.AssertAbsent(t, registry, "ttfb_seconds", usagetest.Labels{"method": "GET"})
+}
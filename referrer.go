@@ -0,0 +1,142 @@
+package caddyusage
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Referrer categories of the requests_by_referrer_total metric
+const (
+	referrerDirect   = "direct"
+	referrerInternal = "internal"
+	referrerSearch   = "search"
+	referrerSocial   = "social"
+	referrerOther    = "other"
+)
+
+// referrerUnknown is the domain of Referer headers without a hostname
+const referrerUnknown = "unknown"
+
+// builtinSearchReferrers are the domains of common search engines. Names
+// ending in .* match the name under any public suffix, like google.co.uk.
+var builtinSearchReferrers = []string{
+	"google.*", "bing.com", "yahoo.*", "duckduckgo.com", "baidu.com",
+	"yandex.*", "ecosia.org", "qwant.com", "startpage.com", "brave.com",
+	"kagi.com", "naver.com", "seznam.cz", "ask.com", "sogou.com",
+}
+
+// builtinSocialReferrers are the domains of common social networks and
+// link aggregators
+var builtinSocialReferrers = []string{
+	"facebook.com", "fb.com", "instagram.com", "threads.net", "twitter.com",
+	"x.com", "t.co", "linkedin.com", "lnkd.in", "reddit.com",
+	"youtube.com", "pinterest.*", "tiktok.com", "tumblr.com", "bsky.app",
+	"mastodon.social", "ycombinator.com", "t.me", "vk.com", "weibo.com",
+	"quora.com", "discord.com",
+}
+
+// ReferrerConfig enables the requests_by_referrer_total metric, counting
+// requests by the registrable domain of their Referer and its category:
+// direct without a Referer, internal from the requested site, search,
+// social, or other. Only the domain of a Referer is recorded.
+type ReferrerConfig struct {
+	// Internal lists additional domains classified as internal, such as
+	// sister sites. Referrers from the registrable domain of the requested
+	// host always are.
+	Internal []string `json:"internal,omitempty"`
+
+	// Search lists domains classified as search engines, in addition to
+	// the builtin ones. Names ending in .* match any public suffix.
+	Search []string `json:"search,omitempty"`
+
+	// Social lists domains classified as social networks, in addition to
+	// the builtin ones. Names ending in .* match any public suffix.
+	Social []string `json:"social,omitempty"`
+}
+
+// classify returns the registrable domain and category of a request's
+// referrer
+func (rc *ReferrerConfig) classify(r *http.Request) (domain, category string) {
+	referer := r.Referer()
+	if referer == "" {
+		return "", referrerDirect
+	}
+
+	u, err := url.Parse(referer)
+	if err != nil || u.Hostname() == "" {
+		return referrerUnknown, referrerOther
+	}
+	domain = registrableDomain(normalizeHostname(u.Hostname()))
+
+	switch {
+	case domain == registrableDomain(normalizeHostname(hostWithoutPort(r.Host))),
+		matchReferrerDomain(domain, rc.Internal):
+		return domain, referrerInternal
+	case matchReferrerDomain(domain, rc.Search), matchReferrerDomain(domain, builtinSearchReferrers):
+		return domain, referrerSearch
+	case matchReferrerDomain(domain, rc.Social), matchReferrerDomain(domain, builtinSocialReferrers):
+		return domain, referrerSocial
+	}
+	return domain, referrerOther
+}
+
+// matchReferrerDomain reports whether a registrable domain is one of
+// names, where names ending in .* match under any public suffix
+func matchReferrerDomain(domain string, names []string) bool {
+	for _, name := range names {
+		prefix, wildcard := strings.CutSuffix(name, ".*")
+		if !wildcard {
+			if strings.EqualFold(domain, name) {
+				return true
+			}
+			continue
+		}
+		if len(domain) > len(prefix)+1 && domain[len(prefix)] == '.' && strings.EqualFold(domain[:len(prefix)], prefix) &&
+			loadedData().suffixes.PublicSuffix(domain) == domain[len(prefix)+1:] {
+			return true
+		}
+	}
+	return false
+}
+
+// collectReferrerMetrics records the referring domain and its category
+func (uc *UsageCollector) collectReferrerMetrics(um *usageMetrics, r *http.Request) {
+	if uc.Referrers == nil {
+		return
+	}
+	domain, category := uc.Referrers.classify(r)
+	um.requestsByReferrer.WithLabelValues(uc.policy.apply(um, "domain", domain), category).Inc()
+}
+
+// unmarshalReferrerConfig parses a referrers block:
+//
+//	referrers [{
+//	    internal <domains...>
+//	    search <domains...>
+//	    social <domains...>
+//	}]
+func unmarshalReferrerConfig(d *caddyfile.Dispenser) (*ReferrerConfig, error) {
+	rc := new(ReferrerConfig)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		domains := d.RemainingArgs()
+		if len(domains) == 0 {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "internal":
+			rc.Internal = append(rc.Internal, domains...)
+		case "search":
+			rc.Search = append(rc.Search, domains...)
+		case "social":
+			rc.Social = append(rc.Social, domains...)
+		default:
+			return nil, d.Errf("unrecognized referrers option '%s'", option)
+		}
+	}
+	return rc, nil
+}
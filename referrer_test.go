@@ -0,0 +1,105 @@
+package caddyusage
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestReferrerClassify tests the domain and category of referrers
+func TestReferrerClassify(t *testing.T) {
+	rc := &ReferrerConfig{
+		Internal: []string{"example-cdn.net"},
+		Search:   []string{"Example.ORG"},
+		Social:   []string{"forum.*"},
+	}
+
+	tests := []struct {
+		referer  string
+		domain   string
+		category string
+	}{
+		{referer: "", domain: "", category: referrerDirect},
+		{referer: "https://www.example.com/pricing", domain: "example.com", category: referrerInternal},
+		{referer: "https://static.example-cdn.net/", domain: "example-cdn.net", category: referrerInternal},
+		{referer: "https://www.google.co.uk/", domain: "google.co.uk", category: referrerSearch},
+		{referer: "https://duckduckgo.com/?q=caddy", domain: "duckduckgo.com", category: referrerSearch},
+		{referer: "https://search.example.org/results", domain: "example.org", category: referrerSearch},
+		{referer: "https://t.co/abc", domain: "t.co", category: referrerSocial},
+		{referer: "https://old.reddit.com/r/golang", domain: "reddit.com", category: referrerSocial},
+		{referer: "https://forum.co.uk/thread", domain: "forum.co.uk", category: referrerSocial},
+		{referer: "https://googleusercontent.com/", domain: "googleusercontent.com", category: referrerOther},
+		{referer: "https://blog.golang.org/", domain: "golang.org", category: referrerOther},
+		{referer: "http://192.0.2.1:8080/", domain: ipDomain, category: referrerOther},
+		{referer: "not a url", domain: referrerUnknown, category: referrerOther},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "https://example.com:8443/", nil)
+		if tt.referer != "" {
+			req.Header.Set("Referer", tt.referer)
+		}
+		domain, category := rc.classify(req)
+		if domain != tt.domain || category != tt.category {
+			t.Errorf("%q: expected %q %s, got %q %s", tt.referer, tt.domain, tt.category, domain, category)
+		}
+	}
+}
+
+// TestReferrerMetrics tests that requests are counted by referrer only
+// when enabled
+func TestReferrerMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	// Disabled by default
+	collectTestRequests(t, uc)
+	usagetest.AssertAbsent(t, registry, "requests_by_referrer_total", nil)
+
+	uc.Referrers = &ReferrerConfig{}
+	for _, referer := range []string{"https://www.bing.com/", "https://www.bing.com/search", "https://news.ycombinator.com/item", ""} {
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		req.Header.Set("Referer", referer)
+		uc.collectReferrerMetrics(globalUsageMetrics, req)
+	}
+	usagetest.AssertValue(t, registry, "requests_by_referrer_total", usagetest.Labels{"domain": "bing.com", "category": referrerSearch}, 2)
+	usagetest.AssertValue(t, registry, "requests_by_referrer_total", usagetest.Labels{"domain": "ycombinator.com", "category": referrerSocial}, 1)
+	usagetest.AssertValue(t, registry, "requests_by_referrer_total", usagetest.Labels{"category": referrerDirect}, 1)
+}
+
+// TestUnmarshalReferrers tests parsing of the referrers option
+func TestUnmarshalReferrers(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *ReferrerConfig
+		expectErr bool
+	}{
+		{input: "usage {\n referrers\n}", expected: &ReferrerConfig{}},
+		{
+			input:    "usage {\n referrers {\n internal example.net example.org\n search kagi.*\n social lemmy.world\n social mastodon.*\n }\n}",
+			expected: &ReferrerConfig{Internal: []string{"example.net", "example.org"}, Search: []string{"kagi.*"}, Social: []string{"lemmy.world", "mastodon.*"}},
+		},
+		{input: "usage {\n referrers all\n}", expectErr: true},
+		{input: "usage {\n referrers {\n internal\n }\n}", expectErr: true},
+		{input: "usage {\n referrers {\n shopping amazon.*\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		var uc UsageCollector
+		err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected an error but got none", tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(uc.Referrers, tt.expected) {
+			t.Errorf("Expected %+v, got %+v", tt.expected, uc.Referrers)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package caddyusage
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// Relabeling actions
+const (
+	relabelReplace = "replace"
+	relabelKeep    = "keep"
+	relabelDrop    = "drop"
+)
+
+// Relabeling defaults, as in Prometheus
+const (
+	defaultRelabelSeparator   = ";"
+	defaultRelabelRegex       = "(.*)"
+	defaultRelabelReplacement = "$1"
+)
+
+// metricNameLabel is the pseudo-label holding the metric name
+const metricNameLabel = "__name__"
+
+// RelabelRule is a step of metric relabeling, modeled on Prometheus'
+// relabel_config. Rules are evaluated in order over the labels of every
+// usage series as it is collected, with the metric name available as the
+// __name__ label.
+type RelabelRule struct {
+	// Action is replace, keep or drop. Defaults to replace.
+	Action string `json:"action,omitempty"`
+
+	// SourceLabels are the labels whose values, joined by Separator, are
+	// matched against Regex.
+	SourceLabels []string `json:"source_labels,omitempty"`
+
+	// Separator joins the source label values. Defaults to ;.
+	Separator string `json:"separator,omitempty"`
+
+	// Regex is the regular expression the joined values must match. It is
+	// anchored at both ends. Defaults to (.*).
+	Regex string `json:"regex,omitempty"`
+
+	// TargetLabel is the label replace rules set. Since the schema of a
+	// metric is fixed, only labels the metric already has can be set.
+	TargetLabel string `json:"target_label,omitempty"`
+
+	// Replacement is the value replace rules set, which may reference
+	// capture groups of Regex like $1. Defaults to $1.
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// compiledRelabelRule is a RelabelRule with its defaults applied and its
+// expression compiled
+type compiledRelabelRule struct {
+	RelabelRule
+	re *regexp.Regexp
+}
+
+// relabeling is a compiled list of relabeling rules
+type relabeling []compiledRelabelRule
+
+// compileRelabeling validates and compiles relabeling rules
+func compileRelabeling(rules []RelabelRule) (relabeling, error) {
+	compiled := make(relabeling, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Action == "" {
+			rule.Action = relabelReplace
+		}
+		if rule.Separator == "" {
+			rule.Separator = defaultRelabelSeparator
+		}
+		if rule.Regex == "" {
+			rule.Regex = defaultRelabelRegex
+		}
+
+		switch rule.Action {
+		case relabelReplace:
+			if rule.TargetLabel == "" || rule.TargetLabel == metricNameLabel {
+				return nil, fmt.Errorf("relabel rule %d: replace requires a target_label other than %s", i, metricNameLabel)
+			}
+			if rule.Replacement == "" {
+				rule.Replacement = defaultRelabelReplacement
+			}
+		case relabelKeep, relabelDrop:
+			if rule.TargetLabel != "" || rule.Replacement != "" {
+				return nil, fmt.Errorf("relabel rule %d: %s takes no target_label or replacement", i, rule.Action)
+			}
+		default:
+			return nil, fmt.Errorf("relabel rule %d: unknown action '%s'", i, rule.Action)
+		}
+		if len(rule.SourceLabels) == 0 {
+			return nil, fmt.Errorf("relabel rule %d: source_labels are required", i)
+		}
+
+		re, err := regexp.Compile("^(?:" + rule.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: invalid regex: %v", i, err)
+		}
+		compiled = append(compiled, compiledRelabelRule{RelabelRule: rule, re: re})
+	}
+	return compiled, nil
+}
+
+// apply runs the rules over the labels of a series, keyed by name, and
+// reports whether the series is kept. Replace rules only change labels
+// already present.
+func (rl relabeling) apply(labels map[string]string) bool {
+	values := make([]string, 0, 4)
+	for _, rule := range rl {
+		values = values[:0]
+		for _, name := range rule.SourceLabels {
+			values = append(values, labels[name])
+		}
+		joined := strings.Join(values, rule.Separator)
+
+		switch rule.Action {
+		case relabelKeep:
+			if !rule.re.MatchString(joined) {
+				return false
+			}
+		case relabelDrop:
+			if rule.re.MatchString(joined) {
+				return false
+			}
+		case relabelReplace:
+			if _, ok := labels[rule.TargetLabel]; !ok {
+				continue
+			}
+			match := rule.re.FindStringSubmatchIndex(joined)
+			if match == nil {
+				continue
+			}
+			labels[rule.TargetLabel] = string(rule.re.ExpandString(nil, rule.Replacement, joined, match))
+		}
+	}
+	return true
+}
+
+// setRelabeling changes the relabeling rules applied to the metrics when
+// collected. Nil rules disable relabeling.
+func (um *usageMetrics) setRelabeling(rl relabeling) {
+	if len(rl) == 0 {
+		um.relabel.Store(nil)
+		return
+	}
+	um.relabel.Store(&rl)
+}
+
+// relabelCollector wraps a collector of a metric set, relabeling the
+// series it collects with the set's rules. Series relabeled to the same
+// labels are merged by summing their values, so that rules can fold
+// dimensions away without breaking the exposition.
+type relabelCollector struct {
+	prometheus.Collector
+	um *usageMetrics
+}
+
+// Collect implements prometheus.Collector
+func (c relabelCollector) Collect(ch chan<- prometheus.Metric) {
+	rl := c.um.relabel.Load()
+	if rl == nil {
+		c.Collector.Collect(ch)
+		return
+	}
+
+	collected := make(chan prometheus.Metric)
+	go func() {
+		c.Collector.Collect(collected)
+		close(collected)
+	}()
+
+	var order []string
+	merged := make(map[string]*relabeledMetric)
+	for metric := range collected {
+		pb := new(dto.Metric)
+		if err := metric.Write(pb); err != nil {
+			ch <- prometheus.NewInvalidMetric(metric.Desc(), err)
+			continue
+		}
+
+		name := descName(metric.Desc())
+		labels := make(map[string]string, len(pb.Label)+1)
+		labels[metricNameLabel] = name
+		for _, pair := range pb.Label {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		if !rl.apply(labels) {
+			continue
+		}
+
+		var key strings.Builder
+		key.WriteString(name)
+		// The written pairs are shared with the collected series, so
+		// relabeled values go in pairs of their own
+		pairs := make([]*dto.LabelPair, len(pb.Label))
+		for i, pair := range pb.Label {
+			value := labels[pair.GetName()]
+			pairs[i] = &dto.LabelPair{Name: pair.Name, Value: &value}
+			key.WriteByte(0xff)
+			key.WriteString(value)
+		}
+		pb.Label = pairs
+
+		if existing, ok := merged[key.String()]; ok {
+			mergeMetric(existing.pb, pb)
+			continue
+		}
+		merged[key.String()] = &relabeledMetric{desc: metric.Desc(), pb: pb}
+		order = append(order, key.String())
+	}
+
+	for _, key := range order {
+		ch <- merged[key]
+	}
+}
+
+// descNameRegexp extracts the metric name from a descriptor's string form,
+// since descriptors don't expose it otherwise
+var descNameRegexp = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// descName returns the metric name of a descriptor
+func descName(desc *prometheus.Desc) string {
+	if match := descNameRegexp.FindStringSubmatch(desc.String()); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// mergeMetric adds the value of src to dst, both series of the same
+// metric. Summary quantiles can't be merged and keep dst's.
+func mergeMetric(dst, src *dto.Metric) {
+	switch {
+	case dst.Counter != nil && src.Counter != nil:
+		dst.Counter.Value = proto.Float64(dst.Counter.GetValue() + src.Counter.GetValue())
+	case dst.Gauge != nil && src.Gauge != nil:
+		dst.Gauge.Value = proto.Float64(dst.Gauge.GetValue() + src.Gauge.GetValue())
+	case dst.Untyped != nil && src.Untyped != nil:
+		dst.Untyped.Value = proto.Float64(dst.Untyped.GetValue() + src.Untyped.GetValue())
+	case dst.Histogram != nil && src.Histogram != nil:
+		dst.Histogram.SampleCount = proto.Uint64(dst.Histogram.GetSampleCount() + src.Histogram.GetSampleCount())
+		dst.Histogram.SampleSum = proto.Float64(dst.Histogram.GetSampleSum() + src.Histogram.GetSampleSum())
+		for i, bucket := range dst.Histogram.Bucket {
+			if i < len(src.Histogram.Bucket) {
+				bucket.CumulativeCount = proto.Uint64(bucket.GetCumulativeCount() + src.Histogram.Bucket[i].GetCumulativeCount())
+			}
+		}
+	case dst.Summary != nil && src.Summary != nil:
+		dst.Summary.SampleCount = proto.Uint64(dst.Summary.GetSampleCount() + src.Summary.GetSampleCount())
+		dst.Summary.SampleSum = proto.Float64(dst.Summary.GetSampleSum() + src.Summary.GetSampleSum())
+	}
+}
+
+// relabeledMetric is a collected series with relabeled label values
+type relabeledMetric struct {
+	desc *prometheus.Desc
+	pb   *dto.Metric
+}
+
+// Desc implements prometheus.Metric
+func (m *relabeledMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+// Write implements prometheus.Metric
+func (m *relabeledMetric) Write(out *dto.Metric) error {
+	proto.Merge(out, m.pb)
+	return nil
+}
+
+// unmarshalRelabelRule parses a relabel block:
+//
+//	relabel [<action>] {
+//	    source_labels <labels...>
+//	    separator <separator>
+//	    regex <regexp>
+//	    target_label <label>
+//	    replacement <replacement>
+//	}
+func unmarshalRelabelRule(d *caddyfile.Dispenser) (RelabelRule, error) {
+	var rule RelabelRule
+	if d.NextArg() {
+		rule.Action = d.Val()
+	}
+	if d.NextArg() {
+		return rule, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if option == "source_labels" {
+			rule.SourceLabels = d.RemainingArgs()
+			if len(rule.SourceLabels) == 0 {
+				return rule, d.ArgErr()
+			}
+			continue
+		}
+
+		if !d.NextArg() {
+			return rule, d.ArgErr()
+		}
+		switch option {
+		case "separator":
+			rule.Separator = d.Val()
+		case "regex":
+			rule.Regex = d.Val()
+		case "target_label":
+			rule.TargetLabel = d.Val()
+		case "replacement":
+			rule.Replacement = d.Val()
+		default:
+			return rule, d.Errf("unrecognized relabel option '%s'", option)
+		}
+		if d.NextArg() {
+			return rule, d.ArgErr()
+		}
+	}
+	return rule, nil
+}
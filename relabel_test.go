@@ -0,0 +1,157 @@
+package caddyusage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestRelabelingApply tests the keep, drop and replace actions over the
+// labels of a series
+func TestRelabelingApply(t *testing.T) {
+	rl, err := compileRelabeling([]RelabelRule{
+		{Action: relabelDrop, SourceLabels: []string{"__name__"}, Regex: ".*_by_headers_total"},
+		{Action: relabelKeep, SourceLabels: []string{"method"}, Regex: "GET|POST|"},
+		{SourceLabels: []string{"path"}, Regex: "/api/v[0-9]+/(.*)", TargetLabel: "path", Replacement: "/api/$1"},
+		{SourceLabels: []string{"method", "status_code"}, Regex: "(.*);5..", TargetLabel: "status_code", Replacement: "5xx"},
+		{SourceLabels: []string{"host"}, TargetLabel: "tenant"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected map[string]string
+	}{
+		{
+			name:   "dropped metric",
+			labels: map[string]string{"__name__": "caddy_usage_requests_by_headers_total", "method": "GET"},
+		},
+		{
+			name:   "method not kept",
+			labels: map[string]string{"__name__": "caddy_usage_requests_total", "method": "DELETE"},
+		},
+		{
+			name:     "rewritten path and status",
+			labels:   map[string]string{"__name__": "caddy_usage_requests_total", "method": "GET", "path": "/api/v2/users", "status_code": "503"},
+			expected: map[string]string{"__name__": "caddy_usage_requests_total", "method": "GET", "path": "/api/users", "status_code": "5xx"},
+		},
+		{
+			name:     "unmatched replace",
+			labels:   map[string]string{"__name__": "caddy_usage_requests_total", "method": "POST", "path": "/", "status_code": "200", "host": "example.com"},
+			expected: map[string]string{"__name__": "caddy_usage_requests_total", "method": "POST", "path": "/", "status_code": "200", "host": "example.com"},
+		},
+		{
+			name:     "series without the labels",
+			labels:   map[string]string{"__name__": "caddy_usage_active_paths"},
+			expected: map[string]string{"__name__": "caddy_usage_active_paths"},
+		},
+	}
+	for _, tt := range tests {
+		kept := rl.apply(tt.labels)
+		if kept != (tt.expected != nil) {
+			t.Errorf("%s: expected kept %v, got %v", tt.name, tt.expected != nil, kept)
+			continue
+		}
+		if kept && !reflect.DeepEqual(tt.labels, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, tt.labels)
+		}
+	}
+}
+
+// TestCompileRelabeling tests validation of relabeling rules
+func TestCompileRelabeling(t *testing.T) {
+	tests := map[string]struct {
+		rule      RelabelRule
+		expectErr bool
+	}{
+		"replace":               {rule: RelabelRule{SourceLabels: []string{"path"}, TargetLabel: "path"}},
+		"keep":                  {rule: RelabelRule{Action: relabelKeep, SourceLabels: []string{"host"}, Regex: "example\\.com"}},
+		"unknown action":        {rule: RelabelRule{Action: "hashmod", SourceLabels: []string{"path"}}, expectErr: true},
+		"missing sources":       {rule: RelabelRule{Action: relabelDrop, Regex: ".*"}, expectErr: true},
+		"missing target":        {rule: RelabelRule{SourceLabels: []string{"path"}}, expectErr: true},
+		"metric name target":    {rule: RelabelRule{SourceLabels: []string{"path"}, TargetLabel: "__name__"}, expectErr: true},
+		"drop with target":      {rule: RelabelRule{Action: relabelDrop, SourceLabels: []string{"path"}, TargetLabel: "path"}, expectErr: true},
+		"invalid regex":         {rule: RelabelRule{Action: relabelDrop, SourceLabels: []string{"path"}, Regex: "("}, expectErr: true},
+		"keep with replacement": {rule: RelabelRule{Action: relabelKeep, SourceLabels: []string{"path"}, Replacement: "x"}, expectErr: true},
+	}
+	for name, tt := range tests {
+		if _, err := compileRelabeling([]RelabelRule{tt.rule}); (err != nil) != tt.expectErr {
+			t.Errorf("%s: expected error %v, got %v", name, tt.expectErr, err)
+		}
+	}
+}
+
+// TestRelabelCollector tests that relabeling applies to collected series,
+// merging those relabeled to the same labels, and can be turned off
+func TestRelabelCollector(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	collectTestRequests(t, uc)
+
+	rl, err := compileRelabeling([]RelabelRule{
+		{Action: relabelDrop, SourceLabels: []string{"__name__"}, Regex: "caddy_usage_requests_by_ip_total"},
+		{SourceLabels: []string{"path"}, Regex: "/api/users(/.*)?", TargetLabel: "path", Replacement: "/api/users/*"},
+		{SourceLabels: []string{"status_code"}, Regex: "([0-9]).*", TargetLabel: "status_code", Replacement: "${1}xx"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	globalUsageMetrics.setRelabeling(rl)
+
+	usagetest.AssertAbsent(t, registry, "requests_by_ip_total", nil)
+	usagetest.AssertCount(t, registry, "requests_total", nil, 3)
+	usagetest.AssertValue(t, registry, "requests_total", usagetest.Labels{"method": "GET", "path": "/api/users/*", "status_code": "2xx"}, 2)
+	usagetest.AssertValue(t, registry, "requests_total", usagetest.Labels{"method": "DELETE", "path": "/api/users/*", "status_code": "4xx"}, 1)
+	usagetest.AssertValue(t, registry, "request_duration_seconds", usagetest.Labels{"method": "GET", "status_code": "2xx"}, 2)
+
+	globalUsageMetrics.setRelabeling(nil)
+	usagetest.AssertValue(t, registry, "requests_by_ip_total", usagetest.Labels{"client_ip": "192.168.1.1"}, 2)
+	usagetest.AssertValue(t, registry, "requests_total", usagetest.Labels{"path": "/api/users/1", "status_code": "404"}, 1)
+}
+
+// TestUnmarshalRelabel tests parsing of relabel blocks
+func TestUnmarshalRelabel(t *testing.T) {
+	var uc UsageCollector
+	input := `usage {
+		relabel drop {
+			source_labels __name__
+			regex caddy_usage_requests_by_headers_total
+		}
+		relabel {
+			source_labels method status_code
+			separator :
+			regex "GET:(.*)"
+			target_label status_code
+			replacement $1
+		}
+	}`
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []RelabelRule{
+		{Action: relabelDrop, SourceLabels: []string{"__name__"}, Regex: "caddy_usage_requests_by_headers_total"},
+		{SourceLabels: []string{"method", "status_code"}, Separator: ":", Regex: "GET:(.*)", TargetLabel: "status_code", Replacement: "$1"},
+	}
+	if !reflect.DeepEqual(uc.Relabel, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, uc.Relabel)
+	}
+
+	for _, invalid := range []string{
+		"usage {\n relabel drop extra {\n source_labels path\n }\n}",
+		"usage {\n relabel {\n source_labels\n }\n}",
+		"usage {\n relabel {\n regex\n }\n}",
+		"usage {\n relabel {\n regex a b\n }\n}",
+		"usage {\n relabel {\n modulus 8\n }\n}",
+	} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package caddyusage
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	// resetTokens are the bearer tokens configured by handlers for the
+	// admin API's reset endpoint, with their number of users
+	resetTokens   = make(map[string]int)
+	resetTokensMu sync.Mutex
+)
+
+// acquireResetToken allows resets with token. Each call must be balanced
+// by a call to releaseResetToken.
+func acquireResetToken(token string) {
+	resetTokensMu.Lock()
+	defer resetTokensMu.Unlock()
+
+	resetTokens[token]++
+}
+
+// releaseResetToken releases a handler's token, no longer allowing resets
+// with it once no handler configures it anymore
+func releaseResetToken(token string) {
+	resetTokensMu.Lock()
+	defer resetTokensMu.Unlock()
+
+	if resetTokens[token]--; resetTokens[token] <= 0 {
+		delete(resetTokens, token)
+	}
+}
+
+// resetAuthorized reports whether a request carries one of the configured
+// reset tokens as a bearer token. Without any configured, resets are
+// refused. Every token is compared, in constant time, so that timing
+// doesn't tell how much of a token matched.
+func resetAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+
+	resetTokensMu.Lock()
+	defer resetTokensMu.Unlock()
+
+	authorized := false
+	for configured := range resetTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(configured)) == 1 {
+			authorized = true
+		}
+	}
+	return authorized
+}
+
+// resetters returns a function clearing each of the metrics, by name
+// without namespace, including the gauges that aren't plain vectors
+func (um *usageMetrics) resetters() map[string]func() {
+	resetters := map[string]func(){
+		"last_scrape_timestamp_seconds": um.lastScrape.Reset,
+		"active_paths":                  um.activePaths.reset,
+		"active_hosts":                  um.activeHosts.reset,
+		"active_clients":                um.activeClients.reset,
+		"apdex_score":                   um.apdex.reset,
+		"aggregates":                    um.aggregates.reset,
+		"top_paths":                     um.topPaths.reset,
+		"top_clients":                   um.topClients.reset,
+		"top_user_agents":               um.topUserAgents.reset,
+		"duplicate_content":             um.contents.reset,
+	}
+	resetters["unique_clients"] = func() {
+		for _, sketch := range um.uniqueClients {
+			sketch.reset()
+		}
+	}
+	for name, vec := range um.vectors() {
+		resetters[name] = vec.Reset
+	}
+	// Series resolved by the cache are gone with their vectors' series
+	for _, name := range []string{"requests_total", "request_duration_seconds", "ttfb_seconds"} {
+		reset := resetters[name]
+		resetters[name] = func() {
+			reset()
+			um.series.invalidate()
+		}
+	}
+	return resetters
+}
+
+// resetMetrics clears the named metric, or all usage metrics if name is
+// empty, in the shared metrics and every namespace. The _total suffix of
+// counters may be omitted. It returns the names of the metrics cleared,
+// none if no metrics are initialized.
+func resetMetrics(name string) ([]string, error) {
+	var names []string
+	for _, um := range usageMetricSets() {
+		resetters := um.resetters()
+		if name == "" {
+			for _, reset := range resetters {
+				reset()
+			}
+			names = slices.Sorted(maps.Keys(resetters))
+			continue
+		}
+
+		full := name
+		if _, ok := resetters[full]; !ok && !strings.HasSuffix(full, "_total") {
+			full += "_total"
+		}
+		reset, ok := resetters[full]
+		if !ok {
+			return nil, fmt.Errorf("unknown metric '%s'", name)
+		}
+		reset()
+		names = []string{full}
+	}
+
+	// Forget the label values of the series cleared
+	if len(names) > 0 {
+		labelValues.reset()
+	}
+	return names, nil
+}
@@ -0,0 +1,144 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// resetRequest returns a reset request carrying the bearer token
+func resetRequest(method, target, token string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// TestResetEndpoint tests clearing one or all usage metrics through the admin API
+func TestResetEndpoint(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	acquireResetToken("s3cret")
+	defer releaseResetToken("s3cret")
+
+	collectTestRequests(t, uc)
+	if testutil.CollectAndCount(globalUsageMetrics.requestsByIP) == 0 {
+		t.Fatal("Expected requests to be recorded")
+	}
+
+	// A single metric, named without its _total suffix
+	w, err := serveAdmin(t, "/usage/reset", resetRequest("POST", "/usage/reset?metric=requests_by_ip", "s3cret"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var body struct {
+		Reset []string `json:"reset"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if expected := []string{"requests_by_ip_total"}; !reflect.DeepEqual(body.Reset, expected) {
+		t.Errorf("Expected %v reset, got %v", expected, body.Reset)
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.requestsByIP); n != 0 {
+		t.Errorf("Expected requests_by_ip_total to be cleared, got %d series", n)
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.requestsTotal); n == 0 {
+		t.Error("Expected requests_total to be kept")
+	}
+
+	// Everything
+	if _, err := serveAdmin(t, "/usage/reset", resetRequest("POST", "/usage/reset", "s3cret")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.requestsTotal); n != 0 {
+		t.Errorf("Expected requests_total to be cleared, got %d series", n)
+	}
+	if got := globalUsageMetrics.activeClients.estimate(time.Now()); got != 0 {
+		t.Errorf("Expected active clients to be cleared, got %v", got)
+	}
+}
+
+// TestResetEndpointErrors tests rejected reset requests
+func TestResetEndpointErrors(t *testing.T) {
+	_, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	// Without a configured token, resets are refused
+	if _, err := serveAdmin(t, "/usage/reset", resetRequest("POST", "/usage/reset", "s3cret")); apiErrorStatus(err) != http.StatusUnauthorized {
+		t.Errorf("Expected resets to be refused without a configured token, got %v", err)
+	}
+
+	acquireResetToken("s3cret")
+	defer releaseResetToken("s3cret")
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		token    string
+		expected int
+	}{
+		{"GET", "GET", "/usage/reset", "s3cret", http.StatusMethodNotAllowed},
+		{"no token", "POST", "/usage/reset", "", http.StatusUnauthorized},
+		{"wrong token", "POST", "/usage/reset", "guess", http.StatusUnauthorized},
+		{"unknown metric", "POST", "/usage/reset?metric=nonexistent", "s3cret", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := serveAdmin(t, "/usage/reset", resetRequest(tt.method, tt.target, tt.token))
+			if got := apiErrorStatus(err); got != tt.expected {
+				t.Errorf("Expected status %d, got %d (%v)", tt.expected, got, err)
+			}
+		})
+	}
+}
+
+// TestResetToken tests that handlers allow resets with their token for as
+// long as they are provisioned
+func TestResetToken(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	t.Setenv("USAGE_RESET_TOKEN", "from-env")
+	uc.ResetToken = "{env.USAGE_RESET_TOKEN}"
+	if err := uc.Provision(uc.ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if !resetAuthorized(resetRequest("POST", "/usage/reset", "from-env")) {
+		t.Error("Expected the token from the environment to allow resets")
+	}
+
+	if err := uc.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if resetAuthorized(resetRequest("POST", "/usage/reset", "from-env")) {
+		t.Error("Expected the token to stop allowing resets once released")
+	}
+}
+
+// TestUnmarshalResetToken tests parsing of the reset_token option
+func TestUnmarshalResetToken(t *testing.T) {
+	var uc UsageCollector
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser("usage {\n reset_token s3cret\n}")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if uc.ResetToken != "s3cret" {
+		t.Errorf("Expected reset token s3cret, got %q", uc.ResetToken)
+	}
+
+	for _, invalid := range []string{"usage {\n reset_token\n}", "usage {\n reset_token a b\n}"} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
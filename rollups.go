@@ -0,0 +1,525 @@
+package caddyusage
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Usage rollup defaults and bounds
+const (
+	defaultRollupRetention = 90 * 24 * time.Hour
+	rollupMonthlyRetention = 24
+	rollupSaveInterval     = 5 * time.Minute
+	maxRollups             = 100000
+)
+
+// Rollup granularities and the layouts of their periods
+const (
+	rollupDaily   = "daily"
+	rollupMonthly = "monthly"
+
+	rollupDayLayout   = "2006-01-02"
+	rollupMonthLayout = "2006-01"
+)
+
+// What usage is rolled up by
+const (
+	rollupByHost   = "host"
+	rollupByAPIKey = "api_key"
+)
+
+// rollupsCSVHeader is the header row of rollups exported as CSV
+var rollupsCSVHeader = []string{"period", "by", "tenant", "requests", "request_bytes", "response_bytes", "client_errors", "server_errors"}
+
+// RollupsConfig aggregates the usage of each host and API key into daily
+// and monthly rollups of requests, bytes and errors, persisted so that they
+// survive restarts and exported by the admin API as JSON or CSV, for
+// invoicing.
+type RollupsConfig struct {
+	// File is where rollups are persisted. Defaults to usage/rollups.json
+	// in Caddy's data directory.
+	File string `json:"file,omitempty"`
+
+	// Retention is how long daily rollups are kept. Monthly rollups are
+	// kept for 24 months. Defaults to 90 days.
+	Retention caddy.Duration `json:"retention,omitempty"`
+}
+
+// validate checks the retention
+func (rc *RollupsConfig) validate() error {
+	if rc.Retention < 0 {
+		return fmt.Errorf("rollups retention must not be negative, got %s", time.Duration(rc.Retention))
+	}
+	if rc.Retention > 0 && rc.Retention < caddy.Duration(24*time.Hour) {
+		return fmt.Errorf("rollups retention must be at least a day, got %s", time.Duration(rc.Retention))
+	}
+	return nil
+}
+
+// file returns the configured file or its default
+func (rc *RollupsConfig) file() string {
+	if rc.File != "" {
+		return rc.File
+	}
+	return filepath.Join(caddy.AppDataDir(), "usage", "rollups.json")
+}
+
+// rollupKey identifies the usage of a tenant in a period
+type rollupKey struct {
+	period string
+	by     string
+	tenant string
+}
+
+// granularity returns the granularity of the key's period
+func (k rollupKey) granularity() string {
+	if len(k.period) == len(rollupMonthLayout) {
+		return rollupMonthly
+	}
+	return rollupDaily
+}
+
+// rollupUsage is the usage of a tenant in a period
+type rollupUsage struct {
+	Requests      uint64 `json:"requests"`
+	RequestBytes  uint64 `json:"request_bytes"`
+	ResponseBytes uint64 `json:"response_bytes"`
+	ClientErrors  uint64 `json:"client_errors"`
+	ServerErrors  uint64 `json:"server_errors"`
+}
+
+// add adds other usage
+func (u *rollupUsage) add(other rollupUsage) {
+	u.Requests += other.Requests
+	u.RequestBytes += other.RequestBytes
+	u.ResponseBytes += other.ResponseBytes
+	u.ClientErrors += other.ClientErrors
+	u.ServerErrors += other.ServerErrors
+}
+
+// rollup is the usage of a tenant in a period, as persisted and reported
+type rollup struct {
+	Period string `json:"period"`
+	By     string `json:"by"`
+	Tenant string `json:"tenant"`
+	rollupUsage
+}
+
+// rollupTracker aggregates usage into rollups and persists them. Handlers
+// configured with the same file share a tracker, so config reloads keep
+// its rollups.
+type rollupTracker struct {
+	path   string
+	logger *zap.Logger
+
+	mu        sync.Mutex
+	retention time.Duration
+	rollups   map[rollupKey]*rollupUsage
+	dirty     bool
+	saveFails bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// rollupTrackerEntry is a shared tracker and the number of handlers using it
+type rollupTrackerEntry struct {
+	tracker *rollupTracker
+	refs    int
+}
+
+var (
+	// Running trackers by file
+	rollupTrackers   = make(map[string]*rollupTrackerEntry)
+	rollupTrackersMu sync.Mutex
+)
+
+// acquireRollupTracker returns the running tracker for the configured
+// file, starting one if needed. Since trackers are shared, the most
+// recently provisioned handler's retention applies. Each call must be
+// balanced by a call to releaseRollupTracker.
+func acquireRollupTracker(rc *RollupsConfig, logger *zap.Logger) *rollupTracker {
+	retention := defaultRollupRetention
+	if rc.Retention > 0 {
+		retention = time.Duration(rc.Retention)
+	}
+
+	rollupTrackersMu.Lock()
+	defer rollupTrackersMu.Unlock()
+
+	path := rc.file()
+	if entry, ok := rollupTrackers[path]; ok {
+		entry.refs++
+		entry.tracker.mu.Lock()
+		entry.tracker.retention = retention
+		entry.tracker.mu.Unlock()
+		return entry.tracker
+	}
+
+	tracker := newRollupTracker(path, retention, logger)
+	tracker.start()
+	rollupTrackers[path] = &rollupTrackerEntry{tracker: tracker, refs: 1}
+	return tracker
+}
+
+// releaseRollupTracker releases a handler's use of a tracker, stopping it
+// and persisting its rollups once no handler uses it anymore
+func releaseRollupTracker(tracker *rollupTracker) error {
+	rollupTrackersMu.Lock()
+	defer rollupTrackersMu.Unlock()
+
+	entry, ok := rollupTrackers[tracker.path]
+	if !ok || entry.tracker != tracker {
+		return nil
+	}
+	if entry.refs--; entry.refs > 0 {
+		return nil
+	}
+	delete(rollupTrackers, tracker.path)
+	return tracker.stop()
+}
+
+// newRollupTracker creates a tracker, loading the rollups persisted in path
+func newRollupTracker(path string, retention time.Duration, logger *zap.Logger) *rollupTracker {
+	t := &rollupTracker{
+		path:      path,
+		logger:    logger,
+		retention: retention,
+		rollups:   make(map[rollupKey]*rollupUsage),
+		done:      make(chan struct{}),
+	}
+	t.load()
+	return t
+}
+
+// start persists the rollups periodically
+func (t *rollupTracker) start() {
+	ticker := newTicker(rollupSaveInterval)
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				t.saveLogged()
+			case <-t.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the periodic saves and persists the rollups
+func (t *rollupTracker) stop() error {
+	close(t.done)
+	t.wg.Wait()
+	return t.save()
+}
+
+// record adds usage to the daily and monthly rollups of a tenant. New
+// rollups are dropped once the tracker is full.
+func (t *rollupTracker) record(by, tenant string, usage rollupUsage, now time.Time) {
+	now = now.UTC()
+	keys := [...]rollupKey{
+		{period: now.Format(rollupDayLayout), by: by, tenant: tenant},
+		{period: now.Format(rollupMonthLayout), by: by, tenant: tenant},
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range keys {
+		u, ok := t.rollups[key]
+		if !ok {
+			if len(t.rollups) >= maxRollups {
+				t.evictExpired(now)
+				if len(t.rollups) >= maxRollups {
+					continue
+				}
+			}
+			u = new(rollupUsage)
+			t.rollups[key] = u
+		}
+		u.add(usage)
+	}
+	t.dirty = true
+}
+
+// evictExpired drops the daily rollups older than the retention and the
+// monthly ones older than rollupMonthlyRetention months. The caller must
+// hold t.mu.
+func (t *rollupTracker) evictExpired(now time.Time) {
+	now = now.UTC()
+	oldestDay := now.Add(-t.retention).Format(rollupDayLayout)
+	oldestMonth := time.Date(now.Year(), now.Month()-rollupMonthlyRetention, 1, 0, 0, 0, 0, time.UTC).Format(rollupMonthLayout)
+	for key := range t.rollups {
+		oldest := oldestDay
+		if key.granularity() == rollupMonthly {
+			oldest = oldestMonth
+		}
+		if key.period <= oldest {
+			delete(t.rollups, key)
+		}
+	}
+}
+
+// load reads persisted rollups. A missing or unreadable file just means
+// starting with no rollups.
+func (t *rollupTracker) load() {
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return
+	}
+
+	var rollups []rollup
+	if err := json.Unmarshal(data, &rollups); err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, r := range rollups {
+		if len(t.rollups) >= maxRollups {
+			break
+		}
+		usage := r.rollupUsage
+		t.rollups[rollupKey{period: r.Period, by: r.By, tenant: r.Tenant}] = &usage
+	}
+	t.evictExpired(now())
+}
+
+// save persists the rollups if they changed since they were last saved.
+// The file is replaced atomically so that a crash never leaves it
+// truncated.
+func (t *rollupTracker) save() error {
+	t.mu.Lock()
+	if !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	t.evictExpired(now())
+	rollups := make([]rollup, 0, len(t.rollups))
+	for key, u := range t.rollups {
+		rollups = append(rollups, rollup{Period: key.period, By: key.by, Tenant: key.tenant, rollupUsage: *u})
+	}
+	data, err := json.Marshal(rollups)
+	t.dirty = false
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(t.path, data, 0o600); err != nil {
+		t.mu.Lock()
+		t.dirty = true
+		t.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// saveLogged persists the rollups, logging when saves start or stop failing
+func (t *rollupTracker) saveLogged() {
+	err := t.save()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case err != nil && !t.saveFails:
+		t.logger.Warn("failed to save usage rollups", zap.String("path", t.path), zap.Error(err))
+	case err == nil && t.saveFails:
+		t.logger.Info("saving usage rollups again", zap.String("path", t.path))
+	}
+	t.saveFails = err != nil
+}
+
+// rollupQuery selects the rollups to report
+type rollupQuery struct {
+	granularity string
+	by          string
+	tenant      string
+	from, to    string
+}
+
+// parseRollupQuery reads the granularity, by, tenant, from and to query
+// parameters. from and to are inclusive periods in the layout of the
+// granularity, which defaults to monthly.
+func parseRollupQuery(query url.Values) (rollupQuery, error) {
+	q := rollupQuery{
+		granularity: cmp.Or(query.Get("granularity"), rollupMonthly),
+		by:          query.Get("by"),
+		tenant:      query.Get("tenant"),
+		from:        query.Get("from"),
+		to:          query.Get("to"),
+	}
+
+	layout := rollupMonthLayout
+	switch q.granularity {
+	case rollupMonthly:
+	case rollupDaily:
+		layout = rollupDayLayout
+	default:
+		return q, fmt.Errorf("granularity must be daily or monthly, got '%s'", q.granularity)
+	}
+	if q.by != "" && q.by != rollupByHost && q.by != rollupByAPIKey {
+		return q, fmt.Errorf("by must be host or api_key, got '%s'", q.by)
+	}
+	for _, period := range []string{q.from, q.to} {
+		if _, err := time.Parse(layout, period); period != "" && err != nil {
+			return q, fmt.Errorf("invalid %s period '%s': must be formatted as %s", q.granularity, period, layout)
+		}
+	}
+	return q, nil
+}
+
+// matches reports whether a rollup is selected
+func (q rollupQuery) matches(key rollupKey) bool {
+	return key.granularity() == q.granularity &&
+		(q.by == "" || key.by == q.by) &&
+		(q.tenant == "" || key.tenant == q.tenant) &&
+		(q.from == "" || key.period >= q.from) &&
+		(q.to == "" || key.period <= q.to)
+}
+
+// usageRollups reports the selected rollups of the running trackers,
+// summing those of trackers sharing a tenant, by period, then by and tenant
+func usageRollups(q rollupQuery) []rollup {
+	rollupTrackersMu.Lock()
+	trackers := make([]*rollupTracker, 0, len(rollupTrackers))
+	for _, entry := range rollupTrackers {
+		trackers = append(trackers, entry.tracker)
+	}
+	rollupTrackersMu.Unlock()
+
+	usage := make(map[rollupKey]*rollupUsage)
+	for _, t := range trackers {
+		t.mu.Lock()
+		for key, u := range t.rollups {
+			if !q.matches(key) {
+				continue
+			}
+			total, ok := usage[key]
+			if !ok {
+				total = new(rollupUsage)
+				usage[key] = total
+			}
+			total.add(*u)
+		}
+		t.mu.Unlock()
+	}
+
+	out := make([]rollup, 0, len(usage))
+	for key, u := range usage {
+		out = append(out, rollup{Period: key.period, By: key.by, Tenant: key.tenant, rollupUsage: *u})
+	}
+	slices.SortFunc(out, func(a, b rollup) int {
+		return cmp.Or(cmp.Compare(a.Period, b.Period), cmp.Compare(a.By, b.By), cmp.Compare(a.Tenant, b.Tenant))
+	})
+	return out
+}
+
+// writeRollupsCSV writes rollups as CSV, with a header row
+func writeRollupsCSV(w io.Writer, rollups []rollup) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(rollupsCSVHeader); err != nil {
+		return err
+	}
+	for _, r := range rollups {
+		record := []string{
+			r.Period,
+			r.By,
+			r.Tenant,
+			strconv.FormatUint(r.Requests, 10),
+			strconv.FormatUint(r.RequestBytes, 10),
+			strconv.FormatUint(r.ResponseBytes, 10),
+			strconv.FormatUint(r.ClientErrors, 10),
+			strconv.FormatUint(r.ServerErrors, 10),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// collectRollups adds a request to the rollups of its host and, when it
+// carries one, of its API key, read as configured by api_keys
+func (uc *UsageCollector) collectRollups(rec recordedResponse, r *http.Request, host string) {
+	usage := rollupUsage{Requests: 1, ResponseBytes: uint64(max(rec.Size(), 0))}
+	if r.ContentLength > 0 {
+		usage.RequestBytes = uint64(r.ContentLength)
+	}
+	switch status := rec.Status(); {
+	case status >= 500:
+		usage.ServerErrors = 1
+	case status >= 400:
+		usage.ClientErrors = 1
+	}
+
+	seen := now()
+	uc.rollupTracker.record(rollupByHost, host, usage, seen)
+
+	keys := uc.APIKeys
+	if keys == nil {
+		keys = &APIKeysConfig{}
+	}
+	if key := keys.key(r); key != anonymousAPIKey {
+		uc.rollupTracker.record(rollupByAPIKey, key, usage, seen)
+	}
+}
+
+// unmarshalRollupsConfig parses a rollups directive, whose block is
+// optional:
+//
+//	rollups [{
+//	    file <path>
+//	    retention <duration>
+//	}]
+func unmarshalRollupsConfig(d *caddyfile.Dispenser) (*RollupsConfig, error) {
+	rc := new(RollupsConfig)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		value := d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "file":
+			rc.File = value
+		case "retention":
+			dur, err := caddy.ParseDuration(value)
+			if err != nil {
+				return nil, d.Errf("invalid rollups retention '%s': %v", value, err)
+			}
+			rc.Retention = caddy.Duration(dur)
+		default:
+			return nil, d.Errf("unrecognized rollups option '%s'", option)
+		}
+	}
+	return rc, nil
+}
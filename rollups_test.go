@@ -0,0 +1,183 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// fetchRollups fetches usage rollups as JSON from the admin API
+func fetchRollups(t *testing.T, target string) []rollup {
+	t.Helper()
+
+	w, err := serveAdmin(t, "/usage/rollups", httptest.NewRequest("GET", target, nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var rollups []rollup
+	if err := json.Unmarshal(w.Body.Bytes(), &rollups); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return rollups
+}
+
+// TestRollups tests that requests are rolled up by day and month per host
+// and API key, and exported as JSON and CSV
+func TestRollups(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	uc.rollupTracker = acquireRollupTracker(&RollupsConfig{File: filepath.Join(t.TempDir(), "rollups.json")}, zap.NewNop())
+	defer func() { _ = releaseRollupTracker(uc.rollupTracker) }()
+
+	send := func(method, host, key, body string, status int) {
+		req := httptest.NewRequest(method, "http://"+host+"/", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("X-Api-Key", key)
+		}
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(status)
+		_, _ = rec.Write([]byte("ok"))
+		uc.collectMetrics(rec, req, now(), nil)
+	}
+	send("POST", "example.com", "key-1", "hello", 200)
+	send("GET", "example.com", "", "", 404)
+	send("GET", "api.example.com", "key-1", "", 503)
+	clock.Advance(31 * 24 * time.Hour)
+	send("GET", "example.com", "", "", 200)
+
+	expected := []rollup{
+		{Period: "2025-01", By: rollupByHost, Tenant: "api.example.com", rollupUsage: rollupUsage{Requests: 1, ResponseBytes: 2, ServerErrors: 1}},
+		{Period: "2025-01", By: rollupByHost, Tenant: "example.com", rollupUsage: rollupUsage{Requests: 2, RequestBytes: 5, ResponseBytes: 4, ClientErrors: 1}},
+		{Period: "2025-02", By: rollupByHost, Tenant: "example.com", rollupUsage: rollupUsage{Requests: 1, ResponseBytes: 2}},
+	}
+	if rollups := fetchRollups(t, "/usage/rollups?by=host"); !reflect.DeepEqual(rollups, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, rollups)
+	}
+
+	daily := fetchRollups(t, "/usage/rollups?granularity=daily&from=2025-01-01&to=2025-01-31&tenant=example.com")
+	if len(daily) != 1 || daily[0].Period != "2025-01-01" || daily[0].Requests != 2 {
+		t.Errorf("Expected a single day of example.com, got %+v", daily)
+	}
+
+	w, err := serveAdmin(t, "/usage/rollups", httptest.NewRequest("GET", "/usage/rollups?by=api_key&format=csv", nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectedCSV := "period,by,tenant,requests,request_bytes,response_bytes,client_errors,server_errors\n2025-01,api_key,key-1,2,5,4,0,1\n"
+	if got := w.Body.String(); got != expectedCSV {
+		t.Errorf("Expected CSV %q, got %q", expectedCSV, got)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("Expected text/csv, got %q", ct)
+	}
+
+	for _, target := range []string{
+		"/usage/rollups?granularity=weekly",
+		"/usage/rollups?by=path",
+		"/usage/rollups?granularity=daily&from=2025-01",
+		"/usage/rollups?format=xml",
+	} {
+		if _, err := serveAdmin(t, "/usage/rollups", httptest.NewRequest("GET", target, nil)); err == nil {
+			t.Errorf("%s: expected an error but got none", target)
+		}
+	}
+}
+
+// TestRollupsPersist tests that rollups survive a restart and daily ones
+// expire after the retention
+func TestRollupsPersist(t *testing.T) {
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	rc := &RollupsConfig{File: filepath.Join(t.TempDir(), "rollups.json"), Retention: caddy.Duration(7 * 24 * time.Hour)}
+	tracker := acquireRollupTracker(rc, zap.NewNop())
+	tracker.record(rollupByHost, "example.com", rollupUsage{Requests: 1, ResponseBytes: 100}, now())
+	if err := releaseRollupTracker(tracker); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	clock.Advance(24 * time.Hour)
+	tracker = acquireRollupTracker(rc, zap.NewNop())
+	defer func() { _ = releaseRollupTracker(tracker) }()
+
+	if rollups := usageRollups(rollupQuery{granularity: rollupDaily}); len(rollups) != 1 || rollups[0].ResponseBytes != 100 {
+		t.Errorf("Expected the daily rollup to be restored, got %+v", rollups)
+	}
+
+	clock.Advance(7 * 24 * time.Hour)
+	tracker.mu.Lock()
+	tracker.evictExpired(now())
+	tracker.mu.Unlock()
+	if rollups := usageRollups(rollupQuery{granularity: rollupDaily}); len(rollups) != 0 {
+		t.Errorf("Expected the daily rollup to expire, got %+v", rollups)
+	}
+	if rollups := usageRollups(rollupQuery{granularity: rollupMonthly}); len(rollups) != 1 || rollups[0].Requests != 1 {
+		t.Errorf("Expected the monthly rollup to be kept, got %+v", rollups)
+	}
+}
+
+// TestRollupsValidate tests validation of rollups options
+func TestRollupsValidate(t *testing.T) {
+	tests := map[string]struct {
+		config    RollupsConfig
+		expectErr bool
+	}{
+		"default":            {config: RollupsConfig{}},
+		"a year":             {config: RollupsConfig{Retention: caddy.Duration(365 * 24 * time.Hour)}},
+		"negative retention": {config: RollupsConfig{Retention: -1}, expectErr: true},
+		"under a day":        {config: RollupsConfig{Retention: caddy.Duration(time.Hour)}, expectErr: true},
+	}
+	for name, tt := range tests {
+		if err := tt.config.validate(); (err != nil) != tt.expectErr {
+			t.Errorf("%s: expected error %v, got %v", name, tt.expectErr, err)
+		}
+	}
+}
+
+// TestUnmarshalRollups tests parsing of the rollups option
+func TestUnmarshalRollups(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *RollupsConfig
+		expectErr bool
+	}{
+		{input: "usage {\n rollups\n}", expected: &RollupsConfig{}},
+		{input: "usage {\n rollups {\n file /var/lib/caddy/rollups.json\n retention 180d\n }\n}", expected: &RollupsConfig{File: "/var/lib/caddy/rollups.json", Retention: caddy.Duration(180 * 24 * time.Hour)}},
+		{input: "usage {\n rollups monthly\n}", expectErr: true},
+		{input: "usage {\n rollups {\n retention forever\n }\n}", expectErr: true},
+		{input: "usage {\n rollups {\n file\n }\n}", expectErr: true},
+		{input: "usage {\n rollups {\n by host\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.Rollups, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.Rollups)
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+package caddyusage
+
+// collectRouteMetrics records requests by the logical route named by
+// route_name, so that routes can be compared without matching their paths.
+// Streams, recorded apart from request durations, are only counted.
+func (uc *UsageCollector) collectRouteMetrics(um *usageMetrics, statusCode, method string, duration float64, stream bool) {
+	if uc.RouteName == "" {
+		return
+	}
+	um.routeRequests.WithLabelValues(uc.RouteName, statusCode, method).Inc()
+	if !stream {
+		um.routeDuration.WithLabelValues(uc.RouteName, statusCode).Observe(duration)
+	}
+}
@@ -0,0 +1,40 @@
+package caddyusage
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+	"go.uber.org/zap"
+)
+
+// TestRouteMetrics tests that handlers with a route name record their
+// requests by route in the shared metrics
+func TestRouteMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	api := &UsageCollector{logger: zap.NewNop(), ctx: uc.ctx, RouteName: "api"}
+	static := &UsageCollector{logger: zap.NewNop(), ctx: uc.ctx, RouteName: "static"}
+
+	collect := func(uc *UsageCollector, target string, status int) {
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(status)
+		uc.collectMetrics(rec, httptest.NewRequest("GET", target, nil), now().Add(-100*time.Millisecond), nil)
+	}
+	collect(api, "http://example.com/v1/users", 200)
+	collect(api, "http://example.com/v1/orders", 500)
+	collect(static, "http://example.com/logo.png", 200)
+	collect(uc, "http://example.com/", 200)
+
+	usagetest.AssertValue(t, registry, "route_requests_total", usagetest.Labels{"route": "api"}, 2)
+	usagetest.AssertValue(t, registry, "route_requests_total", usagetest.Labels{"route": "api", "status_code": "500", "method": "GET"}, 1)
+	usagetest.AssertValue(t, registry, "route_requests_total", usagetest.Labels{"route": "static"}, 1)
+	usagetest.AssertValue(t, registry, "route_request_duration_seconds", usagetest.Labels{"route": "api", "status_code": "200"}, 1)
+
+	// Handlers without a route name aren't recorded by route
+	usagetest.AssertCount(t, registry, "route_requests_total", nil, 3)
+	usagetest.AssertValue(t, registry, "requests_total", nil, 4)
+}
@@ -0,0 +1,99 @@
+package caddyusage
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// sampleWeight returns the weight with which the current request should
+// be recorded by the expensive dimensions, or 0 if it should be skipped.
+// The configured sample rate applies on top of the collection governor's
+// sampling.
+func (uc *UsageCollector) sampleWeight() float64 {
+	weight := uc.governor.weight()
+	if weight == 0 || uc.SampleRate <= 0 || uc.SampleRate >= 1 {
+		return weight
+	}
+	if rand.Float64() >= uc.SampleRate {
+		return 0
+	}
+	return weight / uc.SampleRate
+}
+
+// sampledVarKey is the request variable flagging sampled requests
+const sampledVarKey = "usage_sampled"
+
+// defaultSampledHeader is the response header set by sampled_header
+// without a name
+const defaultSampledHeader = "X-Usage-Sampled"
+
+// sampled reports whether a request with the given sample weight is
+// sampled for detailed collection: recorded by the expensive dimensions,
+// as decided by sample_rate and collection_budget, and, when inspectors
+// are configured, with its body inspected
+func (uc *UsageCollector) sampled(weight float64, tee *bodyTee) bool {
+	if weight == 0 {
+		return false
+	}
+	return uc.Inspect == nil || len(uc.Inspect.inspectors) == 0 || tee != nil
+}
+
+// markSampled flags a sampled request in its variables and, when
+// configured, in a response header
+func (uc *UsageCollector) markSampled(w http.ResponseWriter, r *http.Request) {
+	caddyhttp.SetVar(r.Context(), sampledVarKey, true)
+	if header := uc.sampledHeader(); header != "" {
+		w.Header().Set(header, "1")
+	}
+}
+
+// sampledHeader returns the response header flagging sampled requests,
+// or an empty string if none is configured
+func (uc *UsageCollector) sampledHeader() string {
+	if uc.SampledHeader == "" && uc.Inspect != nil {
+		return uc.Inspect.SampledHeader
+	}
+	return uc.SampledHeader
+}
+
+// Sampled reports whether a request was sampled for detailed collection
+// by a usage handler earlier in the chain
+func Sampled(r *http.Request) bool {
+	sampled, _ := caddyhttp.GetVar(r.Context(), sampledVarKey).(bool)
+	return sampled
+}
+
+// snippetArgRegexp matches the placeholder of a snippet argument, which
+// Caddy leaves as-is when the argument isn't passed to the import
+var snippetArgRegexp = regexp.MustCompile(`^\{args\[[0-9:]*\]\}$`)
+
+// snippetArg returns the value of an option that may be passed as a
+// snippet argument, or an empty string if the argument was omitted
+func snippetArg(value string) string {
+	if snippetArgRegexp.MatchString(value) {
+		return ""
+	}
+	return value
+}
+
+// parseSampleRate parses a sample rate between 0 and 1. An omitted
+// snippet argument or an empty value is the default rate.
+func parseSampleRate(value string) (float64, error) {
+	value = snippetArg(value)
+	if value == "" {
+		return 0, nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate <= 0 || rate > 1 {
+		return 0, errors.New("must be greater than 0 and at most 1")
+	}
+	return rate, nil
+}
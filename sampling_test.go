@@ -0,0 +1,176 @@
+package caddyusage
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+	"go.uber.org/zap"
+)
+
+// TestSampleWeight tests that sampled requests are weighted so that
+// totals stay approximately right
+func TestSampleWeight(t *testing.T) {
+	uc := &UsageCollector{}
+	if weight := uc.sampleWeight(); weight != 1 {
+		t.Errorf("Expected every request to be recorded, got weight %v", weight)
+	}
+
+	uc.SampleRate = 0.25
+	const requests = 20000
+	var total float64
+	for range requests {
+		switch weight := uc.sampleWeight(); weight {
+		case 0, 4:
+			total += weight
+		default:
+			t.Fatalf("Expected a weight of 0 or 4, got %v", weight)
+		}
+	}
+	if math.Abs(total-requests) > requests/10 {
+		t.Errorf("Expected a weighted total near %d, got %v", requests, total)
+	}
+
+	if err := (&UsageCollector{SampleRate: 1.5}).Validate(); err == nil {
+		t.Error("Expected a sample rate above 1 to be rejected")
+	}
+}
+
+// TestSampledFlag tests that requests are flagged as sampled exactly when
+// the expensive dimensions record them
+func TestSampledFlag(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.SampledHeader = defaultSampledHeader
+	uc.governor = newCollectionGovernor(time.Millisecond, zap.NewNop())
+	uc.governor.factor.Store(2)
+
+	flagged := 0
+	for range 4 {
+		var sampledDownstream bool
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			sampledDownstream = Sampled(r)
+			w.WriteHeader(http.StatusOK)
+			return nil
+		})
+
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+		w := httptest.NewRecorder()
+		if err := uc.ServeHTTP(w, req, next); err != nil {
+			t.Fatalf("ServeHTTP failed: %v", err)
+		}
+
+		header := w.Header().Get(defaultSampledHeader) == "1"
+		if header != sampledDownstream {
+			t.Errorf("Expected the header and variable to agree, got %v and %v", header, sampledDownstream)
+		}
+		if header {
+			flagged++
+		}
+	}
+
+	if flagged != 2 {
+		t.Errorf("Expected 2 of 4 requests to be flagged, got %d", flagged)
+	}
+	usagetest.AssertCount(t, registry, "requests_by_ip_total", nil, 1)
+	usagetest.AssertValue(t, registry, "requests_by_ip_total", nil, 4)
+}
+
+// TestUnmarshalSampledHeader tests parsing of the sampled_header option
+func TestUnmarshalSampledHeader(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  string
+		expectErr bool
+	}{
+		{"usage {\n sampled_header\n}", defaultSampledHeader, false},
+		{"usage {\n sampled_header X-Sampled\n}", "X-Sampled", false},
+		{"usage {\n sampled_header X-A X-B\n}", "", true},
+	}
+
+	for _, tt := range tests {
+		var uc UsageCollector
+		err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+		if (err != nil) != tt.expectErr {
+			t.Errorf("%q: expected error %v, got %v", tt.input, tt.expectErr, err)
+		}
+		if err == nil && uc.SampledHeader != tt.expected {
+			t.Errorf("%q: expected header %q, got %q", tt.input, tt.expected, uc.SampledHeader)
+		}
+	}
+}
+
+// TestUnmarshalSnippet tests that a usage block imported from a snippet
+// takes its route name and sample rate from the snippet's arguments, which
+// may be omitted
+func TestUnmarshalSnippet(t *testing.T) {
+	input := `(usage_block) {
+		usage {
+			route_name {args[0]}
+			sample_rate {args[1]}
+		}
+	}
+	api.example.com {
+		import usage_block api 0.1
+	}
+	static.example.com {
+		import usage_block static
+	}
+	example.com {
+		import usage_block
+	}`
+	blocks, err := caddyfile.Parse("Caddyfile", []byte(input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []UsageCollector{
+		{RouteName: "api", SampleRate: 0.1},
+		{RouteName: "static"},
+		{},
+	}
+	if len(blocks) != len(expected) {
+		t.Fatalf("Expected %d site blocks, got %d", len(expected), len(blocks))
+	}
+	for i, block := range blocks {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewDispenser(block.Segments[0])); err != nil {
+			t.Fatalf("%s: unexpected error: %v", block.Keys[0].Text, err)
+		}
+		if uc.RouteName != expected[i].RouteName || uc.SampleRate != expected[i].SampleRate {
+			t.Errorf("%s: expected route %q at rate %v, got %q at %v", block.Keys[0].Text,
+				expected[i].RouteName, expected[i].SampleRate, uc.RouteName, uc.SampleRate)
+		}
+	}
+
+	// Placeholders of omitted arguments are left unset
+	var omitted UsageCollector
+	if err := omitted.UnmarshalCaddyfile(caddyfile.NewTestDispenser("usage {\n route_name {args[0]}\n sample_rate {args[1]}\n}")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if omitted.RouteName != "" || omitted.SampleRate != 0 {
+		t.Errorf("Expected omitted arguments to be unset, got %q at %v", omitted.RouteName, omitted.SampleRate)
+	}
+
+	for _, invalid := range []string{
+		"usage {\n sample_rate 0\n}",
+		"usage {\n sample_rate 2\n}",
+		"usage {\n sample_rate half\n}",
+		"usage {\n sample_rate\n}",
+		"usage {\n route_name\n}",
+		"usage {\n route_name api static\n}",
+	} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package caddyusage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTrackedScrapers bounds the distinct scrapers recorded, so that a
+// misbehaving or hostile consumer can't blow up cardinality; further
+// scrapers are recorded as "other"
+const maxTrackedScrapers = 100
+
+// scraperLabels are the labels identifying who collects the usage metrics
+var scraperLabels = []string{"scraper_ip", "user_agent", "credential"}
+
+// scraperIdentity identifies a consumer of the usage metrics endpoint
+type scraperIdentity struct {
+	ip         string
+	userAgent  string
+	credential string
+}
+
+// otherScraper is recorded for scrapers beyond maxTrackedScrapers
+var otherScraper = scraperIdentity{ip: "other", userAgent: "other", credential: "other"}
+
+// scraperSet is the bounded set of scrapers seen so far
+type scraperSet struct {
+	mu   sync.Mutex
+	seen map[scraperIdentity]struct{}
+}
+
+// scrapers tracks every scraper of the usage metrics endpoint
+var scrapers = &scraperSet{seen: make(map[scraperIdentity]struct{})}
+
+// admit returns id if it is tracked or there is room to track it, or
+// otherScraper otherwise
+func (s *scraperSet) admit(id scraperIdentity) scraperIdentity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.seen[id]; ok {
+		return id
+	}
+	if len(s.seen) >= maxTrackedScrapers {
+		return otherScraper
+	}
+	s.seen[id] = struct{}{}
+	return id
+}
+
+// identifyScraper returns the identity of the client of a metrics request.
+// The credential is the common name of a client certificate, or a short
+// fingerprint of the Authorization header, so that secrets never end up in
+// labels.
+func identifyScraper(r *http.Request) scraperIdentity {
+	id := scraperIdentity{
+		ip:         normalizeIP(r.RemoteAddr),
+		userAgent:  scraperUserAgent(r.UserAgent()),
+		credential: "none",
+	}
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		id.credential = "cert:" + r.TLS.PeerCertificates[0].Subject.CommonName
+	} else if auth := r.Header.Get("Authorization"); auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		id.credential = "token:" + hex.EncodeToString(sum[:4])
+	}
+
+	return id
+}
+
+// scraperUserAgent returns the leading product of a User-Agent, like
+// Prometheus/2.53.0, which identifies scrapers without the platform
+// details that would split them into several series
+func scraperUserAgent(ua string) string {
+	product, _, _ := strings.Cut(strings.TrimSpace(ua), " ")
+	if product == "" {
+		return "none"
+	}
+	if len(product) > 64 {
+		product = product[:64]
+	}
+	return product
+}
+
+// recordScrape counts a collection of the usage metrics endpoint and
+// stamps its scraper's last scrape time
+func (um *usageMetrics) recordScrape(r *http.Request, now time.Time) {
+	id := scrapers.admit(identifyScraper(r))
+	um.scrapes.WithLabelValues(id.ip, id.userAgent, id.credential).Inc()
+	um.lastScrape.WithLabelValues(id.ip, id.userAgent, id.credential).Set(float64(now.UnixNano()) / 1e9)
+}
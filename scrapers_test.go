@@ -0,0 +1,103 @@
+package caddyusage
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestIdentifyScraper tests scraper identification
+func TestIdentifyScraper(t *testing.T) {
+	tokenSum := sha256.Sum256([]byte("Bearer secret"))
+
+	tests := []struct {
+		name     string
+		setup    func(r *http.Request)
+		expected scraperIdentity
+	}{
+		{
+			name: "prometheus",
+			setup: func(r *http.Request) {
+				r.RemoteAddr = "[2001:db8::5]:40000"
+				r.Header.Set("User-Agent", "Prometheus/2.53.0 (linux)")
+			},
+			expected: scraperIdentity{ip: "2001:db8::5", userAgent: "Prometheus/2.53.0", credential: "none"},
+		},
+		{
+			name: "bearer token",
+			setup: func(r *http.Request) {
+				r.RemoteAddr = "10.0.0.5:40000"
+				r.Header.Set("User-Agent", "curl/8.5.0")
+				r.Header.Set("Authorization", "Bearer secret")
+			},
+			expected: scraperIdentity{ip: "10.0.0.5", userAgent: "curl/8.5.0", credential: fmt.Sprintf("token:%x", tokenSum[:4])},
+		},
+		{
+			name: "client certificate",
+			setup: func(r *http.Request) {
+				r.RemoteAddr = "10.0.0.6:40000"
+				r.Header.Set("Authorization", "Bearer ignored")
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "vmagent"}}}}
+			},
+			expected: scraperIdentity{ip: "10.0.0.6", userAgent: "none", credential: "cert:vmagent"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/usage/metrics", nil)
+			req.Header.Del("User-Agent")
+			tt.setup(req)
+			if got := identifyScraper(req); got != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestScrapeAccounting tests that scrapes of the metrics endpoint are
+// counted and timestamped by scraper, and that scrapers are bounded
+func TestScrapeAccounting(t *testing.T) {
+	_, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	original := scrapers
+	scrapers = &scraperSet{seen: make(map[scraperIdentity]struct{})}
+	defer func() { scrapers = original }()
+
+	before := time.Now()
+	for range 2 {
+		req := httptest.NewRequest("GET", "/usage/metrics", nil)
+		req.RemoteAddr = "10.0.0.5:40000"
+		req.Header.Set("User-Agent", "Prometheus/2.53.0")
+		if _, err := serveAdmin(t, "/usage/metrics", req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	labels := []string{"10.0.0.5", "Prometheus/2.53.0", "none"}
+	if got := testutil.ToFloat64(globalUsageMetrics.scrapes.WithLabelValues(labels...)); got != 2 {
+		t.Errorf("Expected 2 scrapes, got %v", got)
+	}
+	if got := testutil.ToFloat64(globalUsageMetrics.lastScrape.WithLabelValues(labels...)); got < float64(before.Unix()) {
+		t.Errorf("Expected a last scrape timestamp after %d, got %v", before.Unix(), got)
+	}
+
+	// Scrapers beyond the limit are recorded as other
+	for i := range maxTrackedScrapers {
+		req := httptest.NewRequest("GET", "/usage/metrics", nil)
+		req.RemoteAddr = fmt.Sprintf("10.1.%d.%d:40000", i/256, i%256)
+		globalUsageMetrics.recordScrape(req, time.Now())
+	}
+	if got := testutil.ToFloat64(globalUsageMetrics.scrapes.WithLabelValues("other", "other", "other")); got != 1 {
+		t.Errorf("Expected 1 scrape recorded as other, got %v", got)
+	}
+}
@@ -0,0 +1,111 @@
+package caddyusage
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverTimingEdge names the request duration measured by Caddy in the
+// server_timing_seconds histogram, next to the timings of upstreams
+const serverTimingEdge = "edge"
+
+// ServerTimingConfig enables recording the W3C Server-Timing metrics that
+// upstream applications report in response headers or trailers, such as
+// db;dur=53, in the server_timing_seconds histogram by host and path.
+type ServerTimingConfig struct {
+	// Names lists the timing names recorded. Defaults to all of them;
+	// upstreams reporting generated names then create unbounded series.
+	Names []string `json:"names,omitempty"`
+}
+
+// serverTiming is a named duration of a Server-Timing header
+type serverTiming struct {
+	name     string
+	duration time.Duration
+}
+
+// parseServerTimings returns the timings with a duration in Server-Timing
+// header values, like `cache;desc="Cache Read";dur=23.2, db;dur=53`.
+// Durations are in milliseconds; invalid and negative ones are skipped.
+func parseServerTimings(values []string) []serverTiming {
+	var timings []serverTiming
+	for _, value := range values {
+		for _, metric := range splitServerTiming(value, ',') {
+			params := splitServerTiming(metric, ';')
+			name := strings.TrimSpace(params[0])
+			if name == "" {
+				continue
+			}
+			for _, param := range params[1:] {
+				key, raw, ok := strings.Cut(param, "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(key), "dur") {
+					continue
+				}
+				ms, err := strconv.ParseFloat(strings.Trim(strings.TrimSpace(raw), `"`), 64)
+				if err != nil || ms < 0 || math.IsInf(ms, 0) || math.IsNaN(ms) {
+					break
+				}
+				timings = append(timings, serverTiming{name: name, duration: time.Duration(ms * float64(time.Millisecond))})
+				break
+			}
+		}
+	}
+	return timings
+}
+
+// splitServerTiming splits s at each sep outside of quoted strings, such
+// as descriptions containing commas
+func splitServerTiming(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped := false, false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// collectServerTimingMetrics records the Server-Timing durations reported
+// by upstreams, along with the request duration measured by Caddy under
+// the edge name, so that breakdowns compare with the same requests' total
+func (uc *UsageCollector) collectServerTimingMetrics(um *usageMetrics, header http.Header, host, path string, elapsed time.Duration) {
+	if uc.ServerTiming == nil {
+		return
+	}
+
+	values := slices.Concat(header.Values("Server-Timing"), header.Values(http.TrailerPrefix+"Server-Timing"))
+	if len(values) == 0 {
+		return
+	}
+
+	recorded := false
+	for _, timing := range parseServerTimings(values) {
+		// Upstream timings named edge would mix with Caddy's own
+		if timing.name == serverTimingEdge {
+			continue
+		}
+		if len(uc.ServerTiming.Names) > 0 && !slices.Contains(uc.ServerTiming.Names, timing.name) {
+			continue
+		}
+		name := uc.policy.apply(um, "timing", timing.name)
+		um.serverTiming.WithLabelValues(host, path, name).Observe(timing.duration.Seconds())
+		recorded = true
+	}
+	if recorded {
+		um.serverTiming.WithLabelValues(host, path, serverTimingEdge).Observe(elapsed.Seconds())
+	}
+}
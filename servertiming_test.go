@@ -0,0 +1,90 @@
+package caddyusage
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestParseServerTimings tests parsing of Server-Timing header values
+func TestParseServerTimings(t *testing.T) {
+	tests := []struct {
+		values   []string
+		expected []serverTiming
+	}{
+		{
+			values:   []string{"db;dur=53, app;dur=47.2"},
+			expected: []serverTiming{{name: "db", duration: 53 * time.Millisecond}, {name: "app", duration: 47200 * time.Microsecond}},
+		},
+		{
+			values:   []string{`cache;desc="Cache Read, L2";dur=23`, "miss", "total;DUR=\"1.5\""},
+			expected: []serverTiming{{name: "cache", duration: 23 * time.Millisecond}, {name: "total", duration: 1500 * time.Microsecond}},
+		},
+		{
+			values: []string{"db;dur=slow", "db;dur=-1", "db;dur=NaN", ";dur=5", "cpu;desc=\"a;dur=9\""},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := parseServerTimings(tt.values); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%q: expected %+v, got %+v", tt.values, tt.expected, got)
+		}
+	}
+}
+
+// TestServerTimingMetrics tests that upstream timings are recorded next to
+// the edge duration, limited to the configured names
+func TestServerTimingMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	header := http.Header{}
+	header.Add("Server-Timing", "db;dur=50, render;dur=20")
+	header.Add("Server-Timing", "edge;dur=1")
+	header.Set(http.TrailerPrefix+"Server-Timing", "cache;dur=5")
+
+	// Disabled by default
+	uc.collectServerTimingMetrics(globalUsageMetrics, header, "example.com", "/", time.Second)
+	usagetest.AssertAbsent(t, registry, "server_timing_seconds", nil)
+
+	uc.ServerTiming = &ServerTimingConfig{}
+	uc.collectServerTimingMetrics(globalUsageMetrics, header, "example.com", "/", 100*time.Millisecond)
+	for name, count := range map[string]int{"db": 1, "render": 1, "cache": 1, "edge": 1} {
+		usagetest.AssertValue(t, registry, "server_timing_seconds", usagetest.Labels{"host": "example.com", "path": "/", "timing": name}, float64(count))
+	}
+
+	uc.ServerTiming = &ServerTimingConfig{Names: []string{"db"}}
+	uc.collectServerTimingMetrics(globalUsageMetrics, header, "example.com", "/", 100*time.Millisecond)
+	usagetest.AssertValue(t, registry, "server_timing_seconds", usagetest.Labels{"timing": "db"}, 2)
+	usagetest.AssertValue(t, registry, "server_timing_seconds", usagetest.Labels{"timing": "render"}, 1)
+	usagetest.AssertValue(t, registry, "server_timing_seconds", usagetest.Labels{"timing": "edge"}, 2)
+
+	// Responses without a recorded timing leave the edge duration alone
+	uc.collectServerTimingMetrics(globalUsageMetrics, http.Header{"Server-Timing": {"miss"}}, "example.com", "/", time.Second)
+	usagetest.AssertValue(t, registry, "server_timing_seconds", usagetest.Labels{"timing": "edge"}, 2)
+}
+
+// TestUnmarshalServerTiming tests parsing of the server_timing option
+func TestUnmarshalServerTiming(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected *ServerTimingConfig
+	}{
+		{input: "usage {\n server_timing\n}", expected: &ServerTimingConfig{}},
+		{input: "usage {\n server_timing db cache\n}", expected: &ServerTimingConfig{Names: []string{"db", "cache"}}},
+	}
+
+	for _, tt := range tests {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(uc.ServerTiming, tt.expected) {
+			t.Errorf("Expected %+v, got %+v", tt.expected, uc.ServerTiming)
+		}
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
@@ -283,7 +285,7 @@ func TestCollectMetricsWithNilGlobal(_ *testing.T) {
 	startTime := time.Now()
 
 	// This should not panic and should log an error
-	uc.collectMetrics(rec, req, startTime)
+	uc.collectMetrics(rec, req, startTime, nil)
 
 	// The function should handle nil global metrics gracefully
 	// We can't easily verify the log message without more complex setup,
@@ -323,6 +325,91 @@ func BenchmarkCollectMetrics(b *testing.B) {
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		uc.collectMetrics(rec, req, startTime)
+		uc.collectMetrics(rec, req, startTime, nil)
+	}
+}
+
+// TestUnmarshalCaddyfile tests parsing of the usage directive
+func TestUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expectErr bool
+		expected  UsageCollector
+	}{
+		{
+			name:     "bare directive",
+			input:    `usage`,
+			expected: UsageCollector{},
+		},
+		{
+			name: "active window",
+			input: `usage {
+				active_window 15m
+			}`,
+			expected: UsageCollector{ActiveWindow: caddy.Duration(15 * time.Minute)},
+		},
+		{
+			name: "tracked headers",
+			input: `usage {
+				headers User-Agent X-Api-Version
+			}`,
+			expected: UsageCollector{TrackedHeaders: []string{"User-Agent", "X-Api-Version"}},
+		},
+		{
+			name: "headers without names",
+			input: `usage {
+				headers
+			}`,
+			expectErr: true,
+		},
+		{
+			name:      "unexpected argument",
+			input:     `usage extra`,
+			expectErr: true,
+		},
+		{
+			name: "invalid duration",
+			input: `usage {
+				active_window soon
+			}`,
+			expectErr: true,
+		},
+		{
+			name: "extra active window argument",
+			input: `usage {
+				active_window 15m 1h
+			}`,
+			expectErr: true,
+		},
+		{
+			name: "unknown option",
+			input: `usage {
+				bogus
+			}`,
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if uc.ActiveWindow != tt.expected.ActiveWindow {
+				t.Errorf("Expected active_window %v, got %v", tt.expected.ActiveWindow, uc.ActiveWindow)
+			}
+			if !slices.Equal(uc.TrackedHeaders, tt.expected.TrackedHeaders) {
+				t.Errorf("Expected headers %v, got %v", tt.expected.TrackedHeaders, uc.TrackedHeaders)
+			}
+		})
 	}
 }
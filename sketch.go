@@ -0,0 +1,163 @@
+package caddyusage
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// hllPrecision is the number of index bits used by the HyperLogLog sketches.
+// 2^12 registers gives a standard error of roughly 1.6% in 4KiB of memory.
+const hllPrecision = 12
+
+const hllRegisters = 1 << hllPrecision
+
+// hyperLogLog is a fixed-size cardinality sketch. It is not safe for
+// concurrent use; callers are expected to provide their own locking.
+type hyperLogLog struct {
+	registers [hllRegisters]uint8
+}
+
+// addHash records a pre-hashed value in the sketch
+func (h *hyperLogLog) addHash(x uint64) {
+	idx := x >> (64 - hllPrecision)
+	w := x<<hllPrecision | 1<<(hllPrecision-1)
+	rho := uint8(bits.LeadingZeros64(w) + 1)
+	if rho > h.registers[idx] {
+		h.registers[idx] = rho
+	}
+}
+
+// merge folds the registers of other into h
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// reset clears all registers
+func (h *hyperLogLog) reset() {
+	h.registers = [hllRegisters]uint8{}
+}
+
+// estimate returns the approximate number of distinct values added
+func (h *hyperLogLog) estimate() float64 {
+	const m = float64(hllRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	var sum float64
+	zeros := 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	e := alpha * m * m / sum
+
+	// Small-range correction using linear counting
+	if e <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+
+	return e
+}
+
+// windowSlots is the number of time slices a windowedSketch is divided into.
+// The window advances one slice at a time, so the effective window length
+// varies between (windowSlots-1)/windowSlots and 1 times the configured value.
+const windowSlots = 10
+
+// sketchSlot is one time slice of a windowedSketch
+type sketchSlot struct {
+	epoch int64
+	hll   hyperLogLog
+}
+
+// windowedSketch estimates the number of distinct values seen during a sliding
+// time window by keeping one timestamped HyperLogLog per slice of the window
+// and merging the live slices on read.
+type windowedSketch struct {
+	mu        sync.Mutex
+	slotWidth time.Duration
+	slots     [windowSlots]sketchSlot
+}
+
+// newWindowedSketch creates a sketch covering the given window
+func newWindowedSketch(window time.Duration) *windowedSketch {
+	ws := &windowedSketch{}
+	ws.setWindow(window)
+	return ws
+}
+
+// setWindow changes the window length, discarding all previously seen values
+// if it differs from the current one
+func (ws *windowedSketch) setWindow(window time.Duration) {
+	slotWidth := window / windowSlots
+	if slotWidth <= 0 {
+		slotWidth = 1
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if slotWidth == ws.slotWidth {
+		return
+	}
+	ws.slotWidth = slotWidth
+	for i := range ws.slots {
+		ws.slots[i].epoch = -1
+		ws.slots[i].hll.reset()
+	}
+}
+
+// reset discards all previously seen values
+func (ws *windowedSketch) reset() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for i := range ws.slots {
+		ws.slots[i].epoch = -1
+		ws.slots[i].hll.reset()
+	}
+}
+
+// add records value as seen at the given time
+func (ws *windowedSketch) add(value string, now time.Time) {
+	x := xxhash.Sum64String(value)
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	epoch := now.UnixNano() / int64(ws.slotWidth)
+	slot := &ws.slots[epoch%windowSlots]
+	if slot.epoch != epoch {
+		slot.epoch = epoch
+		slot.hll.reset()
+	}
+	slot.hll.addHash(x)
+}
+
+// estimate returns the approximate number of distinct values seen within the
+// window ending at now
+func (ws *windowedSketch) estimate(now time.Time) float64 {
+	var merged hyperLogLog
+
+	ws.mu.Lock()
+	current := now.UnixNano() / int64(ws.slotWidth)
+	for i := range ws.slots {
+		slot := &ws.slots[i]
+		if slot.epoch > current-windowSlots && slot.epoch <= current {
+			merged.merge(&slot.hll)
+		}
+	}
+	ws.mu.Unlock()
+
+	return math.Round(merged.estimate())
+}
@@ -0,0 +1,155 @@
+package caddyusage
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestHyperLogLogEstimate tests that the sketch estimates cardinality within tolerance
+func TestHyperLogLogEstimate(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 1000, 50000} {
+		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
+			ws := newWindowedSketch(time.Minute)
+			now := time.Unix(1700000000, 0)
+
+			for i := 0; i < n; i++ {
+				ws.add(fmt.Sprintf("value-%d", i), now)
+				// Duplicates must not change the estimate
+				ws.add(fmt.Sprintf("value-%d", i), now)
+			}
+
+			got := ws.estimate(now)
+			if n == 0 {
+				if got != 0 {
+					t.Errorf("Expected 0 for empty sketch, got %v", got)
+				}
+				return
+			}
+
+			if relErr := math.Abs(got-float64(n)) / float64(n); relErr > 0.05 {
+				t.Errorf("Estimate %v too far from %d (relative error %.3f)", got, n, relErr)
+			}
+		})
+	}
+}
+
+// TestWindowedSketchExpiry tests that values fall out of the window as time advances
+func TestWindowedSketchExpiry(t *testing.T) {
+	window := 10 * time.Minute
+	ws := newWindowedSketch(window)
+	start := time.Unix(1700000000, 0)
+
+	for i := 0; i < 10; i++ {
+		ws.add(fmt.Sprintf("old-%d", i), start)
+	}
+	for i := 0; i < 5; i++ {
+		ws.add(fmt.Sprintf("new-%d", i), start.Add(window/2))
+	}
+
+	if got := ws.estimate(start.Add(window / 2)); got != 15 {
+		t.Errorf("Expected 15 distinct values within the window, got %v", got)
+	}
+
+	// Once the first slice has left the window only the newer values remain
+	if got := ws.estimate(start.Add(window + time.Minute)); got != 5 {
+		t.Errorf("Expected 5 distinct values after expiry, got %v", got)
+	}
+
+	if got := ws.estimate(start.Add(3 * window)); got != 0 {
+		t.Errorf("Expected 0 distinct values long after the window, got %v", got)
+	}
+}
+
+// TestWindowedSketchSetWindow tests that resizing the window resets the sketch
+func TestWindowedSketchSetWindow(t *testing.T) {
+	ws := newWindowedSketch(time.Minute)
+	now := time.Unix(1700000000, 0)
+	ws.add("a", now)
+
+	ws.setWindow(time.Hour)
+	if got := ws.estimate(now); got != 0 {
+		t.Errorf("Expected sketch to be empty after resize, got %v", got)
+	}
+
+	ws.add("b", now)
+	if got := ws.estimate(now.Add(50 * time.Minute)); got != 1 {
+		t.Errorf("Expected value to remain within the hour window, got %v", got)
+	}
+}
+
+// TestActiveWindowReload tests that reprovisioning handlers with the same
+// active window, as a config reload does, keeps the active_* values, while
+// a different window starts them over
+func TestActiveWindowReload(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.ActiveWindow = caddy.Duration(10 * time.Minute)
+	if err := uc.Provision(uc.ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	collectTestRequests(t, uc)
+	globalUsageMetrics.apdex.add("api", apdexSatisfied, now())
+
+	reload := func(window time.Duration) {
+		reloaded := &UsageCollector{ActiveWindow: caddy.Duration(window)}
+		if err := reloaded.Provision(uc.ctx); err != nil {
+			t.Fatalf("Provision failed: %v", err)
+		}
+		if err := reloaded.Cleanup(); err != nil {
+			t.Fatalf("Cleanup failed: %v", err)
+		}
+	}
+
+	reload(10 * time.Minute)
+	usagetest.AssertValue(t, registry, "active_paths", nil, 2)
+	usagetest.AssertValue(t, registry, "active_clients", nil, 3)
+	if _, ok := globalUsageMetrics.apdex.scores(now())["api"]; !ok {
+		t.Error("Expected the Apdex window to keep its requests over a reload")
+	}
+
+	reload(time.Hour)
+	usagetest.AssertValue(t, registry, "active_paths", nil, 0)
+	if _, ok := globalUsageMetrics.apdex.scores(now())["api"]; ok {
+		t.Error("Expected a new window to discard counted requests")
+	}
+}
+
+// TestActiveGauges tests that collected requests are reflected in the active gauges
+func TestActiveGauges(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	collectTestRequests(t, uc)
+
+	metricFamilies, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+
+	expected := map[string]float64{
+		"caddy_usage_active_paths":   2,
+		"caddy_usage_active_hosts":   1,
+		"caddy_usage_active_clients": 3,
+	}
+
+	for _, mf := range metricFamilies {
+		want, ok := expected[mf.GetName()]
+		if !ok {
+			continue
+		}
+		if got := mf.GetMetric()[0].GetGauge().GetValue(); got != want {
+			t.Errorf("Expected %s to be %v, got %v", mf.GetName(), want, got)
+		}
+		delete(expected, mf.GetName())
+	}
+
+	for name := range expected {
+		t.Errorf("%s metric not found", name)
+	}
+}
@@ -0,0 +1,441 @@
+package caddyusage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Clock check defaults
+const (
+	defaultClockCheckInterval = time.Minute
+	defaultClockMaxSkew       = time.Second
+	defaultNTPPort            = "123"
+
+	// ntpTimeout bounds an NTP query, so that stopping the monitor never
+	// waits long on an unresponsive server
+	ntpTimeout = 5 * time.Second
+)
+
+// NTP packets and timestamps
+const (
+	ntpPacketSize = 48
+
+	// ntpClientRequest is the first byte of a request: no leap warning,
+	// version 4, client mode
+	ntpClientRequest = 0x23
+
+	// ntpServerMode is the mode of a server's response
+	ntpServerMode = 4
+
+	// ntpUnsynchronized is the leap indicator of a server whose clock is
+	// not synchronized
+	ntpUnsynchronized = 3
+
+	// ntpEpochOffset is the number of seconds from the NTP epoch, 1900, to
+	// the Unix epoch
+	ntpEpochOffset = 2208988800
+)
+
+// ClockCheckConfig configures monitoring of the wall clock, whose
+// adjustments shift the timestamps of recorded usage. Durations are
+// measured on the monotonic clock, and are not affected.
+type ClockCheckConfig struct {
+	// NTPServer is an NTP server, as host[:port], the wall clock is
+	// compared with. Without it, only adjustments of the wall clock
+	// relative to the monotonic clock are detected.
+	NTPServer string `json:"ntp_server,omitempty"`
+
+	// Interval is the time between checks. Defaults to 1m.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// MaxSkew is the skew past which the clock is considered unreliable.
+	// Defaults to 1s.
+	MaxSkew caddy.Duration `json:"max_skew,omitempty"`
+}
+
+// validate checks the server address and durations
+func (cc *ClockCheckConfig) validate() error {
+	if cc.NTPServer != "" {
+		if _, err := ntpAddress(cc.NTPServer); err != nil {
+			return fmt.Errorf("invalid clock_check ntp_server '%s': %v", cc.NTPServer, err)
+		}
+	}
+	if cc.Interval < 0 {
+		return fmt.Errorf("clock_check interval must not be negative, got %s", time.Duration(cc.Interval))
+	}
+	if cc.MaxSkew < 0 {
+		return fmt.Errorf("clock_check max_skew must not be negative, got %s", time.Duration(cc.MaxSkew))
+	}
+	return nil
+}
+
+// ntpAddress returns the address of an NTP server, with the default port
+// unless one is given
+func ntpAddress(server string) (string, error) {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server, nil
+	}
+	address := net.JoinHostPort(server, defaultNTPPort)
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", err
+	}
+	return address, nil
+}
+
+// clockSkew is the result of a clock check
+type clockSkew struct {
+	// step is how far the wall clock was moved relative to the monotonic
+	// clock since monitoring started, positive when moved forward
+	step time.Duration
+
+	// offset is how far the wall clock is ahead of the NTP server's, or
+	// nil without a server or when the last query failed
+	offset *time.Duration
+
+	// skewed reports whether the step or offset exceeds the maximum skew
+	skewed bool
+}
+
+// currentClockSkew is the result of the latest check, or nil while no
+// handler monitors the clock
+var currentClockSkew atomic.Pointer[clockSkew]
+
+// clockSkewed reports whether the latest clock check found the wall clock
+// unreliable
+func clockSkewed() bool {
+	skew := currentClockSkew.Load()
+	return skew != nil && skew.skewed
+}
+
+// monotonicBase anchors the monotonic readings of clockReadings
+var monotonicBase = time.Now()
+
+// clockReadings returns the wall clock time and a monotonic clock reading.
+// It is a variable so that tests can move the clocks apart.
+var clockReadings = func() (time.Time, time.Duration) {
+	t := now()
+	return t.Round(0), t.Sub(monotonicBase)
+}
+
+// clockMonitor periodically checks the wall clock. A single monitor runs
+// for all handlers, and like other shared settings, the most recently
+// provisioned handler's configuration applies.
+type clockMonitor struct {
+	key      string
+	server   string
+	interval time.Duration
+	maxSkew  time.Duration
+	logger   *zap.Logger
+
+	wallBase time.Time
+	monoBase time.Duration
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+var (
+	// The running monitor and the number of handlers using it
+	runningClockMonitor *clockMonitor
+	clockMonitorRefs    int
+	clockMonitorMu      sync.Mutex
+)
+
+// acquireClockMonitor starts monitoring the clock with the configuration,
+// replacing a monitor running with another one. Each successful call must
+// be balanced by a call to releaseClockMonitor.
+func acquireClockMonitor(cc *ClockCheckConfig, logger *zap.Logger) error {
+	clockMonitorMu.Lock()
+	defer clockMonitorMu.Unlock()
+
+	key, err := json.Marshal(cc)
+	if err != nil {
+		return err
+	}
+	clockMonitorRefs++
+	if m := runningClockMonitor; m != nil {
+		if m.key == string(key) {
+			return nil
+		}
+		m.stop()
+	}
+
+	m, err := newClockMonitor(cc, logger)
+	if err != nil {
+		clockMonitorRefs--
+		runningClockMonitor = nil
+		return err
+	}
+	m.key = string(key)
+	m.run()
+	runningClockMonitor = m
+	return nil
+}
+
+// releaseClockMonitor releases a handler's use of the monitor, stopping it
+// once no handler uses it anymore
+func releaseClockMonitor() {
+	clockMonitorMu.Lock()
+	defer clockMonitorMu.Unlock()
+
+	if clockMonitorRefs--; clockMonitorRefs > 0 {
+		return
+	}
+	clockMonitorRefs = 0
+	if runningClockMonitor != nil {
+		runningClockMonitor.stop()
+		runningClockMonitor = nil
+	}
+	currentClockSkew.Store(nil)
+}
+
+// newClockMonitor returns a monitor of the configuration, taking the
+// current clock readings as reference
+func newClockMonitor(cc *ClockCheckConfig, logger *zap.Logger) (*clockMonitor, error) {
+	m := &clockMonitor{
+		interval: defaultClockCheckInterval,
+		maxSkew:  defaultClockMaxSkew,
+		logger:   logger,
+		done:     make(chan struct{}),
+	}
+	if cc.NTPServer != "" {
+		address, err := ntpAddress(cc.NTPServer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clock_check ntp_server '%s': %v", cc.NTPServer, err)
+		}
+		m.server = address
+	}
+	if cc.Interval > 0 {
+		m.interval = time.Duration(cc.Interval)
+	}
+	if cc.MaxSkew > 0 {
+		m.maxSkew = time.Duration(cc.MaxSkew)
+	}
+	m.wallBase, m.monoBase = clockReadings()
+	return m, nil
+}
+
+// run checks the clock right away, then every interval until stopped
+func (m *clockMonitor) run() {
+	ticker := newTicker(m.interval)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer ticker.Stop()
+
+		m.check()
+		for {
+			select {
+			case <-ticker.C():
+				m.check()
+			case <-m.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the checks
+func (m *clockMonitor) stop() {
+	close(m.done)
+	m.wg.Wait()
+}
+
+// check measures the skew of the wall clock, logging when it starts or
+// stops exceeding the maximum
+func (m *clockMonitor) check() {
+	wall, mono := clockReadings()
+	skew := &clockSkew{step: wall.Sub(m.wallBase) - (mono - m.monoBase)}
+	skew.skewed = skew.step.Abs() > m.maxSkew
+
+	if m.server != "" {
+		offset, err := queryNTPOffset(m.server)
+		if err != nil {
+			m.logger.Warn("clock check failed", zap.String("ntp_server", m.server), zap.Error(err))
+		} else {
+			skew.offset = &offset
+			skew.skewed = skew.skewed || offset.Abs() > m.maxSkew
+		}
+	}
+
+	previous := currentClockSkew.Swap(skew)
+	switch wasSkewed := previous != nil && previous.skewed; {
+	case skew.skewed && !wasSkewed:
+		fields := []zap.Field{zap.Duration("step", skew.step), zap.Duration("max_skew", m.maxSkew)}
+		if skew.offset != nil {
+			fields = append(fields, zap.Duration("ntp_offset", *skew.offset))
+		}
+		m.logger.Warn("wall clock skew detected, usage timestamps may be unreliable", fields...)
+	case !skew.skewed && wasSkewed:
+		m.logger.Info("wall clock skew back within bounds")
+	}
+}
+
+// queryNTPOffset returns how far the wall clock is ahead of an NTP
+// server's, using the server's receive and transmit times and the round
+// trip measured on the monotonic clock
+func queryNTPOffset(address string) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", address, ntpTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = conn.Close() }()
+	if err := conn.SetDeadline(time.Now().Add(ntpTimeout)); err != nil {
+		return 0, err
+	}
+
+	request := make([]byte, ntpPacketSize)
+	request[0] = ntpClientRequest
+	sent := now()
+	origin := toNTPTime(sent)
+	binary.BigEndian.PutUint64(request[40:], origin)
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+
+	response := make([]byte, ntpPacketSize)
+	n, err := conn.Read(response)
+	if err != nil {
+		return 0, err
+	}
+	received := sent.Add(since(sent))
+
+	switch {
+	case n < ntpPacketSize:
+		return 0, fmt.Errorf("short NTP response of %d bytes", n)
+	case response[0]&0x7 != ntpServerMode:
+		return 0, errors.New("NTP response is not from a server")
+	case response[0]>>6 == ntpUnsynchronized:
+		return 0, errors.New("NTP server is not synchronized")
+	case response[1] == 0:
+		return 0, errors.New("NTP server refused the query")
+	case binary.BigEndian.Uint64(response[24:]) != origin:
+		return 0, errors.New("NTP response does not match the query")
+	}
+
+	serverReceived := fromNTPTime(binary.BigEndian.Uint64(response[32:]))
+	serverSent := fromNTPTime(binary.BigEndian.Uint64(response[40:]))
+	return (sent.Sub(serverReceived) + received.Sub(serverSent)) / 2, nil
+}
+
+// toNTPTime returns the NTP timestamp of t: seconds since 1900 in the
+// upper 32 bits, and the fraction of a second in the lower ones
+func toNTPTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / 1e9
+	return seconds<<32 | fraction
+}
+
+// fromNTPTime returns the time of an NTP timestamp
+func fromNTPTime(timestamp uint64) time.Time {
+	seconds := int64(timestamp>>32) - ntpEpochOffset
+	nanos := int64((timestamp & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(seconds, nanos)
+}
+
+// clockSkewCollector exports the results of clock checks
+type clockSkewCollector struct {
+	skewSeconds *prometheus.Desc
+	skewed      *prometheus.Desc
+}
+
+// newClockSkewCollector returns a collector of the clock check gauges of
+// the metrics named <ns>_usage_*
+func newClockSkewCollector(ns string) clockSkewCollector {
+	return clockSkewCollector{
+		skewSeconds: prometheus.NewDesc(
+			prometheus.BuildFQName(ns, "usage", "clock_skew_seconds"),
+			"Skew of the wall clock in seconds, positive when ahead, relative to the monotonic clock or an NTP server",
+			[]string{"reference"}, nil,
+		),
+		skewed: prometheus.NewDesc(
+			prometheus.BuildFQName(ns, "usage", "clock_skewed"),
+			"Whether the wall clock skew exceeds the configured maximum (1) or not (0)",
+			nil, nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c clockSkewCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.skewSeconds
+	ch <- c.skewed
+}
+
+// Collect implements prometheus.Collector
+func (c clockSkewCollector) Collect(ch chan<- prometheus.Metric) {
+	skew := currentClockSkew.Load()
+	if skew == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.skewSeconds, prometheus.GaugeValue, skew.step.Seconds(), "monotonic")
+	if skew.offset != nil {
+		ch <- prometheus.MustNewConstMetric(c.skewSeconds, prometheus.GaugeValue, skew.offset.Seconds(), "ntp")
+	}
+	skewed := 0.0
+	if skew.skewed {
+		skewed = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.skewed, prometheus.GaugeValue, skewed)
+}
+
+// unmarshalClockCheckConfig parses a clock_check block:
+//
+//	clock_check [{
+//	    ntp_server <host[:port]>
+//	    interval <duration>
+//	    max_skew <duration>
+//	}]
+func unmarshalClockCheckConfig(d *caddyfile.Dispenser) (*ClockCheckConfig, error) {
+	cc := new(ClockCheckConfig)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch option := d.Val(); option {
+		case "ntp_server":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			cc.NTPServer = d.Val()
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+
+		case "interval", "max_skew":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid clock_check %s '%s': %v", option, d.Val(), err)
+			}
+			if option == "interval" {
+				cc.Interval = caddy.Duration(dur)
+			} else {
+				cc.MaxSkew = caddy.Duration(dur)
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+
+		default:
+			return nil, d.Errf("unrecognized clock_check option '%s'", option)
+		}
+	}
+	return cc, nil
+}
+
+// Interface guards
+var (
+	_ prometheus.Collector = clockSkewCollector{}
+)
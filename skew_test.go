@@ -0,0 +1,227 @@
+package caddyusage
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/chalabi2/caddy-usage/usagetest"
+	"go.uber.org/zap"
+)
+
+// serveNTP answers NTP queries on a local socket with a clock ahead of
+// the local one by offset, letting respond alter each response
+func serveNTP(t *testing.T, offset time.Duration, respond func(response []byte)) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, ntpPacketSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < ntpPacketSize {
+				continue
+			}
+			server := toNTPTime(now().Add(offset))
+			response := make([]byte, ntpPacketSize)
+			response[0] = 0x24 // version 4, server mode
+			response[1] = 2
+			copy(response[24:], buf[40:48])
+			binary.BigEndian.PutUint64(response[32:], server)
+			binary.BigEndian.PutUint64(response[40:], server)
+			if respond != nil {
+				respond(response)
+			}
+			_, _ = conn.WriteTo(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// TestQueryNTPOffset tests the offset computed from a server's response,
+// and that invalid responses are rejected
+func TestQueryNTPOffset(t *testing.T) {
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	offset, err := queryNTPOffset(serveNTP(t, 3*time.Second, nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if diff := offset + 3*time.Second; diff.Abs() > time.Millisecond {
+		t.Errorf("Expected an offset of -3s, got %s", offset)
+	}
+
+	tests := []struct {
+		name    string
+		respond func(response []byte)
+	}{
+		{name: "client mode", respond: func(r []byte) { r[0] = 0x23 }},
+		{name: "unsynchronized", respond: func(r []byte) { r[0] = 0xe4 }},
+		{name: "kiss of death", respond: func(r []byte) { r[1] = 0 }},
+		{name: "wrong origin", respond: func(r []byte) { r[31]++ }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := queryNTPOffset(serveNTP(t, 0, tt.respond)); err == nil {
+				t.Error("Expected an error but got none")
+			}
+		})
+	}
+}
+
+// TestNTPTime tests the conversion of times to NTP timestamps and back
+func TestNTPTime(t *testing.T) {
+	at := time.Date(2026, 10, 16, 12, 30, 0, 250_000_000, time.UTC)
+	timestamp := toNTPTime(at)
+	if seconds := timestamp >> 32; seconds != uint64(at.Unix())+ntpEpochOffset {
+		t.Errorf("Expected seconds since 1900, got %d", seconds)
+	}
+	if back := fromNTPTime(timestamp); back.Sub(at).Abs() > time.Microsecond {
+		t.Errorf("Expected %s, got %s", at, back)
+	}
+}
+
+// TestClockMonitor tests that adjustments of the wall clock and NTP
+// offsets are reported, and cleared once monitoring stops
+func TestClockMonitor(t *testing.T) {
+	_, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	// The wall clock is stepped independently of the monotonic clock
+	var step time.Duration
+	start := now()
+	originalReadings := clockReadings
+	clockReadings = func() (time.Time, time.Duration) {
+		return now().Add(step), since(start)
+	}
+	defer func() { clockReadings = originalReadings }()
+
+	monitor, err := newClockMonitor(&ClockCheckConfig{NTPServer: serveNTP(t, -500*time.Millisecond, nil)}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer currentClockSkew.Store(nil)
+
+	monitor.check()
+	usagetest.AssertValue(t, registry, "clock_skew_seconds", usagetest.Labels{"reference": "monotonic"}, 0)
+	if got := usagetest.Value(t, registry, "clock_skew_seconds", usagetest.Labels{"reference": "ntp"}); got < 0.499 || got > 0.501 {
+		t.Errorf("Expected an NTP skew of 0.5s, got %v", got)
+	}
+	usagetest.AssertValue(t, registry, "clock_skewed", nil, 0)
+
+	clock.Advance(time.Minute)
+	step = -2 * time.Second
+	monitor.check()
+	usagetest.AssertValue(t, registry, "clock_skew_seconds", usagetest.Labels{"reference": "monotonic"}, -2)
+	usagetest.AssertValue(t, registry, "clock_skewed", nil, 1)
+
+	// Without monitoring, nothing is reported
+	currentClockSkew.Store(nil)
+	usagetest.AssertAbsent(t, registry, "clock_skewed", nil)
+}
+
+// TestAcquireClockMonitor tests that handlers share the monitor, and that
+// a new configuration replaces it
+func TestAcquireClockMonitor(t *testing.T) {
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	if err := acquireClockMonitor(&ClockCheckConfig{}, zap.NewNop()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	first := runningClockMonitor
+	if err := acquireClockMonitor(&ClockCheckConfig{}, zap.NewNop()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if runningClockMonitor != first {
+		t.Error("Expected handlers with the same configuration to share the monitor")
+	}
+	if err := acquireClockMonitor(&ClockCheckConfig{MaxSkew: caddy.Duration(time.Minute)}, zap.NewNop()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if runningClockMonitor == first || runningClockMonitor.maxSkew != time.Minute {
+		t.Error("Expected the most recent configuration to replace the monitor")
+	}
+
+	for range 3 {
+		releaseClockMonitor()
+	}
+	if runningClockMonitor != nil || clockMonitorRefs != 0 || currentClockSkew.Load() != nil {
+		t.Error("Expected the monitor to stop once released by every handler")
+	}
+}
+
+// TestUnmarshalClockCheck tests parsing of the clock_check option
+func TestUnmarshalClockCheck(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *ClockCheckConfig
+		expectErr bool
+	}{
+		{input: "usage {\n clock_check\n}", expected: &ClockCheckConfig{}},
+		{
+			input: "usage {\n clock_check {\n ntp_server pool.ntp.org\n interval 5m\n max_skew 250ms\n }\n}",
+			expected: &ClockCheckConfig{
+				NTPServer: "pool.ntp.org",
+				Interval:  caddy.Duration(5 * time.Minute),
+				MaxSkew:   caddy.Duration(250 * time.Millisecond),
+			},
+		},
+		{input: "usage {\n clock_check pool.ntp.org\n}", expectErr: true},
+		{input: "usage {\n clock_check {\n ntp_server\n }\n}", expectErr: true},
+		{input: "usage {\n clock_check {\n max_skew lots\n }\n}", expectErr: true},
+		{input: "usage {\n clock_check {\n drift 1s\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.ClockCheck, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.ClockCheck)
+			}
+		})
+	}
+}
+
+// TestClockCheckValidate tests validation of clock_check options
+func TestClockCheckValidate(t *testing.T) {
+	valid := []ClockCheckConfig{{}, {NTPServer: "pool.ntp.org"}, {NTPServer: "10.0.0.1:1123"}, {NTPServer: "::1"}}
+	for _, cc := range valid {
+		if err := cc.validate(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", cc, err)
+		}
+	}
+
+	invalid := []ClockCheckConfig{{Interval: -1}, {MaxSkew: -1}, {NTPServer: "[::1"}}
+	for _, cc := range invalid {
+		if err := cc.validate(); err == nil {
+			t.Errorf("%+v: expected an error but got none", cc)
+		}
+	}
+}
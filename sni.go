@@ -0,0 +1,55 @@
+package caddyusage
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipDomain buckets IP address hosts in the SNI mismatch counter, and in the
+// host label when collapse_hosts is enabled
+const ipDomain = "ip"
+
+// collectSNIMetrics records TLS requests whose SNI names a different host
+// than the Host header, as seen with domain fronting or misconfigured
+// clients. Both names are bucketed to their registrable domain (eTLD+1) to
+// keep cardinality in check, so a mismatch between subdomains of the same
+// site is still counted but recorded under the same domain twice.
+func (uc *UsageCollector) collectSNIMetrics(um *usageMetrics, r *http.Request) {
+	if r.TLS == nil || r.TLS.ServerName == "" {
+		return
+	}
+
+	sni := normalizeHostname(r.TLS.ServerName)
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normalizeHostname(host)
+
+	if sni == host {
+		return
+	}
+
+	sniDomain := uc.policy.apply(um, "sni_domain", registrableDomain(sni))
+	hostDomain := uc.policy.apply(um, "host_domain", registrableDomain(host))
+	um.sniMismatches.WithLabelValues(sniDomain, hostDomain).Inc()
+}
+
+// normalizeHostname lowercases a hostname and strips a trailing dot
+func normalizeHostname(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// registrableDomain returns the eTLD+1 of a hostname, such as example.co.uk
+// for api.example.co.uk. IP addresses are bucketed together, and names that
+// have no registrable domain, like localhost, are returned as-is.
+func registrableDomain(name string) string {
+	if net.ParseIP(strings.Trim(name, "[]")) != nil {
+		return ipDomain
+	}
+	if domain, err := effectiveTLDPlusOne(loadedData().suffixes, name); err == nil {
+		return domain
+	}
+	return name
+}
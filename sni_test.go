@@ -0,0 +1,70 @@
+package caddyusage
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestRegistrableDomain tests bucketing of hostnames to registrable domains
+func TestRegistrableDomain(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"example.com", "example.com"},
+		{"api.example.com", "example.com"},
+		{"shop.example.co.uk", "example.co.uk"},
+		{"192.168.1.1", ipDomain},
+		{"[::1]", ipDomain},
+		{"localhost", "localhost"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := registrableDomain(tt.name); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestSNIMismatchMetrics tests that only differing SNI and Host pairs are counted
+func TestSNIMismatchMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	tests := []struct {
+		sni  string
+		host string
+	}{
+		{"", "example.com"},                         // no SNI
+		{"example.com", "example.com:443"},          // port is ignored
+		{"Example.com.", "example.com"},             // case and trailing dot are ignored
+		{"cdn.example.com", "internal.other.org"},   // fronting
+		{"cdn.example.com", "admin.other.org:8443"}, // fronting, same domains
+		{"www.example.com", "api.example.com"},      // same site
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "https://"+tt.host+"/", nil)
+		req.Host = tt.host
+		req.TLS = &tls.ConnectionState{ServerName: tt.sni}
+		uc.collectSNIMetrics(globalUsageMetrics, req)
+	}
+
+	// Plain HTTP requests are ignored
+	uc.collectSNIMetrics(globalUsageMetrics, httptest.NewRequest("GET", "http://other.org/", nil))
+
+	if got := testutil.ToFloat64(globalUsageMetrics.sniMismatches.WithLabelValues("example.com", "other.org")); got != 2 {
+		t.Errorf("Expected 2 fronted requests, got %v", got)
+	}
+	if got := testutil.ToFloat64(globalUsageMetrics.sniMismatches.WithLabelValues("example.com", "example.com")); got != 1 {
+		t.Errorf("Expected 1 same-site mismatch, got %v", got)
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.sniMismatches); n != 2 {
+		t.Errorf("Expected 2 mismatch series, got %d", n)
+	}
+}
@@ -0,0 +1,133 @@
+package caddyusage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
+)
+
+// defaultSOAPMaxBody caps how much of a request body is read to find the
+// SOAP operation when no SOAPAction is given
+const defaultSOAPMaxBody = 64 << 10
+
+// unknownSOAPAction labels requests whose action could not be determined
+const unknownSOAPAction = "unknown"
+
+// SOAPConfig enables per-action metrics for SOAP and other XML services.
+// The action is taken from the SOAPAction header (SOAP 1.1), the action
+// parameter of the Content-Type (SOAP 1.2), or else the name of the first
+// element inside the envelope's Body read from a size-capped prefix of the
+// request body.
+type SOAPConfig struct {
+	// MaxBody is the maximum number of request body bytes read to find
+	// the operation element. Defaults to 64KiB.
+	MaxBody int64 `json:"max_body,omitempty"`
+}
+
+// soapAction determines the SOAP action of a request
+func (uc *UsageCollector) soapAction(r *http.Request) string {
+	if r.Method != http.MethodPost {
+		return ""
+	}
+
+	if action := strings.Trim(strings.TrimSpace(r.Header.Get("SOAPAction")), `"`); action != "" {
+		return action
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if action := params["action"]; mediaType == "application/soap+xml" && action != "" {
+		return action
+	}
+
+	maxBody := uc.SOAP.MaxBody
+	if maxBody == 0 {
+		maxBody = defaultSOAPMaxBody
+	}
+
+	// A truncated body is fine here; the operation element is near the start
+	body, _, err := peekRequestBody(r, maxBody)
+	if err != nil {
+		return unknownSOAPAction
+	}
+	return xmlOperation(body)
+}
+
+// xmlOperation returns the local name of the first element inside a SOAP
+// Body, or of the root element for plain XML documents
+func xmlOperation(body []byte) string {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+
+	var (
+		root   string
+		inBody bool
+	)
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			// Reached the end of the (possibly truncated) body without
+			// finding an operation element
+			return unknownSOAPAction
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case inBody:
+			return start.Name.Local
+		case root == "":
+			root = start.Name.Local
+			if root != "Envelope" {
+				return root
+			}
+		case start.Name.Local == "Body":
+			inBody = true
+		}
+	}
+}
+
+// collectSOAPMetrics records the action of a SOAP request
+func (uc *UsageCollector) collectSOAPMetrics(um *usageMetrics, action, statusCode string, duration float64) {
+	action = uc.policy.apply(um, "soap_action", action)
+	um.soapRequests.WithLabelValues(action, statusCode).Inc()
+	um.soapDuration.WithLabelValues(action).Observe(duration)
+}
+
+// unmarshalSOAPConfig parses a soap block:
+//
+//	soap {
+//	    max_body <size>
+//	}
+func unmarshalSOAPConfig(d *caddyfile.Dispenser) (*SOAPConfig, error) {
+	cfg := new(SOAPConfig)
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "max_body":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil || size == 0 {
+				return nil, d.Errf("invalid max_body '%s'", d.Val())
+			}
+			cfg.MaxBody = int64(size)
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unrecognized soap option '%s'", d.Val())
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,120 @@
+package caddyusage
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testSOAPEnvelope = `<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+  <soap:Header><auth:Token xmlns:auth="urn:auth">abc</auth:Token></soap:Header>
+  <soap:Body>
+    <m:GetStockPrice xmlns:m="http://example.com/stock">
+      <m:StockName>ACME</m:StockName>
+    </m:GetStockPrice>
+  </soap:Body>
+</soap:Envelope>`
+
+// TestSOAPAction tests the sources a SOAP action is read from
+func TestSOAPAction(t *testing.T) {
+	uc := &UsageCollector{SOAP: &SOAPConfig{}}
+
+	tests := []struct {
+		name     string
+		method   string
+		headers  map[string]string
+		body     string
+		expected string
+	}{
+		{"SOAP 1.1 header", "POST", map[string]string{"SOAPAction": `"http://example.com/GetStockPrice"`}, testSOAPEnvelope, "http://example.com/GetStockPrice"},
+		{"SOAP 1.2 content type", "POST", map[string]string{"Content-Type": `application/soap+xml; charset=utf-8; action="urn:GetQuote"`}, testSOAPEnvelope, "urn:GetQuote"},
+		{"body operation", "POST", map[string]string{"SOAPAction": `""`}, testSOAPEnvelope, "GetStockPrice"},
+		{"plain xml root", "POST", nil, `<UpdateOrder><Id>1</Id></UpdateOrder>`, "UpdateOrder"},
+		{"not xml", "POST", nil, `{"json": true}`, unknownSOAPAction},
+		{"empty body element", "POST", nil, `<Envelope><Body></Body></Envelope>`, unknownSOAPAction},
+		{"not a POST", "GET", map[string]string{"SOAPAction": "urn:x"}, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://soap.example.com/service", strings.NewReader(tt.body))
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			if got := uc.soapAction(req); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+
+			rest, _ := io.ReadAll(req.Body)
+			if string(rest) != tt.body {
+				t.Error("Request body was not preserved")
+			}
+		})
+	}
+}
+
+// TestSOAPActionTruncatedBody tests that the operation is found within a capped prefix
+func TestSOAPActionTruncatedBody(t *testing.T) {
+	uc := &UsageCollector{SOAP: &SOAPConfig{MaxBody: 256}}
+	body := strings.Replace(testSOAPEnvelope, "ACME", strings.Repeat("A", 4096), 1)
+
+	req := httptest.NewRequest("POST", "http://soap.example.com/service", strings.NewReader(body))
+	if got := uc.soapAction(req); got != "GetStockPrice" {
+		t.Errorf("Expected GetStockPrice, got %q", got)
+	}
+}
+
+// TestSOAPMetrics tests per-action metrics through the full handler
+func TestSOAPMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	uc.SOAP = &SOAPConfig{}
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	})
+
+	req := httptest.NewRequest("POST", "http://soap.example.com/service", strings.NewReader(testSOAPEnvelope))
+	if err := uc.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	if got := testutil.ToFloat64(globalUsageMetrics.soapRequests.WithLabelValues("GetStockPrice", "500")); got != 1 {
+		t.Errorf("Expected 1 GetStockPrice request, got %v", got)
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.soapDuration); n != 1 {
+		t.Errorf("Expected 1 latency histogram, got %d", n)
+	}
+}
+
+// TestUnmarshalSOAP tests parsing of the soap block
+func TestUnmarshalSOAP(t *testing.T) {
+	var uc UsageCollector
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser("usage {\n soap {\n max_body 8KiB\n }\n}")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if uc.SOAP == nil || uc.SOAP.MaxBody != 8<<10 {
+		t.Errorf("Unexpected soap config: %+v", uc.SOAP)
+	}
+
+	for _, invalid := range []string{
+		"usage {\n soap extra\n}",
+		"usage {\n soap {\n max_body 0\n }\n}",
+		"usage {\n soap {\n actions Get\n }\n}",
+	} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// StatsD sink defaults and bounds
+const (
+	defaultStatsDAddress       = "localhost:8125"
+	defaultStatsDPrefix        = "caddy.usage"
+	defaultStatsDFlushInterval = time.Second
+
+	// statsdMaxPacket keeps packets within a typical Ethernet MTU, as
+	// larger UDP datagrams get fragmented or dropped
+	statsdMaxPacket = 1432
+)
+
+// statsdTagReplacer removes the characters that delimit DogStatsD tags
+var statsdTagReplacer = strings.NewReplacer(",", "_", "|", "_", "\n", "_", "#", "_")
+
+// StatsDConfig configures sending usage metrics to a StatsD server, or to
+// a Datadog agent with tags.
+type StatsDConfig struct {
+	// Address is the server's UDP host:port. Defaults to localhost:8125.
+	Address string `json:"address,omitempty"`
+
+	// Prefix is prepended to metric names. Defaults to caddy.usage.
+	Prefix string `json:"prefix,omitempty"`
+
+	// DogStatsD adds the method, status code and host as DogStatsD tags.
+	// Plain StatsD has no tags, so metrics are then only totals.
+	DogStatsD bool `json:"dogstatsd,omitempty"`
+
+	// Tags are added to every metric with DogStatsD, such as env:prod.
+	Tags []string `json:"tags,omitempty"`
+
+	// FlushInterval is the longest time metrics are buffered before being
+	// sent. Full packets are sent right away. Defaults to 1s.
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+
+	// Exclusive records requests to StatsD only, skipping the Prometheus
+	// metrics.
+	Exclusive bool `json:"exclusive,omitempty"`
+}
+
+// validate checks the address, flush interval and tags
+func (sc *StatsDConfig) validate() error {
+	if sc.Address != "" {
+		if _, _, err := net.SplitHostPort(sc.Address); err != nil {
+			return fmt.Errorf("invalid statsd address '%s': %v", sc.Address, err)
+		}
+	}
+	if sc.FlushInterval < 0 {
+		return fmt.Errorf("statsd flush_interval must not be negative, got %s", time.Duration(sc.FlushInterval))
+	}
+	for _, tag := range sc.Tags {
+		if strings.ContainsAny(tag, ",|#\n") {
+			return fmt.Errorf("invalid statsd tag '%s'", tag)
+		}
+	}
+	return nil
+}
+
+// statsdClient buffers metric lines into packets sent over UDP. Handlers
+// with the same configuration share a client, so config reloads keep it.
+type statsdClient struct {
+	key       string
+	prefix    string
+	dogstatsd bool
+	tags      string
+	interval  time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	buf  []byte
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// statsdClientEntry is a shared client and the number of handlers using it
+type statsdClientEntry struct {
+	client *statsdClient
+	refs   int
+}
+
+var (
+	// Running clients by configuration
+	statsdClients   = make(map[string]*statsdClientEntry)
+	statsdClientsMu sync.Mutex
+)
+
+// acquireStatsDClient returns the running client for the configuration,
+// starting one if needed. Each successful call must be balanced by a call
+// to releaseStatsDClient.
+func acquireStatsDClient(sc *StatsDConfig) (*statsdClient, error) {
+	statsdClientsMu.Lock()
+	defer statsdClientsMu.Unlock()
+
+	key, err := json.Marshal(sc)
+	if err != nil {
+		return nil, err
+	}
+	if entry, ok := statsdClients[string(key)]; ok {
+		entry.refs++
+		return entry.client, nil
+	}
+
+	address := sc.Address
+	if address == "" {
+		address = defaultStatsDAddress
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("setting up statsd: %v", err)
+	}
+
+	client := &statsdClient{
+		key:       string(key),
+		prefix:    defaultStatsDPrefix,
+		dogstatsd: sc.DogStatsD,
+		tags:      strings.Join(sc.Tags, ","),
+		interval:  defaultStatsDFlushInterval,
+		conn:      conn,
+		buf:       make([]byte, 0, statsdMaxPacket),
+		done:      make(chan struct{}),
+	}
+	if sc.Prefix != "" {
+		client.prefix = sc.Prefix
+	}
+	if sc.FlushInterval > 0 {
+		client.interval = time.Duration(sc.FlushInterval)
+	}
+	client.run()
+	statsdClients[client.key] = &statsdClientEntry{client: client, refs: 1}
+	return client, nil
+}
+
+// releaseStatsDClient releases a handler's use of a client, flushing and
+// closing it once no handler uses it anymore
+func releaseStatsDClient(client *statsdClient) error {
+	statsdClientsMu.Lock()
+	defer statsdClientsMu.Unlock()
+
+	entry, ok := statsdClients[client.key]
+	if !ok || entry.client != client {
+		return nil
+	}
+	if entry.refs--; entry.refs > 0 {
+		return nil
+	}
+	delete(statsdClients, client.key)
+	return client.stop()
+}
+
+// run flushes buffered metrics every interval until stopped
+func (c *statsdClient) run() {
+	ticker := newTicker(c.interval)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				c.flush()
+			case <-c.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the flusher, sends what's buffered and closes the socket
+func (c *statsdClient) stop() error {
+	close(c.done)
+	c.wg.Wait()
+	c.flush()
+	return c.conn.Close()
+}
+
+// flush sends the buffered metrics
+func (c *statsdClient) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.flushLocked()
+}
+
+// flushLocked sends the buffered metrics. StatsD is fire-and-forget, so
+// write errors, such as no server listening, are ignored.
+func (c *statsdClient) flushLocked() {
+	if len(c.buf) == 0 {
+		return
+	}
+	_, _ = c.conn.Write(c.buf)
+	c.buf = c.buf[:0]
+}
+
+// send buffers a metric line of the given value and type, tagged with
+// pairs of tag names and values when DogStatsD is enabled
+func (c *statsdClient) send(name, value, kind string, tags ...string) {
+	// Like lost packets, dropped metrics go unnoticed
+	if sinkFault(sinkStatsD) != nil {
+		return
+	}
+
+	line := make([]byte, 0, 128)
+	line = append(line, c.prefix...)
+	line = append(line, '.')
+	line = append(line, name...)
+	line = append(line, ':')
+	line = append(line, value...)
+	line = append(line, '|')
+	line = append(line, kind...)
+	if c.dogstatsd && (len(tags) > 0 || c.tags != "") {
+		line = append(line, "|#"...)
+		line = append(line, c.tags...)
+		for i := 0; i+1 < len(tags); i += 2 {
+			if i > 0 || c.tags != "" {
+				line = append(line, ',')
+			}
+			line = append(line, tags[i]...)
+			line = append(line, ':')
+			line = append(line, statsdTagReplacer.Replace(tags[i+1])...)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Lines are newline-separated within a packet
+	if len(c.buf) > 0 && len(c.buf)+1+len(line) > statsdMaxPacket {
+		c.flushLocked()
+	}
+	if len(c.buf) > 0 {
+		c.buf = append(c.buf, '\n')
+	}
+	c.buf = append(c.buf, line...)
+}
+
+// collectStatsDMetrics sends a request's count and duration to StatsD,
+// tagged with the label values of requests_total
+func (uc *UsageCollector) collectStatsDMetrics(method, statusCode, host string, elapsed time.Duration) {
+	tags := []string{"method", method, "status_code", statusCode, "host", host}
+	uc.statsd.send("requests", "1", "c", tags...)
+	uc.statsd.send("request_duration", strconv.FormatFloat(float64(elapsed)/float64(time.Millisecond), 'f', -1, 64), "ms", tags...)
+}
+
+// statsdOnly reports whether requests are recorded to StatsD instead of
+// the Prometheus metrics
+func (uc *UsageCollector) statsdOnly() bool {
+	return uc.StatsD != nil && uc.StatsD.Exclusive
+}
+
+// unmarshalStatsDConfig parses a statsd block:
+//
+//	statsd [<address>] [{
+//	    prefix <prefix>
+//	    dogstatsd
+//	    tags <tags...>
+//	    flush_interval <duration>
+//	    exclusive
+//	}]
+func unmarshalStatsDConfig(d *caddyfile.Dispenser) (*StatsDConfig, error) {
+	sc := new(StatsDConfig)
+	if d.NextArg() {
+		sc.Address = d.Val()
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch option := d.Val(); option {
+		case "prefix":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			sc.Prefix = d.Val()
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+
+		case "tags":
+			tags := d.RemainingArgs()
+			if len(tags) == 0 {
+				return nil, d.ArgErr()
+			}
+			sc.Tags = append(sc.Tags, tags...)
+
+		case "flush_interval":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid statsd flush_interval '%s': %v", d.Val(), err)
+			}
+			sc.FlushInterval = caddy.Duration(dur)
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+
+		case "dogstatsd", "exclusive":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			if option == "dogstatsd" {
+				sc.DogStatsD = true
+			} else {
+				sc.Exclusive = true
+			}
+
+		default:
+			return nil, d.Errf("unrecognized statsd option '%s'", option)
+		}
+	}
+
+	return sc, nil
+}
@@ -0,0 +1,178 @@
+package caddyusage
+
+import (
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// listenStatsD returns a UDP socket standing in for a StatsD server
+func listenStatsD(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// readStatsD returns the lines of the next packet received
+func readStatsD(t *testing.T, conn net.PacketConn) []string {
+	t.Helper()
+
+	buf := make([]byte, 65536)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Failed to read packet: %v", err)
+	}
+	return strings.Split(string(buf[:n]), "\n")
+}
+
+// TestStatsDMetrics tests the lines sent for a request, with and without
+// DogStatsD tags, and that exclusive mode skips the Prometheus metrics
+func TestStatsDMetrics(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      StatsDConfig
+		expected []string
+	}{
+		{
+			name: "statsd",
+			expected: []string{
+				"caddy.usage.requests:1|c",
+				"caddy.usage.request_duration:0|ms",
+			},
+		},
+		{
+			name: "dogstatsd",
+			cfg:  StatsDConfig{Prefix: "web", DogStatsD: true, Tags: []string{"env:prod"}, Exclusive: true},
+			expected: []string{
+				"web.requests:1|c|#env:prod,method:GET,status_code:404,host:example.com",
+				"web.request_duration:0|ms|#env:prod,method:GET,status_code:404,host:example.com",
+			},
+		},
+	}
+
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uc, registry, cleanup := setupTestMetrics(t)
+			defer cleanup()
+
+			server := listenStatsD(t)
+			cfg := tt.cfg
+			cfg.Address = server.LocalAddr().String()
+			uc.StatsD = &cfg
+
+			client, err := acquireStatsDClient(uc.StatsD)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			uc.statsd = client
+
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+			rec.WriteHeader(404)
+			uc.collectMetrics(rec, req, now(), nil)
+
+			// Releasing the last user flushes the buffer
+			if err := releaseStatsDClient(client); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := readStatsD(t, server); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+
+			labels := usagetest.Labels{"host": "example.com"}
+			if cfg.Exclusive {
+				usagetest.AssertAbsent(t, registry, "requests_total", labels)
+			} else {
+				usagetest.AssertValue(t, registry, "requests_total", labels, 1)
+			}
+		})
+	}
+}
+
+// TestStatsDPackets tests that lines are batched into packets of at most
+// statsdMaxPacket bytes
+func TestStatsDPackets(t *testing.T) {
+	server := listenStatsD(t)
+	client, err := acquireStatsDClient(&StatsDConfig{Address: server.LocalAddr().String(), FlushInterval: caddy.Duration(time.Hour)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer func() { _ = releaseStatsDClient(client) }()
+
+	// Lines of 24 bytes and their separators fill a packet after 57
+	for range 100 {
+		client.send("requests", "1", "c")
+	}
+
+	lines := readStatsD(t, server)
+	if len(lines) != 57 {
+		t.Errorf("Expected 57 lines in the first packet, got %d", len(lines))
+	}
+	for _, line := range lines {
+		if line != "caddy.usage.requests:1|c" {
+			t.Fatalf("Unexpected line %q", line)
+		}
+	}
+}
+
+// TestUnmarshalStatsD tests parsing of the statsd option
+func TestUnmarshalStatsD(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *StatsDConfig
+		expectErr bool
+	}{
+		{input: "usage {\n statsd\n}", expected: &StatsDConfig{}},
+		{input: "usage {\n statsd 10.0.0.1:8125\n}", expected: &StatsDConfig{Address: "10.0.0.1:8125"}},
+		{
+			input: "usage {\n statsd {\n prefix web\n dogstatsd\n tags env:prod team:edge\n flush_interval 5s\n exclusive\n }\n}",
+			expected: &StatsDConfig{
+				Prefix:        "web",
+				DogStatsD:     true,
+				Tags:          []string{"env:prod", "team:edge"},
+				FlushInterval: caddy.Duration(5 * time.Second),
+				Exclusive:     true,
+			},
+		},
+		{input: "usage {\n statsd a:1 b:2\n}", expectErr: true},
+		{input: "usage {\n statsd {\n tags\n }\n}", expectErr: true},
+		{input: "usage {\n statsd {\n flush_interval often\n }\n}", expectErr: true},
+		{input: "usage {\n statsd {\n sample_rate 0.5\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.StatsD, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.StatsD)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package caddyusage
+
+// statusClassOther is the class of status codes outside of 100 to 599
+const statusClassOther = "other"
+
+// statusClasses are the classes of status codes by hundreds
+var statusClasses = [...]string{1: "1xx", 2: "2xx", 3: "3xx", 4: "4xx", 5: "5xx"}
+
+// statusClass returns the class of a status code, like 4xx for 404
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return statusClassOther
+	}
+	return statusClasses[status/100]
+}
+
+// collectStatusClassMetrics counts a request by status class, and as an
+// error when it was answered with a 5xx status. status is the status the
+// request was answered with, including the error's for handlers that
+// failed before writing a response (see responseStatus).
+func (uc *UsageCollector) collectStatusClassMetrics(um *usageMetrics, status int, host, method string) {
+	class := statusClass(status)
+	um.requestsByClass.WithLabelValues(class, host, method).Inc()
+	if class == "5xx" {
+		um.errorsTotal.WithLabelValues(host, method).Inc()
+	}
+}
@@ -0,0 +1,67 @@
+package caddyusage
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestStatusClass tests the class of status codes
+func TestStatusClass(t *testing.T) {
+	tests := map[int]string{
+		101: "1xx",
+		200: "2xx",
+		204: "2xx",
+		304: "3xx",
+		404: "4xx",
+		499: "4xx",
+		500: "5xx",
+		599: "5xx",
+		0:   statusClassOther,
+		600: statusClassOther,
+	}
+	for status, expected := range tests {
+		if got := statusClass(status); got != expected {
+			t.Errorf("%d: expected %s, got %s", status, expected, got)
+		}
+	}
+}
+
+// TestStatusClassMetrics tests that requests are counted by status class,
+// and 5xx responses as errors
+func TestStatusClassMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	collectTestRequests(t, uc)
+	for _, status := range []int{500, 503} {
+		uc.collectStatusClassMetrics(globalUsageMetrics, status, "example.com", "GET")
+	}
+
+	usagetest.AssertValue(t, registry, "requests_by_class_total", usagetest.Labels{"class": "2xx", "method": "GET"}, 2)
+	usagetest.AssertValue(t, registry, "requests_by_class_total", usagetest.Labels{"class": "2xx", "method": "POST"}, 1)
+	usagetest.AssertValue(t, registry, "requests_by_class_total", usagetest.Labels{"class": "4xx", "method": "DELETE"}, 1)
+	usagetest.AssertValue(t, registry, "requests_by_class_total", usagetest.Labels{"class": "5xx", "host": "example.com"}, 2)
+	usagetest.AssertCount(t, registry, "errors_total", nil, 1)
+	usagetest.AssertValue(t, registry, "errors_total", usagetest.Labels{"host": "example.com", "method": "GET"}, 2)
+}
+
+// TestStatusClassHandlerErrors tests that requests whose handler failed
+// before writing a response are counted by the error's status
+func TestStatusClassHandlerErrors(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return caddyhttp.Error(http.StatusBadGateway, errors.New("no upstreams available"))
+	})
+	_ = uc.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/api", nil), next)
+
+	usagetest.AssertValue(t, registry, "requests_by_class_total", usagetest.Labels{"class": "5xx", "host": "example.com", "method": "GET"}, 1)
+	usagetest.AssertAbsent(t, registry, "requests_by_class_total", usagetest.Labels{"class": "2xx"})
+	usagetest.AssertValue(t, registry, "errors_total", usagetest.Labels{"host": "example.com", "method": "GET"}, 1)
+}
@@ -0,0 +1,96 @@
+package caddyusage
+
+import (
+	"fmt"
+	"mime"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Types of streamed responses, as the type label of the stream_* metrics
+const (
+	streamEvents  = "sse"
+	streamChunked = "chunked"
+)
+
+// defaultStreamMinDuration is how long a response of unknown length must
+// last to count as a stream
+const defaultStreamMinDuration = 10 * time.Second
+
+// streamDurationBuckets span long-lived streams, from a second to two hours
+var streamDurationBuckets = []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 7200}
+
+// StreamsConfig records streamed responses, Server-Sent Events and long
+// responses of unknown length, in stream histograms of their own: the time
+// to the first byte in stream_first_byte_seconds and the whole stream in
+// stream_duration_seconds. Streams are left out of request_duration_seconds
+// so that they don't skew the latency of ordinary requests.
+type StreamsConfig struct {
+	// MinDuration is how long a response without a Content-Length must
+	// last to count as a stream. Event streams always do. Default: 10s.
+	MinDuration caddy.Duration `json:"min_duration,omitempty"`
+}
+
+// minDuration returns the configured minimum duration or its default
+func (sc *StreamsConfig) minDuration() time.Duration {
+	if sc.MinDuration > 0 {
+		return time.Duration(sc.MinDuration)
+	}
+	return defaultStreamMinDuration
+}
+
+// validate checks the minimum duration
+func (sc *StreamsConfig) validate() error {
+	if sc.MinDuration < 0 {
+		return fmt.Errorf("streams minimum duration must not be negative, got %s", time.Duration(sc.MinDuration))
+	}
+	return nil
+}
+
+// streamType returns the type of stream a response is, or "" when it's an
+// ordinary response or streams aren't recorded apart
+func (uc *UsageCollector) streamType(rec recordedResponse, elapsed time.Duration) string {
+	sc := uc.Streams
+	if sc == nil {
+		return ""
+	}
+	header := rec.Header()
+	if mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return streamEvents
+	}
+	if header.Get("Content-Length") == "" && rec.Size() > 0 && elapsed >= sc.minDuration() {
+		return streamChunked
+	}
+	return ""
+}
+
+// collectStreamMetrics records the time to first byte and duration of a
+// streamed response. The time to first byte is only known for responses
+// served by the handler, and left out otherwise.
+func collectStreamMetrics(um *usageMetrics, rec recordedResponse, stream, host string, startTime time.Time, elapsed time.Duration) {
+	if firstByte := firstByteTime(rec); !firstByte.IsZero() {
+		um.streamFirstByte.WithLabelValues(host, stream).Observe(firstByte.Sub(startTime).Seconds())
+	}
+	um.streamDuration.WithLabelValues(host, stream).Observe(elapsed.Seconds())
+}
+
+// unmarshalStreamsConfig parses a streams directive:
+//
+//	streams [<min_duration>]
+func unmarshalStreamsConfig(d *caddyfile.Dispenser) (*StreamsConfig, error) {
+	sc := &StreamsConfig{}
+	if !d.NextArg() {
+		return sc, nil
+	}
+	dur, err := caddy.ParseDuration(d.Val())
+	if err != nil || dur <= 0 {
+		return nil, d.Errf("invalid streams minimum duration '%s'", d.Val())
+	}
+	sc.MinDuration = caddy.Duration(dur)
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	return sc, nil
+}
@@ -0,0 +1,115 @@
+package caddyusage
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestStreamMetrics tests that event streams and long responses of unknown
+// length are recorded in the stream histograms instead of the request
+// duration
+func TestStreamMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	// serve passes a request to a handler that waits firstByte before
+	// writing its headers, and then streams for rest
+	serve := func(path, contentType, contentLength string, firstByte, rest time.Duration) {
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+			clock.Advance(firstByte)
+			w.Header().Set("Content-Type", contentType)
+			if contentLength != "" {
+				w.Header().Set("Content-Length", contentLength)
+			}
+			if _, err := w.Write([]byte("data: 1\n\n")); err != nil {
+				return err
+			}
+			clock.Advance(rest)
+			_, err := w.Write([]byte("data: 2\n\n"))
+			return err
+		})
+		if err := uc.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com"+path, nil), next); err != nil {
+			t.Fatalf("ServeHTTP failed: %v", err)
+		}
+	}
+
+	// Without streams, every response is an ordinary request
+	serve("/events", "text/event-stream", "", 0, time.Minute)
+	usagetest.AssertValue(t, registry, "request_duration_seconds", nil, 1)
+	usagetest.AssertAbsent(t, registry, "stream_duration_seconds", nil)
+
+	uc.Streams = &StreamsConfig{}
+	serve("/events", "text/event-stream; charset=utf-8", "", 200*time.Millisecond, time.Minute)
+	serve("/export", "text/csv", "", time.Second, 30*time.Second)
+	serve("/report", "text/csv", "", time.Second, time.Second)
+	serve("/download", "application/octet-stream", "18", time.Second, 30*time.Second)
+
+	events := usagetest.Labels{"host": "example.com", "type": streamEvents}
+	chunked := usagetest.Labels{"host": "example.com", "type": streamChunked}
+	usagetest.AssertValue(t, registry, "stream_first_byte_seconds", events, 1)
+	usagetest.AssertValue(t, registry, "stream_duration_seconds", events, 1)
+	usagetest.AssertValue(t, registry, "stream_first_byte_seconds", chunked, 1)
+	usagetest.AssertValue(t, registry, "stream_duration_seconds", chunked, 1)
+
+	// Short responses and responses of known length stay ordinary, and
+	// every request is still counted
+	usagetest.AssertValue(t, registry, "request_duration_seconds", nil, 3)
+	usagetest.AssertValue(t, registry, "requests_total", usagetest.Labels{"host": "example.com"}, 5)
+
+	series := usagetest.Series(t, registry, "stream_first_byte_seconds", events)
+	if sum := series[0].GetHistogram().GetSampleSum(); math.Abs(sum-0.2) > 1e-9 {
+		t.Errorf("Expected a time to first byte of 0.2s, got %gs", sum)
+	}
+	series = usagetest.Series(t, registry, "stream_duration_seconds", events)
+	if sum := series[0].GetHistogram().GetSampleSum(); math.Abs(sum-60.2) > 1e-9 {
+		t.Errorf("Expected a stream duration of 60.2s, got %gs", sum)
+	}
+}
+
+// TestUnmarshalStreams tests parsing and validation of the streams option
+func TestUnmarshalStreams(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *StreamsConfig
+		expectErr bool
+	}{
+		{input: "usage {\n streams\n}", expected: &StreamsConfig{}},
+		{input: "usage {\n streams 1m\n}", expected: &StreamsConfig{MinDuration: caddy.Duration(time.Minute)}},
+		{input: "usage {\n streams forever\n}", expectErr: true},
+		{input: "usage {\n streams 0s\n}", expectErr: true},
+		{input: "usage {\n streams 1m 2m\n}", expectErr: true},
+	}
+	for _, tt := range tests {
+		var uc UsageCollector
+		err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected an error but got none", tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(uc.Streams, tt.expected) {
+			t.Errorf("Expected %+v, got %+v", tt.expected, uc.Streams)
+		}
+	}
+
+	sc := StreamsConfig{MinDuration: caddy.Duration(-time.Second)}
+	if err := sc.validate(); err == nil {
+		t.Error("Expected an error for a negative minimum duration")
+	}
+}
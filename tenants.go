@@ -0,0 +1,621 @@
+package caddyusage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Tenant report defaults and bounds
+const (
+	defaultTenantReportInterval = 24 * time.Hour
+	defaultTenantLatencyTarget  = 0.99
+	tenantReportTimeout         = 10 * time.Second
+)
+
+// TenantReport subscribes a tenant to reports of its own usage and service
+// levels, posted to a webhook on a schedule, so that customers can follow
+// their usage without a portal backend.
+type TenantReport struct {
+	// Tenant names the tenant in its reports.
+	Tenant string `json:"tenant"`
+
+	// Webhook is the URL reports are posted to as JSON.
+	Webhook string `json:"webhook"`
+
+	// Headers are sent with every report, such as authentication tokens.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Hosts identify the tenant's requests by host, as case-insensitive
+	// globs, or regular expressions when starting with ^. Hosts of a host
+	// group are matched by the group's name.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// APIKeys identify the tenant's requests by the API key they carry.
+	APIKeys []string `json:"api_keys,omitempty"`
+
+	// KeyHeader is the request header carrying API keys, with or without
+	// a "Bearer " prefix. Defaults to Authorization.
+	KeyHeader string `json:"key_header,omitempty"`
+
+	// Interval is the time between reports. Defaults to 24h.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// SLO adds the tenant's service level objectives to its reports.
+	SLO *TenantSLO `json:"slo,omitempty"`
+}
+
+// TenantSLO sets the service level objectives reported to a tenant
+type TenantSLO struct {
+	// Availability is the target fraction of requests not failing with a
+	// 5xx status, such as 0.999.
+	Availability float64 `json:"availability,omitempty"`
+
+	// Latency is the response time requests should be served within.
+	Latency caddy.Duration `json:"latency,omitempty"`
+
+	// LatencyTarget is the target fraction of requests served within
+	// Latency. Defaults to 0.99.
+	LatencyTarget float64 `json:"latency_target,omitempty"`
+}
+
+// validate checks the webhook, request matching, interval and objectives
+func (tr *TenantReport) validate() error {
+	if tr.Tenant == "" {
+		return fmt.Errorf("tenant_report: tenant is required")
+	}
+	u, err := url.Parse(tr.Webhook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("tenant_report %s: invalid webhook '%s': expected an http or https URL", tr.Tenant, tr.Webhook)
+	}
+	if len(tr.Hosts) == 0 && len(tr.APIKeys) == 0 {
+		return fmt.Errorf("tenant_report %s: hosts or api_keys are required", tr.Tenant)
+	}
+	if _, err := compilePatterns(tr.Hosts, true); err != nil {
+		return fmt.Errorf("tenant_report %s: %v", tr.Tenant, err)
+	}
+	if tr.Interval < 0 {
+		return fmt.Errorf("tenant_report %s: interval must not be negative, got %s", tr.Tenant, time.Duration(tr.Interval))
+	}
+	if slo := tr.SLO; slo != nil {
+		if slo.Availability < 0 || slo.Availability > 1 {
+			return fmt.Errorf("tenant_report %s: availability must be between 0 and 1, got %g", tr.Tenant, slo.Availability)
+		}
+		if slo.Latency < 0 {
+			return fmt.Errorf("tenant_report %s: latency must not be negative, got %s", tr.Tenant, time.Duration(slo.Latency))
+		}
+		if slo.LatencyTarget < 0 || slo.LatencyTarget > 1 {
+			return fmt.Errorf("tenant_report %s: latency target must be between 0 and 1, got %g", tr.Tenant, slo.LatencyTarget)
+		}
+	}
+	return nil
+}
+
+// validateTenantReports checks each subscription, and that tenants are
+// subscribed once
+func validateTenantReports(reports []TenantReport) error {
+	seen := make(map[string]bool, len(reports))
+	for i := range reports {
+		if err := reports[i].validate(); err != nil {
+			return err
+		}
+		if seen[reports[i].Tenant] {
+			return fmt.Errorf("tenant_report %s: tenant subscribed more than once", reports[i].Tenant)
+		}
+		seen[reports[i].Tenant] = true
+	}
+	return nil
+}
+
+// tenantUsageReport is the JSON body of a report
+type tenantUsageReport struct {
+	Tenant              string           `json:"tenant"`
+	PeriodStart         time.Time        `json:"period_start"`
+	PeriodEnd           time.Time        `json:"period_end"`
+	Requests            uint64           `json:"requests"`
+	ClientErrors        uint64           `json:"client_errors"`
+	ServerErrors        uint64           `json:"server_errors"`
+	Bytes               uint64           `json:"bytes"`
+	MeanDurationSeconds float64          `json:"mean_duration_seconds"`
+	SLO                 *tenantSLOReport `json:"slo,omitempty"`
+}
+
+// tenantSLOReport reports how a tenant's objectives were met
+type tenantSLOReport struct {
+	Availability *sloResult `json:"availability,omitempty"`
+	Latency      *sloResult `json:"latency,omitempty"`
+}
+
+// sloResult is the outcome of an objective over a report's period
+type sloResult struct {
+	ThresholdSeconds float64 `json:"threshold_seconds,omitempty"`
+	Target           float64 `json:"target"`
+	Actual           float64 `json:"actual"`
+	Met              bool    `json:"met"`
+}
+
+// newSLOResult compares the fraction of good requests with a target. A
+// period without requests meets every objective.
+func newSLOResult(good, total uint64, target float64) *sloResult {
+	actual := 1.0
+	if total > 0 {
+		actual = float64(good) / float64(total)
+	}
+	return &sloResult{Target: target, Actual: actual, Met: actual >= target}
+}
+
+// tenantUsage is what a tenant's requests added up to since the previous
+// report
+type tenantUsage struct {
+	start         time.Time
+	requests      uint64
+	clientErrors  uint64
+	serverErrors  uint64
+	bytes         uint64
+	withinLatency uint64
+	duration      float64
+}
+
+// add folds the usage of an earlier period into u
+func (u *tenantUsage) add(earlier tenantUsage) {
+	u.start = earlier.start
+	u.requests += earlier.requests
+	u.clientErrors += earlier.clientErrors
+	u.serverErrors += earlier.serverErrors
+	u.bytes += earlier.bytes
+	u.withinLatency += earlier.withinLatency
+	u.duration += earlier.duration
+}
+
+// tenantReporter adds up a tenant's usage and posts it to the tenant's
+// webhook every interval. Subscriptions of a tenant share its reporter, so
+// config reloads keep the usage counted since the previous report; like
+// other shared settings, the most recently provisioned handler's
+// subscription applies.
+type tenantReporter struct {
+	tenant string
+	client *http.Client
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	webhook  string
+	headers  http.Header
+	interval time.Duration
+	slo      *TenantSLO
+	usage    tenantUsage
+	failing  bool
+
+	intervals chan time.Duration
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// tenantReporterEntry is a shared reporter and the number of handlers
+// using it
+type tenantReporterEntry struct {
+	reporter *tenantReporter
+	refs     int
+}
+
+var (
+	// Running reporters by tenant
+	tenantReporters   = make(map[string]*tenantReporterEntry)
+	tenantReportersMu sync.Mutex
+)
+
+// acquireTenantReporter returns the running reporter of the subscription's
+// tenant, starting one if needed, and applies the subscription. Each call
+// must be balanced by a call to releaseTenantReporter.
+func acquireTenantReporter(tr *TenantReport, logger *zap.Logger) *tenantReporter {
+	tenantReportersMu.Lock()
+	defer tenantReportersMu.Unlock()
+
+	if entry, ok := tenantReporters[tr.Tenant]; ok {
+		entry.refs++
+		entry.reporter.configure(tr)
+		return entry.reporter
+	}
+
+	r := &tenantReporter{
+		tenant:    tr.Tenant,
+		client:    &http.Client{Timeout: tenantReportTimeout},
+		logger:    logger,
+		usage:     tenantUsage{start: now()},
+		intervals: make(chan time.Duration, 1),
+		done:      make(chan struct{}),
+	}
+	r.configure(tr)
+	r.run()
+	tenantReporters[r.tenant] = &tenantReporterEntry{reporter: r, refs: 1}
+	return r
+}
+
+// releaseTenantReporter releases a handler's use of a reporter, stopping
+// it once no handler uses it anymore
+func releaseTenantReporter(r *tenantReporter) {
+	tenantReportersMu.Lock()
+	defer tenantReportersMu.Unlock()
+
+	entry, ok := tenantReporters[r.tenant]
+	if !ok || entry.reporter != r {
+		return
+	}
+	if entry.refs--; entry.refs > 0 {
+		return
+	}
+	delete(tenantReporters, r.tenant)
+	r.stop()
+}
+
+// configure applies a subscription's webhook, schedule and objectives
+func (r *tenantReporter) configure(tr *TenantReport) {
+	headers := make(http.Header, len(tr.Headers))
+	for name, value := range tr.Headers {
+		headers.Set(name, value)
+	}
+	interval := defaultTenantReportInterval
+	if tr.Interval > 0 {
+		interval = time.Duration(tr.Interval)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.webhook = tr.Webhook
+	r.headers = headers
+	r.slo = tr.SLO
+	if interval != r.interval {
+		// The previous interval may not have been picked up yet
+		select {
+		case <-r.intervals:
+		default:
+		}
+		r.intervals <- interval
+		r.interval = interval
+	}
+}
+
+// run reports every interval until stopped. The first interval is the one
+// queued by the first configure.
+func (r *tenantReporter) run() {
+	ticker := newTicker(<-r.intervals)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer func() { ticker.Stop() }()
+
+		for {
+			select {
+			case <-ticker.C():
+				r.reportLogged()
+			case interval := <-r.intervals:
+				ticker.Stop()
+				ticker = newTicker(interval)
+			case <-r.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops reporting. The usage since the previous report is discarded,
+// since the tenant is no longer subscribed.
+func (r *tenantReporter) stop() {
+	close(r.done)
+	r.wg.Wait()
+	r.client.CloseIdleConnections()
+}
+
+// record adds a request to the tenant's usage
+func (r *tenantReporter) record(status int, elapsed time.Duration, size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u := &r.usage
+	u.requests++
+	switch {
+	case status >= 500:
+		u.serverErrors++
+	case status >= 400:
+		u.clientErrors++
+	}
+	if size > 0 {
+		u.bytes += uint64(size)
+	}
+	u.duration += elapsed.Seconds()
+	if r.slo != nil && r.slo.Latency > 0 && elapsed <= time.Duration(r.slo.Latency) {
+		u.withinLatency++
+	}
+}
+
+// reportLogged reports the usage, logging when reports start or stop
+// failing
+func (r *tenantReporter) reportLogged() {
+	err := r.report()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case err != nil && !r.failing:
+		r.logger.Warn("failed to send tenant usage report",
+			zap.String("tenant", r.tenant),
+			zap.Error(err))
+	case err == nil && r.failing:
+		r.logger.Info("sending tenant usage reports again", zap.String("tenant", r.tenant))
+	}
+	r.failing = err != nil
+}
+
+// report posts the usage since the previous report to the webhook. Usage
+// that couldn't be reported is carried over to the next report.
+func (r *tenantReporter) report() error {
+	r.mu.Lock()
+	usage := r.usage
+	end := now()
+	r.usage = tenantUsage{start: end}
+	webhook, headers, body := r.webhook, r.headers, r.newReport(usage, end)
+	r.mu.Unlock()
+
+	err := r.send(webhook, headers, body)
+	if err != nil {
+		r.mu.Lock()
+		r.usage.add(usage)
+		r.mu.Unlock()
+	}
+	return err
+}
+
+// newReport builds the report of a period's usage
+func (r *tenantReporter) newReport(u tenantUsage, end time.Time) *tenantUsageReport {
+	report := &tenantUsageReport{
+		Tenant:       r.tenant,
+		PeriodStart:  u.start.UTC(),
+		PeriodEnd:    end.UTC(),
+		Requests:     u.requests,
+		ClientErrors: u.clientErrors,
+		ServerErrors: u.serverErrors,
+		Bytes:        u.bytes,
+	}
+	if u.requests > 0 {
+		report.MeanDurationSeconds = u.duration / float64(u.requests)
+	}
+
+	if slo := r.slo; slo != nil {
+		report.SLO = new(tenantSLOReport)
+		if slo.Availability > 0 {
+			report.SLO.Availability = newSLOResult(u.requests-u.serverErrors, u.requests, slo.Availability)
+		}
+		if slo.Latency > 0 {
+			target := slo.LatencyTarget
+			if target == 0 {
+				target = defaultTenantLatencyTarget
+			}
+			report.SLO.Latency = newSLOResult(u.withinLatency, u.requests, target)
+			report.SLO.Latency.ThresholdSeconds = time.Duration(slo.Latency).Seconds()
+		}
+	}
+	return report
+}
+
+// send posts a report to a webhook
+func (r *tenantReporter) send(webhook string, headers http.Header, report *tenantUsageReport) error {
+	if err := sinkFault(sinkTenantReport); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tenantReportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = headers.Clone()
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// tenantSubscription matches a handler's requests to a tenant's reporter
+type tenantSubscription struct {
+	hosts     []*regexp.Regexp
+	apiKeys   map[string]bool
+	keyHeader string
+	reporter  *tenantReporter
+}
+
+// provisionTenantReports starts reporting to the subscribed tenants
+func (uc *UsageCollector) provisionTenantReports() error {
+	subscriptions := make([]tenantSubscription, 0, len(uc.TenantReports))
+	for i := range uc.TenantReports {
+		tr := &uc.TenantReports[i]
+		hosts, err := compilePatterns(tr.Hosts, true)
+		if err != nil {
+			return fmt.Errorf("tenant_report %s: %v", tr.Tenant, err)
+		}
+		sub := tenantSubscription{hosts: hosts, keyHeader: tr.KeyHeader}
+		if len(tr.APIKeys) > 0 {
+			sub.apiKeys = make(map[string]bool, len(tr.APIKeys))
+			for _, key := range tr.APIKeys {
+				sub.apiKeys[key] = true
+			}
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+
+	for i := range subscriptions {
+		subscriptions[i].reporter = acquireTenantReporter(&uc.TenantReports[i], uc.logger)
+	}
+	uc.tenantSubscriptions = subscriptions
+	return nil
+}
+
+// releaseTenantReports stops reporting to tenants no handler subscribes
+// anymore
+func (uc *UsageCollector) releaseTenantReports() {
+	for _, sub := range uc.tenantSubscriptions {
+		releaseTenantReporter(sub.reporter)
+	}
+	uc.tenantSubscriptions = nil
+}
+
+// collectTenantReports adds a request to the usage of the tenants it
+// belongs to
+func (uc *UsageCollector) collectTenantReports(rec recordedResponse, r *http.Request, elapsed time.Duration) {
+	var host string
+	for _, sub := range uc.tenantSubscriptions {
+		if !sub.matches(uc, r, &host) {
+			continue
+		}
+		sub.reporter.record(rec.Status(), elapsed, rec.Size())
+	}
+}
+
+// matches reports whether a request belongs to the subscription's tenant.
+// host caches the request's grouped host between subscriptions.
+func (sub *tenantSubscription) matches(uc *UsageCollector, r *http.Request, host *string) bool {
+	if len(sub.hosts) > 0 {
+		if *host == "" {
+			*host = hostWithoutPort(uc.groupHost(r.Host))
+		}
+		for _, re := range sub.hosts {
+			if re.MatchString(*host) {
+				return true
+			}
+		}
+	}
+	if sub.apiKeys != nil {
+		if key := requestAPIKey(r, sub.keyHeader); key != "" && sub.apiKeys[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// unmarshalTenantReport parses a tenant_report block:
+//
+//	tenant_report <tenant> <webhook> {
+//	    hosts <patterns...>
+//	    api_keys <keys...>
+//	    key_header <name>
+//	    interval <duration>
+//	    header <name> <value>
+//	    availability <fraction>
+//	    latency <duration> [<fraction>]
+//	}
+func unmarshalTenantReport(d *caddyfile.Dispenser) (TenantReport, error) {
+	var tr TenantReport
+	if !d.Args(&tr.Tenant, &tr.Webhook) {
+		return tr, d.ArgErr()
+	}
+	if d.NextArg() {
+		return tr, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		args := d.RemainingArgs()
+		switch option {
+		case "hosts", "api_keys":
+			if len(args) == 0 {
+				return tr, d.ArgErr()
+			}
+			if option == "hosts" {
+				tr.Hosts = append(tr.Hosts, args...)
+			} else {
+				tr.APIKeys = append(tr.APIKeys, args...)
+			}
+
+		case "key_header":
+			if len(args) != 1 {
+				return tr, d.ArgErr()
+			}
+			tr.KeyHeader = args[0]
+
+		case "interval":
+			if len(args) != 1 {
+				return tr, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return tr, d.Errf("invalid tenant_report interval '%s': %v", args[0], err)
+			}
+			tr.Interval = caddy.Duration(dur)
+
+		case "header":
+			if len(args) != 2 {
+				return tr, d.ArgErr()
+			}
+			if tr.Headers == nil {
+				tr.Headers = make(map[string]string)
+			}
+			tr.Headers[args[0]] = args[1]
+
+		case "availability":
+			if len(args) != 1 {
+				return tr, d.ArgErr()
+			}
+			target, err := strconv.ParseFloat(args[0], 64)
+			if err != nil {
+				return tr, d.Errf("invalid tenant_report availability '%s': %v", args[0], err)
+			}
+			if tr.SLO == nil {
+				tr.SLO = new(TenantSLO)
+			}
+			tr.SLO.Availability = target
+
+		case "latency":
+			if len(args) == 0 || len(args) > 2 {
+				return tr, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return tr, d.Errf("invalid tenant_report latency '%s': %v", args[0], err)
+			}
+			if tr.SLO == nil {
+				tr.SLO = new(TenantSLO)
+			}
+			tr.SLO.Latency = caddy.Duration(dur)
+			if len(args) == 2 {
+				target, err := strconv.ParseFloat(args[1], 64)
+				if err != nil {
+					return tr, d.Errf("invalid tenant_report latency target '%s': %v", args[1], err)
+				}
+				tr.SLO.LatencyTarget = target
+			}
+
+		default:
+			return tr, d.Errf("unrecognized tenant_report option '%s'", option)
+		}
+	}
+
+	return tr, nil
+}
@@ -0,0 +1,263 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// tenantWebhook starts a server receiving reports, failing them while
+// failing is set
+func tenantWebhook(t *testing.T, failing *atomic.Bool) (*httptest.Server, <-chan tenantUsageReport) {
+	t.Helper()
+
+	reports := make(chan tenantUsageReport, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing != nil && failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer hook-token" {
+			t.Errorf("Expected the configured headers, got %v", r.Header)
+		}
+
+		var report tenantUsageReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Errorf("Invalid report: %v", err)
+		}
+		reports <- report
+	}))
+	t.Cleanup(server.Close)
+	return server, reports
+}
+
+// nextReport returns the next report received, failing the test if none
+// arrives
+func nextReport(t *testing.T, reports <-chan tenantUsageReport) tenantUsageReport {
+	t.Helper()
+
+	select {
+	case report := <-reports:
+		return report
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a report")
+		return tenantUsageReport{}
+	}
+}
+
+// TestTenantReports tests that tenants receive reports of their own
+// requests only, identified by host group or API key
+func TestTenantReports(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	server, reports := tenantWebhook(t, nil)
+	headers := map[string]string{"Authorization": "Bearer hook-token"}
+	hostGroups, err := compileHostGroups([]HostGroup{{Match: "*.acme.com", Group: "acme"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	uc.hostGroups = hostGroups
+	uc.TenantReports = []TenantReport{
+		{Tenant: "acme", Webhook: server.URL + "/acme", Headers: headers, Hosts: []string{"acme"}, Interval: caddy.Duration(time.Hour)},
+		{
+			Tenant:    "beta",
+			Webhook:   server.URL + "/beta",
+			Headers:   headers,
+			APIKeys:   []string{"key-b"},
+			KeyHeader: "X-Api-Key",
+			Interval:  caddy.Duration(2 * time.Hour),
+			SLO:       &TenantSLO{Availability: 0.99, Latency: caddy.Duration(100 * time.Millisecond)},
+		},
+	}
+	if err := uc.provisionTenantReports(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer uc.releaseTenantReports()
+
+	start := now()
+	requests := []struct {
+		host     string
+		key      string
+		status   int
+		duration time.Duration
+	}{
+		{host: "shop.acme.com:443", status: 200, duration: 20 * time.Millisecond},
+		{host: "api.example.com", key: "Bearer key-b", status: 500, duration: 50 * time.Millisecond},
+		{host: "api.example.com", key: "key-b", status: 404, duration: 200 * time.Millisecond},
+		{host: "api.example.com", key: "key-c", status: 200, duration: 10 * time.Millisecond},
+	}
+	for _, tt := range requests {
+		req := httptest.NewRequest("GET", "http://"+tt.host+"/", nil)
+		if tt.key != "" {
+			req.Header.Set("X-Api-Key", tt.key)
+		}
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(tt.status)
+		_, _ = rec.Write([]byte("body"))
+		uc.collectMetrics(rec, req, now().Add(-tt.duration), nil)
+	}
+
+	// Each tenant is reported on its own schedule
+	clock.Advance(time.Hour)
+	acme := nextReport(t, reports)
+	expected := tenantUsageReport{
+		Tenant:              "acme",
+		PeriodStart:         start,
+		PeriodEnd:           start.Add(time.Hour),
+		Requests:            1,
+		Bytes:               4,
+		MeanDurationSeconds: 0.02,
+	}
+	if !reflect.DeepEqual(acme, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, acme)
+	}
+
+	clock.Advance(time.Hour)
+	second := map[string]tenantUsageReport{}
+	for range 2 {
+		report := nextReport(t, reports)
+		second[report.Tenant] = report
+	}
+	if report := second["acme"]; report.Requests != 0 || !report.PeriodStart.Equal(start.Add(time.Hour)) {
+		t.Errorf("Expected an empty report for acme's second period, got %+v", report)
+	}
+	beta := second["beta"]
+	if beta.Tenant != "beta" || beta.Requests != 2 || beta.ServerErrors != 1 || beta.ClientErrors != 1 || beta.Bytes != 8 {
+		t.Errorf("Expected beta's two requests, got %+v", beta)
+	}
+	if beta.SLO == nil || beta.SLO.Availability == nil || beta.SLO.Latency == nil {
+		t.Fatalf("Expected availability and latency results, got %+v", beta.SLO)
+	}
+	if want := (sloResult{Target: 0.99, Actual: 0.5}); *beta.SLO.Availability != want {
+		t.Errorf("Expected availability %+v, got %+v", want, *beta.SLO.Availability)
+	}
+	if want := (sloResult{ThresholdSeconds: 0.1, Target: 0.99, Actual: 0.5}); *beta.SLO.Latency != want {
+		t.Errorf("Expected latency %+v, got %+v", want, *beta.SLO.Latency)
+	}
+}
+
+// TestTenantReportRetry tests that usage is carried over to the next report
+// while the webhook fails
+func TestTenantReportRetry(t *testing.T) {
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	var failing atomic.Bool
+	failing.Store(true)
+	server, reports := tenantWebhook(t, &failing)
+
+	r := acquireTenantReporter(&TenantReport{
+		Tenant:  "acme",
+		Webhook: server.URL,
+		Headers: map[string]string{"Authorization": "Bearer hook-token"},
+		Hosts:   []string{"acme.com"},
+	}, zap.NewNop())
+	defer releaseTenantReporter(r)
+
+	start := now()
+	r.record(200, time.Second, 100)
+	clock.Advance(time.Minute)
+	if err := r.report(); err == nil {
+		t.Fatal("Expected the failing webhook's error")
+	}
+
+	r.record(200, time.Second, 100)
+	clock.Advance(time.Minute)
+	failing.Store(false)
+	if err := r.report(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	report := nextReport(t, reports)
+	if report.Requests != 2 || report.Bytes != 200 || !report.PeriodStart.Equal(start) || !report.PeriodEnd.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("Expected both requests since %s, got %+v", start, report)
+	}
+}
+
+// TestTenantReportValidate tests validation of tenant_report options
+func TestTenantReportValidate(t *testing.T) {
+	valid := TenantReport{Tenant: "acme", Webhook: "https://hooks.example.com/acme", Hosts: []string{"*.acme.com"}}
+	if err := validateTenantReports([]TenantReport{valid}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	tests := map[string][]TenantReport{
+		"missing tenant":      {{Webhook: valid.Webhook, Hosts: valid.Hosts}},
+		"invalid webhook":     {{Tenant: "acme", Webhook: "hooks.example.com", Hosts: valid.Hosts}},
+		"nothing to match":    {{Tenant: "acme", Webhook: valid.Webhook}},
+		"invalid host":        {{Tenant: "acme", Webhook: valid.Webhook, Hosts: []string{"^(acme"}}},
+		"negative interval":   {{Tenant: "acme", Webhook: valid.Webhook, Hosts: valid.Hosts, Interval: -1}},
+		"availability over 1": {{Tenant: "acme", Webhook: valid.Webhook, Hosts: valid.Hosts, SLO: &TenantSLO{Availability: 99.9}}},
+		"negative latency":    {{Tenant: "acme", Webhook: valid.Webhook, Hosts: valid.Hosts, SLO: &TenantSLO{Latency: -1}}},
+		"duplicate tenant":    {valid, valid},
+	}
+	for name, reports := range tests {
+		if err := validateTenantReports(reports); err == nil {
+			t.Errorf("%s: expected an error but got none", name)
+		}
+	}
+}
+
+// TestUnmarshalTenantReport tests parsing of the tenant_report option
+func TestUnmarshalTenantReport(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  []TenantReport
+		expectErr bool
+	}{
+		{
+			input: "usage {\n tenant_report acme https://hooks.example.com/acme {\n hosts acme *.acme.com\n api_keys k1 k2\n key_header X-Api-Key\n interval 1h\n header Authorization \"Bearer t\"\n availability 0.999\n latency 300ms 0.95\n }\n tenant_report beta https://hooks.example.com/beta {\n hosts beta.com\n }\n}",
+			expected: []TenantReport{
+				{
+					Tenant:    "acme",
+					Webhook:   "https://hooks.example.com/acme",
+					Headers:   map[string]string{"Authorization": "Bearer t"},
+					Hosts:     []string{"acme", "*.acme.com"},
+					APIKeys:   []string{"k1", "k2"},
+					KeyHeader: "X-Api-Key",
+					Interval:  caddy.Duration(time.Hour),
+					SLO:       &TenantSLO{Availability: 0.999, Latency: caddy.Duration(300 * time.Millisecond), LatencyTarget: 0.95},
+				},
+				{Tenant: "beta", Webhook: "https://hooks.example.com/beta", Hosts: []string{"beta.com"}},
+			},
+		},
+		{input: "usage {\n tenant_report acme\n}", expectErr: true},
+		{input: "usage {\n tenant_report acme https://a https://b\n}", expectErr: true},
+		{input: "usage {\n tenant_report acme https://a {\n hosts\n }\n}", expectErr: true},
+		{input: "usage {\n tenant_report acme https://a {\n interval daily\n }\n}", expectErr: true},
+		{input: "usage {\n tenant_report acme https://a {\n availability high\n }\n}", expectErr: true},
+		{input: "usage {\n tenant_report acme https://a {\n latency 300ms 0.9 0.8\n }\n}", expectErr: true},
+		{input: "usage {\n tenant_report acme https://a {\n email ops@acme.com\n }\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.TenantReports, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.TenantReports)
+			}
+		})
+	}
+}
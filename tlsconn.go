@@ -0,0 +1,30 @@
+package caddyusage
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strconv"
+)
+
+// collectTLSMetrics records requests received over TLS by protocol version,
+// cipher suite, server name and whether a client certificate was presented,
+// for planning the deprecation of old TLS versions and ciphers
+func (uc *UsageCollector) collectTLSMetrics(um *usageMetrics, r *http.Request) {
+	if r.TLS == nil {
+		return
+	}
+
+	// Server names go through host grouping like the host label does, as
+	// wildcard certificates accept unbounded subdomains
+	serverName := "none"
+	if r.TLS.ServerName != "" {
+		serverName = uc.groupHost(normalizeHostname(r.TLS.ServerName))
+	}
+
+	version := uc.policy.apply(um, "tls_version", tls.VersionName(r.TLS.Version))
+	cipher := uc.policy.apply(um, "cipher_suite", tls.CipherSuiteName(r.TLS.CipherSuite))
+	serverName = uc.policy.apply(um, "server_name", serverName)
+	clientCert := strconv.FormatBool(len(r.TLS.PeerCertificates) > 0)
+
+	um.tlsRequests.WithLabelValues(version, cipher, serverName, clientCert).Inc()
+}
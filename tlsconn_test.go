@@ -0,0 +1,48 @@
+package caddyusage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestTLSMetrics tests that TLS requests are counted by connection parameters
+func TestTLSMetrics(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.CollapseHosts = true
+
+	requests := []*tls.ConnectionState{
+		{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, ServerName: "app.example.com"},
+		{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, ServerName: "Api.Example.com."},
+		{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, ServerName: "example.com"},
+		{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, PeerCertificates: []*x509.Certificate{{}}},
+		nil, // plain HTTP is ignored
+	}
+	for _, state := range requests {
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		req.TLS = state
+		uc.collectTLSMetrics(globalUsageMetrics, req)
+	}
+
+	tests := []struct {
+		labels   []string
+		expected float64
+	}{
+		{[]string{"TLS 1.3", "TLS_AES_128_GCM_SHA256", "example.com", "false"}, 2},
+		{[]string{"TLS 1.2", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "example.com", "false"}, 1},
+		{[]string{"TLS 1.2", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "none", "true"}, 1},
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(globalUsageMetrics.tlsRequests.WithLabelValues(tt.labels...)); got != tt.expected {
+			t.Errorf("Expected %v requests for %v, got %v", tt.expected, tt.labels, got)
+		}
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.tlsRequests); n != len(tests) {
+		t.Errorf("Expected %d series, got %d", len(tests), n)
+	}
+}
@@ -0,0 +1,267 @@
+package caddyusage
+
+import (
+	"cmp"
+	"container/heap"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultTopK is the number of heavy hitters reported per dimension when
+// top_k is enabled without a size
+const defaultTopK = 10
+
+// topKOverprovision is how many more counters than reported items a
+// tracker monitors. Space-Saving's estimates are only guaranteed for items
+// more frequent than 1/counters of the traffic, so monitoring more
+// counters than are reported keeps the reported ones accurate.
+const topKOverprovision = 4
+
+// Dimensions tracked for heavy hitters, named after their metrics
+const (
+	topPaths      = "paths"
+	topClients    = "clients"
+	topUserAgents = "user_agents"
+)
+
+// topErrors lists the host and path pairs with the most server errors.
+// Unlike the other dimensions, it is read from requests_total, so its
+// counts are exact and it doesn't need top_k.
+const topErrors = "errors"
+
+// topKEntry is a value monitored by a topKTracker
+type topKEntry struct {
+	Value string `json:"value"`
+
+	// Count is an upper bound of the value's occurrences, and Count-Error
+	// a lower bound
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+
+	index int
+}
+
+// topKHeap is a min-heap of entries by count
+type topKHeap []*topKEntry
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *topKHeap) Push(x any) {
+	entry := x.(*topKEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *topKHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// topKTracker finds the most frequent values of a dimension in constant
+// memory with the Space-Saving algorithm: it monitors a fixed number of
+// counters, and a value that isn't monitored replaces the least frequent
+// one, inheriting its count as overestimation error.
+type topKTracker struct {
+	mu       sync.Mutex
+	k        int
+	counters int
+	entries  map[string]*topKEntry
+	heap     topKHeap
+}
+
+// newTopKTracker creates a tracker reporting the k most frequent values
+func newTopKTracker(k int) *topKTracker {
+	t := &topKTracker{}
+	t.setK(k)
+	return t
+}
+
+// setK changes the number of values reported, discarding all counts if
+// it differs from the current one
+func (t *topKTracker) setK(k int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if k == t.k {
+		return
+	}
+	t.resetLocked(k)
+}
+
+// reset discards all counts
+func (t *topKTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.resetLocked(t.k)
+}
+
+// resetLocked discards all counts and sizes the tracker for k values
+func (t *topKTracker) resetLocked(k int) {
+	t.k = k
+	t.counters = k * topKOverprovision
+	t.entries = make(map[string]*topKEntry, t.counters)
+	t.heap = make(topKHeap, 0, t.counters)
+}
+
+// add counts one occurrence of value
+func (t *topKTracker) add(value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if entry, ok := t.entries[value]; ok {
+		entry.Count++
+		heap.Fix(&t.heap, entry.index)
+		return
+	}
+
+	if len(t.heap) < t.counters {
+		entry := &topKEntry{Value: value, Count: 1}
+		t.entries[value] = entry
+		heap.Push(&t.heap, entry)
+		return
+	}
+
+	// Replace the least frequent value
+	entry := t.heap[0]
+	delete(t.entries, entry.Value)
+	entry.Value = value
+	entry.Error = entry.Count
+	entry.Count++
+	t.entries[value] = entry
+	heap.Fix(&t.heap, 0)
+}
+
+// top returns up to n of the most frequent values, most frequent first.
+// n <= 0 returns the configured number.
+func (t *topKTracker) top(n int) []topKEntry {
+	t.mu.Lock()
+	if n <= 0 || n > t.k {
+		n = t.k
+	}
+	entries := make([]topKEntry, 0, len(t.heap))
+	for _, entry := range t.heap {
+		entries = append(entries, *entry)
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(entries, func(a, b topKEntry) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Value, b.Value)
+	})
+	return entries[:min(n, len(entries))]
+}
+
+// memory estimates the memory held by the tracker's counters
+func (t *topKTracker) memory() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	size := int64(len(t.heap)) * (int64(unsafe.Sizeof(topKEntry{})) + mapEntryBytes + 8)
+	for _, entry := range t.heap {
+		size += int64(len(entry.Value))
+	}
+	return size
+}
+
+// topKCollector exports the heavy hitters of a tracker as a gauge,
+// computed at scrape time
+type topKCollector struct {
+	desc    *prometheus.Desc
+	tracker *topKTracker
+}
+
+// newTopKCollector returns a collector of the top_<dimension> gauge, with
+// the values in label
+func newTopKCollector(ns, dimension, label, help string, tracker *topKTracker) topKCollector {
+	return topKCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(ns, "usage", "top_"+dimension),
+			help,
+			[]string{label}, nil,
+		),
+		tracker: tracker,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c topKCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector
+func (c topKCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, entry := range c.tracker.top(0) {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(entry.Count), entry.Value)
+	}
+}
+
+// topKTrackers returns the heavy hitter trackers of the metrics, by dimension
+func (um *usageMetrics) topKTrackers() map[string]*topKTracker {
+	return map[string]*topKTracker{
+		topPaths:      um.topPaths,
+		topClients:    um.topClients,
+		topUserAgents: um.topUserAgents,
+	}
+}
+
+// errorHotspots returns the n host and path pairs, as host+path, with the
+// most requests answered with a 5xx status, defaultTopK when n is 0
+func (um *usageMetrics) errorHotspots(n int) []topKEntry {
+	if n <= 0 {
+		n = defaultTopK
+	}
+
+	counts := make(map[string]uint64)
+	for _, series := range counterSeries(um.requestsTotal) {
+		if strings.HasPrefix(series.labels["status_code"], "5") {
+			counts[series.labels["host"]+series.labels["path"]] += uint64(series.value)
+		}
+	}
+
+	entries := make([]topKEntry, 0, len(counts))
+	for value, count := range counts {
+		entries = append(entries, topKEntry{Value: value, Count: count})
+	}
+	slices.SortFunc(entries, func(a, b topKEntry) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Value, b.Value)
+	})
+	return entries[:min(n, len(entries))]
+}
+
+// setTopK changes the number of heavy hitters reported per dimension
+func (um *usageMetrics) setTopK(k int) {
+	for _, tracker := range um.topKTrackers() {
+		tracker.setK(k)
+	}
+}
+
+// collectTopKMetrics feeds the heavy hitter trackers. Paths and User-Agents
+// are the label values recorded by the other metrics, so the label policy
+// applies; clients are tracked by their IP as received, like unique
+// clients, so that a policy folding IPs together doesn't merge them.
+func (uc *UsageCollector) collectTopKMetrics(um *usageMetrics, r *http.Request, path, rawIP string) {
+	um.topPaths.add(path)
+	um.topClients.add(rawIP)
+	if ua := r.Header.Get("User-Agent"); ua != "" {
+		um.topUserAgents.add(uc.policy.apply(um, "header_value", ua))
+	}
+}
@@ -0,0 +1,168 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestTopKTracker tests that heavy hitters are found among a long tail
+// of values exceeding the tracker's counters
+func TestTopKTracker(t *testing.T) {
+	tracker := newTopKTracker(3)
+
+	for i := range 10000 {
+		switch {
+		case i%10 < 4:
+			tracker.add("/hot")
+		case i%10 < 6:
+			tracker.add("/warm")
+		case i%10 < 7:
+			tracker.add("/mild")
+		default:
+			tracker.add(fmt.Sprintf("/tail/%d", i))
+		}
+	}
+
+	top := tracker.top(0)
+	if len(top) != 3 {
+		t.Fatalf("Expected 3 values, got %d", len(top))
+	}
+	for i, expected := range []string{"/hot", "/warm", "/mild"} {
+		if top[i].Value != expected {
+			t.Errorf("Expected %s at rank %d, got %s", expected, i+1, top[i].Value)
+		}
+	}
+	if top[0].Count < 4000 || top[0].Count-top[0].Error > 4000 {
+		t.Errorf("Expected bounds of /hot to enclose 4000, got [%d, %d]", top[0].Count-top[0].Error, top[0].Count)
+	}
+	if n := len(tracker.entries); n != 3*topKOverprovision {
+		t.Errorf("Expected memory bounded to %d counters, got %d", 3*topKOverprovision, n)
+	}
+
+	if got := tracker.top(1); len(got) != 1 || got[0].Value != "/hot" {
+		t.Errorf("Expected only /hot, got %+v", got)
+	}
+
+	// Resizing discards counts, keeping the same size doesn't
+	tracker.setK(3)
+	if len(tracker.top(0)) == 0 {
+		t.Error("Expected counts to be kept when the size doesn't change")
+	}
+	tracker.setK(5)
+	if len(tracker.top(0)) != 0 {
+		t.Error("Expected counts to be discarded when resizing")
+	}
+}
+
+// TestTopKMetrics tests the top_* gauges and the admin endpoint
+func TestTopKMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.TopK = 2
+	globalUsageMetrics.setTopK(2)
+
+	// Clients are tracked by their IP as received, even when the label
+	// policy folds it away
+	policy, err := compileLabelPolicy([]LabelRule{{Action: policyDeny, Label: "client_ip", Match: `^10\.`}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	uc.policy = policy
+
+	for _, path := range []string{"/a", "/a", "/a", "/b", "/b", "/c"} {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("User-Agent", "curl/8.5.0")
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(200)
+		uc.collectMetrics(rec, req, now(), nil)
+	}
+
+	usagetest.AssertValue(t, registry, "top_paths", usagetest.Labels{"path": "/a"}, 3)
+	usagetest.AssertCount(t, registry, "top_paths", nil, 2)
+	usagetest.AssertValue(t, registry, "top_clients", usagetest.Labels{"client_ip": "10.0.0.1"}, 6)
+	usagetest.AssertAbsent(t, registry, "top_clients", usagetest.Labels{"client_ip": deniedLabelValue})
+	usagetest.AssertValue(t, registry, "top_user_agents", usagetest.Labels{"user_agent": "curl/8.5.0"}, 6)
+
+	w, err := serveAdmin(t, "/usage/top", httptest.NewRequest("GET", "/usage/top?dimension=paths&n=1", nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var top map[string][]topKEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &top); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if paths := top[topPaths]; len(top) != 1 || len(paths) != 1 || paths[0].Value != "/a" || paths[0].Count != 3 {
+		t.Errorf("Expected only /a with 3 requests, got %+v", top)
+	}
+
+	// Server errors are listed by host and path without top_k
+	for _, path := range []string{"/a", "/c", "/c"} {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(502)
+		uc.collectMetrics(rec, req, now(), nil)
+	}
+	w, err = serveAdmin(t, "/usage/top", httptest.NewRequest("GET", "/usage/top?dimension=errors", nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	top = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &top); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	expectedErrors := []topKEntry{{Value: "example.com/c", Count: 2}, {Value: "example.com/a", Count: 1}}
+	if errors := top[topErrors]; len(top) != 1 || !reflect.DeepEqual(errors, expectedErrors) {
+		t.Errorf("Expected error hotspots %+v, got %+v", expectedErrors, top)
+	}
+
+	for _, target := range []string{"/usage/top?dimension=hosts", "/usage/top?n=zero"} {
+		_, err := serveAdmin(t, "/usage/top", httptest.NewRequest("GET", target, nil))
+		if got := apiErrorStatus(err); got != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", target, got)
+		}
+	}
+}
+
+// TestUnmarshalTopK tests parsing of the top_k option
+func TestUnmarshalTopK(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  int
+		expectErr bool
+	}{
+		{input: "usage {\n top_k\n}", expected: defaultTopK},
+		{input: "usage {\n top_k 25\n}", expected: 25},
+		{input: "usage {\n top_k 0\n}", expectErr: true},
+		{input: "usage {\n top_k many\n}", expectErr: true},
+		{input: "usage {\n top_k 5 10\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if uc.TopK != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, uc.TopK)
+			}
+		})
+	}
+}
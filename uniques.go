@@ -0,0 +1,82 @@
+package caddyusage
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// uniqueClientWindows are the windows over which unique clients are
+// counted, by window label
+var uniqueClientWindows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+}
+
+// UniqueClientsConfig configures unique client estimation.
+type UniqueClientsConfig struct {
+	// Header identifies clients by the value of a request header, such as
+	// a user or session ID set by an authentication layer, instead of by
+	// IP address. Requests without the header are identified by IP.
+	Header string `json:"header,omitempty"`
+}
+
+// newUniqueClientSketches returns a sketch per unique client window
+func newUniqueClientSketches() map[string]*windowedSketch {
+	sketches := make(map[string]*windowedSketch, len(uniqueClientWindows))
+	for label, window := range uniqueClientWindows {
+		sketches[label] = newWindowedSketch(window)
+	}
+	return sketches
+}
+
+// newUniqueClientCollectors returns the unique_clients gauges, one per
+// window, estimated at scrape time
+func newUniqueClientCollectors(ns string, sketches map[string]*windowedSketch) []prometheus.Collector {
+	collectors := make([]prometheus.Collector, 0, len(sketches))
+	for label, sketch := range sketches {
+		collectors = append(collectors, prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace:   ns,
+				Subsystem:   "usage",
+				Name:        "unique_clients",
+				Help:        "Approximate number of distinct clients seen within the window",
+				ConstLabels: prometheus.Labels{"window": label},
+			},
+			func() float64 { return sketch.estimate(now()) },
+		))
+	}
+	return collectors
+}
+
+// collectUniqueClientMetrics counts the client of a request towards the
+// unique client estimates. ip is the client's address before the label
+// policy, so that policies coarsening addresses don't merge clients.
+func (uc *UsageCollector) collectUniqueClientMetrics(um *usageMetrics, r *http.Request, ip string, seen time.Time) {
+	identity := "ip:" + ip
+	if uc.UniqueClients.Header != "" {
+		if v := r.Header.Get(uc.UniqueClients.Header); v != "" {
+			identity = "header:" + v
+		}
+	}
+
+	for _, sketch := range um.uniqueClients {
+		sketch.add(identity, seen)
+	}
+}
+
+// unmarshalUniqueClients parses a unique_clients directive:
+//
+//	unique_clients [<header>]
+func unmarshalUniqueClients(d *caddyfile.Dispenser) (*UniqueClientsConfig, error) {
+	cfg := new(UniqueClientsConfig)
+	if d.NextArg() {
+		cfg.Header = d.Val()
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	return cfg, nil
+}
@@ -0,0 +1,97 @@
+package caddyusage
+
+import (
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// assertUniqueClients checks the unique client estimate of a window,
+// allowing for the sketches' error
+func assertUniqueClients(t *testing.T, g prometheus.Gatherer, window string, expected float64) {
+	t.Helper()
+
+	got := usagetest.Value(t, g, "unique_clients", usagetest.Labels{"window": window})
+	if math.Abs(got-expected) > 1 {
+		t.Errorf("Expected about %v unique clients in %s, got %v", expected, window, got)
+	}
+}
+
+// TestUniqueClients tests distinct client estimates per window, by IP or
+// identity header
+func TestUniqueClients(t *testing.T) {
+	clock := newFakeClock()
+	defer SetClock(clock)()
+
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	uc.UniqueClients = &UniqueClientsConfig{Header: "X-User-ID"}
+
+	serve := func(ip, user string) {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = ip + ":1234"
+		if user != "" {
+			req.Header.Set("X-User-ID", user)
+		}
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(200)
+		uc.collectMetrics(rec, req, now(), nil)
+	}
+
+	// Users behind one address are told apart, anonymous clients by address
+	for i := range 20 {
+		serve("10.0.0.1", fmt.Sprintf("user-%d", i))
+	}
+	serve("10.0.0.2", "")
+	serve("10.0.0.2", "")
+	serve("10.0.0.3", "")
+
+	assertUniqueClients(t, registry, "1h", 22)
+	assertUniqueClients(t, registry, "24h", 22)
+
+	// Clients age out of the shorter window first
+	clock.Advance(2 * time.Hour)
+	serve("10.0.0.4", "")
+	assertUniqueClients(t, registry, "1h", 1)
+	assertUniqueClients(t, registry, "24h", 23)
+}
+
+// TestUnmarshalUniqueClients tests parsing of the unique_clients option
+func TestUnmarshalUniqueClients(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  *UniqueClientsConfig
+		expectErr bool
+	}{
+		{input: "usage {\n unique_clients\n}", expected: &UniqueClientsConfig{}},
+		{input: "usage {\n unique_clients X-User-ID\n}", expected: &UniqueClientsConfig{Header: "X-User-ID"}},
+		{input: "usage {\n unique_clients X-User-ID X-Session\n}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var uc UsageCollector
+			err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(uc.UniqueClients, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, uc.UniqueClients)
+			}
+		})
+	}
+}
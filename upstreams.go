@@ -0,0 +1,61 @@
+package caddyusage
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Placeholders set by reverse_proxy about the upstream it proxied a request
+// to, the last one tried when it retried
+const (
+	upstreamHostPortPlaceholder = "http.reverse_proxy.upstream.hostport"
+	upstreamStatusPlaceholder   = "http.reverse_proxy.status_code"
+	upstreamLatencyPlaceholder  = "http.reverse_proxy.upstream.latency"
+	upstreamDurationPlaceholder = "http.reverse_proxy.upstream.duration"
+)
+
+// upstreamStatus returns the status of the upstream's response, falling
+// back to the status Caddy answered with when the upstream didn't respond
+func upstreamStatus(repl *caddy.Replacer, status int, err error) int {
+	if code, ok := repl.Get(upstreamStatusPlaceholder); ok {
+		if code, ok := code.(int); ok && code > 0 {
+			return code
+		}
+	}
+	if err != nil {
+		return errorStatus(err)
+	}
+	return status
+}
+
+// collectUpstreamMetrics attributes requests proxied by reverse_proxy to
+// their upstream, with the upstream's latency to response headers and the
+// duration of the whole exchange. status is the response status and err
+// the error returned by the handler chain, if any.
+func (uc *UsageCollector) collectUpstreamMetrics(um *usageMetrics, r *http.Request, status int, err error) {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	hostport, ok := repl.GetString(upstreamHostPortPlaceholder)
+	if !ok || hostport == "" {
+		return
+	}
+
+	upstream := uc.policy.apply(um, "upstream", hostport)
+	statusCode := uc.policy.apply(um, "status_code", statusCodeString(upstreamStatus(repl, status, err)))
+	um.upstreamRequests.WithLabelValues(upstream, statusCode).Inc()
+
+	if latency, ok := repl.Get(upstreamLatencyPlaceholder); ok {
+		if latency, ok := latency.(time.Duration); ok {
+			um.upstreamLatency.WithLabelValues(upstream).Observe(latency.Seconds())
+		}
+	}
+	if duration, ok := repl.Get(upstreamDurationPlaceholder); ok {
+		if duration, ok := duration.(time.Duration); ok {
+			um.upstreamDuration.WithLabelValues(upstream).Observe(duration.Seconds())
+		}
+	}
+}
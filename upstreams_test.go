@@ -0,0 +1,68 @@
+package caddyusage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestUpstreamMetrics tests attributing proxied requests to their upstream
+// from the placeholders reverse_proxy sets
+func TestUpstreamMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	// serve passes a request to a handler standing in for reverse_proxy,
+	// which sets placeholders and answers with status or fails with err
+	serve := func(placeholders map[string]any, status int, err error) {
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+			for key, value := range placeholders {
+				repl.Set(key, value)
+			}
+			if err != nil {
+				return err
+			}
+			w.WriteHeader(status)
+			return nil
+		})
+		req := httptest.NewRequest("GET", "http://example.com/api", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		_ = uc.ServeHTTP(httptest.NewRecorder(), req, next)
+	}
+
+	proxied := func(hostport string, status int) map[string]any {
+		return map[string]any{
+			upstreamHostPortPlaceholder: hostport,
+			upstreamStatusPlaceholder:   status,
+			upstreamLatencyPlaceholder:  20 * time.Millisecond,
+			upstreamDurationPlaceholder: 50 * time.Millisecond,
+		}
+	}
+	serve(proxied("10.0.0.1:8080", 200), 200, nil)
+	serve(proxied("10.0.0.1:8080", 200), 200, nil)
+	serve(proxied("10.0.0.2:8080", 503), 503, nil)
+
+	// Caddy answers for upstreams that didn't respond
+	dialErr := caddyhttp.Error(http.StatusBadGateway, errors.New("dial tcp 10.0.0.3:8080: connection refused"))
+	serve(map[string]any{upstreamHostPortPlaceholder: "10.0.0.3:8080"}, 0, dialErr)
+
+	// Requests handled without reverse_proxy aren't attributed
+	serve(nil, 200, nil)
+
+	usagetest.AssertValue(t, registry, "upstream_requests_total", usagetest.Labels{"upstream": "10.0.0.1:8080", "status_code": "200"}, 2)
+	usagetest.AssertValue(t, registry, "upstream_requests_total", usagetest.Labels{"upstream": "10.0.0.2:8080", "status_code": "503"}, 1)
+	usagetest.AssertValue(t, registry, "upstream_requests_total", usagetest.Labels{"upstream": "10.0.0.3:8080", "status_code": "502"}, 1)
+	usagetest.AssertCount(t, registry, "upstream_requests_total", nil, 3)
+
+	usagetest.AssertValue(t, registry, "upstream_latency_seconds", usagetest.Labels{"upstream": "10.0.0.1:8080"}, 2)
+	usagetest.AssertValue(t, registry, "upstream_duration_seconds", usagetest.Labels{"upstream": "10.0.0.2:8080"}, 1)
+	usagetest.AssertAbsent(t, registry, "upstream_latency_seconds", usagetest.Labels{"upstream": "10.0.0.3:8080"})
+}
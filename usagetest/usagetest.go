@@ -0,0 +1,237 @@
+// Package usagetest provides assertions on the metrics recorded by the
+// usage handler, for tests of configurations and integrations embedding
+// the module. Metrics are read from a prometheus.Gatherer, such as the
+// registry Caddy was given, and addressed by name and labels.
+//
+// Metric names may be given in full, like caddy_usage_requests_total, or
+// without the caddy_usage_ prefix, like requests_total. Use Name for
+// metrics of a handler configured with a namespace. The assertions are
+// built on client_golang's testutil package.
+//
+// Gathering from the registry Caddy was given counts as a scrape: with
+// delta temporality enabled and no push exporter running, every assertion
+// resets the usage series.
+package usagetest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DefaultNamespace is the namespace of the shared usage metrics
+const DefaultNamespace = "caddy"
+
+// subsystem is the subsystem of every usage metric
+const subsystem = "usage"
+
+// Labels selects series by label values. A series matches when it has
+// every given label with the given value; other labels are ignored.
+type Labels map[string]string
+
+// Name returns the full name of a usage metric in a namespace, like
+// site_a_usage_requests_total for Name("site_a", "requests_total")
+func Name(namespace, metric string) string {
+	return namespace + "_" + subsystem + "_" + metric
+}
+
+// fullName resolves a metric name given with or without its prefix
+func fullName(name string) string {
+	if strings.Contains(name, "_"+subsystem+"_") {
+		return name
+	}
+	return Name(DefaultNamespace, name)
+}
+
+// Series returns the series of a metric matching labels. It fails the
+// test if the metrics can't be gathered.
+func Series(t testing.TB, g prometheus.Gatherer, name string, labels Labels) []*dto.Metric {
+	t.Helper()
+
+	families, err := selected(g, fullName(name), labels).Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+		return nil
+	}
+
+	var series []*dto.Metric
+	for _, family := range families {
+		series = append(series, family.GetMetric()...)
+	}
+	return series
+}
+
+// Value returns the sum of the values of the series of a metric matching
+// labels, or 0 when none match. Counters, gauges and untyped metrics sum
+// their values, as read by testutil.ToFloat64; histograms and summaries
+// sum their observation counts.
+func Value(t testing.TB, g prometheus.Gatherer, name string, labels Labels) float64 {
+	t.Helper()
+
+	var sum float64
+	for _, metric := range Series(t, g, name, labels) {
+		switch {
+		case metric.Histogram != nil:
+			sum += float64(metric.GetHistogram().GetSampleCount())
+		case metric.Summary != nil:
+			sum += float64(metric.GetSummary().GetSampleCount())
+		default:
+			sum += testutil.ToFloat64(gatheredSeries{name: fullName(name), metric: metric})
+		}
+	}
+	return sum
+}
+
+// AssertValue fails the test unless the series of a metric matching
+// labels sum to want
+func AssertValue(t testing.TB, g prometheus.Gatherer, name string, labels Labels, want float64) {
+	t.Helper()
+
+	if got := Value(t, g, name, labels); got != want {
+		t.Errorf("%s%s = %v, want %v", fullName(name), labels, got, want)
+	}
+}
+
+// AssertCount fails the test unless a metric has want series matching
+// labels, as counted by testutil.GatherAndCount
+func AssertCount(t testing.TB, g prometheus.Gatherer, name string, labels Labels, want int) {
+	t.Helper()
+
+	if got := count(t, g, name, labels); got != want {
+		t.Errorf("%s%s has %d series, want %d", fullName(name), labels, got, want)
+	}
+}
+
+// AssertAbsent fails the test if a metric has any series matching labels
+func AssertAbsent(t testing.TB, g prometheus.Gatherer, name string, labels Labels) {
+	t.Helper()
+
+	if got := count(t, g, name, labels); got > 0 {
+		t.Errorf("%s%s has %d series, want none", fullName(name), labels, got)
+	}
+}
+
+// AssertGathered fails the test unless the named metrics, as gathered,
+// match expected in the text exposition format, as compared by
+// testutil.GatherAndCompare. Whole metric families are compared, so
+// expected lists every series of each, with its HELP and TYPE lines.
+func AssertGathered(t testing.TB, g prometheus.Gatherer, expected string, names ...string) {
+	t.Helper()
+
+	full := make([]string, len(names))
+	for i, name := range names {
+		full[i] = fullName(name)
+	}
+	if err := testutil.GatherAndCompare(g, strings.NewReader(expected), full...); err != nil {
+		t.Errorf("comparing gathered metrics: %v", err)
+	}
+}
+
+// count returns the number of series of a metric matching labels
+func count(t testing.TB, g prometheus.Gatherer, name string, labels Labels) int {
+	t.Helper()
+
+	n, err := testutil.GatherAndCount(selected(g, fullName(name), labels))
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	return n
+}
+
+// selected returns a gatherer of the series of a metric matching labels,
+// as gathered by g
+func selected(g prometheus.Gatherer, name string, labels Labels) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, family := range families {
+			if family.GetName() != name {
+				continue
+			}
+			var series []*dto.Metric
+			for _, metric := range family.GetMetric() {
+				if matches(metric, labels) {
+					series = append(series, metric)
+				}
+			}
+			if len(series) == 0 {
+				return nil, nil
+			}
+			return []*dto.MetricFamily{{Name: family.Name, Help: family.Help, Type: family.Type, Metric: series}}, nil
+		}
+		return nil, nil
+	})
+}
+
+// gatheredSeries is a gathered series of a metric, collected again so
+// that testutil can read it
+type gatheredSeries struct {
+	name   string
+	metric *dto.Metric
+}
+
+// Describe implements prometheus.Collector, leaving the series unchecked
+func (s gatheredSeries) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector
+func (s gatheredSeries) Collect(ch chan<- prometheus.Metric) {
+	ch <- s
+}
+
+// Desc implements prometheus.Metric
+func (s gatheredSeries) Desc() *prometheus.Desc {
+	return prometheus.NewDesc(s.name, "", nil, nil)
+}
+
+// Write implements prometheus.Metric
+func (s gatheredSeries) Write(out *dto.Metric) error {
+	out.Label = s.metric.Label
+	out.Counter = s.metric.Counter
+	out.Gauge = s.metric.Gauge
+	out.Untyped = s.metric.Untyped
+	return nil
+}
+
+// String formats labels like a Prometheus series selector
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, l[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// matches reports whether a series has every label in labels
+func matches(metric *dto.Metric, labels Labels) bool {
+	for name, want := range labels {
+		found := false
+		for _, pair := range metric.GetLabel() {
+			if pair.GetName() == name {
+				found = pair.GetValue() == want
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
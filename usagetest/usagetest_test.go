@@ -0,0 +1,142 @@
+package usagetest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// recorder captures failures reported by the assertions
+type recorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...any) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Fatalf(format string, args ...any) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+// newTestRegistry returns a registry with a few series shaped like the
+// module's metrics
+func newTestRegistry(t *testing.T) *prometheus.Registry {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: DefaultNamespace,
+		Subsystem: subsystem,
+		Name:      "requests_total",
+	}, []string{"host", "status_code"})
+	durations := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "site_a",
+		Subsystem: subsystem,
+		Name:      "request_duration_seconds",
+	}, []string{"host"})
+	registry.MustRegister(requests, durations)
+
+	requests.WithLabelValues("example.com", "200").Add(3)
+	requests.WithLabelValues("example.com", "404").Inc()
+	requests.WithLabelValues("example.org", "200").Inc()
+	durations.WithLabelValues("example.com").Observe(0.1)
+	durations.WithLabelValues("example.com").Observe(0.2)
+	return registry
+}
+
+// TestValue tests summing the series matching labels
+func TestValue(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	tests := []struct {
+		name     string
+		metric   string
+		labels   Labels
+		expected float64
+	}{
+		{"all series", "requests_total", nil, 5},
+		{"full name", "caddy_usage_requests_total", Labels{"host": "example.com"}, 4},
+		{"every label", "requests_total", Labels{"host": "example.com", "status_code": "404"}, 1},
+		{"no match", "requests_total", Labels{"host": "example.net"}, 0},
+		{"unknown label", "requests_total", Labels{"method": "GET"}, 0},
+		{"histogram counts observations", Name("site_a", "request_duration_seconds"), nil, 2},
+		{"missing metric", "errors_total", nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Value(t, registry, tt.metric, tt.labels); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// gatheredRequests is the text exposition of the requests_total series
+// of the test registry
+const gatheredRequests = `
+# TYPE caddy_usage_requests_total counter
+caddy_usage_requests_total{host="example.com",status_code="200"} 3
+caddy_usage_requests_total{host="example.com",status_code="404"} 1
+caddy_usage_requests_total{host="example.org",status_code="200"} 1
+`
+
+// TestAssertions tests that assertions pass and fail as expected
+func TestAssertions(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	tests := []struct {
+		name   string
+		assert func(tb testing.TB)
+		fails  bool
+	}{
+		{"value", func(tb testing.TB) {
+			AssertValue(tb, registry, "requests_total", Labels{"status_code": "200"}, 4)
+		}, false},
+		{"wrong value", func(tb testing.TB) {
+			AssertValue(tb, registry, "requests_total", Labels{"status_code": "200"}, 3)
+		}, true},
+		{"count", func(tb testing.TB) {
+			AssertCount(tb, registry, "requests_total", Labels{"host": "example.com"}, 2)
+		}, false},
+		{"wrong count", func(tb testing.TB) {
+			AssertCount(tb, registry, "requests_total", nil, 2)
+		}, true},
+		{"absent", func(tb testing.TB) {
+			AssertAbsent(tb, registry, "requests_total", Labels{"host": "example.net"})
+		}, false},
+		{"present", func(tb testing.TB) {
+			AssertAbsent(tb, registry, "requests_total", Labels{"host": "example.org"})
+		}, true},
+		{"gathered", func(tb testing.TB) {
+			AssertGathered(tb, registry, gatheredRequests, "requests_total")
+		}, false},
+		{"gathered differently", func(tb testing.TB) {
+			AssertGathered(tb, registry, strings.Replace(gatheredRequests, "} 3", "} 2", 1), "requests_total")
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recorder{TB: t}
+			tt.assert(rec)
+			if failed := len(rec.failures) > 0; failed != tt.fails {
+				t.Errorf("Expected failure=%v, got %v: %v", tt.fails, failed, rec.failures)
+			}
+		})
+	}
+}
+
+// TestLabelsString tests formatting of labels in failure messages
+func TestLabelsString(t *testing.T) {
+	got := Labels{"status_code": "200", "host": "example.com"}.String()
+	if expected := `{host="example.com",status_code="200"}`; got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}
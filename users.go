@@ -0,0 +1,40 @@
+package caddyusage
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// userPlaceholder holds the ID of the user authenticated by caddyauth
+const userPlaceholder = "{http.auth.user.id}"
+
+// UsersConfig records requests by the user authenticated by the
+// authentication handler, such as basic_auth.
+type UsersConfig struct {
+	// Hash records a hash of user IDs instead of the IDs themselves, like
+	// the hash action of label_policy.
+	Hash bool `json:"hash,omitempty"`
+}
+
+// collectUserMetrics counts a request by its authenticated user. Requests
+// without one aren't counted.
+func (uc *UsageCollector) collectUserMetrics(um *usageMetrics, r *http.Request, statusCode, method string) {
+	if uc.Users == nil {
+		return
+	}
+
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	user := repl.ReplaceAll(userPlaceholder, "")
+	if user == "" {
+		return
+	}
+	if uc.Users.Hash {
+		user = hashValue(user)
+	}
+
+	um.requestsByUser.WithLabelValues(uc.policy.apply(um, "user", user), statusCode, method).Inc()
+}
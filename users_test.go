@@ -0,0 +1,71 @@
+package caddyusage
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chalabi2/caddy-usage/usagetest"
+)
+
+// TestUserMetrics tests that requests are counted by authenticated user
+// only when enabled, with user IDs optionally hashed
+func TestUserMetrics(t *testing.T) {
+	uc, registry, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	collect := func(user string) {
+		repl := caddy.NewReplacer()
+		if user != "" {
+			repl.Set("http.auth.user.id", user)
+		}
+		req := httptest.NewRequest("GET", "http://example.com/account", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+		rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), nil, nil)
+		rec.WriteHeader(200)
+		uc.collectMetrics(rec, req, now(), nil)
+	}
+
+	// Disabled by default
+	collect("alice")
+	usagetest.AssertAbsent(t, registry, "requests_by_user_total", nil)
+
+	uc.Users = &UsersConfig{}
+	collect("alice")
+	collect("alice")
+	collect("")
+	usagetest.AssertValue(t, registry, "requests_by_user_total", usagetest.Labels{"user": "alice", "status_code": "200", "method": "GET"}, 2)
+	usagetest.AssertCount(t, registry, "requests_by_user_total", nil, 1)
+
+	uc.Users.Hash = true
+	collect("bob")
+	usagetest.AssertAbsent(t, registry, "requests_by_user_total", usagetest.Labels{"user": "bob"})
+	usagetest.AssertValue(t, registry, "requests_by_user_total", usagetest.Labels{"user": hashValue("bob")}, 1)
+}
+
+// TestUnmarshalUsers tests parsing of the users option
+func TestUnmarshalUsers(t *testing.T) {
+	tests := map[string]*UsersConfig{
+		"usage {\n users\n}":      {},
+		"usage {\n users hash\n}": {Hash: true},
+	}
+	for input, expected := range tests {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if uc.Users == nil || *uc.Users != *expected {
+			t.Errorf("%q: expected %+v, got %+v", input, expected, uc.Users)
+		}
+	}
+
+	for _, invalid := range []string{"usage {\n users salted\n}", "usage {\n users hash hash\n}"} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package caddyusage
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// maxWarmUpSeries bounds the number of series a warm-up may pre-create
+const maxWarmUpSeries = 10000
+
+// WarmUpConfig declares label values known in advance. Every combination
+// gets zero-valued requests_total and request_duration_seconds series at
+// startup, so they exist from the first scrape: alert rules don't need
+// absent(), and rate() is defined from the first request on.
+type WarmUpConfig struct {
+	// Hosts are the hosts to pre-create series for.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Paths are the paths to pre-create series for. Defaults to /.
+	Paths []string `json:"paths,omitempty"`
+
+	// Methods are the HTTP methods to pre-create series for.
+	// Defaults to GET.
+	Methods []string `json:"methods,omitempty"`
+
+	// StatusCodes are the response status codes to pre-create series
+	// for. Defaults to 200.
+	StatusCodes []int `json:"status_codes,omitempty"`
+}
+
+// withDefaults returns the label values to warm up, with defaults applied
+func (wc *WarmUpConfig) withDefaults() (hosts, paths, methods, statusCodes []string) {
+	hosts, paths, methods = wc.Hosts, wc.Paths, wc.Methods
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet}
+	}
+	for _, code := range wc.StatusCodes {
+		statusCodes = append(statusCodes, strconv.Itoa(code))
+	}
+	if len(statusCodes) == 0 {
+		statusCodes = []string{strconv.Itoa(http.StatusOK)}
+	}
+	return hosts, paths, methods, statusCodes
+}
+
+// validate checks that the warm-up stays within reasonable bounds
+func (wc *WarmUpConfig) validate() error {
+	if len(wc.Hosts) == 0 {
+		return fmt.Errorf("warm_up requires at least one host")
+	}
+	for _, code := range wc.StatusCodes {
+		if code < 100 || code > 999 {
+			return fmt.Errorf("warm_up status code %d is out of range", code)
+		}
+	}
+
+	hosts, paths, methods, statusCodes := wc.withDefaults()
+	if n := len(hosts) * len(paths) * len(methods) * len(statusCodes); n > maxWarmUpSeries {
+		return fmt.Errorf("warm_up would create %d series, more than the limit of %d", n, maxWarmUpSeries)
+	}
+	return nil
+}
+
+// warmUp pre-creates zero-valued series for the configured label values.
+// Values pass through host grouping and the label policy, so they match the
+// series recorded for real requests.
+func (uc *UsageCollector) warmUp(um *usageMetrics) {
+	hosts, paths, methods, statusCodes := uc.WarmUp.withDefaults()
+
+	for _, host := range hosts {
+		host = uc.hostLabel(nil, host)
+		for _, method := range methods {
+			method = uc.policy.apply(nil, "method", method)
+			for _, statusCode := range statusCodes {
+				statusCode = uc.policy.apply(nil, "status_code", statusCode)
+				um.requestDuration.WithLabelValues(method, statusCode, host)
+				for _, path := range paths {
+					path = uc.policy.apply(nil, "path", path)
+					um.requestsTotal.WithLabelValues(statusCode, method, host, path)
+				}
+			}
+		}
+	}
+}
+
+// unmarshalWarmUpConfig parses a warm_up block:
+//
+//	warm_up {
+//	    hosts <hosts...>
+//	    paths <paths...>
+//	    methods <methods...>
+//	    status_codes <codes...>
+//	}
+func unmarshalWarmUpConfig(d *caddyfile.Dispenser) (*WarmUpConfig, error) {
+	cfg := new(WarmUpConfig)
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return nil, d.ArgErr()
+		}
+
+		switch option {
+		case "hosts":
+			cfg.Hosts = append(cfg.Hosts, args...)
+		case "paths":
+			cfg.Paths = append(cfg.Paths, args...)
+		case "methods":
+			cfg.Methods = append(cfg.Methods, args...)
+		case "status_codes":
+			for _, arg := range args {
+				code, err := strconv.Atoi(arg)
+				if err != nil {
+					return nil, d.Errf("invalid status code '%s'", arg)
+				}
+				cfg.StatusCodes = append(cfg.StatusCodes, code)
+			}
+		default:
+			return nil, d.Errf("unrecognized warm_up option '%s'", option)
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,99 @@
+package caddyusage
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestWarmUp tests that known label sets get zero-valued series
+func TestWarmUp(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+
+	uc.WarmUp = &WarmUpConfig{
+		Hosts:       []string{"example.com", "api.example.com"},
+		Paths:       []string{"/", "/users/42"},
+		StatusCodes: []int{200, 500},
+	}
+	uc.policy = mustCompileLabelPolicy(idSegmentRules)
+	uc.warmUp(globalUsageMetrics)
+
+	// 2 hosts x 2 paths x GET x 2 status codes
+	if n := testutil.CollectAndCount(globalUsageMetrics.requestsTotal); n != 8 {
+		t.Errorf("Expected 8 requests_total series, got %d", n)
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.requestDuration); n != 4 {
+		t.Errorf("Expected 4 request_duration_seconds series, got %d", n)
+	}
+
+	// Series are zero-valued and match the label policy applied to real requests
+	if got := testutil.ToFloat64(globalUsageMetrics.requestsTotal.WithLabelValues("500", "GET", "api.example.com", "/users/:id")); got != 0 {
+		t.Errorf("Expected a zero-valued series, got %v", got)
+	}
+	if n := testutil.CollectAndCount(globalUsageMetrics.requestsTotal); n != 8 {
+		t.Errorf("Expected warmed-up series to use policy-normalized paths, got %d series", n)
+	}
+}
+
+// TestWarmUpValidation tests the bounds on warm-up configuration
+func TestWarmUpValidation(t *testing.T) {
+	tooManyHosts := make([]string, maxWarmUpSeries+1)
+	for i := range tooManyHosts {
+		tooManyHosts[i] = strings.Repeat("a", i%10+1) + ".example.com"
+	}
+
+	tests := []struct {
+		name  string
+		cfg   WarmUpConfig
+		valid bool
+	}{
+		{"hosts only", WarmUpConfig{Hosts: []string{"example.com"}}, true},
+		{"no hosts", WarmUpConfig{Paths: []string{"/"}}, false},
+		{"bad status", WarmUpConfig{Hosts: []string{"example.com"}, StatusCodes: []int{42}}, false},
+		{"too many series", WarmUpConfig{Hosts: tooManyHosts}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uc := &UsageCollector{WarmUp: &tt.cfg}
+			if err := uc.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Expected valid=%v, got error %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+// TestUnmarshalWarmUp tests parsing of the warm_up block
+func TestUnmarshalWarmUp(t *testing.T) {
+	var uc UsageCollector
+	input := "usage {\n warm_up {\n hosts example.com api.example.com\n paths / /health\n methods GET POST\n status_codes 200 503\n }\n}"
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := &WarmUpConfig{
+		Hosts:       []string{"example.com", "api.example.com"},
+		Paths:       []string{"/", "/health"},
+		Methods:     []string{"GET", "POST"},
+		StatusCodes: []int{200, 503},
+	}
+	if !reflect.DeepEqual(uc.WarmUp, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, uc.WarmUp)
+	}
+
+	for _, invalid := range []string{
+		"usage {\n warm_up extra\n}",
+		"usage {\n warm_up {\n hosts\n }\n}",
+		"usage {\n warm_up {\n status_codes ok\n }\n}",
+		"usage {\n warm_up {\n routes /\n }\n}",
+	} {
+		var uc UsageCollector
+		if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
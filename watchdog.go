@@ -0,0 +1,120 @@
+package caddyusage
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// inflightRequest is a request being served by a usage handler that has a
+// long_running threshold. Its fields are captured when the request starts,
+// since downstream handlers may rewrite the request while it is in flight.
+type inflightRequest struct {
+	method    string
+	host      string
+	path      string
+	client    string
+	start     time.Time
+	threshold time.Duration
+}
+
+// longRunningRequest describes an in-flight request that has exceeded its
+// threshold, as listed by the admin API
+type longRunningRequest struct {
+	Method         string    `json:"method"`
+	Host           string    `json:"host"`
+	Path           string    `json:"path"`
+	Client         string    `json:"client"`
+	Started        time.Time `json:"started"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+}
+
+// inflightRegistry tracks in-flight requests of all usage handlers, so that
+// long-running ones can be counted and listed before any timeout fires
+type inflightRegistry struct {
+	mu       sync.Mutex
+	requests map[*inflightRequest]struct{}
+}
+
+// inflight is shared by all handlers, like the usage metrics themselves
+var inflight = &inflightRegistry{requests: make(map[*inflightRequest]struct{})}
+
+// add starts tracking a request
+func (ir *inflightRegistry) add(req *inflightRequest) {
+	ir.mu.Lock()
+	ir.requests[req] = struct{}{}
+	ir.mu.Unlock()
+}
+
+// remove stops tracking a completed request
+func (ir *inflightRegistry) remove(req *inflightRequest) {
+	ir.mu.Lock()
+	delete(ir.requests, req)
+	ir.mu.Unlock()
+}
+
+// size returns the number of tracked in-flight requests
+func (ir *inflightRegistry) size() int {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	return len(ir.requests)
+}
+
+// countLongRunning returns the number of requests in flight for longer
+// than their threshold
+func (ir *inflightRegistry) countLongRunning(now time.Time) int {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+
+	count := 0
+	for req := range ir.requests {
+		if now.Sub(req.start) > req.threshold {
+			count++
+		}
+	}
+	return count
+}
+
+// longRunning lists the requests in flight for longer than their
+// threshold, longest-running first
+func (ir *inflightRegistry) longRunning(now time.Time) []longRunningRequest {
+	ir.mu.Lock()
+	list := make([]longRunningRequest, 0)
+	for req := range ir.requests {
+		elapsed := now.Sub(req.start)
+		if elapsed <= req.threshold {
+			continue
+		}
+		list = append(list, longRunningRequest{
+			Method:         req.method,
+			Host:           req.host,
+			Path:           req.path,
+			Client:         req.client,
+			Started:        req.start,
+			ElapsedSeconds: elapsed.Seconds(),
+		})
+	}
+	ir.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+// trackInflight registers a request with the watchdog. Values go through
+// the label policy, so that hashed or collapsed labels stay that way in the
+// admin API, but policy hits are not counted twice.
+func (uc *UsageCollector) trackInflight(r *http.Request, start time.Time) *inflightRequest {
+	req := &inflightRequest{
+		method:    uc.policy.apply(nil, "method", r.Method),
+		host:      uc.hostLabel(nil, r.Host),
+		path:      uc.policy.apply(nil, "path", r.URL.Path),
+		client:    uc.policy.apply(nil, "client_ip", getClientIP(r)),
+		start:     start,
+		threshold: time.Duration(uc.LongRunning),
+	}
+	inflight.add(req)
+	return req
+}
@@ -0,0 +1,108 @@
+package caddyusage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// TestInflightRegistry tests counting and listing of long-running requests
+func TestInflightRegistry(t *testing.T) {
+	ir := &inflightRegistry{requests: make(map[*inflightRequest]struct{})}
+	now := time.Now()
+
+	fresh := &inflightRequest{path: "/fresh", start: now.Add(-time.Second), threshold: time.Minute}
+	slow := &inflightRequest{path: "/slow", start: now.Add(-2 * time.Minute), threshold: time.Minute}
+	stuck := &inflightRequest{path: "/stuck", start: now.Add(-time.Hour), threshold: time.Minute}
+	for _, req := range []*inflightRequest{fresh, slow, stuck} {
+		ir.add(req)
+	}
+
+	if got := ir.countLongRunning(now); got != 2 {
+		t.Errorf("Expected 2 long-running requests, got %d", got)
+	}
+
+	list := ir.longRunning(now)
+	if len(list) != 2 || list[0].Path != "/stuck" || list[1].Path != "/slow" {
+		t.Fatalf("Expected /stuck then /slow, got %+v", list)
+	}
+	if list[0].ElapsedSeconds != time.Hour.Seconds() {
+		t.Errorf("Expected an hour elapsed, got %vs", list[0].ElapsedSeconds)
+	}
+
+	ir.remove(stuck)
+	if got := ir.countLongRunning(now); got != 1 {
+		t.Errorf("Expected 1 long-running request after removal, got %d", got)
+	}
+}
+
+// TestLongRunningWatchdog tests that requests are listed by the admin API
+// while in flight and forgotten once they complete
+func TestLongRunningWatchdog(t *testing.T) {
+	uc, _, cleanup := setupTestMetrics(t)
+	defer cleanup()
+	uc.LongRunning = caddy.Duration(time.Nanosecond)
+
+	var listed []longRunningRequest
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		time.Sleep(time.Millisecond)
+
+		rec, err := serveAdmin(t, "/usage/long_running", httptest.NewRequest("GET", "/usage/long_running", nil))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil {
+			t.Fatalf("Invalid response: %v", err)
+		}
+		return nil
+	})
+
+	req := httptest.NewRequest("GET", "http://example.com/slow/report", nil)
+	req.RemoteAddr = "192.0.2.7:4242"
+	if err := uc.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	if len(listed) != 1 {
+		t.Fatalf("Expected 1 listed request, got %+v", listed)
+	}
+	if got := listed[0]; got.Method != "GET" || got.Path != "/slow/report" || got.Client != "192.0.2.7" || got.ElapsedSeconds <= 0 {
+		t.Errorf("Unexpected listing: %+v", got)
+	}
+
+	if got := inflight.countLongRunning(time.Now()); got != 0 {
+		t.Errorf("Expected completed request to be forgotten, got %d in flight", got)
+	}
+}
+
+// TestLongRunningAdminMethod tests that only GET is allowed
+func TestLongRunningAdminMethod(t *testing.T) {
+	_, err := serveAdmin(t, "/usage/long_running", httptest.NewRequest("POST", "/usage/long_running", nil))
+	if status := apiErrorStatus(err); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", status)
+	}
+}
+
+// TestUnmarshalLongRunning tests parsing of the long_running option
+func TestUnmarshalLongRunning(t *testing.T) {
+	var uc UsageCollector
+	if err := uc.UnmarshalCaddyfile(caddyfile.NewTestDispenser("usage {\n long_running 30s\n}")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if time.Duration(uc.LongRunning) != 30*time.Second {
+		t.Errorf("Expected 30s, got %s", time.Duration(uc.LongRunning))
+	}
+
+	for _, input := range []string{"usage {\n long_running soon\n}", "usage {\n long_running 30s 1m\n}"} {
+		var invalid UsageCollector
+		if err := invalid.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}